@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type storeOptions struct {
+	S3Endpoint     string
+	CredentialFile string
+	NFSVersion     int
+	NFSTimeout     time.Duration
+
+	SSHKey              string
+	SSHKnownHosts       string
+	SSHSkipHostKeyCheck bool
+	SFTPStreams         int
+
+	WebDAVUser     string
+	WebDAVPassword string
+	WebDAVToken    string
+}
+
+// openBackupStore returns the backupstore directory under backupRoot as a
+// filesystem, along with a printable location for it. backupRoot is a local
+// path or a Longhorn backup target URL.
+func openBackupStore(ctx context.Context, backupRoot string, opts storeOptions) (fs.FS, string, error) {
+	scheme, _, remote := strings.Cut(backupRoot, "://")
+	if !remote {
+		backupStorePath := filepath.Join(backupRoot, "backupstore")
+		return os.DirFS(backupStorePath), backupStorePath, nil
+	}
+
+	var store interface {
+		fs.FS
+		String() string
+	}
+	var err error
+	switch scheme {
+	case "s3":
+		store, err = newS3Store(ctx, backupRoot, opts)
+	case "gs":
+		store, err = newGCSStore(ctx, backupRoot)
+	case "sftp":
+		store, err = newSFTPStore(ctx, backupRoot, opts)
+	case "webdav", "webdavs":
+		store, err = newWebDAVStore(ctx, backupRoot, opts)
+	case "nfs":
+		if opts.NFSVersion != nfsVersion3 {
+			return openNFSMount(backupRoot, opts.NFSVersion)
+		}
+		store, err = newNFSStore(ctx, backupRoot, opts)
+	case "cifs", "azblob":
+		return nil, "", fmt.Errorf("%s:// backup targets can't be read directly, mount the target and pass the local path instead", scheme)
+	default:
+		return nil, "", fmt.Errorf("unsupported backup target scheme %s://, expected s3, gs, nfs, sftp, webdav or webdavs, or a local path", scheme)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return store, store.String(), nil
+}
+
+func displayPath(root string, name string) string {
+	if strings.Contains(root, "://") {
+		return strings.TrimSuffix(root, "/") + "/" + name
+	}
+	return filepath.Join(root, filepath.FromSlash(name))
+}
+
+// retryCounter counts the retries of a remote store, which it reports to
+// the restore summary as a backupstore.RetryingFS
+type retryCounter struct {
+	retries atomic.Int64
+}
+
+func (c *retryCounter) Retries() int64 { return c.retries.Load() }
+
+// retryBackoff runs op up to attempts times, doubling the wait between
+// attempts, for as long as it fails with errors transient accepts
+func (c *retryCounter) retryBackoff(ctx context.Context, attempts int, backoff time.Duration, op func() error, transient func(error) bool) error {
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			c.retries.Add(1)
+			select {
+			case <-time.After(backoff << (attempt - 1)):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		err = op()
+		if err == nil || !transient(err) {
+			return err
+		}
+	}
+	return err
+}
+
+type remoteFS interface {
+	Stat(name string) (fs.FileInfo, error)
+	ReadDir(name string) ([]fs.DirEntry, error)
+	ReadFile(name string) ([]byte, error)
+}
+
+// openRemote implements fs.FS.Open for stores that fetch whole objects
+func openRemote(store remoteFS, name string) (fs.File, error) {
+	info, err := store.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		entries, err := store.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+		return &remoteDir{info: info, entries: entries}, nil
+	}
+	data, err := store.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return &remoteFile{info: info, Reader: bytes.NewReader(data)}, nil
+}
+
+// remoteFileInfo describes a file or directory of a backupstore that is not
+// on the local filesystem
+type remoteFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i remoteFileInfo) Name() string       { return i.name }
+func (i remoteFileInfo) Size() int64        { return i.size }
+func (i remoteFileInfo) ModTime() time.Time { return i.modTime }
+func (i remoteFileInfo) IsDir() bool        { return i.dir }
+func (i remoteFileInfo) Sys() any           { return nil }
+
+func (i remoteFileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+type remoteFile struct {
+	*bytes.Reader
+	info fs.FileInfo
+}
+
+func (f *remoteFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *remoteFile) Close() error               { return nil }
+
+type remoteDir struct {
+	info    fs.FileInfo
+	entries []fs.DirEntry
+}
+
+func (d *remoteDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *remoteDir) Close() error               { return nil }
+
+func (d *remoteDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.Name(), Err: errors.New("is a directory")}
+}
+
+func (d *remoteDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
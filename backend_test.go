@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOpenBackupStoreScheme(t *testing.T) {
+	local := t.TempDir()
+	_, backupStorePath, err := openBackupStore(context.Background(), local, storeOptions{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expected := filepath.Join(local, "backupstore"); backupStorePath != expected {
+		t.Errorf("Expected %s, got %s", expected, backupStorePath)
+	}
+
+	tests := []struct {
+		backupRoot string
+		expected   string
+	}{
+		{"cifs://nas/longhorn", "cifs:// backup targets can't be read directly, mount the target"},
+		{"azblob://container@core.windows.net/", "azblob:// backup targets can't be read directly, mount the target"},
+		{"ftp://nas/longhorn", "unsupported backup target scheme ftp://"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.backupRoot, func(t *testing.T) {
+			_, _, err := openBackupStore(context.Background(), tt.backupRoot, storeOptions{})
+			if err == nil || !strings.Contains(err.Error(), tt.expected) {
+				t.Errorf("Expected error containing %q, got %v", tt.expected, err)
+			}
+		})
+	}
+}
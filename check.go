@@ -0,0 +1,300 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+)
+
+// Kinds of checkProblem
+const (
+	problemConfig   = "config"
+	problemMissing  = "missing"
+	problemCorrupt  = "corrupt"
+	problemOrphaned = "orphaned"
+)
+
+// checkProblem is something check found wrong with a volume: a cfg file
+// that can't be read, a block that is missing or corrupt, or a block file
+// no backup references
+type checkProblem struct {
+	Kind string `json:"kind"`
+	// Path is the cfg or block file, when there is one
+	Path     string `json:"path,omitempty"`
+	Checksum string `json:"checksum,omitempty"`
+	// Backups are the cfg files referencing a missing or corrupt block
+	Backups []string `json:"backups,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// checkCounts tallies what check found. CorruptBlocks is -1 unless the
+// blocks were decompressed, and OrphanedBlocks -1 when a cfg file could
+// not be read, as the blocks only it references would look orphaned.
+type checkCounts struct {
+	Backups           int `json:"backups"`
+	BlockFiles        int `json:"blockFiles"`
+	UnreadableConfigs int `json:"unreadableConfigs"`
+	MissingBlocks     int `json:"missingBlocks"`
+	CorruptBlocks     int `json:"corruptBlocks"`
+	OrphanedBlocks    int `json:"orphanedBlocks"`
+}
+
+// broken is true if a backup of the volume can't be restored as it is.
+// Orphaned blocks take space, but break nothing.
+func (c checkCounts) broken() bool {
+	return c.UnreadableConfigs > 0 || c.MissingBlocks > 0 || c.CorruptBlocks > 0
+}
+
+func (c *checkCounts) add(o checkCounts) {
+	c.Backups += o.Backups
+	c.BlockFiles += o.BlockFiles
+	c.UnreadableConfigs += o.UnreadableConfigs
+	c.MissingBlocks += o.MissingBlocks
+	c.CorruptBlocks += max(o.CorruptBlocks, 0)
+	c.OrphanedBlocks += max(o.OrphanedBlocks, 0)
+}
+
+// volumeCheck is what check found in one volume
+type volumeCheck struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	checkCounts
+	Problems []checkProblem `json:"problems"`
+}
+
+// storeCheck is what check found in the whole backupstore. The total
+// counts the orphaned blocks of the volumes they were counted in.
+type storeCheck struct {
+	Volumes []volumeCheck `json:"volumes"`
+	Total   checkCounts   `json:"total"`
+}
+
+func (r *storeCheck) exitCode() int {
+	switch {
+	case r.Total.MissingBlocks > 0 || r.Total.CorruptBlocks > 0:
+		return exitBlockError
+	case r.Total.UnreadableConfigs > 0:
+		return exitFailure
+	}
+	return 0
+}
+
+// checkStore checks every volume in the backupstore in order of name, see
+// checkVolume
+func checkStore(store fs.FS, deep bool, jobs int, progress io.Writer) (*storeCheck, error) {
+	volumes, err := backupstore.ListVolumes(store)
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(volumes, func(a, b string) int {
+		return cmp.Or(cmp.Compare(path.Base(a), path.Base(b)), cmp.Compare(a, b))
+	})
+	report := &storeCheck{Volumes: make([]volumeCheck, 0, len(volumes)), Total: checkCounts{CorruptBlocks: -1}}
+	if deep {
+		report.Total.CorruptBlocks = 0
+	}
+	for _, volume := range volumes {
+		fmt.Fprintf(progress, "Checking %s\n", volume)
+		checked, err := checkVolume(store, volume, deep, jobs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check %s: %w", volume, err)
+		}
+		report.Volumes = append(report.Volumes, checked)
+		report.Total.add(checked.checkCounts)
+	}
+	return report, nil
+}
+
+// checkVolume reads every cfg file of the volume in volumePath on its own,
+// so one that can't be read doesn't hide the others, and matches the
+// blocks they reference against the files in the blocks tree. With deep,
+// every referenced block is also decompressed, jobs at a time, and
+// checked against its checksum.
+func checkVolume(store fs.FS, volumePath string, deep bool, jobs int) (volumeCheck, error) {
+	checked := volumeCheck{Name: path.Base(volumePath), Path: volumePath, Problems: []checkProblem{}}
+	checked.CorruptBlocks = -1
+
+	if _, err := backupstore.ReadVolumeConfig(store, volumePath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		checked.UnreadableConfigs++
+		checked.Problems = append(checked.Problems, checkProblem{Kind: problemConfig, Path: path.Join(volumePath, "volume.cfg"), Error: err.Error()})
+	}
+
+	cfgPaths, err := backupstore.ListBackupConfigs(store, volumePath)
+	if err != nil {
+		return checked, err
+	}
+	// references maps each checksum to the backups referencing it, and
+	// sources to the first of them, whose compression and block size it
+	// is checked with
+	references := make(map[string][]string)
+	sources := make(map[string]backupstore.Backup)
+	badBackup := false
+	for _, cfgPath := range cfgPaths {
+		backup, err := backupstore.ReadBackup(store, cfgPath)
+		if err != nil {
+			badBackup = true
+			checked.UnreadableConfigs++
+			checked.Problems = append(checked.Problems, checkProblem{Kind: problemConfig, Path: cfgPath, Error: err.Error()})
+			continue
+		}
+		checked.Backups++
+		for _, block := range backup.Blocks {
+			if _, ok := sources[block.Checksum]; !ok {
+				sources[block.Checksum] = backup
+			}
+			if !slices.Contains(references[block.Checksum], cfgPath) {
+				references[block.Checksum] = append(references[block.Checksum], cfgPath)
+			}
+		}
+	}
+
+	blocks, err := backupstore.ListBlocks(store, volumePath)
+	if err != nil {
+		return checked, err
+	}
+	checked.BlockFiles = len(blocks)
+
+	var present []string
+	for _, checksum := range slices.Sorted(maps.Keys(references)) {
+		if _, ok := blocks[checksum]; !ok {
+			checked.MissingBlocks++
+			checked.Problems = append(checked.Problems, checkProblem{Kind: problemMissing, Checksum: checksum, Backups: references[checksum]})
+			continue
+		}
+		present = append(present, checksum)
+	}
+
+	if deep {
+		corrupt := verifyBlockFiles(store, blocks, present, sources, jobs)
+		checked.CorruptBlocks = len(corrupt)
+		for _, problem := range corrupt {
+			problem.Backups = references[problem.Checksum]
+			checked.Problems = append(checked.Problems, problem)
+		}
+	}
+
+	if badBackup {
+		checked.OrphanedBlocks = -1
+		return checked, nil
+	}
+	for _, checksum := range slices.Sorted(maps.Keys(blocks)) {
+		if _, ok := references[checksum]; !ok {
+			checked.OrphanedBlocks++
+			checked.Problems = append(checked.Problems, checkProblem{Kind: problemOrphaned, Path: blocks[checksum], Checksum: checksum})
+		}
+	}
+	return checked, nil
+}
+
+// verifyBlockFiles decompresses the file in blocks of each of checksums
+// as its backup in sources stores it, jobs at a time, returning those
+// that fail in the order of checksums
+func verifyBlockFiles(store fs.FS, blocks map[string]string, checksums []string, sources map[string]backupstore.Backup, jobs int) []checkProblem {
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		corrupt []checkProblem
+		sem     = make(chan struct{}, max(jobs, 1))
+		buffers = sync.Pool{New: func() any { return make([]byte, 256<<10) }}
+	)
+	for _, checksum := range checksums {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			buf := buffers.Get().([]byte)
+			defer buffers.Put(buf)
+			err := backupstore.VerifyBlockFile(store, blocks[checksum], checksum, sources[checksum].Compression, sources[checksum].BlockSize, buf)
+			if err == nil {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			corrupt = append(corrupt, checkProblem{Kind: problemCorrupt, Path: blocks[checksum], Checksum: checksum, Error: err.Error()})
+		}()
+	}
+	wg.Wait()
+	slices.SortFunc(corrupt, func(a, b checkProblem) int {
+		return cmp.Compare(a.Checksum, b.Checksum)
+	})
+	return corrupt
+}
+
+// printStoreCheck writes report as JSON, or as a table of the counts of
+// each volume followed by its problems
+func printStoreCheck(w io.Writer, report *storeCheck, format string) error {
+	if format == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+
+	count := func(n int) string {
+		if n < 0 {
+			return "-"
+		}
+		return fmt.Sprint(n)
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "VOLUME\tBACKUPS\tBLOCK FILES\tBAD CFG\tMISSING\tCORRUPT\tORPHANED")
+	row := func(name string, c checkCounts) {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%s\t%s\n", name, c.Backups, c.BlockFiles, c.UnreadableConfigs, c.MissingBlocks, count(c.CorruptBlocks), count(c.OrphanedBlocks))
+	}
+	for _, volume := range report.Volumes {
+		row(volume.Name, volume.checkCounts)
+	}
+	row("TOTAL", report.Total)
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	broken := 0
+	for _, volume := range report.Volumes {
+		if volume.broken() {
+			broken++
+		}
+		for _, problem := range volume.Problems {
+			fmt.Fprintf(w, "%s: %s\n", volume.Name, describeProblem(problem))
+		}
+		if volume.OrphanedBlocks < 0 {
+			fmt.Fprintf(w, "%s: orphaned blocks not counted, as a backup cfg could not be read\n", volume.Name)
+		}
+	}
+	if broken > 0 {
+		fmt.Fprintf(w, "Check failed, %d of %d volumes have backups that can't be restored\n", broken, len(report.Volumes))
+	} else {
+		fmt.Fprintf(w, "All %d volumes can be restored\n", len(report.Volumes))
+	}
+	if report.Total.OrphanedBlocks > 0 {
+		fmt.Fprintf(w, "%d block files are referenced by no backup\n", report.Total.OrphanedBlocks)
+	}
+	return nil
+}
+
+func describeProblem(problem checkProblem) string {
+	var backups []string
+	for _, backup := range problem.Backups {
+		backups = append(backups, backupNameFromConfig(backup))
+	}
+	switch problem.Kind {
+	case problemConfig:
+		return fmt.Sprintf("unreadable %s: %s", problem.Path, problem.Error)
+	case problemMissing:
+		return fmt.Sprintf("missing block %s, referenced by %s", problem.Checksum, strings.Join(backups, ", "))
+	case problemCorrupt:
+		return fmt.Sprintf("corrupt block %s, referenced by %s: %s", problem.Path, strings.Join(backups, ", "), problem.Error)
+	}
+	return fmt.Sprintf("orphaned block %s", problem.Path)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestBackupCfg writes the cfg file of a backup of the volume in
+// volumePath referencing checksums, one block each
+func writeTestBackupCfg(t *testing.T, volumePath, name string, checksums ...string) {
+	t.Helper()
+	var blocks []string
+	for i, checksum := range checksums {
+		blocks = append(blocks, fmt.Sprintf(`{"Offset": %d, "BlockChecksum": %q}`, i*4096, checksum))
+	}
+	cfg := fmt.Sprintf(`{"Name": %q, "VolumeName": %q, "SnapshotName": "snapshot-%s", "SnapshotCreatedAt": "2024-01-01T00:00:00Z", "CreatedTime": "2024-01-01T00:00:00Z", "Size": "%d", "Labels": {}, "IsIncremental": true, "CompressionMethod": "lz4", "BlockSize": "4096", "Blocks": [%s]}`,
+		name, filepath.Base(volumePath), name, len(checksums)*4096, strings.Join(blocks, ", "))
+	if err := os.MkdirAll(filepath.Join(volumePath, "backups"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(volumePath, "backups", "backup_"+name+".cfg"), []byte(cfg), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckStore(t *testing.T) {
+	root := t.TempDir()
+	good := filepath.Join(root, "volumes", "ab", "cd", "pvc-good")
+	a := writeTestBlock(t, good, testBlockData(1, 4096))
+	orphan := writeTestBlock(t, good, testBlockData(2, 4096))
+	writeTestBackupCfg(t, good, "backup-1", a)
+
+	bad := filepath.Join(root, "volumes", "ef", "01", "pvc-bad")
+	b := writeTestBlock(t, bad, testBlockData(3, 4096))
+	corrupt := writeTestBlock(t, bad, testBlockData(4, 4096))
+	// the block of 5 stored under the checksum of 4
+	if err := os.WriteFile(filepath.Join(bad, "blocks", corrupt[0:2], corrupt[2:4], corrupt+".blk"), compressTestLZ4(t, testBlockData(5, 4096)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	missing := strings.Repeat("d4", 64)
+	writeTestBackupCfg(t, bad, "backup-1", b, missing, corrupt)
+	writeTestBackupCfg(t, bad, "backup-2", b, missing)
+	if err := os.WriteFile(filepath.Join(bad, "backups", "backup_backup-3.cfg"), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	store := os.DirFS(root)
+
+	report, err := checkStore(store, false, 2, &bytes.Buffer{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(report.Volumes) != 2 || report.Volumes[0].Name != "pvc-bad" || report.Volumes[1].Name != "pvc-good" {
+		t.Fatalf("Expected pvc-bad and pvc-good, got %+v", report.Volumes)
+	}
+	expected := checkCounts{Backups: 3, BlockFiles: 4, UnreadableConfigs: 1, MissingBlocks: 1, CorruptBlocks: -1, OrphanedBlocks: 1}
+	if report.Total != expected {
+		t.Errorf("Expected totals %+v, got %+v", expected, report.Total)
+	}
+	if report.Volumes[0].OrphanedBlocks != -1 {
+		t.Errorf("Expected the orphans of a volume with an unreadable cfg not to be counted, got %d", report.Volumes[0].OrphanedBlocks)
+	}
+	if problems := report.Volumes[1].Problems; len(problems) != 1 || problems[0].Kind != problemOrphaned || problems[0].Checksum != orphan {
+		t.Errorf("Expected %s to be orphaned, got %+v", orphan, problems)
+	}
+	if code := report.exitCode(); code != exitBlockError {
+		t.Errorf("Expected exit status %d, got %d", exitBlockError, code)
+	}
+
+	report, err = checkStore(store, true, 2, &bytes.Buffer{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if report.Total.CorruptBlocks != 1 || report.Volumes[1].CorruptBlocks != 0 {
+		t.Errorf("Expected the 1 corrupt block in pvc-bad, got %+v", report.Total)
+	}
+
+	var out bytes.Buffer
+	if err := printStoreCheck(&out, report, "text"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, line := range []string{
+		"VOLUME    BACKUPS  BLOCK FILES  BAD CFG  MISSING  CORRUPT  ORPHANED\n",
+		"pvc-bad   2        2            1        1        1        -\n",
+		"TOTAL     3        4            1        1        1        1\n",
+		"pvc-bad: missing block " + missing + ", referenced by backup-1, backup-2\n",
+		"pvc-bad: orphaned blocks not counted, as a backup cfg could not be read\n",
+		"Check failed, 1 of 2 volumes have backups that can't be restored\n",
+		"1 block files are referenced by no backup\n",
+	} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("Expected %q in the report, got %q", line, out.String())
+		}
+	}
+
+	out.Reset()
+	if err := printStoreCheck(&out, report, "json"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var decoded storeCheck
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if decoded.Total != report.Total || len(decoded.Volumes[0].Problems) != 3 {
+		t.Errorf("Expected the report to round trip through JSON, got %+v", decoded)
+	}
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+)
+
+// cliOptions holds every flag; each command registers the ones it accepts
+type cliOptions struct {
+	configFile          *string
+	versionFlag         *bool
+	listVolumes         *bool
+	fullPath            *bool
+	listBackups         *bool
+	listFormat          *string
+	backupRoot          *string
+	s3Endpoint          *string
+	credentialFile      *string
+	nfsVersion          *int
+	nfsTimeout          *time.Duration
+	sshKey              *string
+	sshKnownHosts       *string
+	sshSkipHostKeyCheck *bool
+	sftpStreams         *int
+	webdavUser          *string
+	webdavPassword      *string
+	webdavToken         *string
+	target              *string
+	outfile             *string
+	inspect             *bool
+	latest              *bool
+	backupName          *string
+	jobs                *int
+	noSparse            *bool
+	outputFormat        *string
+	compressOutput      *string
+	before              *string
+	includeIncomplete   *bool
+	allowEmpty          *bool
+	noTruncate          *bool
+	padToSize           *string
+	luksPassphrase      *string
+	verify              *bool
+	dryRun              *bool
+	failFast            *bool
+	all                 *bool
+	multi               *bool
+	concurrency         *int
+	estimate            *bool
+	resume              *bool
+	luksKeyFile         *string
+	progressFormat      *string
+	quiet               *bool
+	verbose             *bool
+	image               *string
+	cacheSize           *string
+	bandwidthLimit      *string
+	writeLimit          *string
+	metricsListen       *string
+	noPreallocate       *bool
+	legacyPasses        *bool
+	writeBatch          *string
+	fsyncInterval       *string
+	directIO            *bool
+	strict              *bool
+	maxMemory           *string
+	onChecksumMismatch  *string
+	onMissingBlock      *string
+	fast                *bool
+	deep                *bool
+	confirm             *bool
+	pruneLog            *string
+	logFile             *string
+	logFormat           *string
+	logLevel            *string
+	mount               *string
+	mountRW             *bool
+	yes                 *bool
+	noClobber           *bool
+	dest                *string
+	destRoot            *string
+	path                *string
+	preserveOwner       *bool
+	listen              *string
+	apiToken            *string
+	from                *string
+	to                  *string
+	content             *bool
+}
+
+func defineFlags(flags *flag.FlagSet) *cliOptions {
+	o := &cliOptions{}
+	o.configFile = flags.String("config", "", "YAML or JSON file of flag values, overridden by "+envPrefix+"* environment variables and the command line")
+	o.versionFlag = flags.Bool("version", false, "Print version")
+	o.listVolumes = flags.Bool("list-volumes", false, "List volumes")
+	o.fullPath = flags.Bool("full-path", false, "List volumes by their full path in the backupstore instead of by name")
+	o.listBackups = flags.Bool("list-backups", false, "List the backups of -target, newest first, without reading any blocks")
+	o.listFormat = flags.String("output", "text", "Format of list-volumes, list-backups, describe, diff, verify-backup, check and ls (text, json), or names for only the names of volumes or backups")
+	o.backupRoot = flags.String("backup-root", "", "Backup root directory, s3://bucket[@region]/prefix, gs://bucket/prefix, nfs://server:/export, sftp://user@host/path or webdav[s]://host/path")
+	o.s3Endpoint = flags.String("s3-endpoint", "", "Custom S3 endpoint URL (e.g. for MinIO)")
+	o.credentialFile = flags.String("credential-file", "", "Directory or .env file with the keys of a Longhorn S3 backup target secret (AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_ENDPOINTS, AWS_CERT, VIRTUAL_HOSTED_STYLE)")
+	o.nfsVersion = flags.Int("nfs-version", 3, "NFS protocol version for nfs:// backup roots")
+	o.nfsTimeout = flags.Duration("nfs-timeout", 30*time.Second, "Timeout for each NFS request")
+	o.sshKey = flags.String("ssh-key", "", "Private key for sftp:// backup roots (ssh-agent is used as well)")
+	o.sshKnownHosts = flags.String("ssh-known-hosts", "", "known_hosts file to verify sftp:// hosts against (default ~/.ssh/known_hosts)")
+	o.sshSkipHostKeyCheck = flags.Bool("ssh-skip-host-key-check", false, "Accept any host key for sftp:// backup roots")
+	o.sftpStreams = flags.Int("sftp-streams", 4, "Number of files fetched concurrently over the SFTP connection")
+	o.webdavUser = flags.String("webdav-user", "", "User for basic auth against webdav:// backup roots")
+	o.webdavPassword = flags.String("webdav-password", "", "Password for basic auth against webdav:// backup roots (default $WEBDAV_PASSWORD)")
+	o.webdavToken = flags.String("webdav-token", "", "Bearer token for webdav:// backup roots (default $WEBDAV_TOKEN)")
+	o.target = new(string)
+	flags.Var((*targetList)(o.target), "target", "Backup target, or several separated by commas or given more than once. A target that isn't the name of a volume is matched as a glob (pvc-8f3a*) or a substring (8f3a), and one containing a / is the path of a volume directory")
+	o.outfile = flags.String("outfile", "", "Output file, or - to stream the image to stdout. With several targets, a directory or a path containing {volume}")
+	o.failFast = flags.Bool("fail-fast", false, "With several targets, stop at the first one that fails")
+	o.all = flags.Bool("all", false, "Restore every volume in the backupstore into the directory -outfile, or with verify-backup verify the newest backup of each, instead of -target")
+	o.multi = flags.Bool("multi", false, "Use every volume a -target pattern matches, instead of asking for a more specific one")
+	o.concurrency = flags.Int("concurrency", 1, "With several targets, how many to restore at the same time")
+	o.inspect = flags.Bool("inspect", false, "inspect backup")
+	o.latest = flags.Bool("latest", false, "Use only the most recent backup")
+	o.backupName = flags.String("backup", "", "Use only the named backup (name or cfg file)")
+	o.jobs = flags.Int("jobs", runtime.NumCPU(), "Number of blocks to decompress in parallel, and to read at once from remote backup roots")
+	o.noSparse = flags.Bool("no-sparse", false, "Write all-zero blocks explicitly instead of leaving holes")
+	o.fsyncInterval = flags.String("fsync-interval", "256MiB", "Sync the output file to disk and checkpoint the -resume journal each time this much has been written (e.g. 4GiB) or this long has passed (e.g. 30s), and before and after its final truncate, or 0 to never sync")
+	o.directIO = flags.Bool("direct-io", false, "Write a raw output file with O_DIRECT, bypassing the page cache (Linux only)")
+	o.writeBatch = flags.String("write-batch", "32MiB", "Merge blocks at contiguous offsets into writes of up to this size, or 0 to write every block on its own")
+	o.onChecksumMismatch = flags.String("on-checksum-mismatch", "fail", "What to do with a block that fails its checksum: fail the restore, warn and write it anyway, or skip it and leave zeroes")
+	o.onMissingBlock = flags.String("on-missing-block", "fail", "What to do with a block missing from the backupstore: fail the restore, or zero-fill its region and go on")
+	o.noPreallocate = flags.Bool("no-preallocate", false, "Don't reserve the space of a raw image before restoring into it")
+	o.legacyPasses = flags.Bool("legacy-passes", false, "Restore each backup in a pass of its own, newest first, instead of the final block of every offset in one pass")
+	o.strict = flags.Bool("strict", false, "Fail on a backup whose cfg file lists several blocks at one offset, blocks at offsets that aren't a multiple of its block size, or blocks past the end of the volume, instead of warning")
+	o.outputFormat = flags.String("output-format", "raw", "Output image format (raw, qcow2, vhd, vmdk, vdi)")
+	o.compressOutput = flags.String("compress-output", "", "Compress the output image as it is written (gzip, zstd)")
+	o.before = flags.String("before", "", "Only use backups created at or before this time (RFC3339 or YYYY-MM-DD)")
+	o.allowEmpty = flags.Bool("allow-empty", false, "Write an empty image, zero-filled to the size in volume.cfg, for a volume whose backups hold no blocks")
+	o.includeIncomplete = flags.Bool("include-incomplete", false, "Use backups still in progress or that failed, which are skipped otherwise, for forensics")
+	o.noTruncate = flags.Bool("no-truncate", false, "Keep the image exactly as written instead of truncating it to the detected size")
+	o.padToSize = flags.String("pad-to-size", "", "Force the final image size, in bytes or with a unit (e.g. 20GiB)")
+	o.luksPassphrase = flags.String("luks-passphrase", "", "Decrypt a LUKS encrypted volume with this passphrase and write the plaintext image")
+	o.verify = flags.Bool("verify", false, "Compare the written image with the backup blocks once the restore is done")
+	o.dryRun = flags.Bool("dry-run", false, "Check that every block of the restore can be found, or with prune, list the blocks it would remove, without writing anything")
+	o.estimate = flags.Bool("estimate", false, "Print the size of the restore and how long it may take, without writing anything")
+	o.mount = flags.String("mount", "", "Once restored, loop-mount the filesystem of the raw image read-only at this directory (Linux, as root)")
+	o.mountRW = flags.Bool("mount-rw", false, "With -mount, mount the filesystem read-write, replaying its journal into the image")
+	o.yes = flags.Bool("yes", false, "Overwrite an existing -outfile without asking")
+	flags.BoolVar(o.yes, "force", false, "Alias for -yes")
+	o.noClobber = flags.Bool("no-clobber", false, "Fail instead of asking when -outfile already exists")
+	o.resume = flags.Bool("resume", false, "Continue an interrupted restore into -outfile from its last checkpoint")
+	o.luksKeyFile = flags.String("luks-key-file", "", "Decrypt a LUKS encrypted volume with the contents of this file and write the plaintext image")
+	o.progressFormat = flags.String("progress-format", "human", "Restore progress format (human, json)")
+	o.quiet = flags.Bool("quiet", false, "Only print errors, warnings and the final summary")
+	flags.BoolVar(o.quiet, "q", false, "Shorthand for -quiet")
+	o.verbose = flags.Bool("verbose", false, "Print a progress line for every block")
+	flags.BoolVar(o.verbose, "v", false, "Shorthand for -verbose")
+	o.logFile = flags.String("log-file", "", "Also append everything printed, but the image and JSON progress, to this file, with a progress line every second instead of the bar")
+	o.logFormat = flags.String("log-format", "text", "Format of the errors and warnings printed to stderr (text, json)")
+	o.logLevel = flags.String("log-level", "", "Least severe errors and warnings to print: debug, info, warn or error (default: info, or warn with -quiet)")
+	o.fast = flags.Bool("fast", false, "With describe, don't stat every block file for the size the backups take in the store")
+	o.deep = flags.Bool("deep", false, "With check, also decompress every block and check it against its checksum")
+	o.confirm = flags.Bool("confirm", false, "With prune and delete-backup, remove the files they list with -dry-run, which can't be undone")
+	o.pruneLog = flags.String("prune-log", "lhbr-prune.log", "File prune and delete-backup append every file they remove to")
+	o.dest = flags.String("dest", "", "With export, the backup root to copy the backups into, with extract, the directory to copy -path into, created if needed, and with serve, the directory the outfiles of jobs are in (default: the current directory)")
+	o.destRoot = flags.String("dest-root", "", "With copy, the local backup root to merge the backups into, which may already hold some of them")
+	o.path = flags.String("path", "/", "With ls and extract, the directory or file to list or copy in the filesystem of the backup")
+	o.preserveOwner = flags.Bool("preserve-owner", false, "With extract, give the extracted files the owner and group they have in the backup (as root)")
+	o.listen = flags.String("listen", "localhost:8080", "With serve, the address to answer HTTP requests on")
+	o.apiToken = flags.String("api-token", "", "With serve, the bearer token requests must have")
+	o.from = flags.String("from", "", "With diff, the older backup to compare (name or cfg file)")
+	o.to = flags.String("to", "", "With diff, the newer backup to compare (name or cfg file)")
+	o.content = flags.Bool("content", false, "With diff, also decompress the blocks that differ and count the bytes within them that do")
+	o.image = flags.String("image", "", "Raw image to compare with the backups")
+	o.maxMemory = flags.String("max-memory", "1GiB", "Bound the block buffers held by parallel jobs at once, or 0 for no bound (the cache is not counted)")
+	o.cacheSize = flags.String("cache-size", "512MiB", "Memory for decompressed blocks shared by several offsets or backups, or 0 to read every block from the store")
+	o.bandwidthLimit = flags.String("bandwidth-limit", "", "Cap the bytes read from the backupstore per second, by all jobs together, e.g. 100MiB/s")
+	o.writeLimit = flags.String("write-limit", "", "Cap the bytes written to the output file per second, e.g. 50MiB/s")
+	o.metricsListen = flags.String("metrics-listen", "", "Serve Prometheus metrics of the restore at /metrics on this address, e.g. :9090, until it exits")
+	return o
+}
+
+// command is a subcommand, which accepts only the flags it uses
+type command struct {
+	name    string
+	summary string
+	flags   []string
+	// required flags can also come from the config file or environment
+	required []string
+	// legacyFlag selected the command before there were commands
+	legacyFlag string
+	// args names the arguments the command takes after its flags, all of
+	// which have to be given
+	args []string
+}
+
+var (
+	storeFlags     = []string{"config", "backup-root", "s3-endpoint", "credential-file", "nfs-version", "nfs-timeout", "ssh-key", "ssh-known-hosts", "ssh-skip-host-key-check", "sftp-streams", "webdav-user", "webdav-password", "webdav-token", "bandwidth-limit", "log-format", "log-level"}
+	selectionFlags = []string{"target", "backup", "before", "latest", "include-incomplete"}
+	logFlags       = []string{"quiet", "q", "verbose", "v", "log-file"}
+)
+
+var commands = []command{
+	{
+		name:     "repack",
+		summary:  "Restore the backups of a volume into a disk image",
+		flags:    slices.Concat(storeFlags, selectionFlags, logFlags, []string{"outfile", "jobs", "no-sparse", "no-preallocate", "legacy-passes", "write-batch", "fsync-interval", "direct-io", "strict", "on-checksum-mismatch", "on-missing-block", "output-format", "compress-output", "no-truncate", "pad-to-size", "luks-passphrase", "luks-key-file", "verify", "dry-run", "estimate", "allow-empty", "all", "multi", "concurrency", "fail-fast", "resume", "yes", "force", "no-clobber", "mount", "mount-rw", "progress-format", "cache-size", "max-memory", "write-limit", "metrics-listen"}),
+		required: []string{"backup-root", "target"},
+	},
+	{
+		name:       "list-volumes",
+		summary:    "List the volumes in the backupstore with the size, creation time, last backup and backing image in their volume.cfg",
+		flags:      slices.Concat(storeFlags, []string{"full-path", "output"}),
+		required:   []string{"backup-root"},
+		legacyFlag: "list-volumes",
+	},
+	{
+		name:       "list-backups",
+		summary:    "List the backups of a volume, newest first, without reading any blocks",
+		flags:      slices.Concat(storeFlags, []string{"target", "output", "include-incomplete"}),
+		required:   []string{"backup-root", "target"},
+		legacyFlag: "list-backups",
+	},
+	{
+		name:       "describe",
+		summary:    "Show the snapshot, labels, size, filesystem and blocks of each backup of a volume, and how much they share",
+		flags:      slices.Concat(storeFlags, []string{"target", "backup", "before", "include-incomplete", "fast", "multi", "fail-fast", "concurrency", "output", "compress-output", "outfile"}),
+		required:   []string{"backup-root", "target"},
+		legacyFlag: "inspect",
+	},
+	{
+		name:     "diff",
+		summary:  "Compare the blocks of two backups of a volume, listing the extents added, removed and changed between them",
+		flags:    slices.Concat(storeFlags, logFlags, []string{"target", "from", "to", "include-incomplete", "content", "jobs", "cache-size", "output"}),
+		required: []string{"backup-root", "target", "from", "to"},
+	},
+	{
+		name:     "verify",
+		summary:  "Compare a restored raw image with the backups of a volume",
+		flags:    slices.Concat(storeFlags, selectionFlags, logFlags, []string{"image", "jobs", "cache-size", "max-memory"}),
+		required: []string{"backup-root", "target", "image"},
+	},
+	{
+		name:     "verify-backup",
+		summary:  "Read, decompress and checksum every block of the newest or selected backup of a volume, without writing an image",
+		flags:    slices.Concat(storeFlags, logFlags, []string{"target", "backup", "before", "include-incomplete", "all", "multi", "concurrency", "fail-fast", "jobs", "output"}),
+		required: []string{"backup-root", "target"},
+	},
+	{
+		name:     "ls",
+		summary:  "List a directory of the ext4 filesystem in the backups of a volume, reading only the blocks it needs instead of restoring the image",
+		flags:    slices.Concat(storeFlags, selectionFlags, []string{"path", "output", "cache-size"}),
+		required: []string{"backup-root", "target"},
+	},
+	{
+		name:     "extract",
+		summary:  "Copy a file or directory out of the ext4 filesystem in the backups of a volume, without restoring the image",
+		flags:    slices.Concat(storeFlags, selectionFlags, logFlags, []string{"path", "dest", "preserve-owner", "cache-size"}),
+		required: []string{"backup-root", "target", "dest"},
+	},
+	{
+		name:     "export",
+		summary:  "Copy the backups of a volume and the blocks they reference into a new backupstore",
+		flags:    slices.Concat(storeFlags, selectionFlags, logFlags, []string{"dest", "jobs", "multi", "fail-fast", "concurrency"}),
+		required: []string{"backup-root", "target", "dest"},
+	},
+	{
+		name:     "copy",
+		summary:  "Merge the backups of a volume and the blocks they reference into another backupstore, skipping what it already has",
+		flags:    slices.Concat(storeFlags, selectionFlags, logFlags, []string{"dest-root", "jobs", "multi", "fail-fast", "concurrency"}),
+		required: []string{"backup-root", "target", "dest-root"},
+	},
+	{
+		name:     "serve",
+		summary:  "Answer an HTTP API to list and describe volumes and backups, and to run, follow and cancel restores",
+		flags:    slices.Concat(storeFlags, []string{"listen", "api-token", "dest", "jobs", "no-sparse", "no-preallocate", "legacy-passes", "write-batch", "fsync-interval", "direct-io", "strict", "on-checksum-mismatch", "on-missing-block", "output-format", "cache-size", "max-memory", "write-limit"}),
+		required: []string{"backup-root", "api-token"},
+	},
+	{
+		name:     "check",
+		summary:  "Check every volume in the backupstore for unreadable cfg files, missing or corrupt blocks, and blocks no backup references",
+		flags:    slices.Concat(storeFlags, []string{"deep", "jobs", "output", "quiet", "q"}),
+		required: []string{"backup-root"},
+	},
+	{
+		name:     "prune",
+		summary:  "Remove the block files no backup of any volume references, from a store Longhorn no longer collects garbage in",
+		flags:    slices.Concat(storeFlags, []string{"confirm", "dry-run", "prune-log"}),
+		required: []string{"backup-root"},
+	},
+	{
+		name:     "delete-backup",
+		summary:  "Remove a backup and the blocks no other backup of any volume references",
+		flags:    slices.Concat(storeFlags, []string{"target", "backup", "confirm", "dry-run", "prune-log"}),
+		required: []string{"backup-root", "target", "backup"},
+	},
+	{
+		name:    "completion",
+		summary: "Print the completion script of a shell: bash, zsh or fish",
+		args:    []string{"shell"},
+	},
+}
+
+func lookupCommand(name string) (command, bool) {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd, true
+		}
+	}
+	return command{}, false
+}
+
+// commandFlagSet registers the flags of cmd from all, sharing their values
+func commandFlagSet(all *flag.FlagSet, cmd command) *flag.FlagSet {
+	flags := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	flags.SetOutput(all.Output())
+	for _, name := range cmd.flags {
+		f := all.Lookup(name)
+		flags.Var(f.Value, f.Name, f.Usage)
+	}
+	flags.Usage = func() {
+		out := flags.Output()
+		fmt.Fprintf(out, "Usage: %s %s [flags]", all.Name(), cmd.name)
+		for _, arg := range cmd.args {
+			fmt.Fprintf(out, " <%s>", arg)
+		}
+		fmt.Fprintf(out, "\n\n%s.\n\nFlags:\n", cmd.summary)
+		flags.PrintDefaults()
+		printExitStatuses(out)
+	}
+	return flags
+}
+
+// parseCommand parses args with the flag set of the command they start
+// with. Args that start with a flag are parsed with all of the flags, as
+// before there were commands, and the returned command is nil; see
+// legacyCommand. Errors are reported with the usage, like the flag
+// package does.
+func parseCommand(all *flag.FlagSet, args []string) (*command, *flag.FlagSet, error) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return nil, all, all.Parse(args)
+	}
+	if args[0] == "help" {
+		all.Usage()
+		return nil, all, flag.ErrHelp
+	}
+	cmd, ok := lookupCommand(args[0])
+	if !ok {
+		return nil, all, usageError(all, fmt.Errorf("unknown command %q", args[0]))
+	}
+	flags := commandFlagSet(all, cmd)
+	if err := flags.Parse(args[1:]); err != nil {
+		return nil, flags, err
+	}
+	switch {
+	case flags.NArg() > len(cmd.args):
+		return nil, flags, usageError(flags, fmt.Errorf("unexpected argument %q", flags.Arg(len(cmd.args))))
+	case flags.NArg() < len(cmd.args):
+		return nil, flags, usageError(flags, fmt.Errorf("missing argument <%s>", cmd.args[flags.NArg()]))
+	}
+	return &cmd, flags, nil
+}
+
+func usageError(flags *flag.FlagSet, err error) error {
+	fmt.Fprintln(flags.Output(), err)
+	flags.Usage()
+	return err
+}
+
+// legacyCommand is the command a flag-only invocation runs: the one its
+// mode flag selects, or repack
+func legacyCommand(flags *flag.FlagSet) command {
+	for _, cmd := range commands {
+		if cmd.legacyFlag != "" && flags.Lookup(cmd.legacyFlag).Value.String() == "true" {
+			return cmd
+		}
+	}
+	cmd, _ := lookupCommand("repack")
+	return cmd
+}
+
+// migrationHint tells how to run a flag-only invocation as a command
+func migrationHint(program string, cmd command) string {
+	if cmd.legacyFlag != "" {
+		return fmt.Sprintf("Running without a command is deprecated, use '%s %s' instead of -%s", program, cmd.name, cmd.legacyFlag)
+	}
+	return fmt.Sprintf("Running without a command is deprecated, use '%s %s' with the same flags", program, cmd.name)
+}
+
+// validateCommand checks the flags cmd can't run without, once the config
+// file and environment have been applied
+func validateCommand(cmd command, flags *flag.FlagSet) error {
+	value := func(name string) string {
+		return flags.Lookup(name).Value.String()
+	}
+	// -all restores every volume instead of -target
+	all := (cmd.name == "repack" || cmd.name == "verify-backup") && value("all") == "true"
+	if all && value("target") != "" {
+		return fmt.Errorf("-all and -target are mutually exclusive")
+	}
+	// -target paths of volume directories locate the backupstore themselves
+	located := false
+	if slices.Contains(cmd.flags, "target") {
+		paths, patterns := splitVolumePaths(splitTargets(value("target")))
+		located = len(paths) > 0 && len(patterns) == 0
+	}
+	for _, name := range cmd.required {
+		if value(name) == "" && !(all && name == "target") && !(located && name == "backup-root") {
+			return fmt.Errorf("-%s is required", name)
+		}
+	}
+	if cmd.name == "repack" && value("outfile") == "" && value("dry-run") != "true" && value("estimate") != "true" {
+		return fmt.Errorf("-outfile is required to restore")
+	}
+	if cmd.name == "repack" && value("mount") != "" && !mountSupported {
+		return fmt.Errorf("-mount is only supported on Linux")
+	}
+	if cmd.name == "repack" && value("mount-rw") == "true" && value("mount") == "" {
+		return fmt.Errorf("-mount-rw needs -mount")
+	}
+	if (cmd.name == "prune" || cmd.name == "delete-backup") && value("confirm") != "true" && value("dry-run") != "true" {
+		return fmt.Errorf("%s removes files only with -confirm, or lists them with -dry-run", cmd.name)
+	}
+	return nil
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	program := flag.CommandLine.Name()
+	fmt.Fprintf(out, "Usage: %s <command> [flags]\n\nCommands:\n", program)
+	for _, cmd := range commands {
+		fmt.Fprintf(out, "  %-13s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(out, "\nRun '%s <command> -h' for the flags of a command.\n", program)
+	fmt.Fprintf(out, "\nWithout a command, all of the flags below are accepted and run repack, or the\ncommand selected by -list-volumes, -list-backups or -inspect (deprecated):\n")
+	flag.PrintDefaults()
+	printExitStatuses(out)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"strings"
+	"testing"
+)
+
+func newTestFlags() (*flag.FlagSet, *cliOptions) {
+	all := flag.NewFlagSet("longhorn-backup-repacker", flag.ContinueOnError)
+	all.SetOutput(io.Discard)
+	return all, defineFlags(all)
+}
+
+func TestCommandFlags(t *testing.T) {
+	for _, cmd := range commands {
+		all, _ := newTestFlags()
+		flags := commandFlagSet(all, cmd)
+		for _, name := range cmd.flags {
+			if flags.Lookup(name) == nil {
+				t.Errorf("Expected %s to accept -%s", cmd.name, name)
+			}
+		}
+		for _, name := range []string{"list-volumes", "list-backups", "inspect", "version"} {
+			if flags.Lookup(name) != nil {
+				t.Errorf("Expected %s to reject the mode flag -%s", cmd.name, name)
+			}
+		}
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		command  string
+		expected map[string]string
+		err      string
+	}{
+		{
+			name:     "repack",
+			args:     []string{"repack", "-backup-root", "/backups", "-target", "pvc-1", "-outfile", "out.raw", "-jobs", "2", "-q"},
+			command:  "repack",
+			expected: map[string]string{"backup-root": "/backups", "target": "pvc-1", "outfile": "out.raw", "jobs": "2", "quiet": "true"},
+		},
+		{
+			name:     "list-volumes",
+			args:     []string{"list-volumes", "-backup-root", "s3://bucket/", "-full-path"},
+			command:  "list-volumes",
+			expected: map[string]string{"backup-root": "s3://bucket/", "full-path": "true"},
+		},
+		{
+			name:     "list-backups",
+			args:     []string{"list-backups", "-backup-root", "/backups", "-target", "pvc-1", "-output", "json"},
+			command:  "list-backups",
+			expected: map[string]string{"target": "pvc-1", "output": "json"},
+		},
+		{
+			name:     "describe",
+			args:     []string{"describe", "-backup-root", "/backups", "-target", "pvc-1", "-before", "2024-01-01"},
+			command:  "describe",
+			expected: map[string]string{"target": "pvc-1", "before": "2024-01-01"},
+		},
+		{
+			name:     "verify",
+			args:     []string{"verify", "-backup-root", "/backups", "-target", "pvc-1", "-image", "out.raw", "-latest"},
+			command:  "verify",
+			expected: map[string]string{"image": "out.raw", "latest": "true"},
+		},
+		{
+			name:     "flags without a command",
+			args:     []string{"-backup-root", "/backups", "-list-volumes", "-jobs", "3"},
+			expected: map[string]string{"list-volumes": "true", "jobs": "3"},
+		},
+		{name: "flag of another command", args: []string{"list-volumes", "-backup-root", "/backups", "-outfile", "out.raw"}, err: "flag provided but not defined: -outfile"},
+		{name: "mode flag", args: []string{"repack", "-inspect"}, err: "flag provided but not defined: -inspect"},
+		{name: "unknown command", args: []string{"restore", "-target", "pvc-1"}, err: `unknown command "restore"`},
+		{name: "unexpected argument", args: []string{"describe", "-target", "pvc-1", "pvc-2"}, err: `unexpected argument "pvc-2"`},
+		{name: "completion", args: []string{"completion", "bash"}, command: "completion"},
+		{name: "missing argument", args: []string{"completion"}, err: "missing argument <shell>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			all, _ := newTestFlags()
+			cmd, flags, err := parseCommand(all, tt.args)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Expected error containing %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			switch {
+			case tt.command == "" && cmd != nil:
+				t.Errorf("Expected no command, got %s", cmd.name)
+			case tt.command != "" && (cmd == nil || cmd.name != tt.command):
+				t.Errorf("Expected command %s, got %v", tt.command, cmd)
+			}
+			for name, expected := range tt.expected {
+				if got := flags.Lookup(name).Value.String(); got != expected {
+					t.Errorf("Expected -%s %q, got %q", name, expected, got)
+				}
+			}
+		})
+	}
+}
+
+func TestParseCommandHelp(t *testing.T) {
+	for _, args := range [][]string{{"help"}, {"repack", "-h"}, {"-h"}} {
+		all, _ := newTestFlags()
+		if _, _, err := parseCommand(all, args); !errors.Is(err, flag.ErrHelp) {
+			t.Errorf("Expected flag.ErrHelp for %v, got %v", args, err)
+		}
+	}
+}
+
+func TestCommandSharesValues(t *testing.T) {
+	all, o := newTestFlags()
+	_, flags, err := parseCommand(all, []string{"repack", "-target", "pvc-1"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	getenv := func(name string) string {
+		return map[string]string{"LHBR_OUTFILE": "env.raw", "LHBR_FULL_PATH": "true"}[name]
+	}
+	if err := applySettings(flags, nil, getenv); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if *o.target != "pvc-1" || *o.outfile != "env.raw" {
+		t.Errorf("Expected target pvc-1 and outfile env.raw, got %q and %q", *o.target, *o.outfile)
+	}
+	if *o.fullPath {
+		t.Errorf("Expected LHBR_FULL_PATH to be ignored by repack, which has no -full-path")
+	}
+}
+
+func TestLegacyCommand(t *testing.T) {
+	tests := []struct {
+		args     []string
+		expected string
+		hint     string
+	}{
+		{args: []string{"-target", "pvc-1", "-outfile", "out.raw"}, expected: "repack", hint: "with the same flags"},
+		{args: []string{"-list-volumes"}, expected: "list-volumes", hint: "instead of -list-volumes"},
+		{args: []string{"-list-backups", "-target", "pvc-1"}, expected: "list-backups", hint: "instead of -list-backups"},
+		{args: []string{"-inspect", "-target", "pvc-1", "-verify"}, expected: "describe", hint: "'longhorn-backup-repacker describe' instead of -inspect"},
+	}
+	for _, tt := range tests {
+		all, _ := newTestFlags()
+		if err := all.Parse(tt.args); err != nil {
+			t.Fatal(err)
+		}
+		cmd := legacyCommand(all)
+		if cmd.name != tt.expected {
+			t.Errorf("Expected %v to run %s, got %s", tt.args, tt.expected, cmd.name)
+		}
+		if hint := migrationHint(all.Name(), cmd); !strings.Contains(hint, tt.hint) {
+			t.Errorf("Expected hint containing %q, got %q", tt.hint, hint)
+		}
+	}
+}
+
+func TestValidateCommand(t *testing.T) {
+	tests := []struct {
+		args []string
+		err  string
+	}{
+		{args: []string{"list-volumes"}, err: "-backup-root is required"},
+		{args: []string{"list-volumes", "-backup-root", "/backups"}},
+		{args: []string{"list-backups", "-backup-root", "/backups"}, err: "-target is required"},
+		{args: []string{"describe", "-backup-root", "/backups", "-target", "pvc-1"}},
+		{args: []string{"describe", "-target", "/backups/backupstore/volumes/6f/1a/pvc-1"}},
+		{args: []string{"describe", "-target", "/backups/backupstore/volumes/6f/1a/pvc-1,pvc-2"}, err: "-backup-root is required"},
+		{args: []string{"repack", "-backup-root", "/backups", "-target", "pvc-1"}, err: "-outfile is required to restore"},
+		{args: []string{"repack", "-backup-root", "/backups", "-target", "pvc-1", "-dry-run"}},
+		{args: []string{"repack", "-backup-root", "/backups", "-target", "pvc-1", "-estimate"}},
+		{args: []string{"repack", "-backup-root", "/backups", "-all", "-outfile", "/restore"}},
+		{args: []string{"repack", "-backup-root", "/backups", "-all", "-target", "pvc-1", "-outfile", "/restore"}, err: "-all and -target are mutually exclusive"},
+		{args: []string{"repack", "-backup-root", "/backups", "-target", "pvc-1", "-outfile", "-"}},
+		{args: []string{"repack", "-backup-root", "/backups", "-target", "pvc-1", "-outfile", "pvc-1.img", "-mount-rw"}, err: "-mount-rw needs -mount"},
+		{args: []string{"verify", "-backup-root", "/backups", "-target", "pvc-1"}, err: "-image is required"},
+		{args: []string{"verify-backup", "-backup-root", "/backups", "-all"}},
+		{args: []string{"verify-backup", "-backup-root", "/backups"}, err: "-target is required"},
+		{args: []string{"serve", "-backup-root", "/backups", "-api-token", "secret"}},
+		{args: []string{"serve", "-backup-root", "/backups"}, err: "-api-token is required"},
+		{args: []string{"check", "-backup-root", "/backups", "-deep", "-output", "json"}},
+		{args: []string{"export", "-backup-root", "/backups", "-target", "pvc-1"}, err: "-dest is required"},
+		{args: []string{"prune", "-backup-root", "/backups"}, err: "prune removes files only with -confirm, or lists them with -dry-run"},
+		{args: []string{"prune", "-backup-root", "/backups", "-dry-run"}},
+		{args: []string{"prune", "-backup-root", "/backups", "-confirm"}},
+		{args: []string{"delete-backup", "-backup-root", "/backups", "-target", "pvc-1", "-confirm"}, err: "-backup is required"},
+		{args: []string{"delete-backup", "-backup-root", "/backups", "-target", "pvc-1", "-backup", "backup-1"}, err: "delete-backup removes files only with -confirm, or lists them with -dry-run"},
+		{args: []string{"-backup-root", "/backups", "-list-volumes"}},
+		{args: []string{"-backup-root", "/backups", "-target", "pvc-1"}, err: "-outfile is required to restore"},
+	}
+	for _, tt := range tests {
+		all, _ := newTestFlags()
+		cmd, flags, err := parseCommand(all, tt.args)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if cmd == nil {
+			legacy := legacyCommand(flags)
+			cmd = &legacy
+		}
+		err = validateCommand(*cmd, flags)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("Unexpected error for %v: %v", tt.args, err)
+		case tt.err != "" && (err == nil || err.Error() != tt.err):
+			t.Errorf("Expected error %q for %v, got %v", tt.err, tt.args, err)
+		}
+	}
+}
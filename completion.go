@@ -0,0 +1,374 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+// completionShells are the shells the completion command writes scripts
+// for
+var completionShells = []string{"bash", "zsh", "fish"}
+
+// completionArgs are the values of the arguments of commands, by name
+var completionArgs = map[string][]string{
+	"shell": completionShells,
+}
+
+// completionFlag is a flag as the completion scripts see it
+type completionFlag struct {
+	Name        string
+	Description string
+	// Value is set for a flag that takes a value, and Values lists the
+	// ones it accepts when there is a fixed set
+	Value  bool
+	Values []string
+	// Commands are the commands that accept the flag
+	Commands []string
+}
+
+type completionCommand struct {
+	Name    string
+	Summary string
+	// Flags are the flags of the command with their dash, and Args the
+	// values of its arguments
+	Flags []string
+	Args  []string
+}
+
+// completionData is what the completion scripts are generated from.
+// -target is completed with the names list-volumes prints, and -backup,
+// -from and -to with those list-backups prints for the -target given
+// already, both with the StoreFlags of the command line passed on.
+type completionData struct {
+	Program string
+	// Function is Program as a shell function name
+	Function   string
+	Commands   []completionCommand
+	Flags      []completionFlag
+	StoreFlags []completionFlag
+}
+
+// completionValues are the values of the flags that accept a fixed set
+func completionValues() map[string][]string {
+	return map[string][]string{
+		"output":               append(slices.Clone(listFormats), namesFormat),
+		"output-format":        outputFormats,
+		"compress-output":      outputCompressions,
+		"progress-format":      progressFormats,
+		"log-format":           logFormats,
+		"log-level":            slices.Sorted(maps.Keys(logLevels)),
+		"on-checksum-mismatch": slices.Sorted(maps.Keys(mismatchPolicies)),
+		"on-missing-block":     slices.Sorted(maps.Keys(missingPolicies)),
+	}
+}
+
+func newCompletionData(all *flag.FlagSet, program string) completionData {
+	data := completionData{
+		Program:  program,
+		Function: regexp.MustCompile(`[^A-Za-z0-9_]`).ReplaceAllString(program, "_"),
+	}
+	values := completionValues()
+	byName := make(map[string]*completionFlag)
+	var names []string
+	for _, cmd := range commands {
+		completed := completionCommand{Name: cmd.name, Summary: cmd.summary}
+		for _, name := range cmd.flags {
+			completed.Flags = append(completed.Flags, "-"+name)
+			if f, ok := byName[name]; ok {
+				f.Commands = append(f.Commands, cmd.name)
+				continue
+			}
+			f := all.Lookup(name)
+			boolean, ok := f.Value.(interface{ IsBoolFlag() bool })
+			description, _, _ := strings.Cut(f.Usage, ". ")
+			byName[name] = &completionFlag{
+				Name:        name,
+				Description: description,
+				Value:       !ok || !boolean.IsBoolFlag(),
+				Values:      values[name],
+				Commands:    []string{cmd.name},
+			}
+			names = append(names, name)
+		}
+		for _, arg := range cmd.args {
+			completed.Args = append(completed.Args, completionArgs[arg]...)
+		}
+		data.Commands = append(data.Commands, completed)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		data.Flags = append(data.Flags, *byName[name])
+	}
+	for _, name := range storeFlags {
+		data.StoreFlags = append(data.StoreFlags, *byName[name])
+	}
+	return data
+}
+
+// writeCompletion writes the completion script of shell for program
+func writeCompletion(w io.Writer, all *flag.FlagSet, program, shell string) error {
+	script, ok := completionScripts[shell]
+	if !ok {
+		return fmt.Errorf("unsupported shell %s, expected %s", shell, strings.Join(completionShells, ", "))
+	}
+	return script.Execute(w, newCompletionData(all, program))
+}
+
+var completionFuncs = template.FuncMap{
+	"join": strings.Join,
+	// quote single-quotes s for bash and zsh
+	"quote": func(s string) string {
+		return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+	},
+	// fishQuote single-quotes s for fish, which escapes quotes differently
+	"fishQuote": func(s string) string {
+		return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+	},
+	// patterns is a case pattern matching any of flags, with suffix
+	"patterns": func(flags []completionFlag, value bool, suffix string) string {
+		var names []string
+		for _, f := range flags {
+			if f.Value == value {
+				names = append(names, f.Name+suffix)
+			}
+		}
+		return strings.Join(names, "|")
+	},
+}
+
+var completionScripts = map[string]*template.Template{
+	"bash": template.Must(template.New("bash").Funcs(completionFuncs).Parse(bashCompletion)),
+	"zsh":  template.Must(template.New("zsh").Funcs(completionFuncs).Parse(zshCompletion)),
+	"fish": template.Must(template.New("fish").Funcs(completionFuncs).Parse(fishCompletion)),
+}
+
+const bashCompletion = `# bash completion for {{.Program}}
+# Load it with: source <({{.Program}} completion bash)
+
+_{{.Function}}() {
+    local line=${COMP_LINE:0:COMP_POINT}
+    local -a words
+    read -ra words <<< "$line"
+    if [[ -z $line || $line == *[[:space:]] ]]; then
+        words+=("")
+    fi
+    local cur=${words[${#words[@]}-1]}
+    COMPREPLY=()
+    if ((${#words[@]} == 2)); then
+        COMPREPLY=($(compgen -W "{{range .Commands}}{{.Name}} {{end}}" -- "$cur"))
+        return
+    fi
+
+    # the flags saying where the backupstore is are passed on to the
+    # listings of volumes and backups
+    local -a store=()
+    local target="" name i
+    for ((i = 2; i < ${#words[@]} - 1; i++)); do
+        name=${words[i]#-}
+        name=${name#-}
+        case $name in
+        {{patterns .StoreFlags true ""}})
+            store+=("-$name" "${words[i+1]}")
+            ;;
+        {{patterns .StoreFlags true "=*"}}|{{patterns .StoreFlags false ""}})
+            store+=("-$name")
+            ;;
+        target)
+            target=${words[i+1]}
+            ;;
+        target=*)
+            target=${name#target=}
+            ;;
+        esac
+    done
+
+    local prev=${words[${#words[@]}-2]#-}
+    prev=${prev#-}
+    case $prev in
+    target)
+        COMPREPLY=($(compgen -W "$("${words[0]}" list-volumes -output names "${store[@]}" 2>/dev/null)" -- "$cur"))
+        return
+        ;;
+    backup|from|to)
+        if [[ -n $target ]]; then
+            COMPREPLY=($(compgen -W "$("${words[0]}" list-backups -target "$target" -output names "${store[@]}" 2>/dev/null)" -- "$cur"))
+        fi
+        return
+        ;;
+{{- range .Flags}}{{if .Values}}
+    {{.Name}})
+        COMPREPLY=($(compgen -W "{{join .Values " "}}" -- "$cur"))
+        return
+        ;;
+{{- end}}{{end}}
+    {{patterns .Flags true ""}})
+        # file names, or whatever the value is
+        return
+        ;;
+    esac
+
+    case ${words[1]} in
+{{- range .Commands}}
+    {{.Name}})
+        COMPREPLY=($(compgen -W "{{range .Flags}}{{.}} {{end}}{{range .Args}}{{.}} {{end}}" -- "$cur"))
+        ;;
+{{- end}}
+    esac
+}
+
+complete -o default -F _{{.Function}} {{.Program}}
+`
+
+const zshCompletion = `#compdef {{.Program}}
+# zsh completion for {{.Program}}
+# Load it with: source <({{.Program}} completion zsh), or save it as
+# _{{.Program}} in a directory of $fpath
+
+_{{.Function}}() {
+    if (( CURRENT == 2 )); then
+        local -a commands
+        commands=(
+{{- range .Commands}}
+            {{quote (print .Name ":" .Summary)}}
+{{- end}}
+        )
+        _describe command commands
+        return
+    fi
+
+    # the flags saying where the backupstore is are passed on to the
+    # listings of volumes and backups
+    local -a store
+    local target name i
+    for (( i = 3; i < CURRENT; i++ )); do
+        name=${words[i]#-}
+        name=${name#-}
+        case $name in
+        ({{patterns .StoreFlags true ""}})
+            store+=("-$name" "${words[i+1]}")
+            ;;
+        ({{patterns .StoreFlags true "=*"}}|{{patterns .StoreFlags false ""}})
+            store+=("-$name")
+            ;;
+        (target)
+            target=${words[i+1]}
+            ;;
+        (target=*)
+            target=${name#target=}
+            ;;
+        esac
+    done
+
+    local prev=${words[CURRENT-1]#-}
+    prev=${prev#-}
+    case $prev in
+    (target)
+        compadd -- ${(f)"$(${words[1]} list-volumes -output names "${store[@]}" 2>/dev/null)"}
+        _files -/
+        return
+        ;;
+    (backup|from|to)
+        if [[ -n $target ]]; then
+            compadd -- ${(f)"$(${words[1]} list-backups -target "$target" -output names "${store[@]}" 2>/dev/null)"}
+        fi
+        return
+        ;;
+{{- range .Flags}}{{if .Values}}
+    ({{.Name}})
+        compadd -- {{join .Values " "}}
+        return
+        ;;
+{{- end}}{{end}}
+    ({{patterns .Flags true ""}})
+        _files
+        return
+        ;;
+    esac
+
+    case ${words[2]} in
+{{- range .Commands}}
+    ({{.Name}})
+        compadd -- {{range .Flags}}{{.}} {{end}}{{range .Args}}{{.}} {{end}}
+        ;;
+{{- end}}
+    esac
+}
+
+if [[ $funcstack[1] == _{{.Program}} ]]; then
+    _{{.Function}} "$@"
+else
+    compdef _{{.Function}} {{.Program}}
+fi
+`
+
+const fishCompletion = `# fish completion for {{.Program}}
+# Load it with: {{.Program}} completion fish | source, or save it as
+# {{.Program}}.fish in ~/.config/fish/completions
+
+# the flags saying where the backupstore is, passed on to the listings of
+# volumes and backups
+function __{{.Function}}_store_args
+    set -l words (commandline -opc)
+    for i in (seq 3 (count $words))
+        set -l name (string replace -r -- '^--?' '' $words[$i])
+        switch $name
+            case {{range .StoreFlags}}{{if .Value}}{{.Name}} {{end}}{{end}}
+                if test $i -lt (count $words)
+                    printf '%s\n' -$name $words[(math $i + 1)]
+                end
+            case {{range .StoreFlags}}{{if .Value}}'{{.Name}}=*' {{else}}{{.Name}} {{end}}{{end}}
+                printf '%s\n' -$name
+        end
+    end
+end
+
+function __{{.Function}}_target
+    set -l words (commandline -opc)
+    for i in (seq 3 (count $words))
+        set -l name (string replace -r -- '^--?' '' $words[$i])
+        switch $name
+            case target
+                if test $i -lt (count $words)
+                    echo $words[(math $i + 1)]
+                end
+            case 'target=*'
+                string replace -- target= '' $name
+        end
+    end
+end
+
+function __{{.Function}}_volumes
+    set -l words (commandline -opc)
+    $words[1] list-volumes -output names (__{{.Function}}_store_args) 2>/dev/null
+end
+
+function __{{.Function}}_backups
+    set -l words (commandline -opc)
+    set -l target (__{{.Function}}_target)
+    if test -n "$target[-1]"
+        $words[1] list-backups -target $target[-1] -output names (__{{.Function}}_store_args) 2>/dev/null
+    end
+end
+
+complete -c {{.Program}} -f
+{{- range .Commands}}
+complete -c {{$.Program}} -n __fish_use_subcommand -a {{.Name}} -d {{fishQuote .Summary}}
+{{- end}}
+{{- range .Commands}}{{if .Args}}
+complete -c {{$.Program}} -n '__fish_seen_subcommand_from {{.Name}}' -a '{{join .Args " "}}'
+{{- end}}{{end}}
+{{- range .Flags}}
+complete -c {{$.Program}} -n '__fish_seen_subcommand_from {{join .Commands " "}}' -o {{.Name}} -d {{fishQuote .Description}}
+{{- if eq .Name "target"}} -x -a '(__{{$.Function}}_volumes)'
+{{- else if or (eq .Name "backup") (eq .Name "from") (eq .Name "to")}} -x -a '(__{{$.Function}}_backups)'
+{{- else if .Values}} -x -a '{{join .Values " "}}'
+{{- else if .Value}} -r -F
+{{- end}}
+{{- end}}
+`
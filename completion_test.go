@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteCompletion(t *testing.T) {
+	for _, shell := range completionShells {
+		t.Run(shell, func(t *testing.T) {
+			all, _ := newTestFlags()
+			var out bytes.Buffer
+			if err := writeCompletion(&out, all, "longhorn-backup-repacker", shell); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			script := out.String()
+			for _, expected := range []string{"list-volumes -output names", "list-backups -target", "repack", "completion", "backup-root", "on-missing-block", "qcow2"} {
+				if !strings.Contains(script, expected) {
+					t.Errorf("Expected the %s script to contain %q", shell, expected)
+				}
+			}
+			if strings.Contains(script, "<no value>") {
+				t.Errorf("Expected every value of the %s script to be set", shell)
+			}
+			if _, err := exec.LookPath(shell); err != nil {
+				return
+			}
+			path := filepath.Join(t.TempDir(), "completion")
+			if err := os.WriteFile(path, out.Bytes(), 0644); err != nil {
+				t.Fatal(err)
+			}
+			check := []string{"-n", path}
+			if shell == "fish" {
+				check = []string{"--no-execute", path}
+			}
+			if output, err := exec.Command(shell, check...).CombinedOutput(); err != nil {
+				t.Errorf("Expected valid %s syntax, got %v: %s", shell, err, output)
+			}
+		})
+	}
+}
+
+func TestCompletionData(t *testing.T) {
+	all, _ := newTestFlags()
+	data := newCompletionData(all, "./lhbr")
+	if data.Function != "__lhbr" {
+		t.Errorf("Expected the function __lhbr, got %s", data.Function)
+	}
+	for _, f := range data.Flags {
+		switch f.Name {
+		case "full-path":
+			if f.Value {
+				t.Errorf("Expected -full-path to take no value")
+			}
+		case "output":
+			if !strings.Contains(strings.Join(f.Values, " "), namesFormat) {
+				t.Errorf("Expected -output to accept %s, got %v", namesFormat, f.Values)
+			}
+		}
+	}
+	if len(data.StoreFlags) != len(storeFlags) {
+		t.Errorf("Expected %d store flags, got %d", len(storeFlags), len(data.StoreFlags))
+	}
+}
+
+func TestWriteCompletionUnsupported(t *testing.T) {
+	all, _ := newTestFlags()
+	if err := writeCompletion(&bytes.Buffer{}, all, "longhorn-backup-repacker", "tcsh"); err == nil || !strings.Contains(err.Error(), "unsupported shell tcsh") {
+		t.Errorf("Expected an unsupported shell error, got %v", err)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+)
+
+var outputCompressions = []string{"gzip", "zstd"}
+
+func compressedExtension(method string) string {
+	switch method {
+	case "gzip":
+		return ".gz"
+	case "zstd":
+		return ".zst"
+	}
+	return ""
+}
+
+func withCompressedExtension(path string, method string) string {
+	ext := compressedExtension(method)
+	if strings.HasSuffix(path, ext) {
+		return path
+	}
+	return path + ext
+}
+
+func newCompressedWriter(w io.Writer, method string) (io.WriteCloser, error) {
+	switch method {
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	case "zstd":
+		return zstd.NewWriter(w)
+	default:
+		return nil, fmt.Errorf("unsupported output compression %s", method)
+	}
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	if err != nil {
+		// it wraps the output itself, under any compression or decryption
+		err = &backupstore.OutputError{Err: err}
+	}
+	return n, err
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+)
+
+func TestWithCompressedExtension(t *testing.T) {
+	tests := []struct {
+		path     string
+		method   string
+		expected string
+	}{
+		{path: "out.raw", method: "gzip", expected: "out.raw.gz"},
+		{path: "out.raw.gz", method: "gzip", expected: "out.raw.gz"},
+		{path: "out.raw", method: "zstd", expected: "out.raw.zst"},
+		{path: "out.raw.zst", method: "zstd", expected: "out.raw.zst"},
+	}
+
+	for _, tt := range tests {
+		if got := withCompressedExtension(tt.path, tt.method); got != tt.expected {
+			t.Errorf("Expected %s, got %s", tt.expected, got)
+		}
+	}
+}
+
+func TestStreamBackupsCompressed(t *testing.T) {
+	volumePath := t.TempDir()
+	blockSize := 4096
+	first := writeTestBlock(t, volumePath, ext4TestBlock(blockSize, 12, 0))
+	second := writeTestBlock(t, volumePath, testBlockData(2, blockSize))
+	backups := []backupstore.Backup{{
+		Identifier:  "backup-1",
+		Compression: "lz4",
+		Blocks: []backupstore.Block{
+			{Offset: 0, Checksum: first},
+			{Offset: int64(2 * blockSize), Checksum: second},
+		},
+	}}
+
+	var plain bytes.Buffer
+	if _, err := streamBackups(context.Background(), os.DirFS(volumePath), ".", backups, &plain, restoreOptions{Jobs: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, method := range outputCompressions {
+		t.Run(method, func(t *testing.T) {
+			var compressed bytes.Buffer
+			counted := &countingWriter{w: &compressed}
+			w, err := newCompressedWriter(counted, method)
+			if err != nil {
+				t.Fatal(err)
+			}
+			written, err := streamBackups(context.Background(), os.DirFS(volumePath), ".", backups, w, restoreOptions{Jobs: 2})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if written != 12288 {
+				t.Errorf("Expected 12288 logical bytes, got %d", written)
+			}
+			if counted.n != int64(compressed.Len()) {
+				t.Errorf("Expected %d compressed bytes counted, got %d", compressed.Len(), counted.n)
+			}
+
+			var r io.Reader
+			if method == "gzip" {
+				r, err = gzip.NewReader(&compressed)
+			} else {
+				var zr *zstd.Decoder
+				zr, err = zstd.NewReader(&compressed)
+				r = zr
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			decompressed, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decompressed, plain.Bytes()) {
+				t.Error("Decompressed image does not match the plain stream")
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix starts the environment variable each flag can be set with,
+// e.g. LHBR_BACKUP_ROOT for -backup-root
+const envPrefix = "LHBR_"
+
+// flagEnvFallbacks are the variables flags read before envPrefix existed;
+// like those, they take precedence over the config file
+var flagEnvFallbacks = map[string]string{
+	"webdav-password": "WEBDAV_PASSWORD",
+	"webdav-token":    "WEBDAV_TOKEN",
+}
+
+func flagEnvName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// configFlagName maps a config file key like backupRoot to the flag
+// backup-root. Keys spelled like the flag are accepted too.
+func configFlagName(key string) string {
+	var b strings.Builder
+	for i, r := range key {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('-')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// loadConfig reads a YAML or JSON config file into flag values, keyed by
+// flag name. Keys that aren't flags are an error so a typo doesn't go
+// unnoticed.
+func loadConfig(flags *flag.FlagSet, configPath string) (map[string]string, error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+	// YAML is a superset of JSON, so this reads both. Values are taken as
+	// written, so dates and durations reach the flags unchanged.
+	var raw map[string]yaml.Node
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", configPath, err)
+	}
+
+	values := make(map[string]string, len(raw))
+	for key, node := range raw {
+		name := configFlagName(key)
+		if flags.Lookup(name) == nil || name == "config" {
+			return nil, fmt.Errorf("unknown setting %q in %s", key, configPath)
+		}
+		if node.Kind != yaml.ScalarNode || node.Tag == "!!null" {
+			return nil, fmt.Errorf("setting %q in %s must be a string, number or boolean", key, configPath)
+		}
+		values[name] = node.Value
+	}
+	return values, nil
+}
+
+// applySettings fills in the flags not given on the command line, from
+// their environment variable if set and otherwise from config
+func applySettings(flags *flag.FlagSet, config map[string]string, getenv func(string) string) error {
+	explicit := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		if err != nil || explicit[f.Name] {
+			return
+		}
+		if value := getenv(flagEnvName(f.Name)); value != "" {
+			if setErr := flags.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("invalid value %q for %s: %w", value, flagEnvName(f.Name), setErr)
+			}
+			return
+		}
+		if fallback, ok := flagEnvFallbacks[f.Name]; ok && getenv(fallback) != "" {
+			return
+		}
+		if value, ok := config[f.Name]; ok {
+			if setErr := flags.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("invalid value %q for %s in the config file: %w", value, f.Name, setErr)
+			}
+		}
+	})
+	return err
+}
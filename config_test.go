@@ -0,0 +1,138 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	yamlConfig := writeTestConfig(t, "config.yaml", `
+backupRoot: s3://from-file
+target: pvc-file
+jobs: 8
+verify: true
+webdav-token: file-token
+nfsTimeout: 1m
+before: 2024-01-01
+`)
+	jsonConfig := writeTestConfig(t, "config.json", `{"backupRoot": "s3://from-file", "target": "pvc-file", "jobs": 8, "verify": true, "webdavToken": "file-token", "nfsTimeout": "1m", "before": "2024-01-01"}`)
+
+	tests := []struct {
+		name     string
+		args     []string
+		env      map[string]string
+		expected map[string]string
+	}{
+		{
+			name:     "file over defaults",
+			expected: map[string]string{"backup-root": "s3://from-file", "target": "pvc-file", "jobs": "8", "verify": "true", "outfile": "", "nfs-timeout": "1m0s", "before": "2024-01-01"},
+		},
+		{
+			name:     "environment over file",
+			env:      map[string]string{"LHBR_TARGET": "pvc-env", "LHBR_OUTFILE": "/restore/env.raw"},
+			expected: map[string]string{"backup-root": "s3://from-file", "target": "pvc-env", "outfile": "/restore/env.raw"},
+		},
+		{
+			name:     "command line over environment and file",
+			args:     []string{"-target", "pvc-flag", "-jobs", "2", "-verify=false"},
+			env:      map[string]string{"LHBR_TARGET": "pvc-env", "LHBR_JOBS": "4"},
+			expected: map[string]string{"target": "pvc-flag", "jobs": "2", "verify": "false"},
+		},
+		{
+			name:     "older environment fallbacks over file",
+			env:      map[string]string{"WEBDAV_TOKEN": "env-token"},
+			expected: map[string]string{"webdav-token": ""},
+		},
+	}
+	for _, config := range []string{yamlConfig, jsonConfig} {
+		for _, tt := range tests {
+			t.Run(filepath.Ext(config)+"/"+tt.name, func(t *testing.T) {
+				flags := flag.NewFlagSet("test", flag.ContinueOnError)
+				flags.String("backup-root", "", "")
+				flags.String("target", "", "")
+				flags.String("outfile", "", "")
+				flags.Int("jobs", 1, "")
+				flags.Bool("verify", false, "")
+				flags.String("webdav-token", "", "")
+				flags.Duration("nfs-timeout", 0, "")
+				flags.String("before", "", "")
+				if err := flags.Parse(tt.args); err != nil {
+					t.Fatal(err)
+				}
+
+				values, err := loadConfig(flags, config)
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				getenv := func(name string) string { return tt.env[name] }
+				if err := applySettings(flags, values, getenv); err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				for name, expected := range tt.expected {
+					if got := flags.Lookup(name).Value.String(); got != expected {
+						t.Errorf("Expected -%s %q, got %q", name, expected, got)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		message string
+	}{
+		{name: "unknown key", content: "backupRot: /backups\n", message: `unknown setting "backupRot"`},
+		{name: "list value", content: "target: [a, b]\n", message: "must be a string, number or boolean"},
+		{name: "empty value", content: "target:\n", message: "must be a string, number or boolean"},
+		{name: "config key", content: "config: other.yaml\n", message: `unknown setting "config"`},
+		{name: "invalid syntax", content: "target: [\n", message: "failed to parse"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flags := flag.NewFlagSet("test", flag.ContinueOnError)
+			flags.String("config", "", "")
+			flags.String("backup-root", "", "")
+			flags.String("target", "", "")
+			_, err := loadConfig(flags, writeTestConfig(t, "config.yaml", tt.content))
+			if err == nil || !strings.Contains(err.Error(), tt.message) {
+				t.Errorf("Expected error containing %q, got %v", tt.message, err)
+			}
+		})
+	}
+
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.Int("jobs", 1, "")
+	err := applySettings(flags, map[string]string{"jobs": "many"}, func(string) string { return "" })
+	if err == nil || !strings.Contains(err.Error(), "jobs") {
+		t.Errorf("Expected error for an invalid value, got %v", err)
+	}
+}
+
+func TestConfigFlagName(t *testing.T) {
+	tests := map[string]string{
+		"backupRoot":          "backup-root",
+		"sshSkipHostKeyCheck": "ssh-skip-host-key-check",
+		"backup-root":         "backup-root",
+		"jobs":                "jobs",
+	}
+	for key, expected := range tests {
+		if got := configFlagName(key); got != expected {
+			t.Errorf("Expected %s for %s, got %s", expected, key, got)
+		}
+	}
+}
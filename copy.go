@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+)
+
+// copyResult is what copyChain merged into the destination, and what it
+// found there already
+type copyResult struct {
+	Backups        int
+	BackupsPresent int
+	Blocks         int
+	BlocksPresent  int
+	// Bytes is the size of the block files copied, compressed as they are
+	// stored
+	Bytes int64
+}
+
+// copyConflictError is a cfg file the destination has with other contents
+// than the one copied over it would have
+type copyConflictError struct {
+	path string
+}
+
+func (e *copyConflictError) Error() string {
+	return fmt.Sprintf("%s differs from the one in -backup-root, not overwriting it", e.path)
+}
+
+// copyChain merges backups of volume, their cfg files and the blocks they
+// reference into the backupstore of the local backup root dest, which may
+// already hold the volume and some of them. A block dest has a file for
+// is not copied again, and a cfg file it has is kept when it is the same,
+// or else stops the copy before anything is written, so a copy that was
+// interrupted can be run again. As with exportChain, blocks are checked
+// before they are written and the cfg files are written last. The copy
+// ends by reading the volume back from dest, checking that it has every
+// backup copied and every block they reference.
+func copyChain(store fs.FS, volume *backupstore.VolumeBackup, backups []backupstore.Backup, dest string, jobs int, progress io.Writer, level verbosity) (copyResult, error) {
+	result := copyResult{}
+	destStore := os.DirFS(filepath.Join(dest, "backupstore"))
+	// Longhorn shards volumes by name, so the volume is at the same path
+	// in dest unless it was put elsewhere
+	volumePath, err := backupstore.FindVolumeBackupPath(destStore, volume.Name)
+	switch {
+	case errors.Is(err, backupstore.ErrVolumeNotFound):
+		volumePath = volume.BackupPath
+	case err != nil:
+		return result, err
+	}
+	volumeDir := filepath.Join(dest, "backupstore", filepath.FromSlash(volumePath))
+
+	var pending []backupstore.Backup
+	cfgs := make(map[string][]byte)
+	for _, backup := range backups {
+		data, err := fs.ReadFile(store, backup.ConfigPath)
+		if err != nil {
+			return result, err
+		}
+		name := filepath.Join(volumeDir, "backups", path.Base(backup.ConfigPath))
+		existing, err := os.ReadFile(name)
+		switch {
+		case err == nil && bytes.Equal(existing, data):
+			result.BackupsPresent++
+			continue
+		case err == nil:
+			return result, &copyConflictError{path: name}
+		case !errors.Is(err, fs.ErrNotExist):
+			return result, err
+		}
+		pending = append(pending, backup)
+		cfgs[name] = data
+	}
+
+	// the blocks an interrupted copy got through are all there, as each is
+	// renamed into place once written
+	have, err := backupstore.ListBlocks(destStore, volumePath)
+	if err != nil {
+		return result, err
+	}
+	referenced := blockCount(backups, nil)
+	missing := blockCount(backups, have)
+	result.BlocksPresent = referenced - missing
+	blocks, n, err := exportBlocks(store, volume.BackupPath, volumeDir, backups, have, jobs, newPassProgress(progress, "[copy]", missing, level))
+	result.Bytes = n
+	if err != nil {
+		return result, err
+	}
+	result.Blocks = blocks
+
+	// the volume.cfg of dest is kept, as Longhorn may have updated it
+	data, err := fs.ReadFile(store, path.Join(volume.BackupPath, "volume.cfg"))
+	switch {
+	case err == nil:
+		name := filepath.Join(volumeDir, "volume.cfg")
+		if _, err := os.Stat(name); errors.Is(err, fs.ErrNotExist) {
+			if err := writeExportFile(name, data); err != nil {
+				return result, err
+			}
+		}
+	case !errors.Is(err, fs.ErrNotExist):
+		return result, err
+	}
+	for _, backup := range pending {
+		name := filepath.Join(volumeDir, "backups", path.Base(backup.ConfigPath))
+		if err := writeExportFile(name, cfgs[name]); err != nil {
+			return result, err
+		}
+		result.Backups++
+	}
+
+	fmt.Fprintf(progress, "Verifying %s in %s\n", volume.Name, dest)
+	if err := verifyCopy(destStore, volumePath, backups); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// verifyCopy checks that the volume in volumePath of the destination has
+// every one of backups, and every block they reference
+func verifyCopy(destStore fs.FS, volumePath string, backups []backupstore.Backup) error {
+	copied, err := backupstore.ReadBackups(destStore, volumePath)
+	if err != nil {
+		return err
+	}
+	found := make(map[string]struct{})
+	for _, backup := range copied.Backups {
+		found[path.Base(backup.ConfigPath)] = struct{}{}
+	}
+	missingBackups := 0
+	for _, backup := range backups {
+		if _, ok := found[path.Base(backup.ConfigPath)]; !ok {
+			missingBackups++
+		}
+	}
+	have, err := backupstore.ListBlocks(destStore, volumePath)
+	if err != nil {
+		return err
+	}
+	if missing := blockCount(backups, have); missing > 0 || missingBackups > 0 {
+		return &backupstore.BlockError{Err: fmt.Errorf("the copy is missing %d of %d backups and %d of %d blocks", missingBackups, len(backups), missing, blockCount(backups, nil))}
+	}
+	return nil
+}
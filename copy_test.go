@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+)
+
+func TestCopyChain(t *testing.T) {
+	root := t.TempDir()
+	volumePath := filepath.Join(root, "volumes", "ab", "cd", "pvc-1")
+	a := writeTestBlock(t, volumePath, testBlockData(1, 4096))
+	b := writeTestBlock(t, volumePath, testBlockData(2, 4096))
+	c := writeTestBlock(t, volumePath, testBlockData(3, 4096))
+	writeTestBackupCfg(t, volumePath, "backup-1", a, b)
+	writeTestBackupCfg(t, volumePath, "backup-2", a, c)
+	store := os.DirFS(root)
+	volume, err := backupstore.ReadBackups(store, "volumes/ab/cd/pvc-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := selectBackup(volume.Backups, "backup-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dest := t.TempDir()
+	result, err := copyChain(store, volume, first, dest, 2, io.Discard, verbosityNormal)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if result.Backups != 1 || result.Blocks != 2 || result.BlocksPresent != 0 {
+		t.Errorf("Expected backup-1 and 2 blocks copied, got %+v", result)
+	}
+
+	// backup-2 shares a with backup-1, which is already there
+	result, err = copyChain(store, volume, volume.Backups, dest, 2, io.Discard, verbosityNormal)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if result.Backups != 1 || result.BackupsPresent != 1 || result.Blocks != 1 || result.BlocksPresent != 2 {
+		t.Errorf("Expected backup-2 and its new block copied next to backup-1, got %+v", result)
+	}
+	result, err = copyChain(store, volume, volume.Backups, dest, 2, io.Discard, verbosityNormal)
+	if err != nil || result.Backups != 0 || result.Blocks != 0 || result.BackupsPresent != 2 {
+		t.Errorf("Expected a second run to copy nothing, got %+v and %v", result, err)
+	}
+
+	copiedPath := filepath.Join(dest, "backupstore", "volumes", "ab", "cd", "pvc-1")
+	if err := os.Remove(filepath.Join(copiedPath, "blocks", c[0:2], c[2:4], c+".blk")); err != nil {
+		t.Fatal(err)
+	}
+	var blockErr *backupstore.BlockError
+	if err := verifyCopy(os.DirFS(filepath.Join(dest, "backupstore")), "volumes/ab/cd/pvc-1", volume.Backups); !errors.As(err, &blockErr) {
+		t.Errorf("Expected a BlockError for the missing block, got %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(copiedPath, "backups", "backup_backup-1.cfg"), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var conflict *copyConflictError
+	if _, err := copyChain(store, volume, volume.Backups, dest, 2, io.Discard, verbosityNormal); !errors.As(err, &conflict) {
+		t.Fatalf("Expected a conflict with the changed cfg file, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(copiedPath, "blocks", c[0:2], c[2:4], c+".blk")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected nothing copied after a conflict, got %v", err)
+	}
+}
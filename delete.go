@@ -0,0 +1,130 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"slices"
+
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+)
+
+// backupDeletion is what deleting a backup removes: its cfg file, then
+// the blocks no other backup of any volume references
+type backupDeletion struct {
+	Config storeFile
+	Blocks []storeFile
+	// Shared are the blocks of the backup other backups reference, and
+	// Missing those already missing from the store
+	Shared  int
+	Missing int
+}
+
+// planBackupDeletion works out what deleting backup of the volume in
+// volumePath removes, see storeReferences
+func planBackupDeletion(store fs.FS, volumePath string, backup backupstore.Backup) (*backupDeletion, error) {
+	referenced, _, err := storeReferences(store, backup.ConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	info, err := fs.Stat(store, backup.ConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	plan := &backupDeletion{Config: storeFile{Path: backup.ConfigPath, Size: info.Size()}}
+
+	seen := make(map[string]struct{})
+	for _, block := range backup.Blocks {
+		if _, ok := seen[block.Checksum]; ok {
+			continue
+		}
+		seen[block.Checksum] = struct{}{}
+		if _, ok := referenced[block.Checksum]; ok {
+			plan.Shared++
+			continue
+		}
+		blockPath, info, err := backupstore.StatBlock(store, volumePath, block.Checksum)
+		if errors.Is(err, fs.ErrNotExist) {
+			plan.Missing++
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		plan.Blocks = append(plan.Blocks, storeFile{Path: blockPath, Checksum: block.Checksum, Size: info.Size()})
+	}
+	slices.SortFunc(plan.Blocks, func(a, b storeFile) int {
+		return cmp.Compare(a.Path, b.Path)
+	})
+	return plan, nil
+}
+
+// printDeletionPlan lists what deleting a backup would remove
+func printDeletionPlan(w io.Writer, plan *backupDeletion, display func(name string) string) {
+	fmt.Fprintf(w, "Would remove %s\n", display(plan.Config.Path))
+	var reclaimed int64
+	for _, block := range plan.Blocks {
+		reclaimed += block.Size
+		fmt.Fprintf(w, "Would remove %s (%s)\n", display(block.Path), formatBytes(block.Size))
+	}
+	fmt.Fprintf(w, "Dry run: the backup and %d blocks would be removed, reclaiming %s\n", len(plan.Blocks), formatSize(reclaimed))
+	printDeletionKept(w, plan)
+}
+
+func printDeletionKept(w io.Writer, plan *backupDeletion) {
+	if plan.Shared > 0 {
+		fmt.Fprintf(w, "%d blocks are kept, as other backups reference them\n", plan.Shared)
+	}
+	if plan.Missing > 0 {
+		fmt.Fprintf(w, "%d blocks were already missing from the store\n", plan.Missing)
+	}
+}
+
+// deleteBackup runs the delete-backup command for backup of the volume in
+// volumePath and returns its exit status. The cfg file is removed first,
+// so a deletion that stops early leaves orphaned blocks for prune rather
+// than a backup missing blocks.
+func deleteBackup(store fs.FS, backupRoot, backupStorePath, volumePath string, backup backupstore.Backup, dryRun bool, logPath string, out io.Writer, logger *slog.Logger) int {
+	display := func(name string) string {
+		return displayPath(backupStorePath, name)
+	}
+	if !dryRun && !removable(logger, "delete-backup", backupRoot) {
+		return exitUsage
+	}
+
+	plan, err := planBackupDeletion(store, volumePath, backup)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Refusing to delete %s", display(backup.ConfigPath)), "error", err)
+		return exitFailure
+	}
+	if dryRun {
+		printDeletionPlan(out, plan, display)
+		return 0
+	}
+
+	log, err := openAppendLog(logPath, fmt.Sprintf("delete-backup of %s, %d blocks", display(backup.ConfigPath), len(plan.Blocks)))
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to open prune log %s", logPath), "error", err)
+		return exitOutputError
+	}
+	defer log.Close()
+	remove := localRemover(backupStorePath)
+	if err := removeLogged(plan.Config, remove, display, out, log); err != nil {
+		return exitFailure
+	}
+	removed, reclaimed, failed := pruneBlocks(plan.Blocks, remove, display, out, log)
+	if err := log.Sync(); err != nil {
+		logger.Error(fmt.Sprintf("Failed to write prune log %s", logPath), "error", err)
+		return exitOutputError
+	}
+	fmt.Fprintf(out, "Deleted backup %s and %d blocks, reclaiming %s, logged to %s\n", backup.Identifier, removed, formatSize(reclaimed), logPath)
+	printDeletionKept(out, plan)
+	if failed > 0 {
+		logger.Error(fmt.Sprintf("Failed to remove %d blocks, prune can remove them later", failed))
+		return exitFailure
+	}
+	return 0
+}
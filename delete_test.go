@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+)
+
+func TestDeleteBackup(t *testing.T) {
+	root := t.TempDir()
+	first := filepath.Join(root, "volumes", "ab", "cd", "pvc-1")
+	second := filepath.Join(root, "volumes", "ef", "01", "pvc-2")
+	a := writeTestBlock(t, first, testBlockData(1, 4096))
+	b := writeTestBlock(t, first, testBlockData(2, 4096))
+	c := writeTestBlock(t, first, testBlockData(3, 4096))
+	writeTestBlock(t, second, testBlockData(3, 4096))
+	missing := strings.Repeat("d4", 64)
+	writeTestBackupCfg(t, first, "backup-1", a, b, c, missing)
+	writeTestBackupCfg(t, first, "backup-2", a)
+	// c is kept, as pvc-2 references it as well
+	writeTestBackupCfg(t, second, "backup-1", c)
+	store := os.DirFS(root)
+	volume, err := backupstore.ReadBackups(store, "volumes/ab/cd/pvc-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup, err := selectBackup(volume.Backups, "backup-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := planBackupDeletion(store, volume.BackupPath, backup[0])
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(plan.Blocks) != 1 || plan.Blocks[0].Checksum != b || plan.Shared != 2 || plan.Missing != 1 {
+		t.Errorf("Expected only %s to be removed, got %+v", b, plan)
+	}
+
+	var out bytes.Buffer
+	if code := deleteBackup(store, root, root, volume.BackupPath, backup[0], true, "", &out, newLogger(&out, "text", slog.LevelInfo)); code != 0 {
+		t.Fatalf("Expected the dry run to succeed, got exit status %d: %s", code, out.String())
+	}
+	if line := "Dry run: the backup and 1 blocks would be removed"; !strings.Contains(out.String(), line) {
+		t.Errorf("Expected %q in the dry run, got %q", line, out.String())
+	}
+
+	logPath := filepath.Join(t.TempDir(), "prune.log")
+	out.Reset()
+	if code := deleteBackup(store, root, root, volume.BackupPath, backup[0], false, logPath, &out, newLogger(&out, "text", slog.LevelInfo)); code != 0 {
+		t.Fatalf("Expected the deletion to succeed, got exit status %d: %s", code, out.String())
+	}
+	for _, name := range []string{
+		filepath.Join(first, "backups", "backup_backup-1.cfg"),
+		filepath.Join(first, "blocks", b[0:2], b[2:4], b+".blk"),
+	} {
+		if _, err := os.Stat(name); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Expected %s to be removed, got %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(first, "blocks", c[0:2], c[2:4], c+".blk")); err != nil {
+		t.Errorf("Expected the block pvc-2 references to be kept, got %v", err)
+	}
+	log, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removals := strings.Count(string(log), "\tremoved\t"); removals != 2 {
+		t.Errorf("Expected the cfg file and the block to be logged, got %q", log)
+	}
+
+	// an unreadable cfg anywhere in the store stops the deletion
+	if err := os.WriteFile(filepath.Join(second, "backups", "backup_backup-2.cfg"), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := planBackupDeletion(store, volume.BackupPath, volume.Backups[1]); err == nil {
+		t.Errorf("Expected the unreadable cfg to stop the deletion")
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+)
+
+// backupDescription is what describe reports about one backup
+type backupDescription struct {
+	Identifier  string            `json:"identifier"`
+	Snapshot    string            `json:"snapshot,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Created     time.Time         `json:"created"`
+	Size        int64             `json:"size"`
+	Compression string            `json:"compression"`
+	Blocks      int               `json:"blocks"`
+	// Empty is set for a backup without blocks, of a volume that held
+	// no data
+	Empty bool `json:"empty,omitempty"`
+	// NewBlocks are the checksums no earlier backup references, and
+	// NewBytes what they take in the store, or -1 when not statted
+	NewBlocks int   `json:"newBlocks"`
+	NewBytes  int64 `json:"newBytes"`
+	blocks    []backupstore.Block
+	added     []string
+}
+
+// volumeDescription is what describe reports from volume.cfg, with the
+// times as Longhorn wrote them
+type volumeDescription struct {
+	Created      string            `json:"created,omitempty"`
+	LastBackup   string            `json:"lastBackup,omitempty"`
+	LastBackupAt string            `json:"lastBackupAt,omitempty"`
+	BackingImage string            `json:"backingImage,omitempty"`
+	StorageClass string            `json:"storageClass,omitempty"`
+	DataEngine   string            `json:"dataEngine,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+}
+
+// chainDescription is what describe reports about the backups of a
+// volume
+type chainDescription struct {
+	VolumeSize int64 `json:"volumeSize,omitempty"`
+	// Volume is nil without a volume.cfg
+	Volume *volumeDescription `json:"volume,omitempty"`
+	// Filesystem is what the block at offset 0 of the newest backup holds,
+	// and FilesystemSize how large it says it is, or 0 when it doesn't
+	// say. It's empty when that block can't be read.
+	Filesystem      string              `json:"filesystem,omitempty"`
+	FilesystemLabel string              `json:"filesystemLabel,omitempty"`
+	FilesystemUUID  string              `json:"filesystemUUID,omitempty"`
+	FilesystemSize  int64               `json:"filesystemSize,omitempty"`
+	Backups         []backupDescription `json:"backups"`
+	// ReferencedBlocks counts the blocks of every backup, and UniqueBlocks
+	// the checksums among them, each stored once. ZeroReferences are
+	// references to the all-zero block.
+	ReferencedBlocks int     `json:"referencedBlocks"`
+	UniqueBlocks     int     `json:"uniqueBlocks"`
+	DedupRatio       float64 `json:"dedupRatio"`
+	ZeroReferences   int     `json:"zeroReferences"`
+	// ChecksumAlgorithms are the hashes the blocks are named after,
+	// detected from the length of their checksums
+	ChecksumAlgorithms []string `json:"checksumAlgorithms,omitempty"`
+	// DiskSize is what the unique blocks take in the store, or -1 when
+	// their files were not statted, and MissingBlocks were not found
+	DiskSize      int64 `json:"diskSize"`
+	MissingBlocks int   `json:"missingBlocks"`
+}
+
+// zeroBlockChecksum is the checksum of a whole block of zeroes, which
+// every backup of an empty region of the volume shares
+var zeroBlockChecksum = func() string {
+	sum := sha512.Sum512(make([]byte, backupstore.MaxBlockSize))
+	return hex.EncodeToString(sum[:])
+}()
+
+// describeChain sizes the backups of volume from their cfg files, and
+// stats the file of every unique block unless fast is set. The backups
+// are in timestamp order, so the new blocks of each are those no earlier
+// backup references.
+func describeChain(store fs.FS, volume *backupstore.VolumeBackup, fast bool) chainDescription {
+	description := chainDescription{VolumeSize: volume.Size, DiskSize: -1}
+	if cfg := volume.Config; cfg != nil {
+		description.Volume = &volumeDescription{
+			Created:      cfg.CreatedTime,
+			LastBackup:   cfg.LastBackupName,
+			LastBackupAt: cfg.LastBackupAt,
+			BackingImage: cfg.BackingImageName,
+			StorageClass: cfg.StorageClassName,
+			DataEngine:   cfg.DataEngine,
+			Labels:       cfg.Labels,
+		}
+	}
+	if filesystem, err := detectFilesystem(store, volume.BackupPath, volume.Backups); err == nil {
+		description.Filesystem = filesystem.Type
+		description.FilesystemLabel = filesystem.Label
+		description.FilesystemUUID = filesystem.UUID
+		description.FilesystemSize = filesystem.Size()
+	}
+
+	// references counts the backups' references to each checksum
+	references := make(map[string]int)
+	for _, backup := range volume.Backups {
+		described := backupDescription{
+			Identifier:  backup.Identifier,
+			Snapshot:    backup.SnapshotName,
+			Labels:      backup.Labels,
+			Created:     backup.Timestamp,
+			Size:        backup.Size,
+			Compression: backup.Compression,
+			Blocks:      len(backup.Blocks),
+			Empty:       len(backup.Blocks) == 0,
+			NewBytes:    -1,
+			blocks:      backup.Blocks,
+		}
+		description.ReferencedBlocks += len(backup.Blocks)
+		for _, block := range backup.Blocks {
+			if references[block.Checksum] == 0 {
+				described.added = append(described.added, block.Checksum)
+			}
+			references[block.Checksum]++
+		}
+		described.NewBlocks = len(described.added)
+		description.Backups = append(description.Backups, described)
+	}
+	description.UniqueBlocks = len(references)
+	algorithms := make(map[string]struct{})
+	for checksum := range references {
+		// ReadBackups already rejected checksums of no algorithm
+		if algorithm, err := backupstore.ChecksumAlgorithm(checksum); err == nil {
+			algorithms[algorithm] = struct{}{}
+		}
+	}
+	description.ChecksumAlgorithms = slices.Sorted(maps.Keys(algorithms))
+	description.ZeroReferences = references[zeroBlockChecksum]
+	if description.UniqueBlocks > 0 {
+		description.DedupRatio = float64(description.ReferencedBlocks) / float64(description.UniqueBlocks)
+	}
+	if fast {
+		return description
+	}
+
+	// each checksum is new in exactly one backup, so summing what the
+	// blocks new in each take sums the unique blocks
+	description.DiskSize = 0
+	for i := range description.Backups {
+		backup := &description.Backups[i]
+		backup.NewBytes = 0
+		for _, checksum := range backup.added {
+			_, info, err := backupstore.StatBlock(store, volume.BackupPath, checksum)
+			if err != nil {
+				description.MissingBlocks++
+				continue
+			}
+			backup.NewBytes += info.Size()
+		}
+		description.DiskSize += backup.NewBytes
+	}
+	return description
+}
+
+// formatSize is a size in bytes followed by its human readable form
+func formatSize(n int64) string {
+	return fmt.Sprintf("%d bytes (%s)", n, formatBytes(n))
+}
+
+// printDescription writes d as JSON, or as text listing the blocks of
+// every backup
+func printDescription(w io.Writer, d chainDescription, format string) error {
+	if format == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(d)
+	}
+	if d.VolumeSize > 0 {
+		fmt.Fprintf(w, "Volume Size: %s\n", formatSize(d.VolumeSize))
+	}
+	if v := d.Volume; v != nil {
+		if v.Created != "" {
+			fmt.Fprintf(w, "Volume Created: %s\n", v.Created)
+		}
+		switch {
+		case v.LastBackup != "" && v.LastBackupAt != "":
+			fmt.Fprintf(w, "Last Backup: %s (at %s)\n", v.LastBackup, v.LastBackupAt)
+		case v.LastBackup != "":
+			fmt.Fprintf(w, "Last Backup: %s\n", v.LastBackup)
+		}
+		if v.BackingImage != "" {
+			fmt.Fprintf(w, "Backing Image: %s\n", v.BackingImage)
+		}
+		if v.StorageClass != "" {
+			fmt.Fprintf(w, "Storage Class: %s\n", v.StorageClass)
+		}
+		if v.DataEngine != "" {
+			fmt.Fprintf(w, "Data Engine: %s\n", v.DataEngine)
+		}
+		for _, key := range slices.Sorted(maps.Keys(v.Labels)) {
+			fmt.Fprintf(w, "Volume Label: %s=%s\n", key, v.Labels[key])
+		}
+	}
+	if d.Filesystem != "" {
+		fmt.Fprintf(w, "Filesystem: %s\n", d.Filesystem)
+	}
+	if d.FilesystemLabel != "" {
+		fmt.Fprintf(w, "Filesystem Label: %s\n", d.FilesystemLabel)
+	}
+	if d.FilesystemUUID != "" {
+		fmt.Fprintf(w, "Filesystem UUID: %s\n", d.FilesystemUUID)
+	}
+	if d.FilesystemSize > 0 {
+		fmt.Fprintf(w, "Filesystem Size: %s", formatSize(d.FilesystemSize))
+		if d.VolumeSize > 0 && d.FilesystemSize > d.VolumeSize {
+			fmt.Fprint(w, ", larger than the volume")
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintf(w, "Number of Backups: %d\n", len(d.Backups))
+	for _, backup := range d.Backups {
+		fmt.Fprintf(w, "Backup: %s\n", backup.Identifier)
+		if backup.Snapshot != "" {
+			fmt.Fprintf(w, "Snapshot: %s\n", backup.Snapshot)
+		}
+		for _, key := range slices.Sorted(maps.Keys(backup.Labels)) {
+			fmt.Fprintf(w, "Label: %s=%s\n", key, backup.Labels[key])
+		}
+		fmt.Fprintf(w, "Created: %s\n", backup.Created)
+		fmt.Fprintf(w, "Size: %s\n", formatSize(backup.Size))
+		fmt.Fprintf(w, "Compression: %s\n", backup.Compression)
+		if backup.Empty {
+			fmt.Fprintf(w, "Blocks: 0 (empty, the volume held no data)\n")
+		} else {
+			fmt.Fprintf(w, "Blocks: %d\n", backup.Blocks)
+		}
+		if backup.NewBytes < 0 {
+			fmt.Fprintf(w, "New Blocks: %d\n", backup.NewBlocks)
+		} else {
+			fmt.Fprintf(w, "New Blocks: %d, %s\n", backup.NewBlocks, formatSize(backup.NewBytes))
+		}
+		for _, block := range backup.blocks {
+			fmt.Fprintf(w, "[block] Checksum: %s; Offset: %d\n", block.Checksum, block.Offset)
+		}
+	}
+	fmt.Fprintf(w, "Referenced Blocks: %d\n", d.ReferencedBlocks)
+	fmt.Fprintf(w, "Unique Blocks: %d\n", d.UniqueBlocks)
+	if len(d.ChecksumAlgorithms) > 0 {
+		fmt.Fprintf(w, "Checksum Algorithm: %s\n", strings.Join(d.ChecksumAlgorithms, ", "))
+	}
+	fmt.Fprintf(w, "Deduplication Ratio: %.2f\n", d.DedupRatio)
+	if d.ReferencedBlocks > 0 {
+		fmt.Fprintf(w, "Zero Block References: %d (%.1f%%)\n", d.ZeroReferences, 100*float64(d.ZeroReferences)/float64(d.ReferencedBlocks))
+	}
+	switch {
+	case d.DiskSize < 0:
+		fmt.Fprintf(w, "Size on Disk: not checked (-fast)\n")
+	case d.MissingBlocks > 0:
+		fmt.Fprintf(w, "Size on Disk: %s, %d blocks missing from the store\n", formatSize(d.DiskSize), d.MissingBlocks)
+	default:
+		fmt.Fprintf(w, "Size on Disk: %s\n", formatSize(d.DiskSize))
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+)
+
+// writeSizedBlock stores a block file of size bytes under checksum, for
+// tests that only stat blocks
+func writeSizedBlock(t *testing.T, volumePath, checksum string, size int) {
+	t.Helper()
+	dir := filepath.Join(volumePath, "blocks", checksum[0:2], checksum[2:4])
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, checksum+".blk"), make([]byte, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDescribeChain(t *testing.T) {
+	volumePath := t.TempDir()
+	a, b, c, missing := strings.Repeat("a1", 64), strings.Repeat("b2", 64), zeroBlockChecksum, strings.Repeat("d4", 64)
+	writeSizedBlock(t, volumePath, a, 1000)
+	writeSizedBlock(t, volumePath, b, 300)
+	writeSizedBlock(t, volumePath, c, 25)
+	volume := &backupstore.VolumeBackup{
+		BackupPath: ".",
+		Size:       8 << 20,
+		Config:     &backupstore.VolumeConfig{CreatedTime: "2023-12-01T00:00:00Z", LastBackupName: "backup-2", LastBackupAt: "2024-01-02T00:00:00Z", BackingImageName: "ubuntu-22.04"},
+		Backups: []backupstore.Backup{
+			{Identifier: "backup-1", Timestamp: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), Size: 4 << 20, Compression: "lz4", Blocks: []backupstore.Block{
+				{Offset: 0, Checksum: a},
+				{Offset: 2 << 20, Checksum: b},
+			}},
+			{Identifier: "backup-2", Timestamp: time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), Size: 6 << 20, Compression: "lz4", SnapshotName: "snapshot-2", Labels: map[string]string{"longhorn.io/volume-access-mode": "rwo"}, Blocks: []backupstore.Block{
+				{Offset: 0, Checksum: a},
+				{Offset: 2 << 20, Checksum: c},
+				{Offset: 4 << 20, Checksum: b},
+				{Offset: 6 << 20, Checksum: missing},
+			}},
+		},
+	}
+
+	d := describeChain(os.DirFS(volumePath), volume, false)
+	if d.ReferencedBlocks != 6 || d.UniqueBlocks != 4 {
+		t.Errorf("Expected 6 referenced and 4 unique blocks, got %d and %d", d.ReferencedBlocks, d.UniqueBlocks)
+	}
+	if d.DedupRatio != 1.5 || d.ZeroReferences != 1 {
+		t.Errorf("Expected a ratio of 1.5 and 1 zero block reference, got %v and %d", d.DedupRatio, d.ZeroReferences)
+	}
+	if d.DiskSize != 1325 || d.MissingBlocks != 1 {
+		t.Errorf("Expected 1325 bytes on disk and 1 missing block, got %d and %d", d.DiskSize, d.MissingBlocks)
+	}
+	if len(d.Backups) != 2 || d.Backups[0].Blocks != 2 || d.Backups[1].Blocks != 4 || d.Backups[1].Size != 6<<20 {
+		t.Errorf("Expected backups of 2 and 4 blocks, got %+v", d.Backups)
+	}
+
+	var out bytes.Buffer
+	if err := printDescription(&out, d, "text"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, line := range []string{
+		"Volume Size: 8388608 bytes (8.0 MiB)\n",
+		"Volume Created: 2023-12-01T00:00:00Z\n",
+		"Last Backup: backup-2 (at 2024-01-02T00:00:00Z)\n",
+		"Backing Image: ubuntu-22.04\n",
+		"Size: 6291456 bytes (6.0 MiB)\n",
+		"Snapshot: snapshot-2\n",
+		"Label: longhorn.io/volume-access-mode=rwo\n",
+		"Unique Blocks: 4\n",
+		"Checksum Algorithm: sha512\n",
+		"Deduplication Ratio: 1.50\n",
+		"Zero Block References: 1 (16.7%)\n",
+		"Size on Disk: 1325 bytes (1.3 KiB), 1 blocks missing from the store\n",
+	} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("Expected %q in the description, got %q", line, out.String())
+		}
+	}
+
+	out.Reset()
+	if err := printDescription(&out, d, "json"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var decoded map[string]any
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if decoded["dedupRatio"] != 1.5 || decoded["zeroReferences"] != 1.0 || decoded["uniqueBlocks"] != 4.0 || fmt.Sprint(decoded["checksumAlgorithms"]) != "[sha512]" {
+		t.Errorf("Expected the ratio and block counts in the JSON description, got %s", out.String())
+	}
+
+	fast := describeChain(os.DirFS(volumePath), volume, true)
+	if fast.DiskSize != -1 || fast.UniqueBlocks != 4 {
+		t.Errorf("Expected -fast to count blocks without statting them, got %+v", fast)
+	}
+}
+
+func TestDescribeChainNewBlocks(t *testing.T) {
+	volumePath := t.TempDir()
+	a, b, c, d := strings.Repeat("a1", 64), strings.Repeat("b2", 64), strings.Repeat("c3", 64), strings.Repeat("d4", 64)
+	writeSizedBlock(t, volumePath, a, 1000)
+	writeSizedBlock(t, volumePath, b, 300)
+	writeSizedBlock(t, volumePath, c, 25)
+	writeSizedBlock(t, volumePath, d, 7)
+	volume := &backupstore.VolumeBackup{
+		BackupPath: ".",
+		Backups: []backupstore.Backup{
+			{Identifier: "backup-1", Blocks: []backupstore.Block{
+				{Offset: 0, Checksum: a},
+				{Offset: 2 << 20, Checksum: b},
+			}},
+			// only c is new, referenced twice
+			{Identifier: "backup-2", Blocks: []backupstore.Block{
+				{Offset: 0, Checksum: a},
+				{Offset: 2 << 20, Checksum: c},
+				{Offset: 4 << 20, Checksum: c},
+			}},
+			// b was dropped by backup-2, but is not new again
+			{Identifier: "backup-3", Blocks: []backupstore.Block{
+				{Offset: 0, Checksum: b},
+				{Offset: 2 << 20, Checksum: c},
+				{Offset: 4 << 20, Checksum: d},
+			}},
+			{Identifier: "backup-4", Blocks: []backupstore.Block{
+				{Offset: 0, Checksum: a},
+			}},
+		},
+	}
+
+	tests := []struct {
+		fast      bool
+		newBlocks []int
+		newBytes  []int64
+	}{
+		{false, []int{2, 1, 1, 0}, []int64{1300, 25, 7, 0}},
+		{true, []int{2, 1, 1, 0}, []int64{-1, -1, -1, -1}},
+	}
+	for _, test := range tests {
+		chain := describeChain(os.DirFS(volumePath), volume, test.fast)
+		for i, backup := range chain.Backups {
+			if backup.NewBlocks != test.newBlocks[i] || backup.NewBytes != test.newBytes[i] {
+				t.Errorf("Expected %s to add %d blocks of %d bytes with fast %v, got %d of %d", backup.Identifier, test.newBlocks[i], test.newBytes[i], test.fast, backup.NewBlocks, backup.NewBytes)
+			}
+		}
+		if !test.fast && chain.DiskSize != 1332 {
+			t.Errorf("Expected the new bytes to sum to the 1332 bytes on disk, got %d", chain.DiskSize)
+		}
+	}
+
+	chain := describeChain(os.DirFS(volumePath), volume, false)
+	var out bytes.Buffer
+	if err := printDescription(&out, chain, "text"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if line := "New Blocks: 1, 25 bytes (25 B)\n"; !strings.Contains(out.String(), line) {
+		t.Errorf("Expected %q in the description, got %q", line, out.String())
+	}
+	out.Reset()
+	if err := printDescription(&out, chain, "json"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var decoded struct {
+		Backups []struct {
+			NewBlocks int   `json:"newBlocks"`
+			NewBytes  int64 `json:"newBytes"`
+		} `json:"backups"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(decoded.Backups) != 4 || decoded.Backups[0].NewBlocks != 2 || decoded.Backups[0].NewBytes != 1300 {
+		t.Errorf("Expected newBlocks and newBytes in the JSON description, got %s", out.String())
+	}
+}
+
+func TestDescribeChainEmpty(t *testing.T) {
+	a := strings.Repeat("a1", 64)
+	volume := &backupstore.VolumeBackup{
+		BackupPath: ".",
+		Backups: []backupstore.Backup{
+			// backed up before anything was written to the volume
+			{Identifier: "backup-1"},
+			{Identifier: "backup-2", Blocks: []backupstore.Block{{Offset: 0, Checksum: a}}},
+		},
+	}
+	chain := describeChain(os.DirFS(t.TempDir()), volume, true)
+	if !chain.Backups[0].Empty || chain.Backups[1].Empty {
+		t.Errorf("Expected only backup-1 to be empty, got %+v", chain.Backups)
+	}
+	var out bytes.Buffer
+	if err := printDescription(&out, chain, "text"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if line := "Blocks: 0 (empty, the volume held no data)\n"; strings.Count(out.String(), line) != 1 {
+		t.Errorf("Expected backup-1 to be marked empty, got %q", out.String())
+	}
+}
+
+func TestDescribeChainFilesystem(t *testing.T) {
+	volumePath := t.TempDir()
+	swap := writeTestBlock(t, volumePath, swapTestImage(4096))
+	volume := &backupstore.VolumeBackup{
+		BackupPath: ".",
+		Size:       512 << 10,
+		Backups: []backupstore.Backup{
+			{Identifier: "backup-1", Compression: "lz4", Blocks: []backupstore.Block{{Offset: 0, Checksum: swap}}},
+		},
+	}
+	chain := describeChain(os.DirFS(volumePath), volume, true)
+	if chain.Filesystem != "swap" || chain.FilesystemLabel != "swap0" || chain.FilesystemSize != 1<<20 {
+		t.Errorf("Expected a 1MiB swap area labelled swap0, got %+v", chain)
+	}
+
+	var out bytes.Buffer
+	if err := printDescription(&out, chain, "text"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, line := range []string{
+		"Filesystem: swap\n",
+		"Filesystem Label: swap0\n",
+		"Filesystem UUID: 9b1f3c52-4e7a-4d18-a265-0cd38e417f06\n",
+		"Filesystem Size: 1048576 bytes (1.0 MiB), larger than the volume\n",
+	} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("Expected %q in the description, got %q", line, out.String())
+		}
+	}
+}
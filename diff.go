@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"slices"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+)
+
+// diffExtent is a run of contiguous blocks that changed the same way
+// between two backups
+type diffExtent struct {
+	// Change is added for blocks only the newer backup has, removed for
+	// blocks only the older one has, and changed for different checksums
+	Change string `json:"change"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+	Blocks int    `json:"blocks"`
+	// DifferentBytes are the bytes of the extent that differ once the
+	// blocks are decompressed, a missing block reading as zeroes, or -1
+	// without -content
+	DifferentBytes int64 `json:"differentBytes"`
+}
+
+// diffBlock is an offset whose block differs between the backups, with
+// the block each has there, or nil
+type diffBlock struct {
+	Offset   int64
+	Length   int64
+	From, To *backupstore.Block
+	// extent is the index of the extent the block is in
+	extent int
+}
+
+func (b diffBlock) change() string {
+	switch {
+	case b.From == nil:
+		return "added"
+	case b.To == nil:
+		return "removed"
+	}
+	return "changed"
+}
+
+// diffTotal counts the blocks, and their bytes, of one kind of change
+type diffTotal struct {
+	Blocks int   `json:"blocks"`
+	Bytes  int64 `json:"bytes"`
+}
+
+// backupDiff is what diff reports about two backups of a volume
+type backupDiff struct {
+	From        string       `json:"from"`
+	FromCreated time.Time    `json:"fromCreated"`
+	To          string       `json:"to"`
+	ToCreated   time.Time    `json:"toCreated"`
+	Extents     []diffExtent `json:"extents"`
+	Added       diffTotal    `json:"added"`
+	Removed     diffTotal    `json:"removed"`
+	Changed     diffTotal    `json:"changed"`
+	Unchanged   diffTotal    `json:"unchanged"`
+	// DifferentBytes sums those of the extents, or is -1 without -content
+	DifferentBytes int64 `json:"differentBytes"`
+	blocks         []diffBlock
+}
+
+// diffBackups compares the offset to checksum maps of two backups, each
+// on its own as -backup restores it. Each block covers a whole Longhorn
+// block, up to volumeSize when it is known.
+func diffBackups(from, to backupstore.Backup, volumeSize int64) backupDiff {
+	d := backupDiff{
+		From:           from.Identifier,
+		FromCreated:    from.Timestamp,
+		To:             to.Identifier,
+		ToCreated:      to.Timestamp,
+		Extents:        []diffExtent{},
+		DifferentBytes: -1,
+	}
+	blocks := make(map[int64]*diffBlock)
+	for _, block := range from.Blocks {
+		blocks[block.Offset] = &diffBlock{Offset: block.Offset, From: &block}
+	}
+	for _, block := range to.Blocks {
+		if b, ok := blocks[block.Offset]; ok {
+			b.To = &block
+		} else {
+			blocks[block.Offset] = &diffBlock{Offset: block.Offset, To: &block}
+		}
+	}
+
+	for _, offset := range slices.Sorted(maps.Keys(blocks)) {
+		b := blocks[offset]
+		b.Length = longhornBlockSize
+		if volumeSize > 0 {
+			b.Length = max(0, min(b.Length, volumeSize-offset))
+		}
+		if b.From != nil && b.To != nil && b.From.Checksum == b.To.Checksum {
+			d.Unchanged.Blocks++
+			d.Unchanged.Bytes += b.Length
+			continue
+		}
+		total := map[string]*diffTotal{"added": &d.Added, "removed": &d.Removed, "changed": &d.Changed}[b.change()]
+		total.Blocks++
+		total.Bytes += b.Length
+
+		// contiguous blocks that changed the same way make one extent
+		if n := len(d.Extents); n > 0 && d.Extents[n-1].Change == b.change() && d.Extents[n-1].Offset+d.Extents[n-1].Length == offset {
+			d.Extents[n-1].Length += b.Length
+			d.Extents[n-1].Blocks++
+		} else {
+			d.Extents = append(d.Extents, diffExtent{Change: b.change(), Offset: offset, Length: b.Length, Blocks: 1, DifferentBytes: -1})
+		}
+		b.extent = len(d.Extents) - 1
+		d.blocks = append(d.blocks, *b)
+	}
+	return d
+}
+
+// compareDiffContents decompresses the blocks of d that differ, jobs at a
+// time, and counts the bytes that differ within each extent
+func compareDiffContents(store fs.FS, backupPath string, from, to backupstore.Backup, d *backupDiff, opts restoreOptions) error {
+	jobs := max(opts.Jobs, 1)
+	progress := opts.Progress
+	if progress == nil {
+		progress = io.Discard
+	}
+
+	different := make([]int64, len(d.blocks))
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		done     int
+		firstErr error
+	)
+	status := newPassProgress(progress, "[diff]", len(d.blocks), opts.Verbosity)
+	status.limit(opts.Throttles)
+	work := make(chan int)
+	for range jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				b := d.blocks[i]
+				n, err := diffBlockContents(store, backupPath, b, from, to, opts.Cache)
+				mu.Lock()
+				done++
+				different[i] = n
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				status.block(done, b.Length, func() string {
+					return fmt.Sprintf("Block {offset=%d}", b.Offset)
+				})
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := range d.blocks {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+	status.close()
+	if firstErr != nil {
+		return firstErr
+	}
+
+	d.DifferentBytes = 0
+	for i := range d.Extents {
+		d.Extents[i].DifferentBytes = 0
+	}
+	for i, b := range d.blocks {
+		d.Extents[b.extent].DifferentBytes += different[i]
+		d.DifferentBytes += different[i]
+	}
+	return nil
+}
+
+// diffBlockContents counts the bytes of b that differ between the blocks
+// of the two backups, a missing or short block reading as zeroes
+func diffBlockContents(store fs.FS, backupPath string, b diffBlock, fromBackup, toBackup backupstore.Backup, cache *backupstore.BlockCache) (int64, error) {
+	load := func(block *backupstore.Block, backup backupstore.Backup) ([]byte, error) {
+		if block == nil {
+			return nil, nil
+		}
+		return cache.Load(store, backupPath, *block, backup.Compression, backup.BlockSize)
+	}
+	from, err := load(b.From, fromBackup)
+	if err != nil {
+		return 0, err
+	}
+	to, err := load(b.To, toBackup)
+	if err != nil {
+		return 0, err
+	}
+	at := func(data []byte, i int) byte {
+		if i < len(data) {
+			return data[i]
+		}
+		return 0
+	}
+	var n int64
+	for i := range int(b.Length) {
+		if at(from, i) != at(to, i) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// printBackupDiff writes d as JSON, or as a table of its extents followed
+// by the totals
+func printBackupDiff(w io.Writer, d backupDiff, format string) error {
+	if format == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(d)
+	}
+	content := d.DifferentBytes >= 0
+	fmt.Fprintf(w, "From: %s (created %s)\n", d.From, d.FromCreated.Format(time.RFC3339))
+	fmt.Fprintf(w, "To: %s (created %s)\n", d.To, d.ToCreated.Format(time.RFC3339))
+	if len(d.Extents) > 0 {
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		header := "CHANGE\tOFFSET\tLENGTH\tBLOCKS"
+		if content {
+			header += "\tDIFFERENT BYTES"
+		}
+		fmt.Fprintln(tw, header)
+		for _, extent := range d.Extents {
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%d", extent.Change, extent.Offset, extent.Length, extent.Blocks)
+			if content {
+				fmt.Fprintf(tw, "\t%d", extent.DifferentBytes)
+			}
+			fmt.Fprintln(tw)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(w, "Added: %d blocks, %s\n", d.Added.Blocks, formatSize(d.Added.Bytes))
+	fmt.Fprintf(w, "Removed: %d blocks, %s\n", d.Removed.Blocks, formatSize(d.Removed.Bytes))
+	fmt.Fprintf(w, "Changed: %d blocks, %s\n", d.Changed.Blocks, formatSize(d.Changed.Bytes))
+	fmt.Fprintf(w, "Unchanged: %d blocks, %s\n", d.Unchanged.Blocks, formatSize(d.Unchanged.Bytes))
+	if content {
+		fmt.Fprintf(w, "Different Bytes: %s\n", formatSize(d.DifferentBytes))
+	}
+	return nil
+}
+
+// diff runs diff for volume, comparing the backups -from and -to, and
+// returns the exit status
+func (in *invocation) diff(volume *backupstore.VolumeBackup) int {
+	var selected []backupstore.Backup
+	for _, name := range []string{*in.o.from, *in.o.to} {
+		backup, err := selectBackup(volume.Backups, name)
+		if err != nil {
+			in.log.Error(fmt.Sprintf("Failed to select a backup of %s", volume.Name), "error", err, "hint", availableBackups(volume.Backups))
+			return exitVolumeNotFound
+		}
+		selected = append(selected, backup[0])
+	}
+	from, to := selected[0], selected[1]
+
+	d := diffBackups(from, to, volume.Size)
+	if *in.o.content {
+		err := compareDiffContents(in.store, volume.BackupPath, from, to, &d, restoreOptions{
+			Jobs:      *in.o.jobs,
+			Progress:  in.progress,
+			Verbosity: in.level,
+			Cache:     in.cache,
+			Throttles: in.throttles,
+		})
+		if err != nil {
+			in.log.Error(fmt.Sprintf("Failed to compare the blocks of %s and %s", from.Identifier, to.Identifier), "error", err)
+			return exitCode(err)
+		}
+	}
+	if err := printBackupDiff(in.out, d, *in.o.listFormat); err != nil {
+		in.log.Error(fmt.Sprintf("Failed to compare %s and %s", from.Identifier, to.Identifier), "error", err)
+		return exitFailure
+	}
+	return 0
+}
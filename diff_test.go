@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+)
+
+func TestDiffBackups(t *testing.T) {
+	const mib = 1 << 20
+	from := backupstore.Backup{Identifier: "backup-1", Blocks: []backupstore.Block{
+		{Offset: 0, Checksum: "a"},
+		{Offset: 2 * mib, Checksum: "b"},
+		{Offset: 4 * mib, Checksum: "c"},
+		{Offset: 6 * mib, Checksum: "d"},
+		{Offset: 10 * mib, Checksum: "e"},
+	}}
+	to := backupstore.Backup{Identifier: "backup-2", Blocks: []backupstore.Block{
+		{Offset: 0, Checksum: "a"},
+		{Offset: 2 * mib, Checksum: "x"},
+		{Offset: 4 * mib, Checksum: "y"},
+		{Offset: 8 * mib, Checksum: "z"},
+		{Offset: 12 * mib, Checksum: "w"},
+	}}
+
+	d := diffBackups(from, to, 13*mib)
+	expected := []diffExtent{
+		{Change: "changed", Offset: 2 * mib, Length: 4 * mib, Blocks: 2, DifferentBytes: -1},
+		{Change: "removed", Offset: 6 * mib, Length: 2 * mib, Blocks: 1, DifferentBytes: -1},
+		{Change: "added", Offset: 8 * mib, Length: 2 * mib, Blocks: 1, DifferentBytes: -1},
+		{Change: "removed", Offset: 10 * mib, Length: 2 * mib, Blocks: 1, DifferentBytes: -1},
+		// cut off at the size of the volume
+		{Change: "added", Offset: 12 * mib, Length: mib, Blocks: 1, DifferentBytes: -1},
+	}
+	if len(d.Extents) != len(expected) {
+		t.Fatalf("Expected %d extents, got %+v", len(expected), d.Extents)
+	}
+	for i := range expected {
+		if d.Extents[i] != expected[i] {
+			t.Errorf("Expected extent %d to be %+v, got %+v", i, expected[i], d.Extents[i])
+		}
+	}
+	totals := []struct {
+		name     string
+		got      diffTotal
+		expected diffTotal
+	}{
+		{"added", d.Added, diffTotal{Blocks: 2, Bytes: 3 * mib}},
+		{"removed", d.Removed, diffTotal{Blocks: 2, Bytes: 4 * mib}},
+		{"changed", d.Changed, diffTotal{Blocks: 2, Bytes: 4 * mib}},
+		{"unchanged", d.Unchanged, diffTotal{Blocks: 1, Bytes: 2 * mib}},
+	}
+	for _, tt := range totals {
+		if tt.got != tt.expected {
+			t.Errorf("Expected %s to be %+v, got %+v", tt.name, tt.expected, tt.got)
+		}
+	}
+
+	if d := diffBackups(from, from, 0); len(d.Extents) != 0 || d.Unchanged.Blocks != 5 {
+		t.Errorf("Expected a backup to have no differences with itself, got %+v", d)
+	}
+}
+
+func TestCompareDiffContents(t *testing.T) {
+	volumePath := t.TempDir()
+	blockSize := 4096
+	first := testBlockData(1, blockSize)
+	second := bytes.Clone(first)
+	second[10], second[20], second[30] = 0, 0, 0
+	from := backupstore.Backup{Identifier: "backup-1", Compression: "lz4", Blocks: []backupstore.Block{
+		{Offset: 0, Checksum: writeTestBlock(t, volumePath, first)},
+	}}
+	to := backupstore.Backup{Identifier: "backup-2", Compression: "lz4", Blocks: []backupstore.Block{
+		{Offset: 0, Checksum: writeTestBlock(t, volumePath, second)},
+		{Offset: longhornBlockSize, Checksum: writeTestBlock(t, volumePath, append(make([]byte, 100), 1, 2, 3))},
+	}}
+
+	d := diffBackups(from, to, 0)
+	if err := compareDiffContents(os.DirFS(volumePath), ".", from, to, &d, restoreOptions{Jobs: 2}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// the added block differs from the zeroes before it in 3 bytes
+	if d.DifferentBytes != 6 || d.Extents[0].DifferentBytes != 3 || d.Extents[1].DifferentBytes != 3 {
+		t.Errorf("Expected 3 different bytes in each extent, got %+v", d.Extents)
+	}
+
+	var out bytes.Buffer
+	if err := printBackupDiff(&out, d, "text"); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"changed  0        2097152  1       3", "Different Bytes: 6 bytes"} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("Expected %q in the diff, got %q", line, out.String())
+		}
+	}
+	out.Reset()
+	if err := printBackupDiff(&out, d, "json"); err != nil {
+		t.Fatal(err)
+	}
+	var decoded backupDiff
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil || decoded.Added.Blocks != 1 || decoded.DifferentBytes != 6 {
+		t.Errorf("Expected the diff as JSON, got %s (%v)", out.String(), err)
+	}
+
+	// a block missing from the store fails the comparison
+	to.Blocks[1].Checksum = strings.Repeat("0", 128)
+	d = diffBackups(from, to, 0)
+	if err := compareDiffContents(os.DirFS(volumePath), ".", from, to, &d, restoreOptions{Jobs: 1}); exitCode(err) != exitBlockError {
+		t.Errorf("Expected a block error, got %v", err)
+	}
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// openDirect opens path with O_DIRECT, failing with errors.ErrUnsupported
+// on filesystems that don't take it
+func openDirect(path string, flag int) (*os.File, error) {
+	f, err := os.OpenFile(path, flag|syscall.O_DIRECT, 0666)
+	if errors.Is(err, syscall.EINVAL) {
+		return nil, errors.ErrUnsupported
+	}
+	return f, err
+}
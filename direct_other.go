@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func openDirect(path string, flag int) (*os.File, error) {
+	return nil, errors.New("direct I/O is only supported on Linux")
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// openTestDirectFile opens a file in a temporary directory for direct I/O,
+// skipping the test where that isn't possible
+func openTestDirectFile(t *testing.T) *directFile {
+	t.Helper()
+	if runtime.GOOS != "linux" {
+		t.Skip("direct I/O is only supported on Linux")
+	}
+	file, err := openDirect(filepath.Join(t.TempDir(), "image.raw"), os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	if errors.Is(err, errors.ErrUnsupported) {
+		t.Skip("the temporary directory doesn't support O_DIRECT")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { file.Close() })
+	return &directFile{File: file}
+}
+
+func TestDirectFile(t *testing.T) {
+	f := openTestDirectFile(t)
+	expected := make([]byte, 0, 3*directIOAlign)
+
+	aligned := alignedBuffer(2 * directIOAlign)
+	copy(aligned, testBlockData(1, len(aligned)))
+	expected = append(expected, aligned...)
+	if _, err := f.WriteAt(aligned, 0); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// a write inside a sector keeps the data around it
+	patch := testBlockData(2, 100)
+	copy(expected[5000:], patch)
+	if _, err := f.WriteAt(patch, 5000); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// a short tail ends the file where it ends, not at the next sector
+	tail := testBlockData(3, 3000)
+	expected = append(expected, tail...)
+	if _, err := f.WriteAt(tail, int64(2*directIOAlign)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != int64(len(expected)) {
+		t.Errorf("Expected a file of %d bytes, got %d", len(expected), info.Size())
+	}
+	// unaligned reads, like the probe of a superblock
+	got := make([]byte, len(expected))
+	if n, err := f.ReadAt(got, 0); n != len(expected) || err != nil {
+		t.Fatalf("Expected %d bytes, got %d and %v", len(expected), n, err)
+	}
+	if !bytes.Equal(got, expected) {
+		t.Error("Expected the file to hold what was written")
+	}
+	probe := make([]byte, 200)
+	if n, err := f.ReadAt(probe, int64(len(expected))-100); n != 100 || err != io.EOF {
+		t.Errorf("Expected 100 bytes and EOF reading past the end, got %d and %v", n, err)
+	}
+	if !bytes.Equal(probe[:100], expected[len(expected)-100:]) {
+		t.Error("Expected the last 100 bytes of the file")
+	}
+}
+
+func TestRestoreDirectIO(t *testing.T) {
+	openTestDirectFile(t)
+
+	restore := func(directIO bool) []byte {
+		flags := flag.NewFlagSet("test", flag.ContinueOnError)
+		o := defineFlags(flags)
+		*o.directIO = directIO
+		repack, _ := lookupCommand("repack")
+		in := &invocation{
+			o:               o,
+			cmd:             &repack,
+			store:           os.DirFS("testdata/restore/backupstore"),
+			backupStorePath: "testdata/restore/backupstore",
+			progress:        io.Discard,
+			level:           verbosityQuiet,
+			out:             io.Discard,
+			log:             newLogger(io.Discard, "text", slog.LevelInfo),
+			ctx:             t.Context(),
+		}
+		outfile := filepath.Join(t.TempDir(), "pvc-fixture.img")
+		if code := in.run("pvc-fixture", outfile); code != 0 {
+			t.Fatalf("Expected the restore to succeed, got exit code %d", code)
+		}
+		data, err := os.ReadFile(outfile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	if !bytes.Equal(restore(true), restore(false)) {
+		t.Error("Expected the same image with and without -direct-io")
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"slices"
+	"sync"
+
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+)
+
+// longhornBlockSize is the size of the blocks Longhorn splits volumes into
+const longhornBlockSize = 2 << 20
+
+type blockProblem struct {
+	Block backupstore.Block
+	Err   error
+}
+
+// dryRunPass is what one backup would contribute to a restore
+type dryRunPass struct {
+	Identifier string
+	// Blocks are the blocks the pass would write, Superseded the ones
+	// newer backups overwrite and that are never read
+	Blocks     int
+	Superseded int
+	// Bytes is the size of the block files the pass would read
+	Bytes    int64
+	Problems []blockProblem
+}
+
+type dryRunReport struct {
+	Passes []dryRunPass
+	// ImageSize is the end of the last block unless volume.cfg says
+	// otherwise
+	ImageSize int64
+}
+
+func (r *dryRunReport) problems() int {
+	total := 0
+	for _, pass := range r.Passes {
+		total += len(pass.Problems)
+	}
+	return total
+}
+
+// dryRunRestore resolves every block a restore of backups would read,
+// checking that each one exists and is a non-empty file, without reading
+// or writing any block data. Passes are in restore order, newest first.
+func dryRunRestore(store fs.FS, backupPath string, backups []backupstore.Backup, volumeSize int64, jobs int) *dryRunReport {
+	jobs = max(jobs, 1)
+	report := &dryRunReport{ImageSize: volumeSize}
+
+	claimed := make(map[int64]struct{})
+	for i := len(backups) - 1; i >= 0; i-- {
+		backup := backups[i]
+		pass := dryRunPass{Identifier: backup.Identifier}
+		pending := make([]backupstore.Block, 0, len(backup.Blocks))
+		for _, block := range backup.Blocks {
+			if _, ok := claimed[block.Offset]; ok {
+				pass.Superseded++
+				continue
+			}
+			claimed[block.Offset] = struct{}{}
+			pending = append(pending, block)
+			if volumeSize == 0 {
+				report.ImageSize = max(report.ImageSize, block.Offset+longhornBlockSize)
+			}
+		}
+		pass.Blocks = len(pending)
+
+		var (
+			wg  sync.WaitGroup
+			mu  sync.Mutex
+			sem = make(chan struct{}, jobs)
+		)
+		for _, block := range pending {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+				_, info, err := backupstore.StatBlock(store, backupPath, block.Checksum)
+				if err == nil && (!info.Mode().IsRegular() || info.Size() == 0) {
+					err = errors.New("block file is empty or not a regular file")
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					pass.Problems = append(pass.Problems, blockProblem{Block: block, Err: err})
+					return
+				}
+				pass.Bytes += info.Size()
+			}()
+		}
+		wg.Wait()
+		slices.SortFunc(pass.Problems, func(a, b blockProblem) int {
+			return cmp.Compare(a.Block.Offset, b.Block.Offset)
+		})
+		report.Passes = append(report.Passes, pass)
+	}
+	return report
+}
+
+func printDryRunReport(w io.Writer, report *dryRunReport, volumeSize int64) {
+	blocks, bytes := 0, int64(0)
+	for _, pass := range report.Passes {
+		blocks += pass.Blocks
+		bytes += pass.Bytes
+	}
+	fmt.Fprintf(w, "Dry run: %d passes, %d blocks to restore\n", len(report.Passes), blocks)
+	for i, pass := range report.Passes {
+		fmt.Fprintf(w, "[pass %d/%d] %s: %d blocks, %d bytes to read", i+1, len(report.Passes), pass.Identifier, pass.Blocks, pass.Bytes)
+		if pass.Superseded > 0 {
+			fmt.Fprintf(w, ", %d superseded by newer backups", pass.Superseded)
+		}
+		if len(pass.Problems) > 0 {
+			fmt.Fprintf(w, ", %d problems", len(pass.Problems))
+		}
+		fmt.Fprintln(w)
+		for _, problem := range pass.Problems {
+			fmt.Fprintf(w, "  offset %d: %s\n", problem.Block.Offset, problem.Err)
+		}
+	}
+	fmt.Fprintf(w, "Total to read: %d bytes\n", bytes)
+	if volumeSize > 0 {
+		fmt.Fprintf(w, "Image size: %d bytes (from volume.cfg)\n", report.ImageSize)
+	} else {
+		fmt.Fprintf(w, "Image size: up to %d bytes (end of the last block)\n", report.ImageSize)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+)
+
+func TestDryRunRestore(t *testing.T) {
+	volumePath := t.TempDir()
+	blockSize := 4096
+	first := writeTestBlock(t, volumePath, testBlockData(1, blockSize))
+	second := writeTestBlock(t, volumePath, testBlockData(2, blockSize))
+	empty := writeTestBlock(t, volumePath, testBlockData(3, blockSize))
+	emptyPath := filepath.Join(volumePath, "blocks", empty[0:2], empty[2:4], empty+".blk")
+	if err := os.Truncate(emptyPath, 0); err != nil {
+		t.Fatal(err)
+	}
+	missing := strings.Repeat("ab", 64)
+
+	backups := []backupstore.Backup{
+		{
+			Identifier:  "backup-1",
+			Compression: "lz4",
+			Blocks: []backupstore.Block{
+				{Offset: 0, Checksum: first},
+				// never read, backup-2 replaces it
+				{Offset: 4096, Checksum: missing},
+				{Offset: 12288, Checksum: empty},
+			},
+		},
+		{
+			Identifier:  "backup-2",
+			Compression: "lz4",
+			Blocks: []backupstore.Block{
+				{Offset: 4096, Checksum: second},
+				{Offset: 8192, Checksum: missing},
+			},
+		},
+	}
+
+	report := dryRunRestore(os.DirFS(volumePath), ".", backups, 0, 2)
+	if len(report.Passes) != 2 {
+		t.Fatalf("Expected 2 passes, got %d", len(report.Passes))
+	}
+	newest, oldest := report.Passes[0], report.Passes[1]
+	if newest.Identifier != "backup-2" || newest.Blocks != 2 || len(newest.Problems) != 1 {
+		t.Errorf("Expected backup-2 with 2 blocks and 1 problem, got %+v", newest)
+	}
+	if newest.Problems[0].Block.Offset != 8192 {
+		t.Errorf("Expected the missing block at 8192, got %d", newest.Problems[0].Block.Offset)
+	}
+	if oldest.Blocks != 2 || oldest.Superseded != 1 || len(oldest.Problems) != 1 {
+		t.Errorf("Expected backup-1 with 2 blocks, 1 superseded and 1 problem, got %+v", oldest)
+	}
+	if report.problems() != 2 {
+		t.Errorf("Expected 2 problems, got %d", report.problems())
+	}
+	if report.ImageSize != 12288+longhornBlockSize {
+		t.Errorf("Expected the image to end with the last block, got %d", report.ImageSize)
+	}
+
+	var out bytes.Buffer
+	printDryRunReport(&out, report, 0)
+	for _, expected := range []string{"Dry run: 2 passes, 4 blocks to restore", "[pass 2/2] backup-1", "offset 12288: block file is empty"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Expected output to contain %q, got %q", expected, out.String())
+		}
+	}
+
+	report = dryRunRestore(os.DirFS(volumePath), ".", backups[:1], 16384, 1)
+	if report.ImageSize != 16384 {
+		t.Errorf("Expected the volume size, got %d", report.ImageSize)
+	}
+	if report.Passes[0].Bytes == 0 {
+		t.Error("Expected the size of the block files to be counted")
+	}
+}
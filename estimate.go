@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"time"
+
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+)
+
+// estimateSamples is how many blocks -estimate decompresses to time a
+// restore
+const estimateSamples = 8
+
+// restoreEstimate is what a restore would read and write, worked out from
+// the final block map before any block is read
+type restoreEstimate struct {
+	// Blocks are the offsets the restore writes, and ZeroBlocks those of
+	// them holding the all-zero block, which are left as holes
+	Blocks     int
+	ZeroBlocks int
+	// UniqueBlocks are the checksums among Blocks, each read once when
+	// the block cache holds them
+	UniqueBlocks int
+	// WriteBytes is what the blocks that aren't all zero fill
+	WriteBytes int64
+	// ImageSize is from volume.cfg, from the filesystem, partition table or
+	// LUKS header SizedBy names, or the end of the last block when SizedBy
+	// is empty
+	ImageSize int64
+	SizedBy   string
+	// Duration is projected from the time Sampled blocks took to read and
+	// decompress, and is zero until sample has run
+	Duration time.Duration
+	Sampled  int
+}
+
+// estimateRestore sizes the restore of final, a FinalBlockMap. Each block
+// fills up to the next one, or a whole Longhorn block.
+func estimateRestore(final []backupstore.MappedBlock, volumeSize int64) restoreEstimate {
+	estimate := restoreEstimate{Blocks: len(final), ImageSize: volumeSize}
+	if volumeSize > 0 {
+		estimate.SizedBy = "volume.cfg"
+	}
+	unique := make(map[string]struct{})
+	for i, block := range final {
+		unique[block.Checksum] = struct{}{}
+		extent := backupstore.ZeroExtent(final, i)
+		if volumeSize > 0 {
+			extent = max(0, min(extent, volumeSize-block.Offset))
+		} else {
+			estimate.ImageSize = max(estimate.ImageSize, block.Offset+longhornBlockSize)
+		}
+		if block.Checksum == zeroBlockChecksum {
+			estimate.ZeroBlocks++
+			continue
+		}
+		estimate.WriteBytes += extent
+	}
+	estimate.UniqueBlocks = len(unique)
+	return estimate
+}
+
+// probed takes the image size probeImageSize found in the first block,
+// which only replaces the size from volume.cfg when a GPT outgrows it
+func (e *restoreEstimate) probed(size int64, contents string) {
+	if e.SizedBy == "volume.cfg" && size == e.ImageSize {
+		return
+	}
+	e.ImageSize, e.SizedBy = size, contents
+}
+
+// sample reads and decompresses up to estimateSamples blocks spread over
+// final, and projects the time reading every unique block takes jobs at a
+// time. The all-zero block is left out, as it decompresses faster than
+// any other.
+func (e *restoreEstimate) sample(store fs.FS, backupPath string, final []backupstore.MappedBlock, jobs int) error {
+	var candidates []backupstore.MappedBlock
+	seen := make(map[string]struct{})
+	for _, block := range final {
+		if _, ok := seen[block.Checksum]; ok || block.Checksum == zeroBlockChecksum {
+			continue
+		}
+		seen[block.Checksum] = struct{}{}
+		candidates = append(candidates, block)
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	step := max(1, len(candidates)/estimateSamples)
+	started, sampled := time.Now(), 0
+	for i := 0; i < len(candidates) && sampled < estimateSamples; i += step {
+		block := candidates[i]
+		if _, err := backupstore.LoadBlock(store, backupPath, block.Block, block.Compression, block.BlockSize); err != nil {
+			return err
+		}
+		sampled++
+	}
+	perBlock := time.Since(started) / time.Duration(sampled)
+	e.Duration = perBlock * time.Duration(e.UniqueBlocks) / time.Duration(max(jobs, 1))
+	e.Sampled = sampled
+	return nil
+}
+
+func printEstimate(w io.Writer, e restoreEstimate) {
+	fmt.Fprintf(w, "Blocks to restore: %d, %d unique", e.Blocks, e.UniqueBlocks)
+	if e.ZeroBlocks > 0 {
+		fmt.Fprintf(w, ", %d all zero left as holes", e.ZeroBlocks)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "Data to write: %s\n", formatSize(e.WriteBytes))
+	switch e.SizedBy {
+	case "volume.cfg":
+		fmt.Fprintf(w, "Image size: %s (from volume.cfg)\n", formatSize(e.ImageSize))
+	case "":
+		fmt.Fprintf(w, "Image size: up to %s (end of the last block)\n", formatSize(e.ImageSize))
+	default:
+		fmt.Fprintf(w, "Image size: %s (%s found in the first block)\n", formatSize(e.ImageSize), e.SizedBy)
+	}
+	if e.Sampled > 0 {
+		fmt.Fprintf(w, "Estimated duration: %s (from %d sampled blocks)\n", formatEstimatedDuration(e.Duration), e.Sampled)
+	}
+}
+
+func formatEstimatedDuration(d time.Duration) string {
+	if d < time.Second {
+		return "under a second"
+	}
+	return d.Round(time.Second).String()
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+)
+
+func TestEstimateRestore(t *testing.T) {
+	volumePath := t.TempDir()
+	blockSize := 4096
+	first := writeTestBlock(t, volumePath, testBlockData(1, blockSize))
+	second := writeTestBlock(t, volumePath, testBlockData(2, blockSize))
+	backups := []backupstore.Backup{
+		{Identifier: "backup-1", Compression: "lz4", Blocks: []backupstore.Block{
+			{Offset: 0, Checksum: first},
+			// replaced by backup-2, so never written
+			{Offset: 4096, Checksum: first},
+			{Offset: 8192, Checksum: zeroBlockChecksum},
+		}},
+		{Identifier: "backup-2", Compression: "lz4", Blocks: []backupstore.Block{
+			{Offset: 4096, Checksum: second},
+			{Offset: 12288, Checksum: first},
+		}},
+	}
+	final := backupstore.FinalBlockMap(backups)
+
+	tests := []struct {
+		volumeSize int64
+		writeBytes int64
+		imageSize  int64
+		line       string
+	}{
+		// the last block fills a whole Longhorn block without volume.cfg
+		{0, 2*4096 + longhornBlockSize, 12288 + longhornBlockSize, "Image size: up to 2109440 bytes (2.0 MiB) (end of the last block)\n"},
+		{16384, 3 * 4096, 16384, "Image size: 16384 bytes (16.0 KiB) (from volume.cfg)\n"},
+	}
+	for _, tt := range tests {
+		estimate := estimateRestore(final, tt.volumeSize)
+		if estimate.Blocks != 4 || estimate.UniqueBlocks != 3 || estimate.ZeroBlocks != 1 {
+			t.Errorf("Expected 4 blocks, 3 unique and 1 zero, got %+v", estimate)
+		}
+		if estimate.WriteBytes != tt.writeBytes || estimate.ImageSize != tt.imageSize {
+			t.Errorf("Expected %d bytes to write into %d, got %d into %d", tt.writeBytes, tt.imageSize, estimate.WriteBytes, estimate.ImageSize)
+		}
+		var out bytes.Buffer
+		printEstimate(&out, estimate)
+		if !strings.Contains(out.String(), tt.line) {
+			t.Errorf("Expected %q in the estimate, got %q", tt.line, out.String())
+		}
+		if strings.Contains(out.String(), "Estimated duration") {
+			t.Errorf("Expected no duration before sampling, got %q", out.String())
+		}
+	}
+
+	// the filesystem sizes the image without volume.cfg, but doesn't
+	// replace it
+	estimate := estimateRestore(final, 0)
+	estimate.probed(1<<20, "ext4")
+	fromCfg := estimateRestore(final, 16384)
+	fromCfg.probed(16384, "ext4")
+	for e, line := range map[*restoreEstimate]string{
+		&estimate: "Image size: 1048576 bytes (1.0 MiB) (ext4 found in the first block)\n",
+		&fromCfg:  "Image size: 16384 bytes (16.0 KiB) (from volume.cfg)\n",
+	} {
+		var out bytes.Buffer
+		printEstimate(&out, *e)
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("Expected %q in the estimate, got %q", line, out.String())
+		}
+	}
+
+	estimate = estimateRestore(final, 0)
+	if err := estimate.sample(os.DirFS(volumePath), ".", final, 2); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if estimate.Sampled != 2 {
+		t.Errorf("Expected the 2 blocks that aren't zero to be sampled, got %d", estimate.Sampled)
+	}
+	var out bytes.Buffer
+	printEstimate(&out, estimate)
+	if line := "Estimated duration: under a second (from 2 sampled blocks)\n"; !strings.Contains(out.String(), line) {
+		t.Errorf("Expected %q in the estimate, got %q", line, out.String())
+	}
+
+	missing := []backupstore.MappedBlock{{Block: backupstore.Block{Checksum: strings.Repeat("ab", 64)}, Compression: "lz4"}}
+	if err := estimate.sample(os.DirFS(volumePath), ".", missing, 2); err == nil {
+		t.Errorf("Expected an error sampling a missing block")
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+)
+
+// Exit statuses, documented in the usage message
+const (
+	exitFailure          = 1
+	exitUsage            = 2
+	exitVolumeNotFound   = 3
+	exitBlockError       = 4
+	exitOutputError      = 5
+	exitVerifyFailed     = 6
+	exitInterrupted      = 7
+	exitChecksumMismatch = 8
+	exitDegraded         = 9
+)
+
+var exitStatuses = []struct {
+	code    int
+	meaning string
+}{
+	{0, "success"},
+	{exitFailure, "any other failure, such as an unreachable backup root"},
+	{exitUsage, "invalid flags or flag combinations, or a -target matching several volumes"},
+	{exitVolumeNotFound, "the target volume, a backup matching -backup or -before, or the -path of ls or extract, was not found"},
+	{exitBlockError, "a block is missing from the backupstore or corrupt"},
+	{exitOutputError, "the output file could not be written, or was not overwritten"},
+	{exitVerifyFailed, "-verify or the verify command found the image differs from the backup"},
+	{exitInterrupted, "the restore was interrupted"},
+	{exitChecksumMismatch, "the restore finished, but blocks failed their checksum and were written or skipped by -on-checksum-mismatch"},
+	{exitDegraded, "a degraded restore: it finished, but missing blocks were zero-filled by -on-missing-block"},
+}
+
+// exitCode maps an error to the exit status of its class
+func exitCode(err error) int {
+	var (
+		block    *backupstore.BlockError
+		mismatch *backupstore.ChecksumMismatchError
+		output   *backupstore.OutputError
+	)
+	switch {
+	case errors.Is(err, context.Canceled):
+		return exitInterrupted
+	case errors.Is(err, backupstore.ErrVolumeNotFound):
+		return exitVolumeNotFound
+	case errors.Is(err, backupstore.ErrAmbiguousVolume), errors.Is(err, path.ErrBadPattern):
+		return exitUsage
+	case errors.As(err, &block), errors.As(err, &mismatch):
+		return exitBlockError
+	case errors.As(err, &output):
+		return exitOutputError
+	}
+	return exitFailure
+}
+
+// damageExitCode is the exit status of a restore that finished despite
+// the blocks in damaged. Corrupt blocks outrank missing ones, as they may
+// have been written as they are.
+func damageExitCode(damaged *backupstore.DamageReport) int {
+	code := 0
+	for _, block := range damaged.Blocks() {
+		switch block.Action {
+		case backupstore.ActionWritten, backupstore.ActionSkipped:
+			return exitChecksumMismatch
+		case backupstore.ActionZeroed:
+			code = exitDegraded
+		}
+	}
+	return code
+}
+
+func printExitStatuses(out io.Writer) {
+	fmt.Fprintf(out, "\nExit status:\n")
+	for _, status := range exitStatuses {
+		fmt.Fprintf(out, "  %d  %s\n", status.code, status.meaning)
+	}
+}
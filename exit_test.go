@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+)
+
+func TestExitCode(t *testing.T) {
+	volumePath := t.TempDir()
+	good := writeTestBlock(t, volumePath, testBlockData(1, 4096))
+	corrupt := writeTestBlock(t, volumePath, testBlockData(2, 4096))
+	corruptPath := filepath.Join(volumePath, "blocks", corrupt[0:2], corrupt[2:4], corrupt+".blk")
+	if err := os.WriteFile(corruptPath, []byte("not lz4"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	missing := strings.Repeat("ab", 64)
+	store := os.DirFS(volumePath)
+
+	restore := func(checksum string, out *failingWriter) error {
+		backups := []backupstore.Backup{{Identifier: "backup-1", Compression: "lz4", Blocks: []backupstore.Block{{Offset: 0, Checksum: checksum}}}}
+		return backupstore.Repack(context.Background(), store, ".", backups, out, backupstore.RepackOptions{Jobs: 1})
+	}
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, volumeErr := backupstore.FindVolumeBackupPath(os.DirFS(t.TempDir()), "pvc-123")
+	tests := []struct {
+		name     string
+		err      error
+		expected int
+	}{
+		{name: "volume not found", err: volumeErr, expected: exitVolumeNotFound},
+		{name: "missing block", err: restore(missing, &failingWriter{limit: 1}), expected: exitBlockError},
+		{name: "corrupt block", err: restore(corrupt, &failingWriter{limit: 1}), expected: exitBlockError},
+		{name: "checksum mismatch", err: &backupstore.ChecksumMismatchError{Path: "block.blk"}, expected: exitBlockError},
+		{name: "write error", err: restore(good, &failingWriter{limit: 0}), expected: exitOutputError},
+		{name: "output error from the stream sink", err: func() error {
+			_, err := (&countingWriter{w: &failingFileWriter{}}).Write([]byte("image"))
+			return err
+		}(), expected: exitOutputError},
+		{name: "interrupted", err: backupstore.Repack(cancelled, store, ".", []backupstore.Backup{{Compression: "lz4", Blocks: []backupstore.Block{{Checksum: good}}}}, &failingWriter{limit: 1}, backupstore.RepackOptions{}), expected: exitInterrupted},
+		{name: "other", err: errors.New("connection refused"), expected: exitFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.err == nil {
+				t.Fatal("Expected error but got none")
+			}
+			if code := exitCode(tt.err); code != tt.expected {
+				t.Errorf("Expected exit status %d, got %d for %v", tt.expected, code, tt.err)
+			}
+		})
+	}
+}
+
+type failingFileWriter struct{}
+
+func (failingFileWriter) Write(p []byte) (int, error) {
+	return 0, errTestDiskFull
+}
+
+func TestUsageExitStatuses(t *testing.T) {
+	var out bytes.Buffer
+	flag.CommandLine.SetOutput(&out)
+	defer flag.CommandLine.SetOutput(nil)
+	usage()
+	for _, status := range exitStatuses {
+		if !strings.Contains(out.String(), status.meaning) {
+			t.Errorf("Expected the usage to explain exit status %d, got %q", status.code, out.String())
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+)
+
+// exportResult is what exportChain copied
+type exportResult struct {
+	Backups int
+	Blocks  int
+	// Bytes is the size of the block files, compressed as they are stored
+	Bytes int64
+}
+
+// exportChain copies backups of volume, their cfg files and the blocks
+// they reference, into the backupstore of the backup root dest, with the
+// volume.cfg of the volume if it has one. The volume keeps its path in the
+// store and every block is written where Longhorn shards it, compressed as
+// it is. Each block is checked against its checksum before it is written,
+// jobs at a time, and the cfg files are only written once every block
+// they reference has been, so an interrupted export has no cfg file
+// referencing a missing block.
+func exportChain(store fs.FS, volume *backupstore.VolumeBackup, backups []backupstore.Backup, dest string, jobs int, progress io.Writer, level verbosity) (exportResult, error) {
+	result := exportResult{Backups: len(backups)}
+	volumeDir := filepath.Join(dest, "backupstore", filepath.FromSlash(volume.BackupPath))
+
+	blocks, n, err := exportBlocks(store, volume.BackupPath, volumeDir, backups, nil, jobs, newPassProgress(progress, "[export]", blockCount(backups, nil), level))
+	result.Bytes = n
+	if err != nil {
+		return result, err
+	}
+	result.Blocks = blocks
+
+	data, err := fs.ReadFile(store, path.Join(volume.BackupPath, "volume.cfg"))
+	switch {
+	case err == nil:
+		if err := writeExportFile(filepath.Join(volumeDir, "volume.cfg"), data); err != nil {
+			return result, err
+		}
+	case !errors.Is(err, fs.ErrNotExist):
+		return result, err
+	}
+	for _, backup := range backups {
+		data, err := fs.ReadFile(store, backup.ConfigPath)
+		if err != nil {
+			return result, err
+		}
+		if err := writeExportFile(filepath.Join(volumeDir, "backups", path.Base(backup.ConfigPath)), data); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// blockCount is the number of blocks backups reference that have doesn't
+// hold
+func blockCount(backups []backupstore.Backup, have map[string]string) int {
+	checksums := make(map[string]struct{})
+	for _, backup := range backups {
+		for _, block := range backup.Blocks {
+			if _, ok := have[block.Checksum]; !ok {
+				checksums[block.Checksum] = struct{}{}
+			}
+		}
+	}
+	return len(checksums)
+}
+
+// exportBlocks copies the blocks backups reference into the blocks tree
+// of volumeDir, jobs at a time, leaving out those in have. It returns how
+// many it copied and their size, and stops at the first that fails.
+func exportBlocks(store fs.FS, backupPath, volumeDir string, backups []backupstore.Backup, have map[string]string, jobs int, status *passProgress) (int, int64, error) {
+	// the first backup referencing each checksum, whose compression and
+	// block size it is checked with
+	sources := make(map[string]backupstore.Backup)
+	for _, backup := range backups {
+		for _, block := range backup.Blocks {
+			if _, ok := have[block.Checksum]; ok {
+				continue
+			}
+			if _, ok := sources[block.Checksum]; !ok {
+				sources[block.Checksum] = backup
+			}
+		}
+	}
+	checksums := slices.Sorted(maps.Keys(sources))
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		done     int
+		bytes    int64
+	)
+	work := make(chan string)
+	for range max(jobs, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for checksum := range work {
+				n, err := exportBlock(store, backupPath, volumeDir, checksum, sources[checksum])
+
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				done++
+				bytes += n
+				status.block(done, n, func() string {
+					return fmt.Sprintf("Block %s*", shortChecksum(checksum))
+				})
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, checksum := range checksums {
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			break
+		}
+		work <- checksum
+	}
+	close(work)
+	wg.Wait()
+	status.close()
+	if firstErr != nil {
+		return 0, bytes, firstErr
+	}
+	return len(checksums), bytes, nil
+}
+
+// exportBlock copies the file of a block of backup into the blocks tree
+// of the volume in volumeDir, returning its size
+func exportBlock(store fs.FS, backupPath, volumeDir, checksum string, backup backupstore.Backup) (int64, error) {
+	data, err := backupstore.ReadRawBlock(store, backupPath, backupstore.Block{Offset: -1, Checksum: checksum}, backup.Compression, backup.BlockSize)
+	if err != nil {
+		return 0, err
+	}
+	name := filepath.Join(volumeDir, "blocks", checksum[0:2], checksum[2:4], checksum+".blk")
+	if err := writeExportFile(name, data); err != nil {
+		return 0, err
+	}
+	return int64(len(data)), nil
+}
+
+// writeExportFile writes data to name, creating its directory, through a
+// temporary file so name never holds part of it
+func writeExportFile(name string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return &backupstore.OutputError{Err: err}
+	}
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return &backupstore.OutputError{Err: err}
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		return &backupstore.OutputError{Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+)
+
+func TestExportChain(t *testing.T) {
+	root := t.TempDir()
+	volumePath := filepath.Join(root, "volumes", "ab", "cd", "pvc-1")
+	a := writeTestBlock(t, volumePath, testBlockData(1, 4096))
+	b := writeTestBlock(t, volumePath, testBlockData(2, 4096))
+	c := writeTestBlock(t, volumePath, testBlockData(3, 4096))
+	writeTestBackupCfg(t, volumePath, "backup-1", a, b)
+	writeTestBackupCfg(t, volumePath, "backup-2", a, c)
+	if err := os.WriteFile(filepath.Join(volumePath, "volume.cfg"), []byte(`{"Name": "pvc-1", "Size": "8192"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	store := os.DirFS(root)
+	volume, err := backupstore.ReadBackups(store, "volumes/ab/cd/pvc-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	selected, err := selectBackup(volume.Backups, "backup-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dest := t.TempDir()
+	result, err := exportChain(store, volume, selected, dest, 2, io.Discard, verbosityNormal)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if result.Backups != 1 || result.Blocks != 2 || result.Bytes == 0 {
+		t.Errorf("Expected 1 backup and 2 blocks exported, got %+v", result)
+	}
+
+	exported := os.DirFS(filepath.Join(dest, "backupstore"))
+	exportedPath, err := backupstore.FindVolumeBackupPath(exported, "pvc-1")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	copied, err := backupstore.ReadBackups(exported, exportedPath)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if exportedPath != "volumes/ab/cd/pvc-1" || copied.Size != 8192 || len(copied.Backups) != 1 {
+		t.Errorf("Expected backup-2 of pvc-1 and its volume.cfg at volumes/ab/cd/pvc-1, got %+v at %s", copied, exportedPath)
+	}
+	blocks, err := backupstore.ListBlocks(exported, exportedPath)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, ok := blocks[b]; len(blocks) != 2 || ok {
+		t.Errorf("Expected only the blocks of backup-2, got %v", blocks)
+	}
+
+	// the block of 4 stored under the checksum of c
+	if err := os.WriteFile(filepath.Join(volumePath, "blocks", c[0:2], c[2:4], c+".blk"), compressTestLZ4(t, testBlockData(4, 4096)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dest = t.TempDir()
+	_, err = exportChain(store, volume, selected, dest, 2, io.Discard, verbosityNormal)
+	var mismatch *backupstore.ChecksumMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("Expected a checksum mismatch, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "backupstore", "volumes", "ab", "cd", "pvc-1", "backups")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected no cfg file to be exported with a corrupt block, got %v", err)
+	}
+}
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// the ext4 on-disk format, as described in the kernel's
+// Documentation/filesystems/ext4
+const (
+	ext4RootInode = 2
+
+	ext4IncompatFiletype = 0x2
+	ext4IncompatMetaBG   = 0x10
+	ext4Incompat64Bit    = 0x80
+	ext4IncompatEncrypt  = 0x10000
+
+	ext4ExtentsFlag    = 0x80000
+	ext4InlineDataFlag = 0x10000000
+
+	ext4ExtentMagic = 0xF30A
+	// ext4InitMaxLen is the longest initialized extent, longer ones are
+	// uninitialized and read as zeroes
+	ext4InitMaxLen = 32768
+
+	// ext4DirectBlocks are the block numbers of a block-mapped inode
+	// before its indirect, double and triple indirect blocks
+	ext4DirectBlocks = 12
+)
+
+// ext4Superblock is the start of the ext4 superblock, the fields ext4FS
+// needs to find inodes
+type ext4Superblock struct {
+	InodesCount     uint32
+	BlocksCountLo   uint32
+	_               [12]byte
+	FirstDataBlock  uint32
+	LogBlockSize    uint32
+	_               [4]byte
+	BlocksPerGroup  uint32
+	_               [4]byte
+	InodesPerGroup  uint32
+	_               [12]byte
+	Magic           uint16
+	_               [18]byte
+	RevLevel        uint32
+	_               [8]byte
+	InodeSize       uint16
+	_               [6]byte
+	FeatureIncompat uint32
+	_               [154]byte
+	DescSize        uint16
+}
+
+// ext4InodeRaw is the first 128 bytes of an inode, which every inode size
+// has
+type ext4InodeRaw struct {
+	Mode       uint16
+	UID        uint16
+	SizeLo     uint32
+	Atime      uint32
+	Ctime      uint32
+	Mtime      uint32
+	Dtime      uint32
+	GID        uint16
+	LinksCount uint16
+	BlocksLo   uint32
+	Flags      uint32
+	_          [4]byte
+	Block      [60]byte
+	Generation uint32
+	FileACLLo  uint32
+	SizeHigh   uint32
+	_          [8]byte
+	UIDHigh    uint16
+	GIDHigh    uint16
+	_          [4]byte
+}
+
+type ext4ExtentHeader struct {
+	Magic      uint16
+	Entries    uint16
+	Max        uint16
+	Depth      uint16
+	Generation uint32
+}
+
+// ext4ExtentEntry is a leaf of an extent tree. Nodes above depth 0 hold
+// indexes instead, which keep the block of the node below in Len and
+// StartHi, then the low 16 bits of StartLo, see ext4IndexLeaf.
+type ext4ExtentEntry struct {
+	Block   uint32
+	Len     uint16
+	StartHi uint16
+	StartLo uint32
+}
+
+// ext4FS reads the directories and files of an ext4 filesystem, or an
+// ext2 or ext3 one, which ext4 reads as well
+type ext4FS struct {
+	r              io.ReaderAt
+	blockSize      int64
+	inodeSize      int64
+	inodesPerGroup uint32
+	inodesCount    uint32
+	descSize       int64
+	descTable      int64
+	filetype       bool
+}
+
+// ext4Inode is an inode, with the fields a listing shows
+type ext4Inode struct {
+	Number uint32
+	Mode   fs.FileMode
+	UID    uint32
+	GID    uint32
+	Links  uint16
+	Size   int64
+	Mtime  time.Time
+	raw    ext4InodeRaw
+}
+
+// ext4DirEntry is a name in a directory, and the inode it links to
+type ext4DirEntry struct {
+	Name  string
+	Inode uint32
+}
+
+// ext4Extent maps Len blocks of a file from Logical on to the filesystem
+// block Start
+type ext4Extent struct {
+	Logical uint32
+	Len     uint32
+	Start   uint64
+	// Uninitialized extents are allocated but read as zeroes
+	Uninitialized bool
+}
+
+// openExt4 reads the superblock of the ext4 filesystem at the start of r
+func openExt4(r io.ReaderAt) (*ext4FS, error) {
+	data := make([]byte, 1024)
+	if _, err := r.ReadAt(data, ext4SuperblockOffset); err != nil {
+		return nil, err
+	}
+	var sb ext4Superblock
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &sb); err != nil {
+		return nil, err
+	}
+	if sb.Magic != ext4Magic {
+		return nil, errors.New("no ext4 superblock found")
+	}
+	switch {
+	case sb.FeatureIncompat&ext4IncompatMetaBG != 0:
+		return nil, errors.New("ext4 filesystems with meta_bg are not supported")
+	case sb.FeatureIncompat&ext4IncompatEncrypt != 0:
+		return nil, errors.New("encrypted ext4 filesystems are not supported")
+	case sb.InodesPerGroup == 0 || sb.LogBlockSize > 6:
+		return nil, errors.New("invalid ext4 superblock")
+	}
+
+	f := &ext4FS{
+		r:              r,
+		blockSize:      1024 << sb.LogBlockSize,
+		inodeSize:      128,
+		inodesPerGroup: sb.InodesPerGroup,
+		inodesCount:    sb.InodesCount,
+		descSize:       32,
+		filetype:       sb.FeatureIncompat&ext4IncompatFiletype != 0,
+	}
+	// revision 0 filesystems have 128 byte inodes and no inode size
+	if sb.RevLevel > 0 {
+		f.inodeSize = int64(sb.InodeSize)
+	}
+	if sb.FeatureIncompat&ext4Incompat64Bit != 0 && sb.DescSize >= 64 {
+		f.descSize = int64(sb.DescSize)
+	}
+	// the group descriptors follow the block holding the superblock
+	f.descTable = (int64(sb.FirstDataBlock) + 1) * f.blockSize
+	if f.inodeSize < 128 {
+		return nil, errors.New("invalid ext4 inode size")
+	}
+	return f, nil
+}
+
+// inode reads inode n
+func (f *ext4FS) inode(n uint32) (*ext4Inode, error) {
+	if n == 0 || n > f.inodesCount {
+		return nil, fmt.Errorf("invalid inode %d", n)
+	}
+	group := int64((n - 1) / f.inodesPerGroup)
+	desc := make([]byte, f.descSize)
+	if _, err := f.r.ReadAt(desc, f.descTable+group*f.descSize); err != nil {
+		return nil, fmt.Errorf("failed to read the descriptor of group %d: %w", group, err)
+	}
+	table := uint64(binary.LittleEndian.Uint32(desc[0x8:]))
+	if f.descSize >= 64 {
+		table |= uint64(binary.LittleEndian.Uint32(desc[0x28:])) << 32
+	}
+
+	data := make([]byte, 128)
+	offset := int64(table)*f.blockSize + int64((n-1)%f.inodesPerGroup)*f.inodeSize
+	if _, err := f.r.ReadAt(data, offset); err != nil {
+		return nil, fmt.Errorf("failed to read inode %d: %w", n, err)
+	}
+	var raw ext4InodeRaw
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &raw); err != nil {
+		return nil, err
+	}
+	return &ext4Inode{
+		Number: n,
+		Mode:   ext4FileMode(raw.Mode),
+		UID:    uint32(raw.UIDHigh)<<16 | uint32(raw.UID),
+		GID:    uint32(raw.GIDHigh)<<16 | uint32(raw.GID),
+		Links:  raw.LinksCount,
+		Size:   int64(raw.SizeHigh)<<32 | int64(raw.SizeLo),
+		Mtime:  time.Unix(int64(raw.Mtime), 0).UTC(),
+		raw:    raw,
+	}, nil
+}
+
+// ext4FileMode converts the mode of an inode, the type and permission bits
+// of stat(2), to an fs.FileMode
+func ext4FileMode(mode uint16) fs.FileMode {
+	m := fs.FileMode(mode & 0777)
+	switch mode & 0xF000 {
+	case 0x4000:
+		m |= fs.ModeDir
+	case 0xA000:
+		m |= fs.ModeSymlink
+	case 0x2000:
+		m |= fs.ModeDevice | fs.ModeCharDevice
+	case 0x6000:
+		m |= fs.ModeDevice
+	case 0x1000:
+		m |= fs.ModeNamedPipe
+	case 0xC000:
+		m |= fs.ModeSocket
+	}
+	if mode&0x800 != 0 {
+		m |= fs.ModeSetuid
+	}
+	if mode&0x400 != 0 {
+		m |= fs.ModeSetgid
+	}
+	if mode&0x200 != 0 {
+		m |= fs.ModeSticky
+	}
+	return m
+}
+
+// open returns a reader of the contents of inode
+func (f *ext4FS) open(inode *ext4Inode) (*io.SectionReader, error) {
+	if inode.raw.Flags&ext4InlineDataFlag != 0 {
+		return nil, fmt.Errorf("inode %d keeps its data inline, which is not supported", inode.Number)
+	}
+	var extents []ext4Extent
+	var err error
+	if inode.raw.Flags&ext4ExtentsFlag != 0 {
+		extents, err = f.extentTree(inode.raw.Block[:], 0)
+	} else {
+		extents, err = f.blockMap(inode.raw.Block[:])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("inode %d: %w", inode.Number, err)
+	}
+	file := &ext4File{fs: f, extents: extents}
+	return io.NewSectionReader(file, 0, inode.Size), nil
+}
+
+// extentTree returns the extents of the extent tree node in data, in
+// logical order
+func (f *ext4FS) extentTree(data []byte, level int) ([]ext4Extent, error) {
+	// a tree deeper than the kernel allows is corrupt, if not a loop
+	if level > 5 {
+		return nil, errors.New("extent tree too deep")
+	}
+	var header ext4ExtentHeader
+	r := bytes.NewReader(data)
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return nil, err
+	}
+	if header.Magic != ext4ExtentMagic {
+		return nil, errors.New("invalid extent tree")
+	}
+	entries := make([]ext4ExtentEntry, header.Entries)
+	if err := binary.Read(r, binary.LittleEndian, entries); err != nil {
+		return nil, errors.New("invalid extent tree")
+	}
+
+	var extents []ext4Extent
+	for _, entry := range entries {
+		if header.Depth == 0 {
+			extent := ext4Extent{
+				Logical: entry.Block,
+				Len:     uint32(entry.Len),
+				Start:   uint64(entry.StartHi)<<32 | uint64(entry.StartLo),
+			}
+			if entry.Len > ext4InitMaxLen {
+				extent.Len -= ext4InitMaxLen
+				extent.Uninitialized = true
+			}
+			extents = append(extents, extent)
+			continue
+		}
+		leaf := ext4IndexLeaf(entry)
+		node := make([]byte, f.blockSize)
+		if _, err := f.r.ReadAt(node, int64(leaf)*f.blockSize); err != nil {
+			return nil, err
+		}
+		below, err := f.extentTree(node, level+1)
+		if err != nil {
+			return nil, err
+		}
+		extents = append(extents, below...)
+	}
+	return extents, nil
+}
+
+// ext4IndexLeaf is the block of the node below an index entry
+func ext4IndexLeaf(entry ext4ExtentEntry) uint64 {
+	return uint64(entry.StartLo&0xFFFF)<<32 | uint64(entry.StartHi)<<16 | uint64(entry.Len)
+}
+
+// blockMap returns the extents of an inode whose blocks are mapped as ext2
+// and ext3 do, through direct and indirect block numbers
+func (f *ext4FS) blockMap(data []byte) ([]ext4Extent, error) {
+	var extents []ext4Extent
+	var logical uint32
+	add := func(block uint32) {
+		if block != 0 {
+			if last := len(extents) - 1; last >= 0 && extents[last].Logical+extents[last].Len == logical && extents[last].Start+uint64(extents[last].Len) == uint64(block) {
+				extents[last].Len++
+			} else {
+				extents = append(extents, ext4Extent{Logical: logical, Len: 1, Start: uint64(block)})
+			}
+		}
+		logical++
+	}
+	perBlock := uint32(f.blockSize / 4)
+	// indirect reads the block numbers in block, depth levels of indirect
+	// blocks above the data
+	var indirect func(block uint32, depth int) error
+	indirect = func(block uint32, depth int) error {
+		if block == 0 {
+			span := uint32(1)
+			for range depth {
+				span *= perBlock
+			}
+			logical += span
+			return nil
+		}
+		if depth == 0 {
+			add(block)
+			return nil
+		}
+		numbers := make([]uint32, perBlock)
+		node := make([]byte, f.blockSize)
+		if _, err := f.r.ReadAt(node, int64(block)*f.blockSize); err != nil {
+			return err
+		}
+		if err := binary.Read(bytes.NewReader(node), binary.LittleEndian, numbers); err != nil {
+			return err
+		}
+		for _, number := range numbers {
+			if err := indirect(number, depth-1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var blocks [ext4DirectBlocks + 3]uint32
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &blocks); err != nil {
+		return nil, err
+	}
+	for i, block := range blocks {
+		depth := max(i-ext4DirectBlocks+1, 0)
+		if err := indirect(block, depth); err != nil {
+			return nil, err
+		}
+	}
+	return extents, nil
+}
+
+// ext4File reads the blocks of a file through its extents. Blocks no
+// extent maps are holes and read as zeroes.
+type ext4File struct {
+	fs      *ext4FS
+	extents []ext4Extent
+}
+
+func (f *ext4File) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		logical := uint32((off + int64(n)) / f.fs.blockSize)
+		within := (off + int64(n)) % f.fs.blockSize
+		chunk := p[n:min(len(p), n+int(f.fs.blockSize-within))]
+
+		i, found := slices.BinarySearchFunc(f.extents, logical, func(e ext4Extent, logical uint32) int {
+			switch {
+			case logical < e.Logical:
+				return 1
+			case logical >= e.Logical+e.Len:
+				return -1
+			}
+			return 0
+		})
+		if !found || f.extents[i].Uninitialized {
+			clear(chunk)
+		} else {
+			extent := f.extents[i]
+			block := int64(extent.Start) + int64(logical-extent.Logical)
+			if _, err := f.fs.r.ReadAt(chunk, block*f.fs.blockSize+within); err != nil {
+				return n, err
+			}
+		}
+		n += len(chunk)
+	}
+	return n, nil
+}
+
+// readDir returns the entries of the directory inode, but . and .., in the
+// order they are stored
+func (f *ext4FS) readDir(inode *ext4Inode) ([]ext4DirEntry, error) {
+	if !inode.Mode.IsDir() {
+		return nil, fmt.Errorf("inode %d is not a directory", inode.Number)
+	}
+	r, err := f.open(inode)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, inode.Size)
+	if _, err := r.ReadAt(data, 0); err != nil {
+		return nil, fmt.Errorf("failed to read directory inode %d: %w", inode.Number, err)
+	}
+
+	// hashed directories are read the same way, as their index is hidden
+	// in entries of inode 0 or the rec_len of ..
+	var entries []ext4DirEntry
+	for pos := 0; pos+8 <= len(data); {
+		number := binary.LittleEndian.Uint32(data[pos:])
+		recLen := int(binary.LittleEndian.Uint16(data[pos+4:]))
+		nameLen := int(binary.LittleEndian.Uint16(data[pos+6:]))
+		if f.filetype {
+			nameLen = int(data[pos+6])
+		}
+		if recLen < 8 || pos+recLen > len(data) || 8+nameLen > recLen {
+			return nil, fmt.Errorf("corrupt entry in directory inode %d at %d", inode.Number, pos)
+		}
+		name := string(data[pos+8 : pos+8+nameLen])
+		if number != 0 && name != "." && name != ".." {
+			entries = append(entries, ext4DirEntry{Name: name, Inode: number})
+		}
+		pos += recLen
+	}
+	return entries, nil
+}
+
+// lookup returns the inode at the absolute path name, following no
+// symlinks
+func (f *ext4FS) lookup(name string) (*ext4Inode, error) {
+	inode, err := f.inode(ext4RootInode)
+	if err != nil {
+		return nil, err
+	}
+	walked := "/"
+	for _, part := range strings.Split(strings.Trim(path.Clean("/"+name), "/"), "/") {
+		if part == "" {
+			continue
+		}
+		if !inode.Mode.IsDir() {
+			return nil, fmt.Errorf("%s is not a directory", walked)
+		}
+		entries, err := f.readDir(inode)
+		if err != nil {
+			return nil, err
+		}
+		i := slices.IndexFunc(entries, func(entry ext4DirEntry) bool {
+			return entry.Name == part
+		})
+		walked = path.Join(walked, part)
+		if i < 0 {
+			return nil, fmt.Errorf("%s: %w", walked, fs.ErrNotExist)
+		}
+		if inode, err = f.inode(entries[i].Inode); err != nil {
+			return nil, err
+		}
+	}
+	return inode, nil
+}
+
+// readlink returns the target of the symlink inode, which is kept in the
+// inode itself when short
+func (f *ext4FS) readlink(inode *ext4Inode) (string, error) {
+	if inode.raw.Flags&(ext4ExtentsFlag|ext4InlineDataFlag) == 0 && inode.Size < int64(len(inode.raw.Block)) {
+		return string(inode.raw.Block[:inode.Size]), nil
+	}
+	r, err := f.open(inode)
+	if err != nil {
+		return "", err
+	}
+	target, err := io.ReadAll(r)
+	return string(target), err
+}
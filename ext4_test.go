@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+)
+
+// makeTestFilesystem formats a 32 MiB image with mkfs and the contents of
+// a small tree, returning the image and the contents of its large and
+// sparse files
+func makeTestFilesystem(t *testing.T, mkfs string, args ...string) (string, []byte, []byte) {
+	t.Helper()
+	path, err := exec.LookPath(mkfs)
+	if err != nil {
+		t.Skipf("%s not available", mkfs)
+	}
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	many := filepath.Join(src, "dir", "many")
+	if err := os.MkdirAll(many, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// enough names for the directory to be hashed
+	for i := range 300 {
+		if err := os.WriteFile(filepath.Join(many, fmt.Sprintf("file-%03d", i)), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	large := testBlockData(7, 3_000_000)
+	if err := os.WriteFile(filepath.Join(src, "dir", "large.bin"), large, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// holes between its chunks give it more extents than fit in its inode
+	sparse := make([]byte, 40*65536)
+	for offset := 0; offset < len(sparse); offset += 65536 {
+		copy(sparse[offset:], testBlockData(byte(offset/65536), 4096))
+	}
+	sparseFile, err := os.Create(filepath.Join(src, "dir", "sparse.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for offset := 0; offset < len(sparse); offset += 65536 {
+		if _, err := sparseFile.WriteAt(sparse[offset:offset+4096], int64(offset)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sparseFile.Truncate(int64(len(sparse))); err != nil {
+		t.Fatal(err)
+	}
+	sparseFile.Close()
+	if err := os.Link(filepath.Join(src, "dir", "sparse.bin"), filepath.Join(src, "dir", "sparse.link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "hello.txt"), []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("hello.txt", filepath.Join(src, "short")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(strings.Repeat("x", 100), filepath.Join(src, "long")); err != nil {
+		t.Fatal(err)
+	}
+
+	image := filepath.Join(dir, "fs.img")
+	if err := os.WriteFile(image, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(image, 32*1024*1024); err != nil {
+		t.Fatal(err)
+	}
+	args = append(args, "-q", "-F", "-d", src, image)
+	if out, err := exec.Command(path, args...).CombinedOutput(); err != nil {
+		t.Skipf("%s failed, it may not support -d: %v: %s", mkfs, err, out)
+	}
+	return image, large, sparse
+}
+
+func TestExt4(t *testing.T) {
+	tests := []struct {
+		name string
+		mkfs string
+		args []string
+	}{
+		{"ext4", "mkfs.ext4", nil},
+		{"ext4 with 4k blocks", "mkfs.ext4", []string{"-b", "4096"}},
+		{"ext3", "mkfs.ext3", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			image, large, sparse := makeTestFilesystem(t, tt.mkfs, tt.args...)
+			f, err := os.Open(image)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			filesystem, err := openExt4(f)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			entries, err := listImageDir(filesystem, "/")
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			var names []string
+			for _, entry := range entries {
+				names = append(names, entry.Name)
+			}
+			if expected := []string{"dir", "hello.txt", "long", "lost+found", "short"}; !slices.Equal(names, expected) {
+				t.Errorf("Expected %v, got %v", expected, names)
+			}
+			if entries[1].Mode != "-rw-r--r--" || entries[1].Size != 6 {
+				t.Errorf("Expected hello.txt to be a 6 byte -rw-r--r-- file, got %+v", entries[1])
+			}
+			if entries[4].Target != "hello.txt" || entries[2].Target != strings.Repeat("x", 100) {
+				t.Errorf("Expected the targets of both symlinks, got %q and %q", entries[4].Target, entries[2].Target)
+			}
+
+			many, err := listImageDir(filesystem, "/dir/many")
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(many) != 300 || many[0].Name != "file-000" || many[299].Name != "file-299" {
+				t.Errorf("Expected the 300 files of the hashed directory, got %d", len(many))
+			}
+
+			for name, expected := range map[string][]byte{"/dir/large.bin": large, "/dir/sparse.bin": sparse} {
+				inode, err := filesystem.lookup(name)
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				r, err := filesystem.open(inode)
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				content, err := io.ReadAll(r)
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				if !bytes.Equal(content, expected) {
+					t.Errorf("Expected the %d bytes of %s, got %d that differ", len(expected), name, len(content))
+				}
+			}
+
+			if _, err := listImageDir(filesystem, "/dir/missing"); !errors.Is(err, fs.ErrNotExist) || !strings.Contains(err.Error(), "/dir/missing") {
+				t.Errorf("Expected /dir/missing not to exist, got %v", err)
+			}
+			if _, err := listImageDir(filesystem, "/hello.txt/x"); err == nil {
+				t.Errorf("Expected a path through a file to fail")
+			}
+		})
+	}
+}
+
+func TestListImageDirFromBackup(t *testing.T) {
+	image, _, _ := makeTestFilesystem(t, "mkfs.ext4")
+	data, err := os.ReadFile(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the filesystem as a backup of 2 MiB blocks, leaving out the zero ones
+	volumePath := t.TempDir()
+	backup := backupstore.Backup{Compression: "lz4"}
+	for offset := 0; offset < len(data); offset += testBlockSize {
+		block := data[offset : offset+testBlockSize]
+		if backupstore.IsZeroBlock(block) {
+			continue
+		}
+		backup.Blocks = append(backup.Blocks, backupstore.Block{Offset: int64(offset), Checksum: writeTestBlock(t, volumePath, block)})
+	}
+	reader, err := backupstore.NewImageReader(os.DirFS(volumePath), ".", []backupstore.Backup{backup}, int64(len(data)), backupstore.NewBlockCache(64<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filesystem, err := openExt4(reader)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	entries, err := listImageDir(filesystem, "/dir")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(entries) != 4 || entries[0].Name != "large.bin" || entries[0].Size != 3_000_000 || entries[1].Name != "many" || entries[3].Links != 2 {
+		t.Errorf("Expected large.bin, many, and sparse.bin with its hard link, got %+v", entries)
+	}
+
+	var out bytes.Buffer
+	if err := printListing(&out, entries, "text"); err != nil {
+		t.Fatal(err)
+	}
+	if line := "-rw-------  1"; !strings.Contains(out.String(), line) {
+		t.Errorf("Expected %q in the listing, got %q", line, out.String())
+	}
+}
+
+func TestLsMode(t *testing.T) {
+	tests := []struct {
+		mode     uint16
+		expected string
+	}{
+		{0x81A4, "-rw-r--r--"},
+		{0x41ED, "drwxr-xr-x"},
+		{0xA1FF, "lrwxrwxrwx"},
+		{0x89ED, "-rwsr-xr-x"},
+		{0x43FF, "drwxrwxrwt"},
+		{0x8C00, "---S--S---"},
+		{0x21B6, "crw-rw-rw-"},
+		{0x61B0, "brw-rw----"},
+		{0x11A4, "prw-r--r--"},
+		{0xC1ED, "srwxr-xr-x"},
+	}
+
+	for _, tt := range tests {
+		if mode := lsMode(ext4FileMode(tt.mode)); mode != tt.expected {
+			t.Errorf("Expected %s for %#o, got %s", tt.expected, tt.mode, mode)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+)
+
+// extractChunk is how much of a file extract reads at once
+const extractChunk = 1 << 20
+
+// extractEntry is a file extract copies, Path being where it goes below
+// -dest
+type extractEntry struct {
+	Path  string
+	Inode *ext4Inode
+}
+
+// extractResult is what extractTree copied
+type extractResult struct {
+	Files    int
+	Dirs     int
+	Symlinks int
+	// Links are the hard links to files already extracted
+	Links   int
+	Skipped int
+	Failed  int
+	Bytes   int64
+}
+
+// planExtract walks the tree at name in filesystem, returning every file
+// in it with the directories before what they hold. The tree lands in
+// dest under the base name of name, or in dest itself for the root.
+func planExtract(filesystem *ext4FS, name string) ([]extractEntry, error) {
+	inode, err := filesystem.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	root := path.Base(path.Clean("/" + name))
+	if root == "/" {
+		root = "."
+	}
+	plan := []extractEntry{{Path: root, Inode: inode}}
+	for i := 0; i < len(plan); i++ {
+		if !plan[i].Inode.Mode.IsDir() {
+			continue
+		}
+		children, err := filesystem.readDir(plan[i].Inode)
+		if err != nil {
+			return nil, err
+		}
+		for _, child := range children {
+			// names can't hold a slash, but a corrupt directory could
+			if child.Name == "" || strings.ContainsAny(child.Name, `/\`) || child.Name == "." || child.Name == ".." {
+				return nil, fmt.Errorf("invalid name %q in %s", child.Name, plan[i].Path)
+			}
+			inode, err := filesystem.inode(child.Inode)
+			if err != nil {
+				return nil, err
+			}
+			plan = append(plan, extractEntry{Path: path.Join(plan[i].Path, child.Name), Inode: inode})
+		}
+	}
+	return plan, nil
+}
+
+// extractTree copies the files of plan into dest, keeping their modes,
+// mtimes and symlinks, and their owners if preserveOwner is set. Files
+// with several names are extracted once and hard linked, holes in sparse
+// files are left as holes, and devices, pipes and sockets are skipped. A
+// file that fails is logged and the rest are still copied;
+// directories get their modes and mtimes once their files are in.
+func extractTree(filesystem *ext4FS, plan []extractEntry, dest string, preserveOwner bool, out, progress io.Writer, logger *slog.Logger, level verbosity) (extractResult, error) {
+	var result extractResult
+	var firstErr error
+	fail := func(entry extractEntry, err error) {
+		logger.Error(fmt.Sprintf("Failed to extract %s", entry.Path), "error", err)
+		result.Failed++
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	// the first path each inode with several names was extracted to
+	linked := make(map[uint32]string)
+	var dirs []extractEntry
+
+	status := newPassProgress(progress, "[extract]", len(plan), level)
+	for i, entry := range plan {
+		target := filepath.Join(dest, filepath.FromSlash(entry.Path))
+		inode := entry.Inode
+		var n int64
+		var err error
+		mode := inode.Mode
+		switch {
+		case mode.IsDir():
+			if err = outputError(mkdirExtracted(target)); err == nil {
+				result.Dirs++
+				dirs = append(dirs, entry)
+			}
+		case mode.Type() == fs.ModeSymlink:
+			var link string
+			if link, err = filesystem.readlink(inode); err == nil {
+				err = outputError(os.Symlink(link, target))
+			}
+			if err == nil {
+				result.Symlinks++
+			}
+		case mode.IsRegular() && inode.Links > 1 && linked[inode.Number] != "":
+			if err = outputError(os.Link(linked[inode.Number], target)); err == nil {
+				result.Links++
+			}
+		case mode.IsRegular():
+			if n, err = extractFile(filesystem, inode, target); err == nil {
+				result.Files++
+				result.Bytes += n
+				linked[inode.Number] = target
+			}
+		default:
+			fmt.Fprintf(out, "Skipping %s, a %s\n", entry.Path, describeFileType(mode))
+			result.Skipped++
+			status.block(i+1, 0, func() string { return entry.Path })
+			continue
+		}
+		if err == nil && !mode.IsDir() {
+			err = outputError(setExtractedAttrs(target, inode, preserveOwner))
+		}
+		if err != nil {
+			fail(entry, err)
+		}
+		status.block(i+1, n, func() string { return entry.Path })
+	}
+	status.close()
+
+	// deepest first, so setting a directory's mtime comes after its
+	// files, and a read-only directory after what goes in it
+	for _, entry := range slices.Backward(dirs) {
+		if err := outputError(setExtractedAttrs(filepath.Join(dest, filepath.FromSlash(entry.Path)), entry.Inode, preserveOwner)); err != nil {
+			fail(entry, err)
+		}
+	}
+	return result, firstErr
+}
+
+// mkdirExtracted creates the directory name, which may already be one
+func mkdirExtracted(name string) error {
+	err := os.Mkdir(name, 0700)
+	if errors.Is(err, fs.ErrExist) {
+		if info, statErr := os.Lstat(name); statErr == nil && info.IsDir() {
+			return nil
+		}
+	}
+	return err
+}
+
+// extractFile copies the regular file inode into the new file name, and
+// returns the bytes copied. Blocks of zeroes are left as holes, so sparse
+// files stay sparse.
+func extractFile(filesystem *ext4FS, inode *ext4Inode, name string) (int64, error) {
+	r, err := filesystem.open(inode)
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return 0, outputError(err)
+	}
+	buf := make([]byte, extractChunk)
+	var offset int64
+	for offset < inode.Size {
+		n, err := r.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			f.Close()
+			return offset, err
+		}
+		for start := 0; start < n; start += int(filesystem.blockSize) {
+			block := buf[start:min(n, start+int(filesystem.blockSize))]
+			if backupstore.IsZeroBlock(block) {
+				continue
+			}
+			if _, err := f.WriteAt(block, offset+int64(start)); err != nil {
+				f.Close()
+				return offset, outputError(err)
+			}
+		}
+		offset += int64(n)
+	}
+	if err := f.Truncate(inode.Size); err != nil {
+		f.Close()
+		return offset, outputError(err)
+	}
+	return offset, outputError(f.Close())
+}
+
+// outputError marks err as a failure to write the extracted files, rather
+// than to read them from the backups
+func outputError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &backupstore.OutputError{Err: err}
+}
+
+// setExtractedAttrs gives the extracted file name the mode, mtime and, if
+// preserveOwner is set, the owner of inode. Symlinks only get the owner,
+// as their mode is ignored and their mtime can't be set portably.
+func setExtractedAttrs(name string, inode *ext4Inode, preserveOwner bool) error {
+	if preserveOwner {
+		if err := os.Lchown(name, int(inode.UID), int(inode.GID)); err != nil {
+			return err
+		}
+	}
+	if inode.Mode.Type() == fs.ModeSymlink {
+		return nil
+	}
+	if err := os.Chmod(name, inode.Mode&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky)); err != nil {
+		return err
+	}
+	return os.Chtimes(name, inode.Mtime, inode.Mtime)
+}
+
+// describeFileType names the type of files extract skips
+func describeFileType(mode fs.FileMode) string {
+	switch {
+	case mode&fs.ModeCharDevice != 0:
+		return "character device"
+	case mode&fs.ModeDevice != 0:
+		return "block device"
+	case mode&fs.ModeNamedPipe != 0:
+		return "named pipe"
+	case mode&fs.ModeSocket != 0:
+		return "socket"
+	}
+	return "special file"
+}
+
+// extract runs extract for volume, copying -path out of the image backups
+// restore to into -dest, and returns the exit status
+func (in *invocation) extract(volume *backupstore.VolumeBackup, backups []backupstore.Backup) int {
+	filesystem, code := in.openFilesystem(volume, backups)
+	if filesystem == nil {
+		return code
+	}
+	plan, err := planExtract(filesystem, *in.o.path)
+	if err != nil {
+		in.log.Error(fmt.Sprintf("Failed to read %s in the backups of %s", *in.o.path, volume.Name), "error", err)
+		return pathExitCode(err)
+	}
+	if err := os.MkdirAll(*in.o.dest, 0755); err != nil {
+		in.log.Error(fmt.Sprintf("Failed to create %s", *in.o.dest), "error", err)
+		return exitOutputError
+	}
+
+	result, err := extractTree(filesystem, plan, *in.o.dest, *in.o.preserveOwner, in.out, in.progress, in.log, in.level)
+	in.written = result.Bytes
+	fmt.Fprintf(in.out, "Extracted %s from %s to %s: %d files (%s), %d directories, %d symlinks and %d hard links\n",
+		*in.o.path, volume.Name, *in.o.dest, result.Files, formatSize(result.Bytes), result.Dirs, result.Symlinks, result.Links)
+	if result.Skipped > 0 {
+		fmt.Fprintf(in.out, "Skipped %d devices, pipes and sockets\n", result.Skipped)
+	}
+	if err != nil {
+		in.log.Error(fmt.Sprintf("Failed to extract %d files", result.Failed))
+		return exitCode(err)
+	}
+	return 0
+}
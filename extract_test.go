@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExtractTree(t *testing.T) {
+	image, large, sparse := makeTestFilesystem(t, "mkfs.ext4")
+	f, err := os.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	filesystem, err := openExt4(f)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	plan, err := planExtract(filesystem, "/dir")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if plan[0].Path != "dir" || len(plan) != 305 {
+		t.Fatalf("Expected dir and the 304 files below it, got %d starting with %s", len(plan), plan[0].Path)
+	}
+	dest := t.TempDir()
+	var out bytes.Buffer
+	result, err := extractTree(filesystem, plan, dest, false, &out, io.Discard, newLogger(&out, "text", slog.LevelInfo), verbosityQuiet)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v: %s", err, out.String())
+	}
+	expected := extractResult{Files: 302, Dirs: 2, Links: 1, Bytes: int64(len(large) + len(sparse))}
+	if result != expected {
+		t.Errorf("Expected %+v, got %+v", expected, result)
+	}
+
+	for name, content := range map[string][]byte{"large.bin": large, "sparse.bin": sparse, "sparse.link": sparse, "many/file-299": nil} {
+		got, err := os.ReadFile(filepath.Join(dest, "dir", name))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !bytes.Equal(got, content) {
+			t.Errorf("Expected the %d bytes of %s, got %d that differ", len(content), name, len(got))
+		}
+	}
+	info, err := os.Stat(filepath.Join(dest, "dir", "large.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inode, err := filesystem.lookup("/dir/large.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode() != 0600 || !info.ModTime().Equal(inode.Mtime) {
+		t.Errorf("Expected a -rw------- file modified at %s, got %s modified at %s", inode.Mtime, info.Mode(), info.ModTime())
+	}
+	first, _ := os.Stat(filepath.Join(dest, "dir", "sparse.bin"))
+	second, _ := os.Stat(filepath.Join(dest, "dir", "sparse.link"))
+	if !os.SameFile(first, second) {
+		t.Errorf("Expected sparse.link to be a hard link to sparse.bin")
+	}
+}
+
+func TestExtractRoot(t *testing.T) {
+	image, _, _ := makeTestFilesystem(t, "mkfs.ext4")
+	f, err := os.Open(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	filesystem, err := openExt4(f)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	plan, err := planExtract(filesystem, "/")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	dest := t.TempDir()
+	var out bytes.Buffer
+	result, err := extractTree(filesystem, plan, dest, false, &out, io.Discard, newLogger(&out, "text", slog.LevelInfo), verbosityQuiet)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v: %s", err, out.String())
+	}
+	if result.Symlinks != 2 || result.Dirs != 4 {
+		t.Errorf("Expected 2 symlinks and 4 directories, got %+v", result)
+	}
+	if target, err := os.Readlink(filepath.Join(dest, "short")); err != nil || target != "hello.txt" {
+		t.Errorf("Expected short to point to hello.txt, got %q (%v)", target, err)
+	}
+	if content, err := os.ReadFile(filepath.Join(dest, "hello.txt")); err != nil || string(content) != "hello\n" {
+		t.Errorf("Expected hello.txt in -dest itself, got %q (%v)", content, err)
+	}
+
+	// extracting again doesn't overwrite the files already there
+	result, err = extractTree(filesystem, plan, dest, false, &out, io.Discard, newLogger(&out, "text", slog.LevelInfo), verbosityQuiet)
+	if !errors.Is(err, fs.ErrExist) || exitCode(err) != exitOutputError || result.Failed != 306 {
+		t.Errorf("Expected every file but the directories to fail with exit status 5, got %+v: %v", result, err)
+	}
+
+	if _, err := planExtract(filesystem, "/dir/missing"); pathExitCode(err) != exitVolumeNotFound {
+		t.Errorf("Expected exit status 3 for a missing path, got %v", err)
+	}
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"strings"
+
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+	"golang.org/x/crypto/blake2b"
+)
+
+// lvmPVType is what blkid calls an LVM2 physical volume
+const lvmPVType = "LVM2_member"
+
+// unknownFilesystem is what detectFilesystem reports for an image that
+// starts with none of the filesystems, headers or tables it probes for
+const unknownFilesystem = "unknown"
+
+const (
+	xfsMagic = "XFSB"
+
+	btrfsSuperblockOffset = 65536
+	btrfsSuperblockSize   = 4096
+	btrfsMagic            = "_BHRfS_M"
+	btrfsChecksumSize     = 32
+	btrfsLabelOffset      = 0x12b
+	btrfsLabelSize        = 256
+
+	ntfsOEMID = "NTFS    "
+
+	lvmLabelID      = "LABELONE"
+	lvmLabelType    = "LVM2 001"
+	lvmInitialCRC   = 0xf597a6cf
+	lvmLabelSectors = 4
+
+	swapMagic           = "SWAPSPACE2"
+	swapHeaderOffset    = 1024
+	swapMinimumPageSize = 4096
+	swapMaximumPageSize = 65536
+)
+
+// btrfs checksum types
+const (
+	btrfsCsumCRC32C = iota
+	btrfsCsumXXHash
+	btrfsCsumSHA256
+	btrfsCsumBlake2b
+)
+
+// Filesystem is what the probe found at the start of a restored image
+type Filesystem struct {
+	Type        string
+	BlockSize   int
+	TotalBlocks int64
+	Label       string
+	UUID        string
+}
+
+func (f Filesystem) Size() int64 {
+	return int64(f.BlockSize) * f.TotalBlocks
+}
+
+// xfsSuperblock is the start of the primary XFS superblock, which is
+// stored big-endian at offset 0
+type xfsSuperblock struct {
+	MagicNum   [4]byte
+	BlockSize  uint32
+	DBlocks    uint64
+	RBlocks    uint64
+	RExtents   uint64
+	UUID       [16]byte
+	LogStart   uint64
+	RootIno    uint64
+	RbmIno     uint64
+	RsumIno    uint64
+	RExtSize   uint32
+	AGBlocks   uint32
+	AGCount    uint32
+	RbmBlocks  uint32
+	LogBlocks  uint32
+	VersionNum uint16
+	SectSize   uint16
+	InodeSize  uint16
+	InoPBlock  uint16
+	FName      [12]byte
+	BlockLog   uint8
+}
+
+func readXFSSuperblock(f io.ReaderAt) (Superblock, error) {
+	var raw xfsSuperblock
+	err := binary.Read(io.NewSectionReader(f, 0, int64(binary.Size(raw))), binary.BigEndian, &raw)
+	if err != nil {
+		return Superblock{}, err
+	}
+	if string(raw.MagicNum[:]) != xfsMagic {
+		return Superblock{}, errors.New("no XFS superblock found")
+	}
+	// the block size is stored twice, so a stray magic is easy to reject
+	if raw.BlockLog < 9 || raw.BlockLog > 16 || raw.BlockSize != 1<<raw.BlockLog || raw.DBlocks == 0 {
+		return Superblock{}, fmt.Errorf("invalid XFS superblock: %d blocks of size %d", raw.DBlocks, raw.BlockSize)
+	}
+	return Superblock{
+		TotalBlocks: int(raw.DBlocks),
+		BlockSize:   int(raw.BlockSize),
+		Label:       cString(raw.FName[:]),
+		UUID:        formatUUID(raw.UUID),
+	}, nil
+}
+
+// btrfsSuperblock is the start of the primary btrfs superblock, stored
+// little-endian at 64KiB
+type btrfsSuperblock struct {
+	Checksum       [btrfsChecksumSize]byte
+	FSID           [16]byte
+	ByteNr         uint64
+	Flags          uint64
+	Magic          [8]byte
+	Generation     uint64
+	Root           uint64
+	ChunkRoot      uint64
+	LogRoot        uint64
+	LogRootTransid uint64
+	TotalBytes     uint64
+	BytesUsed      uint64
+	RootDirObject  uint64
+	NumDevices     uint64
+	SectorSize     uint32
+	NodeSize       uint32
+	LeafSize       uint32
+	StripeSize     uint32
+	SysChunkSize   uint32
+	ChunkRootGen   uint64
+	CompatFlags    uint64
+	CompatROFlags  uint64
+	IncompatFlags  uint64
+	ChecksumType   uint16
+}
+
+// btrfsChecksum computes the superblock checksum, which covers everything
+// after the checksum field
+func btrfsChecksum(checksumType uint16, data []byte) ([]byte, error) {
+	sum := make([]byte, btrfsChecksumSize)
+	switch checksumType {
+	case btrfsCsumCRC32C:
+		binary.LittleEndian.PutUint32(sum, crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli)))
+	case btrfsCsumSHA256:
+		digest := sha256.Sum256(data)
+		copy(sum, digest[:])
+	case btrfsCsumBlake2b:
+		digest := blake2b.Sum256(data)
+		copy(sum, digest[:])
+	default:
+		return nil, fmt.Errorf("unsupported btrfs checksum type %d", checksumType)
+	}
+	return sum, nil
+}
+
+func readBtrfsSuperblock(f io.ReaderAt) (Superblock, error) {
+	data := make([]byte, btrfsSuperblockSize)
+	if _, err := f.ReadAt(data, btrfsSuperblockOffset); err != nil {
+		return Superblock{}, err
+	}
+	var raw btrfsSuperblock
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &raw); err != nil {
+		return Superblock{}, err
+	}
+	if string(raw.Magic[:]) != btrfsMagic {
+		return Superblock{}, errors.New("no btrfs superblock found")
+	}
+
+	// total_bytes is only trusted from a superblock that checks out
+	sum, err := btrfsChecksum(raw.ChecksumType, data[btrfsChecksumSize:])
+	if err != nil {
+		return Superblock{}, err
+	}
+	if !bytes.Equal(sum, raw.Checksum[:]) {
+		return Superblock{}, errors.New("btrfs superblock checksum mismatch")
+	}
+	if raw.ByteNr != btrfsSuperblockOffset || raw.SectorSize < 512 || raw.SectorSize&(raw.SectorSize-1) != 0 {
+		return Superblock{}, fmt.Errorf("invalid btrfs superblock: %d bytes in sectors of %d", raw.TotalBytes, raw.SectorSize)
+	}
+	return Superblock{
+		TotalBlocks: int(raw.TotalBytes / uint64(raw.SectorSize)),
+		BlockSize:   int(raw.SectorSize),
+		Label:       cString(data[btrfsLabelOffset : btrfsLabelOffset+btrfsLabelSize]),
+		UUID:        formatUUID(raw.FSID),
+	}, nil
+}
+
+// ntfsBootSector is the BIOS parameter block of an NTFS volume
+type ntfsBootSector struct {
+	Jump              [3]byte
+	OEMID             [8]byte
+	BytesPerSector    uint16
+	SectorsPerCluster uint8
+	Reserved          [7]byte
+	MediaDescriptor   uint8
+	Unused            [18]byte
+	TotalSectors      uint64
+	MFTCluster        uint64
+	MFTMirrorCluster  uint64
+	ClustersPerRecord int8
+	Reserved2         [3]byte
+	ClustersPerIndex  int8
+	Reserved3         [3]byte
+	SerialNumber      uint64
+}
+
+func readNTFSBootSector(f io.ReaderAt) (Superblock, error) {
+	sector := make([]byte, 512)
+	if _, err := f.ReadAt(sector, 0); err != nil {
+		return Superblock{}, err
+	}
+	var raw ntfsBootSector
+	if err := binary.Read(bytes.NewReader(sector), binary.LittleEndian, &raw); err != nil {
+		return Superblock{}, err
+	}
+	if string(raw.OEMID[:]) != ntfsOEMID {
+		return Superblock{}, errors.New("no NTFS boot sector found")
+	}
+
+	bytesPerSector := raw.BytesPerSector
+	// cluster sizes above 64KiB are stored as a negative power of two
+	sectorsPerCluster := uint32(raw.SectorsPerCluster)
+	if raw.SectorsPerCluster > 0x80 {
+		sectorsPerCluster = 1 << (256 - uint32(raw.SectorsPerCluster))
+	}
+	switch {
+	case sector[510] != 0x55 || sector[511] != 0xAA:
+		return Superblock{}, errors.New("NTFS boot sector has no boot signature")
+	case bytesPerSector < 256 || bytesPerSector > 4096 || bytesPerSector&(bytesPerSector-1) != 0:
+		return Superblock{}, fmt.Errorf("invalid NTFS sector size %d", bytesPerSector)
+	case sectorsPerCluster == 0 || sectorsPerCluster&(sectorsPerCluster-1) != 0:
+		return Superblock{}, fmt.Errorf("invalid NTFS cluster size of %d sectors", sectorsPerCluster)
+	case raw.TotalSectors == 0:
+		return Superblock{}, errors.New("NTFS boot sector has no sectors")
+	}
+	// the backup boot sector sits in the last sector, which isn't counted.
+	// The label is an attribute in the MFT, so only the serial is known.
+	return Superblock{
+		TotalBlocks: int(raw.TotalSectors + 1),
+		BlockSize:   int(bytesPerSector),
+		UUID:        fmt.Sprintf("%016X", raw.SerialNumber),
+	}, nil
+}
+
+type lvmLabelHeader struct {
+	ID      [8]byte
+	Sector  uint64
+	CRC     uint32
+	Offset  uint32
+	Type    [8]byte
+	PVUUID  [32]byte
+	DevSize uint64
+}
+
+// lvmCRC is the CRC32 LVM uses: the IEEE polynomial with its own initial
+// value and no final inversion
+func lvmCRC(data []byte) uint32 {
+	return ^crc32.Update(^uint32(lvmInitialCRC), crc32.IEEETable, data)
+}
+
+// readLVMLabel finds the label of an LVM2 physical volume, which can be in
+// any of the first four sectors, and returns the size of the device the PV
+// was created on
+func readLVMLabel(f io.ReaderAt) (Superblock, error) {
+	sector := make([]byte, 512)
+	for i := int64(0); i < lvmLabelSectors; i++ {
+		if _, err := f.ReadAt(sector, i*512); err != nil {
+			return Superblock{}, err
+		}
+		if string(sector[:8]) != lvmLabelID {
+			continue
+		}
+
+		var label lvmLabelHeader
+		if err := binary.Read(bytes.NewReader(sector), binary.LittleEndian, &label); err != nil {
+			return Superblock{}, err
+		}
+		if label.Sector != uint64(i) || lvmCRC(sector[20:]) != label.CRC {
+			return Superblock{}, errors.New("LVM label checksum mismatch")
+		}
+		if string(label.Type[:]) != lvmLabelType || label.Offset != 32 {
+			return Superblock{}, fmt.Errorf("unsupported LVM label type %q", label.Type[:])
+		}
+		if label.DevSize == 0 || label.DevSize%512 != 0 {
+			return Superblock{}, fmt.Errorf("invalid LVM device size %d", label.DevSize)
+		}
+		return Superblock{
+			TotalBlocks: int(label.DevSize / 512),
+			BlockSize:   512,
+			UUID:        formatLVMUUID(label.PVUUID),
+		}, nil
+	}
+	return Superblock{}, errors.New("no LVM label found")
+}
+
+// formatLVMUUID dashes a PV UUID the way pvs prints it
+func formatLVMUUID(uuid [32]byte) string {
+	var parts []string
+	start := 0
+	for _, n := range []int{6, 4, 4, 4, 4, 4, 6} {
+		parts = append(parts, string(uuid[start:start+n]))
+		start += n
+	}
+	return strings.Join(parts, "-")
+}
+
+// formatUUID is the usual 8-4-4-4-12 form of a UUID, empty for a zero UUID
+func formatUUID(uuid [16]byte) string {
+	if uuid == [16]byte{} {
+		return ""
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:])
+}
+
+// swapHeader is the version 1 header of a Linux swap area, which sits
+// 1KiB into its first page
+type swapHeader struct {
+	Version    uint32
+	LastPage   uint32
+	BadPages   uint32
+	UUID       [16]byte
+	VolumeName [16]byte
+}
+
+// readSwapHeader finds a Linux swap area, whose magic ends its first page.
+// The page size isn't recorded, so each one Linux supports is tried.
+func readSwapHeader(f io.ReaderAt) (Superblock, error) {
+	magic := make([]byte, len(swapMagic))
+	for pageSize := swapMinimumPageSize; pageSize <= swapMaximumPageSize; pageSize *= 2 {
+		if _, err := f.ReadAt(magic, int64(pageSize-len(swapMagic))); err != nil {
+			break
+		}
+		if string(magic) != swapMagic {
+			continue
+		}
+
+		var raw swapHeader
+		err := binary.Read(io.NewSectionReader(f, swapHeaderOffset, int64(binary.Size(raw))), binary.LittleEndian, &raw)
+		if err != nil {
+			return Superblock{}, err
+		}
+		if raw.Version != 1 || raw.LastPage == 0 {
+			return Superblock{}, fmt.Errorf("invalid swap header: version %d, last page %d", raw.Version, raw.LastPage)
+		}
+		return Superblock{
+			TotalBlocks: int(raw.LastPage) + 1,
+			BlockSize:   pageSize,
+			Label:       cString(raw.VolumeName[:]),
+			UUID:        formatUUID(raw.UUID),
+		}, nil
+	}
+	return Superblock{}, errors.New("no swap area found")
+}
+
+// probeFilesystem detects the filesystem at the start of an image to find
+// out how large it is
+func probeFilesystem(f io.ReaderAt) (Filesystem, error) {
+	if header, err := readLUKSHeader(f); err == nil {
+		// the size is unknown unless the LUKS2 segment has a fixed length
+		var sectors int64
+		if header.PayloadSize > 0 {
+			sectors = (header.PayloadOffset + header.PayloadSize) / luksSectorSize
+		}
+		return Filesystem{Type: luksType, BlockSize: luksSectorSize, TotalBlocks: sectors, Label: header.Label, UUID: header.UUID}, nil
+	}
+	probes := []struct {
+		fsType string
+		read   func(io.ReaderAt) (Superblock, error)
+	}{
+		{"ext4", readSuperblock},
+		{"xfs", readXFSSuperblock},
+		{"btrfs", readBtrfsSuperblock},
+		{"ntfs", readNTFSBootSector},
+		{lvmPVType, readLVMLabel},
+		{"swap", readSwapHeader},
+	}
+	for _, probe := range probes {
+		if superblock, err := probe.read(f); err == nil {
+			return Filesystem{
+				Type:        probe.fsType,
+				BlockSize:   superblock.BlockSize,
+				TotalBlocks: int64(superblock.TotalBlocks),
+				Label:       superblock.Label,
+				UUID:        superblock.UUID,
+			}, nil
+		}
+	}
+	return Filesystem{}, errors.New("no ext4, XFS, btrfs or NTFS filesystem, swap area, LVM PV or LUKS header found")
+}
+
+// detectFilesystem probes the block at offset 0 of the restored image
+// without restoring anything else, falling back to its partition table.
+// Data none of the probes recognize is unknownFilesystem.
+func detectFilesystem(store fs.FS, backupPath string, backups []backupstore.Backup) (Filesystem, error) {
+	blocks := backupstore.FinalBlockMap(backups)
+	if len(blocks) == 0 || blocks[0].Offset != 0 {
+		return Filesystem{}, errors.New("the backups have no block at offset 0")
+	}
+	data, err := backupstore.LoadBlock(store, backupPath, blocks[0].Block, blocks[0].Compression, blocks[0].BlockSize)
+	if err != nil {
+		return Filesystem{}, err
+	}
+	f := bytes.NewReader(data)
+	if filesystem, err := probeFilesystem(f); err == nil {
+		return filesystem, nil
+	}
+	if table, err := readPartitionTable(f); err == nil {
+		return Filesystem{Type: table.Scheme, BlockSize: 512, TotalBlocks: table.Size / 512}, nil
+	}
+	return Filesystem{Type: unknownFilesystem}, nil
+}
+
+// probeImageSize returns the size of the image final, a FinalBlockMap,
+// restores to, along with what imageSize found at its start, from the
+// block at offset 0 alone. Without that block, or when it can't be read,
+// the volume size is used if there is one.
+func probeImageSize(store fs.FS, backupPath string, final []backupstore.MappedBlock, volumeSize int64, cache *backupstore.BlockCache, progress io.Writer) (int64, string, error) {
+	if len(final) == 0 || final[0].Offset != 0 {
+		if volumeSize > 0 {
+			return volumeSize, "", nil
+		}
+		return 0, "", errors.New("the backups have no block at offset 0")
+	}
+	data, err := cache.Load(store, backupPath, final[0].Block, final[0].Compression, final[0].BlockSize)
+	if err != nil {
+		if volumeSize > 0 {
+			return volumeSize, "", nil
+		}
+		return 0, "", err
+	}
+	return imageSize(bytes.NewReader(data), volumeSize, progress)
+}
+
+// imageSize reports what the start of an image holds to progress, and
+// returns how large the image should be along with the type of filesystem,
+// partition table, LVM PV or LUKS container found, if any. The volume size wins over the
+// filesystem's, but a GPT's backup header at the end of the disk is never
+// cut off.
+func imageSize(f io.ReaderAt, volumeSize int64, progress io.Writer) (int64, string, error) {
+	var size int64
+	var contents string
+	filesystem, err := probeFilesystem(f)
+	if err == nil && filesystem.Type == luksType {
+		header, err := readLUKSHeader(f)
+		if err != nil {
+			return 0, "", err
+		}
+		fmt.Fprintln(progress, describeLUKS(header))
+		size, contents = filesystem.Size(), filesystem.Type
+		if size == 0 && volumeSize == 0 {
+			return 0, contents, errors.New("the LUKS header does not record the volume size")
+		}
+	} else if err == nil {
+		fmt.Fprintf(progress, "Filesystem: %s, %d blocks of size %d\n", filesystem.Type, filesystem.TotalBlocks, filesystem.BlockSize)
+		size, contents = filesystem.Size(), filesystem.Type
+	} else if table, tableErr := readPartitionTable(f); tableErr == nil {
+		fmt.Fprintf(progress, "Partition table: %s, %d partitions\n", table.Scheme, len(table.Partitions))
+		for _, partition := range table.Partitions {
+			fmt.Fprintf(progress, "  %d: %s, %d bytes at offset %d", partition.Index, partition.Type, partition.Size, partition.Start)
+			if partition.Name != "" {
+				fmt.Fprintf(progress, " (%s)", partition.Name)
+			}
+			if filesystem, err := probeFilesystem(io.NewSectionReader(f, partition.Start, partition.Size)); err == nil {
+				fmt.Fprintf(progress, ", %s", filesystem.Type)
+			}
+			fmt.Fprintln(progress)
+		}
+		size, contents = table.Size, table.Scheme
+		if table.Scheme == "gpt" && size > volumeSize {
+			if volumeSize > 0 {
+				fmt.Fprintf(progress, "Warning: the GPT (%d bytes) is larger than the volume (%d bytes)\n", size, volumeSize)
+			}
+			return size, contents, nil
+		}
+	} else if volumeSize == 0 {
+		return 0, "", errors.New("no ext4, XFS, btrfs or NTFS filesystem, swap area, LVM PV, LUKS header or partition table found")
+	}
+
+	if volumeSize == 0 {
+		return size, contents, nil
+	}
+	if size > volumeSize {
+		fmt.Fprintf(progress, "Warning: the filesystem (%d bytes) is larger than the volume (%d bytes)\n", size, volumeSize)
+	}
+	return volumeSize, contents, nil
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+)
+
+// readFixture returns a testdata file padded to size, the way the start of
+// a restored image would look
+func readFixture(t *testing.T, name string, size int) []byte {
+	t.Helper()
+	data, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := make([]byte, max(size, len(data)))
+	copy(image, data)
+	return image
+}
+
+func TestReadXFSSuperblock(t *testing.T) {
+	// xfs-superblock.bin is the first sector of a 1GiB XFS v5 filesystem:
+	// 262144 blocks of 4KiB in 4 allocation groups
+	image := readFixture(t, "xfs-superblock.bin", 4096)
+	superblock, err := readXFSSuperblock(bytes.NewReader(image))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if superblock.TotalBlocks != 262144 || superblock.BlockSize != 4096 {
+		t.Errorf("Expected 262144 blocks of size 4096, got %d of size %d", superblock.TotalBlocks, superblock.BlockSize)
+	}
+
+	mismatched := bytes.Clone(image)
+	binary.BigEndian.PutUint32(mismatched[4:], 8192)
+	if _, err := readXFSSuperblock(bytes.NewReader(mismatched)); err == nil {
+		t.Error("Expected error for a block size that does not match the block log")
+	}
+	if _, err := readXFSSuperblock(bytes.NewReader(make([]byte, 4096))); err == nil {
+		t.Error("Expected error for a zeroed image")
+	}
+	if _, err := readXFSSuperblock(bytes.NewReader([]byte("XFSB"))); err == nil {
+		t.Error("Expected error for a truncated superblock")
+	}
+}
+
+// btrfsTestImage places the btrfs-superblock.bin fixture, the primary
+// superblock of a 1GiB btrfs filesystem with 4KiB sectors and crc32c
+// checksums, at its offset in an image
+func btrfsTestImage(t *testing.T) []byte {
+	t.Helper()
+	superblock := readFixture(t, "btrfs-superblock.bin", btrfsSuperblockSize)
+	image := make([]byte, btrfsSuperblockOffset+btrfsSuperblockSize)
+	copy(image[btrfsSuperblockOffset:], superblock)
+	return image
+}
+
+func TestReadBtrfsSuperblock(t *testing.T) {
+	image := btrfsTestImage(t)
+	superblock, err := readBtrfsSuperblock(bytes.NewReader(image))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if superblock.TotalBlocks != 262144 || superblock.BlockSize != 4096 {
+		t.Errorf("Expected 262144 blocks of size 4096, got %d of size %d", superblock.TotalBlocks, superblock.BlockSize)
+	}
+
+	// total_bytes changed without updating the checksum
+	corrupted := bytes.Clone(image)
+	binary.LittleEndian.PutUint64(corrupted[btrfsSuperblockOffset+0x70:], 1<<40)
+	if _, err := readBtrfsSuperblock(bytes.NewReader(corrupted)); err == nil {
+		t.Error("Expected error for a superblock with a bad checksum")
+	}
+
+	resummed := bytes.Clone(image)
+	region := resummed[btrfsSuperblockOffset : btrfsSuperblockOffset+btrfsSuperblockSize]
+	binary.LittleEndian.PutUint16(region[0xc4:], btrfsCsumSHA256)
+	digest := sha256.Sum256(region[btrfsChecksumSize:])
+	copy(region, digest[:])
+	if _, err := readBtrfsSuperblock(bytes.NewReader(resummed)); err != nil {
+		t.Errorf("Unexpected error for a sha256 checksummed superblock: %v", err)
+	}
+
+	binary.LittleEndian.PutUint16(region[0xc4:], btrfsCsumXXHash)
+	if _, err := readBtrfsSuperblock(bytes.NewReader(resummed)); err == nil {
+		t.Error("Expected error for an unverifiable checksum type")
+	}
+
+	if _, err := readBtrfsSuperblock(bytes.NewReader(make([]byte, len(image)))); err == nil {
+		t.Error("Expected error for a zeroed image")
+	}
+	if _, err := readBtrfsSuperblock(bytes.NewReader(image[:btrfsSuperblockOffset+100])); err == nil {
+		t.Error("Expected error for a truncated image")
+	}
+}
+
+func TestReadNTFSBootSector(t *testing.T) {
+	// ntfs-bootsector.bin is the boot sector of a 1GiB NTFS volume with
+	// 512 byte sectors and 4KiB clusters; ntfs-garbage.bin is random data
+	// carrying the NTFS OEM ID and a boot signature
+	tests := []struct {
+		name          string
+		image         []byte
+		size          int64
+		expectedError bool
+	}{
+		{name: "valid", image: readFixture(t, "ntfs-bootsector.bin", 4096), size: 1 << 30},
+		{name: "garbage", image: readFixture(t, "ntfs-garbage.bin", 4096), expectedError: true},
+		{name: "zeroed", image: make([]byte, 4096), expectedError: true},
+		{name: "truncated", image: []byte("\xebR\x90NTFS    "), expectedError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			superblock, err := readNTFSBootSector(bytes.NewReader(tt.image))
+			if tt.expectedError {
+				if err == nil {
+					t.Error("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if size := int64(superblock.TotalBlocks) * int64(superblock.BlockSize); size != tt.size {
+				t.Errorf("Expected %d bytes, got %d", tt.size, size)
+			}
+		})
+	}
+
+	unsigned := readFixture(t, "ntfs-bootsector.bin", 4096)
+	unsigned[511] = 0
+	if _, err := readNTFSBootSector(bytes.NewReader(unsigned)); err == nil {
+		t.Error("Expected error for a boot sector without a signature")
+	}
+}
+
+// lvmTestImage places the lvm-pv-label.bin fixture, the label sector of an
+// LVM2 physical volume on a 1GiB device, in the second sector of an image
+// as pvcreate does
+func lvmTestImage(t *testing.T) []byte {
+	t.Helper()
+	image := make([]byte, 4096)
+	copy(image[512:], readFixture(t, "lvm-pv-label.bin", 512))
+	return image
+}
+
+func TestReadLVMLabel(t *testing.T) {
+	image := lvmTestImage(t)
+	superblock, err := readLVMLabel(bytes.NewReader(image))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if size := int64(superblock.TotalBlocks) * int64(superblock.BlockSize); size != 1<<30 {
+		t.Errorf("Expected %d bytes, got %d", 1<<30, size)
+	}
+
+	// device_size changed without updating the checksum
+	corrupted := bytes.Clone(image)
+	binary.LittleEndian.PutUint64(corrupted[512+64:], 1<<40)
+	if _, err := readLVMLabel(bytes.NewReader(corrupted)); err == nil {
+		t.Error("Expected error for a label with a bad checksum")
+	}
+	// the label records which sector it was written to
+	moved := make([]byte, 4096)
+	copy(moved[1024:], image[512:1024])
+	if _, err := readLVMLabel(bytes.NewReader(moved)); err == nil {
+		t.Error("Expected error for a label in the wrong sector")
+	}
+	if _, err := readLVMLabel(bytes.NewReader(make([]byte, 4096))); err == nil {
+		t.Error("Expected error for a zeroed image")
+	}
+	if _, err := readLVMLabel(bytes.NewReader(image[:600])); err == nil {
+		t.Error("Expected error for a truncated image")
+	}
+}
+
+func TestDetectFilesystem(t *testing.T) {
+	volumePath := t.TempDir()
+	first := writeTestBlock(t, volumePath, readFixture(t, "ntfs-bootsector.bin", 4096))
+	second := writeTestBlock(t, volumePath, testBlockData(2, 4096))
+	backups := []backupstore.Backup{
+		{Identifier: "backup-1", Compression: "lz4", Blocks: []backupstore.Block{{Offset: 4096, Checksum: second}, {Offset: 0, Checksum: first}}},
+	}
+
+	filesystem, err := detectFilesystem(os.DirFS(volumePath), ".", backups)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if filesystem.Type != "ntfs" || filesystem.UUID != "3A6C1F0E8D4B2C57" {
+		t.Errorf("Expected ntfs with serial 3A6C1F0E8D4B2C57, got %s with %q", filesystem.Type, filesystem.UUID)
+	}
+
+	backups[0].Blocks[1].Checksum = second
+	filesystem, err = detectFilesystem(os.DirFS(volumePath), ".", backups)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if filesystem.Type != unknownFilesystem || filesystem.Size() != 0 {
+		t.Errorf("Expected an unknown filesystem, got %+v", filesystem)
+	}
+
+	backups[0].Blocks = backups[0].Blocks[:1]
+	if _, err := detectFilesystem(os.DirFS(volumePath), ".", backups); err == nil {
+		t.Error("Expected error without a block at offset 0")
+	}
+}
+
+func TestProbeImageSize(t *testing.T) {
+	volumePath := t.TempDir()
+	ntfs := writeTestBlock(t, volumePath, readFixture(t, "ntfs-bootsector.bin", 4096))
+	garbage := writeTestBlock(t, volumePath, testBlockData(2, 4096))
+
+	tests := []struct {
+		name          string
+		first         backupstore.Block
+		volumeSize    int64
+		size          int64
+		contents      string
+		expectedError bool
+	}{
+		{name: "filesystem", first: backupstore.Block{Checksum: ntfs}, size: 1 << 30, contents: "ntfs"},
+		{name: "volume.cfg wins", first: backupstore.Block{Checksum: ntfs}, volumeSize: 1 << 20, size: 1 << 20, contents: "ntfs"},
+		{name: "nothing found", first: backupstore.Block{Checksum: garbage}, expectedError: true},
+		{name: "nothing found with volume.cfg", first: backupstore.Block{Checksum: garbage}, volumeSize: 1 << 20, size: 1 << 20},
+		{name: "no block at offset 0", first: backupstore.Block{Offset: 4096, Checksum: ntfs}, expectedError: true},
+		{name: "no block at offset 0 with volume.cfg", first: backupstore.Block{Offset: 4096, Checksum: ntfs}, volumeSize: 1 << 20, size: 1 << 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			final := []backupstore.MappedBlock{{Block: tt.first, Compression: "lz4"}}
+			size, contents, err := probeImageSize(os.DirFS(volumePath), ".", final, tt.volumeSize, nil, io.Discard)
+			if tt.expectedError {
+				if err == nil {
+					t.Errorf("Expected error, got size %d", size)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if size != tt.size || contents != tt.contents {
+				t.Errorf("Expected %d bytes of %q, got %d bytes of %q", tt.size, tt.contents, size, contents)
+			}
+		})
+	}
+}
+
+// swapTestImage is the first page of a 1MiB swap area made with
+// mkswap -p pageSize -L swap0
+func swapTestImage(pageSize int) []byte {
+	image := make([]byte, pageSize)
+	binary.LittleEndian.PutUint32(image[swapHeaderOffset:], 1)
+	binary.LittleEndian.PutUint32(image[swapHeaderOffset+4:], uint32(1<<20/pageSize-1))
+	copy(image[swapHeaderOffset+12:], []byte{0x9b, 0x1f, 0x3c, 0x52, 0x4e, 0x7a, 0x4d, 0x18, 0xa2, 0x65, 0x0c, 0xd3, 0x8e, 0x41, 0x7f, 0x06})
+	copy(image[swapHeaderOffset+28:], "swap0")
+	copy(image[pageSize-len(swapMagic):], swapMagic)
+	return image
+}
+
+func TestProbeFilesystem(t *testing.T) {
+	ext4 := ext4TestBlock(4096, 10, 2)
+	copy(ext4[ext4SuperblockOffset+0x68:], []byte{0xc2, 0x8e, 0x41, 0x0b, 0x6d, 0x53, 0x4f, 0x2a, 0x91, 0x7c, 0x3e, 0x05, 0xd8, 0xb4, 0x6a, 0x12})
+	copy(ext4[ext4SuperblockOffset+0x78:], "data\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00")
+
+	tests := []struct {
+		name          string
+		image         []byte
+		fsType        string
+		size          int64
+		label         string
+		uuid          string
+		expectedError bool
+	}{
+		{name: "ext4", image: ext4, fsType: "ext4", size: 40960, label: "data", uuid: "c28e410b-6d53-4f2a-917c-3e05d8b46a12"},
+		{name: "xfs", image: readFixture(t, "xfs-superblock.bin", 4096), fsType: "xfs", size: 1 << 30, uuid: "5b7c3f0e-8a4d-4c1e-9f2a-6d3e1b0c7a49"},
+		{name: "btrfs", image: btrfsTestImage(t), fsType: "btrfs", size: 1 << 30, uuid: "0d3c6a51-7f2e-4b8a-a4c9-2e61f0b85d17"},
+		{name: "ntfs", image: readFixture(t, "ntfs-bootsector.bin", 4096), fsType: "ntfs", size: 1 << 30, uuid: "3A6C1F0E8D4B2C57"},
+		{name: "lvm", image: lvmTestImage(t), fsType: lvmPVType, size: 1 << 30, uuid: "Xq3uJ1-LmkP-7Zr2-TbVc-9yWd-4nHs-6fEa0G"},
+		{name: "luks", image: luks2TestImage(t, make([]byte, 8192), "8192"), fsType: luksType, size: 1048576 + 8192, uuid: "6a1e5b3c-2d4f-4e8a-b9c0-1d2e3f4a5b6c"},
+		{name: "swap", image: swapTestImage(4096), fsType: "swap", size: 1 << 20, label: "swap0", uuid: "9b1f3c52-4e7a-4d18-a265-0cd38e417f06"},
+		{name: "swap with 64KiB pages", image: swapTestImage(65536), fsType: "swap", size: 1 << 20, label: "swap0", uuid: "9b1f3c52-4e7a-4d18-a265-0cd38e417f06"},
+		{name: "unknown", image: testBlockData(3, 4096), expectedError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filesystem, err := probeFilesystem(bytes.NewReader(tt.image))
+			if tt.expectedError {
+				if err == nil {
+					t.Errorf("Expected error but got %s", filesystem.Type)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if filesystem.Type != tt.fsType || filesystem.Size() != tt.size {
+				t.Errorf("Expected %s of %d bytes, got %s of %d bytes", tt.fsType, tt.size, filesystem.Type, filesystem.Size())
+			}
+			if filesystem.Label != tt.label || filesystem.UUID != tt.uuid {
+				t.Errorf("Expected label %q and UUID %q, got %q and %q", tt.label, tt.uuid, filesystem.Label, filesystem.UUID)
+			}
+		})
+	}
+}
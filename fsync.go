@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fsyncInterval is how often a restore syncs the image to disk, after an
+// amount written or a time passed. The zero value never syncs.
+type fsyncInterval struct {
+	bytes int64
+	every time.Duration
+}
+
+func (i fsyncInterval) enabled() bool {
+	return i.bytes > 0 || i.every > 0
+}
+
+// parseFsyncInterval accepts a byte size such as 4GiB, a duration such as
+// 30s, or 0
+func parseFsyncInterval(value string) (fsyncInterval, error) {
+	value = strings.TrimSpace(value)
+	if value == "0" {
+		return fsyncInterval{}, nil
+	}
+	if every, err := time.ParseDuration(value); err == nil {
+		if every <= 0 {
+			return fsyncInterval{}, fmt.Errorf("expected a positive duration, got %s", value)
+		}
+		return fsyncInterval{every: every}, nil
+	}
+	bytes, err := parseByteSize(value)
+	if err != nil {
+		return fsyncInterval{}, fmt.Errorf("expected a size such as 4GiB, a duration such as 30s, or 0, got %s", value)
+	}
+	return fsyncInterval{bytes: bytes}, nil
+}
+
+// syncedWriter calls sync each time interval has been written through it or
+// has passed since the last call. A write that hits the interval waits for
+// the sync and returns its error.
+type syncedWriter struct {
+	w        io.WriterAt
+	sync     func() error
+	interval fsyncInterval
+
+	mu      sync.Mutex
+	written int64
+	last    time.Time
+}
+
+func newSyncedWriter(w io.WriterAt, interval fsyncInterval, sync func() error) *syncedWriter {
+	return &syncedWriter{w: w, sync: sync, interval: interval, last: time.Now()}
+}
+
+func (s *syncedWriter) WriteAt(p []byte, off int64) (int, error) {
+	n, err := s.w.WriteAt(p, off)
+	if err != nil {
+		return n, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.written += int64(n)
+	if (s.interval.bytes <= 0 || s.written < s.interval.bytes) && (s.interval.every <= 0 || time.Since(s.last) < s.interval.every) {
+		return n, nil
+	}
+	s.written, s.last = 0, time.Now()
+	return n, s.sync()
+}
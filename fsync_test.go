@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseFsyncInterval(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected fsyncInterval
+		wantErr  bool
+	}{
+		{value: "0", expected: fsyncInterval{}},
+		{value: "4GiB", expected: fsyncInterval{bytes: 4 << 30}},
+		{value: "1073741824", expected: fsyncInterval{bytes: 1 << 30}},
+		{value: "30s", expected: fsyncInterval{every: 30 * time.Second}},
+		{value: "2M", expected: fsyncInterval{bytes: 2 << 20}},
+		{value: "2m", expected: fsyncInterval{every: 2 * time.Minute}},
+		{value: "2m30s", expected: fsyncInterval{every: 150 * time.Second}},
+		{value: "-5s", wantErr: true},
+		{value: "often", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			interval, err := parseFsyncInterval(tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Expected error for %s", tt.value)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if interval != tt.expected {
+				t.Errorf("Expected %+v, got %+v", tt.expected, interval)
+			}
+		})
+	}
+}
+
+type discardWriterAt struct{}
+
+func (discardWriterAt) WriteAt(p []byte, off int64) (int, error) { return len(p), nil }
+
+func TestSyncedWriter(t *testing.T) {
+	syncs := 0
+	w := newSyncedWriter(discardWriterAt{}, fsyncInterval{bytes: 10}, func() error {
+		syncs++
+		return nil
+	})
+	for i := range 5 {
+		if _, err := w.WriteAt(make([]byte, 4), int64(i)*4); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	// synced once 12 bytes were written, with 8 written since
+	if syncs != 1 {
+		t.Errorf("Expected 1 sync, got %d", syncs)
+	}
+
+	w = newSyncedWriter(discardWriterAt{}, fsyncInterval{every: time.Hour}, func() error {
+		syncs++
+		return nil
+	})
+	syncs = 0
+	if _, err := w.WriteAt(make([]byte, 4), 0); err != nil || syncs != 0 {
+		t.Errorf("Expected no sync before the interval passed, got %d and %v", syncs, err)
+	}
+	w.last = time.Now().Add(-time.Hour)
+	if _, err := w.WriteAt(make([]byte, 4), 4); err != nil || syncs != 1 {
+		t.Errorf("Expected a sync once the interval passed, got %d and %v", syncs, err)
+	}
+
+	failed := errors.New("disk gone")
+	w = newSyncedWriter(discardWriterAt{}, fsyncInterval{bytes: 1}, func() error { return failed })
+	if n, err := w.WriteAt(make([]byte, 4), 0); n != 4 || !errors.Is(err, failed) {
+		t.Errorf("Expected the write to report the failed sync, got %d and %v", n, err)
+	}
+}
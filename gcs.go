@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	gcsAttempts = 4
+	gcsEndpoint = "https://storage.googleapis.com"
+	gcsScope    = "https://www.googleapis.com/auth/devstorage.read_only"
+)
+
+// gcsStore exposes the backupstore under a GCS prefix as a read-only
+// filesystem through the JSON API, like s3Store does for S3
+type gcsStore struct {
+	retryCounter
+	ctx      context.Context
+	client   *http.Client
+	endpoint string
+	bucket   string
+	// object prefix of the backupstore, always ending in "/"
+	prefix  string
+	backoff time.Duration
+}
+
+type gcsStatusError struct {
+	Code    int
+	Message string
+}
+
+func (e *gcsStatusError) Error() string {
+	return fmt.Sprintf("gcs: %d %s", e.Code, e.Message)
+}
+
+func (e *gcsStatusError) Is(target error) bool {
+	switch e.Code {
+	case http.StatusNotFound:
+		return target == fs.ErrNotExist
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return target == fs.ErrPermission
+	}
+	return false
+}
+
+type gcsObject struct {
+	Name    string    `json:"name"`
+	Size    string    `json:"size"`
+	Updated time.Time `json:"updated"`
+}
+
+type gcsObjectList struct {
+	Items         []gcsObject `json:"items"`
+	Prefixes      []string    `json:"prefixes"`
+	NextPageToken string      `json:"nextPageToken"`
+}
+
+func parseGCSURL(raw string) (bucket, prefix string, err error) {
+	rest, ok := strings.CutPrefix(raw, "gs://")
+	if !ok {
+		return "", "", fmt.Errorf("not a gs url: %s", raw)
+	}
+	bucket, prefix, _ = strings.Cut(rest, "/")
+	if bucket == "" {
+		return "", "", fmt.Errorf("missing bucket in %s", raw)
+	}
+	return bucket, strings.Trim(prefix, "/"), nil
+}
+
+func newGCSStore(ctx context.Context, backupRoot string) (*gcsStore, error) {
+	bucket, prefix, err := parseGCSURL(backupRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &gcsStore{
+		ctx:      ctx,
+		endpoint: gcsEndpoint,
+		bucket:   bucket,
+		prefix:   path.Join(prefix, "backupstore") + "/",
+		backoff:  500 * time.Millisecond,
+	}
+	// the same variable the official client libraries honour for emulators
+	if host := os.Getenv("STORAGE_EMULATOR_HOST"); host != "" {
+		if !strings.Contains(host, "://") {
+			host = "http://" + host
+		}
+		store.endpoint = strings.TrimSuffix(host, "/")
+		store.client = http.DefaultClient
+		return store, nil
+	}
+
+	store.client, err = google.DefaultClient(ctx, gcsScope)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find Google application default credentials: %w", err)
+	}
+	return store, nil
+}
+
+func (s *gcsStore) String() string {
+	return "gs://" + s.bucket + "/" + strings.TrimSuffix(s.prefix, "/")
+}
+
+// Remote implements backupstore.RemoteFS, so missing blocks aren't
+// searched for
+func (s *gcsStore) Remote() bool { return true }
+
+func (s *gcsStore) key(name string) string {
+	if name == "." {
+		return s.prefix
+	}
+	return s.prefix + name
+}
+
+// gcsTransient reports rate limiting, server errors and network failures
+func gcsTransient(err error) bool {
+	var status *gcsStatusError
+	if errors.As(err, &status) {
+		return status.Code == http.StatusTooManyRequests || status.Code >= 500
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+func (s *gcsStore) retry(op func() error) error {
+	return s.retryBackoff(s.ctx, gcsAttempts, s.backoff, op, gcsTransient)
+}
+
+// get issues a GET and returns the body of a successful response
+func (s *gcsStore) get(rawURL string) ([]byte, error) {
+	var body []byte
+	err := s.retry(func() error {
+		req, err := http.NewRequestWithContext(s.ctx, http.MethodGet, rawURL, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+			return &gcsStatusError{Code: resp.StatusCode, Message: strings.TrimSpace(string(message))}
+		}
+		body, err = io.ReadAll(resp.Body)
+		return err
+	})
+	return body, err
+}
+
+func (s *gcsStore) objectURL(key string) string {
+	return s.endpoint + "/storage/v1/b/" + url.PathEscape(s.bucket) + "/o/" + url.PathEscape(key)
+}
+
+func (s *gcsStore) ReadFile(name string) ([]byte, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrInvalid}
+	}
+	data, err := s.get(s.objectURL(s.key(name)) + "?alt=media")
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	return data, nil
+}
+
+func (s *gcsStore) list(name string, limit int) ([]fs.DirEntry, error) {
+	prefix := s.key(name)
+	if name != "." {
+		prefix += "/"
+	}
+
+	entries := make([]fs.DirEntry, 0)
+	token := ""
+	for {
+		query := url.Values{"prefix": {prefix}, "delimiter": {"/"}}
+		if token != "" {
+			query.Set("pageToken", token)
+		}
+		if limit > 0 {
+			query.Set("maxResults", strconv.Itoa(limit))
+		}
+		body, err := s.get(s.endpoint + "/storage/v1/b/" + url.PathEscape(s.bucket) + "/o?" + query.Encode())
+		if err != nil {
+			return nil, err
+		}
+		var page gcsObjectList
+		if err := json.Unmarshal(body, &page); err != nil {
+			return nil, fmt.Errorf("failed to parse object listing: %w", err)
+		}
+
+		for _, common := range page.Prefixes {
+			dir := strings.TrimSuffix(strings.TrimPrefix(common, prefix), "/")
+			entries = append(entries, fs.FileInfoToDirEntry(remoteFileInfo{name: dir, dir: true}))
+		}
+		for _, object := range page.Items {
+			file := strings.TrimPrefix(object.Name, prefix)
+			if file == "" {
+				continue
+			}
+			size, _ := strconv.ParseInt(object.Size, 10, 64)
+			entries = append(entries, fs.FileInfoToDirEntry(remoteFileInfo{
+				name:    file,
+				size:    size,
+				modTime: object.Updated,
+			}))
+		}
+
+		if limit > 0 || page.NextPageToken == "" {
+			break
+		}
+		token = page.NextPageToken
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+func (s *gcsStore) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	entries, err := s.list(name, 0)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	if len(entries) == 0 {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	return entries, nil
+}
+
+func (s *gcsStore) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+
+	if name != "." {
+		body, err := s.get(s.objectURL(s.key(name)))
+		if err == nil {
+			var object gcsObject
+			if err := json.Unmarshal(body, &object); err != nil {
+				return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+			}
+			size, _ := strconv.ParseInt(object.Size, 10, 64)
+			return remoteFileInfo{name: path.Base(name), size: size, modTime: object.Updated}, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+		}
+	}
+
+	// directories only exist as a prefix of other objects
+	entries, err := s.list(name, 1)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	if len(entries) == 0 {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return remoteFileInfo{name: path.Base(name), dir: true}, nil
+}
+
+func (s *gcsStore) Open(name string) (fs.File, error) {
+	return openRemote(s, name)
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+)
+
+// fakeGCS serves the subset of the GCS JSON API the backend uses
+type fakeGCS struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	failures map[string]int
+	denied   map[string]bool
+	gets     map[string]int
+	pageSize int
+}
+
+func newFakeGCS() *fakeGCS {
+	return &fakeGCS{
+		objects:  make(map[string][]byte),
+		failures: make(map[string]int),
+		denied:   make(map[string]bool),
+		gets:     make(map[string]int),
+		pageSize: 2,
+	}
+}
+
+func (f *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	rest, ok := strings.CutPrefix(r.URL.EscapedPath(), "/storage/v1/b/longhorn-backups/o")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if rest == "" {
+		f.list(w, r)
+		return
+	}
+
+	key, err := url.PathUnescape(strings.TrimPrefix(rest, "/"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.gets[key]++
+	if f.failures[key] > 0 {
+		f.failures[key]--
+		http.Error(w, "backend error", http.StatusServiceUnavailable)
+		return
+	}
+	if f.denied[key] {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	data, ok := f.objects[key]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if r.URL.Query().Get("alt") == "media" {
+		w.Write(data)
+		return
+	}
+	json.NewEncoder(w).Encode(gcsObject{Name: key, Size: strconv.Itoa(len(data))})
+}
+
+func (f *fakeGCS) list(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	delimiter := r.URL.Query().Get("delimiter")
+	seen := make(map[string]bool)
+	keys := make([]string, 0)
+	for key := range f.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		rest := key[len(prefix):]
+		if i := strings.Index(rest, delimiter); delimiter != "" && i >= 0 {
+			key = prefix + rest[:i+1]
+		}
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	start := 0
+	if token := r.URL.Query().Get("pageToken"); token != "" {
+		start = sort.SearchStrings(keys, token)
+	}
+	limit := f.pageSize
+	if max, err := strconv.Atoi(r.URL.Query().Get("maxResults")); err == nil {
+		limit = min(limit, max)
+	}
+	end := min(start+limit, len(keys))
+
+	var out gcsObjectList
+	if end < len(keys) {
+		out.NextPageToken = keys[end]
+	}
+	for _, key := range keys[start:end] {
+		if delimiter != "" && strings.HasSuffix(key, delimiter) {
+			out.Prefixes = append(out.Prefixes, key)
+			continue
+		}
+		out.Items = append(out.Items, gcsObject{Name: key, Size: strconv.Itoa(len(f.objects[key]))})
+	}
+	json.NewEncoder(w).Encode(out)
+}
+
+// uploadDir copies a local directory tree into the fake bucket under prefix
+func (f *fakeGCS) uploadDir(t *testing.T, dir string, prefix string) {
+	t.Helper()
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		f.objects[prefix+filepath.ToSlash(rel)] = data
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// openTestGCSStore points newGCSStore at the fake server the same way an
+// emulator is selected outside of tests
+func openTestGCSStore(t *testing.T, server *fakeGCS) *gcsStore {
+	t.Helper()
+	ts := httptest.NewServer(server)
+	t.Cleanup(ts.Close)
+	t.Setenv("STORAGE_EMULATOR_HOST", ts.URL)
+
+	store, err := newGCSStore(context.Background(), "gs://longhorn-backups/cluster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.backoff = 0
+	return store
+}
+
+func TestParseGCSURL(t *testing.T) {
+	tests := []struct {
+		url           string
+		bucket        string
+		prefix        string
+		expectedError bool
+	}{
+		{url: "gs://longhorn-backups", bucket: "longhorn-backups"},
+		{url: "gs://longhorn-backups/", bucket: "longhorn-backups"},
+		{url: "gs://longhorn-backups/cluster/a/", bucket: "longhorn-backups", prefix: "cluster/a"},
+		{url: "gs://", expectedError: true},
+		{url: "s3://longhorn-backups", expectedError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			bucket, prefix, err := parseGCSURL(tt.url)
+			if tt.expectedError {
+				if err == nil {
+					t.Error("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if bucket != tt.bucket || prefix != tt.prefix {
+				t.Errorf("Expected %s/%s, got %s/%s", tt.bucket, tt.prefix, bucket, prefix)
+			}
+		})
+	}
+}
+
+func TestGCSStoreRestore(t *testing.T) {
+	local := t.TempDir()
+	volumePath := filepath.Join(local, "volumes", "5f", "a2", "pvc-123")
+	if err := os.MkdirAll(filepath.Join(volumePath, "backups"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	blockSize := 4096
+	first := writeTestBlock(t, volumePath, testBlockData(1, blockSize))
+	second := writeTestBlock(t, volumePath, testBlockData(2, blockSize))
+	cfg := `{"CreatedTime": "2024-01-01T00:00:00Z", "Size": "8192", "CompressionMethod": "lz4", "BlockSize": "4096",
+		"Blocks": [{"Offset": 0, "BlockChecksum": "` + first + `"}, {"Offset": 4096, "BlockChecksum": "` + second + `"}]}`
+	if err := os.WriteFile(filepath.Join(volumePath, "backups", "backup_backup-1.cfg"), []byte(cfg), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	server := newFakeGCS()
+	server.uploadDir(t, local, "cluster/backupstore/")
+	store := openTestGCSStore(t, server)
+
+	backupFS, root, err := openBackupStore(context.Background(), "gs://longhorn-backups/cluster", storeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := backupFS.(*gcsStore); !ok || root != "gs://longhorn-backups/cluster/backupstore" {
+		t.Errorf("Expected a gcs store at gs://longhorn-backups/cluster/backupstore, got %T at %s", backupFS, root)
+	}
+
+	volumes, err := backupstore.ListVolumes(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(volumes) != 1 || volumes[0] != "volumes/5f/a2/pvc-123" {
+		t.Errorf("Expected the pvc-123 volume, got %v", volumes)
+	}
+
+	volumeBackupPath, err := backupstore.FindVolumeBackupPath(store, "pvc-123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeBackup, err := backupstore.ReadBackups(store, volumeBackupPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(volumeBackup.Backups) != 1 {
+		t.Fatalf("Expected 1 backup, got %d", len(volumeBackup.Backups))
+	}
+	if len(volumeBackup.Backups[0].Blocks) != 2 {
+		t.Errorf("Expected 2 blocks, got %d", len(volumeBackup.Backups[0].Blocks))
+	}
+
+	out, err := os.Create(filepath.Join(t.TempDir(), "out.raw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	err = backupstore.Repack(context.Background(), store, volumeBackup.BackupPath, volumeBackup.Backups, out, backupstore.RepackOptions{Jobs: 2})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	content, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, append(testBlockData(1, blockSize), testBlockData(2, blockSize)...)) {
+		t.Error("Restored image does not match expected content")
+	}
+}
+
+func TestGCSStoreRetries(t *testing.T) {
+	server := newFakeGCS()
+	server.objects["cluster/backupstore/flaky.cfg"] = []byte("data")
+	server.objects["cluster/backupstore/broken.cfg"] = []byte("data")
+	server.objects["cluster/backupstore/private.cfg"] = []byte("data")
+	server.failures["cluster/backupstore/flaky.cfg"] = gcsAttempts - 1
+	server.failures["cluster/backupstore/broken.cfg"] = gcsAttempts
+	server.denied["cluster/backupstore/private.cfg"] = true
+	store := openTestGCSStore(t, server)
+
+	data, err := store.ReadFile("flaky.cfg")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if string(data) != "data" {
+		t.Errorf("Expected data, got %s", data)
+	}
+	if server.gets["cluster/backupstore/flaky.cfg"] != gcsAttempts {
+		t.Errorf("Expected %d attempts, got %d", gcsAttempts, server.gets["cluster/backupstore/flaky.cfg"])
+	}
+
+	if _, err := store.ReadFile("broken.cfg"); err == nil {
+		t.Error("Expected error after exhausting retries")
+	}
+
+	_, err = store.ReadFile("missing.cfg")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected not exist error, got %v", err)
+	}
+	if server.gets["cluster/backupstore/missing.cfg"] != 1 {
+		t.Errorf("Expected missing objects not to be retried, got %d attempts", server.gets["cluster/backupstore/missing.cfg"])
+	}
+
+	_, err = store.ReadFile("private.cfg")
+	if !errors.Is(err, os.ErrPermission) {
+		t.Errorf("Expected permission error, got %v", err)
+	}
+	if server.gets["cluster/backupstore/private.cfg"] != 1 {
+		t.Errorf("Expected forbidden objects not to be retried, got %d attempts", server.gets["cluster/backupstore/private.cfg"])
+	}
+}
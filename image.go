@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+type imageWriter interface {
+	io.ReaderAt
+	io.WriterAt
+	// Truncate sets the final size of the disk the image describes
+	Truncate(size int64) error
+	Close() error
+}
+
+var outputFormats = []string{"raw", "qcow2", "vhd", "vmdk", "vdi"}
+
+func createImage(path string, format string) (imageWriter, error) {
+	switch format {
+	case "raw":
+		return os.Create(path)
+	case "qcow2":
+		return createQcow2(path)
+	case "vhd":
+		return createVHD(path)
+	case "vmdk":
+		return createVMDK(path)
+	case "vdi":
+		return createVDI(path)
+	default:
+		return nil, fmt.Errorf("unsupported output format %s", format)
+	}
+}
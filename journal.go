@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+const journalSuffix = ".lhbr-state"
+
+// journalHeader identifies the restore a journal belongs to, so a resume
+// only continues the exact same restore into the same file
+type journalHeader struct {
+	Target  string `json:"target"`
+	Outfile string `json:"outfile"`
+	// Backups are the cfg files of the backups restored
+	Backups []string `json:"backups"`
+}
+
+func (h journalHeader) matches(other journalHeader) bool {
+	return h.Target == other.Target && h.Outfile == other.Outfile && slices.Equal(h.Backups, other.Backups)
+}
+
+// restoreJournal records which offsets of the image have been restored so
+// an interrupted restore can pick up where it stopped. The file is a JSON
+// header line followed by one offset per line, appended at each
+// checkpoint after the image itself has been synced. Checkpoints are made
+// at each -fsync-interval, and when the journal is closed.
+type restoreJournal struct {
+	mu      sync.Mutex
+	file    *os.File
+	image   interface{ Sync() error }
+	pending []int64
+}
+
+func journalPath(outfile string) string {
+	return outfile + journalSuffix
+}
+
+func createJournal(path string, header journalHeader, image interface{ Sync() error }) (*restoreJournal, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	line, err := json.Marshal(header)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &restoreJournal{file: file, image: image}, nil
+}
+
+// readJournal returns the header of a journal and the offsets it records
+// as restored. A line cut short by a crash is ignored.
+func readJournal(path string) (journalHeader, map[int64]struct{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return journalHeader{}, nil, err
+	}
+	// only complete lines were synced
+	data = data[:bytes.LastIndexByte(data, '\n')+1]
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	var header journalHeader
+	if !scanner.Scan() {
+		return journalHeader{}, nil, errors.New("empty restore journal")
+	}
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		return journalHeader{}, nil, fmt.Errorf("invalid restore journal header: %w", err)
+	}
+	completed := make(map[int64]struct{})
+	for scanner.Scan() {
+		offset, err := strconv.ParseInt(scanner.Text(), 10, 64)
+		if err != nil {
+			return journalHeader{}, nil, fmt.Errorf("invalid restore journal entry %q", scanner.Text())
+		}
+		completed[offset] = struct{}{}
+	}
+	return header, completed, scanner.Err()
+}
+
+// openJournal reopens an existing journal to append to it
+func openJournal(path string, image interface{ Sync() error }) (*restoreJournal, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &restoreJournal{file: file, image: image}, nil
+}
+
+// Record marks the block at offset as restored, as of the next checkpoint
+func (j *restoreJournal) Record(offset int64) error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.pending = append(j.pending, offset)
+	return nil
+}
+
+// Checkpoint syncs the image and records the blocks restored since the
+// last checkpoint
+func (j *restoreJournal) Checkpoint() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.checkpoint()
+}
+
+// checkpoint syncs the image, then the offsets restored since the last
+// checkpoint, so the journal never claims blocks that could be lost
+func (j *restoreJournal) checkpoint() error {
+	if err := j.image.Sync(); err != nil {
+		return fmt.Errorf("failed to sync image: %w", err)
+	}
+	if len(j.pending) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	for _, offset := range j.pending {
+		buf.WriteString(strconv.FormatInt(offset, 10))
+		buf.WriteByte('\n')
+	}
+	if _, err := j.file.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to write restore journal: %w", err)
+	}
+	if err := j.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync restore journal: %w", err)
+	}
+	j.pending = j.pending[:0]
+	return nil
+}
+
+// Close checkpoints whatever has been restored so far
+func (j *restoreJournal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	err := j.checkpoint()
+	if closeErr := j.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
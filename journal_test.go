@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+)
+
+type countingSyncer struct {
+	syncs int
+}
+
+func (c *countingSyncer) Sync() error {
+	c.syncs++
+	return nil
+}
+
+func TestRestoreJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.raw"+journalSuffix)
+	header := journalHeader{Target: "pvc-123", Outfile: "/restore/out.raw", Backups: []string{"backup-1", "backup-2"}}
+	image := &countingSyncer{}
+
+	journal, err := createJournal(path, header, image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 5 {
+		if err := journal.Record(int64(i) * 4096); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if _, completed, err := readJournal(path); err != nil || len(completed) != 0 {
+		t.Errorf("Expected no offsets before the first checkpoint, got %d and %v", len(completed), err)
+	}
+	if err := journal.Checkpoint(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if image.syncs != 1 {
+		t.Errorf("Expected the image to be synced at the checkpoint, got %d syncs", image.syncs)
+	}
+	_, completed, err := readJournal(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(completed) != 5 {
+		t.Errorf("Expected 5 offsets before closing, got %d", len(completed))
+	}
+
+	for i := range 3 {
+		if err := journal.Record(int64(5+i) * 4096); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if err := journal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if image.syncs != 2 {
+		t.Errorf("Expected the image to be synced again on close, got %d syncs", image.syncs)
+	}
+	saved, completed, err := readJournal(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !saved.matches(header) {
+		t.Errorf("Expected header %+v, got %+v", header, saved)
+	}
+	if len(completed) != 8 {
+		t.Errorf("Expected 8 offsets, got %d", len(completed))
+	}
+
+	// a crash can leave half a line behind
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, append(data, "81"...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, completed, err = readJournal(path); err != nil || len(completed) != 8 {
+		t.Errorf("Expected the partial line to be ignored, got %d offsets and %v", len(completed), err)
+	}
+
+	other := header
+	other.Backups = []string{"backup-1"}
+	if saved.matches(other) {
+		t.Error("Expected a journal for a different backup chain not to match")
+	}
+
+	if err := os.WriteFile(path, []byte("{}\nnot an offset\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := readJournal(path); err == nil {
+		t.Error("Expected error for an invalid entry")
+	}
+}
+
+func TestRestoreBackupsResume(t *testing.T) {
+	volumePath := t.TempDir()
+	blockSize := 4096
+	first := writeTestBlock(t, volumePath, testBlockData(1, blockSize))
+	second := writeTestBlock(t, volumePath, testBlockData(2, blockSize))
+	third := writeTestBlock(t, volumePath, testBlockData(3, blockSize))
+	backups := []backupstore.Backup{
+		{Identifier: "backup-1", Compression: "lz4", Blocks: []backupstore.Block{{Offset: 0, Checksum: first}, {Offset: 4096, Checksum: first}}},
+		{Identifier: "backup-2", Compression: "lz4", Blocks: []backupstore.Block{{Offset: 4096, Checksum: second}, {Offset: 8192, Checksum: third}}},
+	}
+
+	// the earlier run got as far as the newer copy of offset 4096, marked
+	// here so a rewrite would be noticed
+	out, err := os.Create(filepath.Join(t.TempDir(), "out.raw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	marker := bytes.Repeat([]byte{0xaa}, blockSize)
+	if _, err := out.WriteAt(marker, 4096); err != nil {
+		t.Fatal(err)
+	}
+
+	journal, err := createJournal(out.Name()+journalSuffix, journalHeader{Target: "pvc-123"}, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var progress bytes.Buffer
+	err = backupstore.Repack(context.Background(), os.DirFS(volumePath), ".", backups, out, backupstore.RepackOptions{
+		Jobs:      2,
+		Completed: map[int64]struct{}{4096: {}},
+		Journal:   journal,
+		Logger:    newLogger(&progress, "text", slog.LevelInfo),
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := journal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := append(append(testBlockData(1, blockSize), marker...), testBlockData(3, blockSize)...)
+	if !bytes.Equal(content, expected) {
+		t.Error("Expected the completed offset to be left alone and the rest restored")
+	}
+	if !bytes.Contains(progress.Bytes(), []byte("Skipping blocks restored by an earlier run blocks=1")) {
+		t.Errorf("Expected the resumed block to be reported, got %q", progress.String())
+	}
+
+	_, completed, err := readJournal(out.Name() + journalSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(completed) != 2 {
+		t.Errorf("Expected the 2 newly restored offsets in the journal, got %v", completed)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+)
+
+var listFormats = []string{"text", "json"}
+
+// namesFormat is the -output of list-volumes and list-backups that prints
+// only names, one per line, for scripts and shell completion. It reads no
+// cfg file.
+const namesFormat = "names"
+
+type backupListEntry struct {
+	Name        string    `json:"name"`
+	Created     time.Time `json:"created"`
+	Size        int64     `json:"size"`
+	Compression string    `json:"compression"`
+	Blocks      int       `json:"blocks"`
+}
+
+// printBackupList writes one row per backup, newest first, from the
+// backup.cfg files alone
+func printBackupList(w io.Writer, backups []backupstore.Backup, format string) error {
+	entries := make([]backupListEntry, 0, len(backups))
+	for _, backup := range slices.Backward(backups) {
+		entries = append(entries, backupListEntry{
+			Name:        backup.Identifier,
+			Created:     backup.Timestamp,
+			Size:        backup.Size,
+			Compression: backup.Compression,
+			Blocks:      len(backup.Blocks),
+		})
+	}
+
+	if format == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(entries)
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tCREATED\tSIZE\tCOMPRESSION\tBLOCKS")
+	for _, entry := range entries {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%d\n", entry.Name, entry.Created.Format(time.RFC3339), entry.Size, entry.Compression, entry.Blocks)
+	}
+	return tw.Flush()
+}
+
+// volumeListEntry is a row of list-volumes, from the volume.cfg of the
+// volume, which leaves the other fields empty if it has none
+type volumeListEntry struct {
+	Name         string `json:"name"`
+	Size         int64  `json:"size,omitempty"`
+	Created      string `json:"created,omitempty"`
+	LastBackup   string `json:"lastBackup,omitempty"`
+	BackingImage string `json:"backingImage,omitempty"`
+	// Error is why volume.cfg couldn't be read
+	Error string `json:"error,omitempty"`
+}
+
+// listVolumes reads the volume.cfg of every volume in volumes, a request
+// each in a remote store, and returns a row for each in order of name
+func listVolumes(store fs.FS, volumes []string, name func(volume string) string) []volumeListEntry {
+	entries := make([]volumeListEntry, 0, len(volumes))
+	for _, volume := range volumes {
+		entry := volumeListEntry{Name: name(volume)}
+		cfg, err := backupstore.ReadVolumeConfig(store, volume)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+		case err != nil:
+			entry.Error = err.Error()
+		default:
+			entry.Size, entry.Created, entry.LastBackup, entry.BackingImage = int64(cfg.Size), cfg.CreatedTime, cfg.LastBackupName, cfg.BackingImageName
+		}
+		entries = append(entries, entry)
+	}
+	slices.SortStableFunc(entries, func(a, b volumeListEntry) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+	return entries
+}
+
+// printVolumeList writes one row per volume, followed in text by why any
+// volume.cfg couldn't be read
+func printVolumeList(w io.Writer, entries []volumeListEntry, format string) error {
+	if format == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(entries)
+	}
+	cell := func(value string) string {
+		return cmp.Or(value, "-")
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSIZE\tCREATED\tLAST BACKUP\tBACKING IMAGE")
+	for _, entry := range entries {
+		size := "-"
+		if entry.Size > 0 {
+			size = strconv.FormatInt(entry.Size, 10)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", entry.Name, size, cell(entry.Created), cell(entry.LastBackup), cell(entry.BackingImage))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Error != "" {
+			fmt.Fprintf(w, "Warning: could not read the volume.cfg of %s: %s\n", entry.Name, entry.Error)
+		}
+	}
+	return nil
+}
+
+// printNames writes one name per line
+func printNames(w io.Writer, names []string) error {
+	for _, name := range names {
+		if _, err := fmt.Fprintln(w, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// volumeNames returns the names of the volumes at paths, sorted and
+// without duplicates
+func volumeNames(paths []string) []string {
+	names := make([]string, 0, len(paths))
+	for _, p := range paths {
+		names = append(names, path.Base(p))
+	}
+	slices.Sort(names)
+	return slices.Compact(names)
+}
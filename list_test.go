@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+)
+
+func TestPrintBackupList(t *testing.T) {
+	backups := []backupstore.Backup{
+		{Identifier: "backup-1", ConfigPath: "backups/backup_backup-1.cfg", Timestamp: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), Size: 4096, Compression: "gzip", Blocks: []backupstore.Block{{}, {}}},
+		{Identifier: "backup-2", ConfigPath: "backups/backup_backup-2.cfg", Timestamp: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), Size: 8192, Compression: "lz4", Blocks: []backupstore.Block{{}}},
+	}
+
+	var text bytes.Buffer
+	if err := printBackupList(&text, backups, "text"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(text.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected a header and 2 rows, got %q", text.String())
+	}
+	if fields := strings.Fields(lines[1]); strings.Join(fields, " ") != "backup-2 2024-02-01T00:00:00Z 8192 lz4 1" {
+		t.Errorf("Expected the newest backup first, got %q", lines[1])
+	}
+	if !strings.HasPrefix(lines[2], "backup-1 ") {
+		t.Errorf("Expected the oldest backup last, got %q", lines[2])
+	}
+
+	var out bytes.Buffer
+	if err := printBackupList(&out, backups, "json"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var entries []backupListEntry
+	if err := json.Unmarshal(out.Bytes(), &entries); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(entries) != 2 || entries[0].Name != "backup-2" || entries[1].Blocks != 2 || entries[1].Compression != "gzip" {
+		t.Errorf("Unexpected entries %+v", entries)
+	}
+	// the names are what -backup accepts
+	if selected, err := selectBackup(backups, entries[1].Name); err != nil || selected[0].Identifier != backups[0].Identifier {
+		t.Errorf("Expected %s to select the oldest backup, got %v", entries[1].Name, err)
+	}
+}
+
+func TestListVolumes(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{
+		"volumes/5f/a2/pvc-b/backups",
+		"volumes/01/02/pvc-a/blocks/ab/cd",
+		"volumes/03/04/pvc-c/blocks/ab/cd",
+		// a copy of pvc-b under a different shard
+		"volumes/9e/9e/pvc-b/backups",
+		// not volumes: an empty shard and one with only blocks left
+		"volumes/77/88",
+		"volumes/ee/ff/pvc-deleted/blocks/ab/cd",
+	} {
+		if err := os.MkdirAll(filepath.Join(root, filepath.FromSlash(dir)), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{
+		"volumes/01/02/pvc-a/volume.cfg",
+		"volumes/03/04/pvc-c/volume.cfg",
+		"volumes/README",
+		"volumes/5f/stray.txt",
+	} {
+		if err := os.WriteFile(filepath.Join(root, filepath.FromSlash(file)), []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	volumes, err := backupstore.ListVolumes(os.DirFS(root))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := []string{"volumes/01/02/pvc-a", "volumes/03/04/pvc-c", "volumes/5f/a2/pvc-b", "volumes/9e/9e/pvc-b"}
+	if !slices.Equal(volumes, expected) {
+		t.Errorf("Expected volumes %v, got %v", expected, volumes)
+	}
+	if names := volumeNames(volumes); !slices.Equal(names, []string{"pvc-a", "pvc-b", "pvc-c"}) {
+		t.Errorf("Expected sorted, unique names, got %v", names)
+	}
+}
+
+func TestPrintVolumeList(t *testing.T) {
+	store := fstest.MapFS{
+		"volumes/01/02/pvc-b/volume.cfg": &fstest.MapFile{Data: []byte(`{"Name": "pvc-b", "Size": "21474836480", "Labels": {}, "CreatedTime": "2024-01-01T00:00:00Z",
+			"LastBackupName": "backup-5d0e3b4a9c1f4e27", "LastBackupAt": "2024-03-01T08:00:11Z", "BackingImageName": "", "StorageClassName": "longhorn", "DataEngine": "v1"}`)},
+		"volumes/03/04/pvc-a/backups/backup_backup-1.cfg": &fstest.MapFile{Data: []byte("{}")},
+		"volumes/05/06/pvc-c/volume.cfg":                  &fstest.MapFile{Data: []byte(`{"Size": "big"}`)},
+	}
+	volumes, err := backupstore.ListVolumes(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := listVolumes(store, volumes, path.Base)
+	if len(entries) != 3 || entries[0].Name != "pvc-a" || entries[0].Size != 0 || entries[0].Error != "" {
+		t.Fatalf("Expected pvc-a first without a volume.cfg, got %+v", entries)
+	}
+	if entries[1].Size != 21474836480 || entries[1].LastBackup != "backup-5d0e3b4a9c1f4e27" || entries[1].Created != "2024-01-01T00:00:00Z" {
+		t.Errorf("Expected the volume.cfg of pvc-b, got %+v", entries[1])
+	}
+	if entries[2].Error == "" {
+		t.Errorf("Expected the invalid size of pvc-c to be reported, got %+v", entries[2])
+	}
+
+	var out bytes.Buffer
+	if err := printVolumeList(&out, entries, "text"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("Expected a header, 3 rows and a warning, got %q", out.String())
+	}
+	for i, expected := range []string{
+		"pvc-a - - - -",
+		"pvc-b 21474836480 2024-01-01T00:00:00Z backup-5d0e3b4a9c1f4e27 -",
+	} {
+		if fields := strings.Join(strings.Fields(lines[i+1]), " "); fields != expected {
+			t.Errorf("Expected %q, got %q", expected, fields)
+		}
+	}
+	if !strings.HasPrefix(lines[4], "Warning: could not read the volume.cfg of pvc-c") {
+		t.Errorf("Expected a warning for pvc-c, got %q", lines[4])
+	}
+}
+
+func TestPrintNames(t *testing.T) {
+	var out bytes.Buffer
+	if err := printNames(&out, []string{"pvc-a", "pvc-b"}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if out.String() != "pvc-a\npvc-b\n" {
+		t.Errorf("Expected a name per line, got %q", out.String())
+	}
+}
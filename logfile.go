@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// teeWriter copies what is printed to the terminal into the file of
+// -log-file. The file is written unbuffered, so every warning and error
+// is in it as soon as it is printed.
+type teeWriter struct {
+	terminal io.Writer
+	log      io.Writer
+}
+
+func (t *teeWriter) Write(p []byte) (int, error) {
+	n, err := t.terminal.Write(p)
+	// a log that can't be written to doesn't stop the restore
+	t.log.Write(p)
+	return n, err
+}
+
+// runLog is the file of -log-file, nil without it
+type runLog struct {
+	file *os.File
+}
+
+// openRunLog opens the file of -log-file for appending, so the log of
+// each run follows those of the runs before
+func openRunLog(logPath, header string) (*runLog, error) {
+	if logPath == "" {
+		return nil, nil
+	}
+	file, err := openAppendLog(logPath, header)
+	if err != nil {
+		return nil, err
+	}
+	return &runLog{file: file}, nil
+}
+
+// tee returns w, also writing to the log if there is one. Discarded
+// output isn't logged either.
+func (l *runLog) tee(w io.Writer) io.Writer {
+	if l == nil || w == io.Discard {
+		return w
+	}
+	return &teeWriter{terminal: w, log: l.file}
+}
+
+// end ends the log with the exit status of the run, returning it
+func (l *runLog) end(code int) int {
+	if l != nil {
+		fmt.Fprintf(l.file, "# exit status %d\n", code)
+		l.file.Close()
+	}
+	return code
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunLog(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "restore.log")
+	for run, code := range []int{0, exitChecksumMismatch} {
+		log, err := openRunLog(logPath, "repack of pvc-1")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		var terminal bytes.Buffer
+		out := log.tee(&terminal)
+		fmt.Fprintf(out, "Warning: run %d\n", run)
+		if log.tee(io.Discard) != io.Discard {
+			t.Errorf("Expected discarded output to stay discarded")
+		}
+		if terminal.String() != fmt.Sprintf("Warning: run %d\n", run) {
+			t.Errorf("Expected the warning on the terminal, got %q", terminal.String())
+		}
+		if got := log.end(code); got != code {
+			t.Errorf("Expected exit status %d, got %d", code, got)
+		}
+	}
+
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	// reruns are appended
+	if len(lines) != 6 {
+		t.Fatalf("Expected 3 lines for each run, got %q", data)
+	}
+	for i, expected := range []string{"repack of pvc-1", "Warning: run 0", "# exit status 0", "repack of pvc-1", "Warning: run 1", "# exit status 8"} {
+		if !strings.HasSuffix(lines[i], expected) {
+			t.Errorf("Expected line %d to end with %q, got %q", i, expected, lines[i])
+		}
+	}
+
+	var none *runLog
+	if none.tee(os.Stdout) != os.Stdout || none.end(exitFailure) != exitFailure {
+		t.Errorf("Expected no log to leave the output and exit status as they are")
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var logFormats = []string{"text", "json"}
+
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// newLogger returns the logger of errors and warnings, writing the
+// records of level and above to w in format, which is text or json
+func newLogger(w io.Writer, format string, level slog.Level) *slog.Logger {
+	if format == "json" {
+		return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level}))
+	}
+	return slog.New(&consoleHandler{w: w, level: level, mu: &sync.Mutex{}})
+}
+
+// parseLogLevel is the level of -log-level, which without it is info, or
+// warn with -quiet
+func parseLogLevel(value string, quiet bool) (slog.Level, error) {
+	if value == "" {
+		if quiet {
+			return slog.LevelWarn, nil
+		}
+		return slog.LevelInfo, nil
+	}
+	level, ok := logLevels[strings.ToLower(value)]
+	if !ok {
+		return 0, fmt.Errorf("expected debug, info, warn or error, got %s", value)
+	}
+	return level, nil
+}
+
+// targetLogger is logger for one of several targets run at once: text
+// lines are prefixed with the target like the rest of its output, and
+// JSON records get a target attribute
+func targetLogger(logger *slog.Logger, target string) *slog.Logger {
+	if h, ok := logger.Handler().(*consoleHandler); ok {
+		prefixed := *h
+		prefixed.prefix = "[" + target + "] "
+		return slog.New(&prefixed)
+	}
+	return logger.With("target", target)
+}
+
+// consoleHandler writes records the way the tool printed its errors and
+// warnings before -log-format: the message, prefixed with Warning: for a
+// warning, then the error and the hint attributes on lines of their own.
+// Other attributes follow the message as key=value.
+type consoleHandler struct {
+	w      io.Writer
+	level  slog.Level
+	prefix string
+	attrs  []slog.Attr
+	// mu keeps the lines of a record together, and is shared by the
+	// handlers derived from this one
+	mu *sync.Mutex
+}
+
+func (h *consoleHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *consoleHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	b.WriteString(h.prefix)
+	if r.Level >= slog.LevelWarn && r.Level < slog.LevelError {
+		b.WriteString("Warning: ")
+	}
+	b.WriteString(r.Message)
+	var errText, hint string
+	attr := func(a slog.Attr) bool {
+		switch a.Key {
+		case "error":
+			errText = a.Value.String()
+		case "hint":
+			hint = a.Value.String()
+		default:
+			value := a.Value.String()
+			if value == "" || strings.ContainsAny(value, " =\"\n") {
+				value = strconv.Quote(value)
+			}
+			fmt.Fprintf(&b, " %s=%s", a.Key, value)
+		}
+		return true
+	}
+	for _, a := range h.attrs {
+		attr(a)
+	}
+	r.Attrs(attr)
+	b.WriteString("\n")
+	if errText != "" {
+		fmt.Fprintf(&b, "%sError: %s\n", h.prefix, errText)
+	}
+	if hint != "" {
+		fmt.Fprintf(&b, "%s%s\n", h.prefix, hint)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, b.String())
+	return err
+}
+
+func (h *consoleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	derived := *h
+	derived.attrs = append(slices.Clip(h.attrs), attrs...)
+	return &derived
+}
+
+// WithGroup doesn't qualify the keys of the attributes, which are few
+// enough to be told apart without
+func (h *consoleHandler) WithGroup(string) slog.Handler {
+	return h
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"testing"
+)
+
+func TestConsoleHandler(t *testing.T) {
+	var out bytes.Buffer
+	logger := newLogger(&out, "text", slog.LevelInfo)
+	logger.Debug("Not shown")
+	logger.Error("Failed to read backups for pvc-1", "error", errors.New("permission denied"))
+	logger.Warn("pvc-1 has no volume.cfg")
+	logger.Info("Skipping blocks", "pass", 2, "volume", "pvc 1")
+	targetLogger(logger, "pvc-2").Error("Restore failed", "error", errors.New("EOF"), "hint", "Run again with -resume")
+
+	expected := "Failed to read backups for pvc-1\n" +
+		"Error: permission denied\n" +
+		"Warning: pvc-1 has no volume.cfg\n" +
+		"Skipping blocks pass=2 volume=\"pvc 1\"\n" +
+		"[pvc-2] Restore failed\n" +
+		"[pvc-2] Error: EOF\n" +
+		"[pvc-2] Run again with -resume\n"
+	if out.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, out.String())
+	}
+}
+
+func TestJSONLogger(t *testing.T) {
+	var out bytes.Buffer
+	logger := targetLogger(newLogger(&out, "json", slog.LevelWarn), "pvc-1")
+	logger.Info("Not shown")
+	logger.Error("Failed to read backups", "error", errors.New("permission denied"))
+
+	var record map[string]any
+	if err := json.Unmarshal(out.Bytes(), &record); err != nil {
+		t.Fatalf("Unexpected error: %v: %s", err, out.String())
+	}
+	if record["level"] != "ERROR" || record["msg"] != "Failed to read backups" || record["error"] != "permission denied" || record["target"] != "pvc-1" {
+		t.Errorf("Expected the error record of pvc-1, got %s", out.String())
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	tests := []struct {
+		value         string
+		quiet         bool
+		expected      slog.Level
+		expectedError bool
+	}{
+		{value: "", expected: slog.LevelInfo},
+		{value: "", quiet: true, expected: slog.LevelWarn},
+		{value: "debug", quiet: true, expected: slog.LevelDebug},
+		{value: "ERROR", expected: slog.LevelError},
+		{value: "verbose", expectedError: true},
+	}
+	for _, tt := range tests {
+		level, err := parseLogLevel(tt.value, tt.quiet)
+		if tt.expectedError {
+			if err == nil {
+				t.Errorf("Expected an error for %q", tt.value)
+			}
+			continue
+		}
+		if err != nil || level != tt.expected {
+			t.Errorf("Expected %s for %q, got %s (%v)", tt.expected, tt.value, level, err)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+)
+
+// lsCacheSize holds the blocks ls and extract read with -cache-size 0,
+// as the metadata of a filesystem is read a few bytes at a time
+const lsCacheSize = 64 << 20
+
+// lsEntry is a row of ls, a file in the filesystem of a backup
+type lsEntry struct {
+	Name     string    `json:"name"`
+	Mode     string    `json:"mode"`
+	Links    uint16    `json:"links"`
+	UID      uint32    `json:"uid"`
+	GID      uint32    `json:"gid"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	// Target is where a symlink points
+	Target string `json:"target,omitempty"`
+}
+
+// list runs ls for volume, over the image backups restore to, and returns
+// the exit status
+func (in *invocation) list(volume *backupstore.VolumeBackup, backups []backupstore.Backup) int {
+	filesystem, code := in.openFilesystem(volume, backups)
+	if filesystem == nil {
+		return code
+	}
+	entries, err := listImageDir(filesystem, *in.o.path)
+	if err != nil {
+		in.log.Error(fmt.Sprintf("Failed to list %s in the backups of %s", *in.o.path, volume.Name), "error", err)
+		return pathExitCode(err)
+	}
+	if err := printListing(in.out, entries, *in.o.listFormat); err != nil {
+		in.log.Error(fmt.Sprintf("Failed to list %s in the backups of %s", *in.o.path, volume.Name), "error", err)
+		return exitFailure
+	}
+	return 0
+}
+
+// openFilesystem opens the ext4 filesystem of the image backups of volume
+// restore to, without restoring it, and returns the exit status when it
+// can't
+func (in *invocation) openFilesystem(volume *backupstore.VolumeBackup, backups []backupstore.Backup) (*ext4FS, int) {
+	if len(backups) == 0 {
+		fmt.Fprintf(in.out, "%s has no backups to read\n", volume.Name)
+		return nil, exitVolumeNotFound
+	}
+	cache := in.cache
+	if cache == nil {
+		cache = backupstore.NewBlockCache(lsCacheSize)
+	}
+	image, err := backupstore.NewImageReader(in.store, volume.BackupPath, backups, volume.Size, cache)
+	if err == nil {
+		var filesystem *ext4FS
+		if filesystem, err = openExt4(image); err == nil {
+			return filesystem, 0
+		}
+	}
+	in.log.Error(fmt.Sprintf("Failed to read the filesystem in the backups of %s", volume.Name), "error", err)
+	return nil, exitCode(err)
+}
+
+// pathExitCode is the exit status of failing to read -path, which is
+// missing rather than failed when the filesystem has no such file
+func pathExitCode(err error) int {
+	if code := exitCode(err); code != exitFailure || !errors.Is(err, fs.ErrNotExist) {
+		return code
+	}
+	return exitVolumeNotFound
+}
+
+// listImageDir lists the directory name in filesystem, sorted by name, or
+// the file name alone if it isn't a directory
+func listImageDir(filesystem *ext4FS, name string) ([]lsEntry, error) {
+	inode, err := filesystem.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if !inode.Mode.IsDir() {
+		entry, err := newLsEntry(filesystem, path.Base(name), inode)
+		if err != nil {
+			return nil, err
+		}
+		return []lsEntry{entry}, nil
+	}
+
+	children, err := filesystem.readDir(inode)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]lsEntry, 0, len(children))
+	for _, child := range children {
+		inode, err := filesystem.inode(child.Inode)
+		if err != nil {
+			return nil, err
+		}
+		entry, err := newLsEntry(filesystem, child.Name, inode)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	slices.SortFunc(entries, func(a, b lsEntry) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+	return entries, nil
+}
+
+func newLsEntry(filesystem *ext4FS, name string, inode *ext4Inode) (lsEntry, error) {
+	entry := lsEntry{
+		Name:     name,
+		Mode:     lsMode(inode.Mode),
+		Links:    inode.Links,
+		UID:      inode.UID,
+		GID:      inode.GID,
+		Size:     inode.Size,
+		Modified: inode.Mtime,
+	}
+	if inode.Mode.Type() == fs.ModeSymlink {
+		target, err := filesystem.readlink(inode)
+		if err != nil {
+			return entry, fmt.Errorf("failed to read symlink %s: %w", name, err)
+		}
+		entry.Target = target
+	}
+	return entry, nil
+}
+
+// lsMode formats mode as ls -l does, which fs.FileMode.String doesn't
+func lsMode(mode fs.FileMode) string {
+	kind := byte('-')
+	switch mode.Type() {
+	case fs.ModeDir:
+		kind = 'd'
+	case fs.ModeSymlink:
+		kind = 'l'
+	case fs.ModeDevice | fs.ModeCharDevice:
+		kind = 'c'
+	case fs.ModeDevice:
+		kind = 'b'
+	case fs.ModeNamedPipe:
+		kind = 'p'
+	case fs.ModeSocket:
+		kind = 's'
+	}
+	out := []byte{kind}
+	for i, c := range "rwxrwxrwx" {
+		if mode&(1<<(8-i)) != 0 {
+			out = append(out, byte(c))
+		} else {
+			out = append(out, '-')
+		}
+	}
+	// setuid, setgid and sticky replace the execute bits they go with
+	special := func(set bool, i int, lower byte) {
+		if !set {
+			return
+		}
+		if out[i] == 'x' {
+			out[i] = lower
+		} else {
+			out[i] = lower - 'a' + 'A'
+		}
+	}
+	special(mode&fs.ModeSetuid != 0, 3, 's')
+	special(mode&fs.ModeSetgid != 0, 6, 's')
+	special(mode&fs.ModeSticky != 0, 9, 't')
+	return string(out)
+}
+
+// printListing writes one row per file, like ls -l
+func printListing(w io.Writer, entries []lsEntry, format string) error {
+	if format == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(entries)
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "MODE\tLINKS\tUID\tGID\tSIZE\tMODIFIED\tNAME")
+	for _, entry := range entries {
+		name := entry.Name
+		if entry.Target != "" {
+			name += " -> " + entry.Target
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%s\t%s\n", entry.Mode, entry.Links, entry.UID, entry.GID, entry.Size, entry.Modified.Format(time.RFC3339), name)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/aes"
+	"crypto/pbkdf2"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/xts"
+)
+
+// luksType is what blkid calls a LUKS container
+const luksType = "crypto_LUKS"
+
+const (
+	luksMagic          = "LUKS\xba\xbe"
+	luks1HeaderSize    = 592
+	luks1KeyEnabled    = 0x00ac71f3
+	luks2BinHeaderSize = 4096
+	luksSectorSize     = 512
+)
+
+var luksHashes = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+type luks1Keyslot struct {
+	Active            uint32
+	Iterations        uint32
+	Salt              [32]byte
+	KeyMaterialOffset uint32
+	Stripes           uint32
+}
+
+// luks1Header is the big-endian LUKS1 phdr
+type luks1Header struct {
+	Magic         [6]byte
+	Version       uint16
+	CipherName    [32]byte
+	CipherMode    [32]byte
+	HashSpec      [32]byte
+	PayloadOffset uint32
+	KeyBytes      uint32
+	MKDigest      [20]byte
+	MKDigestSalt  [32]byte
+	MKDigestIter  uint32
+	UUID          [40]byte
+	Keyslots      [8]luks1Keyslot
+}
+
+// luks2BinHeader is the big-endian binary header in front of the LUKS2
+// JSON metadata
+type luks2BinHeader struct {
+	Magic       [6]byte
+	Version     uint16
+	HeaderSize  uint64
+	SeqID       uint64
+	Label       [48]byte
+	ChecksumAlg [32]byte
+	Salt        [64]byte
+	UUID        [40]byte
+	Subsystem   [48]byte
+	HeaderOff   uint64
+	Padding     [184]byte
+	Checksum    [64]byte
+}
+
+type luks2Metadata struct {
+	Keyslots map[string]struct {
+		Type    string `json:"type"`
+		KeySize int    `json:"key_size"`
+		AF      struct {
+			Type    string `json:"type"`
+			Stripes int    `json:"stripes"`
+			Hash    string `json:"hash"`
+		} `json:"af"`
+		Area struct {
+			Type       string `json:"type"`
+			Offset     string `json:"offset"`
+			Encryption string `json:"encryption"`
+			KeySize    int    `json:"key_size"`
+		} `json:"area"`
+		KDF struct {
+			Type       string `json:"type"`
+			Hash       string `json:"hash"`
+			Iterations int    `json:"iterations"`
+			Time       uint32 `json:"time"`
+			Memory     uint32 `json:"memory"`
+			CPUs       uint8  `json:"cpus"`
+			Salt       string `json:"salt"`
+		} `json:"kdf"`
+	} `json:"keyslots"`
+	Segments map[string]struct {
+		Type       string `json:"type"`
+		Offset     string `json:"offset"`
+		Size       string `json:"size"`
+		IVTweak    string `json:"iv_tweak"`
+		Encryption string `json:"encryption"`
+		SectorSize int    `json:"sector_size"`
+	} `json:"segments"`
+	Digests map[string]struct {
+		Type       string   `json:"type"`
+		Keyslots   []string `json:"keyslots"`
+		Hash       string   `json:"hash"`
+		Iterations int      `json:"iterations"`
+		Salt       string   `json:"salt"`
+		Digest     string   `json:"digest"`
+	} `json:"digests"`
+}
+
+// luksKeyslot is what's needed to recover the volume key from one keyslot
+type luksKeyslot struct {
+	kdf        func(passphrase []byte, keySize int) ([]byte, error)
+	keySize    int
+	areaKey    int
+	cipher     string
+	areaOffset int64
+	stripes    int
+	afHash     string
+	digest     luksDigest
+}
+
+type luksDigest struct {
+	hash       string
+	iterations int
+	salt       []byte
+	digest     []byte
+}
+
+// luksHeader is the part of a LUKS1 or LUKS2 header needed to size and
+// decrypt the volume
+type luksHeader struct {
+	Version       int
+	Cipher        string
+	PayloadOffset int64
+	// PayloadSize is 0 when the payload runs to the end of the device
+	PayloadSize int64
+	SectorSize  int
+	IVTweak     uint64
+	// Label is only recorded by LUKS2
+	Label string
+	UUID  string
+
+	keyslots []luksKeyslot
+}
+
+// readLUKSHeader parses the LUKS1 or LUKS2 header at the start of an
+// image. Only the primary LUKS2 header is read.
+func readLUKSHeader(f io.ReaderAt) (*luksHeader, error) {
+	magic := make([]byte, 8)
+	if _, err := f.ReadAt(magic, 0); err != nil {
+		return nil, err
+	}
+	if string(magic[:6]) != luksMagic {
+		return nil, errors.New("no LUKS header found")
+	}
+	switch version := binary.BigEndian.Uint16(magic[6:]); version {
+	case 1:
+		return readLUKS1Header(f)
+	case 2:
+		return readLUKS2Header(f)
+	default:
+		return nil, fmt.Errorf("unsupported LUKS version %d", version)
+	}
+}
+
+func readLUKS1Header(f io.ReaderAt) (*luksHeader, error) {
+	data := make([]byte, luks1HeaderSize)
+	if _, err := f.ReadAt(data, 0); err != nil {
+		return nil, err
+	}
+	var raw luks1Header
+	if err := binary.Read(bytes.NewReader(data), binary.BigEndian, &raw); err != nil {
+		return nil, err
+	}
+
+	cipher := cString(raw.CipherName[:]) + "-" + cString(raw.CipherMode[:])
+	hashSpec := cString(raw.HashSpec[:])
+	if _, ok := luksHashes[hashSpec]; !ok {
+		return nil, fmt.Errorf("unsupported LUKS hash %s", hashSpec)
+	}
+	header := &luksHeader{
+		Version:       1,
+		Cipher:        cipher,
+		PayloadOffset: int64(raw.PayloadOffset) * luksSectorSize,
+		SectorSize:    luksSectorSize,
+		UUID:          cString(raw.UUID[:]),
+	}
+	digest := luksDigest{
+		hash:       hashSpec,
+		iterations: int(raw.MKDigestIter),
+		salt:       raw.MKDigestSalt[:],
+		digest:     raw.MKDigest[:],
+	}
+	for _, slot := range raw.Keyslots {
+		if slot.Active != luks1KeyEnabled {
+			continue
+		}
+		salt, iterations := slot.Salt, int(slot.Iterations)
+		header.keyslots = append(header.keyslots, luksKeyslot{
+			kdf: func(passphrase []byte, keySize int) ([]byte, error) {
+				return pbkdf2.Key(luksHashes[hashSpec], string(passphrase), salt[:], iterations, keySize)
+			},
+			keySize:    int(raw.KeyBytes),
+			areaKey:    int(raw.KeyBytes),
+			cipher:     cipher,
+			areaOffset: int64(slot.KeyMaterialOffset) * luksSectorSize,
+			stripes:    int(slot.Stripes),
+			afHash:     hashSpec,
+			digest:     digest,
+		})
+	}
+	return header, nil
+}
+
+func readLUKS2Header(f io.ReaderAt) (*luksHeader, error) {
+	binHeader := make([]byte, luks2BinHeaderSize)
+	if _, err := f.ReadAt(binHeader, 0); err != nil {
+		return nil, err
+	}
+	var raw luks2BinHeader
+	if err := binary.Read(bytes.NewReader(binHeader), binary.BigEndian, &raw); err != nil {
+		return nil, err
+	}
+	if raw.HeaderSize < luks2BinHeaderSize || raw.HeaderSize > 4<<20 {
+		return nil, fmt.Errorf("invalid LUKS2 header size %d", raw.HeaderSize)
+	}
+	if alg := cString(raw.ChecksumAlg[:]); alg != "sha256" {
+		return nil, fmt.Errorf("unsupported LUKS2 header checksum %s", alg)
+	}
+
+	data := make([]byte, raw.HeaderSize)
+	if _, err := f.ReadAt(data, 0); err != nil {
+		return nil, err
+	}
+	// the checksum covers the whole header with its own field zeroed
+	clear(data[448:512])
+	sum := sha256.Sum256(data)
+	if !bytes.Equal(sum[:], raw.Checksum[:sha256.Size]) {
+		return nil, errors.New("LUKS2 header checksum mismatch")
+	}
+
+	var metadata luks2Metadata
+	if err := json.Unmarshal(bytes.TrimRight(data[luks2BinHeaderSize:], "\x00"), &metadata); err != nil {
+		return nil, fmt.Errorf("failed to parse LUKS2 metadata: %w", err)
+	}
+	// a volume being reencrypted has more than one segment
+	if len(metadata.Segments) != 1 {
+		return nil, fmt.Errorf("unsupported LUKS2 layout with %d segments", len(metadata.Segments))
+	}
+	segment, ok := metadata.Segments["0"]
+	if !ok || segment.Type != "crypt" {
+		return nil, errors.New("LUKS2 header has no crypt segment")
+	}
+	header := &luksHeader{
+		Version:    2,
+		Cipher:     segment.Encryption,
+		SectorSize: segment.SectorSize,
+		Label:      cString(raw.Label[:]),
+		UUID:       cString(raw.UUID[:]),
+	}
+	var err error
+	if header.PayloadOffset, err = strconv.ParseInt(segment.Offset, 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid LUKS2 segment offset %q", segment.Offset)
+	}
+	if segment.Size != "dynamic" {
+		if header.PayloadSize, err = strconv.ParseInt(segment.Size, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid LUKS2 segment size %q", segment.Size)
+		}
+	}
+	if header.IVTweak, err = strconv.ParseUint(cmp.Or(segment.IVTweak, "0"), 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid LUKS2 IV tweak %q", segment.IVTweak)
+	}
+	if !slices.Contains([]int{512, 1024, 2048, 4096}, header.SectorSize) {
+		return nil, fmt.Errorf("invalid LUKS2 sector size %d", header.SectorSize)
+	}
+
+	ids := make([]string, 0, len(metadata.Keyslots))
+	for id := range metadata.Keyslots {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	for _, id := range ids {
+		slot := metadata.Keyslots[id]
+		if slot.Type != "luks2" || slot.AF.Type != "luks1" || slot.Area.Type != "raw" {
+			continue
+		}
+		var digest *luksDigest
+		for _, d := range metadata.Digests {
+			if d.Type != "pbkdf2" || !slices.Contains(d.Keyslots, id) {
+				continue
+			}
+			salt, saltErr := base64.StdEncoding.DecodeString(d.Salt)
+			sum, sumErr := base64.StdEncoding.DecodeString(d.Digest)
+			if saltErr != nil || sumErr != nil {
+				return nil, fmt.Errorf("invalid LUKS2 digest for keyslot %s", id)
+			}
+			digest = &luksDigest{hash: d.Hash, iterations: d.Iterations, salt: salt, digest: sum}
+		}
+		if digest == nil {
+			continue
+		}
+		salt, err := base64.StdEncoding.DecodeString(slot.KDF.Salt)
+		if err != nil {
+			return nil, fmt.Errorf("invalid LUKS2 salt for keyslot %s", id)
+		}
+		areaOffset, err := strconv.ParseInt(slot.Area.Offset, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid LUKS2 area offset for keyslot %s", id)
+		}
+
+		keyslot := luksKeyslot{
+			keySize:    slot.KeySize,
+			areaKey:    slot.Area.KeySize,
+			cipher:     slot.Area.Encryption,
+			areaOffset: areaOffset,
+			stripes:    slot.AF.Stripes,
+			afHash:     slot.AF.Hash,
+			digest:     *digest,
+		}
+		kdf := slot.KDF
+		switch kdf.Type {
+		case "pbkdf2":
+			hash, ok := luksHashes[kdf.Hash]
+			if !ok {
+				continue
+			}
+			keyslot.kdf = func(passphrase []byte, keySize int) ([]byte, error) {
+				return pbkdf2.Key(hash, string(passphrase), salt, kdf.Iterations, keySize)
+			}
+		case "argon2i":
+			keyslot.kdf = func(passphrase []byte, keySize int) ([]byte, error) {
+				return argon2.Key(passphrase, salt, kdf.Time, kdf.Memory, kdf.CPUs, uint32(keySize)), nil
+			}
+		case "argon2id":
+			keyslot.kdf = func(passphrase []byte, keySize int) ([]byte, error) {
+				return argon2.IDKey(passphrase, salt, kdf.Time, kdf.Memory, kdf.CPUs, uint32(keySize)), nil
+			}
+		default:
+			continue
+		}
+		header.keyslots = append(header.keyslots, keyslot)
+	}
+	return header, nil
+}
+
+func cString(b []byte) string {
+	return string(bytes.TrimRight(b, "\x00"))
+}
+
+// newLUKSCipher returns the sector cipher for a dm-crypt cipher spec. Only
+// aes-xts-plain64, the default since cryptsetup 1.6, is supported.
+func newLUKSCipher(spec string, key []byte) (*xts.Cipher, error) {
+	if spec != "aes-xts-plain64" {
+		return nil, fmt.Errorf("unsupported LUKS cipher %s", spec)
+	}
+	return xts.NewCipher(aes.NewCipher, key)
+}
+
+// afMerge undoes the anti-forensic split of a LUKS key across stripes
+func afMerge(material []byte, keySize, stripes int, h func() hash.Hash) []byte {
+	key := make([]byte, keySize)
+	for i := range stripes - 1 {
+		subtle.XORBytes(key, key, material[i*keySize:(i+1)*keySize])
+		key = afDiffuse(key, h)
+	}
+	subtle.XORBytes(key, key, material[(stripes-1)*keySize:stripes*keySize])
+	return key
+}
+
+func afDiffuse(src []byte, h func() hash.Hash) []byte {
+	digest := h()
+	dst := make([]byte, 0, len(src))
+	for i := 0; i*digest.Size() < len(src); i++ {
+		chunk := src[i*digest.Size() : min((i+1)*digest.Size(), len(src))]
+		digest.Reset()
+		binary.Write(digest, binary.BigEndian, uint32(i))
+		digest.Write(chunk)
+		dst = append(dst, digest.Sum(nil)[:len(chunk)]...)
+	}
+	return dst
+}
+
+// unlock recovers the volume key from the first keyslot the passphrase
+// opens. The keyslot areas are read from f, which needs to hold the
+// image up to the payload.
+func (h *luksHeader) unlock(f io.ReaderAt, passphrase []byte) ([]byte, error) {
+	if len(h.keyslots) == 0 {
+		return nil, errors.New("the LUKS header has no usable keyslots")
+	}
+	for _, slot := range h.keyslots {
+		afHash, ok := luksHashes[slot.afHash]
+		digestHash, digestOK := luksHashes[slot.digest.hash]
+		if !ok || !digestOK || slot.stripes < 1 {
+			continue
+		}
+		areaKey, err := slot.kdf(passphrase, slot.areaKey)
+		if err != nil {
+			return nil, err
+		}
+		cipher, err := newLUKSCipher(slot.cipher, areaKey)
+		if err != nil {
+			return nil, err
+		}
+
+		length := slot.keySize * slot.stripes
+		material := make([]byte, (length+luksSectorSize-1)/luksSectorSize*luksSectorSize)
+		if _, err := f.ReadAt(material, slot.areaOffset); err != nil {
+			return nil, fmt.Errorf("failed to read LUKS keyslot area: %w", err)
+		}
+		for sector := range len(material) / luksSectorSize {
+			buf := material[sector*luksSectorSize : (sector+1)*luksSectorSize]
+			cipher.Decrypt(buf, buf, uint64(sector))
+		}
+
+		key := afMerge(material[:length], slot.keySize, slot.stripes, afHash)
+		check, err := pbkdf2.Key(digestHash, string(key), slot.digest.salt, slot.digest.iterations, len(slot.digest.digest))
+		if err != nil {
+			return nil, err
+		}
+		if subtle.ConstantTimeCompare(check, slot.digest.digest) == 1 {
+			return key, nil
+		}
+	}
+	return nil, errors.New("no LUKS keyslot could be opened with the passphrase")
+}
+
+// luksWriter decrypts a LUKS image written to it sequentially from offset
+// 0 and writes only the plaintext payload to w. The header is buffered
+// until the whole of it, keyslots included, has been written.
+type luksWriter struct {
+	w          io.WriteCloser
+	passphrase []byte
+
+	header  *luksHeader
+	cipher  *xts.Cipher
+	buf     []byte
+	pos     int64
+	written int64
+}
+
+func newLUKSWriter(w io.WriteCloser, passphrase []byte) *luksWriter {
+	return &luksWriter{w: w, passphrase: passphrase}
+}
+
+func (l *luksWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	l.buf = append(l.buf, p...)
+	if l.cipher == nil {
+		if err := l.open(); err != nil {
+			return 0, err
+		}
+		if l.cipher == nil {
+			return n, nil
+		}
+	}
+
+	sectorSize := l.header.SectorSize
+	whole := len(l.buf) / sectorSize * sectorSize
+	if l.header.PayloadSize > 0 {
+		whole = int(min(int64(whole), l.header.PayloadSize-l.pos))
+	}
+	for off := 0; off < whole; off += sectorSize {
+		sector := l.buf[off : off+sectorSize]
+		l.cipher.Decrypt(sector, sector, l.header.IVTweak+uint64(l.pos)/uint64(sectorSize))
+		l.pos += int64(sectorSize)
+	}
+	written, err := l.w.Write(l.buf[:whole])
+	l.written += int64(written)
+	if err != nil {
+		return 0, err
+	}
+	l.buf = l.buf[:copy(l.buf, l.buf[whole:])]
+	if l.header.PayloadSize > 0 && l.pos >= l.header.PayloadSize {
+		// anything past the segment isn't part of the volume
+		l.buf = l.buf[:0]
+	}
+	return n, nil
+}
+
+// open unlocks the volume once the buffer holds everything up to the
+// payload, leaving l.cipher nil while more of the header is needed
+func (l *luksWriter) open() error {
+	if l.header == nil {
+		header, err := readLUKSHeader(bytes.NewReader(l.buf))
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		l.header = header
+	}
+	if int64(len(l.buf)) < l.header.PayloadOffset {
+		return nil
+	}
+
+	key, err := l.header.unlock(bytes.NewReader(l.buf), l.passphrase)
+	if err != nil {
+		return err
+	}
+	l.cipher, err = newLUKSCipher(l.header.Cipher, key)
+	if err != nil {
+		return err
+	}
+	l.buf = l.buf[:copy(l.buf, l.buf[l.header.PayloadOffset:])]
+	return nil
+}
+
+func (l *luksWriter) Close() error {
+	switch {
+	case l.cipher == nil:
+		l.w.Close()
+		return errors.New("the image ended before the LUKS payload")
+	case len(l.buf) > 0:
+		l.w.Close()
+		return fmt.Errorf("the LUKS payload ends with a partial %d byte sector", len(l.buf))
+	}
+	return l.w.Close()
+}
+
+// describeLUKS is the summary printed for an encrypted image
+func describeLUKS(h *luksHeader) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Encrypted volume (LUKS%d, %s), payload at offset %d", h.Version, h.Cipher, h.PayloadOffset)
+	if h.PayloadSize > 0 {
+		fmt.Fprintf(&b, ", %d bytes", h.PayloadSize)
+	}
+	return b.String()
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"strconv"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	testLUKSPassphrase = "correct horse battery staple"
+	testLUKSStripes    = 4000
+)
+
+// afSplit is the inverse of afMerge, with the random stripes taken from
+// testBlockData so images are reproducible
+func afSplit(key []byte, stripes int) []byte {
+	material := testBlockData(11, len(key)*stripes)
+	d := make([]byte, len(key))
+	for i := range stripes - 1 {
+		subtle.XORBytes(d, d, material[i*len(key):(i+1)*len(key)])
+		d = afDiffuse(d, sha256.New)
+	}
+	subtle.XORBytes(material[(stripes-1)*len(key):], d, key)
+	return material
+}
+
+// luksEncrypt encrypts data in place with aes-xts-plain64, numbering
+// sectors from first
+func luksEncrypt(t *testing.T, key, data []byte, sectorSize int, first uint64) {
+	t.Helper()
+	cipher, err := newLUKSCipher("aes-xts-plain64", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(data); i += sectorSize {
+		cipher.Encrypt(data[i:i+sectorSize], data[i:i+sectorSize], first+uint64(i/sectorSize))
+	}
+}
+
+// luksKeyMaterial encrypts the AF split volume key with areaKey the way a
+// keyslot area is written
+func luksKeyMaterial(t *testing.T, volumeKey, areaKey []byte) []byte {
+	t.Helper()
+	material := afSplit(volumeKey, testLUKSStripes)
+	luksEncrypt(t, areaKey, material, luksSectorSize, 0)
+	return material
+}
+
+func testPBKDF2(t *testing.T, secret, salt []byte, iterations, size int) []byte {
+	t.Helper()
+	key, err := pbkdf2.Key(sha256.New, string(secret), salt, iterations, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// luks1TestImage lays out a LUKS1 header with one keyslot at sector 8 and
+// the given plaintext encrypted from sector 512
+func luks1TestImage(t *testing.T, plaintext []byte) []byte {
+	t.Helper()
+	volumeKey := testBlockData(12, 64)
+	header := luks1Header{
+		Version:       1,
+		PayloadOffset: 512,
+		KeyBytes:      64,
+		MKDigestIter:  1000,
+	}
+	copy(header.Magic[:], luksMagic)
+	copy(header.CipherName[:], "aes")
+	copy(header.CipherMode[:], "xts-plain64")
+	copy(header.HashSpec[:], "sha256")
+	copy(header.MKDigestSalt[:], testBlockData(13, 32))
+	copy(header.MKDigest[:], testPBKDF2(t, volumeKey, header.MKDigestSalt[:], 1000, 20))
+	copy(header.UUID[:], "0e4f8a6c-7b1d-4c2e-9f3a-5d6b7c8d9e0f")
+
+	slot := &header.Keyslots[3]
+	slot.Active = luks1KeyEnabled
+	slot.Iterations = 1000
+	slot.KeyMaterialOffset = 8
+	slot.Stripes = testLUKSStripes
+	copy(slot.Salt[:], testBlockData(14, 32))
+	for i := range header.Keyslots {
+		if i != 3 {
+			header.Keyslots[i].Active = 0x0000dead
+		}
+	}
+
+	image := make([]byte, 512*luksSectorSize+len(plaintext))
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.BigEndian, header); err != nil {
+		t.Fatal(err)
+	}
+	copy(image, buf.Bytes())
+	areaKey := testPBKDF2(t, []byte(testLUKSPassphrase), slot.Salt[:], 1000, 64)
+	copy(image[8*luksSectorSize:], luksKeyMaterial(t, volumeKey, areaKey))
+
+	payload := image[512*luksSectorSize:]
+	copy(payload, plaintext)
+	luksEncrypt(t, volumeKey, payload, luksSectorSize, 0)
+	return image
+}
+
+// luks2TestImage lays out a 16KiB LUKS2 header with an argon2id keyslot at
+// 32KiB and the given plaintext encrypted in 4KiB sectors from 1MiB.
+// segmentSize is "dynamic" or a byte count.
+func luks2TestImage(t *testing.T, plaintext []byte, segmentSize string) []byte {
+	t.Helper()
+	volumeKey := testBlockData(15, 64)
+	kdfSalt, digestSalt := testBlockData(16, 32), testBlockData(17, 32)
+	areaKey := argon2.IDKey([]byte(testLUKSPassphrase), kdfSalt, 1, 64, 1, 64)
+
+	metadata := map[string]any{
+		"keyslots": map[string]any{
+			"0": map[string]any{
+				"type":     "luks2",
+				"key_size": 64,
+				"af":       map[string]any{"type": "luks1", "stripes": testLUKSStripes, "hash": "sha256"},
+				"area": map[string]any{
+					"type": "raw", "offset": "32768", "size": "258048",
+					"encryption": "aes-xts-plain64", "key_size": 64,
+				},
+				"kdf": map[string]any{
+					"type": "argon2id", "time": 1, "memory": 64, "cpus": 1,
+					"salt": base64.StdEncoding.EncodeToString(kdfSalt),
+				},
+			},
+		},
+		"segments": map[string]any{
+			"0": map[string]any{
+				"type": "crypt", "offset": "1048576", "size": segmentSize, "iv_tweak": "0",
+				"encryption": "aes-xts-plain64", "sector_size": 4096,
+			},
+		},
+		"digests": map[string]any{
+			"0": map[string]any{
+				"type": "pbkdf2", "keyslots": []string{"0"}, "segments": []string{"0"},
+				"hash": "sha256", "iterations": 1000,
+				"salt":   base64.StdEncoding.EncodeToString(digestSalt),
+				"digest": base64.StdEncoding.EncodeToString(testPBKDF2(t, volumeKey, digestSalt, 1000, 32)),
+			},
+		},
+		"config": map[string]any{"json_size": "12288", "keyslots_size": "1015808"},
+	}
+	jsonArea, err := json.Marshal(metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := luks2BinHeader{Version: 2, HeaderSize: 16384, SeqID: 1}
+	copy(header.Magic[:], luksMagic)
+	copy(header.ChecksumAlg[:], "sha256")
+	copy(header.UUID[:], "6a1e5b3c-2d4f-4e8a-b9c0-1d2e3f4a5b6c")
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.BigEndian, header); err != nil {
+		t.Fatal(err)
+	}
+
+	image := make([]byte, 1048576+len(plaintext))
+	copy(image, buf.Bytes())
+	copy(image[luks2BinHeaderSize:], jsonArea)
+	sum := sha256.Sum256(image[:16384])
+	copy(image[448:], sum[:])
+	copy(image[32768:], luksKeyMaterial(t, volumeKey, areaKey))
+
+	payload := image[1048576:]
+	copy(payload, plaintext)
+	luksEncrypt(t, volumeKey, payload, 4096, 0)
+	return image
+}
+
+func TestReadLUKSHeader(t *testing.T) {
+	plaintext := ext4TestBlock(8192, 2, 2)
+	tests := []struct {
+		name          string
+		image         []byte
+		version       int
+		offset        int64
+		size          int64
+		expectedError bool
+	}{
+		{name: "luks1", image: luks1TestImage(t, plaintext), version: 1, offset: 262144},
+		{name: "luks2", image: luks2TestImage(t, plaintext, "dynamic"), version: 2, offset: 1048576},
+		{name: "luks2 fixed size", image: luks2TestImage(t, plaintext, "8192"), version: 2, offset: 1048576, size: 8192},
+		{name: "zeroed", image: make([]byte, 4096), expectedError: true},
+		{name: "truncated", image: []byte(luksMagic + "\x00\x02"), expectedError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header, err := readLUKSHeader(bytes.NewReader(tt.image))
+			if tt.expectedError {
+				if err == nil {
+					t.Error("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if header.Version != tt.version || header.PayloadOffset != tt.offset || header.PayloadSize != tt.size {
+				t.Errorf("Expected LUKS%d with payload of %d bytes at %d, got %+v", tt.version, tt.size, tt.offset, header)
+			}
+			if header.Cipher != "aes-xts-plain64" {
+				t.Errorf("Expected aes-xts-plain64, got %s", header.Cipher)
+			}
+		})
+	}
+
+	corrupted := luks2TestImage(t, plaintext, "dynamic")
+	corrupted[luks2BinHeaderSize+10] ^= 0xff
+	if _, err := readLUKSHeader(bytes.NewReader(corrupted)); err == nil {
+		t.Error("Expected error for a LUKS2 header with a bad checksum")
+	}
+}
+
+func TestLUKSUnlock(t *testing.T) {
+	plaintext := ext4TestBlock(8192, 2, 2)
+	for name, image := range map[string][]byte{
+		"luks1": luks1TestImage(t, plaintext),
+		"luks2": luks2TestImage(t, plaintext, "dynamic"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			header, err := readLUKSHeader(bytes.NewReader(image))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := header.unlock(bytes.NewReader(image), []byte(testLUKSPassphrase)); err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			if _, err := header.unlock(bytes.NewReader(image), []byte("wrong")); err == nil {
+				t.Error("Expected error for a wrong passphrase")
+			}
+		})
+	}
+}
+
+// recordingWriteCloser collects everything written to it
+type recordingWriteCloser struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (c *recordingWriteCloser) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestLUKSWriter(t *testing.T) {
+	plaintext := append(ext4TestBlock(4096, 4, 2), testBlockData(18, 12288)...)
+	tests := []struct {
+		name          string
+		image         []byte
+		passphrase    string
+		expected      []byte
+		expectedError bool
+	}{
+		{name: "luks1", image: luks1TestImage(t, plaintext), passphrase: testLUKSPassphrase, expected: plaintext},
+		{name: "luks2", image: luks2TestImage(t, plaintext, "dynamic"), passphrase: testLUKSPassphrase, expected: plaintext},
+		{name: "luks2 fixed size", image: luks2TestImage(t, plaintext, "8192"), passphrase: testLUKSPassphrase, expected: plaintext[:8192]},
+		{name: "wrong passphrase", image: luks1TestImage(t, plaintext), passphrase: "wrong", expectedError: true},
+		{name: "not luks", image: testBlockData(19, 65536), passphrase: testLUKSPassphrase, expectedError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out recordingWriteCloser
+			w := newLUKSWriter(&out, []byte(tt.passphrase))
+			// odd sized writes so sectors and the header straddle them
+			_, err := io.CopyBuffer(w, struct{ io.Reader }{bytes.NewReader(tt.image)}, make([]byte, 3001))
+			if err == nil {
+				err = w.Close()
+			}
+			if tt.expectedError {
+				if err == nil {
+					t.Error("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !bytes.Equal(out.Bytes(), tt.expected) {
+				t.Errorf("Expected %d bytes of plaintext, got %d bytes that differ", len(tt.expected), out.Len())
+			}
+			if w.written != int64(len(tt.expected)) || !out.closed {
+				t.Errorf("Expected %d bytes written and the output closed, got %d and %v", len(tt.expected), w.written, out.closed)
+			}
+		})
+	}
+
+	var out recordingWriteCloser
+	w := newLUKSWriter(&out, []byte(testLUKSPassphrase))
+	if _, err := w.Write(luks1TestImage(t, plaintext)[:4096]); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err == nil {
+		t.Error("Expected error for an image that ends inside the header")
+	}
+}
+
+func TestImageSizeLUKS(t *testing.T) {
+	var progress bytes.Buffer
+	image := luks2TestImage(t, make([]byte, 8192), "dynamic")
+	if _, _, err := imageSize(bytes.NewReader(image), 0, &progress); err == nil {
+		t.Error("Expected error for a LUKS volume without a size")
+	}
+	size, contents, err := imageSize(bytes.NewReader(image), 1<<30, &progress)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if size != 1<<30 || contents != luksType {
+		t.Errorf("Expected a %d byte %s, got a %d byte %s", 1<<30, luksType, size, contents)
+	}
+
+	fixed := luks2TestImage(t, make([]byte, 8192), strconv.Itoa(8192))
+	size, _, err = imageSize(bytes.NewReader(fixed), 0, &progress)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if size != 1048576+8192 {
+		t.Errorf("Expected %d, got %d", 1048576+8192, size)
+	}
+	if !bytes.Contains(progress.Bytes(), []byte("Encrypted volume (LUKS2, aes-xts-plain64), payload at offset 1048576")) {
+		t.Errorf("Expected the LUKS header to be reported, got %q", progress.String())
+	}
+}
@@ -1,20 +1,29 @@
 package main
 
 import (
-	"bytes"
-	"compress/gzip"
-	"encoding/binary"
-	"encoding/json"
+	"bufio"
+	"cmp"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
+	"log/slog"
+	"math"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
-	"sort"
+	"runtime"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
-	"github.com/pierrec/lz4/v4"
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
 )
 
 var (
@@ -25,6 +34,9 @@ var (
 type Superblock struct {
 	TotalBlocks int
 	BlockSize   int
+	// Label and UUID are empty when the superblock doesn't record them
+	Label string
+	UUID  string
 }
 
 type superblockRaw struct {
@@ -37,318 +49,1533 @@ type superblockRaw struct {
 	SLogBlockSize    uint32
 }
 
-type Block struct {
-	Offset   int64  `json:"Offset"`
-	Checksum string `json:"BlockChecksum"`
+func readSuperblock(f io.ReaderAt) (Superblock, error) {
+	data := make([]byte, ext4SuperblockOffset+1024)
+	if _, err := f.ReadAt(data, 0); err != nil && err != io.EOF {
+		return Superblock{}, err
+	}
+	return superblockFromData(data)
+}
+
+func latestBackup(backups []backupstore.Backup) []backupstore.Backup {
+	if len(backups) == 0 {
+		return backups
+	}
+	return backups[len(backups)-1:]
 }
 
-type BackupConfig struct {
-	CreatedTime       string  `json:"CreatedTime"`
-	Size              string  `json:"Size"`
-	CompressionMethod string  `json:"CompressionMethod"`
-	Blocks            []Block `json:"Blocks"`
+// backupNameFromConfig is the name of a backup from the path of its cfg
+// file
+func backupNameFromConfig(cfgPath string) string {
+	name := strings.TrimSuffix(filepath.Base(cfgPath), ".cfg")
+	return strings.TrimPrefix(name, "backup_")
 }
 
-type Backup struct {
-	Identifier  string
-	Timestamp   time.Time
-	Size        int64
-	Compression string
-	Blocks      []Block
+// selectBackup returns the backup named name, or whose cfg file is named
+// name, with or without its extension or backup_ prefix
+func selectBackup(backups []backupstore.Backup, name string) ([]backupstore.Backup, error) {
+	for _, backup := range backups {
+		base := filepath.Base(backup.ConfigPath)
+		if name == backup.Identifier || name == base || name == strings.TrimSuffix(base, ".cfg") || name == backupNameFromConfig(backup.ConfigPath) {
+			return []backupstore.Backup{backup}, nil
+		}
+	}
+	return nil, fmt.Errorf("could not find backup %s", name)
 }
 
-type VolumeBackup struct {
-	Name       string
-	BackupPath string
-	Backups    []Backup
+// availableBackups lists the backups that can be selected, for when the one
+// asked for isn't among them
+func availableBackups(backups []backupstore.Backup) string {
+	var b strings.Builder
+	b.WriteString("Available backups:")
+	for _, backup := range backups {
+		b.WriteString("\n  " + backup.Identifier)
+	}
+	return b.String()
 }
 
-func findVolumeBackupPath(backupStorePath string, volumeName string) (string, error) {
-	pattern := filepath.Join(backupStorePath, "volumes", "**", "**", volumeName)
-	matches, err := filepath.Glob(pattern)
+func parseBeforeTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	day, err := time.Parse(time.DateOnly, value)
 	if err != nil {
-		return "", err
+		return time.Time{}, fmt.Errorf("expected RFC3339 timestamp or YYYY-MM-DD date, got %s", value)
 	}
-	if len(matches) == 0 {
-		return "", fmt.Errorf("could not find backup for %s", volumeName)
+	// a bare date covers the whole day
+	return day.Add(24*time.Hour - time.Nanosecond), nil
+}
+
+var byteSizeUnits = []struct {
+	suffix     string
+	multiplier int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40},
+	{"B", 1},
+}
+
+// parseByteSize accepts a plain byte count or one with a unit, such as
+// 20GiB or 512M. Bare K, M, G and T are binary units, like dd and truncate.
+func parseByteSize(value string) (int64, error) {
+	number, multiplier := strings.TrimSpace(value), int64(1)
+	for _, unit := range byteSizeUnits {
+		if trimmed, ok := strings.CutSuffix(number, unit.suffix); ok {
+			number, multiplier = strings.TrimSpace(trimmed), unit.multiplier
+			break
+		}
 	}
-	return matches[0], nil
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("expected a positive size such as 1073741824 or 20GiB, got %s", value)
+	}
+	if n > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("size %s is too large", value)
+	}
+	return n * multiplier, nil
 }
-func readSuperblock(f *os.File) (Superblock, error) {
-	const superblockOffset = 1024
 
-	_, err := f.Seek(superblockOffset, 0)
+// parseRate accepts a byte size per second, such as 100MiB/s, or without
+// the /s
+func parseRate(value string) (int64, error) {
+	rate, err := parseByteSize(strings.TrimSuffix(strings.TrimSpace(value), "/s"))
 	if err != nil {
-		return Superblock{}, err
+		return 0, fmt.Errorf("expected a positive rate such as 100MiB/s, got %s", value)
 	}
+	return rate, nil
+}
 
-	var raw superblockRaw
-	err = binary.Read(f, binary.LittleEndian, &raw)
+// parseRateLimit is the limiter of the rate -name was given, or nil when
+// it is unset
+func parseRateLimit(logger *slog.Logger, name, value string) *backupstore.RateLimiter {
+	if value == "" {
+		return nil
+	}
+	rate, err := parseRate(value)
 	if err != nil {
-		return Superblock{}, err
+		logger.Error(fmt.Sprintf("Invalid -%s value %s", name, value), "error", err)
+		os.Exit(exitUsage)
 	}
-
-	return Superblock{
-		TotalBlocks: int(raw.SBlocksCount),
-		BlockSize:   int(1024 << raw.SLogBlockSize),
-	}, nil
+	return backupstore.NewRateLimiter(rate)
 }
 
-func decompressLZ4(data []byte) ([]byte, error) {
-	r := lz4.NewReader(bytes.NewReader(data))
-	return io.ReadAll(r)
+func filterBackupsBefore(backups []backupstore.Backup, cutoff time.Time) []backupstore.Backup {
+	filtered := make([]backupstore.Backup, 0, len(backups))
+	for _, backup := range backups {
+		if !backup.Timestamp.After(cutoff) {
+			filtered = append(filtered, backup)
+		}
+	}
+	return filtered
 }
 
-func decompressGZIP(data []byte) ([]byte, error) {
-	r, err := gzip.NewReader(bytes.NewReader(data))
-	if err != nil {
-		return nil, err
+func main() {
+	o := defineFlags(flag.CommandLine)
+	flag.Usage = usage
+	cmd, flags, err := parseCommand(flag.CommandLine, os.Args[1:])
+	switch {
+	case errors.Is(err, flag.ErrHelp):
+		os.Exit(0)
+	case err != nil:
+		// already reported, along with the usage
+		os.Exit(exitUsage)
 	}
-	defer r.Close()
-	return io.ReadAll(r)
-}
 
-func readBackups(path string) (*VolumeBackup, error) {
-	backupCfgPattern := filepath.Join(path, "backups", "*.cfg")
-	backupCfgPaths, err := filepath.Glob(backupCfgPattern)
+	// errors and warnings go to stderr, as text until -log-format is known
+	logger := newLogger(os.Stderr, "text", slog.LevelInfo)
+	if cmd != nil && cmd.name == "completion" {
+		if err := writeCompletion(os.Stdout, flag.CommandLine, filepath.Base(os.Args[0]), flags.Arg(0)); err != nil {
+			logger.Error("Failed to write the completion script", "error", err)
+			os.Exit(exitUsage)
+		}
+		os.Exit(0)
+	}
+	var config map[string]string
+	if path := cmp.Or(*o.configFile, os.Getenv(flagEnvName("config"))); path != "" {
+		var err error
+		// checked against every flag, so one file can serve all commands
+		config, err = loadConfig(flag.CommandLine, path)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Failed to read config file %s", path), "error", err)
+			os.Exit(exitUsage)
+		}
+	}
+	if err := applySettings(flags, config, os.Getenv); err != nil {
+		logger.Error("Failed to apply the config file and environment", "error", err)
+		os.Exit(exitUsage)
+	}
+	if !slices.Contains(logFormats, *o.logFormat) {
+		logger.Error(fmt.Sprintf("Unsupported log format %s", *o.logFormat))
+		flags.Usage()
+		os.Exit(exitUsage)
+	}
+	logLevel, err := parseLogLevel(*o.logLevel, *o.quiet)
 	if err != nil {
-		return nil, err
+		logger.Error(fmt.Sprintf("Invalid -log-level value %s", *o.logLevel), "error", err)
+		os.Exit(exitUsage)
+	}
+	logger = newLogger(os.Stderr, *o.logFormat, logLevel)
+
+	imageOut := os.Stdout
+	if *o.outfile == "-" {
+		// the image owns stdout, so everything else goes to stderr
+		os.Stdout = os.Stderr
+	}
+
+	if *o.versionFlag {
+		fmt.Printf("Version: %s\n", version)
+		fmt.Printf("Commit: %s\n", commit)
+		os.Exit(0)
+	}
+
+	if cmd == nil {
+		legacy := legacyCommand(flags)
+		cmd = &legacy
+		if flags.NFlag() > 0 {
+			fmt.Fprintln(os.Stderr, migrationHint(flag.CommandLine.Name(), legacy))
+		}
+	}
+	if err := validateCommand(*cmd, flags); err != nil {
+		logger.Error(err.Error())
+		flags.Usage()
+		os.Exit(exitUsage)
+	}
+
+	// the limits are shared by every job and target, so together they stay
+	// within them
+	readLimit := parseRateLimit(logger, "bandwidth-limit", *o.bandwidthLimit)
+	writeLimit := parseRateLimit(logger, "write-limit", *o.writeLimit)
+	var throttles []throttle
+	if readLimit != nil {
+		throttles = append(throttles, throttle{name: "read", limiter: readLimit})
+	}
+	if writeLimit != nil {
+		throttles = append(throttles, throttle{name: "write", limiter: writeLimit})
 	}
 
-	volumeBackup := &VolumeBackup{
-		Name:       filepath.Base(path),
-		BackupPath: path,
-		Backups:    make([]Backup, 0),
+	// -target paths of volume directories are used as they are, and
+	// without -backup-root the backupstore is found from them
+	volumePaths, targetPatterns := splitVolumePaths(splitTargets(*o.target))
+	var (
+		locatedNames    []string
+		located         map[string]string
+		store           fs.FS
+		backupStorePath string
+	)
+	if len(volumePaths) > 0 {
+		if strings.Contains(*o.backupRoot, "://") {
+			logger.Error(fmt.Sprintf("-target %s is a local path, which can't be read from %s", volumePaths[0], *o.backupRoot),
+				"hint", "Pass the volume's name instead, or a local -backup-root")
+			os.Exit(exitUsage)
+		}
+		var storePath string
+		storePath, locatedNames, located, err = locateVolumePaths(volumePaths, *o.backupRoot)
+		var pathErr *volumePathError
+		switch {
+		case errors.As(err, &pathErr):
+			logger.Error(err.Error(), "hint", "Pass the directory of a volume, or its name with -backup-root")
+			os.Exit(exitUsage)
+		case err != nil:
+			logger.Error("Failed to find the volume directories of -target", "error", err)
+			os.Exit(exitCode(err))
+		}
+		if *o.backupRoot == "" {
+			store, backupStorePath = os.DirFS(storePath), storePath
+		}
 	}
 
-	for _, cfgPath := range backupCfgPaths {
-		cfgFile, err := os.Open(cfgPath)
-		defer cfgFile.Close()
+	if store == nil {
+		store, backupStorePath, err = openBackupStore(context.Background(), *o.backupRoot, storeOptions{
+			S3Endpoint:     *o.s3Endpoint,
+			CredentialFile: *o.credentialFile,
+			NFSVersion:     *o.nfsVersion,
+			NFSTimeout:     *o.nfsTimeout,
+
+			SSHKey:              *o.sshKey,
+			SSHKnownHosts:       *o.sshKnownHosts,
+			SSHSkipHostKeyCheck: *o.sshSkipHostKeyCheck,
+			SFTPStreams:         *o.sftpStreams,
+
+			WebDAVUser:     *o.webdavUser,
+			WebDAVPassword: cmp.Or(*o.webdavPassword, os.Getenv("WEBDAV_PASSWORD")),
+			WebDAVToken:    cmp.Or(*o.webdavToken, os.Getenv("WEBDAV_TOKEN")),
+		})
 		if err != nil {
-			return nil, err
+			logger.Error(fmt.Sprintf("Failed to open backup root %s", *o.backupRoot), "error", err)
+			os.Exit(exitFailure)
 		}
-		data, err := io.ReadAll(cfgFile)
+	}
+	store = backupstore.LimitReads(store, readLimit)
+
+	// checked first so a wrong -backup-root isn't mistaken for an empty one
+	if _, err := fs.Stat(store, "."); errors.Is(err, fs.ErrNotExist) {
+		logger.Error(fmt.Sprintf("Backup root %s does not contain backupstore", *o.backupRoot))
+		os.Exit(exitFailure)
+	}
+
+	if cmd.name == "list-volumes" {
+		if !slices.Contains(listFormats, *o.listFormat) && *o.listFormat != namesFormat {
+			logger.Error(fmt.Sprintf("Unsupported output %s", *o.listFormat))
+			flags.Usage()
+			os.Exit(exitUsage)
+		}
+		volumes, err := backupstore.ListVolumes(store)
+		if err != nil {
+			logger.Error("Failed to list volumes", "error", err)
+			os.Exit(exitFailure)
+		}
+		name := path.Base
+		if *o.fullPath {
+			name = func(volume string) string {
+				return displayPath(backupStorePath, volume)
+			}
+		}
+		if *o.listFormat == namesFormat {
+			names := make([]string, 0, len(volumes))
+			for _, volume := range volumes {
+				names = append(names, name(volume))
+			}
+			slices.Sort(names)
+			err = printNames(os.Stdout, slices.Compact(names))
+		} else {
+			err = printVolumeList(os.Stdout, listVolumes(store, volumes, name), *o.listFormat)
+		}
+		if err != nil {
+			logger.Error("Failed to list volumes", "error", err)
+			os.Exit(exitFailure)
+		}
+		os.Exit(0)
+	}
+
+	if *o.jobs < 1 {
+		logger.Error("-jobs must be at least 1")
+		os.Exit(exitUsage)
+	}
+
+	if !slices.Contains(outputFormats, *o.outputFormat) {
+		logger.Error(fmt.Sprintf("Unsupported output format %s", *o.outputFormat))
+		flags.Usage()
+		os.Exit(exitUsage)
+	}
+
+	if *o.compressOutput != "" {
+		if !slices.Contains(outputCompressions, *o.compressOutput) {
+			logger.Error(fmt.Sprintf("Unsupported output compression %s", *o.compressOutput))
+			flags.Usage()
+			os.Exit(exitUsage)
+		}
+		if *o.outputFormat != "raw" {
+			logger.Error("Output compression only supports the raw output format")
+			os.Exit(exitUsage)
+		}
+	}
 
-		var cfg BackupConfig
-		if err := json.Unmarshal(data, &cfg); err != nil {
-			return nil, err
+	var events *progressReporter
+	switch *o.progressFormat {
+	case "human":
+	case "json":
+		// events get stdout to themselves, or share stderr with everything
+		// else when the image is streamed to stdout
+		events = newProgressReporter(os.Stdout)
+		os.Stdout = os.Stderr
+	default:
+		logger.Error(fmt.Sprintf("Unsupported progress format %s", *o.progressFormat))
+		flags.Usage()
+		os.Exit(exitUsage)
+	}
+
+	// progress carries everything but errors and the summary, which -quiet
+	// drops, and listings print nothing but the list
+	var progress io.Writer = os.Stdout
+	level := verbosityNormal
+	if cmd.name == "list-backups" || cmd.name == "describe" || cmd.name == "diff" || cmd.name == "verify-backup" || cmd.name == "check" || cmd.name == "ls" {
+		if !slices.Contains(listFormats, *o.listFormat) && !(cmd.name == "list-backups" && *o.listFormat == namesFormat) {
+			logger.Error(fmt.Sprintf("Unsupported output %s", *o.listFormat))
+			flags.Usage()
+			os.Exit(exitUsage)
+		}
+		if cmd.name == "list-backups" || cmd.name == "ls" || *o.listFormat == "json" {
+			progress = io.Discard
 		}
+	}
+	switch {
+	case *o.quiet && *o.verbose:
+		logger.Error("-quiet and -verbose are mutually exclusive")
+		os.Exit(exitUsage)
+	case *o.quiet:
+		progress = io.Discard
+		level = verbosityQuiet
+	case *o.verbose:
+		level = verbosityVerbose
+	}
 
-		fmt.Printf("time %s\n", cfg.CreatedTime)
-		timestamp, err := time.Parse(time.RFC3339, cfg.CreatedTime)
+	if cmd.name == "check" {
+		report, err := checkStore(store, *o.deep, *o.jobs, progress)
 		if err != nil {
-			timestamp = time.Now()
+			logger.Error(fmt.Sprintf("Failed to check %s", backupStorePath), "error", err)
+			os.Exit(exitFailure)
+		}
+		if err := printStoreCheck(os.Stdout, report, *o.listFormat); err != nil {
+			logger.Error(fmt.Sprintf("Failed to print the check of %s", backupStorePath), "error", err)
+			os.Exit(exitFailure)
+		}
+		os.Exit(report.exitCode())
+	}
+
+	if cmd.name == "export" && filepath.Clean(*o.dest) == filepath.Clean(*o.backupRoot) {
+		logger.Error("-dest must be another backup root than -backup-root")
+		os.Exit(exitUsage)
+	}
+
+	if cmd.name == "copy" {
+		switch {
+		case strings.Contains(*o.destRoot, "://"):
+			logger.Error("-dest-root must be a local backup root", "hint", "Mount a remote store to copy into it")
+			os.Exit(exitUsage)
+		case filepath.Clean(*o.destRoot) == filepath.Clean(*o.backupRoot):
+			logger.Error("-dest-root must be another backup root than -backup-root")
+			os.Exit(exitUsage)
 		}
+	}
+
+	if cmd.name == "prune" {
+		os.Exit(prune(logger, store, *o.backupRoot, backupStorePath, *o.dryRun, *o.pruneLog))
+	}
+
+	if *o.yes && *o.noClobber {
+		logger.Error("-yes and -no-clobber are mutually exclusive")
+		os.Exit(exitUsage)
+	}
 
-		size, err := strconv.Atoi(cfg.Size)
+	var padSize int64
+	if *o.padToSize != "" {
+		if *o.noTruncate {
+			logger.Error("-no-truncate and -pad-to-size are mutually exclusive")
+			os.Exit(exitUsage)
+		}
+		padSize, err = parseByteSize(*o.padToSize)
 		if err != nil {
-			return nil, err
+			logger.Error(fmt.Sprintf("Invalid -pad-to-size value %s", *o.padToSize), "error", err)
+			os.Exit(exitUsage)
 		}
+	}
 
-		backup := Backup{
-			Identifier:  cfgPath,
-			Timestamp:   timestamp,
-			Size:        int64(size),
-			Compression: cfg.CompressionMethod,
-			Blocks:      cfg.Blocks,
+	// a block is cached by checksum, so blocks shared between offsets or
+	// backups are only read and decompressed once
+	var cache *backupstore.BlockCache
+	if *o.cacheSize != "0" {
+		cacheSize, err := parseByteSize(*o.cacheSize)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Invalid -cache-size value %s", *o.cacheSize), "error", err)
+			os.Exit(exitUsage)
 		}
+		cache = backupstore.NewBlockCache(cacheSize)
+	}
+	var memory *backupstore.MemoryBudget
+	if *o.maxMemory != "0" {
+		maxMemory, err := parseByteSize(*o.maxMemory)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Invalid -max-memory value %s", *o.maxMemory), "error", err)
+			os.Exit(exitUsage)
+		}
+		memory = backupstore.NewMemoryBudget(maxMemory)
+	}
+	var writeBatch int64
+	if *o.writeBatch != "0" {
+		writeBatch, err = parseByteSize(*o.writeBatch)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Invalid -write-batch value %s", *o.writeBatch), "error", err)
+			os.Exit(exitUsage)
+		}
+	}
 
-		volumeBackup.Backups = append(volumeBackup.Backups, backup)
+	fsync, err := parseFsyncInterval(*o.fsyncInterval)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Invalid -fsync-interval value %s", *o.fsyncInterval), "error", err)
+		os.Exit(exitUsage)
 	}
 
-	sort.Slice(volumeBackup.Backups, func(i, j int) bool {
-		return volumeBackup.Backups[i].Timestamp.Before(volumeBackup.Backups[j].Timestamp)
-	})
+	onMismatch, ok := mismatchPolicies[*o.onChecksumMismatch]
+	if !ok {
+		logger.Error(fmt.Sprintf("Unsupported -on-checksum-mismatch value %s, expected fail, warn or skip", *o.onChecksumMismatch))
+		os.Exit(exitUsage)
+	}
+	onMissing, ok := missingPolicies[*o.onMissingBlock]
+	if !ok {
+		logger.Error(fmt.Sprintf("Unsupported -on-missing-block value %s, expected fail or zero", *o.onMissingBlock))
+		os.Exit(exitUsage)
+	}
 
-	return volumeBackup, nil
-}
+	var passphrase []byte
+	if *o.luksPassphrase != "" || *o.luksKeyFile != "" {
+		if *o.luksPassphrase != "" && *o.luksKeyFile != "" {
+			logger.Error("-luks-passphrase and -luks-key-file are mutually exclusive")
+			os.Exit(exitUsage)
+		}
+		if *o.outputFormat != "raw" {
+			logger.Error("LUKS decryption only supports the raw output format")
+			os.Exit(exitUsage)
+		}
+		passphrase = []byte(*o.luksPassphrase)
+		if *o.luksKeyFile != "" {
+			passphrase, err = os.ReadFile(*o.luksKeyFile)
+			if err != nil {
+				logger.Error(fmt.Sprintf("Failed to read LUKS key file %s", *o.luksKeyFile), "error", err)
+				os.Exit(exitFailure)
+			}
+		}
+	}
+
+	if cmd.name == "serve" {
+		repack, _ := lookupCommand("repack")
+		in := &invocation{
+			o:               o,
+			cmd:             &repack,
+			store:           store,
+			backupStorePath: backupStorePath,
+			level:           verbosityQuiet,
+			cache:           cache,
+			memory:          memory,
+			writeLimit:      writeLimit,
+			throttles:       throttles,
+			writeBatch:      writeBatch,
+			fsync:           fsync,
+			onMismatch:      onMismatch,
+			onMissing:       onMissing,
+			out:             os.Stdout,
+			log:             logger,
+		}
+		os.Exit(in.serve(*o.listen, *o.apiToken, *o.dest))
+	}
 
-func resolveBlockPath(backupPath, checksum string) (string, error) {
-	pattern := filepath.Join(backupPath, "blocks", "**", "**", checksum+".blk")
-	matches, err := filepath.Glob(pattern)
+	var (
+		targets []string
+		dirs    map[string]string
+	)
+	if *o.all {
+		volumes, err := backupstore.ListVolumes(store)
+		if err != nil {
+			logger.Error("Failed to list volumes", "error", err)
+			os.Exit(exitFailure)
+		}
+		targets, dirs = volumeNames(volumes), volumeDirs(volumes)
+		if len(targets) == 0 {
+			logger.Error(fmt.Sprintf("No volumes found in %s", backupStorePath))
+			os.Exit(exitVolumeNotFound)
+		}
+	} else {
+		targets, dirs, err = resolveTargets(store, targetPatterns, *o.multi)
+		var ambiguous *ambiguousTargetError
+		switch {
+		case errors.As(err, &ambiguous):
+			logger.Error(fmt.Sprintf("-target %s matches %d volumes: %s", ambiguous.pattern, len(ambiguous.volumes), strings.Join(ambiguous.volumes, ", ")),
+				"hint", "Use a more specific -target, or -multi to use all of them")
+			os.Exit(exitUsage)
+		case err != nil:
+			logger.Error(fmt.Sprintf("Failed to look for volumes matching %s", *o.target), "error", err)
+			os.Exit(exitCode(err))
+		}
+		for _, name := range locatedNames {
+			if !slices.Contains(targets, name) {
+				targets = append(targets, name)
+			}
+			dirs[name] = located[name]
+		}
+	}
+	if *o.concurrency < 1 {
+		logger.Error("-concurrency must be at least 1")
+		os.Exit(exitUsage)
+	}
+	multiple := len(targets) > 1 || *o.all
+	if multiple {
+		switch {
+		case cmd.name == "verify", cmd.name == "delete-backup", cmd.name == "diff", cmd.name == "ls", cmd.name == "extract":
+			logger.Error(fmt.Sprintf("%s takes a single -target", cmd.name))
+			os.Exit(exitUsage)
+		case *o.outfile == "-":
+			logger.Error("Streaming to stdout takes a single -target")
+			os.Exit(exitUsage)
+		}
+	}
+	if *o.preserveOwner && os.Geteuid() != 0 {
+		logger.Error("-preserve-owner needs root to change the owner of the extracted files")
+		os.Exit(exitUsage)
+	}
+	if *o.mount != "" {
+		switch {
+		case multiple:
+			logger.Error("-mount takes a single -target")
+			os.Exit(exitUsage)
+		case *o.outfile == "-" || *o.compressOutput != "" || *o.outputFormat != "raw":
+			logger.Error("-mount only supports restoring to a raw output file")
+			os.Exit(exitUsage)
+		case os.Geteuid() != 0:
+			logger.Error("-mount needs root to set up a loop device and mount it")
+			os.Exit(exitUsage)
+		}
+	}
+
+	// everything printed from here on is also appended to -log-file, but
+	// the image and JSON progress events
+	logFile, err := openRunLog(*o.logFile, fmt.Sprintf("%s of %s", cmd.name, strings.Join(targets, ", ")))
 	if err != nil {
-		return "", err
+		logger.Error(fmt.Sprintf("Failed to open log file %s", *o.logFile), "error", err)
+		os.Exit(exitOutputError)
 	}
-	if len(matches) == 0 {
-		return "", fmt.Errorf("could not find block %s", checksum)
+	logger = newLogger(logFile.tee(os.Stderr), *o.logFormat, logLevel)
+
+	// metrics are served from before the first target until the process
+	// exits, so the final values can still be scraped
+	var metrics *metricsRegistry
+	if *o.metricsListen != "" {
+		metrics = newMetricsRegistry(store)
+		addr, err := metrics.serve(*o.metricsListen)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Failed to listen on %s", *o.metricsListen), "error", err)
+			os.Exit(exitFailure)
+		}
+		logger.Info(fmt.Sprintf("Serving metrics on http://%s/metrics", addr))
+	}
+
+	// the first interrupt lets the blocks being written finish, so the
+	// output and the journal agree, and a second one exits at once
+	ctx := context.Background()
+	if cmd.name == "repack" && !*o.dryRun && !*o.estimate {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		interrupts := make(chan os.Signal, 2)
+		signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-interrupts
+			fmt.Fprintln(logFile.tee(os.Stderr), "\nInterrupted, finishing the blocks being written (interrupt again to exit immediately)")
+			cancel()
+			<-interrupts
+			os.Exit(logFile.end(exitInterrupted))
+		}()
 	}
-	return matches[0], nil
+
+	in := &invocation{
+		o:               o,
+		cmd:             cmd,
+		flags:           flags,
+		store:           store,
+		backupStorePath: backupStorePath,
+		progress:        logFile.tee(progress),
+		level:           level,
+		events:          events,
+		cache:           cache,
+		memory:          memory,
+		writeLimit:      writeLimit,
+		throttles:       throttles,
+		metrics:         metrics,
+		writeBatch:      writeBatch,
+		fsync:           fsync,
+		onMismatch:      onMismatch,
+		onMissing:       onMissing,
+		passphrase:      passphrase,
+		padSize:         padSize,
+		imageOut:        imageOut,
+		ctx:             ctx,
+		out:             logFile.tee(os.Stdout),
+		log:             logger,
+		interactive:     isInteractive(os.Stdin, os.Stdout),
+		volumeDirs:      dirs,
+	}
+	if !multiple {
+		os.Exit(logFile.end(in.run(targets[0], targetOutfile(*o.outfile, targets[0], *o.outputFormat, false))))
+	}
+
+	// JSON listings print nothing but the documents, one target after the
+	// other, and otherwise every line is prefixed with its target
+	listing := cmd.name != "repack" && *o.listFormat == "json"
+	concurrency := *o.concurrency
+	if listing {
+		concurrency = 1
+	}
+	results := make([]targetResult, len(targets))
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		stopped bool
+		lines   sync.Mutex
+		sem     = make(chan struct{}, concurrency)
+	)
+	for i, target := range targets {
+		sem <- struct{}{}
+		mu.Lock()
+		stop := stopped
+		mu.Unlock()
+		if stop {
+			break
+		}
+
+		outfile := targetOutfile(*o.outfile, target, *o.outputFormat, true)
+		results[i] = targetResult{Target: target, Ran: true}
+		if cmd.name == "repack" && !*o.dryRun && !*o.estimate {
+			results[i].Outfile = outfile
+		}
+		run := *in
+		run.log = targetLogger(in.log, target)
+		if !listing {
+			run.out = &prefixWriter{mu: &lines, w: in.out, prefix: "[" + target + "] "}
+			if in.progress != io.Discard {
+				run.progress = &prefixWriter{mu: &lines, w: in.progress, prefix: "[" + target + "] "}
+			}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			started := time.Now()
+			code := run.run(target, outfile)
+			results[i].Code, results[i].Size, results[i].Empty = code, run.written, run.empty
+			results[i].Elapsed = time.Since(started)
+			if code == exitInterrupted || *o.failFast && results[i].failed() {
+				mu.Lock()
+				stopped = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if !listing {
+		fmt.Fprintln(in.out)
+		printTargetSummary(in.out, results)
+	}
+	os.Exit(logFile.end(combinedExitCode(results)))
 }
 
-func writeBlockToBuffer(blockData []byte, offset int64, fileDiscriptor *os.File) {
-	fileDiscriptor.Seek(offset, io.SeekStart)
-	fileDiscriptor.Write(blockData)
+// invocation is what the targets of one run share: the flags, and what
+// was set up from them before the first target
+type invocation struct {
+	o               *cliOptions
+	cmd             *command
+	flags           *flag.FlagSet
+	store           fs.FS
+	backupStorePath string
+	progress        io.Writer
+	level           verbosity
+	events          *progressReporter
+	cache           *backupstore.BlockCache
+	memory          *backupstore.MemoryBudget
+	writeLimit      *backupstore.RateLimiter
+	throttles       []throttle
+	metrics         *metricsRegistry
+	writeBatch      int64
+	fsync           fsyncInterval
+	onMismatch      backupstore.MismatchPolicy
+	onMissing       backupstore.MissingPolicy
+	passphrase      []byte
+	padSize         int64
+	imageOut        io.WriteCloser
+	ctx             context.Context
+	// volumeDirs are the directories of the targets found while resolving
+	// them, so run doesn't look for them again
+	volumeDirs map[string]string
+	// out is where run prints everything but progress, errors and
+	// warnings, which go to log
+	out io.Writer
+	log *slog.Logger
+	// interactive is set when questions can be asked, see isInteractive
+	interactive bool
+	// written is the size of the image once run has restored it, and
+	// empty is set when -all skipped the target for having no backups
+	written int64
+	empty   bool
 }
 
-func getVolumes(backupStorePath string) ([]string, error) {
-	matches, err := filepath.Glob(filepath.Join(backupStorePath, "volumes", "**", "**", "*"))
-	if err != nil {
-		return nil, err
+// overwritePrompt is held while asking whether to overwrite an output
+// file, as targets restored at the same time share stdin
+var overwritePrompt sync.Mutex
+
+// stdin is read a line at a time for answers, whatever its line endings
+var stdin = bufio.NewReader(os.Stdin)
+
+// readAnswer reads a line from r, without the \r\n of a Windows console.
+// A closed stdin is io.EOF.
+func readAnswer(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", err
 	}
-	return matches, nil
+	return strings.TrimSpace(line), nil
 }
 
-func main() {
-	versionFlag := flag.Bool("version", false, "Print version")
-	listVolumes := flag.Bool("list-volumes", false, "List volumes")
-	backupRoot := flag.String("backup-root", "", "Backup root directory")
-	target := flag.String("target", "", "Backup target")
-	outfile := flag.String("outfile", "", "Output file")
-	inspect := flag.Bool("inspect", false, "inspect backup")
-	flag.Parse()
-
-	if *versionFlag {
-		fmt.Printf("Version: %s\n", version)
-		fmt.Printf("Commit: %s\n", commit)
-		os.Exit(0)
+// writeManifest finishes manifest, complete or else failed or cancelled
+// by the exit status code, and writes it next to outfile. An image that
+// was never created, or was removed, gets none.
+func (in *invocation) writeManifest(outfile string, manifest *backupstore.Manifest, stats *backupstore.RepackStats, damaged *backupstore.DamageReport, code int) {
+	if _, err := os.Stat(outfile); err != nil {
+		return
+	}
+	status := manifest.Status
+	switch {
+	case status != "":
+	case code == exitInterrupted:
+		status = backupstore.ManifestCancelled
+	default:
+		status = backupstore.ManifestFailed
 	}
+	manifest.Finish(status, stats, damaged.Blocks(), time.Now())
+	path := backupstore.ManifestPath(outfile)
+	if err := manifest.WriteFile(path); err != nil {
+		in.log.Warn(fmt.Sprintf("Failed to write manifest %s", path), "error", err)
+		return
+	}
+	fmt.Fprintf(in.progress, "Wrote manifest %s\n", path)
+}
 
-	if *backupRoot == "" {
-		flag.Usage()
-		os.Exit(1)
+// isInteractive reports whether questions can be asked on stdout and
+// answered on stdin, which are not terminals when piped or run from cron,
+// systemd or a Kubernetes pod
+func isInteractive(stdin, stdout *os.File) bool {
+	return isTerminal(stdin) && isTerminal(stdout)
+}
+
+// confirmOverwrite asks whether to overwrite outfile, reading the answer
+// from answers, and returns 0 for y or yes in any case, or the exit status
+// to stop with otherwise. When not interactive it fails at once, naming
+// the flags that decide instead.
+func confirmOverwrite(answers *bufio.Reader, interactive bool, out io.Writer, outfile string) int {
+	if !interactive {
+		fmt.Fprintf(out, "Not asking whether to overwrite %s, as stdin is not a terminal\n", outfile)
+		fmt.Fprintf(out, "Run with -yes to overwrite it, or -no-clobber to keep it\n")
+		return exitOutputError
+	}
+	fmt.Fprintf(out, "Do you want to overwrite it? [y/n] ")
+	response, err := readAnswer(answers)
+	switch {
+	case errors.Is(err, io.EOF):
+		fmt.Fprintf(out, "\nNo answer on stdin, refusing to overwrite %s without -yes\n", outfile)
+		return exitOutputError
+	case err != nil:
+		fmt.Fprintf(out, "Failed to read input\n")
+		fmt.Fprintf(out, "Error: %s\n", err)
+		return exitOutputError
+	case !strings.EqualFold(response, "y") && !strings.EqualFold(response, "yes"):
+		fmt.Fprintf(out, "Aborting\n")
+		return exitOutputError
 	}
+	return 0
+}
 
-	backupStorePath := filepath.Join(*backupRoot, "backupstore")
+// run runs the command for target, restoring it into outfile, and returns
+// the exit status
+func (in *invocation) run(target, outfile string) (code int) {
+	started := time.Now()
+	// stats count what the restore does, for the summary at the end
+	stats := &backupstore.RepackStats{}
+	in.events = in.events.forTarget(stats)
+	metrics := in.metrics.track(target, stats)
+	damaged := &backupstore.DamageReport{}
 
-	if *listVolumes {
-		volumes, err := getVolumes(backupStorePath)
+	fmt.Fprintf(in.progress, "Looking for backups in %s\n", in.backupStorePath)
+	volumeBackups, ok := in.volumeDirs[target]
+	if !ok {
+		var err error
+		volumeBackups, err = backupstore.FindVolumeBackupPath(in.store, target)
 		if err != nil {
-			fmt.Printf("Failed to list volumes\n")
-			os.Exit(1)
+			if errors.Is(err, backupstore.ErrAmbiguousVolume) {
+				in.log.Error(fmt.Sprintf("Failed to find backups for %s", target), "error", err)
+			} else {
+				in.log.Error(fmt.Sprintf("Failed to find backups for %s", target))
+			}
+			return exitCode(err)
 		}
-		for _, volume := range volumes {
-			fmt.Println(volume)
+	}
+
+	fmt.Fprintf(in.progress, "Found backups for %s at %s\n", target, displayPath(in.backupStorePath, volumeBackups))
+	if in.cmd.name == "list-backups" && *in.o.listFormat == namesFormat {
+		names, err := backupstore.ListBackupNames(in.store, volumeBackups)
+		if err == nil {
+			err = printNames(in.out, names)
 		}
-		os.Exit(0)
+		if err != nil {
+			in.log.Error(fmt.Sprintf("Failed to list backups for %s", target), "error", err)
+			return exitFailure
+		}
+		return 0
 	}
-	if _, err := os.Stat(backupStorePath); os.IsNotExist(err) {
-		fmt.Printf("Backup root %s does not contain backupstore\n", *backupRoot)
-		os.Exit(1)
+	volumeBackup, err := backupstore.ReadBackups(in.store, volumeBackups)
+
+	if err != nil {
+		in.log.Error(fmt.Sprintf("Failed to read backups for %s", target), "error", err)
+		return exitFailure
+	}
+	// a live backupstore has the cfg files of backups Longhorn is still
+	// writing, which would restore a torn image
+	if *in.o.includeIncomplete {
+		for _, skipped := range volumeBackup.Skipped {
+			if skipped.Backup != nil {
+				in.log.Warn(fmt.Sprintf("including incomplete backup %s: %s", skipped.Backup.Identifier, skipped.Reason))
+			}
+		}
+		volumeBackup.IncludeIncomplete()
+	}
+	for _, skipped := range volumeBackup.Skipped {
+		fmt.Fprintf(in.progress, "Skipping %s: %s\n", displayPath(in.backupStorePath, skipped.Path), skipped.Reason)
+	}
+	// hand-copied stores sometimes lack it, and the image can be sized
+	// without it
+	if volumeBackup.Config == nil {
+		in.log.Warn(fmt.Sprintf("%s has no volume.cfg, continuing without its size and metadata", target))
+	}
+	// a cfg file copied into the wrong volume directory still restores,
+	// but most likely not the volume that was asked for
+	for _, backup := range volumeBackup.Backups {
+		if backup.VolumeName != "" && backup.VolumeName != volumeBackup.Name {
+			in.log.Warn(fmt.Sprintf("backup %s in %s is a backup of %s", backup.Identifier, displayPath(in.backupStorePath, volumeBackups), backup.VolumeName))
+		}
+		if backup.Warning != "" {
+			in.log.Warn(fmt.Sprintf("backup %s: %s", backup.Identifier, backup.Warning))
+		}
+	}
+	if *in.o.all && len(volumeBackup.Backups) == 0 {
+		in.log.Warn(fmt.Sprintf("%s has no backups, skipping it", target))
+		in.empty = true
+		return 0
 	}
 
-	if *target == "" {
-		flag.Usage()
-		os.Exit(1)
+	if in.cmd.name == "list-backups" {
+		if err := printBackupList(in.out, volumeBackup.Backups, *in.o.listFormat); err != nil {
+			in.log.Error(fmt.Sprintf("Failed to list backups for %s", target), "error", err)
+			return exitFailure
+		}
+		return 0
 	}
 
-	fmt.Printf("Looking for backups in %s\n", backupStorePath)
-	volumeBackups, err := findVolumeBackupPath(backupStorePath, *target)
-	if err != nil {
-		fmt.Printf("Failed to find backups for %s\n", *target)
-		os.Exit(1)
+	if in.cmd.name == "diff" {
+		return in.diff(volumeBackup)
 	}
 
-	fmt.Printf("Found backups for %s at %s\n", *target, volumeBackups)
-	volumeBackup, err := readBackups(volumeBackups)
+	if *in.o.backupName != "" {
+		selected, err := selectBackup(volumeBackup.Backups, *in.o.backupName)
+		if err != nil {
+			in.log.Error(fmt.Sprintf("Failed to select a backup of %s", target), "error", err, "hint", availableBackups(volumeBackup.Backups))
+			return exitVolumeNotFound
+		}
+		volumeBackup.Backups = selected
+	}
 
-	if err != nil {
-		fmt.Printf("Failed to read backups for %s\n", *target)
-		fmt.Printf("Error: %s\n", err)
-		os.Exit(1)
-	}
-
-	if *inspect {
-		size := 0
-		fmt.Printf("Found backups for %s at %s\n", *target, volumeBackups)
-		fmt.Printf("Number of Backups: %d\n", len(volumeBackup.Backups))
-		for _, backup := range volumeBackup.Backups {
-			fmt.Printf("Backup: %s\n", backup.Identifier)
-			fmt.Printf("Created: %s\n", backup.Timestamp)
-			fmt.Printf("Size: %d\n", backup.Size)
-			fmt.Printf("Compression: %s\n", backup.Compression)
-			for _, block := range backup.Blocks {
-				fmt.Printf("[block] Checksum: %s; Offset: %d\n", block.Checksum, block.Offset)
-				size += 2
+	if in.cmd.name == "delete-backup" {
+		return deleteBackup(in.store, *in.o.backupRoot, in.backupStorePath, volumeBackup.BackupPath, volumeBackup.Backups[0], *in.o.dryRun, *in.o.pruneLog, in.out, in.log)
+	}
+
+	if *in.o.before != "" {
+		cutoff, err := parseBeforeTime(*in.o.before)
+		if err != nil {
+			in.log.Error(fmt.Sprintf("Invalid -before value %s", *in.o.before), "error", err)
+			return exitUsage
+		}
+		filtered := filterBackupsBefore(volumeBackup.Backups, cutoff)
+		if len(filtered) == 0 {
+			var hint []any
+			if len(volumeBackup.Backups) > 0 {
+				oldest := volumeBackup.Backups[0]
+				hint = []any{"hint", fmt.Sprintf("Oldest available backup: %s (created %s)", oldest.Identifier, oldest.Timestamp.Format(time.RFC3339))}
 			}
+			in.log.Error(fmt.Sprintf("No backups for %s were created at or before %s", target, cutoff.Format(time.RFC3339)), hint...)
+			return exitVolumeNotFound
 		}
-		fmt.Printf("Approximate Cumulative Size: %dmb", size)
-		os.Exit(0)
+		volumeBackup.Backups = filtered
+	}
+
+	if in.cmd.name == "describe" {
+		if *in.o.listFormat == "text" {
+			fmt.Fprintf(in.out, "Found backups for %s at %s\n", target, displayPath(in.backupStorePath, volumeBackups))
+		}
+		if err := printDescription(in.out, describeChain(in.store, volumeBackup, *in.o.fast), *in.o.listFormat); err != nil {
+			in.log.Error(fmt.Sprintf("Failed to describe %s", target), "error", err)
+			return exitFailure
+		}
+		if *in.o.compressOutput != "" && *in.o.listFormat == "text" {
+			// the compressed size is only known once the image has been written
+			fmt.Fprintf(in.out, "Output Compression: %s\n", *in.o.compressOutput)
+			if outfile != "" && outfile != "-" {
+				fmt.Fprintf(in.out, "Output File: %s\n", withCompressedExtension(outfile, *in.o.compressOutput))
+			}
+			if len(volumeBackup.Backups) > 0 {
+				fmt.Fprintf(in.out, "Logical Size: %s\n", formatSize(volumeBackup.Backups[len(volumeBackup.Backups)-1].Size))
+			}
+			fmt.Fprintf(in.out, "Compressed Size: reported after restore")
+		}
+		return 0
 	}
 
-	if *outfile == "" {
-		flag.Usage()
-		os.Exit(1)
+	backups := volumeBackup.Backups
+	if *in.o.latest {
+		backups = latestBackup(backups)
 	}
 
-	if _, err := os.Stat(filepath.Dir(*outfile)); os.IsNotExist(err) {
-		fmt.Printf("Output directory for %s does not exist\n", *outfile)
-		flag.Usage()
-		os.Exit(1)
+	if in.cmd.name == "export" {
+		result, err := exportChain(in.store, volumeBackup, backups, *in.o.dest, *in.o.jobs, in.progress, in.level)
+		if err != nil {
+			in.log.Error(fmt.Sprintf("Failed to export %s to %s", target, *in.o.dest), "error", err)
+			return exitCode(err)
+		}
+		in.written = result.Bytes
+		fmt.Fprintf(in.out, "Exported %d backups of %s to %s: %d blocks, %s\n", result.Backups, target, *in.o.dest, result.Blocks, formatSize(result.Bytes))
+		return 0
 	}
 
-	if _, err := os.Stat(*outfile); err == nil {
-		fmt.Printf("Output file %s already exists\n", *outfile)
-		fmt.Printf("Do you want to overwrite it? [y/n] ")
-		var response string
-		_, err := fmt.Scanln(&response)
+	if in.cmd.name == "copy" {
+		result, err := copyChain(in.store, volumeBackup, backups, *in.o.destRoot, *in.o.jobs, in.progress, in.level)
 		if err != nil {
-			fmt.Printf("Failed to read input\n")
-			os.Exit(1)
+			var conflict *copyConflictError
+			if errors.As(err, &conflict) {
+				in.log.Error(fmt.Sprintf("Failed to copy %s to %s", target, *in.o.destRoot), "error", err, "hint", "Remove it from -dest-root, or leave its backup out with -backup or -before")
+				return exitFailure
+			}
+			in.log.Error(fmt.Sprintf("Failed to copy %s to %s", target, *in.o.destRoot), "error", err)
+			return exitCode(err)
 		}
-		if response != "y" {
-			fmt.Printf("Aborting\n")
-			os.Exit(1)
+		in.written = result.Bytes
+		fmt.Fprintf(in.out, "Copied %d backups of %s to %s: %d blocks, %s\n", result.Backups, target, *in.o.destRoot, result.Blocks, formatSize(result.Bytes))
+		if result.BackupsPresent > 0 || result.BlocksPresent > 0 {
+			fmt.Fprintf(in.out, "Already there: %d backups, %d blocks\n", result.BackupsPresent, result.BlocksPresent)
 		}
-		os.Remove(*outfile)
+		fmt.Fprintf(in.out, "Verified %s in %s: all %d backups and their blocks are there\n", target, *in.o.destRoot, len(backups))
+		return 0
 	}
-	outfile_descriptor, err := os.Create(*outfile)
-	defer outfile_descriptor.Close()
-	if err != nil {
-		fmt.Printf("Failed to create output file %s\n", *outfile)
-		os.Exit(1)
-	}
-	for i_backup, backup := range volumeBackup.Backups {
-		totalBlocks := len(backup.Blocks)
-		for i, block := range backup.Blocks {
-			percentage := float64(i+1) / float64(totalBlocks) * 100
-			fmt.Printf("[pass %d/%d] [%.2f%%] Block %s* {offset=%d} {%s}\n",
-				i_backup+1,
-				len(volumeBackup.Backups),
-				percentage,
-				block.Checksum[0:20], block.Offset, backup.Compression)
-
-			blockPath, err := resolveBlockPath(volumeBackup.BackupPath, block.Checksum)
+
+	if in.cmd.name == "verify-backup" {
+		return in.verifyBackupCommand(volumeBackup, backups)
+	}
+
+	if in.cmd.name == "verify" {
+		image, err := os.Open(*in.o.image)
+		if err != nil {
+			in.log.Error(fmt.Sprintf("Failed to open image %s", *in.o.image), "error", err)
+			return exitFailure
+		}
+		// the image may have been written with -no-truncate, so volume.cfg
+		// has the size to check up to, if there is one
+		size := volumeBackup.Size
+		if size <= 0 {
+			info, err := image.Stat()
 			if err != nil {
-				fmt.Printf("Failed to resolve block %s\n", block.Checksum)
-				os.Exit(1)
+				in.log.Error(fmt.Sprintf("Failed to read image %s", *in.o.image), "error", err)
+				return exitFailure
 			}
+			size = info.Size()
+		}
+		checked, mismatches := verifyRestore(in.store, volumeBackup.BackupPath, backups, image, size, restoreOptions{
+			Jobs:      *in.o.jobs,
+			Progress:  in.progress,
+			Verbosity: in.level,
+			Cache:     in.cache,
+			Memory:    in.memory,
+			Throttles: in.throttles,
+		})
+		image.Close()
+		printVerifyReport(in.out, checked, mismatches)
+		printBufferStats(in.out, in.cache, in.memory)
+		printThrottleStats(in.out, in.throttles)
+		if len(mismatches) > 0 {
+			in.log.Error(fmt.Sprintf("Verification failed, %s does not match the backup", *in.o.image))
+			return exitVerifyFailed
+		}
+		fmt.Fprintf(in.out, "%s matches the backup\n", *in.o.image)
+		return 0
+	}
 
-			blockData, err := os.ReadFile(blockPath)
-			if err != nil {
-				fmt.Printf("Failed to read block %s\n", block.Checksum)
-				os.Exit(1)
+	if in.cmd.name == "ls" {
+		return in.list(volumeBackup, backups)
+	}
+	if in.cmd.name == "extract" {
+		return in.extract(volumeBackup, backups)
+	}
+
+	// a volume that was never written, or backed up from an empty
+	// snapshot, has backups without a single block
+	final := backupstore.FinalBlockMap(backups)
+	if len(final) == 0 && !*in.o.allowEmpty {
+		if *in.o.all {
+			in.log.Warn(fmt.Sprintf("the backups of %s hold no blocks, skipping it", target))
+			in.empty = true
+			return 0
+		}
+		message := fmt.Sprintf("The %d backups of %s hold no blocks, the volume contains no data", len(backups), target)
+		if len(backups) == 0 {
+			message = fmt.Sprintf("%s has no backups to restore", target)
+		}
+		in.log.Error(message, "hint", "Run again with -allow-empty to write an empty image, zero-filled to the size in volume.cfg if it has one")
+		return exitFailure
+	}
+
+	if *in.o.dryRun {
+		report := dryRunRestore(in.store, volumeBackup.BackupPath, backups, volumeBackup.Size, *in.o.jobs)
+		printDryRunReport(in.out, report, volumeBackup.Size)
+		if problems := report.problems(); problems > 0 {
+			in.log.Error(fmt.Sprintf("Dry run found %d problems, the restore would fail", problems))
+			return exitBlockError
+		}
+		fmt.Fprintln(in.out, "Dry run complete, all blocks found")
+		return 0
+	}
+
+	estimate := estimateRestore(final, volumeBackup.Size)
+	// the image is sized from its first block before anything is written,
+	// so it can be preallocated; what the block holds is reported once the
+	// image is written
+	probeOut := io.Discard
+	if *in.o.estimate {
+		probeOut = in.out
+	}
+	planned, contents, probeErr := probeImageSize(in.store, volumeBackup.BackupPath, final, volumeBackup.Size, in.cache, probeOut)
+	if len(final) == 0 {
+		// nothing to probe, so the image is as large as volume.cfg says
+		planned, probeErr = volumeBackup.Size, nil
+	}
+	if probeErr == nil {
+		estimate.probed(planned, contents)
+	}
+	if *in.o.estimate {
+		err := estimate.sample(in.store, volumeBackup.BackupPath, final, *in.o.jobs)
+		printEstimate(in.out, estimate)
+		if err != nil {
+			in.log.Error("Failed to time a sample of the blocks", "error", err)
+			return exitCode(err)
+		}
+		return 0
+	}
+
+	if outfile == "-" && *in.o.outputFormat != "raw" {
+		in.log.Error("Streaming to stdout only supports the raw output format")
+		return exitUsage
+	}
+	if *in.o.compressOutput != "" && outfile != "-" {
+		outfile = withCompressedExtension(outfile, *in.o.compressOutput)
+	}
+
+	if _, err := os.Stat(filepath.Dir(outfile)); outfile != "-" && os.IsNotExist(err) {
+		in.log.Error(fmt.Sprintf("Output directory for %s does not exist", outfile))
+		// the jobs of serve have no flags to show the usage of
+		if in.flags != nil {
+			in.flags.Usage()
+		}
+		return exitOutputError
+	}
+
+	streamed := outfile == "-" || *in.o.compressOutput != "" || in.passphrase != nil
+	if *in.o.verify && streamed {
+		in.log.Error("-verify needs an uncompressed, unencrypted output file to read back")
+		return exitUsage
+	}
+	if *in.o.legacyPasses && streamed {
+		in.log.Error("-legacy-passes needs an uncompressed, unencrypted output file to write each pass into")
+		return exitUsage
+	}
+	// a stream without a size simply ends with the last block
+	if probeErr != nil && !streamed && !*in.o.noTruncate && in.padSize == 0 {
+		in.log.Error(fmt.Sprintf("Failed to size the image: the volume has no volume.cfg and %s", probeErr),
+			"hint", "Restore with -no-truncate to keep the image as written, or give its size with -pad-to-size")
+		return exitFailure
+	}
+	outSize := planned
+	switch {
+	case in.padSize > 0:
+		outSize = in.padSize
+	case *in.o.noTruncate:
+		outSize = 0
+	}
+
+	// raw images are written in place, so an interrupted restore can be
+	// continued from the journal next to the output file
+	journaled := outfile != "-" && *in.o.compressOutput == "" && in.passphrase == nil && *in.o.outputFormat == "raw"
+	statePath := journalPath(outfile)
+	absOutfile, _ := filepath.Abs(outfile)
+	state := journalHeader{Target: target, Outfile: absOutfile}
+	for _, backup := range backups {
+		state.Backups = append(state.Backups, backup.ConfigPath)
+	}
+
+	if *in.o.directIO && !journaled {
+		in.log.Error("-direct-io needs a raw, uncompressed, unencrypted output file")
+		return exitUsage
+	}
+
+	var completed map[int64]struct{}
+	if *in.o.resume {
+		if !journaled {
+			in.log.Error("-resume only supports restoring to a raw output file")
+			return exitUsage
+		}
+		saved, offsets, err := readJournal(statePath)
+		if err != nil {
+			in.log.Error(fmt.Sprintf("No interrupted restore into %s to resume", outfile), "error", err)
+			return exitOutputError
+		}
+		if !saved.matches(state) {
+			in.log.Error(fmt.Sprintf("%s is for a different restore (target %s, %d backups)", statePath, saved.Target, len(saved.Backups)))
+			return exitOutputError
+		}
+		if _, err := os.Stat(outfile); err != nil {
+			in.log.Error(fmt.Sprintf("Output file %s is missing, cannot resume", outfile))
+			return exitOutputError
+		}
+		fmt.Fprintf(in.progress, "Resuming restore into %s, %d blocks already restored\n", outfile, len(offsets))
+		completed = offsets
+	} else if _, err := os.Stat(outfile); outfile != "-" && err == nil {
+		fmt.Fprintf(in.out, "Output file %s already exists\n", outfile)
+		if saved, _, err := readJournal(statePath); journaled && err == nil && saved.matches(state) {
+			fmt.Fprintf(in.out, "It is from an interrupted restore, run again with -resume to continue it\n")
+		}
+		switch {
+		case *in.o.noClobber:
+			in.log.Error("Not overwriting it, as -no-clobber is set")
+			return exitOutputError
+		case *in.o.yes:
+			fmt.Fprintf(in.out, "Overwriting it, as -yes is set\n")
+		default:
+			overwritePrompt.Lock()
+			code := confirmOverwrite(stdin, in.interactive, in.out, outfile)
+			overwritePrompt.Unlock()
+			if code != 0 {
+				return code
 			}
+		}
+		os.Remove(outfile)
+		os.Remove(statePath)
+		os.Remove(backupstore.ManifestPath(outfile))
+	}
 
-			if backup.Compression == "lz4" {
-				blockData, err = decompressLZ4(blockData)
-				if err != nil {
-					fmt.Printf("Failed to decompress block %s\n", block.Checksum)
-					os.Exit(1)
-				}
-			} else if backup.Compression == "gzip" {
-				blockData, err = decompressGZIP(blockData)
-				if err != nil {
-					fmt.Printf("Failed to decompress block %s\n", block.Checksum)
-					os.Exit(1)
-				}
+	// the manifest records what produced the image, or how far a restore
+	// that failed or was interrupted got
+	var manifest *backupstore.Manifest
+	if outfile != "-" {
+		manifest = backupstore.NewManifest(volumeBackup, backups, absOutfile, started)
+		manifest.Tool = backupstore.ManifestTool{Name: "longhorn-backup-repacker", Version: version, Commit: commit}
+		manifest.Backupstore = in.backupStorePath
+		manifest.Format = *in.o.outputFormat
+		manifest.Compression = *in.o.compressOutput
+		if probeErr == nil {
+			manifest.Filesystem = contents
+		}
+		defer func() { in.writeManifest(outfile, manifest, stats, damaged, code) }()
+	}
+	failed := func(err error) {
+		in.events.complete(0, err)
+		if manifest != nil {
+			manifest.Error = err.Error()
+		}
+	}
+
+	// the sizes are printed before anything is written, so a restore that
+	// won't fit can be interrupted
+	printEstimate(in.progress, estimate)
+	passes := 1
+	if *in.o.legacyPasses {
+		passes = len(backups)
+	}
+	in.events.start(target, outfile, passes, len(final), outSize)
+
+	// stdout and compressed streams can't seek, and the LUKS payload is
+	// decrypted as it goes past, so the image is written sequentially in
+	// offset order instead
+	if streamed {
+		var sink io.WriteCloser = in.imageOut
+		if outfile != "-" {
+			sink, err = os.Create(outfile)
+			if err != nil {
+				in.log.Error(fmt.Sprintf("Failed to create output file %s", outfile), "error", err)
+				return exitOutputError
 			}
+		}
+		counted := &countingWriter{w: backupstore.LimitWriter(sink, in.writeLimit)}
+		var w io.WriteCloser = nopWriteCloser{counted}
+		if *in.o.compressOutput != "" {
+			w, err = newCompressedWriter(counted, *in.o.compressOutput)
 			if err != nil {
-				fmt.Printf("Failed to decompress block %s\n", block.Checksum)
-				os.Exit(1)
+				in.log.Error("Failed to compress the output", "error", err)
+				return exitFailure
 			}
+		}
+		var decrypted *luksWriter
+		if in.passphrase != nil {
+			decrypted = newLUKSWriter(w, in.passphrase)
+			w = decrypted
+		}
+		metrics.startPass(1, 1)
+		written, err := streamBackups(in.ctx, in.store, volumeBackup.BackupPath, backups, w, restoreOptions{
+			Jobs:               *in.o.jobs,
+			VolumeSize:         volumeBackup.Size,
+			Strict:             *in.o.strict,
+			NoTruncate:         *in.o.noTruncate,
+			PadToSize:          in.padSize,
+			Progress:           in.progress,
+			Verbosity:          in.level,
+			Events:             in.events,
+			Cache:              in.cache,
+			Memory:             in.memory,
+			OnChecksumMismatch: in.onMismatch,
+			OnMissingBlock:     in.onMissing,
+			Damaged:            damaged,
+			Stats:              stats,
+			Throttles:          in.throttles,
+			Logger:             in.log,
+		})
+		if err != nil {
+			failed(err)
+			if errors.Is(err, context.Canceled) {
+				w.Close()
+				sink.Close()
+				in.log.Error(fmt.Sprintf("Restore interrupted after writing %d bytes, the output is incomplete", written))
+				return exitInterrupted
+			}
+			in.log.Error("Restore failed", "error", err)
+			return exitCode(err)
+		}
+		if err := w.Close(); err != nil {
+			failed(err)
+			in.log.Error("Failed to finish output", "error", err)
+			return exitOutputError
+		}
+		if err := sink.Close(); err != nil {
+			failed(err)
+			in.log.Error("Failed to finish output", "error", err)
+			return exitOutputError
+		}
+		fmt.Fprintf(in.out, "Total size of backup: %d\n", written)
+		if decrypted != nil {
+			fmt.Fprintf(in.out, "Decrypted size: %d\n", decrypted.written)
+		}
+		if *in.o.compressOutput != "" {
+			fmt.Fprintf(in.out, "Compressed size (%s): %d\n", *in.o.compressOutput, counted.n)
+		}
+		printBufferStats(in.out, in.cache, in.memory)
+		printThrottleStats(in.out, in.throttles)
+		printRestoreSummary(in.out, stats)
+		printDamageReport(in.out, damaged.Blocks())
+		in.events.complete(written, nil)
+		in.written = written
+		if manifest != nil {
+			manifest.Status, manifest.Size = backupstore.ManifestComplete, written
+		}
+		fmt.Fprintln(in.out, "Restore Complete")
+		return damageExitCode(damaged)
+	}
 
-			writeBlockToBuffer(blockData, block.Offset, outfile_descriptor)
+	var outfile_descriptor imageWriter
+	switch {
+	case *in.o.directIO:
+		flag := os.O_RDWR
+		if completed == nil {
+			flag |= os.O_CREATE | os.O_TRUNC
 		}
+		_, statErr := os.Stat(outfile)
+		var file *os.File
+		if file, err = openDirect(outfile, flag); err == nil {
+			outfile_descriptor = &directFile{File: file}
+		} else if errors.Is(err, errors.ErrUnsupported) {
+			// the file is created before O_DIRECT is refused
+			if completed == nil && os.IsNotExist(statErr) {
+				os.Remove(outfile)
+			}
+			in.log.Error(fmt.Sprintf("Failed to open output file %s for direct I/O", outfile), "error", "O_DIRECT is not supported by its filesystem",
+				"hint", "Run again without -direct-io, or write the image to another filesystem")
+			return exitOutputError
+		}
+	case completed != nil:
+		outfile_descriptor, err = os.OpenFile(outfile, os.O_RDWR, 0)
+	default:
+		outfile_descriptor, err = createImage(outfile, *in.o.outputFormat)
+	}
+	if err != nil {
+		in.log.Error(fmt.Sprintf("Failed to create output file %s", outfile), "error", err)
+		return exitOutputError
+	}
+	var journal *restoreJournal
+	if file, ok := rawImageFile(outfile_descriptor); ok && journaled {
+		if completed != nil {
+			journal, err = openJournal(statePath, file)
+		} else {
+			journal, err = createJournal(statePath, state, file)
+		}
+		if err != nil {
+			in.log.Error(fmt.Sprintf("Failed to write restore journal %s", statePath), "error", err)
+			return exitOutputError
+		}
+	}
+	// a fresh raw image is given its final size up front, unless it is to
+	// be kept as written
+	if file, ok := rawImageFile(outfile_descriptor); ok && journaled && completed == nil && !*in.o.noPreallocate && !*in.o.noTruncate {
+		if size := outSize; size > 0 {
+			fmt.Fprintf(in.progress, "Preallocating %s for %s\n", formatBytes(size), outfile)
+			if err := preallocate(file, size); errors.Is(err, syscall.ENOSPC) {
+				fmt.Fprintf(in.out, "Not enough space for %s, the image needs %s\n", outfile, formatBytes(size))
+				outfile_descriptor.Close()
+				os.Remove(outfile)
+				os.Remove(statePath)
+				return exitOutputError
+			} else if err != nil {
+				fmt.Fprintf(in.progress, "Could not preallocate %s, continuing without: %s\n", outfile, err)
+			}
+		}
+	}
+	// the image is synced at each -fsync-interval, along with a checkpoint
+	// of the journal, so a crash resumes from what reached the disk
+	syncer, _ := outfile_descriptor.(interface{ Sync() error })
+	if !in.fsync.enabled() {
+		syncer = nil
+	}
+	var image io.WriterAt = outfile_descriptor
+	if syncer != nil {
+		checkpoint := syncer.Sync
+		if journal != nil {
+			checkpoint = journal.Checkpoint
+		}
+		image = newSyncedWriter(outfile_descriptor, in.fsync, checkpoint)
+	}
+	syncFailed := func(err error) int {
+		failed(err)
+		in.log.Error(fmt.Sprintf("Failed to sync output file %s", outfile), "error", err)
+		outfile_descriptor.Close()
+		return exitOutputError
 	}
-	superblock, err := readSuperblock(outfile_descriptor)
+	repackOpts := backupstore.RepackOptions{
+		Jobs:               *in.o.jobs,
+		LegacyPasses:       *in.o.legacyPasses,
+		VolumeSize:         volumeBackup.Size,
+		Strict:             *in.o.strict,
+		NoSparse:           *in.o.noSparse,
+		Completed:          completed,
+		Logger:             in.log,
+		Progress:           &repackProgress{w: in.progress, level: in.level, events: in.events, throttles: in.throttles, metrics: metrics},
+		Cache:              in.cache,
+		WriteBatch:         in.writeBatch,
+		Memory:             in.memory,
+		OnChecksumMismatch: in.onMismatch,
+		OnMissingBlock:     in.onMissing,
+		Damaged:            damaged,
+		Stats:              stats,
+	}
+	if journal != nil {
+		repackOpts.Journal = journal
+	}
+	// a write waits for the limit before it is made, so an interrupted
+	// restore finishes the writes in flight
+	err = backupstore.Repack(in.ctx, in.store, volumeBackup.BackupPath, backups, backupstore.LimitWriterAt(image, in.writeLimit), repackOpts)
 	if err != nil {
-		fmt.Printf("Failed to read superblock. This tool only works with ext4 filesystems. The raw filesystem has been created, but you may need to resize the filesystem or extend the physical data with zeroes.\n")
-		os.Exit(1)
-	}
-	fmt.Printf("Superblock: %d blocks of size %d\n", superblock.TotalBlocks, superblock.BlockSize)
-	fmt.Printf("Total size of backup: %d\n", superblock.TotalBlocks*superblock.BlockSize)
-	fmt.Println("Truncating block file")
-	outfile_descriptor.Truncate(int64(superblock.TotalBlocks * superblock.BlockSize))
-	fmt.Println("Restore Complete. Filesystem can now be mounted")
-	fmt.Printf("Run 'sudo mount -o loop %s /mointpoint' to mount the image", *outfile)
+		failed(err)
+		// the journal syncs the image before recording what it holds
+		var hint []any
+		if journal != nil && journal.Close() == nil {
+			hint = []any{"hint", "Run again with -resume to continue from the last checkpoint"}
+		}
+		var interrupted *backupstore.InterruptedError
+		if errors.As(err, &interrupted) {
+			in.log.Error(fmt.Sprintf("Restore interrupted after %d of %d blocks", interrupted.Restored, interrupted.Total), hint...)
+		} else {
+			in.log.Error("Restore failed", append([]any{"error", err}, hint...)...)
+		}
+		outfile_descriptor.Close()
+		return exitCode(err)
+	}
+	if journal != nil {
+		// everything is restored, so a failure from here on only needs
+		// the sizing redone
+		if err := journal.Close(); err != nil {
+			in.log.Warn("Failed to checkpoint restore journal", "error", err)
+		}
+	}
+	// the size probed before the restore is checked against the image as
+	// written, in case its first block was damaged or tolerated
+	size := planned
+	switch {
+	case probeErr != nil:
+		in.log.Warn("Could not size the image", "error", probeErr)
+	case len(final) == 0:
+		// an empty image has no first block to check
+		fmt.Fprintf(in.out, "Total size of backup: %d\n", size)
+	default:
+		if written, _, err := imageSize(outfile_descriptor, volumeBackup.Size, in.progress); err != nil {
+			in.log.Warn(fmt.Sprintf("could not size the image as written: %s", err))
+		} else if written != planned {
+			in.log.Warn(fmt.Sprintf("the image as written is %d bytes, not the %d bytes probed before the restore", written, planned))
+		}
+		fmt.Fprintf(in.out, "Total size of backup: %d\n", size)
+	}
+	// a success is only reported once the image is on disk, sized or not
+	if syncer != nil {
+		if err := syncer.Sync(); err != nil {
+			return syncFailed(err)
+		}
+	}
+	if !*in.o.noTruncate {
+		if in.padSize > 0 {
+			size = in.padSize
+			fmt.Fprintf(in.progress, "Padding block file to %d bytes\n", size)
+		} else {
+			fmt.Fprintln(in.progress, "Truncating block file")
+		}
+		if err := outfile_descriptor.Truncate(size); err != nil {
+			failed(err)
+			in.log.Error(fmt.Sprintf("Failed to truncate output file %s", outfile), "error", err)
+			outfile_descriptor.Close()
+			return exitOutputError
+		}
+		if syncer != nil {
+			if err := syncer.Sync(); err != nil {
+				return syncFailed(err)
+			}
+		}
+	}
+	if *in.o.verify {
+		verifySize := size
+		if *in.o.noTruncate {
+			verifySize = -1
+		}
+		checked, mismatches := verifyRestore(in.store, volumeBackup.BackupPath, backups, outfile_descriptor, verifySize, restoreOptions{
+			Jobs:      *in.o.jobs,
+			Progress:  in.progress,
+			Verbosity: in.level,
+			Cache:     in.cache,
+			Memory:    in.memory,
+			Throttles: in.throttles,
+		})
+		printVerifyReport(in.out, checked, mismatches)
+		if len(mismatches) > 0 {
+			failed(fmt.Errorf("verification found %d mismatches", len(mismatches)))
+			outfile_descriptor.Close()
+			in.log.Error(fmt.Sprintf("Verification failed, %s does not match the backup", outfile))
+			return exitVerifyFailed
+		}
+	}
+	if err := outfile_descriptor.Close(); err != nil {
+		failed(err)
+		in.log.Error(fmt.Sprintf("Failed to finish output file %s", outfile), "error", err)
+		return exitOutputError
+	}
+	if journal != nil {
+		os.Remove(statePath)
+	}
+	printBufferStats(in.out, in.cache, in.memory)
+	printThrottleStats(in.out, in.throttles)
+	printRestoreSummary(in.out, stats)
+	printDamageReport(in.out, damaged.Blocks())
+	in.events.complete(size, nil)
+	in.written = size
+	manifest.Status, manifest.Size = backupstore.ManifestComplete, size
+	switch {
+	case len(final) == 0:
+		fmt.Fprintln(in.out, "Restore Complete. The image is empty, as the volume contains no data")
+	case contents == luksType:
+		fmt.Fprintln(in.out, "Restore Complete. The image is an encrypted volume (LUKS)")
+	case contents == lvmPVType:
+		fmt.Fprintln(in.out, "Restore Complete. The image contains an LVM physical volume")
+	default:
+		fmt.Fprintln(in.out, "Restore Complete. Filesystem can now be mounted")
+	}
+	switch {
+	case *in.o.mount != "" && len(final) > 0:
+		if code := mountRestored(in.out, in.log, outfile, *in.o.mount, !*in.o.mountRW); code != 0 {
+			return code
+		}
+	case len(final) > 0:
+		fmt.Fprintln(in.out, mountHint(runtime.GOOS, *in.o.outputFormat, contents, outfile))
+	}
+	return damageExitCode(damaged)
 }
@@ -1,242 +1,336 @@
 package main
 
 import (
-	"compress/gzip"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
 	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
-	"github.com/pierrec/lz4/v4"
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
 )
 
-func TestFindVolumeBackupPath(t *testing.T) {
-	tmpDir := t.TempDir()
-	volumePath := filepath.Join(tmpDir, "volumes", "ab", "cd", "volume1")
-	err := os.MkdirAll(volumePath, 0755)
-	if err != nil {
-		t.Fatal(err)
+func TestLatestBackup(t *testing.T) {
+	backups := []backupstore.Backup{
+		{Identifier: "oldest"},
+		{Identifier: "middle"},
+		{Identifier: "newest"},
+	}
+
+	selected := latestBackup(backups)
+	if len(selected) != 1 {
+		t.Fatalf("Expected 1 backup, got %d", len(selected))
+	}
+	if selected[0].Identifier != "newest" {
+		t.Errorf("Expected newest, got %s", selected[0].Identifier)
+	}
+
+	if len(latestBackup(nil)) != 0 {
+		t.Error("Expected no backups for empty input")
+	}
+}
+
+func TestSelectBackup(t *testing.T) {
+	backups := []backupstore.Backup{
+		{Identifier: "backup-1111111", ConfigPath: "/store/backups/backup_backup-1111111.cfg"},
+		{Identifier: "backup-7c2a91e", ConfigPath: "/store/backups/backup_backup-7c2a91e.cfg"},
+		// the name in the cfg file wins over the name of the file
+		{Identifier: "backup-5d0e3b4", ConfigPath: "/store/backups/backup_copy.cfg"},
 	}
 
 	tests := []struct {
 		name          string
-		backupStore   string
-		volumeName    string
-		expectedPath  string
+		backupName    string
+		expectedID    string
 		expectedError bool
 	}{
 		{
-			name:          "Valid volume backup",
-			backupStore:   tmpDir,
-			volumeName:    "volume1",
-			expectedPath:  volumePath,
-			expectedError: false,
+			name:       "Backup name",
+			backupName: "backup-7c2a91e",
+			expectedID: "backup-7c2a91e",
+		},
+		{
+			name:       "Cfg basename",
+			backupName: "backup_backup-7c2a91e.cfg",
+			expectedID: "backup-7c2a91e",
+		},
+		{
+			name:       "Cfg basename without extension",
+			backupName: "backup_backup-1111111",
+			expectedID: "backup-1111111",
 		},
 		{
-			name:          "Non-existent volume",
-			backupStore:   tmpDir,
-			volumeName:    "nonexistent",
-			expectedPath:  "",
+			name:       "Name from the cfg file",
+			backupName: "backup-5d0e3b4",
+			expectedID: "backup-5d0e3b4",
+		},
+		{
+			name:       "Renamed cfg file",
+			backupName: "copy",
+			expectedID: "backup-5d0e3b4",
+		},
+		{
+			name:          "Unknown backup",
+			backupName:    "backup-nonexistent",
 			expectedError: true,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			path, err := findVolumeBackupPath(tt.backupStore, tt.volumeName)
-			if tt.expectedError && err == nil {
-				t.Error("Expected error but got none")
+			selected, err := selectBackup(backups, tt.backupName)
+			if tt.expectedError {
+				if err == nil {
+					t.Error("Expected error but got none")
+				}
+				return
 			}
-			if !tt.expectedError && err != nil {
-				t.Errorf("Unexpected error: %v", err)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
 			}
-			if path != tt.expectedPath {
-				t.Errorf("Expected path %s, got %s", tt.expectedPath, path)
+			if len(selected) != 1 || selected[0].Identifier != tt.expectedID {
+				t.Errorf("Expected %s, got %v", tt.expectedID, selected)
 			}
 		})
 	}
 }
 
-func TestReadBackups(t *testing.T) {
-	tmpDir := t.TempDir()
-	backupsDir := filepath.Join(tmpDir, "backups")
-	err := os.MkdirAll(backupsDir, 0755)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	// Create mock backup config file
-	mockConfig := `{
-        "CreatedTime": "2023-01-01T00:00:00Z",
-        "Size": "1024",
-        "CompressionMethod": "lz4",
-        "Blocks": [
-            {
-                "Offset": 0,
-                "BlockChecksum": "test123"
-            }
-        ]
-    }`
-
-	err = os.WriteFile(filepath.Join(backupsDir, "backup1.cfg"), []byte(mockConfig), 0644)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	volumeBackup, err := readBackups(tmpDir)
-	if err != nil {
-		t.Errorf("Expected no error, got %v", err)
-	}
-
-	if volumeBackup == nil {
-		t.Fatal("Expected non-nil VolumeBackup")
-	}
-
-	if len(volumeBackup.Backups) != 1 {
-		t.Errorf("Expected 1 backup, got %d", len(volumeBackup.Backups))
-	}
-}
-
-func TestResolveBlockPath(t *testing.T) {
-	// Create temporary test directory with mock block
-	tmpDir := t.TempDir()
-	blocksDir := filepath.Join(tmpDir, "blocks", "ab", "cd")
-	err := os.MkdirAll(blocksDir, 0755)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	mockBlockPath := filepath.Join(blocksDir, "testchecksum.blk")
-	err = os.WriteFile(mockBlockPath, []byte("test"), 0644)
-	if err != nil {
-		t.Fatal(err)
-	}
-
+func TestParseBeforeTime(t *testing.T) {
 	tests := []struct {
 		name          string
-		backupPath    string
-		checksum      string
+		value         string
+		expected      time.Time
 		expectedError bool
 	}{
 		{
-			name:          "Valid block",
-			backupPath:    tmpDir,
-			checksum:      "testchecksum",
-			expectedError: false,
+			name:     "RFC3339 timestamp",
+			value:    "2024-03-01T12:30:00Z",
+			expected: time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC),
 		},
 		{
-			name:          "Non-existent block",
-			backupPath:    tmpDir,
-			checksum:      "nonexistent",
+			name:     "Date only",
+			value:    "2024-03-01",
+			expected: time.Date(2024, 3, 1, 23, 59, 59, 999999999, time.UTC),
+		},
+		{
+			name:          "Garbage",
+			value:         "last tuesday",
 			expectedError: true,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			_, err := resolveBlockPath(tt.backupPath, tt.checksum)
+			parsed, err := parseBeforeTime(tt.value)
 			if tt.expectedError && err == nil {
 				t.Error("Expected error but got none")
 			}
 			if !tt.expectedError && err != nil {
 				t.Errorf("Unexpected error: %v", err)
 			}
+			if !parsed.Equal(tt.expected) {
+				t.Errorf("Expected %s, got %s", tt.expected, parsed)
+			}
 		})
 	}
 }
 
-func TestWriteBlockToBuffer(t *testing.T) {
-	tmpFile, err := os.CreateTemp("", "test-write-block")
-	if err != nil {
-		t.Fatal(err)
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		value         string
+		expected      int64
+		expectedError bool
+	}{
+		{value: "1073741824", expected: 1 << 30},
+		{value: "20GiB", expected: 20 << 30},
+		{value: "512M", expected: 512 << 20},
+		{value: "10GB", expected: 10e9},
+		{value: "4096B", expected: 4096},
+		{value: "1.5GiB", expectedError: true},
+		{value: "0", expectedError: true},
+		{value: "-1G", expectedError: true},
+		{value: "GiB", expectedError: true},
+		{value: "9999999TiB", expectedError: true},
 	}
-	defer os.Remove(tmpFile.Name())
-	defer tmpFile.Close()
 
-	testData := []byte("test data")
-	writeBlockToBuffer(testData, 10, tmpFile)
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			size, err := parseByteSize(tt.value)
+			if tt.expectedError {
+				if err == nil {
+					t.Errorf("Expected error but got %d", size)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if size != tt.expected {
+				t.Errorf("Expected %d, got %d", tt.expected, size)
+			}
+		})
+	}
+}
 
-	// Verify written data
-	tmpFile.Seek(10, 0)
-	readData := make([]byte, len(testData))
-	_, err = tmpFile.Read(readData)
-	if err != nil {
-		t.Fatal(err)
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		value         string
+		expected      int64
+		expectedError bool
+	}{
+		{value: "100MiB/s", expected: 100 << 20},
+		{value: "100MiB", expected: 100 << 20},
+		{value: "1048576/s", expected: 1 << 20},
+		{value: "0/s", expectedError: true},
+		{value: "/s", expectedError: true},
 	}
 
-	if string(readData) != string(testData) {
-		t.Errorf("Expected %s, got %s", string(testData), string(readData))
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			rate, err := parseRate(tt.value)
+			if tt.expectedError {
+				if err == nil {
+					t.Errorf("Expected error but got %d", rate)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if rate != tt.expected {
+				t.Errorf("Expected %d, got %d", tt.expected, rate)
+			}
+		})
 	}
 }
 
-func TestDecompression(t *testing.T) {
-	test_string := "hello world"
-	r := strings.NewReader(test_string)
-
-	pr, pw := io.Pipe()
-	zw := lz4.NewWriter(pw)
-	defer zw.Close()
-
-	go func() {
-		_, _ = io.Copy(zw, r)
-		_ = zw.Close()
-		_ = pw.Close()
-	}()
-
-	compressed_data_lz4, _ := io.ReadAll(pr)
-
-	pr2, pw2 := io.Pipe()
-	zw2 := gzip.NewWriter(pw2)
-	r2 := strings.NewReader(test_string)
+func TestFilterBackupsBefore(t *testing.T) {
+	backups := []backupstore.Backup{
+		{Identifier: "a", Timestamp: time.Date(2024, 2, 27, 0, 0, 0, 0, time.UTC)},
+		{Identifier: "b", Timestamp: time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)},
+		{Identifier: "c", Timestamp: time.Date(2024, 3, 2, 8, 0, 0, 0, time.UTC)},
+	}
 
-	go func() {
-		_, _ = io.Copy(zw2, r2)
-		zw2.Close()
-		pw2.Close()
-	}()
+	filtered := filterBackupsBefore(backups, time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC))
+	if len(filtered) != 2 {
+		t.Fatalf("Expected 2 backups, got %d", len(filtered))
+	}
+	if filtered[1].Identifier != "b" {
+		t.Errorf("Expected b, got %s", filtered[1].Identifier)
+	}
 
-	compressed_data_gzip, _ := io.ReadAll(pr2)
+	if len(filterBackupsBefore(backups, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))) != 0 {
+		t.Error("Expected no backups before 2020")
+	}
+}
 
-	t.Log(string(compressed_data_gzip))
+func TestConfirmOverwrite(t *testing.T) {
 	tests := []struct {
-		name          string
-		data          []byte
-		compression   string
-		expectedError bool
+		name     string
+		input    string
+		expected int
+		output   string
 	}{
-		{
-			name:          "Decompress LZ4",
-			data:          compressed_data_lz4,
-			compression:   "lz4",
-			expectedError: false,
-		},
-
-		{
-			name:          "Decompress GZIP",
-			data:          compressed_data_gzip,
-			compression:   "gzip",
-			expectedError: false,
-		},
+		{"y", "y\n", 0, ""},
+		{"upper case", "Y\n", 0, ""},
+		{"yes", "yes\n", 0, ""},
+		{"windows console", "Yes\r\n", 0, ""},
+		{"no trailing newline", "y", 0, ""},
+		{"no", "n\n", exitOutputError, "Aborting"},
+		{"empty line", "\n", exitOutputError, "Aborting"},
+		{"closed stdin", "", exitOutputError, "refusing to overwrite image.raw without -yes"},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			decompressed_data, err := decompressLZ4(tt.data)
-			if tt.compression == "gzip" {
-				decompressed_data, err = decompressGZIP(tt.data)
-			} else if tt.compression == "lz4" {
-				decompressed_data, err = decompressLZ4(tt.data)
-			}
-			if tt.expectedError && err == nil {
-				t.Error("Expected error but got none")
-			}
-			if !tt.expectedError && err != nil {
-				t.Errorf("Unexpected error: %v", err)
+			var out bytes.Buffer
+			code := confirmOverwrite(bufio.NewReader(strings.NewReader(tt.input)), true, &out, "image.raw")
+			if code != tt.expected {
+				t.Errorf("Expected exit status %d, got %d", tt.expected, code)
 			}
-			if string(decompressed_data) != test_string {
-				t.Errorf("Expected '%s', got '%s'", test_string, string(decompressed_data))
+			if !strings.Contains(out.String(), tt.output) {
+				t.Errorf("Expected %q in the output, got %q", tt.output, out.String())
 			}
 		})
 	}
 }
+
+func TestConfirmOverwriteNotInteractive(t *testing.T) {
+	// a closed pipe, as stdin is under cron or in a pod
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	w.Close()
+	if isInteractive(r, os.Stdout) {
+		t.Fatalf("Expected a pipe not to be interactive")
+	}
+
+	answers := bufio.NewReader(strings.NewReader("y\n"))
+	var out bytes.Buffer
+	if code := confirmOverwrite(answers, false, &out, "image.raw"); code != exitOutputError {
+		t.Errorf("Expected exit status %d, got %d", exitOutputError, code)
+	}
+	if !strings.Contains(out.String(), "-yes") || !strings.Contains(out.String(), "-no-clobber") {
+		t.Errorf("Expected the error to name -yes and -no-clobber, got %q", out.String())
+	}
+	if response, _ := readAnswer(answers); response != "y" {
+		t.Errorf("Expected nothing to be read from stdin, got %q left", response)
+	}
+}
+
+func TestRestoreManifest(t *testing.T) {
+	restore := func(ctx context.Context) (int, backupstore.Manifest) {
+		flags := flag.NewFlagSet("test", flag.ContinueOnError)
+		o := defineFlags(flags)
+		repack, _ := lookupCommand("repack")
+		in := &invocation{
+			o:               o,
+			cmd:             &repack,
+			store:           os.DirFS("testdata/restore/backupstore"),
+			backupStorePath: "testdata/restore/backupstore",
+			progress:        io.Discard,
+			level:           verbosityQuiet,
+			out:             io.Discard,
+			log:             newLogger(io.Discard, "text", slog.LevelInfo),
+			ctx:             ctx,
+		}
+		outfile := filepath.Join(t.TempDir(), "pvc-fixture.img")
+		code := in.run("pvc-fixture", outfile)
+		data, err := os.ReadFile(backupstore.ManifestPath(outfile))
+		if err != nil {
+			t.Fatalf("Expected a manifest next to the image, got %v", err)
+		}
+		var manifest backupstore.Manifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return code, manifest
+	}
+
+	code, manifest := restore(t.Context())
+	if code != 0 || manifest.Status != backupstore.ManifestComplete {
+		t.Fatalf("Expected a complete restore, got exit code %d and %s", code, manifest.Status)
+	}
+	if manifest.Volume != "pvc-fixture" || len(manifest.Backups) != 1 || manifest.Backups[0].Name != "backup-1" {
+		t.Errorf("Expected backup-1 of pvc-fixture, got %s and %+v", manifest.Volume, manifest.Backups)
+	}
+	if manifest.Blocks.Read != 2 || manifest.Size != 8192 || manifest.Tool.Version != version {
+		t.Errorf("Expected 2 blocks read into 8192 bytes by version %s, got %+v", version, manifest)
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	code, manifest = restore(ctx)
+	if code != exitInterrupted || manifest.Status != backupstore.ManifestCancelled || manifest.Error == "" {
+		t.Errorf("Expected a cancelled restore with its error, got exit code %d, %s and %q", code, manifest.Status, manifest.Error)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+)
+
+// restoreMetric is a metric of each restore, from its stats
+type restoreMetric struct {
+	name  string
+	kind  string
+	help  string
+	value func(t *targetMetrics, stats *backupstore.RepackStats) float64
+}
+
+var restoreMetrics = []restoreMetric{
+	{"lhbr_bytes_written_total", "counter", "Bytes written to the image.", func(t *targetMetrics, stats *backupstore.RepackStats) float64 {
+		return float64(stats.BytesWritten)
+	}},
+	{"lhbr_bytes_decompressed_total", "counter", "Bytes the blocks read decompressed to.", func(t *targetMetrics, stats *backupstore.RepackStats) float64 {
+		return float64(stats.BytesDecompressed)
+	}},
+	{"lhbr_blocks_read_total", "counter", "Blocks read from the store or the cache and decompressed.", func(t *targetMetrics, stats *backupstore.RepackStats) float64 {
+		return float64(stats.BlocksRead)
+	}},
+	{"lhbr_blocks_skipped_total", "counter", "Blocks not needed, as a newer backup or an earlier run had written their offset.", func(t *targetMetrics, stats *backupstore.RepackStats) float64 {
+		return float64(stats.BlocksSkipped)
+	}},
+	{"lhbr_checksum_mismatches_total", "counter", "Blocks that failed their checksum and were written or skipped.", func(t *targetMetrics, stats *backupstore.RepackStats) float64 {
+		return float64(stats.ChecksumMismatches)
+	}},
+	{"lhbr_missing_blocks_total", "counter", "Blocks missing from the store that were zero-filled.", func(t *targetMetrics, stats *backupstore.RepackStats) float64 {
+		return float64(stats.MissingBlocks)
+	}},
+	{"lhbr_pass", "gauge", "The pass of the restore, one per backup applied.", func(t *targetMetrics, stats *backupstore.RepackStats) float64 {
+		return float64(t.pass)
+	}},
+	{"lhbr_passes", "gauge", "The passes the restore takes.", func(t *targetMetrics, stats *backupstore.RepackStats) float64 {
+		return float64(t.passes)
+	}},
+	{"lhbr_throughput_bytes_per_second", "gauge", "Bytes decompressed per second since the restore started.", func(t *targetMetrics, stats *backupstore.RepackStats) float64 {
+		if stats.Elapsed > 0 {
+			return stats.Throughput()
+		}
+		return float64(stats.BytesDecompressed) / time.Since(t.started).Seconds()
+	}},
+}
+
+// metricsRegistry has the restores of a run, for -metrics-listen to
+// expose in the Prometheus text format. A nil registry tracks nothing.
+type metricsRegistry struct {
+	// store is asked for its retries as they happen, as the restores
+	// only count them once they are done
+	store   fs.FS
+	mu      sync.Mutex
+	targets []*targetMetrics
+}
+
+// targetMetrics is the restore of a target, labelled with its volume
+type targetMetrics struct {
+	registry *metricsRegistry
+	volume   string
+	stats    *backupstore.RepackStats
+	started  time.Time
+	// pass and passes are guarded by the mutex of registry
+	pass, passes int
+}
+
+func newMetricsRegistry(store fs.FS) *metricsRegistry {
+	return &metricsRegistry{store: store}
+}
+
+// track adds the restore of volume, which counts into stats
+func (m *metricsRegistry) track(volume string, stats *backupstore.RepackStats) *targetMetrics {
+	if m == nil {
+		return nil
+	}
+	t := &targetMetrics{registry: m, volume: volume, stats: stats, started: time.Now()}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.targets = append(m.targets, t)
+	return t
+}
+
+// startPass records the pass the restore is on
+func (t *targetMetrics) startPass(pass, totalPasses int) {
+	if t == nil {
+		return
+	}
+	t.registry.mu.Lock()
+	defer t.registry.mu.Unlock()
+	t.pass, t.passes = pass, totalPasses
+}
+
+// write writes every metric of every restore, and the retries of the
+// store, in the Prometheus text format
+func (m *metricsRegistry) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := make([]backupstore.RepackStats, len(m.targets))
+	for i, t := range m.targets {
+		stats[i] = t.stats.Snapshot()
+	}
+	for _, metric := range restoreMetrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.kind)
+		for i, t := range m.targets {
+			fmt.Fprintf(w, "%s{volume=%s} %s\n", metric.name, strconv.Quote(t.volume), strconv.FormatFloat(metric.value(t, &stats[i]), 'g', -1, 64))
+		}
+	}
+	var retries int64
+	if retrying, ok := m.store.(backupstore.RetryingFS); ok {
+		retries = retrying.Retries()
+	}
+	fmt.Fprintf(w, "# HELP lhbr_retries_total Requests to the store that were retried.\n# TYPE lhbr_retries_total counter\n")
+	fmt.Fprintf(w, "lhbr_retries_total %d\n", retries)
+}
+
+func (m *metricsRegistry) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		var b strings.Builder
+		m.write(&b)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		io.WriteString(w, b.String())
+	})
+	return mux
+}
+
+// serve answers /metrics on listen until the process exits, so the
+// final values can be scraped until then
+func (m *metricsRegistry) serve(listen string) (net.Addr, error) {
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{Handler: m.handler(), ReadHeaderTimeout: 30 * time.Second}
+	go srv.Serve(listener)
+	return listener.Addr(), nil
+}
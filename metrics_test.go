@@ -0,0 +1,104 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// gatedFS lets the first block file be opened, and holds the others until
+// release is closed
+type gatedFS struct {
+	fs.FS
+	blocks  atomic.Int32
+	release chan struct{}
+}
+
+func (g *gatedFS) Open(name string) (fs.File, error) {
+	if strings.HasSuffix(name, ".blk") && g.blocks.Add(1) > 1 {
+		<-g.release
+	}
+	return g.FS.Open(name)
+}
+
+// Stat isn't held, so the blocks can be checked before they are read
+func (g *gatedFS) Stat(name string) (fs.FileInfo, error) { return fs.Stat(g.FS, name) }
+
+func TestMetricsMidRestore(t *testing.T) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	o := defineFlags(flags)
+	repack, _ := lookupCommand("repack")
+	store := &gatedFS{FS: os.DirFS("testdata/restore/backupstore"), release: make(chan struct{})}
+	metrics := newMetricsRegistry(store)
+	in := &invocation{
+		o:               o,
+		cmd:             &repack,
+		store:           store,
+		backupStorePath: "testdata/restore/backupstore",
+		progress:        io.Discard,
+		level:           verbosityQuiet,
+		metrics:         metrics,
+		out:             io.Discard,
+		log:             newLogger(io.Discard, "text", slog.LevelInfo),
+		ctx:             t.Context(),
+	}
+	done := make(chan int)
+	go func() {
+		done <- in.run("pvc-fixture", filepath.Join(t.TempDir(), "pvc-fixture.img"))
+	}()
+	released := false
+	defer func() {
+		if !released {
+			close(store.release)
+		}
+	}()
+
+	ts := httptest.NewServer(metrics.handler())
+	defer ts.Close()
+	var body string
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		resp, err := ts.Client().Get(ts.URL + "/metrics")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		body = string(data)
+		if strings.Contains(body, `lhbr_pass{volume="pvc-fixture"} 1`) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the restore to be on its first pass, got:\n%s", body)
+		}
+	}
+	for _, name := range []string{
+		"lhbr_bytes_written_total",
+		"lhbr_blocks_read_total",
+		"lhbr_blocks_skipped_total",
+		"lhbr_checksum_mismatches_total",
+		"lhbr_retries_total",
+		"lhbr_pass",
+		"lhbr_throughput_bytes_per_second",
+	} {
+		if !strings.Contains(body, "\n"+name+"{") && !strings.Contains(body, "\n"+name+" ") {
+			t.Errorf("Expected metric %s mid-restore, got:\n%s", name, body)
+		}
+	}
+
+	close(store.release)
+	released = true
+	if code := <-done; code != 0 {
+		t.Errorf("Expected the restore to succeed, got exit code %d", code)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// mountTypes are the kernel filesystem types -mount mounts the filesystems
+// probeFilesystem finds as
+var mountTypes = map[string]string{
+	"ext4":  "ext4",
+	"xfs":   "xfs",
+	"btrfs": "btrfs",
+	"ntfs":  "ntfs3",
+}
+
+// readOnlyMountData keeps a read-only mount from replaying the journal of
+// a backup taken while the volume was in use, which would have to write to
+// the read-only loop device
+var readOnlyMountData = map[string]string{
+	"ext4":  "noload",
+	"xfs":   "norecovery",
+	"btrfs": "nologreplay",
+}
+
+// mountOptions returns the kernel filesystem type and mount data to mount
+// a filesystem of the type probeFilesystem found with, and false if -mount
+// can't mount it
+func mountOptions(filesystem string, readOnly bool) (string, string, bool) {
+	fstype, ok := mountTypes[filesystem]
+	if !ok {
+		return "", "", false
+	}
+	if !readOnly {
+		return fstype, "", true
+	}
+	return fstype, readOnlyMountData[filesystem], true
+}
+
+// mountRestored mounts the filesystem of the restored image outfile at
+// dir for -mount, and returns the exit status
+func mountRestored(out io.Writer, logger *slog.Logger, outfile, dir string, readOnly bool) int {
+	f, err := os.Open(outfile)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to open %s to mount it", outfile), "error", err)
+		return exitOutputError
+	}
+	filesystem, err := probeFilesystem(f)
+	f.Close()
+	fstype, data, ok := mountOptions(filesystem.Type, readOnly)
+	if err != nil || !ok {
+		logger.Error(fmt.Sprintf("Not mounting %s, as it holds no ext4, XFS, btrfs or NTFS filesystem", outfile))
+		return exitFailure
+	}
+
+	device, err := mountImage(outfile, dir, fstype, data, readOnly)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to mount %s at %s", outfile, dir), "error", err)
+		return exitFailure
+	}
+	mode := "read-write"
+	if readOnly {
+		mode = "read-only"
+	}
+	fmt.Fprintf(out, "Mounted %s %s at %s using %s\n", outfile, mode, dir, device)
+	fmt.Fprintf(out, "Run 'umount %s' to unmount it, which detaches %s as well\n", dir, device)
+	return 0
+}
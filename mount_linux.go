@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// mountSupported is whether -mount can set up loop devices here
+const mountSupported = true
+
+// mountImage attaches image to a free loop device, read-only unless
+// readOnly is false, and mounts the filesystem on it at dir, returning the
+// device. The device detaches itself once the filesystem is unmounted, and
+// is detached at once if the mount fails.
+func mountImage(image, dir, fstype, data string, readOnly bool) (string, error) {
+	mode := os.O_RDWR
+	var flags uintptr
+	if readOnly {
+		mode, flags = os.O_RDONLY, unix.MS_RDONLY
+	}
+	backing, err := os.OpenFile(image, mode, 0)
+	if err != nil {
+		return "", err
+	}
+	defer backing.Close()
+	control, err := os.OpenFile("/dev/loop-control", os.O_RDWR, 0)
+	if err != nil {
+		return "", err
+	}
+	defer control.Close()
+
+	// another process can take the free device before image is attached
+	// to it, so a few are tried
+	for range 5 {
+		n, err := unix.IoctlRetInt(int(control.Fd()), unix.LOOP_CTL_GET_FREE)
+		if err != nil {
+			return "", fmt.Errorf("failed to find a free loop device: %w", err)
+		}
+		device := fmt.Sprintf("/dev/loop%d", n)
+		loop, err := os.OpenFile(device, mode, 0)
+		if err != nil {
+			return "", err
+		}
+		err = unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_SET_FD, int(backing.Fd()))
+		if errors.Is(err, unix.EBUSY) {
+			loop.Close()
+			continue
+		}
+		if err != nil {
+			loop.Close()
+			return "", fmt.Errorf("failed to attach %s to %s: %w", image, device, err)
+		}
+		err = mountLoop(loop, image, dir, fstype, data, flags)
+		if err != nil {
+			unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_CLR_FD, 0)
+			loop.Close()
+			return "", fmt.Errorf("%s on %s: %w", fstype, device, err)
+		}
+		loop.Close()
+		return device, nil
+	}
+	return "", errors.New("no loop device was free")
+}
+
+// mountLoop mounts the filesystem of the loop device loop, which image is
+// attached to, at dir
+func mountLoop(loop *os.File, image, dir, fstype, data string, flags uintptr) error {
+	info := unix.LoopInfo64{Flags: unix.LO_FLAGS_AUTOCLEAR}
+	name, _ := filepath.Abs(image)
+	copy(info.File_name[:len(info.File_name)-1], name)
+	if err := unix.IoctlLoopSetStatus64(int(loop.Fd()), &info); err != nil {
+		return err
+	}
+	return unix.Mount(loop.Name(), dir, fstype, flags, data)
+}
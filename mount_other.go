@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// mountSupported is whether -mount can set up loop devices here
+const mountSupported = false
+
+func mountImage(image, dir, fstype, data string, readOnly bool) (string, error) {
+	return "", errors.ErrUnsupported
+}
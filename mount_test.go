@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestMountOptions(t *testing.T) {
+	tests := []struct {
+		filesystem string
+		readOnly   bool
+		fstype     string
+		data       string
+		ok         bool
+	}{
+		{"ext4", true, "ext4", "noload", true},
+		{"ext4", false, "ext4", "", true},
+		{"xfs", true, "xfs", "norecovery", true},
+		{"btrfs", true, "btrfs", "nologreplay", true},
+		{"ntfs", true, "ntfs3", "", true},
+		{"ntfs", false, "ntfs3", "", true},
+		{luksType, true, "", "", false},
+		{lvmPVType, true, "", "", false},
+		{"", true, "", "", false},
+	}
+
+	for _, tt := range tests {
+		fstype, data, ok := mountOptions(tt.filesystem, tt.readOnly)
+		if fstype != tt.fstype || data != tt.data || ok != tt.ok {
+			t.Errorf("Expected %q, %q and %v for %q, got %q, %q and %v", tt.fstype, tt.data, tt.ok, tt.filesystem, fstype, data, ok)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	nfsAttempts = 4
+	// reads are issued in ranges of this size so a timeout only repeats
+	// part of a block
+	nfsReadSize = 1024 * 1024
+)
+
+// nfsConn is the part of an NFS session the backend needs
+type nfsConn interface {
+	stat(name string) (fs.FileInfo, error)
+	readDir(name string) ([]fs.FileInfo, error)
+	readAt(name string, p []byte, off int64) (int, error)
+	Close() error
+}
+
+// nfsStore reads a backupstore over NFSv3 without mounting it. Calls on a
+// connection can't be multiplexed, so requests are serialized, and the
+// connection is replaced whenever a call fails in a way a retry might fix.
+type nfsStore struct {
+	retryCounter
+	mu      sync.Mutex
+	ctx     context.Context
+	dial    func() (nfsConn, error)
+	conn    nfsConn
+	url     string
+	backoff time.Duration
+}
+
+// parseNFSURL accepts Longhorn's nfs://server:/export/path form, as well as
+// nfs://server/export/path
+func parseNFSURL(raw string) (host, export string, err error) {
+	rest, ok := strings.CutPrefix(raw, "nfs://")
+	if !ok {
+		return "", "", fmt.Errorf("not an nfs url: %s", raw)
+	}
+	// Longhorn appends mount options as ?nfsOptions=...
+	rest, _, _ = strings.Cut(rest, "?")
+	host, export, _ = strings.Cut(rest, "/")
+	host = strings.TrimSuffix(host, ":")
+	if host == "" {
+		return "", "", fmt.Errorf("missing server in %s", raw)
+	}
+	return host, path.Clean("/" + export), nil
+}
+
+func newNFSStore(ctx context.Context, backupRoot string, opts storeOptions) (*nfsStore, error) {
+	host, export, err := parseNFSURL(backupRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &nfsStore{
+		ctx: ctx,
+		dial: func() (nfsConn, error) {
+			return dialNFSClient(host, export, opts.NFSTimeout)
+		},
+		url:     "nfs://" + host + ":" + export,
+		backoff: 500 * time.Millisecond,
+	}
+	// fail early on unreachable servers and refused exports
+	if err := store.withConn(func(conn nfsConn) error { return nil }); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// nfsMountTable is where local mounts of an export are looked up
+var nfsMountTable = "/proc/self/mounts"
+
+// openNFSMount reads an nfs:// backup root through a local mount of its
+// export, for NFS versions the built-in client doesn't speak
+func openNFSMount(backupRoot string, version int) (fs.FS, string, error) {
+	host, export, err := parseNFSURL(backupRoot)
+	if err != nil {
+		return nil, "", err
+	}
+	dir, ok := findNFSMount(nfsMountTable, host, export)
+	if !ok {
+		return nil, "", fmt.Errorf("NFS version %d can only be read through a mount, and %s:%s is not mounted here: mount it and pass the mount point, or use -nfs-version 3", version, host, export)
+	}
+	backupStorePath := filepath.Join(dir, "backupstore")
+	return os.DirFS(backupStorePath), backupStorePath, nil
+}
+
+// mountEscapes undoes the octal escapes of the mount table
+var mountEscapes = strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`)
+
+// findNFSMount returns the local directory of export on host, through the
+// mount in table of the export or of the closest directory above it. The
+// server has to be named as it was when mounting.
+func findNFSMount(table, host, export string) (string, bool) {
+	data, err := os.ReadFile(table)
+	if err != nil {
+		return "", false
+	}
+	dir, matched := "", -1
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || !strings.HasPrefix(fields[2], "nfs") {
+			continue
+		}
+		server, mounted, ok := strings.Cut(mountEscapes.Replace(fields[0]), ":")
+		if !ok || server != host {
+			continue
+		}
+		mounted = path.Clean("/" + mounted)
+		rest, ok := strings.CutPrefix(export, mounted)
+		if !ok || (rest != "" && !strings.HasPrefix(rest, "/") && mounted != "/") || len(mounted) <= matched {
+			continue
+		}
+		dir, matched = filepath.Join(mountEscapes.Replace(fields[1]), filepath.FromSlash(rest)), len(mounted)
+	}
+	return dir, matched >= 0
+}
+
+func (s *nfsStore) String() string {
+	return s.url + "/backupstore"
+}
+
+// Remote implements backupstore.RemoteFS, so missing blocks aren't
+// searched for
+func (s *nfsStore) Remote() bool { return true }
+
+// nfsTransient reports errors worth another attempt on a fresh connection:
+// stale handles, a busy server and network failures or timeouts
+func nfsTransient(err error) bool {
+	var status nfsStatusError
+	if errors.As(err, &status) {
+		switch status {
+		case nfs3ErrStale, nfs3ErrBadHandle, nfs3ErrJukebox, nfs3ErrServerFail:
+			return true
+		}
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+// withConn runs op against the current connection, dialing one if needed.
+// After a transient failure the connection may hold a late reply or stale
+// cached handles, so it is dropped and redialed for the next attempt.
+func (s *nfsStore) withConn(op func(conn nfsConn) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.retryBackoff(s.ctx, nfsAttempts, s.backoff, func() error {
+		if s.conn == nil {
+			conn, err := s.dial()
+			if err != nil {
+				return err
+			}
+			s.conn = conn
+		}
+		err := op(s.conn)
+		if err != nil && nfsTransient(err) {
+			s.conn.Close()
+			s.conn = nil
+		}
+		return err
+	}, nfsTransient)
+}
+
+func (s *nfsStore) path(name string) string {
+	return path.Join("backupstore", name)
+}
+
+func (s *nfsStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+func (s *nfsStore) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	var info fs.FileInfo
+	err := s.withConn(func(conn nfsConn) error {
+		var err error
+		info, err = conn.stat(s.path(name))
+		return err
+	})
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return info, nil
+}
+
+func (s *nfsStore) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	var infos []fs.FileInfo
+	err := s.withConn(func(conn nfsConn) error {
+		var err error
+		infos, err = conn.readDir(s.path(name))
+		return err
+	})
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+
+	entries := make([]fs.DirEntry, 0, len(infos))
+	for _, info := range infos {
+		entries = append(entries, fs.FileInfoToDirEntry(info))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+func (s *nfsStore) ReadFile(name string) ([]byte, error) {
+	info, err := s.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: errors.New("is a directory")}
+	}
+
+	data := make([]byte, info.Size())
+	for off := 0; off < len(data); off += nfsReadSize {
+		chunk := data[off:min(off+nfsReadSize, len(data))]
+		err := s.withConn(func(conn nfsConn) error {
+			_, err := conn.readAt(s.path(name), chunk, int64(off))
+			return err
+		})
+		if err != nil {
+			return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+		}
+	}
+	return data, nil
+}
+
+func (s *nfsStore) Open(name string) (fs.File, error) {
+	return openRemote(s, name)
+}
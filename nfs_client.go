@@ -0,0 +1,594 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// A minimal ONC RPC (RFC 5531) client speaking just enough of the portmapper,
+// MOUNT v3 and NFSv3 (RFC 1813) to browse and read a backupstore.
+
+const (
+	rpcVersion     = 2
+	rpcMsgCall     = 0
+	rpcMsgReply    = 1
+	rpcMsgAccepted = 0
+	rpcSuccess     = 0
+	rpcAuthNone    = 0
+	rpcAuthSys     = 1
+	rpcLastFrag    = 1 << 31
+	rpcMaxRecord   = 16 * 1024 * 1024
+
+	portmapProgram = 100000
+	portmapVersion = 2
+	portmapGetPort = 3
+	ipProtoTCP     = 6
+
+	mountProgram  = 100005
+	mountVersion  = 3
+	mountProcMnt  = 1
+	mountProcUmnt = 3
+
+	nfsProgram         = 100003
+	nfsVersion3        = 3
+	nfsProcGetattr     = 1
+	nfsProcLookup      = 3
+	nfsProcRead        = 6
+	nfsProcReaddirplus = 17
+
+	nfs3TypeDir = 2
+	// largest READ issued; servers return less when their limit is lower
+	nfsMaxRead = 1024 * 1024
+)
+
+// nfsPortmapPort is a variable so tests can run a server on any port
+var nfsPortmapPort = 111
+
+type nfsStatusError uint32
+
+const (
+	nfs3Ok            nfsStatusError = 0
+	nfs3ErrPerm       nfsStatusError = 1
+	nfs3ErrNoEnt      nfsStatusError = 2
+	nfs3ErrIO         nfsStatusError = 5
+	nfs3ErrAcces      nfsStatusError = 13
+	nfs3ErrNotDir     nfsStatusError = 20
+	nfs3ErrStale      nfsStatusError = 70
+	nfs3ErrBadHandle  nfsStatusError = 10001
+	nfs3ErrServerFail nfsStatusError = 10006
+	nfs3ErrJukebox    nfsStatusError = 10008
+)
+
+func (e nfsStatusError) Error() string {
+	switch e {
+	case nfs3ErrPerm:
+		return "NFS3ERR_PERM"
+	case nfs3ErrNoEnt:
+		return "NFS3ERR_NOENT"
+	case nfs3ErrIO:
+		return "NFS3ERR_IO"
+	case nfs3ErrAcces:
+		return "NFS3ERR_ACCES"
+	case nfs3ErrNotDir:
+		return "NFS3ERR_NOTDIR"
+	case nfs3ErrStale:
+		return "NFS3ERR_STALE"
+	case nfs3ErrBadHandle:
+		return "NFS3ERR_BADHANDLE"
+	case nfs3ErrServerFail:
+		return "NFS3ERR_SERVERFAULT"
+	case nfs3ErrJukebox:
+		return "NFS3ERR_JUKEBOX"
+	}
+	return "NFS3 error " + strconv.Itoa(int(e))
+}
+
+func (e nfsStatusError) Is(target error) bool {
+	switch e {
+	case nfs3ErrNoEnt:
+		return target == fs.ErrNotExist
+	case nfs3ErrPerm, nfs3ErrAcces:
+		return target == fs.ErrPermission
+	}
+	return false
+}
+
+type xdrWriter struct {
+	bytes.Buffer
+}
+
+func (w *xdrWriter) uint32(v uint32) {
+	w.Write(binary.BigEndian.AppendUint32(nil, v))
+}
+
+func (w *xdrWriter) uint64(v uint64) {
+	w.Write(binary.BigEndian.AppendUint64(nil, v))
+}
+
+func (w *xdrWriter) bool(v bool) {
+	if v {
+		w.uint32(1)
+	} else {
+		w.uint32(0)
+	}
+}
+
+func (w *xdrWriter) opaque(b []byte) {
+	w.uint32(uint32(len(b)))
+	w.Write(b)
+	w.Write(make([]byte, (4-len(b)%4)%4))
+}
+
+func (w *xdrWriter) string(s string) {
+	w.opaque([]byte(s))
+}
+
+// xdrReader decodes XDR data, remembering the first error so callers can
+// check once after decoding a whole structure
+type xdrReader struct {
+	buf []byte
+	err error
+}
+
+func (r *xdrReader) fixed(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.buf) {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *xdrReader) uint32() uint32 {
+	b := r.fixed(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (r *xdrReader) uint64() uint64 {
+	b := r.fixed(8)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func (r *xdrReader) bool() bool {
+	return r.uint32() != 0
+}
+
+func (r *xdrReader) opaque() []byte {
+	n := int(r.uint32())
+	b := r.fixed(n)
+	r.fixed((4 - n%4) % 4)
+	return b
+}
+
+func (r *xdrReader) string() string {
+	return string(r.opaque())
+}
+
+type nfsAttr struct {
+	Type    uint32
+	Size    uint64
+	ModTime time.Time
+}
+
+func (r *xdrReader) fattr() nfsAttr {
+	var attr nfsAttr
+	attr.Type = r.uint32()
+	r.fixed(4 * 4) // mode, nlink, uid, gid
+	attr.Size = r.uint64()
+	r.fixed(8 + 8 + 8 + 8) // used, rdev, fsid, fileid
+	r.fixed(8)             // atime
+	sec, nsec := r.uint32(), r.uint32()
+	attr.ModTime = time.Unix(int64(sec), int64(nsec))
+	r.fixed(8) // ctime
+	return attr
+}
+
+// postOpAttr decodes an optional fattr3
+func (r *xdrReader) postOpAttr() (nfsAttr, bool) {
+	if !r.bool() {
+		return nfsAttr{}, false
+	}
+	return r.fattr(), true
+}
+
+type rpcClient struct {
+	conn    net.Conn
+	xid     uint32
+	timeout time.Duration
+	cred    []byte
+}
+
+func newAuthSys() []byte {
+	var w xdrWriter
+	hostname, _ := os.Hostname()
+	w.uint32(uint32(time.Now().Unix()))
+	w.string(hostname)
+	w.uint32(uint32(os.Getuid()))
+	w.uint32(uint32(os.Getgid()))
+	w.uint32(0) // no supplementary groups
+	return w.Bytes()
+}
+
+// dialRPC connects to an RPC service. As root it binds a reserved source
+// port first, since NFS servers reject other ports by default ("secure").
+func dialRPC(addr string, timeout time.Duration) (*rpcClient, error) {
+	var conn net.Conn
+	var err error
+	if os.Geteuid() == 0 {
+		for _, port := range rand.Perm(512) {
+			dialer := net.Dialer{Timeout: timeout, LocalAddr: &net.TCPAddr{Port: 512 + port}}
+			conn, err = dialer.Dial("tcp", addr)
+			if err == nil || !errors.Is(err, syscall.EADDRINUSE) {
+				break
+			}
+		}
+	}
+	if conn == nil {
+		dialer := net.Dialer{Timeout: timeout}
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &rpcClient{conn: conn, xid: rand.Uint32(), timeout: timeout, cred: newAuthSys()}, nil
+}
+
+func (c *rpcClient) Close() error {
+	return c.conn.Close()
+}
+
+func (c *rpcClient) call(prog, vers, proc uint32, args []byte) (*xdrReader, error) {
+	c.xid++
+	var w xdrWriter
+	w.uint32(0) // record mark, filled in below
+	w.uint32(c.xid)
+	w.uint32(rpcMsgCall)
+	w.uint32(rpcVersion)
+	w.uint32(prog)
+	w.uint32(vers)
+	w.uint32(proc)
+	w.uint32(rpcAuthSys)
+	w.opaque(c.cred)
+	w.uint32(rpcAuthNone)
+	w.uint32(0)
+	w.Write(args)
+	msg := w.Bytes()
+	binary.BigEndian.PutUint32(msg, uint32(len(msg)-4)|rpcLastFrag)
+
+	if c.timeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+	if _, err := c.conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	for {
+		reply, err := readRPCRecord(c.conn)
+		if err != nil {
+			return nil, err
+		}
+		r := &xdrReader{buf: reply}
+		// a reply to an earlier call that timed out may still arrive
+		if r.uint32() != c.xid {
+			continue
+		}
+		if r.uint32() != rpcMsgReply {
+			return nil, errors.New("rpc: expected a reply")
+		}
+		if r.uint32() != rpcMsgAccepted {
+			return nil, errors.New("rpc: call rejected by server")
+		}
+		r.uint32() // verifier flavor
+		r.opaque()
+		if stat := r.uint32(); stat != rpcSuccess {
+			return nil, fmt.Errorf("rpc: program %d version %d call failed with status %d", prog, vers, stat)
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+		return r, nil
+	}
+}
+
+func readRPCRecord(conn io.Reader) ([]byte, error) {
+	var record []byte
+	for {
+		var mark [4]byte
+		if _, err := io.ReadFull(conn, mark[:]); err != nil {
+			return nil, err
+		}
+		header := binary.BigEndian.Uint32(mark[:])
+		if size := header &^ rpcLastFrag; len(record)+int(size) > rpcMaxRecord {
+			return nil, fmt.Errorf("rpc: record of %d bytes is too large", len(record)+int(size))
+		}
+		fragment := make([]byte, header&^rpcLastFrag)
+		if _, err := io.ReadFull(conn, fragment); err != nil {
+			return nil, err
+		}
+		record = append(record, fragment...)
+		if header&rpcLastFrag != 0 {
+			return record, nil
+		}
+	}
+}
+
+func getPort(host string, prog, vers uint32, timeout time.Duration) (int, error) {
+	pm, err := dialRPC(net.JoinHostPort(host, strconv.Itoa(nfsPortmapPort)), timeout)
+	if err != nil {
+		return 0, fmt.Errorf("failed to reach the portmapper on %s: %w", host, err)
+	}
+	defer pm.Close()
+
+	var w xdrWriter
+	w.uint32(prog)
+	w.uint32(vers)
+	w.uint32(ipProtoTCP)
+	w.uint32(0)
+	r, err := pm.call(portmapProgram, portmapVersion, portmapGetPort, w.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	port := r.uint32()
+	if r.err != nil {
+		return 0, r.err
+	}
+	if port == 0 {
+		return 0, fmt.Errorf("program %d version %d is not registered on %s", prog, vers, host)
+	}
+	return int(port), nil
+}
+
+// nfsClient is a read-only NFSv3 session on one export
+type nfsClient struct {
+	mount  *rpcClient
+	nfs    *rpcClient
+	export string
+	root   []byte
+	// directory handles by path, so each block read doesn't walk the tree
+	handles map[string][]byte
+}
+
+func dialNFSClient(host, export string, timeout time.Duration) (*nfsClient, error) {
+	mountPort, err := getPort(host, mountProgram, mountVersion, timeout)
+	if err != nil {
+		return nil, err
+	}
+	nfsPort, err := getPort(host, nfsProgram, nfsVersion3, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	mount, err := dialRPC(net.JoinHostPort(host, strconv.Itoa(mountPort)), timeout)
+	if err != nil {
+		return nil, err
+	}
+	var w xdrWriter
+	w.string(export)
+	r, err := mount.call(mountProgram, mountVersion, mountProcMnt, w.Bytes())
+	if err != nil {
+		mount.Close()
+		return nil, err
+	}
+	if status := r.uint32(); status != 0 {
+		mount.Close()
+		return nil, fmt.Errorf("server refused to mount %s: %w", export, nfsStatusError(status))
+	}
+	root := r.opaque()
+	if r.err != nil {
+		mount.Close()
+		return nil, r.err
+	}
+
+	conn, err := dialRPC(net.JoinHostPort(host, strconv.Itoa(nfsPort)), timeout)
+	if err != nil {
+		mount.Close()
+		return nil, err
+	}
+	return &nfsClient{
+		mount:   mount,
+		nfs:     conn,
+		export:  export,
+		root:    root,
+		handles: map[string][]byte{".": root},
+	}, nil
+}
+
+func (c *nfsClient) Close() error {
+	var w xdrWriter
+	w.string(c.export)
+	c.mount.call(mountProgram, mountVersion, mountProcUmnt, w.Bytes())
+	c.mount.Close()
+	return c.nfs.Close()
+}
+
+func (c *nfsClient) call(proc uint32, args []byte) (*xdrReader, error) {
+	r, err := c.nfs.call(nfsProgram, nfsVersion3, proc, args)
+	if err != nil {
+		return nil, err
+	}
+	if status := nfsStatusError(r.uint32()); status != nfs3Ok {
+		return nil, status
+	}
+	return r, r.err
+}
+
+func (c *nfsClient) getattr(fh []byte) (nfsAttr, error) {
+	var w xdrWriter
+	w.opaque(fh)
+	r, err := c.call(nfsProcGetattr, w.Bytes())
+	if err != nil {
+		return nfsAttr{}, err
+	}
+	attr := r.fattr()
+	return attr, r.err
+}
+
+// lookup resolves a slash separated path relative to the export
+func (c *nfsClient) lookup(name string) ([]byte, nfsAttr, error) {
+	name = path.Clean(name)
+	if name == "." {
+		attr, err := c.getattr(c.root)
+		return c.root, attr, err
+	}
+
+	dir, base := path.Split(name)
+	dir = path.Clean(dir)
+	dirHandle, ok := c.handles[dir]
+	if !ok {
+		var attr nfsAttr
+		var err error
+		dirHandle, attr, err = c.lookup(dir)
+		if err != nil {
+			return nil, nfsAttr{}, err
+		}
+		if attr.Type != nfs3TypeDir {
+			return nil, nfsAttr{}, nfs3ErrNotDir
+		}
+		c.handles[dir] = dirHandle
+	}
+
+	var w xdrWriter
+	w.opaque(dirHandle)
+	w.string(base)
+	r, err := c.call(nfsProcLookup, w.Bytes())
+	if err != nil {
+		return nil, nfsAttr{}, err
+	}
+	fh := r.opaque()
+	attr, ok := r.postOpAttr()
+	if r.err != nil {
+		return nil, nfsAttr{}, r.err
+	}
+	if !ok {
+		if attr, err = c.getattr(fh); err != nil {
+			return nil, nfsAttr{}, err
+		}
+	}
+	return fh, attr, nil
+}
+
+func (c *nfsClient) stat(name string) (fs.FileInfo, error) {
+	_, attr, err := c.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return remoteFileInfo{
+		name:    path.Base(name),
+		size:    int64(attr.Size),
+		modTime: attr.ModTime,
+		dir:     attr.Type == nfs3TypeDir,
+	}, nil
+}
+
+func (c *nfsClient) readDir(name string) ([]fs.FileInfo, error) {
+	fh, attr, err := c.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if attr.Type != nfs3TypeDir {
+		return nil, nfs3ErrNotDir
+	}
+
+	infos := make([]fs.FileInfo, 0)
+	var cookie uint64
+	verifier := make([]byte, 8)
+	for {
+		var w xdrWriter
+		w.opaque(fh)
+		w.uint64(cookie)
+		w.Write(verifier)
+		w.uint32(8192)  // dircount
+		w.uint32(65536) // maxcount
+		r, err := c.call(nfsProcReaddirplus, w.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		r.postOpAttr()
+		verifier = r.fixed(8)
+		for r.bool() {
+			r.uint64() // fileid
+			entry := r.string()
+			cookie = r.uint64()
+			entryAttr, hasAttr := r.postOpAttr()
+			if r.bool() {
+				r.opaque() // handle
+			}
+			if entry == "." || entry == ".." {
+				continue
+			}
+			if !hasAttr {
+				if _, entryAttr, err = c.lookup(path.Join(name, entry)); err != nil {
+					return nil, err
+				}
+			}
+			infos = append(infos, remoteFileInfo{
+				name:    entry,
+				size:    int64(entryAttr.Size),
+				modTime: entryAttr.ModTime,
+				dir:     entryAttr.Type == nfs3TypeDir,
+			})
+		}
+		eof := r.bool()
+		if r.err != nil {
+			return nil, r.err
+		}
+		if eof {
+			return infos, nil
+		}
+	}
+}
+
+func (c *nfsClient) readAt(name string, p []byte, off int64) (int, error) {
+	fh, _, err := c.lookup(name)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for n < len(p) {
+		var w xdrWriter
+		w.opaque(fh)
+		w.uint64(uint64(off) + uint64(n))
+		w.uint32(uint32(min(len(p)-n, nfsMaxRead)))
+		r, err := c.call(nfsProcRead, w.Bytes())
+		if err != nil {
+			return n, err
+		}
+		r.postOpAttr()
+		r.uint32() // count
+		eof := r.bool()
+		data := r.opaque()
+		if r.err != nil {
+			return n, r.err
+		}
+		n += copy(p[n:], data)
+		if eof && n < len(p) {
+			return n, io.ErrUnexpectedEOF
+		}
+		if len(data) == 0 && !eof {
+			return n, fmt.Errorf("server returned no data reading %s", name)
+		}
+	}
+	return n, nil
+}
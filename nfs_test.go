@@ -0,0 +1,495 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+)
+
+// fakeNFSServer serves a local directory over the portmapper, MOUNT and
+// NFSv3 programs, all on one port
+type fakeNFSServer struct {
+	root     string
+	export   string
+	listener net.Listener
+
+	mu         sync.Mutex
+	mounts     int
+	reads      map[string]int
+	staleReads int
+	dropReads  int
+	hangReads  bool
+	denied     map[string]bool
+}
+
+const fakeNFSMaxRead = 1000
+
+func newFakeNFSServer(t *testing.T, root string) *fakeNFSServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &fakeNFSServer{
+		root:     root,
+		export:   "/export",
+		listener: listener,
+		reads:    make(map[string]int),
+		denied:   make(map[string]bool),
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	previous := nfsPortmapPort
+	nfsPortmapPort = listener.Addr().(*net.TCPAddr).Port
+	t.Cleanup(func() { nfsPortmapPort = previous })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (s *fakeNFSServer) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		record, err := readRPCRecord(conn)
+		if err != nil {
+			return
+		}
+		r := &xdrReader{buf: record}
+		xid := r.uint32()
+		r.uint32() // call
+		r.uint32() // rpc version
+		prog, vers, proc := r.uint32(), r.uint32(), r.uint32()
+		r.uint32()
+		r.opaque()
+		r.uint32()
+		r.opaque()
+
+		var results xdrWriter
+		switch {
+		case prog == portmapProgram && proc == portmapGetPort:
+			results.uint32(uint32(s.listener.Addr().(*net.TCPAddr).Port))
+		case prog == mountProgram && proc == mountProcMnt:
+			s.mount(r, &results)
+		case prog == mountProgram && proc == mountProcUmnt:
+		case prog == nfsProgram && vers == nfsVersion3:
+			if !s.nfs(proc, r, &results) {
+				return
+			}
+			if results.Len() == 0 {
+				// hanging call, never answered
+				continue
+			}
+		}
+
+		var reply xdrWriter
+		reply.uint32(0)
+		reply.uint32(xid)
+		reply.uint32(rpcMsgReply)
+		reply.uint32(rpcMsgAccepted)
+		reply.uint32(rpcAuthNone)
+		reply.uint32(0)
+		reply.uint32(rpcSuccess)
+		reply.Write(results.Bytes())
+		msg := reply.Bytes()
+		binary.BigEndian.PutUint32(msg, uint32(len(msg)-4)|rpcLastFrag)
+		if _, err := conn.Write(msg); err != nil {
+			return
+		}
+	}
+}
+
+func (s *fakeNFSServer) mount(r *xdrReader, w *xdrWriter) {
+	if r.string() != s.export {
+		w.uint32(uint32(nfs3ErrAcces))
+		return
+	}
+	s.mu.Lock()
+	s.mounts++
+	s.mu.Unlock()
+	w.uint32(0)
+	w.opaque([]byte("fh:."))
+	w.uint32(1)
+	w.uint32(rpcAuthSys)
+}
+
+func (s *fakeNFSServer) fattr(w *xdrWriter, info fs.FileInfo) {
+	if info.IsDir() {
+		w.uint32(nfs3TypeDir)
+	} else {
+		w.uint32(1)
+	}
+	w.uint32(uint32(info.Mode().Perm()))
+	w.uint32(1)
+	w.uint32(0)
+	w.uint32(0)
+	w.uint64(uint64(info.Size()))
+	w.uint64(uint64(info.Size()))
+	w.uint64(0) // rdev
+	w.uint64(1) // fsid
+	w.uint64(0) // fileid
+	for i := 0; i < 3; i++ {
+		w.uint32(uint32(info.ModTime().Unix()))
+		w.uint32(0)
+	}
+}
+
+// nfs handles an NFSv3 call, returning false to drop the connection
+func (s *fakeNFSServer) nfs(proc uint32, r *xdrReader, w *xdrWriter) bool {
+	name := strings.TrimPrefix(string(r.opaque()), "fh:")
+	switch proc {
+	case nfsProcGetattr:
+		info, err := os.Stat(filepath.Join(s.root, name))
+		if err != nil {
+			w.uint32(uint32(nfs3ErrStale))
+			return true
+		}
+		w.uint32(0)
+		s.fattr(w, info)
+	case nfsProcLookup:
+		name = path.Join(name, r.string())
+		info, err := os.Stat(filepath.Join(s.root, name))
+		if err != nil {
+			w.uint32(uint32(nfs3ErrNoEnt))
+			w.bool(false)
+			return true
+		}
+		w.uint32(0)
+		w.opaque([]byte("fh:" + name))
+		w.bool(true)
+		s.fattr(w, info)
+		w.bool(false)
+	case nfsProcRead:
+		off, count := r.uint64(), r.uint32()
+		s.mu.Lock()
+		s.reads[name]++
+		stale, drop, hang, denied := s.staleReads > 0, s.dropReads > 0, s.hangReads, s.denied[name]
+		if stale {
+			s.staleReads--
+		} else if drop {
+			s.dropReads--
+		}
+		s.mu.Unlock()
+		switch {
+		case hang:
+			return true
+		case stale:
+			w.uint32(uint32(nfs3ErrStale))
+			w.bool(false)
+			return true
+		case drop:
+			return false
+		case denied:
+			w.uint32(uint32(nfs3ErrAcces))
+			w.bool(false)
+			return true
+		}
+
+		file, err := os.ReadFile(filepath.Join(s.root, name))
+		if err != nil {
+			w.uint32(uint32(nfs3ErrIO))
+			w.bool(false)
+			return true
+		}
+		// short reads, like a server with a small rtmax
+		start := min(int(off), len(file))
+		data := file[start:min(len(file), start+int(count), start+fakeNFSMaxRead)]
+		w.uint32(0)
+		w.bool(false)
+		w.uint32(uint32(len(data)))
+		w.bool(start+len(data) == len(file))
+		w.opaque(data)
+	case nfsProcReaddirplus:
+		cookie := r.uint64()
+		entries, err := os.ReadDir(filepath.Join(s.root, name))
+		if err != nil {
+			w.uint32(uint32(nfs3ErrNotDir))
+			w.bool(false)
+			return true
+		}
+		names := []string{".", ".."}
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		w.uint32(0)
+		w.bool(false)
+		w.Write(make([]byte, 8))
+		// a few entries per reply so the client has to page
+		end := min(int(cookie)+3, len(names))
+		for i := int(cookie); i < end; i++ {
+			info, err := os.Stat(filepath.Join(s.root, name, names[i]))
+			if err != nil {
+				continue
+			}
+			w.bool(true)
+			w.uint64(uint64(i))
+			w.string(names[i])
+			w.uint64(uint64(i + 1))
+			w.bool(true)
+			s.fattr(w, info)
+			w.bool(false)
+		}
+		w.bool(false)
+		w.bool(end == len(names))
+	}
+	return true
+}
+
+func TestParseNFSURL(t *testing.T) {
+	tests := []struct {
+		url           string
+		host          string
+		export        string
+		expectedError bool
+	}{
+		{url: "nfs://nas:/volume1/longhorn", host: "nas", export: "/volume1/longhorn"},
+		{url: "nfs://longhorn-test-nfs-svc.default:/opt/backupstore?nfsOptions=soft,timeo=330", host: "longhorn-test-nfs-svc.default", export: "/opt/backupstore"},
+		{url: "nfs://nas/volume1", host: "nas", export: "/volume1"},
+		{url: "nfs://nas:/", host: "nas", export: "/"},
+		{url: "nfs://:/export", expectedError: true},
+		{url: "s3://bucket/", expectedError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			host, export, err := parseNFSURL(tt.url)
+			if tt.expectedError {
+				if err == nil {
+					t.Error("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if host != tt.host || export != tt.export {
+				t.Errorf("Expected %s:%s, got %s:%s", tt.host, tt.export, host, export)
+			}
+		})
+	}
+}
+
+func openTestNFSStore(t *testing.T, timeout time.Duration) *nfsStore {
+	t.Helper()
+	store, _, err := openBackupStore(context.Background(), "nfs://127.0.0.1:/export", storeOptions{
+		NFSVersion: 3,
+		NFSTimeout: timeout,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nfs := store.(*nfsStore)
+	nfs.backoff = time.Millisecond
+	t.Cleanup(func() { nfs.Close() })
+	return nfs
+}
+
+func TestNFSStoreRestore(t *testing.T) {
+	root := t.TempDir()
+	volumePath := filepath.Join(root, "backupstore", "volumes", "5f", "a2", "pvc-123")
+	if err := os.MkdirAll(filepath.Join(volumePath, "backups"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	blockSize := 4096
+	first := writeTestBlock(t, volumePath, testBlockData(1, blockSize))
+	second := writeTestBlock(t, volumePath, testBlockData(2, blockSize))
+	cfg := `{"CreatedTime": "2024-01-01T00:00:00Z", "Size": "8192", "CompressionMethod": "lz4", "BlockSize": "4096",
+		"Blocks": [{"Offset": 0, "BlockChecksum": "` + first + `"}, {"Offset": 4096, "BlockChecksum": "` + second + `"}]}`
+	if err := os.WriteFile(filepath.Join(volumePath, "backups", "backup_backup-1.cfg"), []byte(cfg), 0644); err != nil {
+		t.Fatal(err)
+	}
+	newFakeNFSServer(t, root)
+	store := openTestNFSStore(t, 5*time.Second)
+
+	volumes, err := backupstore.ListVolumes(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(volumes) != 1 || volumes[0] != "volumes/5f/a2/pvc-123" {
+		t.Errorf("Expected the pvc-123 volume, got %v", volumes)
+	}
+
+	volumeBackupPath, err := backupstore.FindVolumeBackupPath(store, "pvc-123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeBackup, err := backupstore.ReadBackups(store, volumeBackupPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(volumeBackup.Backups) != 1 {
+		t.Fatalf("Expected 1 backup, got %d", len(volumeBackup.Backups))
+	}
+
+	out, err := os.Create(filepath.Join(t.TempDir(), "out.raw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	err = backupstore.Repack(context.Background(), store, volumeBackup.BackupPath, volumeBackup.Backups, out, backupstore.RepackOptions{Jobs: 2})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	content, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, append(testBlockData(1, blockSize), testBlockData(2, blockSize)...)) {
+		t.Error("Restored image does not match expected content")
+	}
+}
+
+func TestNFSStoreRetries(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "backupstore"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	content := bytes.Repeat([]byte("longhorn"), 1000)
+	for _, name := range []string{"flaky.cfg", "private.cfg"} {
+		if err := os.WriteFile(filepath.Join(root, "backupstore", name), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server := newFakeNFSServer(t, root)
+	store := openTestNFSStore(t, 5*time.Second)
+
+	// a stale handle and a dropped connection each cost a reconnect
+	server.mu.Lock()
+	server.staleReads = 1
+	server.dropReads = 1
+	server.mu.Unlock()
+	data, err := store.ReadFile("flaky.cfg")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !bytes.Equal(data, content) {
+		t.Error("Read data does not match file content")
+	}
+	server.mu.Lock()
+	if server.mounts != 3 {
+		t.Errorf("Expected 3 mounts, got %d", server.mounts)
+	}
+	server.staleReads = nfsAttempts
+	server.mu.Unlock()
+	if _, err := store.ReadFile("flaky.cfg"); err == nil {
+		t.Error("Expected error after exhausting retries")
+	}
+
+	server.mu.Lock()
+	server.denied["backupstore/private.cfg"] = true
+	server.mu.Unlock()
+	_, err = store.ReadFile("private.cfg")
+	if !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("Expected permission error, got %v", err)
+	}
+	server.mu.Lock()
+	if server.reads["backupstore/private.cfg"] != 1 {
+		t.Errorf("Expected permission errors not to be retried, got %d reads", server.reads["backupstore/private.cfg"])
+	}
+	server.mu.Unlock()
+
+	_, err = store.ReadFile("missing.cfg")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected not exist error, got %v", err)
+	}
+}
+
+func TestNFSStoreTimeout(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "backupstore"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "backupstore", "slow.cfg"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	server := newFakeNFSServer(t, root)
+	store := openTestNFSStore(t, 100*time.Millisecond)
+
+	server.mu.Lock()
+	server.hangReads = true
+	server.mu.Unlock()
+	start := time.Now()
+	if _, err := store.ReadFile("slow.cfg"); err == nil {
+		t.Error("Expected timeout error")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the read to give up quickly, took %s", elapsed)
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.reads["backupstore/slow.cfg"] != nfsAttempts {
+		t.Errorf("Expected %d attempts, got %d", nfsAttempts, server.reads["backupstore/slow.cfg"])
+	}
+}
+
+func TestNFSStoreOptions(t *testing.T) {
+	_, _, err := openBackupStore(context.Background(), "nfs://127.0.0.1:/export", storeOptions{NFSVersion: 4})
+	if err == nil {
+		t.Error("Expected error for unsupported NFS version")
+	}
+
+	root := t.TempDir()
+	newFakeNFSServer(t, root)
+	_, _, err = openBackupStore(context.Background(), "nfs://127.0.0.1:/other", storeOptions{NFSVersion: 3, NFSTimeout: time.Second})
+	if !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("Expected refused mount, got %v", err)
+	}
+}
+
+func TestNFSMount(t *testing.T) {
+	mounted := filepath.Join(t.TempDir(), "nas share")
+	if err := os.MkdirAll(filepath.Join(mounted, "longhorn", "backupstore"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	table := filepath.Join(t.TempDir(), "mounts")
+	mounts := "nas:/ /mnt/root nfs4 rw 0 0\n" +
+		"nas:/volume1 " + strings.ReplaceAll(mounted, " ", `\040`) + " nfs4 rw,vers=4.1 0 0\n" +
+		"nas:/volume1/longhornish /mnt/prefix nfs4 rw 0 0\n" +
+		"other:/volume1/longhorn /mnt/host nfs4 rw 0 0\n" +
+		"nas:/volume1/longhorn /mnt/tmpfs tmpfs rw 0 0\n"
+	if err := os.WriteFile(table, []byte(mounts), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(table string) { nfsMountTable = table }(nfsMountTable)
+	nfsMountTable = table
+
+	_, backupStorePath, err := openBackupStore(context.Background(), "nfs://nas:/volume1/longhorn", storeOptions{NFSVersion: 4})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expected := filepath.Join(mounted, "longhorn", "backupstore"); backupStorePath != expected {
+		t.Errorf("Expected %s, got %s", expected, backupStorePath)
+	}
+
+	_, backupStorePath, err = openBackupStore(context.Background(), "nfs://nas:/volume2/longhorn", storeOptions{NFSVersion: 4})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expected := filepath.Join("/mnt/root", "volume2", "longhorn", "backupstore"); backupStorePath != expected {
+		t.Errorf("Expected %s, got %s", expected, backupStorePath)
+	}
+
+	_, _, err = openBackupStore(context.Background(), "nfs://other:/volume2/longhorn", storeOptions{NFSVersion: 4})
+	if err == nil || !strings.Contains(err.Error(), "other:/volume2/longhorn is not mounted here") {
+		t.Errorf("Expected an error for an export that isn't mounted, got %v", err)
+	}
+}
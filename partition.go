@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	gptSignature   = "EFI PART"
+	mbrProtective  = 0xEE
+	mbrEntryOffset = 446
+)
+
+type Partition struct {
+	Index int
+	Type  string
+	Name  string
+	Start int64
+	Size  int64
+}
+
+// PartitionTable is a GPT or MBR partition table found at the start of an
+// image. Size is the length of the disk it describes: up to the backup GPT
+// header, or the end of the last MBR partition.
+type PartitionTable struct {
+	Scheme     string
+	Size       int64
+	Partitions []Partition
+}
+
+type gptHeader struct {
+	Signature      [8]byte
+	Revision       uint32
+	HeaderSize     uint32
+	HeaderCRC      uint32
+	Reserved       uint32
+	CurrentLBA     uint64
+	BackupLBA      uint64
+	FirstUsableLBA uint64
+	LastUsableLBA  uint64
+	DiskGUID       [16]byte
+	EntriesLBA     uint64
+	NumEntries     uint32
+	EntrySize      uint32
+	EntriesCRC     uint32
+}
+
+type gptEntry struct {
+	TypeGUID   [16]byte
+	UniqueGUID [16]byte
+	FirstLBA   uint64
+	LastLBA    uint64
+	Attributes uint64
+	Name       [36]uint16
+}
+
+type mbrEntry struct {
+	Status   uint8
+	CHSFirst [3]byte
+	Type     uint8
+	CHSLast  [3]byte
+	FirstLBA uint32
+	Sectors  uint32
+}
+
+var gptTypes = map[string]string{
+	"C12A7328-F81F-11D2-BA4B-00A0C93EC93B": "EFI system",
+	"21686148-6449-6E6F-744E-656564454649": "BIOS boot",
+	"0FC63DAF-8483-4772-8E79-3D69D8477DE4": "Linux filesystem",
+	"0657FD6D-A4AB-43C4-84E5-0933C84B4F4F": "Linux swap",
+	"E6D6D379-F507-44C2-A23C-238F2A3DF928": "Linux LVM",
+	"A19D880F-05FC-4D3B-A006-743F0F84911E": "Linux RAID",
+	"4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709": "Linux root (x86-64)",
+	"EBD0A0A2-B9E5-4433-87C0-68B6B72699C7": "Microsoft basic data",
+	"E3C9E316-0B5C-4DB8-817D-F92DF00215AE": "Microsoft reserved",
+	"DE94BBA4-06D1-4D40-A16A-BFD50179D6AC": "Windows recovery",
+}
+
+var mbrTypes = map[uint8]string{
+	0x05: "Extended",
+	0x07: "NTFS/exFAT",
+	0x0b: "FAT32",
+	0x0c: "FAT32 (LBA)",
+	0x0f: "Extended (LBA)",
+	0x82: "Linux swap",
+	0x83: "Linux",
+	0x8e: "Linux LVM",
+	0xef: "EFI system",
+	0xfd: "Linux RAID",
+}
+
+// formatGUID prints a GUID stored in the mixed-endian on-disk layout
+func formatGUID(b [16]byte) string {
+	return fmt.Sprintf("%08X-%04X-%04X-%X-%X",
+		binary.LittleEndian.Uint32(b[0:4]), binary.LittleEndian.Uint16(b[4:6]),
+		binary.LittleEndian.Uint16(b[6:8]), b[8:10], b[10:16])
+}
+
+// readPartitionTable parses the GPT, or failing that the MBR, at the start
+// of an image
+func readPartitionTable(f io.ReaderAt) (*PartitionTable, error) {
+	mbr := make([]byte, 512)
+	if _, err := f.ReadAt(mbr, 0); err != nil {
+		return nil, err
+	}
+	if mbr[510] != 0x55 || mbr[511] != 0xAA {
+		return nil, errors.New("no partition table found")
+	}
+	var entries [4]mbrEntry
+	if err := binary.Read(bytes.NewReader(mbr[mbrEntryOffset:]), binary.LittleEndian, &entries); err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.Type == mbrProtective {
+			return readGPT(f)
+		}
+	}
+	return readMBR(entries)
+}
+
+func readGPT(f io.ReaderAt) (*PartitionTable, error) {
+	// the header is in LBA 1, wherever that is for the disk's sector size
+	for _, sectorSize := range []int64{512, 4096} {
+		sector := make([]byte, sectorSize)
+		if _, err := f.ReadAt(sector, sectorSize); err != nil {
+			return nil, err
+		}
+		if string(sector[:8]) != gptSignature {
+			continue
+		}
+
+		var header gptHeader
+		if err := binary.Read(bytes.NewReader(sector), binary.LittleEndian, &header); err != nil {
+			return nil, err
+		}
+		if header.HeaderSize < 92 || int64(header.HeaderSize) > sectorSize {
+			return nil, fmt.Errorf("invalid GPT header size %d", header.HeaderSize)
+		}
+		raw := bytes.Clone(sector[:header.HeaderSize])
+		binary.LittleEndian.PutUint32(raw[16:], 0)
+		if crc32.ChecksumIEEE(raw) != header.HeaderCRC {
+			return nil, errors.New("GPT header checksum mismatch")
+		}
+		if header.EntrySize < 128 || header.NumEntries > 1024 {
+			return nil, fmt.Errorf("invalid GPT entry layout: %d entries of %d bytes", header.NumEntries, header.EntrySize)
+		}
+
+		table := make([]byte, int64(header.NumEntries)*int64(header.EntrySize))
+		if _, err := f.ReadAt(table, int64(header.EntriesLBA)*sectorSize); err != nil {
+			return nil, fmt.Errorf("failed to read GPT entries: %w", err)
+		}
+		if crc32.ChecksumIEEE(table) != header.EntriesCRC {
+			return nil, errors.New("GPT partition entries checksum mismatch")
+		}
+
+		partitions := make([]Partition, 0)
+		for i := 0; i < int(header.NumEntries); i++ {
+			var entry gptEntry
+			raw := table[i*int(header.EntrySize):]
+			if err := binary.Read(bytes.NewReader(raw), binary.LittleEndian, &entry); err != nil {
+				return nil, err
+			}
+			if entry.TypeGUID == [16]byte{} {
+				continue
+			}
+			guid := formatGUID(entry.TypeGUID)
+			partType, ok := gptTypes[guid]
+			if !ok {
+				partType = guid
+			}
+			partitions = append(partitions, Partition{
+				Index: i + 1,
+				Type:  partType,
+				Name:  strings.TrimRight(string(utf16.Decode(entry.Name[:])), "\x00"),
+				Start: int64(entry.FirstLBA) * sectorSize,
+				Size:  int64(entry.LastLBA-entry.FirstLBA+1) * sectorSize,
+			})
+		}
+		return &PartitionTable{
+			Scheme:     "gpt",
+			Size:       int64(header.BackupLBA+1) * sectorSize,
+			Partitions: partitions,
+		}, nil
+	}
+	return nil, errors.New("protective MBR without a GPT header")
+}
+
+func readMBR(entries [4]mbrEntry) (*PartitionTable, error) {
+	table := &PartitionTable{Scheme: "mbr", Partitions: make([]Partition, 0)}
+	for i, entry := range entries {
+		if entry.Type == 0 && entry.Sectors == 0 {
+			continue
+		}
+		// anything else, such as a VBR's boot code, is not a partition table
+		if entry.Status&0x7f != 0 || entry.Type == 0 || entry.FirstLBA == 0 || entry.Sectors == 0 {
+			return nil, errors.New("no partition table found")
+		}
+		partType, ok := mbrTypes[entry.Type]
+		if !ok {
+			partType = fmt.Sprintf("0x%02x", entry.Type)
+		}
+		partition := Partition{
+			Index: i + 1,
+			Type:  partType,
+			Start: int64(entry.FirstLBA) * 512,
+			Size:  int64(entry.Sectors) * 512,
+		}
+		table.Partitions = append(table.Partitions, partition)
+		table.Size = max(table.Size, partition.Start+partition.Size)
+	}
+	if len(table.Partitions) == 0 {
+		return nil, errors.New("no partition table found")
+	}
+	return table, nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"slices"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+type testPartition struct {
+	typeGUID string
+	name     string
+	first    uint64
+	last     uint64
+}
+
+// parseGUID is the inverse of formatGUID
+func parseGUID(t *testing.T, s string) [16]byte {
+	t.Helper()
+	raw, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil || len(raw) != 16 {
+		t.Fatalf("invalid GUID %s", s)
+	}
+	// the first three fields are stored little-endian
+	slices.Reverse(raw[0:4])
+	slices.Reverse(raw[4:6])
+	slices.Reverse(raw[6:8])
+	return [16]byte(raw)
+}
+
+// gptTestImage lays out a protective MBR, a GPT header in LBA 1 and 128
+// partition entries from LBA 2 for a disk of the given number of sectors,
+// returning the first size bytes of it
+func gptTestImage(t *testing.T, sectors uint64, size int, partitions []testPartition) []byte {
+	t.Helper()
+	image := make([]byte, size)
+
+	binary.LittleEndian.PutUint32(image[mbrEntryOffset+8:], 1)
+	binary.LittleEndian.PutUint32(image[mbrEntryOffset+12:], uint32(min(sectors-1, 0xffffffff)))
+	image[mbrEntryOffset+4] = mbrProtective
+	image[510], image[511] = 0x55, 0xAA
+
+	entries := image[2*512 : 2*512+128*128]
+	for i, partition := range partitions {
+		entry := gptEntry{
+			TypeGUID:   parseGUID(t, partition.typeGUID),
+			UniqueGUID: [16]byte{byte(i + 1)},
+			FirstLBA:   partition.first,
+			LastLBA:    partition.last,
+		}
+		copy(entry.Name[:], utf16.Encode([]rune(partition.name)))
+		var buf bytes.Buffer
+		if err := binary.Write(&buf, binary.LittleEndian, entry); err != nil {
+			t.Fatal(err)
+		}
+		copy(entries[i*128:], buf.Bytes())
+	}
+
+	header := gptHeader{
+		Revision:       0x10000,
+		HeaderSize:     92,
+		CurrentLBA:     1,
+		BackupLBA:      sectors - 1,
+		FirstUsableLBA: 34,
+		LastUsableLBA:  sectors - 34,
+		EntriesLBA:     2,
+		NumEntries:     128,
+		EntrySize:      128,
+		EntriesCRC:     crc32.ChecksumIEEE(entries),
+	}
+	copy(header.Signature[:], gptSignature)
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, header); err != nil {
+		t.Fatal(err)
+	}
+	raw := buf.Bytes()
+	binary.LittleEndian.PutUint32(raw[16:], crc32.ChecksumIEEE(raw))
+	copy(image[512:], raw)
+	return image
+}
+
+// defaultGPTTestImage is the first 2MiB of a 64MiB disk with a 32MiB ext4
+// root partition at 1MiB and a swap partition after it
+func defaultGPTTestImage(t *testing.T) []byte {
+	t.Helper()
+	image := gptTestImage(t, 131072, 2*1024*1024, []testPartition{
+		{typeGUID: "0FC63DAF-8483-4772-8E79-3D69D8477DE4", name: "root", first: 2048, last: 67583},
+		{typeGUID: "0657FD6D-A4AB-43C4-84E5-0933C84B4F4F", name: "swap", first: 67584, last: 131038},
+	})
+	copy(image[1024*1024:], ext4TestBlock(4096, 8192, 2))
+	return image
+}
+
+func TestReadPartitionTableGPT(t *testing.T) {
+	image := defaultGPTTestImage(t)
+	table, err := readPartitionTable(bytes.NewReader(image))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if table.Scheme != "gpt" || table.Size != 64*1024*1024 {
+		t.Errorf("Expected a 64MiB gpt, got a %d byte %s", table.Size, table.Scheme)
+	}
+	if len(table.Partitions) != 2 {
+		t.Fatalf("Expected 2 partitions, got %d", len(table.Partitions))
+	}
+	root := table.Partitions[0]
+	if root.Type != "Linux filesystem" || root.Name != "root" || root.Start != 1024*1024 || root.Size != 32*1024*1024 {
+		t.Errorf("Unexpected root partition %+v", root)
+	}
+	if table.Partitions[1].Type != "Linux swap" {
+		t.Errorf("Expected Linux swap, got %s", table.Partitions[1].Type)
+	}
+
+	corrupted := bytes.Clone(image)
+	corrupted[2*512] ^= 0xff
+	if _, err := readPartitionTable(bytes.NewReader(corrupted)); err == nil {
+		t.Error("Expected error for corrupted partition entries")
+	}
+	corrupted = bytes.Clone(image)
+	binary.LittleEndian.PutUint64(corrupted[512+32:], 1<<40)
+	if _, err := readPartitionTable(bytes.NewReader(corrupted)); err == nil {
+		t.Error("Expected error for a corrupted GPT header")
+	}
+}
+
+func TestReadPartitionTableMBR(t *testing.T) {
+	image := make([]byte, 4096)
+	for i, partition := range []mbrEntry{
+		{Status: 0x80, Type: 0x83, FirstLBA: 2048, Sectors: 204800},
+		{Type: 0x8e, FirstLBA: 206848, Sectors: 1024000},
+	} {
+		var buf bytes.Buffer
+		if err := binary.Write(&buf, binary.LittleEndian, partition); err != nil {
+			t.Fatal(err)
+		}
+		copy(image[mbrEntryOffset+i*16:], buf.Bytes())
+	}
+	image[510], image[511] = 0x55, 0xAA
+
+	table, err := readPartitionTable(bytes.NewReader(image))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if table.Scheme != "mbr" || table.Size != (206848+1024000)*512 {
+		t.Errorf("Expected an mbr ending at the LVM partition, got a %d byte %s", table.Size, table.Scheme)
+	}
+	if len(table.Partitions) != 2 || table.Partitions[0].Type != "Linux" || table.Partitions[1].Type != "Linux LVM" {
+		t.Errorf("Unexpected partitions %+v", table.Partitions)
+	}
+
+	// boot sectors of filesystems also end in 55AA
+	for _, fixture := range []string{"ntfs-bootsector.bin", "ntfs-garbage.bin"} {
+		if _, err := readPartitionTable(bytes.NewReader(readFixture(t, fixture, 4096))); err == nil {
+			t.Errorf("Expected %s not to be read as a partition table", fixture)
+		}
+	}
+}
+
+func TestImageSize(t *testing.T) {
+	gpt := defaultGPTTestImage(t)
+	tests := []struct {
+		name          string
+		image         []byte
+		volumeSize    int64
+		expected      int64
+		contents      string
+		output        string
+		expectedError bool
+	}{
+		{name: "gpt", image: gpt, expected: 64 * 1024 * 1024, contents: "gpt", output: "1: Linux filesystem, 33554432 bytes at offset 1048576 (root), ext4"},
+		{name: "gpt within volume", image: gpt, volumeSize: 128 * 1024 * 1024, expected: 128 * 1024 * 1024, contents: "gpt"},
+		{name: "gpt past volume", image: gpt, volumeSize: 32 * 1024 * 1024, expected: 64 * 1024 * 1024, contents: "gpt", output: "Warning"},
+		{name: "filesystem", image: ext4TestBlock(4096, 10, 2), expected: 40960, contents: "ext4", output: "Filesystem: ext4"},
+		{name: "filesystem past volume", image: ext4TestBlock(4096, 10, 2), volumeSize: 8192, expected: 8192, contents: "ext4", output: "Warning"},
+		{name: "lvm", image: lvmTestImage(t), volumeSize: 1 << 30, expected: 1 << 30, contents: lvmPVType, output: "Filesystem: LVM2_member"},
+		{name: "unknown with volume", image: testBlockData(3, 4096), volumeSize: 8192, expected: 8192},
+		{name: "unknown", image: testBlockData(3, 4096), expectedError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var progress bytes.Buffer
+			size, contents, err := imageSize(bytes.NewReader(tt.image), tt.volumeSize, &progress)
+			if tt.expectedError {
+				if err == nil {
+					t.Error("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if size != tt.expected {
+				t.Errorf("Expected %d, got %d", tt.expected, size)
+			}
+			if contents != tt.contents {
+				t.Errorf("Expected %q, got %q", tt.contents, contents)
+			}
+			if !strings.Contains(progress.String(), tt.output) {
+				t.Errorf("Expected output to contain %q, got %q", tt.output, progress.String())
+			}
+		})
+	}
+}
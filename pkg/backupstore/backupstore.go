@@ -0,0 +1,632 @@
+// Package backupstore reads the backups Longhorn keeps in a backupstore and
+// repacks them into a disk image.
+//
+// A backupstore is any fs.FS rooted at the backupstore directory of a
+// Longhorn backup target, such as os.DirFS("/mnt/backups/backupstore").
+// Volumes live under volumes/, each with a backups/ directory holding one
+// cfg file per backup and a blocks/ directory holding the compressed
+// blocks they share.
+package backupstore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Block is a block of a backup: the offset it is restored to and the
+// SHA-512 of its uncompressed content, which is also the name of its file.
+// See ChecksumAlgorithm for the other hashes it can be.
+type Block struct {
+	Offset   int64  `json:"Offset"`
+	Checksum string `json:"BlockChecksum"`
+}
+
+// BackupConfig is the cfg file Longhorn writes for each backup. Fields
+// it has that aren't listed here are ignored.
+type BackupConfig struct {
+	Name              string            `json:"Name"`
+	VolumeName        string            `json:"VolumeName"`
+	SnapshotName      string            `json:"SnapshotName"`
+	SnapshotCreatedAt string            `json:"SnapshotCreatedAt"`
+	CreatedTime       string            `json:"CreatedTime"`
+	Size              Int64             `json:"Size"`
+	Labels            map[string]string `json:"Labels"`
+	IsIncremental     bool              `json:"IsIncremental"`
+	CompressionMethod string            `json:"CompressionMethod"`
+	// Error is what a backup that failed part way ended with
+	Error string `json:"Error"`
+	// BlockSize is only recorded by Longhorn versions that let it be
+	// changed from the 2MiB it always was
+	BlockSize Int64   `json:"BlockSize"`
+	Blocks    []Block `json:"Blocks"`
+}
+
+// VolumeConfig is the volume.cfg Longhorn keeps next to the backups of
+// each volume. Fields it has that aren't listed here are ignored.
+type VolumeConfig struct {
+	Name              string            `json:"Name"`
+	Size              Int64             `json:"Size"`
+	Labels            map[string]string `json:"Labels"`
+	CreatedTime       string            `json:"CreatedTime"`
+	LastBackupName    string            `json:"LastBackupName"`
+	LastBackupAt      string            `json:"LastBackupAt"`
+	BackingImageName  string            `json:"BackingImageName"`
+	CompressionMethod string            `json:"CompressionMethod"`
+	StorageClassName  string            `json:"StorageClassName"`
+	DataEngine        string            `json:"DataEngine"`
+}
+
+// Int64 is an integer in a cfg file, which Longhorn writes as a JSON
+// string in most versions and as a number in newer ones. An empty string
+// or null is 0.
+type Int64 int64
+
+func (n *Int64) UnmarshalJSON(data []byte) error {
+	value := string(data)
+	if value == "null" {
+		return nil
+	}
+	if strings.HasPrefix(value, `"`) {
+		if err := json.Unmarshal(data, &value); err != nil {
+			return err
+		}
+		if value == "" {
+			*n = 0
+			return nil
+		}
+	}
+	i, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid integer %s", data)
+	}
+	*n = Int64(i)
+	return nil
+}
+
+// Backup is one backup of a volume. Identifier is the name Longhorn gave
+// it, or for a cfg file without one, the name of the file without its
+// backup_ prefix, and ConfigPath the path of its cfg file in the
+// backupstore.
+type Backup struct {
+	Identifier  string
+	ConfigPath  string
+	Timestamp   time.Time
+	Size        int64
+	Compression string
+	Blocks      []Block
+	// VolumeName is the volume Longhorn backed up, which should be the
+	// one whose directory holds the cfg file
+	VolumeName        string
+	SnapshotName      string
+	SnapshotCreatedAt time.Time
+	Labels            map[string]string
+	IsIncremental     bool
+	// BlockSize is what every block decompresses to: the one the cfg file
+	// records, or MaxBlockSize. A Backup built with 0 has its blocks only
+	// bounded by MaxBlockSize.
+	BlockSize int64
+	// Incomplete is why the backup can't be restored as it is, when its
+	// cfg file is of a backup still in progress or one that failed, and
+	// empty otherwise
+	Incomplete string
+	// Warning is why Timestamp isn't the CreatedTime of the cfg file,
+	// when it had to be taken from the modification time of the file
+	Warning string
+}
+
+// SkippedBackup is a file in the backups directory of a volume that
+// ReadBackups left out, and why. Backup is only set for the cfg file of
+// an incomplete backup.
+type SkippedBackup struct {
+	Path   string
+	Reason string
+	Backup *Backup
+}
+
+// VolumeBackup is a volume and its backups, oldest first
+type VolumeBackup struct {
+	Name       string
+	BackupPath string
+	// Size of the volume in bytes from volume.cfg, 0 if it has none
+	Size int64
+	// Config is the volume.cfg of the volume, nil if it has none
+	Config  *VolumeConfig
+	Backups []Backup
+	// Skipped are the temporary files and incomplete backups of the
+	// volume, which a live backupstore has while Longhorn backs it up
+	Skipped []SkippedBackup
+}
+
+// IncludeIncomplete adds the incomplete backups ReadBackups skipped to
+// Backups, for restoring what a backup in progress or one that failed
+// holds so far
+func (v *VolumeBackup) IncludeIncomplete() {
+	skipped := v.Skipped[:0]
+	for _, s := range v.Skipped {
+		if s.Backup == nil {
+			skipped = append(skipped, s)
+			continue
+		}
+		v.Backups = append(v.Backups, *s.Backup)
+	}
+	v.Skipped = skipped
+	sortBackups(v.Backups)
+}
+
+// temporarySuffixes are the files Longhorn keeps in a backups directory
+// while writing a cfg file or holding a lock on it
+var temporarySuffixes = []string{".tmp", ".lck", ".lock"}
+
+// timestampLayouts are the formats Longhorn versions have written times
+// in, tried in order. Those without a zone are UTC, as Longhorn writes.
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	// time.Time.String, which some versions wrote the time with
+	"2006-01-02 15:04:05.999999999 -0700 MST",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+}
+
+// parseTimestamp parses a time in the cfg files of a backup in any of
+// the timestampLayouts
+func parseTimestamp(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	// the monotonic clock reading time.Time.String appends
+	value, _, _ = strings.Cut(value, " m=")
+	for _, layout := range timestampLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized time %q", value)
+}
+
+// ErrNoTimestamp is returned by ReadBackup for a cfg file with neither a
+// CreatedTime it can parse nor a modification time to order it by
+var ErrNoTimestamp = errors.New("backup has no timestamp")
+
+// ErrVolumeNotFound is returned by FindVolumeBackupPath for a volume with
+// no directory in the backupstore
+var ErrVolumeNotFound = errors.New("volume not found")
+
+// ErrAmbiguousVolume is returned by FindVolumeBackupPath for a name that
+// several volume directories have
+var ErrAmbiguousVolume = errors.New("volume name is ambiguous")
+
+// volumeMarkers are the entries Longhorn keeps in a volume directory; one
+// holding backups or volume.cfg has something to restore
+var volumeMarkers = []string{"backups", "blocks", "volume.cfg"}
+
+// WalkVolumes calls fn with every volume directory under volumes, however
+// deeply it is nested. A directory is a volume if it is named volumeName
+// or holds backups or volume.cfg. No directory holding any of the
+// volumeMarkers is descended into, so block trees are never listed. fn
+// can return fs.SkipAll to end the walk early.
+func WalkVolumes(store fs.FS, volumeName string, fn func(dir string) error) error {
+	err := walkVolumeDir(store, "volumes", volumeName, fn)
+	if errors.Is(err, fs.SkipAll) {
+		return nil
+	}
+	return err
+}
+
+func walkVolumeDir(store fs.FS, dir string, volumeName string, fn func(dir string) error) error {
+	if volumeName != "" && path.Base(dir) == volumeName {
+		return fn(dir)
+	}
+	entries, err := fs.ReadDir(store, dir)
+	if dir == "volumes" && errors.Is(err, fs.ErrNotExist) {
+		// a backupstore nothing has been backed up to yet
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var subdirs []string
+	isVolume, hasMarker := false, false
+	for _, entry := range entries {
+		if slices.Contains(volumeMarkers, entry.Name()) {
+			hasMarker = true
+			isVolume = isVolume || entry.Name() != "blocks"
+		}
+		if entry.IsDir() {
+			subdirs = append(subdirs, entry.Name())
+		}
+	}
+	if isVolume {
+		return fn(dir)
+	}
+	if hasMarker {
+		return nil
+	}
+	for _, name := range subdirs {
+		if err := walkVolumeDir(store, path.Join(dir, name), volumeName, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListVolumes returns the path of every volume directory in the
+// backupstore
+func ListVolumes(store fs.FS) ([]string, error) {
+	var volumes []string
+	err := WalkVolumes(store, "", func(dir string) error {
+		volumes = append(volumes, dir)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return volumes, nil
+}
+
+// FindVolumeBackupPath returns the directory of the volume named
+// volumeName, or an error wrapping ErrVolumeNotFound, or
+// ErrAmbiguousVolume if several directories have the name
+func FindVolumeBackupPath(store fs.FS, volumeName string) (string, error) {
+	var found []string
+	err := WalkVolumes(store, volumeName, func(dir string) error {
+		if path.Base(dir) == volumeName {
+			found = append(found, dir)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("could not find backup for %s: %w", volumeName, ErrVolumeNotFound)
+	case 1:
+		return found[0], nil
+	}
+	return "", fmt.Errorf("%s is the name of %d volumes (%s): %w", volumeName, len(found), strings.Join(found, ", "), ErrAmbiguousVolume)
+}
+
+// MatchVolumes returns the directory of every volume named pattern, or if
+// there are none, of every volume whose name matches pattern as a
+// path.Match glob, or contains it when it has no glob characters
+func MatchVolumes(store fs.FS, pattern string) ([]string, error) {
+	glob := strings.ContainsAny(pattern, "*?[\\")
+	if glob {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid volume pattern %s: %w", pattern, err)
+		}
+	}
+	var exact, matched []string
+	err := WalkVolumes(store, pattern, func(dir string) error {
+		name := path.Base(dir)
+		switch {
+		case name == pattern:
+			exact = append(exact, dir)
+		case glob:
+			if ok, _ := path.Match(pattern, name); ok {
+				matched = append(matched, dir)
+			}
+		case strings.Contains(name, pattern):
+			matched = append(matched, dir)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(exact) > 0 {
+		return exact, nil
+	}
+	return matched, nil
+}
+
+// ReadVolumeConfig reads the volume.cfg in volumePath
+func ReadVolumeConfig(store fs.FS, volumePath string) (*VolumeConfig, error) {
+	data, err := fs.ReadFile(store, path.Join(volumePath, "volume.cfg"))
+	if err != nil {
+		return nil, err
+	}
+	var cfg VolumeConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse volume.cfg: %w", err)
+	}
+	return &cfg, nil
+}
+
+// ReadBackups reads the cfg file of every backup of the volume in
+// volumePath, and its size from volume.cfg if it has one. Every block
+// checksum is validated, but no blocks are read. Temporary files and the
+// cfg files of incomplete backups, or of backups with no timestamp, are
+// left in Skipped rather than Backups.
+func ReadBackups(store fs.FS, volumePath string) (*VolumeBackup, error) {
+	backupCfgPaths, temporary, err := listBackupFiles(store, volumePath)
+	if err != nil {
+		return nil, err
+	}
+
+	volumeBackup := &VolumeBackup{
+		Name:       path.Base(volumePath),
+		BackupPath: volumePath,
+		Backups:    make([]Backup, 0),
+	}
+
+	volumeCfg, err := ReadVolumeConfig(store, volumePath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if volumeCfg != nil {
+		volumeBackup.Config = volumeCfg
+		volumeBackup.Size = int64(volumeCfg.Size)
+	}
+
+	for _, name := range temporary {
+		volumeBackup.Skipped = append(volumeBackup.Skipped, SkippedBackup{Path: name, Reason: "temporary file"})
+	}
+	for _, cfgPath := range backupCfgPaths {
+		backup, err := ReadBackup(store, cfgPath)
+		if errors.Is(err, ErrNoTimestamp) {
+			volumeBackup.Skipped = append(volumeBackup.Skipped, SkippedBackup{Path: cfgPath, Reason: err.Error()})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if backup.Incomplete != "" {
+			volumeBackup.Skipped = append(volumeBackup.Skipped, SkippedBackup{Path: cfgPath, Reason: backup.Incomplete, Backup: &backup})
+			continue
+		}
+		volumeBackup.Backups = append(volumeBackup.Backups, backup)
+	}
+
+	sortBackups(volumeBackup.Backups)
+
+	return volumeBackup, nil
+}
+
+func sortBackups(backups []Backup) {
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Timestamp.Before(backups[j].Timestamp)
+	})
+}
+
+// ReadBackup reads the cfg file of a backup, validating every block
+// checksum without reading any blocks
+func ReadBackup(store fs.FS, cfgPath string) (Backup, error) {
+	data, err := fs.ReadFile(store, cfgPath)
+	if err != nil {
+		return Backup{}, fmt.Errorf("failed to read %s: %w", cfgPath, err)
+	}
+
+	var cfg BackupConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return Backup{}, fmt.Errorf("failed to parse %s: %w", cfgPath, err)
+	}
+
+	for i, block := range cfg.Blocks {
+		if err := ValidateChecksum(block.Checksum); err != nil {
+			return Backup{}, fmt.Errorf("invalid checksum %q for block %d (offset %d) in %s: %w", block.Checksum, i, block.Offset, cfgPath, err)
+		}
+	}
+
+	// only shown, so a snapshot time that doesn't parse is left zero
+	snapshotCreated, _ := parseTimestamp(cfg.SnapshotCreatedAt)
+
+	// Longhorn only records the creation time once every block of the
+	// backup is in the store. Very old versions didn't record it at all,
+	// but their cfg files list the blocks.
+	inProgress := cfg.CreatedTime == "" && len(cfg.Blocks) == 0
+	var incomplete string
+	switch {
+	case cfg.Error != "":
+		incomplete = fmt.Sprintf("the backup failed: %s", cfg.Error)
+	case inProgress:
+		incomplete = "no CreatedTime, the backup is still in progress"
+	}
+
+	var warning string
+	timestamp, parseErr := parseTimestamp(cfg.CreatedTime)
+	switch {
+	case parseErr == nil:
+	case inProgress && !snapshotCreated.IsZero():
+		// a backup in progress was at least started after its snapshot
+		timestamp = snapshotCreated
+	default:
+		info, err := fs.Stat(store, cfgPath)
+		if err != nil || info.ModTime().IsZero() {
+			return Backup{}, fmt.Errorf("%s has no usable CreatedTime and no modification time: %w", cfgPath, ErrNoTimestamp)
+		}
+		timestamp = info.ModTime()
+		switch {
+		case inProgress:
+		case cfg.CreatedTime == "":
+			warning = "no CreatedTime, ordered by the modification time of its cfg file"
+		default:
+			warning = fmt.Sprintf("CreatedTime %q is not a time, ordered by the modification time of its cfg file", cfg.CreatedTime)
+		}
+	}
+
+	compression := cfg.CompressionMethod
+	if compression == "" {
+		// Longhorn only started recording the method once it added
+		// lz4; older backups are gzip
+		compression = "gzip"
+	}
+	if !slices.Contains(Compressions, compression) {
+		return Backup{}, fmt.Errorf("backup %s uses unsupported compression method %q", cfgPath, compression)
+	}
+
+	blockSize := int64(cfg.BlockSize)
+	if blockSize <= 0 {
+		blockSize = MaxBlockSize
+	}
+
+	name := cfg.Name
+	if name == "" {
+		name = strings.TrimPrefix(strings.TrimSuffix(path.Base(cfgPath), ".cfg"), "backup_")
+	}
+
+	return Backup{
+		Identifier:        name,
+		ConfigPath:        cfgPath,
+		Timestamp:         timestamp,
+		Size:              int64(cfg.Size),
+		Compression:       compression,
+		Blocks:            cfg.Blocks,
+		VolumeName:        cfg.VolumeName,
+		SnapshotName:      cfg.SnapshotName,
+		SnapshotCreatedAt: snapshotCreated,
+		Labels:            cfg.Labels,
+		IsIncremental:     cfg.IsIncremental,
+		BlockSize:         blockSize,
+		Incomplete:        incomplete,
+		Warning:           warning,
+	}, nil
+}
+
+// ListBackupConfigs returns the path of the cfg file of every backup of
+// the volume in volumePath
+func ListBackupConfigs(store fs.FS, volumePath string) ([]string, error) {
+	cfgPaths, _, err := listBackupFiles(store, volumePath)
+	return cfgPaths, err
+}
+
+// ListBackupNames returns the names of the backups of the volume in
+// volumePath from the names of their cfg files, backup_<name>.cfg, in
+// order of name. No cfg file is read, so backups still in progress or
+// that failed are listed too.
+func ListBackupNames(store fs.FS, volumePath string) ([]string, error) {
+	cfgPaths, _, err := listBackupFiles(store, volumePath)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(cfgPaths))
+	for _, cfgPath := range cfgPaths {
+		names = append(names, strings.TrimPrefix(strings.TrimSuffix(path.Base(cfgPath), ".cfg"), "backup_"))
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+// listBackupFiles returns the paths of the cfg files in the backups
+// directory of the volume in volumePath, and of the temporary files next
+// to them, such as a cfg file Longhorn is still writing
+func listBackupFiles(store fs.FS, volumePath string) (cfgPaths, temporary []string, err error) {
+	dir := path.Join(volumePath, "backups")
+	entries, err := fs.ReadDir(store, dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, entry := range entries {
+		switch name := entry.Name(); {
+		case entry.IsDir():
+		case strings.HasSuffix(name, ".cfg"):
+			cfgPaths = append(cfgPaths, path.Join(dir, name))
+		case slices.ContainsFunc(temporarySuffixes, func(suffix string) bool { return strings.HasSuffix(name, suffix) }):
+			temporary = append(temporary, path.Join(dir, name))
+		}
+	}
+	return cfgPaths, temporary, nil
+}
+
+// ListBlocks returns the path of every block file of the volume in
+// volumePath by the checksum it is named after, however deeply the blocks
+// tree nests it. Every directory of the tree is listed, a request each in
+// a remote store.
+func ListBlocks(store fs.FS, volumePath string) (map[string]string, error) {
+	blocks := make(map[string]string)
+	err := fs.WalkDir(store, path.Join(volumePath, "blocks"), func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if name == path.Join(volumePath, "blocks") && errors.Is(err, fs.ErrNotExist) {
+				// a volume that was never backed up
+				return fs.SkipAll
+			}
+			return err
+		}
+		checksum, ok := strings.CutSuffix(d.Name(), ".blk")
+		if !ok || d.IsDir() {
+			return nil
+		}
+		if _, seen := blocks[checksum]; !seen {
+			blocks[checksum] = name
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return blocks, nil
+}
+
+// RemoteFS is a store where every request is a round trip, such as an S3
+// bucket. Blocks that aren't where Longhorn puts them are only searched for
+// in stores that aren't remote.
+type RemoteFS interface {
+	fs.FS
+	Remote() bool
+}
+
+func isRemote(store fs.FS) bool {
+	remote, ok := store.(RemoteFS)
+	return ok && remote.Remote()
+}
+
+// ResolveBlockPath returns the path of the file of a block in the store
+func ResolveBlockPath(store fs.FS, backupPath, checksum string) (string, error) {
+	blockPath, _, err := StatBlock(store, backupPath, checksum)
+	return blockPath, err
+}
+
+// StatBlock finds the file of a block in the store, returning its path and
+// file info
+func StatBlock(store fs.FS, backupPath, checksum string) (string, fs.FileInfo, error) {
+	// Longhorn shards blocks by the first two byte pairs of the checksum,
+	// so try that directly before listing the blocks tree
+	if len(checksum) >= 4 {
+		canonical := path.Join(backupPath, "blocks", checksum[0:2], checksum[2:4], checksum+".blk")
+		info, err := fs.Stat(store, canonical)
+		if err == nil {
+			return canonical, info, nil
+		}
+		// listing the whole blocks tree of a remote store costs a request
+		// per directory, so only local stores fall back to searching it
+		if isRemote(store) {
+			return "", nil, fmt.Errorf("could not find block %s: %w", checksum, err)
+		}
+	}
+
+	// blocks copied around by hand may not be sharded the usual way, so
+	// look for the file at any depth
+	var blockPath string
+	var info fs.FileInfo
+	err := fs.WalkDir(store, path.Join(backupPath, "blocks"), func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || d.Name() != checksum+".blk" {
+			return nil
+		}
+		info, err = d.Info()
+		if err != nil {
+			return err
+		}
+		blockPath = name
+		return fs.SkipAll
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	if blockPath == "" {
+		return "", nil, fmt.Errorf("could not find block %s: %w", checksum, fs.ErrNotExist)
+	}
+	return blockPath, info, nil
+}
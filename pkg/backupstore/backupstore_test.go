@@ -0,0 +1,785 @@
+package backupstore
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+func TestFindVolumeBackupPath(t *testing.T) {
+	tmpDir := t.TempDir()
+	err := os.MkdirAll(filepath.Join(tmpDir, "volumes", "ab", "cd", "volume1"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		backupStore   fs.FS
+		volumeName    string
+		expectedPath  string
+		expectedError bool
+	}{
+		{
+			name:          "Valid volume backup",
+			backupStore:   os.DirFS(tmpDir),
+			volumeName:    "volume1",
+			expectedPath:  "volumes/ab/cd/volume1",
+			expectedError: false,
+		},
+		{
+			name:          "Non-existent volume",
+			backupStore:   os.DirFS(tmpDir),
+			volumeName:    "nonexistent",
+			expectedPath:  "",
+			expectedError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, err := FindVolumeBackupPath(tt.backupStore, tt.volumeName)
+			if tt.expectedError && err == nil {
+				t.Error("Expected error but got none")
+			}
+			if !tt.expectedError && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			if path != tt.expectedPath {
+				t.Errorf("Expected path %s, got %s", tt.expectedPath, path)
+			}
+		})
+	}
+}
+
+func TestMatchVolumes(t *testing.T) {
+	tmpDir := t.TempDir()
+	for _, dir := range []string{"ab/cd/pvc-8f3a01", "ef/01/pvc-8f3b02", "12/34/pvc-1", "56/78/pvc-10", "9a/bc/pvc-shared", "de/f0/pvc-shared"} {
+		if err := os.MkdirAll(filepath.Join(tmpDir, "volumes", dir, "backups"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store := os.DirFS(tmpDir)
+
+	tests := []struct {
+		pattern  string
+		expected []string
+	}{
+		// an exact name wins over the names containing it
+		{"pvc-1", []string{"volumes/12/34/pvc-1"}},
+		{"8f3", []string{"volumes/ab/cd/pvc-8f3a01", "volumes/ef/01/pvc-8f3b02"}},
+		{"pvc-8f3a*", []string{"volumes/ab/cd/pvc-8f3a01"}},
+		{"pvc-?0", []string{"volumes/56/78/pvc-10"}},
+		{"pvc-shared", []string{"volumes/9a/bc/pvc-shared", "volumes/de/f0/pvc-shared"}},
+		{"pvc-404", nil},
+	}
+	for _, tt := range tests {
+		volumes, err := MatchVolumes(store, tt.pattern)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !slices.Equal(volumes, tt.expected) {
+			t.Errorf("Expected %v for %s, got %v", tt.expected, tt.pattern, volumes)
+		}
+	}
+	if _, err := MatchVolumes(store, "pvc-["); !errors.Is(err, path.ErrBadPattern) {
+		t.Errorf("Expected a bad pattern error, got %v", err)
+	}
+
+	if _, err := FindVolumeBackupPath(store, "pvc-shared"); !errors.Is(err, ErrAmbiguousVolume) {
+		t.Errorf("Expected pvc-shared to be ambiguous, got %v", err)
+	}
+	if dir, err := FindVolumeBackupPath(store, "pvc-1"); err != nil || dir != "volumes/12/34/pvc-1" {
+		t.Errorf("Expected volumes/12/34/pvc-1, got %s and %v", dir, err)
+	}
+}
+
+func TestReadBackups(t *testing.T) {
+	tmpDir := t.TempDir()
+	backupsDir := filepath.Join(tmpDir, "backups")
+	err := os.MkdirAll(backupsDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create mock backup config file
+	mockConfig := `{
+        "CreatedTime": "2023-01-01T00:00:00Z",
+        "Size": "1024",
+        "CompressionMethod": "lz4",
+        "Blocks": [
+            {
+                "Offset": 0,
+                "BlockChecksum": "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+            }
+        ]
+    }`
+
+	err = os.WriteFile(filepath.Join(backupsDir, "backup1.cfg"), []byte(mockConfig), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	volumeBackup, err := ReadBackups(os.DirFS(tmpDir), ".")
+	if err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+
+	if volumeBackup == nil {
+		t.Fatal("Expected non-nil VolumeBackup")
+	}
+
+	if len(volumeBackup.Backups) != 1 {
+		t.Errorf("Expected 1 backup, got %d", len(volumeBackup.Backups))
+	}
+	if volumeBackup.Size != 0 || volumeBackup.Config != nil {
+		t.Errorf("Expected no volume size or config without volume.cfg, got %d and %+v", volumeBackup.Size, volumeBackup.Config)
+	}
+
+	volumeConfig := `{"Name": "pvc-123", "Size": "21474836480", "CreatedTime": "2023-01-01T00:00:00Z"}`
+	err = os.WriteFile(filepath.Join(tmpDir, "volume.cfg"), []byte(volumeConfig), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeBackup, err = ReadBackups(os.DirFS(tmpDir), ".")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if volumeBackup.Size != 21474836480 {
+		t.Errorf("Expected volume size 21474836480, got %d", volumeBackup.Size)
+	}
+	if volumeBackup.Config == nil || volumeBackup.Config.Name != "pvc-123" || volumeBackup.Config.CreatedTime != "2023-01-01T00:00:00Z" {
+		t.Errorf("Expected the volume.cfg of pvc-123, got %+v", volumeBackup.Config)
+	}
+
+	err = os.WriteFile(filepath.Join(tmpDir, "volume.cfg"), []byte(`{"Size": "big"}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadBackups(os.DirFS(tmpDir), "."); err == nil {
+		t.Error("Expected error for an invalid volume size")
+	}
+	if err := os.Remove(filepath.Join(tmpDir, "volume.cfg")); err != nil {
+		t.Fatal(err)
+	}
+
+	// backups from before CompressionMethod was recorded are gzip
+	legacyConfig := `{"CreatedTime": "2022-01-01T00:00:00Z", "Size": "1024", "Blocks": []}`
+	err = os.WriteFile(filepath.Join(backupsDir, "backup0.cfg"), []byte(legacyConfig), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeBackup, err = ReadBackups(os.DirFS(tmpDir), ".")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if volumeBackup.Backups[0].Compression != "gzip" {
+		t.Errorf("Expected gzip for a backup without a compression method, got %s", volumeBackup.Backups[0].Compression)
+	}
+
+	unknownConfig := `{"CreatedTime": "2024-01-01T00:00:00Z", "Size": "1024", "CompressionMethod": "bzip2", "Blocks": []}`
+	err = os.WriteFile(filepath.Join(backupsDir, "backup2.cfg"), []byte(unknownConfig), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ReadBackups(os.DirFS(tmpDir), ".")
+	if err == nil || !strings.Contains(err.Error(), "bzip2") {
+		t.Errorf("Expected error naming the unsupported compression method, got %v", err)
+	}
+}
+
+func TestReadBackupLonghornConfig(t *testing.T) {
+	// the cfg file Longhorn writes, including fields ReadBackup ignores
+	data, err := os.ReadFile("testdata/backup_backup-5d0e3b4a9c1f4e27.cfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfgPath := "volumes/4d/4a/pvc-4d4a8b3e-5a38-4a6b-8e1b-0d8e2c1b7f59/backups/backup_backup-5d0e3b4a9c1f4e27.cfg"
+	store := fstest.MapFS{cfgPath: &fstest.MapFile{Data: data}}
+
+	backup, err := ReadBackup(store, cfgPath)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if backup.Identifier != "backup-5d0e3b4a9c1f4e27" || backup.ConfigPath != cfgPath {
+		t.Errorf("Expected backup-5d0e3b4a9c1f4e27 at %s, got %s at %s", cfgPath, backup.Identifier, backup.ConfigPath)
+	}
+	if backup.VolumeName != "pvc-4d4a8b3e-5a38-4a6b-8e1b-0d8e2c1b7f59" || backup.SnapshotName != "a3c1e6f2-7b4d-4f0e-9d2a-6c8b1e5f3a70" {
+		t.Errorf("Unexpected volume %s and snapshot %s", backup.VolumeName, backup.SnapshotName)
+	}
+	if created := time.Date(2024, 3, 1, 8, 0, 2, 0, time.UTC); !backup.SnapshotCreatedAt.Equal(created) || !backup.Timestamp.Equal(created.Add(9*time.Second)) {
+		t.Errorf("Unexpected snapshot time %s and creation time %s", backup.SnapshotCreatedAt, backup.Timestamp)
+	}
+	if backup.Labels["longhorn.io/volume-access-mode"] != "rwo" || len(backup.Labels) != 2 {
+		t.Errorf("Unexpected labels %v", backup.Labels)
+	}
+	if !backup.IsIncremental || backup.BlockSize != 2097152 || backup.Size != 6291456 || backup.Compression != "lz4" || len(backup.Blocks) != 3 {
+		t.Errorf("Unexpected backup %+v", backup)
+	}
+
+	// cfg files from before Longhorn recorded the name are named after
+	// the file
+	legacy := "volumes/pvc-1/backups/backup_backup-1.cfg"
+	store[legacy] = &fstest.MapFile{Data: []byte(`{"CreatedTime": "2022-01-01T00:00:00Z", "Size": "0", "BlockSize": 2097152}`)}
+	backup, err = ReadBackup(store, legacy)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if backup.Identifier != "backup-1" || backup.BlockSize != 2097152 {
+		t.Errorf("Expected backup-1 with a block size of 2097152, got %s with %d", backup.Identifier, backup.BlockSize)
+	}
+
+	// blocks are 2MiB unless the cfg file says otherwise
+	unsized := "volumes/pvc-1/backups/backup_backup-2.cfg"
+	store[unsized] = &fstest.MapFile{Data: []byte(`{"CreatedTime": "2022-01-01T00:00:00Z", "Size": "0"}`)}
+	backup, err = ReadBackup(store, unsized)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if backup.BlockSize != MaxBlockSize {
+		t.Errorf("Expected a block size of %d, got %d", MaxBlockSize, backup.BlockSize)
+	}
+}
+
+func TestInt64UnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		expected int64
+		err      bool
+	}{
+		{name: "string", data: `"1024"`, expected: 1024},
+		{name: "number", data: `1024`, expected: 1024},
+		{name: "empty", data: `""`, expected: 0},
+		{name: "null", data: `null`, expected: 0},
+		// over what an int holds on 32-bit builds
+		{name: "large string", data: `"21474836480"`, expected: 21474836480},
+		{name: "large number", data: `21474836480`, expected: 21474836480},
+		{name: "word", data: `"big"`, err: true},
+		{name: "fraction", data: `1.5`, err: true},
+		{name: "bool", data: `true`, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg BackupConfig
+			err := json.Unmarshal([]byte(`{"Size": `+tt.data+`}`), &cfg)
+			if tt.err {
+				if err == nil {
+					t.Errorf("Expected an error, got %d", cfg.Size)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if int64(cfg.Size) != tt.expected {
+				t.Errorf("Expected %d, got %d", tt.expected, cfg.Size)
+			}
+		})
+	}
+}
+
+func TestReadBackupsIncomplete(t *testing.T) {
+	// a store Longhorn is backing up to: one backup done, one whose blocks
+	// are still being written, one that failed, and the cfg file of the
+	// next still being saved
+	store := os.DirFS("testdata/live")
+	volume, err := ReadBackups(store, "volumes/3f/9a/pvc-live")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(volume.Backups) != 1 || volume.Backups[0].Identifier != "backup-done" {
+		t.Errorf("Expected only backup-done, got %+v", volume.Backups)
+	}
+	skipped := make(map[string]SkippedBackup)
+	for _, s := range volume.Skipped {
+		skipped[path.Base(s.Path)] = s
+	}
+	for name, backup := range map[string]string{
+		"backup_backup-writing.cfg":  "backup-writing",
+		"backup_backup-failed.cfg":   "backup-failed",
+		"backup_backup-next.cfg.tmp": "",
+	} {
+		s, ok := skipped[name]
+		if !ok {
+			t.Errorf("Expected %s to be skipped, got %+v", name, volume.Skipped)
+			continue
+		}
+		if backup == "" && s.Backup != nil || backup != "" && (s.Backup == nil || s.Backup.Identifier != backup) {
+			t.Errorf("Expected %s to be skipped with backup %q, got %+v", name, backup, s)
+		}
+	}
+	if reason := skipped["backup_backup-failed.cfg"].Reason; !strings.Contains(reason, "connection reset by peer") {
+		t.Errorf("Expected the error Longhorn recorded as the reason, got %q", reason)
+	}
+
+	volume.IncludeIncomplete()
+	var names []string
+	for _, backup := range volume.Backups {
+		names = append(names, backup.Identifier)
+	}
+	// the backup in progress is ordered by its snapshot
+	if expected := []string{"backup-failed", "backup-done", "backup-writing"}; !slices.Equal(names, expected) {
+		t.Errorf("Expected %v, got %v", expected, names)
+	}
+	if len(volume.Skipped) != 1 {
+		t.Errorf("Expected only the temporary file left skipped, got %+v", volume.Skipped)
+	}
+}
+
+func TestListBackupNames(t *testing.T) {
+	names, err := ListBackupNames(os.DirFS("testdata/live"), "volumes/3f/9a/pvc-live")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// the temporary cfg file of the next backup isn't one yet
+	if expected := []string{"backup-done", "backup-failed", "backup-writing"}; !slices.Equal(names, expected) {
+		t.Errorf("Expected %v, got %v", expected, names)
+	}
+
+	names, err = ListBackupNames(fstest.MapFS{"volumes/pvc-new/volume.cfg": {}}, "volumes/pvc-new")
+	if err != nil || len(names) != 0 {
+		t.Errorf("Expected no backups of a volume never backed up, got %v and %v", names, err)
+	}
+}
+
+func TestParseTimestamp(t *testing.T) {
+	expected := time.Date(2024, 3, 1, 8, 0, 2, 0, time.UTC)
+	tests := []struct {
+		name  string
+		value string
+		nanos int
+	}{
+		{name: "rfc3339", value: "2024-03-01T08:00:02Z"},
+		{name: "rfc3339 nano", value: "2024-03-01T08:00:02.123456789Z", nanos: 123456789},
+		{name: "offset", value: "2024-03-01T09:00:02+01:00"},
+		{name: "space separated", value: "2024-03-01 08:00:02Z"},
+		{name: "space separated offset", value: "2024-03-01 09:00:02+01:00"},
+		{name: "no zone", value: "2024-03-01 08:00:02"},
+		{name: "no zone fractional", value: "2024-03-01T08:00:02.5", nanos: 500000000},
+		{name: "go string", value: "2024-03-01 08:00:02.123 +0000 UTC", nanos: 123000000},
+		{name: "go string monotonic", value: "2024-03-01 08:00:02 +0000 UTC m=+3.000000001"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			timestamp, err := parseTimestamp(tt.value)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if expected := expected.Add(time.Duration(tt.nanos)); !timestamp.Equal(expected) {
+				t.Errorf("Expected %s, got %s", expected, timestamp)
+			}
+		})
+	}
+
+	for _, value := range []string{"", "yesterday", "2024-03-01", "01/03/2024 08:00:02"} {
+		if _, err := parseTimestamp(value); err == nil {
+			t.Errorf("Expected an error for %q", value)
+		}
+	}
+}
+
+func TestReadBackupsTimestampFallback(t *testing.T) {
+	checksum := strings.Repeat("ab", 64)
+	cfg := func(created string) *fstest.MapFile {
+		return &fstest.MapFile{Data: []byte(fmt.Sprintf(`{"CreatedTime": %q, "Size": "4096", "CompressionMethod": "lz4", "Blocks": [{"Offset": 0, "BlockChecksum": %q}]}`, created, checksum))}
+	}
+	modified := time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)
+	store := fstest.MapFS{
+		"volumes/pvc-1/backups/backup_nano.cfg":  cfg("2024-03-01T08:00:02.123456789Z"),
+		"volumes/pvc-1/backups/backup_space.cfg": cfg("2024-02-01 08:00:02"),
+		// very old versions recorded no CreatedTime
+		"volumes/pvc-1/backups/backup_old.cfg": {Data: cfg("").Data, ModTime: modified},
+		"volumes/pvc-1/backups/backup_odd.cfg": {Data: cfg("the first of march").Data, ModTime: modified.Add(time.Hour)},
+		// nothing to order it by
+		"volumes/pvc-1/backups/backup_lost.cfg": cfg("soon"),
+	}
+	volume, err := ReadBackups(store, "volumes/pvc-1")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var names []string
+	for _, backup := range volume.Backups {
+		names = append(names, backup.Identifier)
+	}
+	if expected := []string{"old", "odd", "space", "nano"}; !slices.Equal(names, expected) {
+		t.Fatalf("Expected %v, got %v", expected, names)
+	}
+	if !volume.Backups[0].Timestamp.Equal(modified) || !strings.Contains(volume.Backups[0].Warning, "no CreatedTime") {
+		t.Errorf("Expected the modification time with a warning, got %s and %q", volume.Backups[0].Timestamp, volume.Backups[0].Warning)
+	}
+	if !strings.Contains(volume.Backups[1].Warning, "the first of march") {
+		t.Errorf("Expected the warning to name the CreatedTime, got %q", volume.Backups[1].Warning)
+	}
+	if volume.Backups[2].Warning != "" || volume.Backups[3].Warning != "" {
+		t.Errorf("Expected no warning for a parsed CreatedTime, got %+v", volume.Backups[2:])
+	}
+	if len(volume.Skipped) != 1 || path.Base(volume.Skipped[0].Path) != "backup_lost.cfg" || volume.Skipped[0].Backup != nil {
+		t.Errorf("Expected only backup_lost.cfg to be skipped, got %+v", volume.Skipped)
+	}
+}
+
+func TestReadBackupsInvalidChecksum(t *testing.T) {
+	tests := []struct {
+		name     string
+		checksum string
+	}{
+		{name: "empty", checksum: ""},
+		{name: "short", checksum: "abc"},
+		{name: "not hex", checksum: strings.Repeat("zz", 64)},
+		{name: "too long", checksum: strings.Repeat("ab", 65)},
+		{name: "unrecognized length", checksum: strings.Repeat("ab", 48)},
+		{name: "sha256 not hex", checksum: strings.Repeat("zz", 32)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			if err := os.MkdirAll(filepath.Join(tmpDir, "backups"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			config := `{"CreatedTime": "2023-01-01T00:00:00Z", "Size": "4096", "CompressionMethod": "lz4", "Blocks": [
+				{"Offset": 0, "BlockChecksum": "` + strings.Repeat("ab", 64) + `"},
+				{"Offset": 2097152, "BlockChecksum": "` + tt.checksum + `"}]}`
+			if err := os.WriteFile(filepath.Join(tmpDir, "backups", "backup1.cfg"), []byte(config), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := ReadBackups(os.DirFS(tmpDir), ".")
+			if err == nil {
+				t.Fatal("Expected error but got none")
+			}
+			for _, expected := range []string{"backups/backup1.cfg", "block 1", "offset 2097152"} {
+				if !strings.Contains(err.Error(), expected) {
+					t.Errorf("Expected the error to mention %s, got %v", expected, err)
+				}
+			}
+		})
+	}
+
+}
+
+func TestBackupstoreLayouts(t *testing.T) {
+	tests := []struct {
+		name       string
+		volumePath string
+		blockPath  string
+	}{
+		{name: "canonical", volumePath: "volumes/5f/a2/pvc-123", blockPath: "blocks/ab/cd"},
+		{name: "deeper", volumePath: "volumes/extra/5f/a2/pvc-123", blockPath: "blocks/extra/ab/cd"},
+		{name: "shallower", volumePath: "volumes/pvc-123", blockPath: "blocks"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			volumeDir := filepath.Join(tmpDir, filepath.FromSlash(tt.volumePath))
+			blockDir := filepath.Join(volumeDir, filepath.FromSlash(tt.blockPath))
+			otherDir := filepath.Join(tmpDir, "volumes", "01", "02", "pvc-456", "backups")
+			for _, dir := range []string{blockDir, filepath.Join(volumeDir, "backups"), otherDir} {
+				if err := os.MkdirAll(dir, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.WriteFile(filepath.Join(blockDir, "abcdef.blk"), []byte("block"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			store := os.DirFS(tmpDir)
+
+			volumes, err := ListVolumes(store)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			expected := []string{"volumes/01/02/pvc-456", tt.volumePath}
+			if !slices.Equal(volumes, expected) {
+				t.Errorf("Expected volumes %v, got %v", expected, volumes)
+			}
+
+			volumePath, err := FindVolumeBackupPath(store, "pvc-123")
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if volumePath != tt.volumePath {
+				t.Errorf("Expected path %s, got %s", tt.volumePath, volumePath)
+			}
+
+			blockPath, err := ResolveBlockPath(store, volumePath, "abcdef")
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if expected := path.Join(tt.volumePath, tt.blockPath, "abcdef.blk"); blockPath != expected {
+				t.Errorf("Expected block at %s, got %s", expected, blockPath)
+			}
+			if _, err := ResolveBlockPath(store, volumePath, "missing"); err == nil {
+				t.Error("Expected error but got none")
+			}
+		})
+	}
+
+	empty := os.DirFS(t.TempDir())
+	if volumes, err := ListVolumes(empty); err != nil || len(volumes) != 0 {
+		t.Errorf("Expected no volumes in an empty backupstore, got %v and %v", volumes, err)
+	}
+	if _, err := FindVolumeBackupPath(empty, "pvc-123"); err == nil || !strings.Contains(err.Error(), "could not find backup for pvc-123") {
+		t.Errorf("Expected the volume not to be found, got %v", err)
+	}
+}
+
+// trackingFS counts the files open at once, and fails reads of the files
+// in broken
+type trackingFS struct {
+	fs.FS
+	broken  map[string]bool
+	open    int
+	maxOpen int
+}
+
+type trackedFile struct {
+	fs.File
+	fsys   *trackingFS
+	broken bool
+}
+
+func (t *trackingFS) Open(name string) (fs.File, error) {
+	f, err := t.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	t.open++
+	t.maxOpen = max(t.maxOpen, t.open)
+	return &trackedFile{File: f, fsys: t, broken: t.broken[name]}, nil
+}
+
+func (t *trackingFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return fs.ReadDir(t.FS, name)
+}
+
+func (f *trackedFile) Read(p []byte) (int, error) {
+	if f.broken {
+		return 0, errors.New("input/output error")
+	}
+	return f.File.Read(p)
+}
+
+func (f *trackedFile) Close() error {
+	f.fsys.open--
+	return f.File.Close()
+}
+
+func TestReadBackupsConfigErrors(t *testing.T) {
+	tmpDir := t.TempDir()
+	backupsDir := filepath.Join(tmpDir, "backups")
+	if err := os.MkdirAll(backupsDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for i := range 500 {
+		config := fmt.Sprintf(`{"CreatedTime": "2023-01-01T00:%02d:%02dZ", "Size": "1024", "CompressionMethod": "lz4", "Blocks": []}`, i/60, i%60)
+		if err := os.WriteFile(filepath.Join(backupsDir, fmt.Sprintf("backup-%03d.cfg", i)), []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store := &trackingFS{FS: os.DirFS(tmpDir)}
+	volumeBackup, err := ReadBackups(store, ".")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(volumeBackup.Backups) != 500 {
+		t.Errorf("Expected 500 backups, got %d", len(volumeBackup.Backups))
+	}
+	if store.maxOpen != 1 || store.open != 0 {
+		t.Errorf("Expected each cfg file closed before the next is opened, got %d open at once and %d left open", store.maxOpen, store.open)
+	}
+
+	store = &trackingFS{FS: os.DirFS(tmpDir), broken: map[string]bool{"backups/backup-250.cfg": true}}
+	_, err = ReadBackups(store, ".")
+	if err == nil || !strings.Contains(err.Error(), "backups/backup-250.cfg") || !strings.Contains(err.Error(), "input/output error") {
+		t.Errorf("Expected the read error for backup-250.cfg, got %v", err)
+	}
+	if store.open != 0 {
+		t.Errorf("Expected no cfg files left open after an error, got %d", store.open)
+	}
+
+	if err := os.WriteFile(filepath.Join(backupsDir, "backup-100.cfg"), []byte(`{"Size": `), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = ReadBackups(os.DirFS(tmpDir), ".")
+	if err == nil || !strings.Contains(err.Error(), "backups/backup-100.cfg") {
+		t.Errorf("Expected a parse error naming backup-100.cfg, got %v", err)
+	}
+}
+
+func TestResolveBlockPath(t *testing.T) {
+	// Create temporary test directory with mock block
+	tmpDir := t.TempDir()
+	blocksDir := filepath.Join(tmpDir, "blocks", "ab", "cd")
+	err := os.MkdirAll(blocksDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mockBlockPath := filepath.Join(blocksDir, "testchecksum.blk")
+	err = os.WriteFile(mockBlockPath, []byte("test"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		backupPath    string
+		checksum      string
+		expectedError bool
+	}{
+		{
+			name:          "Valid block",
+			backupPath:    tmpDir,
+			checksum:      "testchecksum",
+			expectedError: false,
+		},
+		{
+			name:          "Non-existent block",
+			backupPath:    tmpDir,
+			checksum:      "nonexistent",
+			expectedError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ResolveBlockPath(os.DirFS(tt.backupPath), ".", tt.checksum)
+			if tt.expectedError && err == nil {
+				t.Error("Expected error but got none")
+			}
+			if !tt.expectedError && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestListBlocks(t *testing.T) {
+	tmpDir := t.TempDir()
+	for _, name := range []string{"blocks/ab/cd/abcd01.blk", "blocks/ef01.blk", "blocks/ab/notes.txt"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(tmpDir, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(tmpDir, name), []byte("test"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	blocks, err := ListBlocks(os.DirFS(tmpDir), ".")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := map[string]string{"abcd01": "blocks/ab/cd/abcd01.blk", "ef01": "blocks/ef01.blk"}
+	if !maps.Equal(blocks, expected) {
+		t.Errorf("Expected %v, got %v", expected, blocks)
+	}
+
+	// a volume that was never backed up has no blocks tree
+	blocks, err = ListBlocks(os.DirFS(t.TempDir()), ".")
+	if err != nil || len(blocks) != 0 {
+		t.Errorf("Expected no blocks, got %v and %v", blocks, err)
+	}
+}
+
+func TestDecompression(t *testing.T) {
+	test_string := "hello world"
+	r := strings.NewReader(test_string)
+
+	pr, pw := io.Pipe()
+	zw := lz4.NewWriter(pw)
+	defer zw.Close()
+
+	go func() {
+		_, _ = io.Copy(zw, r)
+		_ = zw.Close()
+		_ = pw.Close()
+	}()
+
+	compressed_data_lz4, _ := io.ReadAll(pr)
+
+	pr2, pw2 := io.Pipe()
+	zw2 := gzip.NewWriter(pw2)
+	r2 := strings.NewReader(test_string)
+
+	go func() {
+		_, _ = io.Copy(zw2, r2)
+		zw2.Close()
+		pw2.Close()
+	}()
+
+	compressed_data_gzip, _ := io.ReadAll(pr2)
+
+	zw3, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed_data_zstd := zw3.EncodeAll([]byte(test_string), nil)
+	zw3.Close()
+
+	t.Log(string(compressed_data_gzip))
+	tests := []struct {
+		name          string
+		data          []byte
+		compression   string
+		expectedError bool
+	}{
+		{
+			name:          "Decompress LZ4",
+			data:          compressed_data_lz4,
+			compression:   "lz4",
+			expectedError: false,
+		},
+
+		{
+			name:          "Decompress GZIP",
+			data:          compressed_data_gzip,
+			compression:   "gzip",
+			expectedError: false,
+		},
+
+		{
+			name:          "Decompress ZSTD",
+			data:          compressed_data_zstd,
+			compression:   "zstd",
+			expectedError: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decompressed_data, err := DecompressLZ4(tt.data)
+			if tt.compression == "gzip" {
+				decompressed_data, err = DecompressGZIP(tt.data)
+			} else if tt.compression == "lz4" {
+				decompressed_data, err = DecompressLZ4(tt.data)
+			} else if tt.compression == "zstd" {
+				decompressed_data, err = DecompressZSTD(tt.data)
+			}
+			if tt.expectedError && err == nil {
+				t.Error("Expected error but got none")
+			}
+			if !tt.expectedError && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			if string(decompressed_data) != test_string {
+				t.Errorf("Expected '%s', got '%s'", test_string, string(decompressed_data))
+			}
+		})
+	}
+}
@@ -0,0 +1,448 @@
+package backupstore
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"slices"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Compressions are the CompressionMethod values Longhorn writes
+var Compressions = []string{"none", "gzip", "lz4", "zstd"}
+
+// LZ4Block is how a block of an lz4 backup is decompressed when it is a
+// bare lz4 block rather than a frame, as an older Longhorn version wrote
+// them. It is never a CompressionMethod.
+const LZ4Block = "lz4-block"
+
+// lz4FrameMagic starts every lz4 frame. A bare lz4 block never starts
+// with it, as its first sequence would copy from before the start of the
+// block.
+var lz4FrameMagic = []byte{0x04, 0x22, 0x4d, 0x18}
+
+// BlockError is a block that is missing from the backupstore or can't be
+// decompressed
+type BlockError struct {
+	Err error
+}
+
+func (e *BlockError) Error() string { return e.Err.Error() }
+func (e *BlockError) Unwrap() error { return e.Err }
+
+// ChecksumMismatchError is a block whose content doesn't match the
+// checksum it is stored under
+type ChecksumMismatchError struct {
+	Path     string
+	Expected string
+	Actual   string
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("checksum mismatch for block %s: expected %s, got %s", e.Path, e.Expected, e.Actual)
+}
+
+// BlockSizeError is a block that doesn't decompress to the block size of
+// its backup, which is corruption or a format change rather than a block
+// to write short. Offset is -1 for a block file checked on its own.
+type BlockSizeError struct {
+	Checksum string
+	Offset   int64
+	Expected int64
+	Actual   int64
+}
+
+func (e *BlockSizeError) Error() string {
+	if e.Offset < 0 {
+		return fmt.Sprintf("block %s decompresses to %d bytes, expected %d", e.Checksum, e.Actual, e.Expected)
+	}
+	return fmt.Sprintf("block %s at offset %d decompresses to %d bytes, expected %d", e.Checksum, e.Offset, e.Actual, e.Expected)
+}
+
+// checkBlockSize returns a *BlockError for a block that decompressed to n
+// bytes rather than size, unless size is 0 for a block of unknown size
+func checkBlockSize(block Block, size, n int64) error {
+	if size > 0 && n != size {
+		return &BlockError{&BlockSizeError{Checksum: block.Checksum, Offset: block.Offset, Expected: size, Actual: n}}
+	}
+	return nil
+}
+
+// MaxBlockSize is the size of the blocks Longhorn backs a volume up in,
+// the last one of a volume included as it is padded, unless the backup
+// records another BlockSize. A block of unknown size is read up to it,
+// rather than following a corrupt or malicious stream.
+const MaxBlockSize = 2 << 20
+
+// ErrBlockTooLarge is a block that decompresses to more than its size
+var ErrBlockTooLarge = errors.New("block decompresses to more than its size")
+
+// blockReader reads the uncompressed content of a block, failing with
+// ErrBlockTooLarge rather than returning anything past its size
+type blockReader struct {
+	r    io.Reader
+	size int64
+	left int64
+	err  error
+}
+
+// newBlockReader bounds r by size, or by MaxBlockSize when size is 0
+func newBlockReader(r io.Reader, size int64) *blockReader {
+	if size <= 0 {
+		size = MaxBlockSize
+	}
+	return &blockReader{r: r, size: size, left: size}
+}
+
+func (b *blockReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > b.left+1 {
+		p = p[:b.left+1]
+	}
+	n, err := b.r.Read(p)
+	if int64(n) > b.left {
+		b.err = fmt.Errorf("%w of %d bytes", ErrBlockTooLarge, b.size)
+		return 0, b.err
+	}
+	b.left -= int64(n)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+// errorReader remembers the error reading r failed with, to tell a block
+// that can't be read from one that can't be decompressed
+type errorReader struct {
+	r   io.Reader
+	err error
+}
+
+func (e *errorReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil && err != io.EOF {
+		e.err = err
+	}
+	return n, err
+}
+
+// decompressor returns a reader of the uncompressed content of a block
+// stored with compression, and how it is decompressed: compression, or
+// LZ4Block for an lz4 block that isn't a frame. size is what the block
+// decompresses to, or 0 if unknown.
+func decompressor(r io.Reader, compression string, size int64) (io.ReadCloser, string, error) {
+	switch compression {
+	case "lz4":
+		return lz4Decompressor(r, size)
+	case "gzip":
+		d, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, compression, err
+		}
+		return d, compression, nil
+	case "zstd":
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, compression, err
+		}
+		return d.IOReadCloser(), compression, nil
+	case "none":
+		return io.NopCloser(r), compression, nil
+	default:
+		return nil, compression, fmt.Errorf("unsupported compression method %q", compression)
+	}
+}
+
+// lz4Decompressor reads an lz4 frame, falling back to the bare lz4 block
+// format when r doesn't start with a frame. A block is decompressed
+// whole, into at most size bytes, or MaxBlockSize when size is 0, as the
+// block format can't be read as a stream.
+func lz4Decompressor(r io.Reader, size int64) (io.ReadCloser, string, error) {
+	if size <= 0 {
+		size = MaxBlockSize
+	}
+	buffered := bufio.NewReader(r)
+	magic, err := buffered.Peek(len(lz4FrameMagic))
+	if bytes.Equal(magic, lz4FrameMagic) {
+		return io.NopCloser(lz4.NewReader(buffered)), "lz4", nil
+	}
+	if err != nil && err != io.EOF {
+		return nil, "lz4", err
+	}
+	compressed, err := io.ReadAll(io.LimitReader(buffered, int64(lz4.CompressBlockBound(int(size)))+1))
+	if err != nil {
+		return nil, LZ4Block, err
+	}
+	data := make([]byte, size)
+	n, err := lz4.UncompressBlock(compressed, data)
+	if err != nil {
+		return nil, LZ4Block, fmt.Errorf("neither an lz4 frame nor an lz4 block: %w", err)
+	}
+	return io.NopCloser(bytes.NewReader(data[:n])), LZ4Block, nil
+}
+
+// decompress returns the uncompressed content of a block, and how it was
+// decompressed, see decompressor
+func decompress(data []byte, compression string, size int64) ([]byte, string, error) {
+	r, decoding, err := decompressor(bytes.NewReader(data), compression, size)
+	if err != nil {
+		return nil, decoding, err
+	}
+	defer r.Close()
+	data, err = readBlock(r, size)
+	return data, decoding, err
+}
+
+// readBlock reads the uncompressed content of a block from r into a
+// buffer of size, which a block of unknown size grows as it is read
+func readBlock(r io.Reader, size int64) ([]byte, error) {
+	uncompressed := newBlockReader(r, size)
+	if size <= 0 {
+		return io.ReadAll(uncompressed)
+	}
+	data := make([]byte, size)
+	n, err := io.ReadFull(uncompressed, data)
+	switch err {
+	case io.EOF, io.ErrUnexpectedEOF:
+		return data[:n], nil
+	case nil:
+		// anything left past size fails the block reader
+		if _, err = io.ReadFull(uncompressed, make([]byte, 1)); err == io.EOF {
+			err = nil
+		}
+	}
+	return data[:n], err
+}
+
+// DecompressLZ4 decompresses a block stored as an lz4 frame, or as a bare
+// lz4 block
+func DecompressLZ4(data []byte) ([]byte, error) {
+	data, _, err := decompress(data, "lz4", 0)
+	return data, err
+}
+
+// DecompressGZIP decompresses a block stored gzipped, as backups from
+// before Longhorn recorded the compression method are
+func DecompressGZIP(data []byte) ([]byte, error) {
+	data, _, err := decompress(data, "gzip", 0)
+	return data, err
+}
+
+// DecompressZSTD decompresses a block stored as a zstd frame
+func DecompressZSTD(data []byte) ([]byte, error) {
+	data, _, err := decompress(data, "zstd", 0)
+	return data, err
+}
+
+// checksumAlgorithms are the hashes a block can be named after, by the
+// length of its hex checksum. Longhorn has only used SHA-512; the others
+// are for stores built by hand, or should that ever change.
+var checksumAlgorithms = map[int]struct {
+	name string
+	new  func() hash.Hash
+}{
+	sha512.Size * 2: {"sha512", sha512.New},
+	sha256.Size * 2: {"sha256", sha256.New},
+	sha1.Size * 2:   {"sha1", sha1.New},
+}
+
+// ChecksumAlgorithm returns the hash a block named checksum is checked
+// with, detected from its length: sha512, sha256 or sha1
+func ChecksumAlgorithm(checksum string) (string, error) {
+	algorithm, ok := checksumAlgorithms[len(checksum)]
+	if !ok {
+		return "", fmt.Errorf("expected %d hex characters for SHA-512, %d for SHA-256 or %d for SHA-1, got %d",
+			sha512.Size*2, sha256.Size*2, sha1.Size*2, len(checksum))
+	}
+	if _, err := hex.DecodeString(checksum); err != nil {
+		return "", errors.New("not hexadecimal")
+	}
+	return algorithm.name, nil
+}
+
+// newChecksumHash returns the hash of the algorithm checksum is of,
+// SHA-512 unless its length says otherwise
+func newChecksumHash(checksum string) hash.Hash {
+	if algorithm, ok := checksumAlgorithms[len(checksum)]; ok {
+		return algorithm.new()
+	}
+	return sha512.New()
+}
+
+// VerifyBlockChecksum checks data against the checksum its block is named
+// after. Longhorn names each block after the SHA-512 of its uncompressed
+// content, the same check longhorn-engine does when restoring; shorter
+// checksums are checked with the hash ChecksumAlgorithm detects.
+func VerifyBlockChecksum(blockPath string, data []byte, checksum string) error {
+	h := newChecksumHash(checksum)
+	h.Write(data)
+	return checkBlockSum(blockPath, h.Sum(nil), checksum)
+}
+
+func checkBlockSum(blockPath string, sum []byte, checksum string) error {
+	actual := hex.EncodeToString(sum)
+	if actual != strings.ToLower(checksum) {
+		return &ChecksumMismatchError{Path: blockPath, Expected: checksum, Actual: actual}
+	}
+	return nil
+}
+
+// ValidateChecksum checks that checksum is the hex hash of a recognized
+// ChecksumAlgorithm, the name every block is stored under
+func ValidateChecksum(checksum string) error {
+	_, err := ChecksumAlgorithm(checksum)
+	return err
+}
+
+// LoadBlock reads a block of the volume in backupPath, decompresses it
+// and checks it against its checksum. A block that fails the check is
+// still returned, along with the *ChecksumMismatchError. size is the
+// BlockSize of its backup, which the block must decompress to exactly,
+// or 0 to only bound it by MaxBlockSize.
+func LoadBlock(store fs.FS, backupPath string, block Block, compression string, size int64) ([]byte, error) {
+	blockPath, blockData, err := readBlockFile(store, backupPath, block)
+	if err != nil {
+		return nil, err
+	}
+	data, _, err := decodeBlock(blockPath, blockData, block, compression, size)
+	return data, err
+}
+
+// ReadRawBlock returns the content of the file of a block as it is
+// stored, compressed with compression, once it has been decompressed and
+// checked against its checksum and size, as LoadBlock does
+func ReadRawBlock(store fs.FS, backupPath string, block Block, compression string, size int64) ([]byte, error) {
+	blockPath, blockData, err := readBlockFile(store, backupPath, block)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := decodeBlock(blockPath, blockData, block, compression, size); err != nil {
+		return nil, err
+	}
+	return blockData, nil
+}
+
+// readBlockFile returns the path and compressed content of a block
+func readBlockFile(store fs.FS, backupPath string, block Block) (string, []byte, error) {
+	blockPath, err := ResolveBlockPath(store, backupPath, block.Checksum)
+	if err != nil {
+		return "", nil, &BlockError{fmt.Errorf("failed to resolve block %s: %w", block.Checksum, err)}
+	}
+
+	blockData, err := fs.ReadFile(store, blockPath)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read block %s: %w", block.Checksum, err)
+	}
+	return blockPath, blockData, nil
+}
+
+// decodeBlock decompresses the content of the block read from blockPath
+// and checks it against its size and checksum, returning it even if the
+// checksum fails, along with how it was decompressed
+func decodeBlock(blockPath string, blockData []byte, block Block, compression string, size int64) ([]byte, string, error) {
+	if !slices.Contains(Compressions, compression) {
+		return nil, compression, fmt.Errorf("unsupported compression method %q for block %s", compression, block.Checksum)
+	}
+	blockData, decoding, err := decompress(blockData, compression, size)
+	if err != nil {
+		return nil, decoding, &BlockError{fmt.Errorf("failed to decompress block %s: %w", block.Checksum, err)}
+	}
+	if err := checkBlockSize(block, size, int64(len(blockData))); err != nil {
+		return nil, decoding, err
+	}
+
+	return blockData, decoding, VerifyBlockChecksum(blockPath, blockData, block.Checksum)
+}
+
+// CopyBlock decompresses a block of the volume in backupPath into dst as
+// it is read, using buf as io.CopyBuffer does, so no more than buf is
+// held in memory. The checksum can only be checked once the whole block
+// has been copied, so dst may have taken a corrupt block by the time
+// that fails. Errors from dst are returned as they are. size is as for
+// LoadBlock, and is checked once the block has been copied.
+func CopyBlock(dst io.Writer, store fs.FS, backupPath string, block Block, compression string, size int64, buf []byte) (int64, error) {
+	n, _, err := copyBlock(dst, store, backupPath, block, compression, size, buf)
+	return n, err
+}
+
+// copyBlock is CopyBlock, also returning how the block was decompressed
+func copyBlock(dst io.Writer, store fs.FS, backupPath string, block Block, compression string, size int64, buf []byte) (int64, string, error) {
+	blockPath, err := ResolveBlockPath(store, backupPath, block.Checksum)
+	if err != nil {
+		return 0, compression, &BlockError{fmt.Errorf("failed to resolve block %s: %w", block.Checksum, err)}
+	}
+	return copyBlockFile(dst, store, blockPath, block, compression, size, buf)
+}
+
+// CopyBlockFile is CopyBlock for the block file at blockPath, found
+// beforehand with StatBlock
+func CopyBlockFile(dst io.Writer, store fs.FS, blockPath, checksum, compression string, size int64, buf []byte) (int64, error) {
+	n, _, err := copyBlockFile(dst, store, blockPath, Block{Offset: -1, Checksum: checksum}, compression, size, buf)
+	return n, err
+}
+
+// VerifyBlockFile decompresses the block file at blockPath as it is read
+// and checks it against checksum and size, holding no more than buf in
+// memory
+func VerifyBlockFile(store fs.FS, blockPath, checksum, compression string, size int64, buf []byte) error {
+	_, _, err := copyBlockFile(io.Discard, store, blockPath, Block{Offset: -1, Checksum: checksum}, compression, size, buf)
+	return err
+}
+
+func copyBlockFile(dst io.Writer, store fs.FS, blockPath string, block Block, compression string, size int64, buf []byte) (int64, string, error) {
+	f, err := store.Open(blockPath)
+	if err != nil {
+		return 0, compression, fmt.Errorf("failed to read block %s: %w", block.Checksum, err)
+	}
+	defer f.Close()
+	source := &errorReader{r: f}
+	r, decoding, err := decompressor(source, compression, size)
+	if err != nil {
+		if source.err != nil {
+			return 0, decoding, fmt.Errorf("failed to read block %s: %w", block.Checksum, source.err)
+		}
+		return 0, decoding, &BlockError{fmt.Errorf("failed to decompress block %s: %w", block.Checksum, err)}
+	}
+	defer r.Close()
+
+	uncompressed := newBlockReader(r, size)
+	sum := newChecksumHash(block.Checksum)
+	n, err := io.CopyBuffer(io.MultiWriter(sum, dst), uncompressed, buf)
+	switch {
+	case source.err != nil:
+		return n, decoding, fmt.Errorf("failed to read block %s: %w", block.Checksum, source.err)
+	case uncompressed.err != nil:
+		return n, decoding, &BlockError{fmt.Errorf("failed to decompress block %s: %w", block.Checksum, uncompressed.err)}
+	case err != nil:
+		return n, decoding, err
+	}
+	if err := checkBlockSize(block, size, n); err != nil {
+		return n, decoding, err
+	}
+	return n, decoding, checkBlockSum(blockPath, sum.Sum(nil), block.Checksum)
+}
+
+var zeroPage [4096]byte
+
+// IsZeroBlock reports whether data is all zeroes
+func IsZeroBlock(data []byte) bool {
+	for len(data) > 0 {
+		n := min(len(data), len(zeroPage))
+		if !bytes.Equal(data[:n], zeroPage[:n]) {
+			return false
+		}
+		data = data[n:]
+	}
+	return true
+}
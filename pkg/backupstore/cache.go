@@ -0,0 +1,127 @@
+package backupstore
+
+import (
+	"container/list"
+	"io/fs"
+	"sync"
+)
+
+// BlockCache keeps recently loaded blocks by checksum, so a block that
+// several backups or offsets of a chain share is only read and
+// decompressed once, even when they are loaded at the same time. It is
+// safe for concurrent use, and a nil *BlockCache loads every block from
+// the store.
+type BlockCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	lru      *list.List
+	entries  map[string]*list.Element
+	loading  map[string]*blockLoad
+	hits     int64
+	misses   int64
+}
+
+type cachedBlock struct {
+	checksum string
+	data     []byte
+}
+
+// blockLoad is a block being loaded, which done is closed on
+type blockLoad struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+func (l *blockLoad) wait() ([]byte, error) {
+	<-l.done
+	return l.data, l.err
+}
+
+// NewBlockCache returns a cache holding up to maxBytes of decompressed
+// blocks, evicting the least recently used first
+func NewBlockCache(maxBytes int64) *BlockCache {
+	return &BlockCache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+		loading:  make(map[string]*blockLoad),
+	}
+}
+
+// Load returns the block from the cache, or loads it with LoadBlock and
+// keeps it. Blocks are shared between callers, who must not modify them.
+func (c *BlockCache) Load(store fs.FS, backupPath string, block Block, compression string, size int64) ([]byte, error) {
+	if c == nil {
+		return LoadBlock(store, backupPath, block, compression, size)
+	}
+	data, loading, hit := c.start(block.Checksum)
+	if loading != nil {
+		return loading.wait()
+	}
+	if hit {
+		return data, nil
+	}
+	data, err := LoadBlock(store, backupPath, block, compression, size)
+	c.finish(block.Checksum, data, err)
+	return data, err
+}
+
+// Stats returns how many loads were answered from the cache and how many
+// went to the store
+func (c *BlockCache) Stats() (hits, misses int64) {
+	if c == nil {
+		return 0, 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses
+}
+
+// start looks checksum up. A cached block is returned as a hit, and one
+// another caller is loading as the load to wait for. Otherwise the caller
+// loads it and must pass the outcome to finish.
+func (c *BlockCache) start(checksum string) ([]byte, *blockLoad, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[checksum]; ok {
+		c.hits++
+		c.lru.MoveToFront(element)
+		return element.Value.(*cachedBlock).data, nil, true
+	}
+	if loading, ok := c.loading[checksum]; ok {
+		c.hits++
+		return nil, loading, true
+	}
+	c.misses++
+	c.loading[checksum] = &blockLoad{done: make(chan struct{})}
+	return nil, nil, false
+}
+
+// finish keeps a block loaded after start missed, and hands it to the
+// callers waiting for it. Failed loads are not kept.
+func (c *BlockCache) finish(checksum string, data []byte, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	loading := c.loading[checksum]
+	delete(c.loading, checksum)
+	loading.data, loading.err = data, err
+	close(loading.done)
+	if err != nil {
+		return
+	}
+
+	size := int64(len(data))
+	if size > c.maxBytes {
+		return
+	}
+	for c.size+size > c.maxBytes {
+		oldest := c.lru.Back()
+		evicted := c.lru.Remove(oldest).(*cachedBlock)
+		delete(c.entries, evicted.checksum)
+		c.size -= int64(len(evicted.data))
+	}
+	c.entries[checksum] = c.lru.PushFront(&cachedBlock{checksum: checksum, data: data})
+	c.size += size
+}
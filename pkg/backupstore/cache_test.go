@@ -0,0 +1,122 @@
+package backupstore
+
+import (
+	"bytes"
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// countingFS counts how many times each block file is read, rather than
+// just opened to stat it
+type countingFS struct {
+	fs.FS
+	reads map[string]int
+}
+
+type countedFile struct {
+	fs.File
+	read func()
+}
+
+func (c *countingFS) Open(name string) (fs.File, error) {
+	f, err := c.FS.Open(name)
+	if err != nil || !strings.HasSuffix(name, ".blk") {
+		return f, err
+	}
+	return &countedFile{File: f, read: func() { c.reads[name]++ }}, nil
+}
+
+func (f *countedFile) Read(p []byte) (int, error) {
+	if f.read != nil {
+		f.read()
+		f.read = nil
+	}
+	return f.File.Read(p)
+}
+
+func TestRepackCache(t *testing.T) {
+	volumePath := t.TempDir()
+	blockSize := 4096
+	shared := writeTestBlock(t, volumePath, testBlockData(1, blockSize))
+	other := writeTestBlock(t, volumePath, testBlockData(2, blockSize))
+	backups := []Backup{
+		{Identifier: "backup-1", Compression: "lz4", Blocks: []Block{{Offset: 0, Checksum: shared}, {Offset: 4096, Checksum: other}}},
+		{Identifier: "backup-2", Compression: "lz4", Blocks: []Block{{Offset: 8192, Checksum: shared}, {Offset: 12288, Checksum: shared}}},
+	}
+
+	out, err := os.Create(filepath.Join(t.TempDir(), "out.raw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	store := &countingFS{FS: os.DirFS(volumePath), reads: make(map[string]int)}
+	cache := NewBlockCache(1 << 20)
+	if err := Repack(context.Background(), store, ".", backups, out, RepackOptions{Jobs: 1, Cache: cache}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(store.reads) != 2 {
+		t.Errorf("Expected 2 blocks read, got %d", len(store.reads))
+	}
+	for name, reads := range store.reads {
+		if reads != 1 {
+			t.Errorf("Expected %s to be read once, got %d", name, reads)
+		}
+	}
+	if hits, misses := cache.Stats(); hits != 2 || misses != 2 {
+		t.Errorf("Expected 2 hits and 2 misses, got %d and %d", hits, misses)
+	}
+
+	content, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := testBlockData(1, blockSize)
+	expected := bytes.Join([][]byte{first, testBlockData(2, blockSize), first, first}, nil)
+	if !bytes.Equal(content, expected) {
+		t.Error("Restored image does not match expected content")
+	}
+}
+
+func TestBlockCacheEviction(t *testing.T) {
+	volumePath := t.TempDir()
+	blockSize := 4096
+	first := Block{Checksum: writeTestBlock(t, volumePath, testBlockData(1, blockSize))}
+	second := Block{Checksum: writeTestBlock(t, volumePath, testBlockData(2, blockSize))}
+	third := Block{Checksum: writeTestBlock(t, volumePath, testBlockData(3, blockSize))}
+	store := &countingFS{FS: os.DirFS(volumePath), reads: make(map[string]int)}
+
+	// room for two blocks
+	cache := NewBlockCache(int64(2 * blockSize))
+	for _, block := range []Block{first, second, first, third, second, first} {
+		if _, err := cache.Load(store, ".", block, "lz4", 0); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	// third evicts second, the least recently used, which then evicts first
+	if hits, misses := cache.Stats(); hits != 1 || misses != 5 {
+		t.Errorf("Expected 1 hit and 5 misses, got %d and %d", hits, misses)
+	}
+
+	small := NewBlockCache(int64(blockSize - 1))
+	for range 2 {
+		if _, err := small.Load(store, ".", first, "lz4", 0); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if hits, _ := small.Stats(); hits != 0 {
+		t.Errorf("Expected a block larger than the cache not to be kept, got %d hits", hits)
+	}
+
+	var disabled *BlockCache
+	if _, err := disabled.Load(store, ".", first, "lz4", 0); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if hits, misses := disabled.Stats(); hits != 0 || misses != 0 {
+		t.Errorf("Expected a nil cache to count nothing, got %d hits and %d misses", hits, misses)
+	}
+}
@@ -0,0 +1,118 @@
+package backupstore
+
+import (
+	"cmp"
+	"errors"
+	"io/fs"
+	"slices"
+	"sync"
+)
+
+// MismatchPolicy is what a restore does with a block whose content
+// doesn't match its checksum
+type MismatchPolicy int
+
+const (
+	// MismatchFail stops the restore with the *ChecksumMismatchError
+	MismatchFail MismatchPolicy = iota
+	// MismatchWarn writes the block as it is
+	MismatchWarn
+	// MismatchSkip leaves the region of the block untouched, so it reads
+	// as zeroes in a fresh image
+	MismatchSkip
+)
+
+// MissingPolicy is what a restore does with a block whose file is not in
+// the store
+type MissingPolicy int
+
+const (
+	// MissingFail stops the restore with the *BlockError
+	MissingFail MissingPolicy = iota
+	// MissingZero restores the block as zeroes, which a sparse image
+	// already reads as
+	MissingZero
+)
+
+// Actions taken on a damaged block, as recorded in a DamageReport
+const (
+	ActionWritten = "written"
+	ActionSkipped = "skipped"
+	ActionZeroed  = "zero-filled"
+)
+
+// Tolerate returns the action p takes on a block that failed with err, or
+// false if err is to stop the restore
+func (p MismatchPolicy) Tolerate(err error) (string, bool) {
+	var mismatch *ChecksumMismatchError
+	if !errors.As(err, &mismatch) {
+		return "", false
+	}
+	switch p {
+	case MismatchWarn:
+		return ActionWritten, true
+	case MismatchSkip:
+		return ActionSkipped, true
+	}
+	return "", false
+}
+
+// Tolerate returns the action p takes on a block that failed with err, or
+// false if err is to stop the restore. Only a block the store doesn't
+// have is tolerated, not one that couldn't be read.
+func (p MissingPolicy) Tolerate(err error) (string, bool) {
+	if p == MissingZero && errors.Is(err, fs.ErrNotExist) {
+		return ActionZeroed, true
+	}
+	return "", false
+}
+
+// ZeroExtent is the length of the region MissingZero fills for the block
+// at blocks[i] of a FinalBlockMap: a whole Longhorn block, or up to the
+// next block
+func ZeroExtent(blocks []MappedBlock, i int) int64 {
+	n := int64(MaxBlockSize)
+	if i+1 < len(blocks) {
+		n = min(n, blocks[i+1].Offset-blocks[i].Offset)
+	}
+	return n
+}
+
+// DamagedBlock is a block a restore went on without, or with despite
+// Err, and what it did instead of failing
+type DamagedBlock struct {
+	Block
+	Err    error
+	Action string
+}
+
+// DamageReport collects the damaged blocks of a restore. It is safe for
+// concurrent use, and a nil *DamageReport records nothing.
+type DamageReport struct {
+	mu     sync.Mutex
+	blocks []DamagedBlock
+}
+
+// Add records that action was taken on block after it failed with err
+func (r *DamageReport) Add(block Block, err error, action string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.blocks = append(r.blocks, DamagedBlock{Block: block, Err: err, Action: action})
+}
+
+// Blocks returns the damaged blocks recorded, sorted by offset
+func (r *DamageReport) Blocks() []DamagedBlock {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	blocks := slices.Clone(r.blocks)
+	slices.SortFunc(blocks, func(a, b DamagedBlock) int {
+		return cmp.Compare(a.Offset, b.Offset)
+	})
+	return blocks
+}
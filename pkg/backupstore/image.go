@@ -0,0 +1,92 @@
+package backupstore
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"sort"
+)
+
+// ImageReader reads the image a chain of backups restores to, without
+// restoring it. The block that ends up at an offset is only loaded, through
+// the cache, once a read reaches it, and offsets no block covers read as
+// zeroes.
+type ImageReader struct {
+	store      fs.FS
+	backupPath string
+	blocks     []MappedBlock
+	size       int64
+	cache      *BlockCache
+}
+
+// NewImageReader returns a reader of the image of size bytes that backups,
+// oldest first, restore to. A size of 0 ends the image with its last
+// block, which is loaded to find where that is.
+func NewImageReader(store fs.FS, backupPath string, backups []Backup, size int64, cache *BlockCache) (*ImageReader, error) {
+	r := &ImageReader{
+		store:      store,
+		backupPath: backupPath,
+		blocks:     FinalBlockMap(backups),
+		size:       size,
+		cache:      cache,
+	}
+	if size <= 0 && len(r.blocks) > 0 {
+		last := r.blocks[len(r.blocks)-1]
+		data, err := cache.Load(store, backupPath, last.Block, last.Compression, last.BlockSize)
+		if err != nil {
+			return nil, err
+		}
+		r.size = last.Offset + int64(len(data))
+	}
+	return r, nil
+}
+
+// Size is the size of the image
+func (r *ImageReader) Size() int64 {
+	return r.size
+}
+
+// ReadAt reads the image at off, loading the blocks it covers
+func (r *ImageReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	n := 0
+	for n < len(p) && off < r.size {
+		chunk := p[n:]
+		if int64(len(chunk)) > r.size-off {
+			chunk = chunk[:r.size-off]
+		}
+		// the block at or before off, which ends at the next one at most
+		i := sort.Search(len(r.blocks), func(i int) bool {
+			return r.blocks[i].Offset > off
+		}) - 1
+		next := r.size
+		if i+1 < len(r.blocks) {
+			next = r.blocks[i+1].Offset
+		}
+		if int64(len(chunk)) > next-off {
+			chunk = chunk[:next-off]
+		}
+
+		var data []byte
+		if i >= 0 {
+			block := r.blocks[i]
+			loaded, err := r.cache.Load(r.store, r.backupPath, block.Block, block.Compression, block.BlockSize)
+			if err != nil {
+				return n, err
+			}
+			if start := off - block.Offset; start < int64(len(loaded)) {
+				data = loaded[start:]
+			}
+		}
+		copied := copy(chunk, data)
+		clear(chunk[copied:])
+		n += len(chunk)
+		off += int64(len(chunk))
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,79 @@
+package backupstore
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestImageReader(t *testing.T) {
+	volumePath := t.TempDir()
+	blockSize := 4096
+	first := writeTestBlock(t, volumePath, testBlockData(1, blockSize))
+	second := writeTestBlock(t, volumePath, testBlockData(2, blockSize))
+	newer := writeTestBlock(t, volumePath, testBlockData(3, blockSize))
+	short := writeTestBlock(t, volumePath, testBlockData(4, 1000))
+	backups := []Backup{
+		{Identifier: "backup-1", Compression: "lz4", Blocks: []Block{{Offset: 0, Checksum: first}, {Offset: 8192, Checksum: second}}},
+		{Identifier: "backup-2", Compression: "lz4", Blocks: []Block{{Offset: 0, Checksum: newer}, {Offset: 16384, Checksum: short}}},
+	}
+	// the newest block at each offset, with zeroes where no block is
+	expected := make([]byte, 20480)
+	copy(expected, testBlockData(3, blockSize))
+	copy(expected[8192:], testBlockData(2, blockSize))
+	copy(expected[16384:], testBlockData(4, 1000))
+
+	store := &countingFS{FS: os.DirFS(volumePath), reads: make(map[string]int)}
+	image, err := NewImageReader(store, ".", backups, int64(len(expected)), NewBlockCache(1<<20))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// a read within a block loads that block alone
+	part := make([]byte, 100)
+	if _, err := image.ReadAt(part, 8200); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !bytes.Equal(part, expected[8200:8300]) {
+		t.Errorf("Expected the bytes of the block at 8192")
+	}
+	if len(store.reads) != 1 {
+		t.Errorf("Expected 1 block read, got %d", len(store.reads))
+	}
+
+	tests := []struct {
+		name   string
+		offset int64
+		length int
+		err    error
+	}{
+		{"whole image", 0, len(expected), nil},
+		{"across blocks and a hole", 4000, 5000, nil},
+		{"after a short block", 17000, 2000, nil},
+		{"past the end", 20000, 1000, io.EOF},
+		{"at the end", 20480, 10, io.EOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := bytes.Repeat([]byte{0xFF}, tt.length)
+			n, err := image.ReadAt(p, tt.offset)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Expected error %v, got %v", tt.err, err)
+			}
+			end := min(tt.offset+int64(tt.length), int64(len(expected)))
+			if n != int(max(end-tt.offset, 0)) || !bytes.Equal(p[:n], expected[tt.offset:end]) {
+				t.Errorf("Expected %d bytes of the image, got %d that differ", end-tt.offset, n)
+			}
+		})
+	}
+
+	// without a size, the image ends with its last block
+	image, err = NewImageReader(store, ".", backups, 0, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if image.Size() != 17384 {
+		t.Errorf("Expected 17384 bytes, got %d", image.Size())
+	}
+}
@@ -0,0 +1,165 @@
+package backupstore
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// ManifestSuffix is added to the path of an image for the path of its
+// manifest
+const ManifestSuffix = ".manifest.json"
+
+// How the restore a Manifest records ended
+const (
+	ManifestComplete  = "complete"
+	ManifestFailed    = "failed"
+	ManifestCancelled = "cancelled"
+)
+
+// Manifest records what produced a restored image: the backupstore and
+// volume it came from, the backups applied, what became of their blocks
+// and how the restore ended. It is written as JSON next to the image, see
+// ManifestPath, and a restore that fails or is cancelled leaves one with
+// what it got through.
+type Manifest struct {
+	Status string `json:"status"`
+	// Error is why a restore that didn't complete stopped, if known
+	Error string       `json:"error,omitempty"`
+	Tool  ManifestTool `json:"tool"`
+	// Backupstore is where the backupstore was read from, and VolumePath
+	// the directory of the volume in it
+	Backupstore string `json:"backupstore"`
+	Volume      string `json:"volume"`
+	VolumePath  string `json:"volumePath"`
+	Image       string `json:"image"`
+	Format      string `json:"format"`
+	Compression string `json:"compression,omitempty"`
+	// Backups are the backups applied, oldest first
+	Backups []ManifestBackup `json:"backups"`
+	Blocks  ManifestBlocks   `json:"blocks"`
+	// Damaged are the blocks the restore skipped, zero-filled or wrote
+	// despite their checksum, by offset
+	Damaged []ManifestDamage `json:"damaged,omitempty"`
+	// Filesystem is what was found at the start of the image: a
+	// filesystem, partition table, LVM PV or LUKS container
+	Filesystem string `json:"filesystem,omitempty"`
+	// Size is the size of the image once complete, and BytesWritten what
+	// the restore wrote of it
+	Size           int64     `json:"size,omitempty"`
+	BytesWritten   int64     `json:"bytesWritten"`
+	Started        time.Time `json:"started"`
+	Finished       time.Time `json:"finished"`
+	ElapsedSeconds float64   `json:"elapsedSeconds"`
+}
+
+// ManifestTool is the build of the tool that wrote the image
+type ManifestTool struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Commit  string `json:"commit,omitempty"`
+}
+
+// ManifestBackup is a backup applied to the image
+type ManifestBackup struct {
+	Name     string    `json:"name"`
+	Snapshot string    `json:"snapshot,omitempty"`
+	Created  time.Time `json:"created"`
+	Blocks   int       `json:"blocks"`
+}
+
+// ManifestBlocks counts the blocks of the image, as RepackStats does.
+// Total is the number of offsets the backups hold a block for.
+type ManifestBlocks struct {
+	Total              int `json:"total"`
+	Read               int `json:"read"`
+	Skipped            int `json:"skipped"`
+	Zero               int `json:"zero"`
+	ChecksumMismatches int `json:"checksumMismatches"`
+	Missing            int `json:"missing"`
+}
+
+// ManifestDamage is a damaged block and the action taken on it
+type ManifestDamage struct {
+	Offset   int64  `json:"offset"`
+	Checksum string `json:"checksum"`
+	Action   string `json:"action"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ManifestPath is where the manifest of the image at path is written
+func ManifestPath(path string) string {
+	return path + ManifestSuffix
+}
+
+// NewManifest starts the manifest of the restore of backups, oldest first,
+// of volume into image, which started at started
+func NewManifest(volume *VolumeBackup, backups []Backup, image string, started time.Time) *Manifest {
+	m := &Manifest{
+		Volume:     volume.Name,
+		VolumePath: volume.BackupPath,
+		Image:      image,
+		Backups:    make([]ManifestBackup, 0, len(backups)),
+		Blocks:     ManifestBlocks{Total: len(FinalBlockMap(backups))},
+		Started:    started,
+	}
+	for _, backup := range backups {
+		m.Backups = append(m.Backups, ManifestBackup{
+			Name:     backup.Identifier,
+			Snapshot: backup.SnapshotName,
+			Created:  backup.Timestamp,
+			Blocks:   len(backup.Blocks),
+		})
+	}
+	return m
+}
+
+// Finish records how the restore ended at finished, with the counts of
+// stats and the blocks of damaged
+func (m *Manifest) Finish(status string, stats *RepackStats, damaged []DamagedBlock, finished time.Time) {
+	m.Status = status
+	snapshot := stats.Snapshot()
+	m.Blocks.Read = snapshot.BlocksRead
+	m.Blocks.Skipped = snapshot.BlocksSkipped
+	m.Blocks.Zero = snapshot.ZeroBlocks
+	m.Blocks.ChecksumMismatches = snapshot.ChecksumMismatches
+	m.Blocks.Missing = snapshot.MissingBlocks
+	m.BytesWritten = snapshot.BytesWritten
+	m.Damaged = nil
+	for _, block := range damaged {
+		entry := ManifestDamage{Offset: block.Offset, Checksum: block.Checksum, Action: block.Action}
+		if block.Err != nil {
+			entry.Error = block.Err.Error()
+		}
+		m.Damaged = append(m.Damaged, entry)
+	}
+	m.Finished = finished
+	m.ElapsedSeconds = finished.Sub(m.Started).Round(time.Millisecond).Seconds()
+}
+
+// WriteFile writes m to path as indented JSON, through a temporary file
+// that is synced before it replaces path, so path never holds part of a
+// manifest
+func (m *Manifest) WriteFile(path string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(data, '\n'))
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,93 @@
+package backupstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func TestManifestGolden(t *testing.T) {
+	started := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	volume := &VolumeBackup{Name: "pvc-1", BackupPath: "volumes/2a/7c/pvc-1"}
+	backups := []Backup{
+		{
+			Identifier:   "backup-1",
+			SnapshotName: "snap-1",
+			Timestamp:    time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+			Blocks:       []Block{{Offset: 0, Checksum: "aa"}, {Offset: 2 << 20, Checksum: "bb"}},
+		},
+		{
+			Identifier: "backup-2",
+			Timestamp:  time.Date(2024, 2, 2, 0, 0, 0, 0, time.UTC),
+			Blocks:     []Block{{Offset: 2 << 20, Checksum: "cc"}, {Offset: 4 << 20, Checksum: "dd"}},
+		},
+	}
+	m := NewManifest(volume, backups, "/restore/pvc-1.img", started)
+	m.Tool = ManifestTool{Name: "longhorn-backup-repacker", Version: "1.2.3", Commit: "abc1234"}
+	m.Backupstore = "/backups/backupstore"
+	m.Format = "raw"
+	m.Filesystem = "ext4"
+	m.Size = 8 << 20
+
+	stats := &RepackStats{BlocksRead: 2, BlocksSkipped: 1, ZeroBlocks: 1, MissingBlocks: 1, BytesWritten: 2 << 20}
+	damaged := &DamageReport{}
+	damaged.Add(Block{Offset: 4 << 20, Checksum: "dd"}, errors.New("block dd is missing"), ActionZeroed)
+	m.Finish(ManifestComplete, stats, damaged.Blocks(), started.Add(90500*time.Millisecond))
+
+	path := filepath.Join(t.TempDir(), "pvc-1.img"+ManifestSuffix)
+	if err := m.WriteFile(path); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden := filepath.Join("testdata", "manifest.golden.json")
+	if *updateGolden {
+		if err := os.WriteFile(golden, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, expected) {
+		t.Errorf("Expected manifest:\n%s\ngot:\n%s", expected, got)
+	}
+
+	var read Manifest
+	if err := json.Unmarshal(got, &read); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if read.Status != ManifestComplete || len(read.Backups) != 2 || read.Blocks.Total != 3 {
+		t.Errorf("Expected a complete manifest of 2 backups and 3 blocks, got %+v", read)
+	}
+}
+
+func TestManifestFailed(t *testing.T) {
+	started := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	m := NewManifest(&VolumeBackup{Name: "pvc-1"}, nil, "/restore/pvc-1.img", started)
+	m.Error = "restore interrupted after 1 of 3 blocks: context canceled"
+	m.Finish(ManifestCancelled, &RepackStats{BlocksRead: 1}, nil, started.Add(time.Second))
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, field := range []string{`"status":"cancelled"`, `"error":"restore interrupted`, `"backups":[]`} {
+		if !bytes.Contains(data, []byte(field)) {
+			t.Errorf("Expected %s in %s", field, data)
+		}
+	}
+	if bytes.Contains(data, []byte(`"size"`)) || bytes.Contains(data, []byte(`"damaged"`)) {
+		t.Errorf("Expected no size or damaged blocks for a cancelled restore, got %s", data)
+	}
+}
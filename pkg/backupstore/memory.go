@@ -0,0 +1,109 @@
+package backupstore
+
+import (
+	"context"
+	"sync"
+)
+
+// MemoryBudget bounds the bytes of block buffers held at once, making
+// whoever loads the next block wait for earlier ones to be written. It is
+// safe for concurrent use, and a nil *MemoryBudget never waits.
+type MemoryBudget struct {
+	mu    sync.Mutex
+	limit int64
+	used  int64
+	peak  int64
+	// freed is closed, and replaced, whenever memory is released, and
+	// waiting is closed while Acquire waits for it
+	freed   chan struct{}
+	waiting chan struct{}
+	waited  bool
+}
+
+// NewMemoryBudget returns a budget of limit bytes
+func NewMemoryBudget(limit int64) *MemoryBudget {
+	return &MemoryBudget{limit: limit, freed: make(chan struct{}), waiting: make(chan struct{})}
+}
+
+// Acquire takes n bytes from the budget, waiting until they are free or
+// ctx is cancelled. A request larger than the whole budget takes all of
+// it, so a tiny budget still lets one block through at a time.
+func (b *MemoryBudget) Acquire(ctx context.Context, n int64) error {
+	if b == nil {
+		return nil
+	}
+	for {
+		freed, ok := b.take(n, true)
+		if ok {
+			return nil
+		}
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// TryAcquire takes n bytes from the budget if they are free right away
+func (b *MemoryBudget) TryAcquire(n int64) bool {
+	if b == nil {
+		return true
+	}
+	_, ok := b.take(n, false)
+	return ok
+}
+
+func (b *MemoryBudget) take(n int64, wait bool) (chan struct{}, bool) {
+	n = min(n, b.limit)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used+n > b.limit {
+		if wait && !b.waited {
+			close(b.waiting)
+			b.waited = true
+		}
+		return b.freed, false
+	}
+	b.used += n
+	b.peak = max(b.peak, b.used)
+	return nil, true
+}
+
+// Release returns n bytes taken with Acquire or TryAcquire
+func (b *MemoryBudget) Release(n int64) {
+	if b == nil || n == 0 {
+		return
+	}
+	n = min(n, b.limit)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+	close(b.freed)
+	b.freed = make(chan struct{})
+	if b.waited {
+		b.waiting = make(chan struct{})
+		b.waited = false
+	}
+}
+
+// blocked returns a channel that is closed once Acquire has to wait, for
+// holders of memory to give it back rather than wait themselves
+func (b *MemoryBudget) blocked() <-chan struct{} {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.waiting
+}
+
+// Peak returns the most bytes held at once
+func (b *MemoryBudget) Peak() int64 {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.peak
+}
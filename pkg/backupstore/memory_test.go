@@ -0,0 +1,116 @@
+package backupstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	budget := NewMemoryBudget(100)
+	if err := budget.Acquire(context.Background(), 60); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if budget.TryAcquire(50) {
+		t.Error("Expected 50 bytes not to fit beside 60 of 100")
+	}
+
+	acquired := make(chan error)
+	go func() {
+		acquired <- budget.Acquire(context.Background(), 50)
+	}()
+	select {
+	case err := <-acquired:
+		t.Fatalf("Expected Acquire to wait, got %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	budget.Release(60)
+	if err := <-acquired; err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if peak := budget.Peak(); peak != 60 {
+		t.Errorf("Expected a peak of 60, got %d", peak)
+	}
+
+	// more than the whole budget takes all of it
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := budget.Acquire(ctx, 1000); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the wait to be cancelled, got %v", err)
+	}
+	budget.Release(50)
+	if !budget.TryAcquire(1000) || budget.Peak() != 100 {
+		t.Errorf("Expected an oversized request to take the whole budget, got a peak of %d", budget.Peak())
+	}
+
+	var unlimited *MemoryBudget
+	if !unlimited.TryAcquire(1<<40) || unlimited.Acquire(ctx, 1<<40) != nil {
+		t.Error("Expected a nil budget never to wait")
+	}
+}
+
+func TestRepackMemoryBudget(t *testing.T) {
+	volumePath := t.TempDir()
+	blockSize := 4096
+	blocks := make([]Block, 0, 32)
+	var expected []byte
+	for i := range 32 {
+		checksum := writeTestBlock(t, volumePath, testBlockData(byte(i), blockSize))
+		blocks = append(blocks, Block{Offset: int64(i * blockSize), Checksum: checksum})
+		expected = append(expected, testBlockData(byte(i), blockSize)...)
+	}
+	backups := []Backup{
+		{Identifier: "backup-1", Compression: "lz4", Blocks: blocks[:20]},
+		{Identifier: "backup-2", Compression: "lz4", Blocks: blocks[12:]},
+	}
+
+	tests := []struct {
+		name  string
+		opts  RepackOptions
+		limit int64
+	}{
+		{name: "streamed", opts: RepackOptions{}, limit: 1},
+		{name: "batched", opts: RepackOptions{WriteBatch: 8 * 4096}, limit: 1},
+		{name: "cached", opts: RepackOptions{Cache: NewBlockCache(1 << 20)}, limit: 3 * MaxBlockSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := os.Create(filepath.Join(t.TempDir(), "out.raw"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer out.Close()
+
+			opts := tt.opts
+			opts.Jobs = 4
+			opts.Memory = NewMemoryBudget(tt.limit)
+			done := make(chan error)
+			go func() {
+				done <- Repack(context.Background(), os.DirFS(volumePath), ".", backups, out, opts)
+			}()
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("Expected the restore to finish within the budget")
+			}
+
+			if peak := opts.Memory.Peak(); peak > tt.limit {
+				t.Errorf("Expected at most %d bytes held, got %d", tt.limit, peak)
+			}
+			content, err := os.ReadFile(out.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(content, expected) {
+				t.Errorf("Restored image does not match expected content (%d bytes)", len(content))
+			}
+		})
+	}
+}
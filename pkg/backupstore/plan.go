@@ -0,0 +1,119 @@
+package backupstore
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+)
+
+// PassPlan is the blocks a pass of one backup writes, in the order it
+// writes them
+type PassPlan struct {
+	// Blocks are sorted by offset, one per offset, so the image is
+	// written front to back
+	Blocks []Block
+	// Duplicates are the offsets the backup lists more than one block at,
+	// in order. Only the last block listed at each is kept, the one that
+	// writing them in the order listed would have left there.
+	Duplicates []int64
+	// Misaligned are the offsets of Blocks that aren't a multiple of the
+	// block size of the backup, and OutOfRange those at or past the end
+	// of the volume. Only PlanBackup looks for them; the blocks are still
+	// written.
+	Misaligned []int64
+	OutOfRange []int64
+}
+
+// PlanPass returns the plan of a pass writing blocks, which are sorted by
+// offset without reordering those listed at the same offset
+func PlanPass(blocks []Block) PassPlan {
+	sorted := slices.Clone(blocks)
+	slices.SortStableFunc(sorted, func(a, b Block) int {
+		return cmp.Compare(a.Offset, b.Offset)
+	})
+	plan := PassPlan{Blocks: sorted[:0]}
+	for i, block := range sorted {
+		if i+1 < len(sorted) && sorted[i+1].Offset == block.Offset {
+			if len(plan.Duplicates) == 0 || plan.Duplicates[len(plan.Duplicates)-1] != block.Offset {
+				plan.Duplicates = append(plan.Duplicates, block.Offset)
+			}
+			continue
+		}
+		plan.Blocks = append(plan.Blocks, block)
+	}
+	return plan
+}
+
+// PlanBackup returns the plan of a pass of backup, like PlanPass, along
+// with the offsets not a multiple of its block size and, unless volumeSize
+// is 0, those at or past volumeSize
+func PlanBackup(backup Backup, volumeSize int64) PassPlan {
+	plan := PlanPass(backup.Blocks)
+	for _, block := range plan.Blocks {
+		if backup.BlockSize > 0 && block.Offset%backup.BlockSize != 0 {
+			plan.Misaligned = append(plan.Misaligned, block.Offset)
+		}
+		if volumeSize > 0 && block.Offset >= volumeSize {
+			plan.OutOfRange = append(plan.OutOfRange, block.Offset)
+		}
+	}
+	return plan
+}
+
+// MalformedBackupError is a backup whose cfg file lists blocks a backup
+// Longhorn wrote never would: several at one offset, at offsets that
+// aren't a multiple of its block size, or past the end of the volume
+type MalformedBackupError struct {
+	ConfigPath string
+	BlockSize  int64
+	VolumeSize int64
+	Duplicates []int64
+	Misaligned []int64
+	OutOfRange []int64
+}
+
+func (e *MalformedBackupError) Error() string {
+	var problems []string
+	if len(e.Duplicates) > 0 {
+		problems = append(problems, fmt.Sprintf("more than one block at offsets %v", e.Duplicates))
+	}
+	if len(e.Misaligned) > 0 {
+		problems = append(problems, fmt.Sprintf("blocks at offsets %v, which aren't a multiple of its %d byte block size", e.Misaligned, e.BlockSize))
+	}
+	if len(e.OutOfRange) > 0 {
+		problems = append(problems, fmt.Sprintf("blocks at offsets %v, past the end of the %d byte volume", e.OutOfRange, e.VolumeSize))
+	}
+	return fmt.Sprintf("backup %s lists %s", e.ConfigPath, strings.Join(problems, "; "))
+}
+
+// CheckBackups plans a pass of each of backups, warning on logger of the
+// blocks a well formed cfg file doesn't list, as PlanBackup finds them.
+// With strict, the first backup listing any is returned as a
+// *MalformedBackupError instead.
+func CheckBackups(backups []Backup, volumeSize int64, strict bool, logger *slog.Logger) error {
+	for _, backup := range backups {
+		plan := PlanBackup(backup, volumeSize)
+		if strict && len(plan.Duplicates)+len(plan.Misaligned)+len(plan.OutOfRange) > 0 {
+			return &MalformedBackupError{
+				ConfigPath: backup.ConfigPath,
+				BlockSize:  backup.BlockSize,
+				VolumeSize: volumeSize,
+				Duplicates: plan.Duplicates,
+				Misaligned: plan.Misaligned,
+				OutOfRange: plan.OutOfRange,
+			}
+		}
+		if len(plan.Duplicates) > 0 {
+			logger.Warn(fmt.Sprintf("Backup %s lists more than one block at the same offset, keeping the last listed", backup.Identifier), "offsets", plan.Duplicates, "cfg", backup.ConfigPath)
+		}
+		if len(plan.Misaligned) > 0 {
+			logger.Warn(fmt.Sprintf("Backup %s lists blocks at offsets that aren't a multiple of its %d byte block size", backup.Identifier, backup.BlockSize), "offsets", plan.Misaligned, "cfg", backup.ConfigPath)
+		}
+		if len(plan.OutOfRange) > 0 {
+			logger.Warn(fmt.Sprintf("Backup %s lists blocks past the end of the %d byte volume", backup.Identifier, volumeSize), "offsets", plan.OutOfRange, "cfg", backup.ConfigPath)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package backupstore
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestPlanPass(t *testing.T) {
+	tests := []struct {
+		name               string
+		blocks             []Block
+		expected           []Block
+		expectedDuplicates []int64
+	}{
+		{
+			name:     "empty",
+			blocks:   nil,
+			expected: []Block{},
+		},
+		{
+			name:     "sorted by offset",
+			blocks:   []Block{{Offset: 8192, Checksum: "c"}, {Offset: 0, Checksum: "a"}, {Offset: 4096, Checksum: "b"}},
+			expected: []Block{{Offset: 0, Checksum: "a"}, {Offset: 4096, Checksum: "b"}, {Offset: 8192, Checksum: "c"}},
+		},
+		{
+			name: "the last block listed at an offset is kept",
+			blocks: []Block{
+				{Offset: 4096, Checksum: "b1"},
+				{Offset: 0, Checksum: "a1"},
+				{Offset: 4096, Checksum: "b2"},
+				{Offset: 0, Checksum: "a2"},
+				{Offset: 4096, Checksum: "b3"},
+				{Offset: 8192, Checksum: "c"},
+			},
+			expected:           []Block{{Offset: 0, Checksum: "a2"}, {Offset: 4096, Checksum: "b3"}, {Offset: 8192, Checksum: "c"}},
+			expectedDuplicates: []int64{0, 4096},
+		},
+		{
+			name:               "the same block listed twice",
+			blocks:             []Block{{Offset: 0, Checksum: "a"}, {Offset: 0, Checksum: "a"}},
+			expected:           []Block{{Offset: 0, Checksum: "a"}},
+			expectedDuplicates: []int64{0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listed := slices.Clone(tt.blocks)
+			plan := PlanPass(tt.blocks)
+			if !slices.Equal(plan.Blocks, tt.expected) {
+				t.Errorf("Expected blocks %v, got %v", tt.expected, plan.Blocks)
+			}
+			if !slices.Equal(plan.Duplicates, tt.expectedDuplicates) {
+				t.Errorf("Expected duplicates %v, got %v", tt.expectedDuplicates, plan.Duplicates)
+			}
+			if !slices.Equal(tt.blocks, listed) {
+				t.Errorf("Expected the blocks of the backup to be left as listed, got %v", tt.blocks)
+			}
+		})
+	}
+}
+
+func TestPlanBackup(t *testing.T) {
+	tests := []struct {
+		name               string
+		backup             Backup
+		volumeSize         int64
+		expectedMisaligned []int64
+		expectedOutOfRange []int64
+	}{
+		{
+			name:       "well formed",
+			backup:     Backup{BlockSize: 4096, Blocks: []Block{{Offset: 4096}, {Offset: 0}}},
+			volumeSize: 8192,
+		},
+		{
+			name:               "misaligned",
+			backup:             Backup{BlockSize: 4096, Blocks: []Block{{Offset: 0}, {Offset: 4100}, {Offset: 2048}}},
+			volumeSize:         16384,
+			expectedMisaligned: []int64{2048, 4100},
+		},
+		{
+			name:               "past the end of the volume",
+			backup:             Backup{BlockSize: 4096, Blocks: []Block{{Offset: 12288}, {Offset: 0}, {Offset: 8192}}},
+			volumeSize:         8192,
+			expectedOutOfRange: []int64{8192, 12288},
+		},
+		{
+			name:   "no volume size",
+			backup: Backup{BlockSize: 4096, Blocks: []Block{{Offset: 1 << 40}}},
+		},
+		{
+			name:   "no block size",
+			backup: Backup{Blocks: []Block{{Offset: 100}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan := PlanBackup(tt.backup, tt.volumeSize)
+			if !slices.Equal(plan.Misaligned, tt.expectedMisaligned) {
+				t.Errorf("Expected misaligned offsets %v, got %v", tt.expectedMisaligned, plan.Misaligned)
+			}
+			if !slices.Equal(plan.OutOfRange, tt.expectedOutOfRange) {
+				t.Errorf("Expected offsets past the volume %v, got %v", tt.expectedOutOfRange, plan.OutOfRange)
+			}
+		})
+	}
+}
+
+func TestCheckBackups(t *testing.T) {
+	backups := []Backup{
+		{Identifier: "backup-1", ConfigPath: "backups/backup_backup-1.cfg", BlockSize: 4096, Blocks: []Block{{Offset: 0}, {Offset: 4096}}},
+		{
+			Identifier: "backup-2",
+			ConfigPath: "backups/backup_backup-2.cfg",
+			BlockSize:  4096,
+			Blocks:     []Block{{Offset: 0}, {Offset: 0}, {Offset: 6000}, {Offset: 16384}},
+		},
+	}
+
+	var logged bytes.Buffer
+	if err := CheckBackups(backups, 8192, false, slog.New(slog.NewTextHandler(&logged, nil))); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, expected := range []string{
+		`"Backup backup-2 lists more than one block at the same offset, keeping the last listed" offsets=[0] cfg=backups/backup_backup-2.cfg`,
+		`"Backup backup-2 lists blocks at offsets that aren't a multiple of its 4096 byte block size" offsets=[6000] cfg=backups/backup_backup-2.cfg`,
+		`"Backup backup-2 lists blocks past the end of the 8192 byte volume" offsets=[16384] cfg=backups/backup_backup-2.cfg`,
+	} {
+		if !strings.Contains(logged.String(), expected) {
+			t.Errorf("Expected a warning %s, got %q", expected, logged.String())
+		}
+	}
+	if strings.Contains(logged.String(), "backup-1") {
+		t.Errorf("Expected no warning for the well formed backup, got %q", logged.String())
+	}
+
+	logged.Reset()
+	err := CheckBackups(backups, 8192, true, slog.New(slog.NewTextHandler(&logged, nil)))
+	var malformed *MalformedBackupError
+	if !errors.As(err, &malformed) {
+		t.Fatalf("Expected a MalformedBackupError, got %v", err)
+	}
+	if malformed.ConfigPath != "backups/backup_backup-2.cfg" || !slices.Equal(malformed.Duplicates, []int64{0}) ||
+		!slices.Equal(malformed.Misaligned, []int64{6000}) || !slices.Equal(malformed.OutOfRange, []int64{16384}) {
+		t.Errorf("Expected the problems of backup-2, got %+v", malformed)
+	}
+	expected := "backup backups/backup_backup-2.cfg lists more than one block at offsets [0]; blocks at offsets [6000], which aren't a multiple of its 4096 byte block size; blocks at offsets [16384], past the end of the 8192 byte volume"
+	if err.Error() != expected {
+		t.Errorf("Expected %q, got %q", expected, err.Error())
+	}
+	if logged.Len() != 0 {
+		t.Errorf("Expected no warnings with strict, got %q", logged.String())
+	}
+}
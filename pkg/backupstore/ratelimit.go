@@ -0,0 +1,178 @@
+package backupstore
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rateLimitBurst is how far ahead of its rate a RateLimiter lets bytes
+// through after being idle
+const rateLimitBurst = 100 * time.Millisecond
+
+// RateLimiter is a token bucket capping the bytes per second passed
+// through it by all of its callers together, so parallel jobs share the
+// rate rather than each getting it. It is safe for concurrent use, and a
+// nil *RateLimiter never waits.
+type RateLimiter struct {
+	rate float64
+	mu   sync.Mutex
+	// next is when the bytes taken so far are paid for at rate
+	next   time.Time
+	total  atomic.Int64
+	waited atomic.Int64
+}
+
+// NewRateLimiter returns a limiter of bytesPerSecond
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	return &RateLimiter{rate: float64(bytesPerSecond)}
+}
+
+// Wait takes n bytes from the bucket, sleeping until the rate allows
+// them. Bytes are taken before they are paid for, so a block larger than
+// the bucket still goes through, and the caller after it waits instead.
+func (l *RateLimiter) Wait(n int64) {
+	if l == nil || n <= 0 {
+		return
+	}
+	l.total.Add(n)
+	l.mu.Lock()
+	now := time.Now()
+	// time left unused while idle only carries over up to the burst
+	start := l.next
+	if earliest := now.Add(-rateLimitBurst); start.Before(earliest) {
+		start = earliest
+	}
+	l.next = start.Add(time.Duration(float64(n) / l.rate * float64(time.Second)))
+	delay := l.next.Sub(now)
+	l.mu.Unlock()
+	if delay > 0 {
+		l.waited.Add(int64(delay))
+		time.Sleep(delay)
+	}
+}
+
+// Rate returns the bytes per second the limiter allows
+func (l *RateLimiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+	return int64(l.rate)
+}
+
+// Total returns the bytes taken so far
+func (l *RateLimiter) Total() int64 {
+	if l == nil {
+		return 0
+	}
+	return l.total.Load()
+}
+
+// Waited returns how long callers have slept for their bytes in all
+func (l *RateLimiter) Waited() time.Duration {
+	if l == nil {
+		return 0
+	}
+	return time.Duration(l.waited.Load())
+}
+
+// LimitReads returns store with the files read from it, whole or as
+// they are streamed, passed through limiter. A remote store fetches a file
+// before it is read, so the fetch is paid for after the fact, making the
+// next one wait. Listings and stats aren't counted.
+func LimitReads(store fs.FS, limiter *RateLimiter) fs.FS {
+	if limiter == nil {
+		return store
+	}
+	return &limitedFS{FS: store, limiter: limiter}
+}
+
+// limitedFS keeps the interfaces of the store it wraps that the package
+// looks for, so a limited remote store is still treated as remote
+type limitedFS struct {
+	fs.FS
+	limiter *RateLimiter
+}
+
+func (s *limitedFS) Open(name string) (fs.File, error) {
+	f, err := s.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &limitedFile{File: f, limiter: s.limiter}, nil
+}
+
+func (s *limitedFS) ReadFile(name string) ([]byte, error) {
+	data, err := fs.ReadFile(s.FS, name)
+	s.limiter.Wait(int64(len(data)))
+	return data, err
+}
+
+func (s *limitedFS) Stat(name string) (fs.FileInfo, error) { return fs.Stat(s.FS, name) }
+
+func (s *limitedFS) ReadDir(name string) ([]fs.DirEntry, error) { return fs.ReadDir(s.FS, name) }
+
+func (s *limitedFS) Glob(pattern string) ([]string, error) { return fs.Glob(s.FS, pattern) }
+
+func (s *limitedFS) Remote() bool { return isRemote(s.FS) }
+
+func (s *limitedFS) Retries() int64 { return storeRetries(s.FS) }
+
+type limitedFile struct {
+	fs.File
+	limiter *RateLimiter
+}
+
+func (f *limitedFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	f.limiter.Wait(int64(n))
+	return n, err
+}
+
+func (f *limitedFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	dir, ok := f.File.(fs.ReadDirFile)
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Err: errors.New("not a directory")}
+	}
+	return dir.ReadDir(n)
+}
+
+// LimitWriter returns w with the bytes written to it passed through
+// limiter, each write waiting before it is made
+func LimitWriter(w io.Writer, limiter *RateLimiter) io.Writer {
+	if limiter == nil {
+		return w
+	}
+	return &throttledWriter{w: w, limiter: limiter}
+}
+
+type throttledWriter struct {
+	w       io.Writer
+	limiter *RateLimiter
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	w.limiter.Wait(int64(len(p)))
+	return w.w.Write(p)
+}
+
+// LimitWriterAt is LimitWriter for the parallel writes of Repack
+func LimitWriterAt(w io.WriterAt, limiter *RateLimiter) io.WriterAt {
+	if limiter == nil {
+		return w
+	}
+	return &throttledWriterAt{w: w, limiter: limiter}
+}
+
+type throttledWriterAt struct {
+	w       io.WriterAt
+	limiter *RateLimiter
+}
+
+func (w *throttledWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	w.limiter.Wait(int64(len(p)))
+	return w.w.WriteAt(p, off)
+}
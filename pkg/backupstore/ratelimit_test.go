@@ -0,0 +1,81 @@
+package backupstore
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	// 1MiB at 4MiB/s takes 250ms less the burst, whether one reader or
+	// four take it
+	limiter := NewRateLimiter(4 << 20)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 4 {
+				limiter.Wait(64 << 10)
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	if elapsed < 140*time.Millisecond || elapsed > time.Second {
+		t.Errorf("Expected 1MiB at 4MiB/s across 4 readers to take about 150ms, took %s", elapsed)
+	}
+	if limiter.Total() != 1<<20 || limiter.Waited() <= 0 {
+		t.Errorf("Expected 1MiB taken after waiting, got %d after %s", limiter.Total(), limiter.Waited())
+	}
+
+	var unlimited *RateLimiter
+	start = time.Now()
+	unlimited.Wait(1 << 40)
+	if time.Since(start) > 10*time.Millisecond || unlimited.Total() != 0 || unlimited.Rate() != 0 {
+		t.Error("Expected a nil limiter not to wait or count")
+	}
+}
+
+func TestLimitReads(t *testing.T) {
+	dir := t.TempDir()
+	data := testBlockData(1, 4096)
+	if err := os.WriteFile(filepath.Join(dir, "block"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	store := remoteTestFS{os.DirFS(dir)}
+	if limited := LimitReads(store, nil); limited != fs.FS(store) {
+		t.Error("Expected no limiter to leave the store as it is")
+	}
+
+	limiter := NewRateLimiter(1 << 30)
+	limited := LimitReads(store, limiter)
+	if !isRemote(limited) {
+		t.Error("Expected a limited remote store to still be remote")
+	}
+	if got, err := fs.ReadFile(limited, "block"); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("Expected the file read whole, got %d bytes (%v)", len(got), err)
+	}
+	f, err := limited.Open("block")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := io.Copy(io.Discard, f); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	f.Close()
+	if limiter.Total() != 2*4096 {
+		t.Errorf("Expected both reads counted, got %d bytes", limiter.Total())
+	}
+
+	var out bytes.Buffer
+	if _, err := LimitWriter(&out, limiter).Write(data); err != nil || limiter.Total() != 3*4096 {
+		t.Errorf("Expected the write counted, got %d bytes (%v)", limiter.Total(), err)
+	}
+}
@@ -0,0 +1,715 @@
+package backupstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"sort"
+	"sync"
+)
+
+// MappedBlock is a block along with the compression and block size of
+// the backup it comes from
+type MappedBlock struct {
+	Block
+	Compression string
+	BlockSize   int64
+}
+
+// FinalBlockMap returns the block that ends up at each offset once every
+// backup has been applied, as PlanPass plans each, sorted by offset
+func FinalBlockMap(backups []Backup) []MappedBlock {
+	seen := make(map[int64]struct{})
+	mapped := make([]MappedBlock, 0)
+	for i := len(backups) - 1; i >= 0; i-- {
+		for _, block := range PlanPass(backups[i].Blocks).Blocks {
+			if _, ok := seen[block.Offset]; ok {
+				continue
+			}
+			seen[block.Offset] = struct{}{}
+			mapped = append(mapped, MappedBlock{Block: block, Compression: backups[i].Compression, BlockSize: backups[i].BlockSize})
+		}
+	}
+	sort.Slice(mapped, func(i, j int) bool {
+		return mapped[i].Offset < mapped[j].Offset
+	})
+	return mapped
+}
+
+// OutputError is a failure to write the image rather than to read the
+// backup
+type OutputError struct {
+	Err error
+}
+
+func (e *OutputError) Error() string { return e.Err.Error() }
+func (e *OutputError) Unwrap() error { return e.Err }
+
+// InterruptedError is returned by Repack when its context is cancelled,
+// once the blocks already being written are done
+type InterruptedError struct {
+	Restored int
+	Total    int
+	Err      error
+}
+
+func (e *InterruptedError) Error() string {
+	return fmt.Sprintf("restore interrupted after %d of %d blocks: %s", e.Restored, e.Total, e.Err)
+}
+
+func (e *InterruptedError) Unwrap() error {
+	return e.Err
+}
+
+// Journal records the offset of each block once it has been written, so
+// an interrupted repack can be continued with RepackOptions.Completed
+type Journal interface {
+	Record(offset int64) error
+}
+
+// Progress follows a repack pass by pass. Block calls are serialized, and
+// given how each block was decompressed: the compression of its backup,
+// or LZ4Block for an lz4 block an older Longhorn version wrote.
+type Progress interface {
+	StartPass(pass, totalPasses, blocks int)
+	Block(pass, totalPasses, done, totalBlocks int, block Block, compression string, written int64)
+	EndPass(pass, totalPasses int)
+}
+
+// RepackOptions configures Repack; the zero value restores one block at a
+// time, sparsely, reporting nothing
+type RepackOptions struct {
+	// Jobs is the number of blocks read and decompressed in parallel
+	Jobs int
+	// VolumeSize is the size volume.cfg gives the volume, past which no
+	// backup should list a block, or 0 if unknown. The blocks of a backup
+	// that does, lists several at one offset or at offsets that aren't a
+	// multiple of its block size are warned about on Logger, or with
+	// Strict, fail the repack with a *MalformedBackupError before any is
+	// written.
+	VolumeSize int64
+	Strict     bool
+	// LegacyPasses restores the backups in a pass each, newest first,
+	// skipping the offsets a newer backup has written, rather than in one
+	// pass over the final block of each offset. Both write the same image.
+	LegacyPasses bool
+	// NoSparse writes all-zero blocks instead of leaving holes
+	NoSparse bool
+	// Completed holds offsets restored by an earlier, interrupted run,
+	// which are skipped, and Journal records the ones restored by this one
+	Completed map[int64]struct{}
+	Journal   Journal
+	// Logger, if set, gets a record for each pass that skips blocks, and
+	// Progress follows the blocks written
+	Logger   *slog.Logger
+	Progress Progress
+	// Cache, if set, is consulted before reading each block from store
+	Cache *BlockCache
+	// WriteBatch merges blocks at contiguous offsets into writes of about
+	// this many bytes. Without it or Cache, which both need whole blocks,
+	// each block is streamed from the decompressor to out.
+	WriteBatch int64
+	// Memory, if set, bounds the block buffers held by all jobs at once;
+	// blocks in Cache are not counted
+	Memory *MemoryBudget
+	// OnChecksumMismatch and OnMissingBlock are what to do with blocks
+	// that fail their checksum or are missing from store, and Damaged
+	// records those the restore went on without failing
+	OnChecksumMismatch MismatchPolicy
+	OnMissingBlock     MissingPolicy
+	Damaged            *DamageReport
+	// Stats, if set, is added to as the repack goes
+	Stats *RepackStats
+}
+
+// WriteBlock writes a whole block to out at offset, continuing after
+// partial writes for as long as out makes progress
+func WriteBlock(blockData []byte, offset int64, out io.WriterAt) (int, error) {
+	written := 0
+	for written < len(blockData) {
+		n, err := out.WriteAt(blockData[written:], offset+int64(written))
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if n == 0 {
+			return written, io.ErrShortWrite
+		}
+	}
+	return written, nil
+}
+
+// Repack writes the backups of the volume in backupPath to out, which
+// starts empty. The block each offset ends up with once every backup has
+// been applied, as FinalBlockMap finds, is written in a single pass in
+// offset order, or with opts.LegacyPasses in a pass per backup. Each
+// offset is only written once, so zero blocks are left as holes unless
+// opts.NoSparse is set, and the image is not truncated or extended to the
+// size of the volume. Cancelling ctx stops it from starting any more
+// blocks and returns an *InterruptedError.
+func Repack(ctx context.Context, store fs.FS, backupPath string, backups []Backup, out io.WriterAt, opts RepackOptions) error {
+	logger := opts.Logger
+	if logger == nil {
+		logger = slog.New(slog.DiscardHandler)
+	}
+	stats := opts.Stats
+	if stats == nil {
+		stats = &RepackStats{}
+	}
+	defer stats.Measure(store)()
+	stats.Update(func(s *RepackStats) { s.Backups += len(backups) })
+
+	if err := CheckBackups(backups, opts.VolumeSize, opts.Strict, logger); err != nil {
+		return err
+	}
+	listed := 0
+	for _, backup := range backups {
+		listed += len(backup.Blocks)
+	}
+	total := 0
+	final := FinalBlockMap(backups)
+	extents := make(map[int64]int64, len(final))
+	for i, block := range final {
+		if _, ok := opts.Completed[block.Offset]; !ok {
+			total++
+		}
+		extents[block.Offset] = ZeroExtent(final, i)
+	}
+	interrupted := func(restored int, err error) error {
+		if err != nil && ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+			return &InterruptedError{Restored: restored, Total: total, Err: err}
+		}
+		return err
+	}
+
+	if !opts.LegacyPasses {
+		pending := make([]MappedBlock, 0, total)
+		for _, block := range final {
+			if _, ok := opts.Completed[block.Offset]; !ok {
+				pending = append(pending, block)
+			}
+		}
+		if superseded := listed - len(final); superseded > 0 {
+			logger.Info("Skipping blocks overwritten by newer backups", "blocks", superseded)
+		}
+		if resumed := len(final) - len(pending); resumed > 0 {
+			logger.Info("Skipping blocks restored by an earlier run", "blocks", resumed)
+		}
+		stats.Update(func(s *RepackStats) { s.BlocksSkipped += listed - len(pending) })
+		restored, err := repackPass(ctx, store, backupPath, pending, 1, 1, out, extents, stats, opts)
+		return interrupted(restored, err)
+	}
+
+	// walk newest to oldest so each offset is only written by the backup
+	// that would have won had every pass been replayed in order
+	written := make(map[int64]struct{})
+	restored := 0
+	for i := len(backups) - 1; i >= 0; i-- {
+		backup := backups[i]
+		pass := len(backups) - i
+
+		plan := PlanPass(backup.Blocks)
+		pending := make([]MappedBlock, 0, len(plan.Blocks))
+		resumed := 0
+		for _, block := range plan.Blocks {
+			if _, ok := written[block.Offset]; ok {
+				continue
+			}
+			written[block.Offset] = struct{}{}
+			if _, ok := opts.Completed[block.Offset]; ok {
+				// still claimed, so older backups don't overwrite it
+				resumed++
+				continue
+			}
+			pending = append(pending, MappedBlock{Block: block, Compression: backup.Compression, BlockSize: backup.BlockSize})
+		}
+		if skipped := len(plan.Blocks) - len(pending) - resumed; skipped > 0 {
+			logger.Info("Skipping blocks already written by newer backups", "pass", pass, "passes", len(backups), "blocks", skipped)
+		}
+		if resumed > 0 {
+			logger.Info("Skipping blocks restored by an earlier run", "pass", pass, "passes", len(backups), "blocks", resumed)
+		}
+		stats.Update(func(s *RepackStats) { s.BlocksSkipped += len(backup.Blocks) - len(pending) })
+
+		n, err := repackPass(ctx, store, backupPath, pending, pass, len(backups), out, extents, stats, opts)
+		restored += n
+		if err != nil {
+			return interrupted(restored, err)
+		}
+	}
+	return nil
+}
+
+// blockWriter writes a block streamed out of the decompressor at its
+// offset in out, leaving all-zero chunks as holes when sparse
+type blockWriter struct {
+	out     io.WriterAt
+	offset  int64
+	sparse  bool
+	written int64
+	err     error
+}
+
+func (w *blockWriter) Write(p []byte) (int, error) {
+	if !w.sparse || !IsZeroBlock(p) {
+		if _, err := WriteBlock(p, w.offset, w.out); err != nil {
+			w.err = err
+			return 0, err
+		}
+		w.written += int64(len(p))
+	}
+	w.offset += int64(len(p))
+	return len(p), nil
+}
+
+// copyBufferSize is how much of a streamed block is held at once
+const copyBufferSize = 256 << 10
+
+// blockRun is a run of blocks at contiguous offsets, written as one
+type blockRun struct {
+	offset int64
+	data   []byte
+	blocks []Block
+	sizes  []int64
+	// decodings are how each block was decompressed
+	decodings []string
+	// reserved is what the run holds of RepackOptions.Memory
+	reserved int64
+}
+
+// blockAt returns the block holding the nth byte of the run
+func (r *blockRun) blockAt(n int) Block {
+	end := int64(0)
+	for i, size := range r.sizes {
+		end += size
+		if int64(n) < end {
+			return r.blocks[i]
+		}
+	}
+	return r.blocks[len(r.blocks)-1]
+}
+
+// passState is what the goroutines restoring one pass share
+type passState struct {
+	ctx         context.Context
+	cancel      context.CancelFunc
+	opts        RepackOptions
+	pass        int
+	totalPasses int
+	totalBlocks int
+	// extents are the lengths zero-filled for missing blocks
+	extents map[int64]int64
+	stats   *RepackStats
+
+	errOnce  sync.Once
+	firstErr error
+	mu       sync.Mutex
+	done     int
+}
+
+func (p *passState) fail(err error) {
+	p.errOnce.Do(func() {
+		p.firstErr = err
+		p.cancel()
+	})
+}
+
+// count updates the stats of the repack
+func (p *passState) count(update func(*RepackStats)) {
+	p.stats.Update(update)
+}
+
+// finish records a block once it is on disk, or left as a hole
+func (p *passState) finish(block Block, size int64, decoding string) bool {
+	if p.opts.Journal != nil {
+		if err := p.opts.Journal.Record(block.Offset); err != nil {
+			p.fail(&OutputError{err})
+			return false
+		}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done++
+	if p.opts.Progress != nil {
+		p.opts.Progress.Block(p.pass, p.totalPasses, p.done, p.totalBlocks, block, decoding, size)
+	}
+	return true
+}
+
+// tolerate reports whether the restore goes on after block failed with
+// err, recording the action taken on it if so
+func (p *passState) tolerate(block Block, err error) (string, bool) {
+	action, ok := p.opts.OnChecksumMismatch.Tolerate(err)
+	if !ok {
+		action, ok = p.opts.OnMissingBlock.Tolerate(err)
+	}
+	if ok {
+		p.opts.Damaged.Add(block, err, action)
+		p.count(func(s *RepackStats) { s.damaged(action) })
+	}
+	return action, ok
+}
+
+// repackPass writes blocks, sorted by offset, returning how many it
+// wrote. Cancelling ctx stops it from starting any more.
+func repackPass(ctx context.Context, store fs.FS, backupPath string, blocks []MappedBlock, pass, totalPasses int, out io.WriterAt, extents map[int64]int64, stats *RepackStats, opts RepackOptions) (int, error) {
+	passCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	p := &passState{
+		ctx:         passCtx,
+		cancel:      cancel,
+		opts:        opts,
+		pass:        pass,
+		totalPasses: totalPasses,
+		totalBlocks: len(blocks),
+		extents:     extents,
+		stats:       stats,
+	}
+	if opts.Progress != nil {
+		opts.Progress.StartPass(pass, totalPasses, p.totalBlocks)
+		defer opts.Progress.EndPass(pass, totalPasses)
+	}
+
+	// a streamed block is already written by the time its checksum fails,
+	// too late to skip it
+	if opts.Cache == nil && opts.WriteBatch <= 0 && opts.OnChecksumMismatch != MismatchSkip {
+		p.stream(store, backupPath, blocks, out)
+	} else {
+		p.pipeline(store, backupPath, blocks, out)
+	}
+
+	if p.firstErr == nil && p.done < p.totalBlocks {
+		p.firstErr = ctx.Err()
+	}
+	return p.done, p.firstErr
+}
+
+// stream has each job copy blocks from the decompressor straight into
+// out, as nothing needs them whole
+func (p *passState) stream(store fs.FS, backupPath string, blocks []MappedBlock, out io.WriterAt) {
+	var wg sync.WaitGroup
+	work := make(chan MappedBlock)
+	for range max(p.opts.Jobs, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, copyBufferSize)
+			for mapped := range work {
+				block := mapped.Block
+				if p.ctx.Err() != nil {
+					continue
+				}
+				if err := p.opts.Memory.Acquire(p.ctx, copyBufferSize); err != nil {
+					continue
+				}
+				w := &blockWriter{out: out, offset: block.Offset, sparse: !p.opts.NoSparse}
+				n, decoding, err := copyBlock(w, store, backupPath, block, mapped.Compression, mapped.BlockSize, buf)
+				p.opts.Memory.Release(copyBufferSize)
+				var action string
+				if err != nil && w.err == nil {
+					var ok bool
+					if action, ok = p.tolerate(block, err); ok {
+						err = nil
+					}
+				}
+				if action == ActionZeroed {
+					// sparse images already read as zeroes there
+					n = 0
+					if p.opts.NoSparse {
+						zeroed, _ := w.Write(make([]byte, p.extents[block.Offset]))
+						n = int64(zeroed)
+					}
+				}
+				switch {
+				case w.err != nil:
+					p.fail(&OutputError{fmt.Errorf("failed to write block %s at offset %d: %w", block.Checksum, block.Offset, w.err)})
+				case err != nil:
+					p.fail(err)
+				default:
+					p.count(func(s *RepackStats) {
+						if action != ActionZeroed {
+							s.read(n, w.written == 0)
+						}
+						s.BytesWritten += w.written
+					})
+					p.finish(block, n, decoding)
+				}
+			}
+		}()
+	}
+
+feed:
+	for _, block := range blocks {
+		select {
+		case work <- block:
+		case <-p.ctx.Done():
+			break feed
+		}
+	}
+	close(work)
+	wg.Wait()
+}
+
+// pipelineJob is a block on its way from the store to the writer, which
+// gets the outcome on result. cached is set when the job loads the block
+// for the cache.
+type pipelineJob struct {
+	block  MappedBlock
+	path   string
+	data   []byte
+	cached bool
+	result chan loadedBlock
+}
+
+// complete hands the outcome of a job to the writer, and to the cache
+func (p *passState) complete(job pipelineJob, data []byte, decoding string, err error) {
+	if job.cached {
+		p.opts.Cache.finish(job.block.Checksum, data, err)
+	}
+	job.result <- loadedBlock{block: job.block.Block, data: data, decoding: decoding, err: err}
+}
+
+// loadedBlock is a block as the writer gets it. Blocks from the cache
+// have the compression of their backup as their decoding.
+type loadedBlock struct {
+	block    Block
+	data     []byte
+	decoding string
+	err      error
+}
+
+// pipeline restores blocks in three stages connected by bounded channels:
+// readers fetch block files, jobs decompressors check them, and a single
+// writer takes them in offset order, merging contiguous ones
+func (p *passState) pipeline(store fs.FS, backupPath string, blocks []MappedBlock, out io.WriterAt) {
+	jobs := max(p.opts.Jobs, 1)
+	// one reader keeps reads from a local disk sequential, while a remote
+	// store gets a request in flight per job
+	readers := 1
+	if isRemote(store) {
+		readers = jobs
+	}
+
+	var stages, reading sync.WaitGroup
+	queue := make(chan chan loadedBlock, jobs*2)
+	fetch := make(chan pipelineJob)
+	decompress := make(chan pipelineJob)
+
+	// every block takes its share of memory before it is read, in order,
+	// and the writer gives it back
+	stages.Add(1)
+	go func() {
+		defer stages.Done()
+		defer close(queue)
+		defer close(fetch)
+		for _, block := range blocks {
+			if err := p.opts.Memory.Acquire(p.ctx, MaxBlockSize); err != nil {
+				return
+			}
+			result := make(chan loadedBlock, 1)
+			select {
+			case queue <- result:
+			case <-p.ctx.Done():
+				p.opts.Memory.Release(MaxBlockSize)
+				return
+			}
+			fetch <- pipelineJob{block: block, result: result}
+		}
+	}()
+
+	// each job ends with exactly one result, so the writer never waits
+	// for one that isn't coming
+	for range readers {
+		reading.Add(1)
+		go func() {
+			defer reading.Done()
+			for job := range fetch {
+				if err := p.ctx.Err(); err != nil {
+					p.complete(job, nil, job.block.Compression, err)
+					continue
+				}
+				if p.opts.Cache != nil {
+					data, loading, hit := p.opts.Cache.start(job.block.Checksum)
+					switch {
+					case loading != nil:
+						stages.Add(1)
+						go func() {
+							defer stages.Done()
+							data, err := loading.wait()
+							p.complete(job, data, job.block.Compression, err)
+						}()
+						continue
+					case hit:
+						p.complete(job, data, job.block.Compression, nil)
+						continue
+					}
+					job.cached = true
+				}
+				var err error
+				job.path, job.data, err = readBlockFile(store, backupPath, job.block.Block)
+				if err != nil {
+					p.complete(job, nil, job.block.Compression, err)
+					continue
+				}
+				decompress <- job
+			}
+		}()
+	}
+	go func() {
+		reading.Wait()
+		close(decompress)
+	}()
+	for range jobs {
+		stages.Add(1)
+		go func() {
+			defer stages.Done()
+			for job := range decompress {
+				if err := p.ctx.Err(); err != nil {
+					p.complete(job, nil, job.block.Compression, err)
+					continue
+				}
+				data, decoding, err := decodeBlock(job.path, job.data, job.block.Block, job.block.Compression, job.block.BlockSize)
+				p.complete(job, data, decoding, err)
+			}
+		}()
+	}
+
+	p.write(queue, out)
+	stages.Wait()
+}
+
+// receive waits for the next value on ch. Should the feeder have to wait
+// for memory meanwhile, flush writes the run out to give its memory back,
+// and receive reports whether that worked.
+func receive[T any](ch <-chan T, blocked <-chan struct{}, flush func() bool) (T, bool, bool) {
+	select {
+	case v, more := <-ch:
+		return v, more, true
+	case <-blocked:
+		if !flush() {
+			var zero T
+			return zero, false, false
+		}
+		v, more := <-ch
+		return v, more, true
+	}
+}
+
+// write is the last stage of the pipeline. It writes the blocks in the
+// order they were queued, merging those at contiguous offsets into writes
+// of up to WriteBatch bytes, and leaving zero blocks as holes.
+func (p *passState) write(queue <-chan chan loadedBlock, out io.WriterAt) {
+	var (
+		run blockRun
+		// buf is reused by every run merged
+		buf []byte
+	)
+	flush := func() bool {
+		if len(run.blocks) == 0 {
+			return true
+		}
+		n, err := WriteBlock(run.data, run.offset, out)
+		p.opts.Memory.Release(run.reserved)
+		run.reserved = 0
+		if err != nil {
+			block := run.blockAt(n)
+			p.fail(&OutputError{fmt.Errorf("failed to write block %s at offset %d: %w", block.Checksum, block.Offset, err)})
+			return false
+		}
+		p.count(func(s *RepackStats) { s.BytesWritten += int64(n) })
+		for i, block := range run.blocks {
+			if !p.finish(block, run.sizes[i], run.decodings[i]) {
+				return false
+			}
+		}
+		run = blockRun{blocks: run.blocks[:0], sizes: run.sizes[:0], decodings: run.decodings[:0]}
+		return true
+	}
+
+	ok := true
+	for {
+		result, more, flushed := receive(queue, p.opts.Memory.blocked(), flush)
+		if ok = flushed; !ok || !more {
+			break
+		}
+		if p.ctx.Err() != nil {
+			p.opts.Memory.Release(MaxBlockSize)
+			break
+		}
+		loaded, _, flushed := receive(result, p.opts.Memory.blocked(), flush)
+		if ok = flushed; !ok {
+			p.opts.Memory.Release(MaxBlockSize)
+			break
+		}
+		block, data := loaded.block, loaded.data
+		var action string
+		if loaded.err != nil {
+			var tolerated bool
+			if action, tolerated = p.tolerate(block, loaded.err); !tolerated {
+				p.opts.Memory.Release(MaxBlockSize)
+				if p.ctx.Err() == nil {
+					p.fail(loaded.err)
+					ok = false
+				}
+				break
+			}
+			if action == ActionZeroed {
+				// left as a hole below unless NoSparse is set
+				data = make([]byte, p.extents[block.Offset])
+			}
+		}
+
+		// the output starts empty and every offset is written once, so
+		// zero blocks can be left as holes for the final truncate
+		skip := action == ActionSkipped
+		hole := skip || !p.opts.NoSparse && IsZeroBlock(data)
+		if action != ActionZeroed {
+			p.count(func(s *RepackStats) { s.read(int64(len(data)), hole && !skip) })
+		}
+		if hole {
+			p.opts.Memory.Release(MaxBlockSize)
+			if ok = flush() && p.finish(block, int64(len(data)), loaded.decoding); !ok {
+				break
+			}
+			continue
+		}
+		if len(run.blocks) > 0 && (block.Offset != run.offset+int64(len(run.data)) || int64(len(run.data)+len(data)) > p.opts.WriteBatch) {
+			if ok = flush(); !ok {
+				p.opts.Memory.Release(MaxBlockSize)
+				break
+			}
+		}
+		switch len(run.blocks) {
+		case 0:
+			// a lone block is written as it is; it may be shared with the
+			// cache, so it is never appended to
+			run.offset, run.data = block.Offset, data
+		case 1:
+			buf = append(append(buf[:0], run.data...), data...)
+			run.data = buf
+		default:
+			buf = append(run.data, data...)
+			run.data = buf
+		}
+		run.blocks = append(run.blocks, block)
+		run.sizes = append(run.sizes, int64(len(data)))
+		run.decodings = append(run.decodings, loaded.decoding)
+		run.reserved += MaxBlockSize
+	}
+	// blocks already merged are still written when cancelled
+	if ok {
+		flush()
+	} else {
+		p.opts.Memory.Release(run.reserved)
+	}
+
+	// the rest of the queue is drained so the other stages can finish and
+	// give back their memory
+	for result := range queue {
+		<-result
+		p.opts.Memory.Release(MaxBlockSize)
+	}
+}
@@ -0,0 +1,72 @@
+package backupstore
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func allocatedSize(t *testing.T, path string) int64 {
+	t.Helper()
+	var stat syscall.Stat_t
+	if err := syscall.Stat(path, &stat); err != nil {
+		t.Fatal(err)
+	}
+	return stat.Blocks * 512
+}
+
+func TestRepackSparse(t *testing.T) {
+	volumePath := t.TempDir()
+	blockCount := 8
+
+	zero := writeTestBlock(t, volumePath, make([]byte, testBlockSize))
+	data := writeTestBlock(t, volumePath, testBlockData(1, testBlockSize))
+
+	blocks := []Block{{Offset: 0, Checksum: data}}
+	for i := 1; i < blockCount; i++ {
+		blocks = append(blocks, Block{Offset: int64(i * testBlockSize), Checksum: zero})
+	}
+	backups := []Backup{{Identifier: "backup-1", Compression: "lz4", Blocks: blocks}}
+	imageSize := int64(blockCount * testBlockSize)
+
+	restore := func(noSparse bool) string {
+		out, err := os.Create(filepath.Join(t.TempDir(), "out.raw"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer out.Close()
+
+		err = Repack(context.Background(), os.DirFS(volumePath), ".", backups, out, RepackOptions{Jobs: 2, NoSparse: noSparse})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if err := out.Truncate(imageSize); err != nil {
+			t.Fatal(err)
+		}
+		return out.Name()
+	}
+
+	sparsePath := restore(false)
+	densePath := restore(true)
+
+	sparseContent, err := os.ReadFile(sparsePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	denseContent, err := os.ReadFile(densePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sparseContent, denseContent) {
+		t.Error("Sparse and dense images differ")
+	}
+
+	sparseAllocated := allocatedSize(t, sparsePath)
+	denseAllocated := allocatedSize(t, densePath)
+	if sparseAllocated*2 > denseAllocated {
+		t.Errorf("Expected sparse image to allocate much less than %d bytes, got %d", denseAllocated, sparseAllocated)
+	}
+}
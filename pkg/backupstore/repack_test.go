@@ -0,0 +1,1180 @@
+package backupstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pierrec/lz4/v4"
+)
+
+const testBlockSize = 2 * 1024 * 1024
+
+func compressTestLZ4(tb testing.TB, data []byte) []byte {
+	tb.Helper()
+	var compressed bytes.Buffer
+	zw := lz4.NewWriter(&compressed)
+	if _, err := zw.Write(data); err != nil {
+		tb.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		tb.Fatal(err)
+	}
+	return compressed.Bytes()
+}
+
+func writeTestBlock(tb testing.TB, volumePath string, data []byte) string {
+	tb.Helper()
+	compressed := compressTestLZ4(tb, data)
+
+	sum := sha512.Sum512(data)
+	checksum := hex.EncodeToString(sum[:])
+	blocksDir := filepath.Join(volumePath, "blocks", checksum[0:2], checksum[2:4])
+	if err := os.MkdirAll(blocksDir, 0755); err != nil {
+		tb.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(blocksDir, checksum+".blk"), compressed, 0644); err != nil {
+		tb.Fatal(err)
+	}
+	return checksum
+}
+
+func testBlockData(seed byte, size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = seed + byte(i%251)
+	}
+	return data
+}
+
+func TestRepack(t *testing.T) {
+	volumePath := t.TempDir()
+	blockSize := 4096
+
+	first := writeTestBlock(t, volumePath, testBlockData(1, blockSize))
+	second := writeTestBlock(t, volumePath, testBlockData(2, blockSize))
+	third := writeTestBlock(t, volumePath, testBlockData(3, blockSize))
+
+	backups := []Backup{
+		{
+			Identifier:  "backup-1",
+			Compression: "lz4",
+			Blocks: []Block{
+				{Offset: 0, Checksum: first},
+				{Offset: int64(blockSize), Checksum: first},
+			},
+		},
+		{
+			Identifier:  "backup-2",
+			Compression: "lz4",
+			Blocks: []Block{
+				{Offset: int64(blockSize), Checksum: second},
+				{Offset: int64(2 * blockSize), Checksum: third},
+			},
+		},
+	}
+
+	for _, jobs := range []int{1, 4} {
+		t.Run(fmt.Sprintf("jobs=%d", jobs), func(t *testing.T) {
+			out, err := os.Create(filepath.Join(t.TempDir(), "out.raw"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer out.Close()
+
+			err = Repack(context.Background(), os.DirFS(volumePath), ".", backups, out, RepackOptions{Jobs: jobs})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			content, err := os.ReadFile(out.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := append(append(testBlockData(1, blockSize), testBlockData(2, blockSize)...), testBlockData(3, blockSize)...)
+			if !bytes.Equal(content, expected) {
+				t.Error("Restored image does not match expected content")
+			}
+		})
+	}
+}
+
+func TestRepackMissingBlock(t *testing.T) {
+	volumePath := t.TempDir()
+	present := writeTestBlock(t, volumePath, testBlockData(1, 4096))
+
+	blocks := []Block{{Offset: 0, Checksum: "0123456789abcdef0123456789abcdef"}}
+	for i := 1; i < 32; i++ {
+		blocks = append(blocks, Block{Offset: int64(i * 4096), Checksum: present})
+	}
+	backups := []Backup{{Identifier: "backup-1", Compression: "lz4", Blocks: blocks}}
+
+	out, err := os.Create(filepath.Join(t.TempDir(), "out.raw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	err = Repack(context.Background(), os.DirFS(volumePath), ".", backups, out, RepackOptions{Jobs: 4})
+	if err == nil {
+		t.Fatal("Expected error but got none")
+	}
+}
+
+var errTestDiskFull = errors.New("no space left on device")
+
+// failingWriter accepts a number of writes and then fails every one after
+
+type failingWriter struct {
+	mu     sync.Mutex
+	writes int
+	limit  int
+}
+
+func (w *failingWriter) WriteAt(p []byte, off int64) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.writes >= w.limit {
+		return 0, errTestDiskFull
+	}
+	w.writes++
+	return len(p), nil
+}
+
+func TestRepackWriteError(t *testing.T) {
+	volumePath := t.TempDir()
+	checksum := writeTestBlock(t, volumePath, testBlockData(1, 4096))
+
+	blocks := make([]Block, 0, 32)
+	for i := 0; i < 32; i++ {
+		blocks = append(blocks, Block{Offset: int64(i * 4096), Checksum: checksum})
+	}
+	backups := []Backup{{Identifier: "backup-1", Compression: "lz4", Blocks: blocks}}
+
+	for _, jobs := range []int{1, 4} {
+		t.Run(fmt.Sprintf("jobs=%d", jobs), func(t *testing.T) {
+			out := &failingWriter{limit: 5}
+			err := Repack(context.Background(), os.DirFS(volumePath), ".", backups, out, RepackOptions{Jobs: jobs})
+			if err == nil {
+				t.Fatal("Expected error but got none")
+			}
+			if !errors.Is(err, errTestDiskFull) {
+				t.Errorf("Expected the write error, got %v", err)
+			}
+		})
+	}
+}
+
+// cancellingWriter cancels a restore once it has taken a number of writes
+
+type cancellingWriter struct {
+	mu     sync.Mutex
+	writes int
+	limit  int
+	cancel context.CancelFunc
+}
+
+func (w *cancellingWriter) WriteAt(p []byte, off int64) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.writes++
+	if w.writes == w.limit {
+		w.cancel()
+	}
+	return len(p), nil
+}
+
+func TestRepackCancelled(t *testing.T) {
+	volumePath := t.TempDir()
+	checksum := writeTestBlock(t, volumePath, testBlockData(1, 4096))
+
+	blocks := make([]Block, 0, 32)
+	for i := 0; i < 32; i++ {
+		blocks = append(blocks, Block{Offset: int64(i * 4096), Checksum: checksum})
+	}
+	backups := []Backup{
+		{Identifier: "backup-1", Compression: "lz4", Blocks: blocks[:16]},
+		{Identifier: "backup-2", Compression: "lz4", Blocks: blocks[16:]},
+	}
+
+	for _, jobs := range []int{1, 4} {
+		t.Run(fmt.Sprintf("jobs=%d", jobs), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			out := &cancellingWriter{limit: 5, cancel: cancel}
+			err := Repack(ctx, os.DirFS(volumePath), ".", backups, out, RepackOptions{Jobs: jobs})
+
+			var interrupted *InterruptedError
+			if !errors.As(err, &interrupted) {
+				t.Fatalf("Expected the restore to be interrupted, got %v", err)
+			}
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("Expected the cancellation as the cause, got %v", err)
+			}
+			// the blocks already handed to workers are finished, nothing
+			// is started after
+			if interrupted.Restored != out.writes || out.writes < 5 || out.writes > 5+jobs {
+				t.Errorf("Expected the %d blocks written to be reported, got %d restored", out.writes, interrupted.Restored)
+			}
+			if interrupted.Total != 32 {
+				t.Errorf("Expected 32 blocks in total, got %d", interrupted.Total)
+			}
+		})
+	}
+
+}
+
+// remoteTestFS is a local store that claims to be remote, so blocks are
+// read by as many readers as there are jobs
+type remoteTestFS struct {
+	fs.FS
+}
+
+func (remoteTestFS) Remote() bool { return true }
+
+func TestRepackPipeline(t *testing.T) {
+	volumePath := t.TempDir()
+	shared := writeTestBlock(t, volumePath, testBlockData(1, 4096))
+	blocks := make([]Block, 0, 32)
+	var expected []byte
+	for i := range 32 {
+		checksum := shared
+		if i%3 == 0 {
+			checksum = writeTestBlock(t, volumePath, testBlockData(byte(i+2), 4096))
+		}
+		blocks = append(blocks, Block{Offset: int64(i * 4096), Checksum: checksum})
+		data, err := LoadBlock(os.DirFS(volumePath), ".", blocks[i], "lz4", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, data...)
+	}
+	backups := []Backup{{Identifier: "backup-1", Compression: "lz4", Blocks: blocks}}
+
+	stores := map[string]fs.FS{"local": os.DirFS(volumePath), "remote": remoteTestFS{os.DirFS(volumePath)}}
+	for name, store := range stores {
+		for _, jobs := range []int{1, 4} {
+			t.Run(fmt.Sprintf("%s/jobs=%d", name, jobs), func(t *testing.T) {
+				out := &recordingWriter{writes: make(map[int64]int)}
+				cache := NewBlockCache(1 << 20)
+				err := Repack(context.Background(), store, ".", backups, out, RepackOptions{Jobs: jobs, Cache: cache, WriteBatch: 16 * 4096})
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				if !bytes.Equal(out.content, expected) {
+					t.Error("Restored image does not match expected content")
+				}
+				if len(out.writes) != 2 {
+					t.Errorf("Expected 2 writes of 16 blocks, got %v", out.writes)
+				}
+				// the shared block is loaded once, however far ahead it is read
+				if _, misses := cache.Stats(); misses != 12 {
+					t.Errorf("Expected 12 blocks loaded, got %d", misses)
+				}
+			})
+		}
+	}
+}
+
+func TestRepackPipelineErrors(t *testing.T) {
+	volumePath := t.TempDir()
+	checksum := writeTestBlock(t, volumePath, testBlockData(1, 4096))
+	blocks := make([]Block, 0, 32)
+	for i := range 32 {
+		blocks = append(blocks, Block{Offset: int64(i * 4096), Checksum: checksum})
+	}
+	missing := slices.Clone(blocks)
+	missing[20].Checksum = "0123456789abcdef0123456789abcdef"
+
+	tests := []struct {
+		name   string
+		blocks []Block
+		out    io.WriterAt
+		cancel bool
+		check  func(error) bool
+	}{
+		{name: "missing block", blocks: missing, out: &recordingWriter{writes: make(map[int64]int)}, check: func(err error) bool {
+			var blockErr *BlockError
+			return errors.As(err, &blockErr)
+		}},
+		{name: "write error", blocks: blocks, out: &failingWriter{limit: 1}, check: func(err error) bool {
+			var outputErr *OutputError
+			return errors.As(err, &outputErr) && errors.Is(err, errTestDiskFull)
+		}},
+		{name: "cancelled", blocks: blocks, cancel: true, check: func(err error) bool {
+			var interrupted *InterruptedError
+			return errors.As(err, &interrupted) && interrupted.Restored < 32
+		}},
+	}
+	for _, tt := range tests {
+		for _, jobs := range []int{1, 4} {
+			t.Run(fmt.Sprintf("%s/jobs=%d", tt.name, jobs), func(t *testing.T) {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				out := tt.out
+				if tt.cancel {
+					out = &cancellingWriter{limit: 1, cancel: cancel}
+				}
+				backups := []Backup{{Identifier: "backup-1", Compression: "lz4", Blocks: tt.blocks}}
+				opts := RepackOptions{Jobs: jobs, WriteBatch: 4 * 4096, Memory: NewMemoryBudget(8 * MaxBlockSize)}
+
+				done := make(chan error)
+				go func() {
+					done <- Repack(ctx, os.DirFS(volumePath), ".", backups, out, opts)
+				}()
+				select {
+				case err := <-done:
+					if !tt.check(err) {
+						t.Errorf("Unexpected error: %v", err)
+					}
+				case <-time.After(10 * time.Second):
+					t.Fatal("Expected the pipeline to drain and return")
+				}
+			})
+		}
+	}
+}
+
+func TestRepackSkipsOverwrittenBlocks(t *testing.T) {
+	volumePath := t.TempDir()
+	blockSize := 4096
+
+	newer := writeTestBlock(t, volumePath, testBlockData(2, blockSize))
+	kept := writeTestBlock(t, volumePath, testBlockData(3, blockSize))
+
+	// the older block at offset 0 does not exist on disk, so the restore
+	// only succeeds if it is never read
+	backups := []Backup{
+		{
+			Identifier:  "backup-1",
+			Compression: "lz4",
+			Blocks: []Block{
+				{Offset: 0, Checksum: "00000000000000000000000000000000"},
+				{Offset: int64(blockSize), Checksum: kept},
+			},
+		},
+		{
+			Identifier:  "backup-2",
+			Compression: "lz4",
+			Blocks: []Block{
+				{Offset: 0, Checksum: newer},
+			},
+		},
+	}
+
+	out, err := os.Create(filepath.Join(t.TempDir(), "out.raw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	err = Repack(context.Background(), os.DirFS(volumePath), ".", backups, out, RepackOptions{Jobs: 2})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	content, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := append(testBlockData(2, blockSize), testBlockData(3, blockSize)...)
+	if !bytes.Equal(content, expected) {
+		t.Error("Restored image does not match expected content")
+	}
+}
+
+func TestRepackLegacyPasses(t *testing.T) {
+	volumePath := t.TempDir()
+	blockSize := 4096
+	zero := writeTestBlock(t, volumePath, make([]byte, blockSize))
+
+	// every backup rewrites most of the offsets of the one before, out of
+	// order, and leaves some to it; offset 31 is never written
+	var backups []Backup
+	for b := range 6 {
+		var blocks []Block
+		for i := 30; i >= 0; i-- {
+			if (i+b)%4 == 0 {
+				continue
+			}
+			checksum := zero
+			if (i*b)%7 != 3 {
+				checksum = writeTestBlock(t, volumePath, testBlockData(byte(b*31+i), blockSize))
+			}
+			blocks = append(blocks, Block{Offset: int64(i * blockSize), Checksum: checksum})
+		}
+		backups = append(backups, Backup{Identifier: fmt.Sprintf("backup-%d", b+1), Compression: "lz4", BlockSize: int64(blockSize), Blocks: blocks})
+	}
+
+	restore := func(opts RepackOptions) ([]byte, *RepackStats) {
+		t.Helper()
+		out, err := os.Create(filepath.Join(t.TempDir(), "out.raw"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer out.Close()
+		opts.Stats = &RepackStats{}
+		if err := Repack(context.Background(), os.DirFS(volumePath), ".", backups, out, opts); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if err := out.Truncate(int64(32 * blockSize)); err != nil {
+			t.Fatal(err)
+		}
+		content, err := os.ReadFile(out.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return content, opts.Stats
+	}
+	// every backup replayed over the last, oldest first
+	expected := make([]byte, 32*blockSize)
+	for _, backup := range backups {
+		for _, block := range backup.Blocks {
+			data, err := LoadBlock(os.DirFS(volumePath), ".", block, "lz4", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			copy(expected[block.Offset:], data)
+		}
+	}
+	for _, opts := range []RepackOptions{
+		{Jobs: 4},
+		{Jobs: 4, WriteBatch: 16 << 10},
+		{Jobs: 4, NoSparse: true},
+	} {
+		single, singleStats := restore(opts)
+		opts.LegacyPasses = true
+		legacy, legacyStats := restore(opts)
+		if !bytes.Equal(single, expected) {
+			t.Errorf("Expected the single pass to restore every backup replayed in order with %+v", opts)
+		}
+		if !bytes.Equal(single, legacy) {
+			t.Errorf("Expected the single pass to restore the same image as the legacy passes with %+v", opts)
+		}
+		if singleStats.BytesWritten > legacyStats.BytesWritten || singleStats.BlocksRead != legacyStats.BlocksRead || singleStats.BlocksSkipped != legacyStats.BlocksSkipped {
+			t.Errorf("Expected the single pass to read and skip as much as the legacy passes, got %+v and %+v", singleStats, legacyStats)
+		}
+	}
+}
+
+func TestRepackDuplicateOffsets(t *testing.T) {
+	volumePath := t.TempDir()
+	blockSize := 4096
+
+	first := writeTestBlock(t, volumePath, testBlockData(1, blockSize))
+	second := writeTestBlock(t, volumePath, testBlockData(2, blockSize))
+	third := writeTestBlock(t, volumePath, testBlockData(3, blockSize))
+	backups := []Backup{{
+		Identifier:  "backup-1",
+		Compression: "lz4",
+		Blocks: []Block{
+			{Offset: int64(blockSize), Checksum: third},
+			{Offset: 0, Checksum: first},
+			{Offset: 0, Checksum: second},
+		},
+	}}
+
+	for _, batch := range []int64{0, 1 << 20} {
+		var logged bytes.Buffer
+		out := &recordingWriter{writes: make(map[int64]int)}
+		stats := &RepackStats{}
+		err := Repack(context.Background(), os.DirFS(volumePath), ".", backups, out, RepackOptions{
+			Jobs:       2,
+			WriteBatch: batch,
+			Logger:     slog.New(slog.NewTextHandler(&logged, nil)),
+			Stats:      stats,
+		})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		expected := append(testBlockData(2, blockSize), testBlockData(3, blockSize)...)
+		if !bytes.Equal(out.content, expected) {
+			t.Errorf("Expected the last block listed at offset 0 to be restored with a write batch of %d", batch)
+		}
+		if !strings.Contains(logged.String(), "level=WARN") || !strings.Contains(logged.String(), "offsets=[0]") {
+			t.Errorf("Expected a warning of the duplicate offset 0, got %q", logged.String())
+		}
+		if stats.BlocksRead != 2 || stats.BlocksSkipped != 1 {
+			t.Errorf("Expected 2 blocks read and 1 skipped, got %d and %d", stats.BlocksRead, stats.BlocksSkipped)
+		}
+	}
+
+	final := FinalBlockMap(backups)
+	if len(final) != 2 || final[0].Checksum != second || final[1].Checksum != third {
+		t.Errorf("Expected the final blocks %s and %s, got %v", second, third, final)
+	}
+}
+
+func TestRepackStrict(t *testing.T) {
+	volumePath := t.TempDir()
+	blockSize := 4096
+	first := writeTestBlock(t, volumePath, testBlockData(1, blockSize))
+	second := writeTestBlock(t, volumePath, testBlockData(2, blockSize))
+	backups := []Backup{{
+		Identifier:  "backup-1",
+		ConfigPath:  "backups/backup_backup-1.cfg",
+		Compression: "lz4",
+		BlockSize:   int64(blockSize),
+		Blocks:      []Block{{Offset: 0, Checksum: first}, {Offset: 6000, Checksum: second}},
+	}}
+
+	var logged bytes.Buffer
+	out := &recordingWriter{writes: make(map[int64]int)}
+	err := Repack(context.Background(), os.DirFS(volumePath), ".", backups, out, RepackOptions{
+		VolumeSize: 16384,
+		Logger:     slog.New(slog.NewTextHandler(&logged, nil)),
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !strings.Contains(logged.String(), "offsets=[6000] cfg=backups/backup_backup-1.cfg") {
+		t.Errorf("Expected a warning of the misaligned offset, got %q", logged.String())
+	}
+
+	out = &recordingWriter{writes: make(map[int64]int)}
+	err = Repack(context.Background(), os.DirFS(volumePath), ".", backups, out, RepackOptions{VolumeSize: 16384, Strict: true})
+	var malformed *MalformedBackupError
+	if !errors.As(err, &malformed) {
+		t.Fatalf("Expected a MalformedBackupError, got %v", err)
+	}
+	if len(out.writes) != 0 {
+		t.Errorf("Expected nothing written, got %d writes", len(out.writes))
+	}
+}
+
+// recordingWriter keeps every write it takes
+type recordingWriter struct {
+	mu      sync.Mutex
+	content []byte
+	writes  map[int64]int
+}
+
+func (w *recordingWriter) WriteAt(p []byte, off int64) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if end := off + int64(len(p)); end > int64(len(w.content)) {
+		w.content = append(w.content, make([]byte, end-int64(len(w.content)))...)
+	}
+	copy(w.content[off:], p)
+	w.writes[off] = len(p)
+	return len(p), nil
+}
+
+func TestRepackWriteBatch(t *testing.T) {
+	volumePath := t.TempDir()
+	blockSize := 4096
+	zero := writeTestBlock(t, volumePath, make([]byte, blockSize))
+	checksums := make([]string, 10)
+	for i := range checksums {
+		checksums[i] = writeTestBlock(t, volumePath, testBlockData(byte(i+1), blockSize))
+	}
+
+	// offsets 0-3 are contiguous, 4 is zero, 5-6 follow it, 7 is missing
+	// and 8-9 come after the gap; the cfg lists them out of order
+	offsets := []int{9, 2, 0, 5, 3, 1, 8, 6, 4}
+	blocks := make([]Block, 0, len(offsets))
+	for _, i := range offsets {
+		checksum := checksums[i]
+		if i == 4 {
+			checksum = zero
+		}
+		blocks = append(blocks, Block{Offset: int64(i * blockSize), Checksum: checksum})
+	}
+	backups := []Backup{{Identifier: "backup-1", Compression: "lz4", Blocks: blocks}}
+
+	tests := []struct {
+		name     string
+		batch    int64
+		noSparse bool
+		expected map[int64]int
+	}{
+		{name: "per block", batch: 0, expected: map[int64]int{0: 4096, 4096: 4096, 8192: 4096, 12288: 4096, 20480: 4096, 24576: 4096, 32768: 4096, 36864: 4096}},
+		{name: "coalesced", batch: 1 << 20, expected: map[int64]int{0: 16384, 20480: 8192, 32768: 8192}},
+		{name: "no sparse", batch: 1 << 20, noSparse: true, expected: map[int64]int{0: 28672, 32768: 8192}},
+		// a write takes at most 3 blocks
+		{name: "bounded", batch: 3 * 4096, expected: map[int64]int{0: 12288, 12288: 4096, 20480: 8192, 32768: 8192}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := &recordingWriter{writes: make(map[int64]int)}
+			err := Repack(context.Background(), os.DirFS(volumePath), ".", backups, out, RepackOptions{Jobs: 2, WriteBatch: tt.batch, NoSparse: tt.noSparse})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !maps.Equal(out.writes, tt.expected) {
+				t.Errorf("Expected writes %v, got %v", tt.expected, out.writes)
+			}
+
+			var expected []byte
+			for i := range 10 {
+				switch i {
+				case 4, 7:
+					expected = append(expected, make([]byte, blockSize)...)
+				default:
+					expected = append(expected, testBlockData(byte(i+1), blockSize)...)
+				}
+			}
+			if !bytes.Equal(out.content, expected) {
+				t.Error("Restored image does not match expected content")
+			}
+		})
+	}
+}
+
+func TestRepackWriteBatchError(t *testing.T) {
+	volumePath := t.TempDir()
+	first := writeTestBlock(t, volumePath, testBlockData(1, 4096))
+	second := writeTestBlock(t, volumePath, testBlockData(2, 4096))
+	backups := []Backup{{Identifier: "backup-1", Compression: "lz4", Blocks: []Block{{Offset: 0, Checksum: first}, {Offset: 4096, Checksum: second}}}}
+
+	// the merged write stops in the second block
+	out := &limitedWriter{limit: 6000}
+	err := Repack(context.Background(), os.DirFS(volumePath), ".", backups, out, RepackOptions{WriteBatch: 1 << 20})
+	var outputErr *OutputError
+	if !errors.As(err, &outputErr) || !errors.Is(err, errTestDiskFull) {
+		t.Fatalf("Expected an output error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), second) || !strings.Contains(err.Error(), "offset 4096") {
+		t.Errorf("Expected the error to name the second block, got %v", err)
+	}
+}
+
+// limitedWriter takes limit bytes and then fails
+type limitedWriter struct {
+	limit int
+}
+
+func (w *limitedWriter) WriteAt(p []byte, off int64) (int, error) {
+	n := min(len(p), w.limit)
+	w.limit -= n
+	if n < len(p) {
+		return n, errTestDiskFull
+	}
+	return n, nil
+}
+
+func TestIsZeroBlock(t *testing.T) {
+	if !IsZeroBlock(make([]byte, 10000)) {
+		t.Error("Expected zero block to be detected")
+	}
+	data := make([]byte, 10000)
+	data[9999] = 1
+	if IsZeroBlock(data) {
+		t.Error("Expected block with trailing data not to be zero")
+	}
+	if !IsZeroBlock(nil) {
+		t.Error("Expected empty block to be zero")
+	}
+}
+
+func TestVerifyBlockChecksum(t *testing.T) {
+	data := []byte("block content")
+	sha512Sum := sha512.Sum512(data)
+	sha256Sum := sha256.Sum256(data)
+	sha1Sum := sha1.Sum(data)
+	tests := []struct {
+		algorithm string
+		sum       []byte
+	}{
+		{algorithm: "sha512", sum: sha512Sum[:]},
+		{algorithm: "sha256", sum: sha256Sum[:]},
+		{algorithm: "sha1", sum: sha1Sum[:]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.algorithm, func(t *testing.T) {
+			checksum := hex.EncodeToString(tt.sum)
+			if algorithm, err := ChecksumAlgorithm(checksum); err != nil || algorithm != tt.algorithm {
+				t.Errorf("Expected %s, got %s and %v", tt.algorithm, algorithm, err)
+			}
+			if err := VerifyBlockChecksum("block.blk", data, checksum); err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+
+			err := VerifyBlockChecksum("block.blk", []byte("corrupted block"), checksum)
+			var mismatch *ChecksumMismatchError
+			if !errors.As(err, &mismatch) {
+				t.Fatalf("Expected checksum mismatch error, got %v", err)
+			}
+			if mismatch.Expected != checksum || len(mismatch.Actual) != len(checksum) {
+				t.Errorf("Expected checksum %s, got %s for %s", checksum, mismatch.Expected, mismatch.Actual)
+			}
+
+			// streamed blocks are checked with the same hash
+			volumePath := t.TempDir()
+			blocksDir := filepath.Join(volumePath, "blocks", checksum[0:2], checksum[2:4])
+			if err := os.MkdirAll(blocksDir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(blocksDir, checksum+".blk"), compressTestLZ4(t, data), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := CopyBlock(io.Discard, os.DirFS(volumePath), ".", Block{Checksum: checksum}, "lz4", 0, make([]byte, 1024)); err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+
+	for _, checksum := range []string{"", strings.Repeat("ab", 50), strings.Repeat("zz", 32)} {
+		if _, err := ChecksumAlgorithm(checksum); err == nil {
+			t.Errorf("Expected an error for %q", checksum)
+		}
+	}
+}
+
+func TestCopyBlock(t *testing.T) {
+	volumePath := t.TempDir()
+	checksum := writeTestBlock(t, volumePath, testBlockData(1, 10000))
+
+	// a small buffer makes the block arrive in several writes
+	var copied bytes.Buffer
+	n, err := CopyBlock(&copied, os.DirFS(volumePath), ".", Block{Checksum: checksum}, "lz4", 0, make([]byte, 1024))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if n != 10000 || !bytes.Equal(copied.Bytes(), testBlockData(1, 10000)) {
+		t.Errorf("Expected the 10000 byte block, got %d bytes", n)
+	}
+
+	_, err = CopyBlock(failingDst{}, os.DirFS(volumePath), ".", Block{Checksum: checksum}, "lz4", 0, make([]byte, 1024))
+	var blockErr *BlockError
+	if !errors.Is(err, errTestDiskFull) || errors.As(err, &blockErr) {
+		t.Errorf("Expected the write error as it is, got %v", err)
+	}
+}
+
+// decodingProgress records how each block of a repack was decompressed
+type decodingProgress map[int64]string
+
+func (decodingProgress) StartPass(pass, totalPasses, blocks int) {}
+func (decodingProgress) EndPass(pass, totalPasses int)           {}
+func (d decodingProgress) Block(pass, totalPasses, done, totalBlocks int, block Block, decoding string, written int64) {
+	d[block.Offset] = decoding
+}
+
+func TestLegacyLZ4Block(t *testing.T) {
+	// a bare lz4 block, as an older Longhorn version wrote them
+	legacy := "725ccf0b6c82841b8eca77e533d824c7150ce740354d03467dee39b9c15a8a6f2f4684aff21ba3170365762ec44637b890c77f363520d9e8c7445531d4895a2e"
+	expected := []byte(strings.Repeat("longhorn legacy lz4 block\n", 2600)[:65536])
+	volumePath := t.TempDir()
+	if err := os.CopyFS(volumePath, os.DirFS("testdata/legacy-lz4/volumes/pvc-legacy")); err != nil {
+		t.Fatal(err)
+	}
+	framed := writeTestBlock(t, volumePath, testBlockData(1, 65536))
+	store := os.DirFS(volumePath)
+
+	data, err := LoadBlock(store, ".", Block{Checksum: legacy}, "lz4", 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !bytes.Equal(data, expected) {
+		t.Errorf("Expected the %d bytes of the block, got %d", len(expected), len(data))
+	}
+	var copied bytes.Buffer
+	if _, err := CopyBlock(&copied, store, ".", Block{Checksum: legacy}, "lz4", 0, make([]byte, 1024)); err != nil || !bytes.Equal(copied.Bytes(), expected) {
+		t.Errorf("Expected the block to be copied, got %d bytes and %v", copied.Len(), err)
+	}
+
+	backups := []Backup{{Identifier: "backup-1", Compression: "lz4", Blocks: []Block{
+		{Offset: 0, Checksum: legacy},
+		{Offset: 65536, Checksum: framed},
+	}}}
+	// streamed, and decompressed whole by the pipeline
+	for _, batch := range []int64{0, testBlockSize} {
+		t.Run(fmt.Sprintf("batch=%d", batch), func(t *testing.T) {
+			out, err := os.Create(filepath.Join(t.TempDir(), "out.raw"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer out.Close()
+			decodings := make(decodingProgress)
+			err = Repack(context.Background(), store, ".", backups, out, RepackOptions{Jobs: 2, WriteBatch: batch, Progress: decodings})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if decodings[0] != LZ4Block || decodings[65536] != "lz4" {
+				t.Errorf("Expected the first block decompressed as %s and the second as lz4, got %v", LZ4Block, decodings)
+			}
+		})
+	}
+
+	if _, err := DecompressLZ4([]byte("neither lz4 nor anything else")); err == nil || !strings.Contains(err.Error(), "neither an lz4 frame nor an lz4 block") {
+		t.Errorf("Expected both formats to be reported failing, got %v", err)
+	}
+}
+
+type failingDst struct{}
+
+func (failingDst) Write(p []byte) (int, error) {
+	return 0, errTestDiskFull
+}
+
+func TestBlockTooLarge(t *testing.T) {
+	volumePath := t.TempDir()
+	exact := writeTestBlock(t, volumePath, testBlockData(1, MaxBlockSize))
+	// a run of zeroes compresses to next to nothing
+	oversized := writeTestBlock(t, volumePath, make([]byte, MaxBlockSize+1))
+	store := os.DirFS(volumePath)
+
+	if _, err := LoadBlock(store, ".", Block{Checksum: exact}, "lz4", 0); err != nil {
+		t.Errorf("Unexpected error for a block of exactly %d bytes: %v", MaxBlockSize, err)
+	}
+	_, err := LoadBlock(store, ".", Block{Checksum: oversized}, "lz4", 0)
+	var blockErr *BlockError
+	if !errors.Is(err, ErrBlockTooLarge) || !errors.As(err, &blockErr) {
+		t.Errorf("Expected a block error for the oversized block, got %v", err)
+	}
+
+	var copied bytes.Buffer
+	_, err = CopyBlock(&copied, store, ".", Block{Checksum: oversized}, "lz4", 0, make([]byte, 4096))
+	if !errors.Is(err, ErrBlockTooLarge) {
+		t.Errorf("Expected the oversized block to be rejected, got %v", err)
+	}
+	if copied.Len() > MaxBlockSize {
+		t.Errorf("Expected at most %d bytes to be copied, got %d", MaxBlockSize, copied.Len())
+	}
+}
+
+func TestRepackBlockSizeMismatch(t *testing.T) {
+	volumePath := t.TempDir()
+	full := writeTestBlock(t, volumePath, testBlockData(1, 4096))
+	short := writeTestBlock(t, volumePath, testBlockData(2, 1024))
+	backups := []Backup{{
+		Identifier:  "backup-1",
+		Compression: "lz4",
+		BlockSize:   4096,
+		Blocks:      []Block{{Offset: 0, Checksum: full}, {Offset: 4096, Checksum: short}},
+	}}
+
+	for _, opts := range []RepackOptions{
+		{Jobs: 2},
+		{Jobs: 2, WriteBatch: 1 << 20},
+		// neither policy tolerates a block of the wrong size
+		{Jobs: 2, OnChecksumMismatch: MismatchSkip, OnMissingBlock: MissingZero},
+	} {
+		out, err := os.Create(filepath.Join(t.TempDir(), "out.raw"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = Repack(context.Background(), os.DirFS(volumePath), ".", backups, out, opts)
+		out.Close()
+		var sizeErr *BlockSizeError
+		var blockErr *BlockError
+		if !errors.As(err, &sizeErr) || !errors.As(err, &blockErr) {
+			t.Fatalf("Expected a block size error, got %v", err)
+		}
+		if sizeErr.Checksum != short || sizeErr.Offset != 4096 || sizeErr.Expected != 4096 || sizeErr.Actual != 1024 {
+			t.Errorf("Expected block %s at offset 4096 of 1024 bytes rather than 4096, got %+v", short, sizeErr)
+		}
+	}
+
+	// a block past its size stops being decompressed there
+	_, err := LoadBlock(os.DirFS(volumePath), ".", Block{Checksum: full}, "lz4", 1024)
+	if !errors.Is(err, ErrBlockTooLarge) {
+		t.Errorf("Expected the block to be too large for 1024 bytes, got %v", err)
+	}
+	var copied bytes.Buffer
+	_, err = CopyBlock(&copied, os.DirFS(volumePath), ".", Block{Checksum: full}, "lz4", 1024, make([]byte, 4096))
+	if !errors.Is(err, ErrBlockTooLarge) || copied.Len() > 1024 {
+		t.Errorf("Expected at most 1024 bytes copied before failing, got %d and %v", copied.Len(), err)
+	}
+}
+
+func TestRepackCorruptedBlock(t *testing.T) {
+	volumePath := t.TempDir()
+	checksum := writeTestBlock(t, volumePath, testBlockData(1, 4096))
+
+	blockPath, err := ResolveBlockPath(os.DirFS(volumePath), ".", checksum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a well-formed lz4 stream whose content no longer matches the checksum
+	corrupted := testBlockData(1, 4096)
+	corrupted[100] ^= 0xff
+	if err := os.WriteFile(filepath.Join(volumePath, blockPath), compressTestLZ4(t, corrupted), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	backups := []Backup{{
+		Identifier:  "backup-1",
+		Compression: "lz4",
+		Blocks:      []Block{{Offset: 0, Checksum: checksum}},
+	}}
+
+	out, err := os.Create(filepath.Join(t.TempDir(), "out.raw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	err = Repack(context.Background(), os.DirFS(volumePath), ".", backups, out, RepackOptions{Jobs: 1})
+	var mismatch *ChecksumMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("Expected checksum mismatch error, got %v", err)
+	}
+	if mismatch.Path != blockPath {
+		t.Errorf("Expected path %s, got %s", blockPath, mismatch.Path)
+	}
+}
+
+func BenchmarkRepackPass(b *testing.B) {
+	volumePath := b.TempDir()
+	blocks := make([]Block, 0, 32)
+	for i := 0; i < 32; i++ {
+		checksum := writeTestBlock(b, volumePath, testBlockData(byte(i), testBlockSize))
+		blocks = append(blocks, Block{Offset: int64(i * testBlockSize), Checksum: checksum})
+	}
+	final := FinalBlockMap([]Backup{{Identifier: "backup-1", Compression: "lz4", Blocks: blocks}})
+	store := os.DirFS(volumePath)
+
+	for _, jobs := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("jobs=%d", jobs), func(b *testing.B) {
+			out, err := os.Create(filepath.Join(b.TempDir(), "out.raw"))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer out.Close()
+
+			b.SetBytes(int64(len(blocks) * testBlockSize))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := repackPass(context.Background(), store, ".", final, 1, 1, out, nil, &RepackStats{}, RepackOptions{Jobs: jobs})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkRepackWriteBatch(b *testing.B) {
+	volumePath := b.TempDir()
+	blocks := make([]Block, 0, 64)
+	for i := 0; i < 64; i++ {
+		checksum := writeTestBlock(b, volumePath, testBlockData(byte(i), testBlockSize))
+		blocks = append(blocks, Block{Offset: int64(i * testBlockSize), Checksum: checksum})
+	}
+	final := FinalBlockMap([]Backup{{Identifier: "backup-1", Compression: "lz4", Blocks: blocks}})
+	// blocks are cached so the writes are what is measured
+	store := os.DirFS(volumePath)
+	cache := NewBlockCache(int64(len(blocks) * testBlockSize))
+
+	for _, batch := range []int64{0, 8 << 20, 32 << 20} {
+		b.Run(fmt.Sprintf("batch=%d", batch), func(b *testing.B) {
+			out, err := os.Create(filepath.Join(b.TempDir(), "out.raw"))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer out.Close()
+
+			b.SetBytes(int64(len(blocks) * testBlockSize))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := repackPass(context.Background(), store, ".", final, 1, 1, out, nil, &RepackStats{}, RepackOptions{Jobs: 4, Cache: cache, WriteBatch: batch})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteBlock(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "test-write-block")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	testData := []byte("test data")
+	n, err := WriteBlock(testData, 10, tmpFile)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if n != len(testData) {
+		t.Errorf("Expected %d bytes written, got %d", len(testData), n)
+	}
+
+	// Verify written data
+	tmpFile.Seek(10, 0)
+	readData := make([]byte, len(testData))
+	_, err = tmpFile.Read(readData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(readData) != string(testData) {
+		t.Errorf("Expected %s, got %s", string(testData), string(readData))
+	}
+}
+
+// shortWriter writes at most limit bytes per call into data
+type shortWriter struct {
+	data  []byte
+	limit int
+}
+
+func (w *shortWriter) WriteAt(p []byte, off int64) (int, error) {
+	n := copy(w.data[off:], p[:min(len(p), w.limit)])
+	return n, nil
+}
+
+func TestWriteBlockShortWrite(t *testing.T) {
+	w := &shortWriter{data: make([]byte, 16), limit: 4}
+	n, err := WriteBlock([]byte("test data"), 2, w)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if n != 9 || string(w.data[2:11]) != "test data" {
+		t.Errorf("Expected the partial writes to be continued, got %d bytes: %q", n, w.data)
+	}
+
+	// a writer that stops making progress fails the block
+	n, err = WriteBlock([]byte("test data"), 0, &shortWriter{data: make([]byte, 16)})
+	if !errors.Is(err, io.ErrShortWrite) || n != 0 {
+		t.Errorf("Expected short write error, got %d bytes and %v", n, err)
+	}
+}
+
+func TestRepackChecksumMismatch(t *testing.T) {
+	volumePath := t.TempDir()
+	blockSize := 4096
+	var blocks []Block
+	for i := range 3 {
+		checksum := writeTestBlock(t, volumePath, testBlockData(byte(i+1), blockSize))
+		blocks = append(blocks, Block{Offset: int64(i * blockSize), Checksum: checksum})
+	}
+	blockPath, err := ResolveBlockPath(os.DirFS(volumePath), ".", blocks[1].Checksum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupted := testBlockData(2, blockSize)
+	corrupted[100] ^= 0xff
+	if err := os.WriteFile(filepath.Join(volumePath, blockPath), compressTestLZ4(t, corrupted), 0644); err != nil {
+		t.Fatal(err)
+	}
+	backups := []Backup{{Identifier: "backup-1", Compression: "lz4", Blocks: blocks}}
+
+	tests := []struct {
+		name     string
+		policy   MismatchPolicy
+		middle   []byte
+		action   string
+		expected bool
+	}{
+		{name: "fail", policy: MismatchFail},
+		{name: "warn", policy: MismatchWarn, middle: corrupted, action: ActionWritten, expected: true},
+		{name: "skip", policy: MismatchSkip, middle: make([]byte, blockSize), action: ActionSkipped, expected: true},
+	}
+	for _, tt := range tests {
+		for _, batch := range []int64{0, 1 << 20} {
+			t.Run(fmt.Sprintf("%s/batch %d", tt.name, batch), func(t *testing.T) {
+				out := &recordingWriter{writes: make(map[int64]int)}
+				damaged := &DamageReport{}
+				opts := RepackOptions{Jobs: 2, WriteBatch: batch, OnChecksumMismatch: tt.policy, Damaged: damaged}
+				err := Repack(context.Background(), os.DirFS(volumePath), ".", backups, out, opts)
+				if !tt.expected {
+					var mismatch *ChecksumMismatchError
+					if !errors.As(err, &mismatch) {
+						t.Fatalf("Expected checksum mismatch error, got %v", err)
+					}
+					if len(damaged.Blocks()) != 0 {
+						t.Errorf("Expected no damaged blocks, got %v", damaged.Blocks())
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+
+				expected := slices.Concat(testBlockData(1, blockSize), tt.middle, testBlockData(3, blockSize))
+				content := out.content
+				if len(content) < len(expected) {
+					content = append(content, make([]byte, len(expected)-len(content))...)
+				}
+				if !bytes.Equal(content, expected) {
+					t.Errorf("Restored image does not match expected content (%d bytes)", len(out.content))
+				}
+				report := damaged.Blocks()
+				if len(report) != 1 || report[0].Offset != int64(blockSize) || report[0].Action != tt.action {
+					t.Fatalf("Expected block at offset %d to be %s, got %v", blockSize, tt.action, report)
+				}
+				var mismatch *ChecksumMismatchError
+				if !errors.As(report[0].Err, &mismatch) {
+					t.Errorf("Expected checksum mismatch error, got %v", report[0].Err)
+				}
+			})
+		}
+	}
+}
+
+func TestRepackMissingBlockZero(t *testing.T) {
+	volumePath := t.TempDir()
+	blockSize := 4096
+	first := writeTestBlock(t, volumePath, testBlockData(1, blockSize))
+	third := writeTestBlock(t, volumePath, testBlockData(3, blockSize))
+	missing := strings.Repeat("ab", 64)
+	backups := []Backup{{Identifier: "backup-1", Compression: "lz4", Blocks: []Block{
+		{Offset: 0, Checksum: first},
+		{Offset: 4096, Checksum: missing},
+		{Offset: 8192, Checksum: third},
+	}}}
+	expected := slices.Concat(testBlockData(1, blockSize), make([]byte, blockSize), testBlockData(3, blockSize))
+
+	tests := []struct {
+		name     string
+		noSparse bool
+		batch    int64
+		written  bool
+	}{
+		{name: "sparse", batch: 0},
+		{name: "sparse batched", batch: 1 << 20},
+		{name: "no sparse", noSparse: true, batch: 0, written: true},
+		{name: "no sparse batched", noSparse: true, batch: 1 << 20, written: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := &recordingWriter{writes: make(map[int64]int)}
+			damaged := &DamageReport{}
+			opts := RepackOptions{Jobs: 2, NoSparse: tt.noSparse, WriteBatch: tt.batch, OnMissingBlock: MissingZero, Damaged: damaged}
+			if err := Repack(context.Background(), os.DirFS(volumePath), ".", backups, out, opts); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !bytes.Equal(out.content, expected) {
+				t.Errorf("Restored image does not match expected content (%d bytes)", len(out.content))
+			}
+			zeroed := false
+			for offset, n := range out.writes {
+				if offset <= 4096 && offset+int64(n) > 4096 {
+					zeroed = true
+				}
+			}
+			if zeroed != tt.written {
+				t.Errorf("Expected the missing block written %v, got %v in %v", tt.written, zeroed, out.writes)
+			}
+			report := damaged.Blocks()
+			if len(report) != 1 || report[0].Offset != 4096 || report[0].Checksum != missing || report[0].Action != ActionZeroed {
+				t.Fatalf("Expected the block at offset 4096 to be zero-filled, got %v", report)
+			}
+			if !errors.Is(report[0].Err, fs.ErrNotExist) {
+				t.Errorf("Expected a missing block error, got %v", report[0].Err)
+			}
+		})
+	}
+}
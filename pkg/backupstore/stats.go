@@ -0,0 +1,110 @@
+package backupstore
+
+import (
+	"io/fs"
+	"sync"
+	"time"
+)
+
+// RetryingFS is a store that retries failed requests, counting the
+// retries so a repack can report them
+type RetryingFS interface {
+	fs.FS
+	Retries() int64
+}
+
+func storeRetries(store fs.FS) int64 {
+	if retrying, ok := store.(RetryingFS); ok {
+		return retrying.Retries()
+	}
+	return 0
+}
+
+// RepackStats counts what a restore did, for a summary once it is done.
+// A restore adds to it with Update, so it can be read with Snapshot while
+// the restore goes on.
+type RepackStats struct {
+	mu sync.Mutex
+	// Backups is the number of backups applied
+	Backups int
+	// BlocksRead were read from the store or the cache and decompressed,
+	// while BlocksSkipped were not needed, as a newer backup or an
+	// earlier run had already written their offset
+	BlocksRead    int
+	BlocksSkipped int
+	// ZeroBlocks are all-zero blocks left as holes
+	ZeroBlocks        int
+	BytesDecompressed int64
+	BytesWritten      int64
+	// ChecksumMismatches and MissingBlocks count the damaged blocks the
+	// restore went on without failing
+	ChecksumMismatches int
+	MissingBlocks      int
+	// Retries is the number of requests a RetryingFS store retried
+	Retries int64
+	Elapsed time.Duration
+}
+
+// Update changes s under its lock
+func (s *RepackStats) Update(update func(*RepackStats)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	update(s)
+}
+
+// Snapshot returns the counts of s so far
+func (s *RepackStats) Snapshot() RepackStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return RepackStats{
+		Backups:            s.Backups,
+		BlocksRead:         s.BlocksRead,
+		BlocksSkipped:      s.BlocksSkipped,
+		ZeroBlocks:         s.ZeroBlocks,
+		BytesDecompressed:  s.BytesDecompressed,
+		BytesWritten:       s.BytesWritten,
+		ChecksumMismatches: s.ChecksumMismatches,
+		MissingBlocks:      s.MissingBlocks,
+		Retries:            s.Retries,
+		Elapsed:            s.Elapsed,
+	}
+}
+
+// Throughput returns the bytes decompressed per second
+func (s *RepackStats) Throughput() float64 {
+	if s.Elapsed <= 0 {
+		return 0
+	}
+	return float64(s.BytesDecompressed) / s.Elapsed.Seconds()
+}
+
+// Measure starts timing a restore from store, and returns the func that
+// ends it, adding the time taken and the retries of store to s
+func (s *RepackStats) Measure(store fs.FS) func() {
+	started, retries := time.Now(), storeRetries(store)
+	return func() {
+		s.Update(func(s *RepackStats) {
+			s.Retries += storeRetries(store) - retries
+			s.Elapsed += time.Since(started)
+		})
+	}
+}
+
+// damaged counts a block the restore went on without failing
+func (s *RepackStats) damaged(action string) {
+	if action == ActionZeroed {
+		s.MissingBlocks++
+	} else {
+		s.ChecksumMismatches++
+	}
+}
+
+// read counts a block read and decompressed to n bytes, and left as a
+// hole if zero
+func (s *RepackStats) read(n int64, zero bool) {
+	s.BlocksRead++
+	s.BytesDecompressed += n
+	if zero && n > 0 {
+		s.ZeroBlocks++
+	}
+}
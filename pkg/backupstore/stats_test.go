@@ -0,0 +1,76 @@
+package backupstore
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// retryingTestFS counts a retry for every request for a file named after
+// one checksum
+type retryingTestFS struct {
+	fs.FS
+	checksum string
+	retries  atomic.Int64
+}
+
+func (r *retryingTestFS) Open(name string) (fs.File, error) {
+	if strings.Contains(name, r.checksum) {
+		r.retries.Add(1)
+	}
+	return r.FS.Open(name)
+}
+
+func (r *retryingTestFS) Retries() int64 { return r.retries.Load() }
+
+func TestRepackStats(t *testing.T) {
+	volumePath := t.TempDir()
+	blockSize := 4096
+	first := writeTestBlock(t, volumePath, testBlockData(1, blockSize))
+	overwritten := writeTestBlock(t, volumePath, testBlockData(2, blockSize))
+	newer := writeTestBlock(t, volumePath, testBlockData(3, blockSize))
+	zero := writeTestBlock(t, volumePath, make([]byte, blockSize))
+	missing := strings.Repeat("cd", 64)
+	backups := []Backup{
+		{Identifier: "backup-1", Compression: "lz4", Blocks: []Block{
+			{Offset: 0, Checksum: first},
+			{Offset: 4096, Checksum: overwritten},
+			{Offset: 8192, Checksum: zero},
+		}},
+		{Identifier: "backup-2", Compression: "lz4", Blocks: []Block{
+			{Offset: 4096, Checksum: newer},
+			{Offset: 12288, Checksum: missing},
+		}},
+	}
+
+	for _, batch := range []int64{0, 1 << 20} {
+		store := &retryingTestFS{FS: os.DirFS(volumePath), checksum: missing}
+		stats := &RepackStats{}
+		out := &recordingWriter{writes: make(map[int64]int)}
+		opts := RepackOptions{Jobs: 2, WriteBatch: batch, OnMissingBlock: MissingZero, Stats: stats}
+		if err := Repack(context.Background(), store, ".", backups, out, opts); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		expected := RepackStats{
+			Backups:           2,
+			BlocksRead:        3,
+			BlocksSkipped:     1,
+			ZeroBlocks:        1,
+			BytesDecompressed: 3 * 4096,
+			BytesWritten:      2 * 4096,
+			MissingBlocks:     1,
+			Retries:           1,
+			Elapsed:           stats.Elapsed,
+		}
+		if got := stats.Snapshot(); got != expected {
+			t.Errorf("Expected %+v with a batch of %d, got %+v", &expected, batch, &got)
+		}
+		if stats.Elapsed <= 0 {
+			t.Errorf("Expected the elapsed time to be counted, got %s", stats.Elapsed)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// preallocate reserves size bytes for the image in f before any block is
+// written, so the blocks land in contiguous extents and a full disk shows
+// up now rather than at the final truncate. Filesystems without fallocate
+// get the file extended to size instead, which reserves nothing but still
+// fails early on a quota or file size limit.
+func preallocate(f *os.File, size int64) error {
+	err := fallocate(f, size)
+	if errors.Is(err, errors.ErrUnsupported) {
+		_, err = f.WriteAt([]byte{0}, size-1)
+	}
+	return err
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPreallocate(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "out.raw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := preallocate(f, 1<<20); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 1<<20 {
+		t.Errorf("Expected a %d byte file, got %d", 1<<20, info.Size())
+	}
+
+	// the reserved space reads as zeroes until blocks are written over it
+	if _, err := f.WriteAt(testBlockData(1, 4096), 8192); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content[:8192], make([]byte, 8192)) || !bytes.Equal(content[8192:12288], testBlockData(1, 4096)) {
+		t.Error("Expected zeroes around the written block")
+	}
+}
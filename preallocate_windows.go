@@ -0,0 +1,26 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// fileAllocationInfo is the FILE_ALLOCATION_INFO of
+// SetFileInformationByHandle
+type fileAllocationInfo struct {
+	AllocationSize int64
+}
+
+// fallocate reserves size bytes of disk for f without extending it, so
+// NTFS doesn't zero-fill the file ahead of the blocks written into it
+func fallocate(f *os.File, size int64) error {
+	info := fileAllocationInfo{AllocationSize: size}
+	err := windows.SetFileInformationByHandle(windows.Handle(f.Fd()), windows.FileAllocationInfo, (*byte)(unsafe.Pointer(&info)), uint32(unsafe.Sizeof(info)))
+	if errors.Is(err, windows.ERROR_INVALID_FUNCTION) || errors.Is(err, windows.ERROR_NOT_SUPPORTED) {
+		return errors.ErrUnsupported
+	}
+	return err
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+)
+
+var progressFormats = []string{"human", "json"}
+
+// verbosity picks how much of a restore is printed: quiet leaves only
+// errors and the summary, normal a progress line every second or every
+// progressEveryBlocks blocks, and verbose a line for every block
+type verbosity int
+
+const (
+	verbosityQuiet verbosity = iota - 1
+	verbosityNormal
+	verbosityVerbose
+)
+
+const (
+	progressInterval    = time.Second
+	progressEveryBlocks = 1000
+	// the bar is redrawn at most this often, its speed averaged over the
+	// last progressRateWindow
+	progressBarInterval = 100 * time.Millisecond
+	progressRateWindow  = 10 * time.Second
+	progressBarWidth    = 30
+)
+
+type progressSample struct {
+	at    time.Time
+	bytes int64
+	// throttled are the totals of the throttles of the progress
+	throttled []int64
+}
+
+// throttle is a rate limit whose throughput the progress shows beside its
+// own, so the limit can be seen to be honored
+type throttle struct {
+	name    string
+	limiter *backupstore.RateLimiter
+}
+
+// passProgress prints the human readable progress of one pass over the
+// blocks, throttled to its verbosity. On a terminal the default is a bar
+// redrawn in place, elsewhere a plain line every so often. The file of
+// -log-file gets the plain lines while the terminal has the bar.
+type passProgress struct {
+	w         io.Writer
+	log       io.Writer
+	label     string
+	total     int
+	verbosity verbosity
+	printed   time.Time
+	logged    time.Time
+
+	bar       bool
+	drawn     bool
+	bytes     int64
+	samples   []progressSample
+	throttles []throttle
+}
+
+func newPassProgress(w io.Writer, label string, total int, level verbosity) *passProgress {
+	now := time.Now()
+	p := &passProgress{
+		w:         w,
+		label:     label,
+		total:     total,
+		verbosity: level,
+		printed:   now,
+		logged:    now,
+		bar:       isTerminal(w),
+		samples:   []progressSample{{at: now}},
+	}
+	if tee, ok := w.(*teeWriter); ok && isTerminal(tee.terminal) {
+		p.w, p.log, p.bar = tee.terminal, tee.log, true
+	}
+	return p
+}
+
+// limit has the progress show the throughput of throttles
+func (p *passProgress) limit(throttles []throttle) {
+	p.throttles = throttles
+	p.samples[0].throttled = p.throttledTotals()
+}
+
+func (p *passProgress) throttledTotals() []int64 {
+	totals := make([]int64, len(p.throttles))
+	for i, throttle := range p.throttles {
+		totals[i] = throttle.limiter.Total()
+	}
+	return totals
+}
+
+// sample records the bytes done at now, and returns the oldest sample
+// within progressRateWindow of it
+func (p *passProgress) sample(now time.Time) progressSample {
+	p.samples = append(p.samples, progressSample{at: now, bytes: p.bytes, throttled: p.throttledTotals()})
+	for len(p.samples) > 2 && now.Sub(p.samples[0].at) > progressRateWindow {
+		p.samples = p.samples[1:]
+	}
+	return p.samples[0]
+}
+
+// throttleRates is the throughput of each throttle since first, and the
+// rate it is limited to
+func (p *passProgress) throttleRates(first progressSample, now time.Time) string {
+	elapsed := now.Sub(first.at).Seconds()
+	var rates strings.Builder
+	for i, throttle := range p.throttles {
+		rate := 0.0
+		if elapsed > 0 {
+			rate = float64(throttle.limiter.Total()-first.throttled[i]) / elapsed
+		}
+		fmt.Fprintf(&rates, ", %s %s/s of %s/s", throttle.name, formatBytes(int64(rate)), formatBytes(throttle.limiter.Rate()))
+	}
+	return rates.String()
+}
+
+func isTerminal(w io.Writer) bool {
+	file, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// block reports the first done blocks of the pass as finished, the last
+// adding n bytes to the image and described by detail for verbose output
+func (p *passProgress) block(done int, n int64, detail func() string) {
+	p.bytes += n
+	percentage := float64(done) / float64(p.total) * 100
+	switch p.verbosity {
+	case verbosityVerbose:
+		line := fmt.Sprintf("%s [%.2f%%] %s\n", p.label, percentage, detail())
+		io.WriteString(p.w, line)
+		if p.log != nil {
+			io.WriteString(p.log, line)
+		}
+	case verbosityNormal:
+		now := time.Now()
+		if p.log != nil && (done == p.total || done%progressEveryBlocks == 0 || now.Sub(p.logged) >= progressInterval) {
+			p.logged = now
+			fmt.Fprintf(p.log, "%s [%.2f%%] %d/%d blocks\n", p.label, percentage, done, p.total)
+		}
+		if p.bar {
+			if done < p.total && now.Sub(p.printed) < progressBarInterval {
+				return
+			}
+			p.printed = now
+			p.draw(done, percentage, now)
+			return
+		}
+		if done < p.total && done%progressEveryBlocks != 0 && now.Sub(p.printed) < progressInterval {
+			return
+		}
+		p.printed = now
+		var rates string
+		if len(p.throttles) > 0 {
+			rates = p.throttleRates(p.sample(now), now)
+		}
+		fmt.Fprintf(p.w, "%s [%.2f%%] %d/%d blocks%s\n", p.label, percentage, done, p.total, rates)
+	}
+}
+
+func (p *passProgress) draw(done int, percentage float64, now time.Time) {
+	first := p.sample(now)
+	rate := 0.0
+	if elapsed := now.Sub(first.at).Seconds(); elapsed > 0 {
+		rate = float64(p.bytes-first.bytes) / elapsed
+	}
+
+	// blocks differ in size once decompressed, so the total is estimated
+	// from the ones seen so far until the pass is done
+	total := p.bytes * int64(p.total) / int64(done)
+	eta := "--"
+	if rate > 0 {
+		eta = (time.Duration(float64(total-p.bytes) / rate * float64(time.Second))).Round(time.Second).String()
+	}
+	filled := done * progressBarWidth / p.total
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", progressBarWidth-filled)
+	fmt.Fprintf(p.w, "\r%s [%s] %6.2f%% %7.1f MB/s %s/%s ETA %s%s\x1b[K",
+		p.label, bar, percentage, rate/1e6, formatBytes(p.bytes), formatBytes(total), eta, p.throttleRates(first, now))
+	p.drawn = true
+	if done == p.total {
+		p.close()
+	}
+}
+
+// close ends the line of a bar left half drawn, so whatever is printed
+// next starts on a line of its own
+func (p *passProgress) close() {
+	if p.drawn {
+		fmt.Fprintln(p.w)
+		p.drawn = false
+	}
+}
+
+func formatBytes(n int64) string {
+	value := float64(n)
+	for _, unit := range []string{"B", "KiB", "MiB", "GiB", "TiB"} {
+		if value < 1024 || unit == "TiB" {
+			if unit == "B" {
+				return fmt.Sprintf("%d B", n)
+			}
+			return fmt.Sprintf("%.1f %s", value, unit)
+		}
+		value /= 1024
+	}
+	return ""
+}
+
+// progressStart, progressBlock and progressComplete are the lines of
+// -progress-format json, told apart by Event
+type progressStart struct {
+	Event       string  `json:"event"`
+	Target      string  `json:"target"`
+	Outfile     string  `json:"outfile"`
+	TotalPasses int     `json:"total_passes"`
+	TotalBlocks int     `json:"total_blocks"`
+	ImageSize   int64   `json:"image_size,omitempty"`
+	Elapsed     float64 `json:"elapsed_seconds"`
+}
+
+type progressBlock struct {
+	Event        string  `json:"event"`
+	Target       string  `json:"target,omitempty"`
+	Pass         int     `json:"pass"`
+	TotalPasses  int     `json:"total_passes"`
+	Block        int     `json:"block"`
+	TotalBlocks  int     `json:"total_blocks"`
+	Offset       int64   `json:"offset"`
+	Checksum     string  `json:"checksum"`
+	BytesWritten int64   `json:"bytes_written"`
+	Elapsed      float64 `json:"elapsed_seconds"`
+}
+
+type progressComplete struct {
+	Event        string           `json:"event"`
+	Target       string           `json:"target,omitempty"`
+	Blocks       int              `json:"blocks"`
+	BytesWritten int64            `json:"bytes_written"`
+	ImageSize    int64            `json:"image_size,omitempty"`
+	Error        string           `json:"error,omitempty"`
+	Elapsed      float64          `json:"elapsed_seconds"`
+	Summary      *progressSummary `json:"summary,omitempty"`
+}
+
+// progressSummary is backupstore.RepackStats in the complete line
+type progressSummary struct {
+	Backups            int     `json:"backups"`
+	BlocksRead         int     `json:"blocks_read"`
+	BlocksSkipped      int     `json:"blocks_skipped"`
+	ZeroBlocks         int     `json:"zero_blocks"`
+	BytesDecompressed  int64   `json:"bytes_decompressed"`
+	BytesWritten       int64   `json:"bytes_written"`
+	ChecksumMismatches int     `json:"checksum_mismatches"`
+	MissingBlocks      int     `json:"missing_blocks"`
+	Retries            int64   `json:"retries"`
+	Elapsed            float64 `json:"elapsed_seconds"`
+	Throughput         float64 `json:"bytes_per_second"`
+}
+
+// progressReporter writes restore progress as one JSON object per line.
+// A nil reporter leaves progress to the human readable lines.
+type progressReporter struct {
+	// mu is shared by the reporters of several targets, as is enc
+	mu      *sync.Mutex
+	enc     *json.Encoder
+	target  string
+	started time.Time
+	blocks  int
+	written int64
+	// stats, if set, are added to the line of a successful restore
+	stats *backupstore.RepackStats
+}
+
+func newProgressReporter(w io.Writer) *progressReporter {
+	return &progressReporter{mu: &sync.Mutex{}, enc: json.NewEncoder(w), started: time.Now()}
+}
+
+// forTarget returns a reporter for the restore of one target, which
+// counts its own blocks and adds stats to its summary, on the stream of r
+func (r *progressReporter) forTarget(stats *backupstore.RepackStats) *progressReporter {
+	if r == nil {
+		return nil
+	}
+	return &progressReporter{mu: r.mu, enc: r.enc, started: time.Now(), stats: stats}
+}
+
+func (r *progressReporter) elapsed() float64 {
+	return time.Since(r.started).Seconds()
+}
+
+// start reports the restore of target into outfile, with the size of the
+// image if it is known before the restore
+func (r *progressReporter) start(target, outfile string, totalPasses, totalBlocks int, imageSize int64) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.target = target
+	r.enc.Encode(progressStart{
+		Event:       "start",
+		Target:      target,
+		Outfile:     outfile,
+		TotalPasses: totalPasses,
+		TotalBlocks: totalBlocks,
+		ImageSize:   imageSize,
+		Elapsed:     r.elapsed(),
+	})
+}
+
+// block reports a block of a pass as done, n being the bytes it added to
+// the image
+func (r *progressReporter) block(pass, totalPasses, index, totalBlocks int, block backupstore.Block, n int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.blocks++
+	r.written += n
+	r.enc.Encode(progressBlock{
+		Event:        "block",
+		Target:       r.target,
+		Pass:         pass,
+		TotalPasses:  totalPasses,
+		Block:        index,
+		TotalBlocks:  totalBlocks,
+		Offset:       block.Offset,
+		Checksum:     block.Checksum,
+		BytesWritten: r.written,
+		Elapsed:      r.elapsed(),
+	})
+}
+
+// complete ends the stream with a summary; a restore that failed reports
+// err and no image size
+func (r *progressReporter) complete(imageSize int64, err error) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	summary := progressComplete{
+		Event:        "complete",
+		Target:       r.target,
+		Blocks:       r.blocks,
+		BytesWritten: r.written,
+		ImageSize:    imageSize,
+		Elapsed:      r.elapsed(),
+	}
+	if err != nil {
+		summary.Error = err.Error()
+	} else if stats := r.stats; stats != nil {
+		summary.Summary = &progressSummary{
+			Backups:            stats.Backups,
+			BlocksRead:         stats.BlocksRead,
+			BlocksSkipped:      stats.BlocksSkipped,
+			ZeroBlocks:         stats.ZeroBlocks,
+			BytesDecompressed:  stats.BytesDecompressed,
+			BytesWritten:       stats.BytesWritten,
+			ChecksumMismatches: stats.ChecksumMismatches,
+			MissingBlocks:      stats.MissingBlocks,
+			Retries:            stats.Retries,
+			Elapsed:            stats.Elapsed.Seconds(),
+			Throughput:         stats.Throughput(),
+		}
+	}
+	r.enc.Encode(summary)
+}
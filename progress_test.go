@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+)
+
+func decodeProgressEvents(t *testing.T, data []byte) []map[string]any {
+	t.Helper()
+	var events []map[string]any
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var event map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("Expected a JSON object per line, got %q: %v", scanner.Text(), err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestProgressEventsRestore(t *testing.T) {
+	volumePath := t.TempDir()
+	blockSize := 4096
+	first := writeTestBlock(t, volumePath, testBlockData(1, blockSize))
+	second := writeTestBlock(t, volumePath, testBlockData(2, blockSize))
+	backups := []backupstore.Backup{
+		{Identifier: "backup-1", Compression: "lz4", Blocks: []backupstore.Block{{Offset: 0, Checksum: first}}},
+		{Identifier: "backup-2", Compression: "lz4", Blocks: []backupstore.Block{{Offset: 4096, Checksum: second}}},
+	}
+
+	out, err := os.Create(filepath.Join(t.TempDir(), "out.raw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	var stream, human bytes.Buffer
+	events := newProgressReporter(&stream)
+	events.stats = &backupstore.RepackStats{}
+	events.start("pvc-123", out.Name(), 1, 2, 0)
+	err = backupstore.Repack(context.Background(), os.DirFS(volumePath), ".", backups, out, backupstore.RepackOptions{
+		Jobs:     2,
+		Progress: &repackProgress{w: &human, events: events},
+		Stats:    events.stats,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	events.complete(8192, nil)
+
+	if bytes.Contains(human.Bytes(), []byte("Block ")) {
+		t.Errorf("Expected no human readable block lines, got %q", human.String())
+	}
+	decoded := decodeProgressEvents(t, stream.Bytes())
+	if len(decoded) != 4 {
+		t.Fatalf("Expected 4 events, got %d: %s", len(decoded), stream.String())
+	}
+	expected := []string{"start", "block", "block", "complete"}
+	for i, event := range expected {
+		if decoded[i]["event"] != event {
+			t.Errorf("Expected event %d to be %s, got %v", i, event, decoded[i]["event"])
+		}
+	}
+
+	// the blocks of both backups are restored in one pass, in offset order
+	block := decoded[2]
+	if block["pass"] != 1.0 || block["total_passes"] != 1.0 || block["block"] != 2.0 || block["total_blocks"] != 2.0 {
+		t.Errorf("Expected block 2/2 of pass 1/1, got %v", block)
+	}
+	if block["offset"] != 4096.0 || block["checksum"] != second {
+		t.Errorf("Expected the block at offset 4096, got %v", block)
+	}
+	if decoded[2]["bytes_written"] != 8192.0 {
+		t.Errorf("Expected 8192 bytes written, got %v", decoded[2]["bytes_written"])
+	}
+	if _, ok := block["elapsed_seconds"]; !ok {
+		t.Error("Expected elapsed_seconds on block events")
+	}
+
+	summary := decoded[3]
+	if summary["blocks"] != 2.0 || summary["image_size"] != 8192.0 {
+		t.Errorf("Expected a summary of 2 blocks and 8192 bytes, got %v", summary)
+	}
+	if _, ok := summary["error"]; ok {
+		t.Errorf("Expected no error in the summary, got %v", summary["error"])
+	}
+	counters, ok := summary["summary"].(map[string]any)
+	if !ok || counters["backups"] != 2.0 || counters["blocks_read"] != 2.0 || counters["bytes_written"] != 8192.0 {
+		t.Errorf("Expected the counters of 2 backups and 2 blocks, got %v", summary["summary"])
+	}
+}
+
+func TestProgressEventsStream(t *testing.T) {
+	volumePath := t.TempDir()
+	blockSize := 4096
+	first := writeTestBlock(t, volumePath, testBlockData(1, blockSize))
+	second := writeTestBlock(t, volumePath, testBlockData(2, blockSize))
+	backups := []backupstore.Backup{
+		{Identifier: "backup-1", Compression: "lz4", Blocks: []backupstore.Block{{Offset: 0, Checksum: first}, {Offset: 8192, Checksum: second}}},
+	}
+
+	var stream bytes.Buffer
+	events := newProgressReporter(&stream)
+	events.stats = &backupstore.RepackStats{}
+	_, err := streamBackups(context.Background(), os.DirFS(volumePath), ".", backups, io.Discard, restoreOptions{
+		Progress: io.Discard,
+		Events:   events,
+		Stats:    events.stats,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if stats := events.stats; stats.BlocksRead != 2 || stats.BytesDecompressed != 8192 || stats.BytesWritten != 12288 {
+		t.Errorf("Expected 2 blocks read and 12288 bytes streamed, got %+v", stats)
+	}
+	events.complete(0, errors.New("interrupted"))
+
+	decoded := decodeProgressEvents(t, stream.Bytes())
+	if len(decoded) != 3 {
+		t.Fatalf("Expected 3 events, got %d: %s", len(decoded), stream.String())
+	}
+	// the gap before the second block is written as zeroes
+	if decoded[1]["block"] != 2.0 || decoded[1]["offset"] != 8192.0 || decoded[1]["bytes_written"] != 12288.0 {
+		t.Errorf("Expected block 2 at offset 8192 with 12288 bytes written, got %v", decoded[1])
+	}
+	if decoded[2]["event"] != "complete" || decoded[2]["error"] != "interrupted" {
+		t.Errorf("Expected a failed completion event, got %v", decoded[2])
+	}
+	if _, ok := decoded[2]["summary"]; ok {
+		t.Errorf("Expected no counters for a failed restore, got %v", decoded[2]["summary"])
+	}
+}
+
+func TestPassProgress(t *testing.T) {
+	tests := []struct {
+		name      string
+		verbosity verbosity
+		lines     int
+	}{
+		{name: "quiet", verbosity: verbosityQuiet, lines: 0},
+		// every progressEveryBlocks blocks and the last one
+		{name: "normal", verbosity: verbosityNormal, lines: 2},
+		{name: "verbose", verbosity: verbosityVerbose, lines: 1500},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			status := newPassProgress(&out, "[pass 1/1]", 1500, tt.verbosity)
+			for done := 1; done <= 1500; done++ {
+				status.block(done, 4096, func() string { return "Block abc*" })
+			}
+			if lines := bytes.Count(out.Bytes(), []byte("\n")); lines != tt.lines {
+				t.Errorf("Expected %d lines, got %d", tt.lines, lines)
+			}
+		})
+	}
+
+	var out bytes.Buffer
+	status := newPassProgress(&out, "[pass 2/3]", 4, verbosityNormal)
+	status.printed = status.printed.Add(-progressInterval)
+	status.block(1, 4096, func() string { return "" })
+	if out.String() != "[pass 2/3] [25.00%] 1/4 blocks\n" {
+		t.Errorf("Expected a line once a second has passed, got %q", out.String())
+	}
+
+	// the throughput of a limit is shown beside the limit
+	out.Reset()
+	limiter := backupstore.NewRateLimiter(100 << 20)
+	status.limit([]throttle{{name: "read", limiter: limiter}})
+	status.samples[0].at = status.samples[0].at.Add(-time.Second)
+	limiter.Wait(1 << 20)
+	status.printed = status.printed.Add(-progressInterval)
+	status.block(2, 4096, func() string { return "" })
+	if !strings.HasPrefix(out.String(), "[pass 2/3] [50.00%] 2/4 blocks, read ") || !strings.HasSuffix(out.String(), " of 100.0 MiB/s\n") {
+		t.Errorf("Expected the read rate and its limit, got %q", out.String())
+	}
+}
+
+func TestPassProgressBar(t *testing.T) {
+	var out bytes.Buffer
+	status := newPassProgress(&out, "[pass 1/2]", 4, verbosityNormal)
+	status.bar = true
+	// pretend the pass started two seconds ago
+	status.samples[0].at = status.samples[0].at.Add(-2 * time.Second)
+	status.printed = status.printed.Add(-progressBarInterval)
+
+	status.block(1, 1<<20, func() string { return "" })
+	line := out.String()
+	if !strings.HasPrefix(line, "\r[pass 1/2] [=======                       ]  25.00%") {
+		t.Errorf("Expected a quarter full bar, got %q", line)
+	}
+	if !strings.Contains(line, "1.0 MiB/4.0 MiB") {
+		t.Errorf("Expected the bytes done and estimated total, got %q", line)
+	}
+	if !strings.Contains(line, " MB/s") || strings.Contains(line, "ETA --") {
+		t.Errorf("Expected a speed and an ETA, got %q", line)
+	}
+	if strings.Contains(line, "\n") {
+		t.Errorf("Expected the bar to be drawn in place, got %q", line)
+	}
+
+	// redraws are throttled, and the last block always ends the line
+	status.block(2, 1<<20, func() string { return "" })
+	if out.String() != line {
+		t.Errorf("Expected no redraw within %s, got %q", progressBarInterval, out.String())
+	}
+	status.block(4, 2<<20, func() string { return "" })
+	if !strings.HasSuffix(out.String(), "\n") || !strings.Contains(out.String(), "100.00%") {
+		t.Errorf("Expected the finished bar to end its line, got %q", out.String())
+	}
+
+	status.close()
+	if strings.HasSuffix(out.String(), "\n\n") {
+		t.Error("Expected closing a finished bar not to print another line")
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		n        int64
+		expected string
+	}{
+		{n: 512, expected: "512 B"},
+		{n: 1536, expected: "1.5 KiB"},
+		{n: 3 << 30, expected: "3.0 GiB"},
+		{n: 2 << 40, expected: "2.0 TiB"},
+	}
+	for _, tt := range tests {
+		if got := formatBytes(tt.n); got != tt.expected {
+			t.Errorf("Expected %s, got %s", tt.expected, got)
+		}
+	}
+}
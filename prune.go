@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+)
+
+// storeFile is a file to remove from the backupstore, a block file no
+// backup references or the cfg file of a deleted backup
+type storeFile struct {
+	Path     string
+	Checksum string
+	Size     int64
+}
+
+// storeReferences returns the checksums the backup cfg files of every
+// volume reference, leaving out the cfg file skip, and the volumes. A
+// block is only unreferenced if no volume references it, although
+// Longhorn keeps the blocks of each volume apart. Nothing is returned
+// unless every cfg file can be read, as the blocks only an unreadable one
+// references would look unreferenced.
+func storeReferences(store fs.FS, skip string) (map[string]struct{}, []string, error) {
+	volumes, err := backupstore.ListVolumes(store)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	referenced := make(map[string]struct{})
+	var unreadable []error
+	for _, volume := range volumes {
+		if _, err := backupstore.ReadVolumeConfig(store, volume); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			unreadable = append(unreadable, fmt.Errorf("%s/volume.cfg: %w", volume, err))
+		}
+		cfgPaths, err := backupstore.ListBackupConfigs(store, volume)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, cfgPath := range cfgPaths {
+			if cfgPath == skip {
+				continue
+			}
+			backup, err := backupstore.ReadBackup(store, cfgPath)
+			if err != nil {
+				unreadable = append(unreadable, err)
+				continue
+			}
+			for _, block := range backup.Blocks {
+				referenced[block.Checksum] = struct{}{}
+			}
+		}
+	}
+	if len(unreadable) > 0 {
+		return nil, nil, fmt.Errorf("%d cfg files can't be read, so the blocks only they reference can't be told from orphans:\n%w", len(unreadable), errors.Join(unreadable...))
+	}
+	return referenced, volumes, nil
+}
+
+// findOrphanBlocks returns the block files of every volume whose checksum
+// no backup cfg in the whole backupstore references, in order of path,
+// see storeReferences
+func findOrphanBlocks(store fs.FS) ([]storeFile, error) {
+	referenced, volumes, err := storeReferences(store, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var orphans []storeFile
+	for _, volume := range volumes {
+		blocks, err := backupstore.ListBlocks(store, volume)
+		if err != nil {
+			return nil, err
+		}
+		for _, checksum := range slices.Sorted(maps.Keys(blocks)) {
+			if _, ok := referenced[checksum]; ok {
+				continue
+			}
+			info, err := fs.Stat(store, blocks[checksum])
+			if err != nil {
+				return nil, err
+			}
+			orphans = append(orphans, storeFile{Path: blocks[checksum], Checksum: checksum, Size: info.Size()})
+		}
+	}
+	return orphans, nil
+}
+
+// prune runs the prune command and returns its exit status. Blocks are
+// only removed from local backup roots, and each removal is appended to
+// the file logPath before the next one.
+func prune(logger *slog.Logger, store fs.FS, backupRoot, backupStorePath string, dryRun bool, logPath string) int {
+	display := func(name string) string {
+		return displayPath(backupStorePath, name)
+	}
+	if !dryRun && !removable(logger, "prune", backupRoot) {
+		return exitUsage
+	}
+
+	fmt.Printf("Looking for orphaned blocks in %s\n", backupStorePath)
+	orphans, err := findOrphanBlocks(store)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Refusing to prune %s", backupStorePath), "error", err)
+		return exitFailure
+	}
+	if dryRun {
+		printPruneDryRun(os.Stdout, orphans, display)
+		return 0
+	}
+	if len(orphans) == 0 {
+		fmt.Printf("No orphaned blocks found\n")
+		return 0
+	}
+
+	log, err := openAppendLog(logPath, fmt.Sprintf("prune of %s, %d orphaned blocks", backupStorePath, len(orphans)))
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to open prune log %s", logPath), "error", err)
+		return exitOutputError
+	}
+	defer log.Close()
+	removed, reclaimed, failed := pruneBlocks(orphans, localRemover(backupStorePath), display, os.Stdout, log)
+	if err := log.Sync(); err != nil {
+		logger.Error(fmt.Sprintf("Failed to write prune log %s", logPath), "error", err)
+		return exitOutputError
+	}
+	fmt.Printf("Removed %d orphaned blocks, reclaiming %s, logged to %s\n", removed, formatSize(reclaimed), logPath)
+	if failed > 0 {
+		logger.Error(fmt.Sprintf("Failed to remove %d blocks", failed))
+		return exitFailure
+	}
+	return 0
+}
+
+// removable reports whether command can remove files from backupRoot,
+// logging why not. Every remote store is read only.
+func removable(logger *slog.Logger, command, backupRoot string) bool {
+	if strings.Contains(backupRoot, "://") {
+		logger.Error(fmt.Sprintf("%s can only remove files from a local backup root, mount %s first or use -dry-run", command, backupRoot))
+		return false
+	}
+	return true
+}
+
+// localRemover removes files of the backupstore in the directory
+// backupStorePath
+func localRemover(backupStorePath string) func(name string) error {
+	return func(name string) error {
+		return os.Remove(filepath.Join(backupStorePath, filepath.FromSlash(name)))
+	}
+}
+
+// openAppendLog opens the log at logPath for appending, starting the
+// entries of this run with a comment line of header, so the runs that
+// share -prune-log or -log-file can be told apart
+func openAppendLog(logPath, header string) (*os.File, error) {
+	log, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(log, "# %s %s\n", time.Now().Format(time.RFC3339), header); err != nil {
+		log.Close()
+		return nil, err
+	}
+	return log, nil
+}
+
+// pruneBlocks removes each of orphans with remove, going on past the ones
+// that fail, and logs every removal and failure to log as it happens. It
+// returns how many were removed, the bytes they took, and how many
+// failed. display is how paths are printed to out and logged.
+func pruneBlocks(orphans []storeFile, remove func(name string) error, display func(name string) string, out, log io.Writer) (int, int64, int) {
+	removed, reclaimed, failed := 0, int64(0), 0
+	for _, orphan := range orphans {
+		if err := removeLogged(orphan, remove, display, out, log); err != nil {
+			failed++
+			continue
+		}
+		removed++
+		reclaimed += orphan.Size
+	}
+	return removed, reclaimed, failed
+}
+
+// removeLogged removes file with remove, printing and logging the removal
+// or why it failed
+func removeLogged(file storeFile, remove func(name string) error, display func(name string) string, out, log io.Writer) error {
+	if err := remove(file.Path); err != nil {
+		fmt.Fprintf(out, "Failed to remove %s: %s\n", display(file.Path), err)
+		fmt.Fprintf(log, "%s\tfailed\t%s\t%s\n", time.Now().Format(time.RFC3339), display(file.Path), err)
+		return err
+	}
+	fmt.Fprintf(out, "Removed %s (%s)\n", display(file.Path), formatBytes(file.Size))
+	fmt.Fprintf(log, "%s\tremoved\t%s\t%d\n", time.Now().Format(time.RFC3339), display(file.Path), file.Size)
+	return nil
+}
+
+// printPruneDryRun lists what pruneBlocks would remove and the bytes it
+// would reclaim
+func printPruneDryRun(w io.Writer, orphans []storeFile, display func(name string) string) {
+	var reclaimed int64
+	for _, orphan := range orphans {
+		reclaimed += orphan.Size
+		fmt.Fprintf(w, "Would remove %s (%s)\n", display(orphan.Path), formatBytes(orphan.Size))
+	}
+	fmt.Fprintf(w, "Dry run: %d orphaned blocks would be removed, reclaiming %s\n", len(orphans), formatSize(reclaimed))
+}
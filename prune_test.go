@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFindOrphanBlocks(t *testing.T) {
+	root := t.TempDir()
+	first := filepath.Join(root, "volumes", "ab", "cd", "pvc-1")
+	second := filepath.Join(root, "volumes", "ef", "01", "pvc-2")
+	a := writeTestBlock(t, first, testBlockData(1, 4096))
+	orphan := writeTestBlock(t, first, testBlockData(2, 4096))
+	// only referenced by pvc-2, so kept in pvc-1 as well
+	shared := writeTestBlock(t, first, testBlockData(3, 4096))
+	writeTestBlock(t, second, testBlockData(3, 4096))
+	writeTestBackupCfg(t, first, "backup-1", a)
+	writeTestBackupCfg(t, second, "backup-1", shared)
+	store := os.DirFS(root)
+
+	orphans, err := findOrphanBlocks(store)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(orphans) != 1 || orphans[0].Checksum != orphan || orphans[0].Path != "volumes/ab/cd/pvc-1/blocks/"+orphan[0:2]+"/"+orphan[2:4]+"/"+orphan+".blk" || orphans[0].Size == 0 {
+		t.Errorf("Expected %s to be the only orphan, got %+v", orphan, orphans)
+	}
+
+	var out bytes.Buffer
+	printPruneDryRun(&out, orphans, func(name string) string { return name })
+	if line := "Dry run: 1 orphaned blocks would be removed"; !strings.Contains(out.String(), line) {
+		t.Errorf("Expected %q in the dry run, got %q", line, out.String())
+	}
+
+	if err := os.WriteFile(filepath.Join(second, "backups", "backup_backup-2.cfg"), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := findOrphanBlocks(store); err == nil || !strings.Contains(err.Error(), "backup_backup-2.cfg") {
+		t.Errorf("Expected the unreadable cfg to stop the prune, got %v", err)
+	}
+}
+
+func TestPruneBlocks(t *testing.T) {
+	orphans := []storeFile{
+		{Path: "volumes/pvc-1/blocks/a.blk", Size: 100},
+		{Path: "volumes/pvc-1/blocks/b.blk", Size: 200},
+		{Path: "volumes/pvc-1/blocks/c.blk", Size: 400},
+	}
+	var removed []string
+	remove := func(name string) error {
+		if strings.HasSuffix(name, "b.blk") {
+			return errors.New("permission denied")
+		}
+		removed = append(removed, name)
+		return nil
+	}
+	var log bytes.Buffer
+	count, reclaimed, failed := pruneBlocks(orphans, remove, func(name string) string { return "/store/" + name }, io.Discard, &log)
+	if count != 2 || reclaimed != 500 || failed != 1 || len(removed) != 2 {
+		t.Errorf("Expected 2 blocks removed, 500 bytes reclaimed and 1 failure, got %d, %d and %d", count, reclaimed, failed)
+	}
+	lines := strings.Split(strings.TrimSuffix(log.String(), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected a log line for each block, got %q", log.String())
+	}
+	for i, expected := range []string{
+		"\tremoved\t/store/volumes/pvc-1/blocks/a.blk\t100",
+		"\tfailed\t/store/volumes/pvc-1/blocks/b.blk\tpermission denied",
+		"\tremoved\t/store/volumes/pvc-1/blocks/c.blk\t400",
+	} {
+		if !strings.HasSuffix(lines[i], expected) {
+			t.Errorf("Expected log line %d to end with %q, got %q", i, expected, lines[i])
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+const (
+	qcow2Magic        = 0x514649fb
+	qcow2Version      = 3
+	qcow2ClusterBits  = 16
+	qcow2ClusterSize  = 1 << qcow2ClusterBits
+	qcow2HeaderLength = 104
+	qcow2RefcountBits = 16
+	qcow2OflagCopied  = 1 << 63
+	qcow2L2Entries    = qcow2ClusterSize / 8
+	qcow2RefcountsPer = qcow2ClusterSize * 8 / qcow2RefcountBits
+)
+
+type qcow2Header struct {
+	Magic                 uint32
+	Version               uint32
+	BackingFileOffset     uint64
+	BackingFileSize       uint32
+	ClusterBits           uint32
+	Size                  uint64
+	CryptMethod           uint32
+	L1Size                uint32
+	L1TableOffset         uint64
+	RefcountTableOffset   uint64
+	RefcountTableClusters uint32
+	NbSnapshots           uint32
+	SnapshotsOffset       uint64
+	IncompatibleFeatures  uint64
+	CompatibleFeatures    uint64
+	AutoclearFeatures     uint64
+	RefcountOrder         uint32
+	HeaderLength          uint32
+}
+
+// qcow2Writer builds a qcow2 v3 image as blocks are applied. Data clusters
+// are appended as they are first written, and the L1/L2 tables and refcount
+// structures are laid out after the data when the image is closed. Clusters
+// that are never written stay unallocated.
+type qcow2Writer struct {
+	*sparseImage
+}
+
+func createQcow2(path string) (*qcow2Writer, error) {
+	// cluster 0 holds the header
+	image, err := newSparseImage(path, qcow2ClusterSize, qcow2ClusterSize)
+	if err != nil {
+		return nil, err
+	}
+	return &qcow2Writer{sparseImage: image}, nil
+}
+
+func (q *qcow2Writer) Close() error {
+	return q.closeWith(q.finish)
+}
+
+func (q *qcow2Writer) finish() error {
+	size, dropped := q.finalSize()
+	guestClusters := (size + qcow2ClusterSize - 1) / qcow2ClusterSize
+
+	l2Tables := make(map[int64][]uint64)
+	for guest, host := range q.clusters {
+		l1Index := guest / qcow2L2Entries
+		table, ok := l2Tables[l1Index]
+		if !ok {
+			table = make([]uint64, qcow2L2Entries)
+			l2Tables[l1Index] = table
+		}
+		table[guest%qcow2L2Entries] = uint64(host) | qcow2OflagCopied
+	}
+
+	l1Size := (guestClusters + qcow2L2Entries - 1) / qcow2L2Entries
+	l1 := make([]uint64, l1Size)
+	l1Indexes := make([]int64, 0, len(l2Tables))
+	for l1Index := range l2Tables {
+		l1Indexes = append(l1Indexes, l1Index)
+	}
+	sort.Slice(l1Indexes, func(i, j int) bool { return l1Indexes[i] < l1Indexes[j] })
+	for _, l1Index := range l1Indexes {
+		offset := q.allocate(1)
+		if err := q.writeTable(offset, l2Tables[l1Index]); err != nil {
+			return err
+		}
+		l1[l1Index] = uint64(offset) | qcow2OflagCopied
+	}
+
+	l1Clusters := max(1, (l1Size*8+qcow2ClusterSize-1)/qcow2ClusterSize)
+	l1Offset := q.allocate(l1Clusters)
+	if err := q.writeTable(l1Offset, l1); err != nil {
+		return err
+	}
+
+	// the refcount structures have to count themselves as well
+	used := q.next / qcow2ClusterSize
+	var blocks, tableClusters int64
+	for {
+		total := used + blocks + tableClusters
+		nextBlocks := (total + qcow2RefcountsPer - 1) / qcow2RefcountsPer
+		nextTableClusters := (nextBlocks*8 + qcow2ClusterSize - 1) / qcow2ClusterSize
+		if nextBlocks == blocks && nextTableClusters == tableClusters {
+			break
+		}
+		blocks, tableClusters = nextBlocks, nextTableClusters
+	}
+	tableOffset := q.allocate(tableClusters)
+	blocksOffset := q.allocate(blocks)
+
+	refcountTable := make([]uint64, tableClusters*qcow2ClusterSize/8)
+	for i := int64(0); i < blocks; i++ {
+		refcountTable[i] = uint64(blocksOffset + i*qcow2ClusterSize)
+	}
+	if err := q.writeTable(tableOffset, refcountTable); err != nil {
+		return err
+	}
+
+	// every cluster in the file is referenced exactly once, apart from
+	// data clusters dropped above
+	totalClusters := q.next / qcow2ClusterSize
+	refcounts := make([]byte, blocks*qcow2ClusterSize)
+	for i := int64(0); i < totalClusters; i++ {
+		if _, ok := dropped[i*qcow2ClusterSize]; ok {
+			continue
+		}
+		binary.BigEndian.PutUint16(refcounts[i*2:], 1)
+	}
+	if _, err := q.file.WriteAt(refcounts, blocksOffset); err != nil {
+		return err
+	}
+
+	header := qcow2Header{
+		Magic:                 qcow2Magic,
+		Version:               qcow2Version,
+		ClusterBits:           qcow2ClusterBits,
+		Size:                  uint64(size),
+		L1Size:                uint32(l1Size),
+		L1TableOffset:         uint64(l1Offset),
+		RefcountTableOffset:   uint64(tableOffset),
+		RefcountTableClusters: uint32(tableClusters),
+		RefcountOrder:         4,
+		HeaderLength:          qcow2HeaderLength,
+	}
+	headerCluster := make([]byte, qcow2ClusterSize)
+	if _, err := binary.Encode(headerCluster, binary.BigEndian, header); err != nil {
+		return fmt.Errorf("failed to encode qcow2 header: %w", err)
+	}
+	// the header extension area ends with a zeroed end-of-extensions marker,
+	// which the zero-filled cluster already provides
+	if _, err := q.file.WriteAt(headerCluster, 0); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (q *qcow2Writer) writeTable(offset int64, entries []uint64) error {
+	buf := make([]byte, len(entries)*8)
+	for i, entry := range entries {
+		binary.BigEndian.PutUint64(buf[i*8:], entry)
+	}
+	_, err := q.file.WriteAt(buf, offset)
+	return err
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+)
+
+func readQcow2Header(t *testing.T, file *os.File) qcow2Header {
+	t.Helper()
+	var header qcow2Header
+	if err := binary.Read(io.NewSectionReader(file, 0, qcow2HeaderLength), binary.BigEndian, &header); err != nil {
+		t.Fatal(err)
+	}
+	return header
+}
+
+func readQcow2Entry(t *testing.T, file *os.File, offset int64) uint64 {
+	t.Helper()
+	buf := make([]byte, 8)
+	if _, err := file.ReadAt(buf, offset); err != nil {
+		t.Fatal(err)
+	}
+	return binary.BigEndian.Uint64(buf)
+}
+
+// readQcow2At resolves guest offsets through the L1/L2 tables
+func readQcow2At(t *testing.T, file *os.File, header qcow2Header, p []byte, off int64) {
+	t.Helper()
+	for len(p) > 0 {
+		guest := off / qcow2ClusterSize
+		within := off % qcow2ClusterSize
+		n := int(min(int64(len(p)), qcow2ClusterSize-within))
+
+		clear(p[:n])
+		l1Entry := readQcow2Entry(t, file, int64(header.L1TableOffset)+guest/qcow2L2Entries*8)
+		if l2Offset := int64(l1Entry &^ qcow2OflagCopied); l2Offset != 0 {
+			l2Entry := readQcow2Entry(t, file, l2Offset+guest%qcow2L2Entries*8)
+			if host := int64(l2Entry &^ qcow2OflagCopied); host != 0 {
+				if _, err := file.ReadAt(p[:n], host+within); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		off += int64(n)
+		p = p[n:]
+	}
+}
+
+func TestQcow2Writer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.qcow2")
+	writer, err := createQcow2(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size := int64(640 * 1024 * 1024)
+	writes := []struct {
+		offset int64
+		data   []byte
+	}{
+		{offset: 0, data: testBlockData(1, 2*1024*1024)},
+		{offset: 600 * 1024 * 1024, data: testBlockData(2, 2*1024*1024)},
+		{offset: 100, data: testBlockData(3, 50)},
+		{offset: 10 * 1024 * 1024, data: make([]byte, 2*1024*1024)},
+		{offset: size - 1000, data: testBlockData(4, 1000)},
+	}
+	for _, w := range writes {
+		if _, err := writer.WriteAt(w.data, w.offset); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// past the final size, must be dropped
+	if _, err := writer.WriteAt(testBlockData(5, 4096), size+qcow2ClusterSize); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedStart := testBlockData(1, 200)
+	copy(expectedStart[100:], testBlockData(3, 50))
+	readBack := make([]byte, 200)
+	if _, err := writer.ReadAt(readBack, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readBack, expectedStart) {
+		t.Error("ReadAt does not match written data")
+	}
+
+	if err := writer.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	header := readQcow2Header(t, file)
+	if header.Magic != qcow2Magic {
+		t.Errorf("Expected magic %x, got %x", qcow2Magic, header.Magic)
+	}
+	if header.Version != 3 {
+		t.Errorf("Expected version 3, got %d", header.Version)
+	}
+	if header.ClusterBits != qcow2ClusterBits {
+		t.Errorf("Expected cluster bits %d, got %d", qcow2ClusterBits, header.ClusterBits)
+	}
+	if header.Size != uint64(size) {
+		t.Errorf("Expected size %d, got %d", size, header.Size)
+	}
+	if header.L1Size != 2 {
+		t.Errorf("Expected L1 size 2, got %d", header.L1Size)
+	}
+
+	// later writes win where regions overlap
+	for i, w := range writes[1:] {
+		got := make([]byte, len(w.data))
+		readQcow2At(t, file, header, got, w.offset)
+		if !bytes.Equal(got, w.data) {
+			t.Errorf("Write %d at offset %d does not match", i+1, w.offset)
+		}
+	}
+	got := make([]byte, 200)
+	readQcow2At(t, file, header, got, 0)
+	if !bytes.Equal(got, expectedStart) {
+		t.Error("Image start does not match written data")
+	}
+	got = make([]byte, qcow2ClusterSize)
+	readQcow2At(t, file, header, got, 300*1024*1024)
+	if !backupstore.IsZeroBlock(got) {
+		t.Error("Expected unwritten region to read as zeroes")
+	}
+
+	// the zero write and the unwritten regions must stay unallocated
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Size() > 8*1024*1024 {
+		t.Errorf("Expected a compact image, got %d bytes", stat.Size())
+	}
+}
+
+func TestQcow2WriterQemuImg(t *testing.T) {
+	qemuImg, err := exec.LookPath("qemu-img")
+	if err != nil {
+		t.Skip("qemu-img not available")
+	}
+	mkfs, err := exec.LookPath("mkfs.ext4")
+	if err != nil {
+		t.Skip("mkfs.ext4 not available")
+	}
+
+	dir := t.TempDir()
+	rawPath := filepath.Join(dir, "source.raw")
+	if err := os.WriteFile(rawPath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(rawPath, 32*1024*1024); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command(mkfs, "-q", "-F", rawPath).CombinedOutput(); err != nil {
+		t.Fatalf("mkfs.ext4 failed: %v: %s", err, out)
+	}
+	raw, err := os.ReadFile(rawPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	qcowPath := filepath.Join(dir, "out.qcow2")
+	writer, err := createQcow2(qcowPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for offset := 0; offset < len(raw); offset += testBlockSize {
+		if _, err := writer.WriteAt(raw[offset:offset+testBlockSize], int64(offset)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Truncate(int64(len(raw))); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if out, err := exec.Command(qemuImg, "check", qcowPath).CombinedOutput(); err != nil {
+		t.Fatalf("qemu-img check failed: %v: %s", err, out)
+	}
+	convertedPath := filepath.Join(dir, "converted.raw")
+	if out, err := exec.Command(qemuImg, "convert", "-O", "raw", qcowPath, convertedPath).CombinedOutput(); err != nil {
+		t.Fatalf("qemu-img convert failed: %v: %s", err, out)
+	}
+	converted, err := os.ReadFile(convertedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(converted, raw) {
+		t.Error("Converted image does not match the source filesystem")
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+)
+
+// restoreOptions are the options of the sequential writers, streamBackups
+// and verifyRestore, which size the image themselves
+type restoreOptions struct {
+	Jobs int
+	// VolumeSize is the length of the image, if known from volume.cfg
+	VolumeSize int64
+	// Strict fails on a backup listing blocks at the same offset, at
+	// offsets that aren't a multiple of its block size or past
+	// VolumeSize, rather than warning on Logger
+	Strict bool
+	// NoTruncate keeps the image as long as the blocks written, and
+	// PadToSize forces its length, whatever size was detected
+	NoTruncate bool
+	PadToSize  int64
+	Progress   io.Writer
+	// Verbosity throttles the per-block lines on Progress, which Events
+	// replaces when set
+	Verbosity verbosity
+	Events    *progressReporter
+	// Cache, if set, is consulted before reading each block, and Memory
+	// bounds the blocks held at once
+	Cache  *backupstore.BlockCache
+	Memory *backupstore.MemoryBudget
+	// OnChecksumMismatch and OnMissingBlock are what to do with blocks
+	// that fail their checksum or are missing, and Damaged records those
+	// the restore went on without failing
+	OnChecksumMismatch backupstore.MismatchPolicy
+	OnMissingBlock     backupstore.MissingPolicy
+	Damaged            *backupstore.DamageReport
+	// Stats, if set, counts what streamBackups did
+	Stats *backupstore.RepackStats
+	// Throttles are the rate limits the progress shows the throughput of
+	Throttles []throttle
+	// Logger, if set, is warned of backups listing more than one block at
+	// an offset
+	Logger *slog.Logger
+}
+
+// mismatchPolicies are the values of -on-checksum-mismatch
+var mismatchPolicies = map[string]backupstore.MismatchPolicy{
+	"fail": backupstore.MismatchFail,
+	"warn": backupstore.MismatchWarn,
+	"skip": backupstore.MismatchSkip,
+}
+
+// missingPolicies are the values of -on-missing-block
+var missingPolicies = map[string]backupstore.MissingPolicy{
+	"fail": backupstore.MissingFail,
+	"zero": backupstore.MissingZero,
+}
+
+// shortChecksum is the start of checksum for progress lines
+func shortChecksum(checksum string) string {
+	return checksum[:min(len(checksum), 20)]
+}
+
+// repackProgress shows the passes of backupstore.Repack on a status line
+// per pass, or as events when those are set
+type repackProgress struct {
+	w         io.Writer
+	level     verbosity
+	events    *progressReporter
+	throttles []throttle
+	metrics   *targetMetrics
+	status    *passProgress
+}
+
+func (p *repackProgress) StartPass(pass, totalPasses, blocks int) {
+	p.status = newPassProgress(p.w, fmt.Sprintf("[pass %d/%d]", pass, totalPasses), blocks, p.level)
+	p.status.limit(p.throttles)
+	p.metrics.startPass(pass, totalPasses)
+}
+
+func (p *repackProgress) Block(pass, totalPasses, done, totalBlocks int, block backupstore.Block, compression string, written int64) {
+	if p.events != nil {
+		p.events.block(pass, totalPasses, done, totalBlocks, block, written)
+		return
+	}
+	p.status.block(done, written, func() string {
+		return fmt.Sprintf("Block %s* {offset=%d} {%s}", shortChecksum(block.Checksum), block.Offset, compression)
+	})
+}
+
+func (p *repackProgress) EndPass(pass, totalPasses int) {
+	p.status.close()
+}
+
+// printBufferStats prints how often the block cache saved a read and the
+// most memory block buffers took, for those that are enabled
+func printBufferStats(w io.Writer, cache *backupstore.BlockCache, memory *backupstore.MemoryBudget) {
+	if cache != nil {
+		hits, misses := cache.Stats()
+		fmt.Fprintf(w, "Block cache: %d hits, %d misses\n", hits, misses)
+	}
+	if memory != nil {
+		fmt.Fprintf(w, "Peak block buffer memory: %s\n", formatBytes(memory.Peak()))
+	}
+}
+
+// printThrottleStats prints each rate limit, the bytes that went through
+// it and how long they waited for it
+func printThrottleStats(w io.Writer, throttles []throttle) {
+	for _, throttle := range throttles {
+		limiter := throttle.limiter
+		fmt.Fprintf(w, "Rate limit (%s): %s/s, waited %s for %s\n", throttle.name, formatBytes(limiter.Rate()), limiter.Waited().Round(time.Millisecond), formatBytes(limiter.Total()))
+	}
+}
+
+// printRestoreSummary prints what the restore did, once it is done
+func printRestoreSummary(w io.Writer, stats *backupstore.RepackStats) {
+	fmt.Fprintf(w, "Summary:\n")
+	fmt.Fprintf(w, "  Backups applied:      %d\n", stats.Backups)
+	fmt.Fprintf(w, "  Blocks read:          %d\n", stats.BlocksRead)
+	fmt.Fprintf(w, "  Blocks skipped:       %d overwritten by newer backups or already restored, %d zero\n", stats.BlocksSkipped, stats.ZeroBlocks)
+	fmt.Fprintf(w, "  Bytes decompressed:   %s\n", formatBytes(stats.BytesDecompressed))
+	fmt.Fprintf(w, "  Bytes written:        %s\n", formatBytes(stats.BytesWritten))
+	fmt.Fprintf(w, "  Checksum mismatches:  %d\n", stats.ChecksumMismatches)
+	fmt.Fprintf(w, "  Missing blocks:       %d zero-filled\n", stats.MissingBlocks)
+	fmt.Fprintf(w, "  Retries:              %d\n", stats.Retries)
+	fmt.Fprintf(w, "  Time:                 %s, %s/s\n", stats.Elapsed.Round(time.Millisecond), formatBytes(int64(stats.Throughput())))
+}
+
+// printDamageReport lists the blocks the restore went on without failing,
+// and what it did with each
+func printDamageReport(w io.Writer, damaged []backupstore.DamagedBlock) {
+	if len(damaged) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "%d damaged blocks:\n", len(damaged))
+	for _, block := range damaged {
+		fmt.Fprintf(w, "  offset %d: %s, %s\n", block.Offset, block.Err, block.Action)
+	}
+}
+
+// mountHint is how to get at the contents found in the image written to
+// outfile in format, on the platform goos
+func mountHint(goos, format, contents, outfile string) string {
+	encrypted := contents == luksType || contents == lvmPVType
+	switch goos {
+	case "windows":
+		switch {
+		case format != "vhd":
+			return "Windows only attaches VHD images, restore with -output-format vhd to attach it with 'wsl --mount' or Mount-DiskImage"
+		case encrypted:
+			return fmt.Sprintf("Run 'wsl --mount %s --vhd --bare' to attach the image to WSL and open it there, as on Linux", outfile)
+		case contents == "ntfs":
+			return fmt.Sprintf("Run 'Mount-DiskImage -ImagePath %s' in PowerShell to mount the image", outfile)
+		}
+		return fmt.Sprintf("Run 'wsl --mount %s --vhd' to mount the image in WSL, as Windows can't read its filesystem", outfile)
+	case "darwin":
+		switch {
+		case encrypted:
+			return "macOS can't open it, copy the image to a Linux host"
+		case format != "raw":
+			return "Restore with -output-format raw to attach the image with hdiutil"
+		}
+		return fmt.Sprintf("Run 'hdiutil attach -imagekey diskimage-class=CRawDiskImage -nomount %s' to attach the image", outfile)
+	}
+
+	switch {
+	case contents == luksType && format == "raw":
+		return fmt.Sprintf("Run 'sudo cryptsetup open %s restored' and mount /dev/mapper/restored, or restore again with -luks-passphrase to decrypt it", outfile)
+	case contents == luksType:
+		return fmt.Sprintf("Run 'sudo qemu-nbd --connect=/dev/nbd0 %s' and 'sudo cryptsetup open /dev/nbd0 restored', then mount /dev/mapper/restored", outfile)
+	case contents == lvmPVType && format == "raw":
+		return fmt.Sprintf("Run 'sudo losetup --find --show %s' and 'sudo vgchange -ay' to activate its logical volumes", outfile)
+	case contents == lvmPVType:
+		return fmt.Sprintf("Run 'sudo qemu-nbd --connect=/dev/nbd0 %s' and 'sudo vgchange -ay' to activate its logical volumes", outfile)
+	case format == "qcow2" || format == "vmdk" || format == "vdi":
+		return fmt.Sprintf("Run 'sudo qemu-nbd --connect=/dev/nbd0 %s' and mount /dev/nbd0 to access the image", outfile)
+	}
+	return fmt.Sprintf("Run 'sudo mount -o loop %s /mnt' to mount the image", outfile)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pierrec/lz4/v4"
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+)
+
+const testBlockSize = 2 * 1024 * 1024
+
+func compressTestLZ4(tb testing.TB, data []byte) []byte {
+	tb.Helper()
+	var compressed bytes.Buffer
+	zw := lz4.NewWriter(&compressed)
+	if _, err := zw.Write(data); err != nil {
+		tb.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		tb.Fatal(err)
+	}
+	return compressed.Bytes()
+}
+
+func writeTestBlock(tb testing.TB, volumePath string, data []byte) string {
+	tb.Helper()
+	compressed := compressTestLZ4(tb, data)
+
+	sum := sha512.Sum512(data)
+	checksum := hex.EncodeToString(sum[:])
+	blocksDir := filepath.Join(volumePath, "blocks", checksum[0:2], checksum[2:4])
+	if err := os.MkdirAll(blocksDir, 0755); err != nil {
+		tb.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(blocksDir, checksum+".blk"), compressed, 0644); err != nil {
+		tb.Fatal(err)
+	}
+	return checksum
+}
+
+func testBlockData(seed byte, size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = seed + byte(i%251)
+	}
+	return data
+}
+
+var errTestDiskFull = errors.New("no space left on device")
+
+// failingWriter accepts a number of writes and then fails every one after
+type failingWriter struct {
+	mu     sync.Mutex
+	writes int
+	limit  int
+}
+
+func (w *failingWriter) WriteAt(p []byte, off int64) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.writes >= w.limit {
+		return 0, errTestDiskFull
+	}
+	w.writes++
+	return len(p), nil
+}
+
+func TestShortChecksum(t *testing.T) {
+	if got := shortChecksum("abc"); got != "abc" {
+		t.Errorf("Expected a short checksum to be kept whole, got %s", got)
+	}
+	if got := shortChecksum(strings.Repeat("ab", 64)); got != strings.Repeat("ab", 10) {
+		t.Errorf("Expected the first 20 characters, got %s", got)
+	}
+}
+
+func TestRepackProgress(t *testing.T) {
+	volumePath := t.TempDir()
+	first := writeTestBlock(t, volumePath, testBlockData(1, 4096))
+	second := writeTestBlock(t, volumePath, testBlockData(2, 4096))
+	backups := []backupstore.Backup{
+		{Identifier: "backup-1", Compression: "lz4", Blocks: []backupstore.Block{{Offset: 0, Checksum: first}, {Offset: 4096, Checksum: first}}},
+		{Identifier: "backup-2", Compression: "lz4", Blocks: []backupstore.Block{{Offset: 4096, Checksum: second}}},
+	}
+
+	tests := []struct {
+		name         string
+		legacyPasses bool
+		expected     []string
+	}{
+		{
+			name: "single pass",
+			expected: []string{
+				"Skipping blocks overwritten by newer backups blocks=1",
+				"[pass 1/1] [50.00%] Block " + first[:20] + "* {offset=0} {lz4}",
+				"[pass 1/1] [100.00%] Block " + second[:20] + "* {offset=4096} {lz4}",
+			},
+		},
+		{
+			name:         "legacy passes",
+			legacyPasses: true,
+			expected: []string{
+				"[pass 1/2] [100.00%] Block " + second[:20] + "* {offset=4096} {lz4}",
+				"Skipping blocks already written by newer backups pass=2 passes=2 blocks=1",
+				"[pass 2/2] [100.00%] Block " + first[:20] + "* {offset=0} {lz4}",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var log bytes.Buffer
+			out, err := os.Create(filepath.Join(t.TempDir(), "out.raw"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer out.Close()
+			err = backupstore.Repack(context.Background(), os.DirFS(volumePath), ".", backups, out, backupstore.RepackOptions{
+				Jobs:         1,
+				LegacyPasses: tt.legacyPasses,
+				Logger:       newLogger(&log, "text", slog.LevelInfo),
+				Progress:     &repackProgress{w: &log, level: verbosityVerbose},
+			})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			lines := strings.Split(strings.TrimSpace(log.String()), "\n")
+			if len(lines) != len(tt.expected) {
+				t.Fatalf("Expected %d lines, got %q", len(tt.expected), log.String())
+			}
+			for i, line := range lines {
+				if line != tt.expected[i] {
+					t.Errorf("Expected line %d to be %q, got %q", i, tt.expected[i], line)
+				}
+			}
+		})
+	}
+}
+
+func TestMountHint(t *testing.T) {
+	tests := []struct {
+		goos     string
+		format   string
+		contents string
+		expected string
+	}{
+		{goos: "linux", format: "raw", contents: "ext4", expected: "sudo mount -o loop out.img"},
+		{goos: "linux", format: "qcow2", contents: "ext4", expected: "qemu-nbd"},
+		{goos: "linux", format: "raw", contents: lvmPVType, expected: "losetup"},
+		{goos: "linux", format: "raw", contents: luksType, expected: "cryptsetup open out.img"},
+		{goos: "windows", format: "raw", contents: "ntfs", expected: "-output-format vhd"},
+		{goos: "windows", format: "vhd", contents: "ntfs", expected: "Mount-DiskImage -ImagePath out.img"},
+		{goos: "windows", format: "vhd", contents: "ext4", expected: "wsl --mount out.img --vhd'"},
+		{goos: "windows", format: "vhd", contents: luksType, expected: "--bare"},
+		{goos: "darwin", format: "raw", contents: "ext4", expected: "hdiutil attach"},
+		{goos: "darwin", format: "vmdk", contents: "ext4", expected: "-output-format raw"},
+	}
+	for _, tt := range tests {
+		hint := mountHint(tt.goos, tt.format, tt.contents, "out.img")
+		if !strings.Contains(hint, tt.expected) {
+			t.Errorf("Expected %q in the hint for a %s %s image on %s, got %q", tt.expected, tt.contents, tt.format, tt.goos, hint)
+		}
+		if tt.goos != "linux" && strings.Contains(hint, "losetup") {
+			t.Errorf("Expected no losetup on %s, got %q", tt.goos, hint)
+		}
+	}
+}
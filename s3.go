@@ -0,0 +1,417 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+const s3Attempts = 4
+
+type s3API interface {
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+}
+
+// s3Store exposes the backupstore under an S3 prefix as a read-only
+// filesystem, treating "/" separated key prefixes as directories
+type s3Store struct {
+	retryCounter
+	ctx    context.Context
+	client s3API
+	bucket string
+	// key prefix of the backupstore, always ending in "/"
+	prefix  string
+	backoff time.Duration
+}
+
+// parseS3URL accepts s3://bucket/prefix as well as Longhorn's
+// s3://bucket@region/prefix form
+func parseS3URL(raw string) (bucket, region, prefix string, err error) {
+	rest, ok := strings.CutPrefix(raw, "s3://")
+	if !ok {
+		return "", "", "", fmt.Errorf("not an s3 url: %s", raw)
+	}
+	bucket, prefix, _ = strings.Cut(rest, "/")
+	bucket, region, _ = strings.Cut(bucket, "@")
+	if bucket == "" {
+		return "", "", "", fmt.Errorf("missing bucket in %s", raw)
+	}
+	return bucket, region, strings.Trim(prefix, "/"), nil
+}
+
+// longhornS3Keys are the keys of a Longhorn S3 backup target secret the
+// backend reads
+var longhornS3Keys = []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_ENDPOINTS", "AWS_CERT", "VIRTUAL_HOSTED_STYLE"}
+
+// readCredentialFile reads the keys of a Longhorn backup target secret from
+// a directory with a file per key, the way Kubernetes mounts a secret, or
+// from a .env style file of KEY=value lines
+func readCredentialFile(name string) (map[string]string, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string)
+	if info.IsDir() {
+		for _, key := range longhornS3Keys {
+			data, err := os.ReadFile(filepath.Join(name, key))
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			values[key] = strings.TrimRight(string(data), "\r\n")
+		}
+		return values, nil
+	}
+
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected KEY=value", name, i+1)
+		}
+		value = strings.TrimSpace(value)
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		} else if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+			value = value[1 : len(value)-1]
+		}
+		values[strings.TrimSpace(key)] = value
+	}
+	return values, nil
+}
+
+// s3Secret is the part of a Longhorn backup target secret that configures
+// the S3 client. Credentials are only set when they come from a credential
+// file, so the environment is left to the SDK's own credential chain.
+type s3Secret struct {
+	accessKeyID        string
+	secretAccessKey    string
+	endpoint           string
+	cert               string
+	virtualHostedStyle bool
+}
+
+// loadS3Secret reads the secret from credentialFile, if given, falling back
+// to getenv for the keys the AWS SDK doesn't read itself
+func loadS3Secret(credentialFile string, getenv func(string) string) (s3Secret, error) {
+	file := make(map[string]string)
+	if credentialFile != "" {
+		var err error
+		if file, err = readCredentialFile(credentialFile); err != nil {
+			return s3Secret{}, fmt.Errorf("failed to read credential file: %w", err)
+		}
+	}
+	value := func(key string) string {
+		if v, ok := file[key]; ok {
+			return v
+		}
+		return getenv(key)
+	}
+
+	secret := s3Secret{
+		accessKeyID:     file["AWS_ACCESS_KEY_ID"],
+		secretAccessKey: file["AWS_SECRET_ACCESS_KEY"],
+		endpoint:        value("AWS_ENDPOINTS"),
+		cert:            value("AWS_CERT"),
+	}
+	if (secret.accessKeyID == "") != (secret.secretAccessKey == "") {
+		return s3Secret{}, fmt.Errorf("credential file %s needs both AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY", credentialFile)
+	}
+	if v := value("VIRTUAL_HOSTED_STYLE"); v != "" {
+		virtualHostedStyle, err := strconv.ParseBool(v)
+		if err != nil {
+			return s3Secret{}, fmt.Errorf("invalid VIRTUAL_HOSTED_STYLE %q, expected true or false", v)
+		}
+		secret.virtualHostedStyle = virtualHostedStyle
+	}
+	return secret, nil
+}
+
+// s3HTTPClient trusts the PEM certificates of cert on top of the system
+// ones, as Longhorn does with AWS_CERT
+func s3HTTPClient(cert string) (aws.HTTPClient, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM([]byte(cert)) {
+		return nil, errors.New("no PEM certificates found in AWS_CERT")
+	}
+	return awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+		if tr.TLSClientConfig == nil {
+			tr.TLSClientConfig = &tls.Config{}
+		}
+		tr.TLSClientConfig.RootCAs = pool
+	}), nil
+}
+
+// s3ClientOptions points the client at endpoint, with path-style addressing
+// unless virtualHostedStyle is set. MinIO and most other S3 compatible stores
+// need path-style, which is why Longhorn defaults to it too.
+func s3ClientOptions(endpoint string, virtualHostedStyle bool) func(*s3.Options) {
+	return func(o *s3.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+			o.UsePathStyle = !virtualHostedStyle
+		}
+	}
+}
+
+func newS3Store(ctx context.Context, backupRoot string, opts storeOptions) (*s3Store, error) {
+	bucket, region, prefix, err := parseS3URL(backupRoot)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := loadS3Secret(opts.CredentialFile, os.Getenv)
+	if err != nil {
+		return nil, err
+	}
+
+	loadOpts := []func(*config.LoadOptions) error{
+		config.WithRetryer(func() aws.Retryer { return aws.NopRetryer{} }),
+	}
+	if region != "" {
+		loadOpts = append(loadOpts, config.WithRegion(region))
+	}
+	if secret.accessKeyID != "" {
+		loadOpts = append(loadOpts, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(secret.accessKeyID, secret.secretAccessKey, "")))
+	}
+	if secret.cert != "" {
+		httpClient, err := s3HTTPClient(secret.cert)
+		if err != nil {
+			return nil, err
+		}
+		loadOpts = append(loadOpts, config.WithHTTPClient(httpClient))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, loadOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS configuration: %w", err)
+	}
+	// otherwise the first request fails with a signing error that doesn't
+	// say what is missing
+	if _, err := cfg.Credentials.Retrieve(ctx); err != nil {
+		return nil, fmt.Errorf("no AWS credentials found for s3://%s, set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY (the keys of Longhorn's backup target secret), pass the secret as -credential-file, or set AWS_PROFILE: %w", bucket, err)
+	}
+	client := s3.NewFromConfig(cfg, s3ClientOptions(cmp.Or(opts.S3Endpoint, secret.endpoint), secret.virtualHostedStyle))
+
+	return &s3Store{
+		ctx:     ctx,
+		client:  client,
+		bucket:  bucket,
+		prefix:  path.Join(prefix, "backupstore") + "/",
+		backoff: 500 * time.Millisecond,
+	}, nil
+}
+
+func (s *s3Store) String() string {
+	return "s3://" + s.bucket + "/" + strings.TrimSuffix(s.prefix, "/")
+}
+
+// Remote implements backupstore.RemoteFS, so missing blocks aren't
+// searched for
+func (s *s3Store) Remote() bool { return true }
+
+func (s *s3Store) key(name string) string {
+	if name == "." {
+		return s.prefix
+	}
+	return s.prefix + name
+}
+
+func isS3NotFound(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "NoSuchKey", "NotFound":
+			return true
+		}
+	}
+	return false
+}
+
+// s3Transient reports errors that may succeed on another attempt, using the
+// SDK's own classification of throttling, 5xx and connection errors. The
+// SDK retryer is disabled in newS3Store so requests aren't retried twice.
+func s3Transient(err error) bool {
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		// the connection dropped while reading the body
+		return true
+	}
+	return retry.IsErrorRetryables(retry.DefaultRetryables).IsErrorRetryable(err) == aws.TrueTernary
+}
+
+// retry runs op until it succeeds, fails with an error that can't be
+// retried, or the attempts run out
+func (s *s3Store) retry(op func() error) error {
+	return s.retryBackoff(s.ctx, s3Attempts, s.backoff, op, s3Transient)
+}
+
+func (s *s3Store) ReadFile(name string) ([]byte, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrInvalid}
+	}
+
+	var data []byte
+	err := s.retry(func() error {
+		out, err := s.client.GetObject(s.ctx, &s3.GetObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(s.key(name)),
+		})
+		if err != nil {
+			return err
+		}
+		defer out.Body.Close()
+		data, err = io.ReadAll(out.Body)
+		return err
+	})
+	if isS3NotFound(err) {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrNotExist}
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	return data, nil
+}
+
+func (s *s3Store) list(name string, limit int32) ([]fs.DirEntry, error) {
+	prefix := s.key(name)
+	if name != "." {
+		prefix += "/"
+	}
+
+	entries := make([]fs.DirEntry, 0)
+	var token *string
+	for {
+		input := &s3.ListObjectsV2Input{
+			Bucket:            aws.String(s.bucket),
+			Prefix:            aws.String(prefix),
+			Delimiter:         aws.String("/"),
+			ContinuationToken: token,
+		}
+		if limit > 0 {
+			input.MaxKeys = aws.Int32(limit)
+		}
+		var out *s3.ListObjectsV2Output
+		err := s.retry(func() error {
+			var err error
+			out, err = s.client.ListObjectsV2(s.ctx, input)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, common := range out.CommonPrefixes {
+			dir := strings.TrimSuffix(strings.TrimPrefix(aws.ToString(common.Prefix), prefix), "/")
+			entries = append(entries, fs.FileInfoToDirEntry(remoteFileInfo{name: dir, dir: true}))
+		}
+		for _, object := range out.Contents {
+			file := strings.TrimPrefix(aws.ToString(object.Key), prefix)
+			if file == "" {
+				continue
+			}
+			entries = append(entries, fs.FileInfoToDirEntry(remoteFileInfo{
+				name:    file,
+				size:    aws.ToInt64(object.Size),
+				modTime: aws.ToTime(object.LastModified),
+			}))
+		}
+
+		if limit > 0 || !aws.ToBool(out.IsTruncated) {
+			break
+		}
+		token = out.NextContinuationToken
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+func (s *s3Store) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	entries, err := s.list(name, 0)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	if len(entries) == 0 {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	return entries, nil
+}
+
+func (s *s3Store) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+
+	if name != "." {
+		var out *s3.HeadObjectOutput
+		err := s.retry(func() error {
+			var err error
+			out, err = s.client.HeadObject(s.ctx, &s3.HeadObjectInput{
+				Bucket: aws.String(s.bucket),
+				Key:    aws.String(s.key(name)),
+			})
+			return err
+		})
+		if err == nil {
+			return remoteFileInfo{
+				name:    path.Base(name),
+				size:    aws.ToInt64(out.ContentLength),
+				modTime: aws.ToTime(out.LastModified),
+			}, nil
+		}
+		if !isS3NotFound(err) {
+			return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+		}
+	}
+
+	// directories only exist as a prefix of other keys
+	entries, err := s.list(name, 1)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	if len(entries) == 0 {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return remoteFileInfo{name: path.Base(name), dir: true}, nil
+}
+
+func (s *s3Store) Open(name string) (fs.File, error) {
+	return openRemote(s, name)
+}
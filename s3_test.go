@@ -0,0 +1,496 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+)
+
+type fakeS3 struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	failures map[string]int
+	denied   map[string]bool
+	gets     map[string]int
+	lists    int
+	pageSize int
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		objects:  make(map[string][]byte),
+		failures: make(map[string]int),
+		denied:   make(map[string]bool),
+		gets:     make(map[string]int),
+		pageSize: 2,
+	}
+}
+
+func (f *fakeS3) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.lists++
+	prefix := aws.ToString(params.Prefix)
+	delimiter := aws.ToString(params.Delimiter)
+	seen := make(map[string]bool)
+	keys := make([]string, 0)
+	for key := range f.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		rest := key[len(prefix):]
+		if i := strings.Index(rest, delimiter); delimiter != "" && i >= 0 {
+			key = prefix + rest[:i+1]
+		}
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	start := 0
+	if params.ContinuationToken != nil {
+		start = sort.SearchStrings(keys, aws.ToString(params.ContinuationToken))
+	}
+	limit := f.pageSize
+	if params.MaxKeys != nil {
+		limit = min(limit, int(aws.ToInt32(params.MaxKeys)))
+	}
+	end := min(start+limit, len(keys))
+
+	out := &s3.ListObjectsV2Output{IsTruncated: aws.Bool(end < len(keys))}
+	if end < len(keys) {
+		out.NextContinuationToken = aws.String(keys[end])
+	}
+	for _, key := range keys[start:end] {
+		if strings.HasSuffix(key, delimiter) && delimiter != "" {
+			out.CommonPrefixes = append(out.CommonPrefixes, types.CommonPrefix{Prefix: aws.String(key)})
+			continue
+		}
+		out.Contents = append(out.Contents, types.Object{
+			Key:  aws.String(key),
+			Size: aws.Int64(int64(len(f.objects[key]))),
+		})
+	}
+	return out, nil
+}
+
+func (f *fakeS3) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := aws.ToString(params.Key)
+	f.gets[key]++
+	if f.failures[key] > 0 {
+		f.failures[key]--
+		return nil, &smithy.GenericAPIError{Code: "SlowDown", Message: "transient failure"}
+	}
+	if f.denied[key] {
+		return nil, &smithy.GenericAPIError{Code: "AccessDenied", Message: "Access Denied"}
+	}
+	data, ok := f.objects[key]
+	if !ok {
+		return nil, &types.NoSuchKey{}
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(data))}, nil
+}
+
+func (f *fakeS3) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	data, ok := f.objects[aws.ToString(params.Key)]
+	if !ok {
+		return nil, &smithy.GenericAPIError{Code: "NotFound"}
+	}
+	return &s3.HeadObjectOutput{ContentLength: aws.Int64(int64(len(data)))}, nil
+}
+
+// uploadDir copies a local directory tree into the fake bucket under prefix
+func (f *fakeS3) uploadDir(t *testing.T, dir string, prefix string) {
+	t.Helper()
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		f.objects[prefix+filepath.ToSlash(rel)] = data
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestS3Store(client s3API) *s3Store {
+	return &s3Store{
+		ctx:    context.Background(),
+		client: client,
+		bucket: "longhorn-backups",
+		prefix: "cluster/backupstore/",
+	}
+}
+
+func TestParseS3URL(t *testing.T) {
+	tests := []struct {
+		url           string
+		bucket        string
+		region        string
+		prefix        string
+		expectedError bool
+	}{
+		{url: "s3://longhorn-backups@us-east-1/", bucket: "longhorn-backups", region: "us-east-1"},
+		{url: "s3://longhorn-backups@us-east-1/cluster/a", bucket: "longhorn-backups", region: "us-east-1", prefix: "cluster/a"},
+		{url: "s3://longhorn-backups/cluster", bucket: "longhorn-backups", prefix: "cluster"},
+		{url: "s3://", expectedError: true},
+		{url: "/mnt/backups", expectedError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			bucket, region, prefix, err := parseS3URL(tt.url)
+			if tt.expectedError {
+				if err == nil {
+					t.Error("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if bucket != tt.bucket || region != tt.region || prefix != tt.prefix {
+				t.Errorf("Expected %s/%s/%s, got %s/%s/%s", tt.bucket, tt.region, tt.prefix, bucket, region, prefix)
+			}
+		})
+	}
+}
+
+func TestS3StoreRestore(t *testing.T) {
+	local := t.TempDir()
+	volumePath := filepath.Join(local, "volumes", "5f", "a2", "pvc-123")
+	if err := os.MkdirAll(filepath.Join(volumePath, "backups"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	blockSize := 4096
+	first := writeTestBlock(t, volumePath, testBlockData(1, blockSize))
+	second := writeTestBlock(t, volumePath, testBlockData(2, blockSize))
+	cfg := `{"CreatedTime": "2024-01-01T00:00:00Z", "Size": "8192", "CompressionMethod": "lz4", "BlockSize": "4096",
+		"Blocks": [{"Offset": 0, "BlockChecksum": "` + first + `"}, {"Offset": 4096, "BlockChecksum": "` + second + `"}]}`
+	if err := os.WriteFile(filepath.Join(volumePath, "backups", "backup_backup-1.cfg"), []byte(cfg), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	client := newFakeS3()
+	client.uploadDir(t, local, "cluster/backupstore/")
+	store := newTestS3Store(client)
+
+	volumes, err := backupstore.ListVolumes(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(volumes) != 1 || volumes[0] != "volumes/5f/a2/pvc-123" {
+		t.Errorf("Expected the pvc-123 volume, got %v", volumes)
+	}
+
+	volumeBackupPath, err := backupstore.FindVolumeBackupPath(store, "pvc-123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeBackup, err := backupstore.ReadBackups(store, volumeBackupPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(volumeBackup.Backups) != 1 {
+		t.Fatalf("Expected 1 backup, got %d", len(volumeBackup.Backups))
+	}
+
+	out, err := os.Create(filepath.Join(t.TempDir(), "out.raw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	err = backupstore.Repack(context.Background(), store, volumeBackup.BackupPath, volumeBackup.Backups, out, backupstore.RepackOptions{Jobs: 2})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	content, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, append(testBlockData(1, blockSize), testBlockData(2, blockSize)...)) {
+		t.Error("Restored image does not match expected content")
+	}
+}
+
+func TestS3StoreRetries(t *testing.T) {
+	client := newFakeS3()
+	client.objects["cluster/backupstore/flaky.cfg"] = []byte("data")
+	client.objects["cluster/backupstore/broken.cfg"] = []byte("data")
+	client.failures["cluster/backupstore/flaky.cfg"] = s3Attempts - 1
+	client.failures["cluster/backupstore/broken.cfg"] = s3Attempts
+	store := newTestS3Store(client)
+
+	data, err := store.ReadFile("flaky.cfg")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if string(data) != "data" {
+		t.Errorf("Expected data, got %s", data)
+	}
+	if client.gets["cluster/backupstore/flaky.cfg"] != s3Attempts {
+		t.Errorf("Expected %d attempts, got %d", s3Attempts, client.gets["cluster/backupstore/flaky.cfg"])
+	}
+
+	if _, err := store.ReadFile("broken.cfg"); err == nil {
+		t.Error("Expected error after exhausting retries")
+	}
+
+	_, err = store.ReadFile("missing.cfg")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected not exist error, got %v", err)
+	}
+	if client.gets["cluster/backupstore/missing.cfg"] != 1 {
+		t.Errorf("Expected missing objects not to be retried, got %d attempts", client.gets["cluster/backupstore/missing.cfg"])
+	}
+
+	client.objects["cluster/backupstore/private.cfg"] = []byte("data")
+	client.denied["cluster/backupstore/private.cfg"] = true
+	if _, err := store.ReadFile("private.cfg"); err == nil {
+		t.Error("Expected access denied error")
+	}
+	if client.gets["cluster/backupstore/private.cfg"] != 1 {
+		t.Errorf("Expected access denied not to be retried, got %d attempts", client.gets["cluster/backupstore/private.cfg"])
+	}
+
+	// flaky.cfg and broken.cfg were each retried after their first attempt
+	if retries := store.Retries(); retries != 2*(s3Attempts-1) {
+		t.Errorf("Expected %d retries, got %d", 2*(s3Attempts-1), retries)
+	}
+}
+
+func TestS3StoreMissingBlock(t *testing.T) {
+	client := newFakeS3()
+	for i := 0; i < 16; i++ {
+		client.objects[fmt.Sprintf("cluster/backupstore/volumes/5f/a2/pvc-123/blocks/%02x/00/block.blk", i)] = []byte("data")
+	}
+	store := newTestS3Store(client)
+
+	_, err := backupstore.ResolveBlockPath(store, "volumes/5f/a2/pvc-123", "abcdef0123456789")
+	if err == nil {
+		t.Fatal("Expected error but got none")
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected not exist error, got %v", err)
+	}
+	// the directory fallback of Stat is a single limited listing; searching
+	// the blocks tree would take one per directory
+	if client.lists > 1 {
+		t.Errorf("Expected at most 1 listing for a missing block, got %d", client.lists)
+	}
+}
+
+// clearAWSEnv keeps the AWS configuration of the machine running the tests
+// out of the S3 client
+func clearAWSEnv(t *testing.T) {
+	t.Helper()
+	empty := filepath.Join(t.TempDir(), "empty")
+	if err := os.WriteFile(empty, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range append([]string{"AWS_SESSION_TOKEN", "AWS_PROFILE", "AWS_WEB_IDENTITY_TOKEN_FILE", "AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "AWS_CONTAINER_CREDENTIALS_FULL_URI"}, longhornS3Keys...) {
+		t.Setenv(key, "")
+	}
+	t.Setenv("AWS_CONFIG_FILE", empty)
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", empty)
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+}
+
+func TestS3StoreCredentials(t *testing.T) {
+	clearAWSEnv(t)
+	_, _, err := openBackupStore(context.Background(), "s3://longhorn-backups@us-east-1/cluster", storeOptions{})
+	if err == nil || !strings.Contains(err.Error(), "no AWS credentials found for s3://longhorn-backups, set AWS_ACCESS_KEY_ID") {
+		t.Errorf("Expected an error naming the missing credentials, got %v", err)
+	}
+}
+
+func TestS3StoreSecret(t *testing.T) {
+	var mu sync.Mutex
+	var requests []*http.Request
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r)
+		mu.Unlock()
+		fmt.Fprint(w, "backup")
+	}))
+	defer server.Close()
+	cert := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+
+	tests := []struct {
+		name     string
+		env      map[string]string
+		file     string
+		dir      map[string]string
+		endpoint string
+	}{
+		{
+			name: "environment",
+			env: map[string]string{
+				"AWS_ACCESS_KEY_ID": "AKIDTEST", "AWS_SECRET_ACCESS_KEY": "secret",
+				"AWS_ENDPOINTS": server.URL, "AWS_CERT": cert,
+			},
+		},
+		{
+			name: "env file",
+			file: "# longhorn backup target secret\n" +
+				"AWS_ACCESS_KEY_ID=AKIDTEST\n" +
+				"export AWS_SECRET_ACCESS_KEY='secret'\n" +
+				"AWS_ENDPOINTS=" + server.URL + "\n" +
+				"AWS_CERT=" + strconv.Quote(cert) + "\n" +
+				"VIRTUAL_HOSTED_STYLE=false\n",
+		},
+		{
+			name: "secret directory",
+			dir: map[string]string{
+				"AWS_ACCESS_KEY_ID": "AKIDTEST\n", "AWS_SECRET_ACCESS_KEY": "secret",
+				"AWS_ENDPOINTS": "https://minio.invalid", "AWS_CERT": cert,
+			},
+			endpoint: server.URL,
+		},
+		{
+			name: "file over environment",
+			env: map[string]string{
+				"AWS_ACCESS_KEY_ID": "AKIDENV", "AWS_SECRET_ACCESS_KEY": "secret",
+				"AWS_ENDPOINTS": "https://minio.invalid", "AWS_CERT": "not a certificate",
+			},
+			file: "AWS_ACCESS_KEY_ID=AKIDTEST\nAWS_SECRET_ACCESS_KEY=secret\nAWS_ENDPOINTS=" + server.URL + "\nAWS_CERT=" + strconv.Quote(cert) + "\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearAWSEnv(t)
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			opts := storeOptions{S3Endpoint: tt.endpoint}
+			if tt.file != "" {
+				opts.CredentialFile = filepath.Join(t.TempDir(), "longhorn.env")
+				if err := os.WriteFile(opts.CredentialFile, []byte(tt.file), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.dir != nil {
+				opts.CredentialFile = t.TempDir()
+				for key, value := range tt.dir {
+					if err := os.WriteFile(filepath.Join(opts.CredentialFile, key), []byte(value), 0600); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			mu.Lock()
+			requests = nil
+			mu.Unlock()
+
+			store, _, err := openBackupStore(context.Background(), "s3://longhorn-backups@us-east-1/cluster", opts)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			data, err := fs.ReadFile(store, "volumes/backup.cfg")
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if string(data) != "backup" {
+				t.Errorf("Expected backup, got %q", data)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(requests) != 1 {
+				t.Fatalf("Expected 1 request, got %d", len(requests))
+			}
+			// path-style addressing, signed with the key of the secret
+			if expected := "/longhorn-backups/cluster/backupstore/volumes/backup.cfg"; requests[0].URL.Path != expected {
+				t.Errorf("Expected %s, got %s", expected, requests[0].URL.Path)
+			}
+			if auth := requests[0].Header.Get("Authorization"); !strings.Contains(auth, "Credential=AKIDTEST/") {
+				t.Errorf("Expected a request signed with AKIDTEST, got %q", auth)
+			}
+		})
+	}
+}
+
+func TestS3ClientOptions(t *testing.T) {
+	tests := []struct {
+		name               string
+		endpoint           string
+		virtualHostedStyle bool
+		expectedPathStyle  bool
+	}{
+		{name: "AWS", expectedPathStyle: false},
+		{name: "endpoint", endpoint: "https://minio:9000", expectedPathStyle: true},
+		{name: "endpoint with virtual-hosted style", endpoint: "https://minio:9000", virtualHostedStyle: true, expectedPathStyle: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var o s3.Options
+			s3ClientOptions(tt.endpoint, tt.virtualHostedStyle)(&o)
+			if aws.ToString(o.BaseEndpoint) != tt.endpoint {
+				t.Errorf("Expected endpoint %q, got %q", tt.endpoint, aws.ToString(o.BaseEndpoint))
+			}
+			if o.UsePathStyle != tt.expectedPathStyle {
+				t.Errorf("Expected path-style %v, got %v", tt.expectedPathStyle, o.UsePathStyle)
+			}
+		})
+	}
+}
+
+func TestLoadS3Secret(t *testing.T) {
+	env := map[string]string{"VIRTUAL_HOSTED_STYLE": "true", "AWS_ENDPOINTS": "https://minio:9000"}
+	secret, err := loadS3Secret("", func(key string) string { return env[key] })
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !secret.virtualHostedStyle || secret.endpoint != "https://minio:9000" {
+		t.Errorf("Expected virtual-hosted style against https://minio:9000, got %+v", secret)
+	}
+
+	env["VIRTUAL_HOSTED_STYLE"] = "sometimes"
+	if _, err := loadS3Secret("", func(key string) string { return env[key] }); err == nil {
+		t.Error("Expected error for an invalid VIRTUAL_HOSTED_STYLE")
+	}
+
+	file := filepath.Join(t.TempDir(), "longhorn.env")
+	if err := os.WriteFile(file, []byte("AWS_ACCESS_KEY_ID=AKIDTEST\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadS3Secret(file, func(string) string { return "" }); err == nil || !strings.Contains(err.Error(), "needs both AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY") {
+		t.Errorf("Expected error for a secret without AWS_SECRET_ACCESS_KEY, got %v", err)
+	}
+}
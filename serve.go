@@ -0,0 +1,549 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+)
+
+// States of a serveJob
+const (
+	jobRunning   = "running"
+	jobDone      = "done"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+// jobRequest is the body of POST /jobs, a restore of a single volume into
+// Outfile, or streamed as the response when Stream is set
+type jobRequest struct {
+	Target            string `json:"target"`
+	Backup            string `json:"backup"`
+	Before            string `json:"before"`
+	Latest            bool   `json:"latest"`
+	IncludeIncomplete bool   `json:"include_incomplete"`
+	Outfile           string `json:"outfile"`
+	Stream            bool   `json:"stream"`
+	Overwrite         bool   `json:"overwrite"`
+}
+
+// jobProgress is where a job is, taken from the progress events of its
+// restore, which use the same names
+type jobProgress struct {
+	Pass         int   `json:"pass"`
+	TotalPasses  int   `json:"total_passes"`
+	Block        int   `json:"block"`
+	TotalBlocks  int   `json:"total_blocks"`
+	BytesWritten int64 `json:"bytes_written"`
+	ImageSize    int64 `json:"image_size"`
+}
+
+// jobStatus is what GET /jobs/{id} answers. Summary has the counters of
+// the summary repack prints, once the restore succeeded, and Output the
+// lines repack would have printed.
+type jobStatus struct {
+	ID       string           `json:"id"`
+	Target   string           `json:"target"`
+	Backup   string           `json:"backup,omitempty"`
+	Outfile  string           `json:"outfile"`
+	State    string           `json:"state"`
+	Started  time.Time        `json:"started"`
+	Finished *time.Time       `json:"finished,omitempty"`
+	ExitCode *int             `json:"exit_code,omitempty"`
+	Error    string           `json:"error,omitempty"`
+	Progress jobProgress      `json:"progress"`
+	Summary  *progressSummary `json:"summary,omitempty"`
+	Output   string           `json:"output"`
+}
+
+// serveJob is a restore started over HTTP, run in the background like a
+// target of repack, or for the request when it is streamed
+type serveJob struct {
+	mu     sync.Mutex
+	status jobStatus
+	output strings.Builder
+	cancel context.CancelFunc
+}
+
+func (j *serveJob) snapshot() jobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	status := j.status
+	status.Output = j.output.String()
+	return status
+}
+
+func (j *serveJob) running() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status.State == jobRunning
+}
+
+// Write collects the output of the restore
+func (j *serveJob) Write(p []byte) (int, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.output.Write(p)
+}
+
+// finish records the exit status of the restore. A restore that went on
+// despite damaged blocks is done, its exit status telling which, and one
+// interrupted by cancelling its context was cancelled rather than failed.
+func (j *serveJob) finish(code int, cancelled bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	finished := time.Now()
+	j.status.Finished, j.status.ExitCode = &finished, &code
+	switch {
+	case code == 0, code == exitChecksumMismatch, code == exitDegraded:
+		j.status.State = jobDone
+	case code == exitInterrupted && cancelled:
+		j.status.State = jobCancelled
+	default:
+		j.status.State = jobFailed
+	}
+	if j.status.State == jobFailed && j.status.Error == "" {
+		// the restore failed before it started, so its output says why,
+		// on the last Error line if it has one
+		lines := strings.Split(strings.TrimSpace(j.output.String()), "\n")
+		j.status.Error = lines[len(lines)-1]
+		for _, line := range slices.Backward(lines) {
+			if reason, ok := strings.CutPrefix(line, "Error: "); ok {
+				j.status.Error = reason
+				break
+			}
+		}
+	}
+}
+
+// jobEvents reads the progress events of the restore of a job, one JSON
+// object per write, into its status
+type jobEvents struct {
+	job *serveJob
+}
+
+func (e jobEvents) Write(p []byte) (int, error) {
+	var event struct {
+		Error   string           `json:"error"`
+		Summary *progressSummary `json:"summary"`
+	}
+	if err := json.Unmarshal(p, &event); err != nil {
+		return 0, err
+	}
+	e.job.mu.Lock()
+	defer e.job.mu.Unlock()
+	// each event only has the fields it changes
+	if err := json.Unmarshal(p, &e.job.status.Progress); err != nil {
+		return 0, err
+	}
+	e.job.status.Error = event.Error
+	if event.Summary != nil {
+		e.job.status.Summary = event.Summary
+	}
+	return len(p), nil
+}
+
+// streamedImage is the response body of a streamed job. The headers of
+// a successful response go out with the first bytes of the image, so a
+// restore failing before it writes any can still answer with an error.
+type streamedImage struct {
+	w       http.ResponseWriter
+	written int64
+}
+
+func (s *streamedImage) Write(p []byte) (int, error) {
+	if s.written == 0 {
+		s.w.Header().Set("Content-Type", "application/octet-stream")
+		s.w.WriteHeader(http.StatusOK)
+	}
+	n, err := s.w.Write(p)
+	s.written += int64(n)
+	return n, err
+}
+
+// Close leaves the end of the response to the handler
+func (s *streamedImage) Close() error {
+	return nil
+}
+
+// apiError is the body of a response that failed
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// server answers the HTTP API of serve, restoring with the settings of
+// in, which every job shares along with its cache, memory and limits
+type server struct {
+	in    *invocation
+	token string
+	// dest is the directory the outfiles of jobs are in
+	dest string
+
+	mu     sync.Mutex
+	jobs   []*serveJob
+	nextID int
+	// running are the background jobs, which shutting down waits for
+	running sync.WaitGroup
+}
+
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /volumes", s.listVolumes)
+	mux.HandleFunc("GET /volumes/{volume}", s.describeVolume)
+	mux.HandleFunc("GET /volumes/{volume}/backups", s.listBackups)
+	mux.HandleFunc("GET /jobs", s.listJobs)
+	mux.HandleFunc("POST /jobs", s.startJob)
+	mux.HandleFunc("GET /jobs/{id}", s.getJob)
+	mux.HandleFunc("DELETE /jobs/{id}", s.cancelJob)
+	return s.authorize(mux)
+}
+
+// authorize lets through the requests with the bearer token of s
+func (s *server) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, errors.New("a valid bearer token is required"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, apiError{Error: err.Error()})
+}
+
+// httpStatus is the status of a response failing with the exit status
+// repack would have exited with
+func httpStatus(code int) int {
+	switch code {
+	case exitUsage:
+		return http.StatusBadRequest
+	case exitVolumeNotFound:
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+// errorStatus is httpStatus for err, counting a volume name matching
+// several volumes as a bad request, as -target does
+func errorStatus(err error) int {
+	var ambiguous *ambiguousTargetError
+	if errors.As(err, &ambiguous) {
+		return http.StatusBadRequest
+	}
+	return httpStatus(exitCode(err))
+}
+
+// findVolume resolves name the way -target does, to a single volume, and
+// returns its name and directory
+func (s *server) findVolume(name string) (string, string, error) {
+	targets, dirs, err := resolveTargets(s.in.store, []string{name}, false)
+	if err != nil {
+		return "", "", err
+	}
+	dir, ok := dirs[targets[0]]
+	if !ok {
+		dir, err = backupstore.FindVolumeBackupPath(s.in.store, targets[0])
+	}
+	return targets[0], dir, err
+}
+
+// readVolume reads the backups of the volume in the path of r, including
+// the incomplete ones with ?include-incomplete=true, or answers why not
+func (s *server) readVolume(w http.ResponseWriter, r *http.Request) (*backupstore.VolumeBackup, bool) {
+	_, dir, err := s.findVolume(r.PathValue("volume"))
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return nil, false
+	}
+	volume, err := backupstore.ReadBackups(s.in.store, dir)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return nil, false
+	}
+	if r.URL.Query().Get("include-incomplete") == "true" {
+		volume.IncludeIncomplete()
+	}
+	return volume, true
+}
+
+// listVolumes answers GET /volumes like list-volumes -output json
+func (s *server) listVolumes(w http.ResponseWriter, r *http.Request) {
+	volumes, err := backupstore.ListVolumes(s.in.store)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, listVolumes(s.in.store, volumes, path.Base))
+}
+
+// listBackups answers GET /volumes/{volume}/backups like list-backups
+// -output json
+func (s *server) listBackups(w http.ResponseWriter, r *http.Request) {
+	volume, ok := s.readVolume(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	printBackupList(w, volume.Backups, "json")
+}
+
+// describeVolume answers GET /volumes/{volume} like describe -output
+// json, or describe -fast with ?fast=true
+func (s *server) describeVolume(w http.ResponseWriter, r *http.Request) {
+	volume, ok := s.readVolume(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	printDescription(w, describeChain(s.in.store, volume, r.URL.Query().Get("fast") == "true"), "json")
+}
+
+func (s *server) listJobs(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	statuses := make([]jobStatus, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		statuses = append(statuses, job.snapshot())
+	}
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+func (s *server) job(id string) *serveJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := slices.IndexFunc(s.jobs, func(job *serveJob) bool {
+		return job.status.ID == id
+	})
+	if i < 0 {
+		return nil
+	}
+	return s.jobs[i]
+}
+
+func (s *server) getJob(w http.ResponseWriter, r *http.Request) {
+	job := s.job(r.PathValue("id"))
+	if job == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no job %s", r.PathValue("id")))
+		return
+	}
+	writeJSON(w, http.StatusOK, job.snapshot())
+}
+
+// cancelJob interrupts a running job, which lets the blocks being
+// written finish like the first interrupt of repack does
+func (s *server) cancelJob(w http.ResponseWriter, r *http.Request) {
+	job := s.job(r.PathValue("id"))
+	switch {
+	case job == nil:
+		writeError(w, http.StatusNotFound, fmt.Errorf("no job %s", r.PathValue("id")))
+		return
+	case !job.running():
+		writeError(w, http.StatusConflict, fmt.Errorf("job %s has already finished", r.PathValue("id")))
+		return
+	}
+	job.cancel()
+	writeJSON(w, http.StatusAccepted, job.snapshot())
+}
+
+// startJob answers POST /jobs, starting a restore in the background and
+// answering with its status, or streaming the image as the response
+func (s *server) startJob(w http.ResponseWriter, r *http.Request) {
+	var req jobRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid job: %w", err))
+		return
+	}
+	var invalid string
+	switch {
+	case req.Target == "":
+		invalid = "target is required"
+	case req.Stream && req.Outfile != "":
+		invalid = "outfile and stream are mutually exclusive"
+	case !req.Stream && req.Outfile == "":
+		invalid = "outfile or stream is required"
+	case req.Outfile != "" && !filepath.IsLocal(req.Outfile):
+		invalid = "outfile must be a relative path within the -dest of the server"
+	case req.Stream && *s.in.o.outputFormat != "raw":
+		invalid = "streaming only supports the raw output format"
+	}
+	if invalid != "" {
+		writeError(w, http.StatusBadRequest, errors.New(invalid))
+		return
+	}
+	if req.Before != "" {
+		if _, err := parseBeforeTime(req.Before); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid before: %w", err))
+			return
+		}
+	}
+	target, dir, err := s.findVolume(req.Target)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+
+	outfile := "-"
+	if !req.Stream {
+		outfile = filepath.Join(s.dest, req.Outfile)
+		if _, err := os.Stat(outfile); err == nil && !req.Overwrite {
+			writeError(w, http.StatusConflict, fmt.Errorf("%s already exists, set overwrite to replace it", req.Outfile))
+			return
+		}
+	}
+	ctx := context.Background()
+	if req.Stream {
+		// a client that goes away cancels the restore
+		ctx = r.Context()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	job, err := s.addJob(target, req.Backup, outfile, cancel)
+	if err != nil {
+		cancel()
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	s.in.log.Info(fmt.Sprintf("Job %s: restoring %s into %s", job.status.ID, target, outfile))
+
+	run := s.jobInvocation(ctx, job, req, dir)
+	if !req.Stream {
+		s.running.Add(1)
+		go func() {
+			defer s.running.Done()
+			defer cancel()
+			s.finishJob(ctx, job, run.run(target, outfile))
+		}()
+		w.Header().Set("Location", "/jobs/"+job.status.ID)
+		writeJSON(w, http.StatusAccepted, job.snapshot())
+		return
+	}
+
+	defer cancel()
+	w.Header().Set("X-Job-ID", job.status.ID)
+	body := &streamedImage{w: w}
+	run.imageOut = body
+	code := run.run(target, outfile)
+	s.finishJob(ctx, job, code)
+	switch status := job.snapshot(); {
+	case status.State == jobDone:
+	case body.written == 0:
+		writeError(w, httpStatus(code), errors.New(cmp.Or(status.Error, status.State)))
+	default:
+		// the status has been sent, so the image is cut off instead of
+		// ending as if it were whole
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// addJob records a job restoring target into outfile, unless a running
+// job is writing the same file
+func (s *server) addJob(target, backup, outfile string, cancel context.CancelFunc) (*serveJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, job := range s.jobs {
+		if outfile != "-" && job.running() && job.status.Outfile == outfile {
+			return nil, fmt.Errorf("job %s is already restoring into %s", job.status.ID, outfile)
+		}
+	}
+	s.nextID++
+	job := &serveJob{cancel: cancel, status: jobStatus{
+		ID:      strconv.Itoa(s.nextID),
+		Target:  target,
+		Backup:  backup,
+		Outfile: outfile,
+		State:   jobRunning,
+		Started: time.Now(),
+	}}
+	s.jobs = append(s.jobs, job)
+	return job, nil
+}
+
+func (s *server) finishJob(ctx context.Context, job *serveJob, code int) {
+	job.finish(code, ctx.Err() != nil)
+	s.in.log.Info(fmt.Sprintf("Job %s: %s with exit status %d", job.status.ID, job.snapshot().State, code))
+}
+
+// jobInvocation is the invocation repack would run for the restore of
+// req, writing its output and progress into job
+func (s *server) jobInvocation(ctx context.Context, job *serveJob, req jobRequest, dir string) *invocation {
+	o := *s.in.o
+	o.backupName, o.before, o.latest = &req.Backup, &req.Before, &req.Latest
+	o.includeIncomplete, o.yes = &req.IncludeIncomplete, &req.Overwrite
+	run := *s.in
+	run.o = &o
+	run.out, run.progress = job, job
+	// whatever -log-format says, as the error of a job is read back from
+	// its text
+	run.log = newLogger(job, "text", slog.LevelInfo)
+	run.events = newProgressReporter(jobEvents{job: job})
+	run.volumeDirs = map[string]string{job.status.Target: dir}
+	run.ctx = ctx
+	return &run
+}
+
+// serve answers the HTTP API on listen until interrupted, which cancels
+// the running jobs and waits for them, and returns the exit status
+func (in *invocation) serve(listen, token, dest string) int {
+	s := &server{in: in, token: token, dest: dest}
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		in.log.Error(fmt.Sprintf("Failed to listen on %s", listen), "error", err)
+		return exitFailure
+	}
+	srv := &http.Server{Handler: s.handler(), ReadHeaderTimeout: 30 * time.Second}
+	in.log.Info(fmt.Sprintf("Serving %s on http://%s", in.backupStorePath, listener.Addr()))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(listener)
+	}()
+	select {
+	case err := <-served:
+		in.log.Error(fmt.Sprintf("Failed to serve on %s", listen), "error", err)
+		return exitFailure
+	case <-ctx.Done():
+	}
+
+	in.log.Info("Interrupted, cancelling the running jobs")
+	s.mu.Lock()
+	for _, job := range s.jobs {
+		job.cancel()
+	}
+	s.mu.Unlock()
+	srv.Shutdown(context.Background())
+	s.running.Wait()
+	return 0
+}
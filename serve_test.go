@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestServer serves the fixture backupstore, restoring into a temporary
+// directory with the default flags
+func newTestServer(t *testing.T) (*httptest.Server, string) {
+	t.Helper()
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	o := defineFlags(flags)
+	repack, _ := lookupCommand("repack")
+	dest := t.TempDir()
+	s := &server{
+		in: &invocation{
+			o:               o,
+			cmd:             &repack,
+			store:           os.DirFS("testdata/restore/backupstore"),
+			backupStorePath: "testdata/restore/backupstore",
+			level:           verbosityQuiet,
+			out:             io.Discard,
+			log:             newLogger(io.Discard, "text", slog.LevelInfo),
+		},
+		token: "secret",
+		dest:  dest,
+	}
+	ts := httptest.NewServer(s.handler())
+	t.Cleanup(ts.Close)
+	return ts, dest
+}
+
+func serveRequest(t *testing.T, ts *httptest.Server, method, path, body string) (*http.Response, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return resp, data
+}
+
+func TestServeListing(t *testing.T) {
+	ts, _ := newTestServer(t)
+
+	resp, err := ts.Client().Get(ts.URL + "/volumes")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected a request without the token to be refused, got %s", resp.Status)
+	}
+
+	tests := []struct {
+		path     string
+		status   int
+		expected string
+	}{
+		{"/volumes", http.StatusOK, `"name": "pvc-fixture"`},
+		{"/volumes/fixture/backups", http.StatusOK, `"name": "backup-1"`},
+		{"/volumes/pvc-fixture?fast=true", http.StatusOK, `"volumeSize": 8192`},
+		{"/volumes/pvc-404", http.StatusNotFound, `"error":`},
+	}
+	for _, tt := range tests {
+		resp, body := serveRequest(t, ts, "GET", tt.path, "")
+		if resp.StatusCode != tt.status || !bytes.Contains(body, []byte(tt.expected)) {
+			t.Errorf("Expected %d with %s for %s, got %s: %s", tt.status, tt.expected, tt.path, resp.Status, body)
+		}
+	}
+}
+
+func TestServeJobs(t *testing.T) {
+	ts, dest := newTestServer(t)
+
+	resp, image := serveRequest(t, ts, "POST", "/jobs", `{"target": "pvc-fixture", "stream": true}`)
+	if resp.StatusCode != http.StatusOK || len(image) != 8192 || resp.Header.Get("X-Job-ID") != "1" {
+		t.Fatalf("Expected the 8192 byte image of job 1, got %s with %d bytes", resp.Status, len(image))
+	}
+
+	resp, body := serveRequest(t, ts, "POST", "/jobs", `{"target": "pvc-fixture", "outfile": "pvc-fixture.img"}`)
+	if resp.StatusCode != http.StatusAccepted || resp.Header.Get("Location") != "/jobs/2" {
+		t.Fatalf("Expected job 2 to be started, got %s: %s", resp.Status, body)
+	}
+	var status jobStatus
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		_, body = serveRequest(t, ts, "GET", "/jobs/2", "")
+		if err := json.Unmarshal(body, &status); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if status.State != jobRunning || time.Now().After(deadline) {
+			break
+		}
+	}
+	if status.State != jobDone || *status.ExitCode != 0 || status.Summary == nil || status.Summary.BlocksRead != 2 || status.Progress.BytesWritten != 8192 {
+		t.Fatalf("Expected job 2 to restore 2 blocks, got %s", body)
+	}
+	written, err := os.ReadFile(filepath.Join(dest, "pvc-fixture.img"))
+	if err != nil || !bytes.Equal(written, image) {
+		t.Errorf("Expected the file to match the streamed image (%v)", err)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"existing outfile", "POST", "/jobs", `{"target": "pvc-fixture", "outfile": "pvc-fixture.img"}`, http.StatusConflict},
+		{"outfile outside dest", "POST", "/jobs", `{"target": "pvc-fixture", "outfile": "../pvc-fixture.img"}`, http.StatusBadRequest},
+		{"no output", "POST", "/jobs", `{"target": "pvc-fixture"}`, http.StatusBadRequest},
+		{"unknown field", "POST", "/jobs", `{"target": "pvc-fixture", "stream": true, "bakup": "backup-1"}`, http.StatusBadRequest},
+		{"missing volume", "POST", "/jobs", `{"target": "pvc-404", "stream": true}`, http.StatusNotFound},
+		{"missing backup", "POST", "/jobs", `{"target": "pvc-fixture", "stream": true, "backup": "backup-404"}`, http.StatusNotFound},
+		{"cancel finished", "DELETE", "/jobs/2", "", http.StatusConflict},
+		{"cancel missing", "DELETE", "/jobs/404", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := serveRequest(t, ts, tt.method, tt.path, tt.body)
+			if resp.StatusCode != tt.status {
+				t.Errorf("Expected %d, got %s: %s", tt.status, resp.Status, body)
+			}
+		})
+	}
+
+	// the failed stream is listed with why it failed
+	_, body = serveRequest(t, ts, "GET", "/jobs", "")
+	var statuses []jobStatus
+	if err := json.Unmarshal(body, &statuses); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(statuses) != 3 || statuses[2].State != jobFailed || statuses[2].Error != "could not find backup backup-404" {
+		t.Errorf("Expected the third job to have failed for its backup, got %s", body)
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const sftpAttempts = 4
+
+// sftpStore reads a backupstore over SFTP. The SSH connection is shared by
+// all readers, with at most streams files being fetched at a time, and is
+// redialed if it drops.
+type sftpStore struct {
+	retryCounter
+	mu      sync.Mutex
+	ctx     context.Context
+	dial    func() (*sftp.Client, error)
+	client  *sftp.Client
+	streams chan struct{}
+	root    string
+	url     string
+	backoff time.Duration
+}
+
+// parseSFTPURL splits sftp://user@host[:port]/path, defaulting to port 22
+// and the current user
+func parseSFTPURL(raw string) (username, addr, dir string, err error) {
+	rest, ok := strings.CutPrefix(raw, "sftp://")
+	if !ok {
+		return "", "", "", fmt.Errorf("not an sftp url: %s", raw)
+	}
+	addr, dir, _ = strings.Cut(rest, "/")
+	if at := strings.LastIndex(addr, "@"); at >= 0 {
+		username, addr = addr[:at], addr[at+1:]
+	}
+	if addr == "" {
+		return "", "", "", fmt.Errorf("missing host in %s", raw)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), "22")
+	}
+	if username == "" {
+		current, err := user.Current()
+		if err != nil {
+			return "", "", "", fmt.Errorf("no user in %s: %w", raw, err)
+		}
+		username = current.Username
+	}
+	return username, addr, path.Clean("/" + dir), nil
+}
+
+// sshAuthMethods offers the key passed with -ssh-key and any keys held by
+// a running ssh-agent
+func sshAuthMethods(keyFile string) ([]ssh.AuthMethod, error) {
+	methods := make([]ssh.AuthMethod, 0, 2)
+	if keyFile != "" {
+		pem, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(pem)
+		var missing *ssh.PassphraseMissingError
+		if errors.As(err, &missing) {
+			return nil, fmt.Errorf("%s is passphrase protected, add it to ssh-agent instead", keyFile)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", keyFile, err)
+		}
+		methods = append(methods, ssh.PublicKeys(signer))
+	}
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to ssh-agent: %w", err)
+		}
+		methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+	}
+	if len(methods) == 0 {
+		return nil, errors.New("no SSH credentials, pass -ssh-key or start an ssh-agent")
+	}
+	return methods, nil
+}
+
+func sshHostKeyCallback(opts storeOptions) (ssh.HostKeyCallback, error) {
+	if opts.SSHSkipHostKeyCheck {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+	knownHosts := opts.SSHKnownHosts
+	if knownHosts == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		knownHosts = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	return knownhosts.New(knownHosts)
+}
+
+func newSFTPStore(ctx context.Context, backupRoot string, opts storeOptions) (*sftpStore, error) {
+	username, addr, dir, err := parseSFTPURL(backupRoot)
+	if err != nil {
+		return nil, err
+	}
+	auth, err := sshAuthMethods(opts.SSHKey)
+	if err != nil {
+		return nil, err
+	}
+	hostKeyCallback, err := sshHostKeyCallback(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load known hosts: %w", err)
+	}
+	config := &ssh.ClientConfig{
+		User:            username,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	}
+
+	store := &sftpStore{
+		ctx: ctx,
+		dial: func() (*sftp.Client, error) {
+			conn, err := ssh.Dial("tcp", addr, config)
+			if err != nil {
+				return nil, err
+			}
+			client, err := sftp.NewClient(conn)
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return client, nil
+		},
+		streams: make(chan struct{}, max(opts.SFTPStreams, 1)),
+		root:    path.Join(dir, "backupstore"),
+		url:     "sftp://" + username + "@" + addr + path.Join(dir, "backupstore"),
+		backoff: 500 * time.Millisecond,
+	}
+	// fail early on unreachable hosts, unknown host keys and rejected keys
+	if _, err := store.connect(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (s *sftpStore) String() string {
+	return s.url
+}
+
+// Remote implements backupstore.RemoteFS, so missing blocks aren't
+// searched for
+func (s *sftpStore) Remote() bool { return true }
+
+// sftpTransient reports a dropped connection or a network failure
+func sftpTransient(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, sftp.ErrSSHFxConnectionLost) ||
+		errors.As(err, &netErr) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+func (s *sftpStore) connect() (*sftp.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client == nil {
+		client, err := s.dial()
+		if err != nil {
+			return nil, err
+		}
+		s.client = client
+	}
+	return s.client, nil
+}
+
+// withClient runs op with the shared client. Unlike NFS, SFTP requests are
+// multiplexed, so callers only wait for a free stream; after a connection
+// loss the first caller to notice drops the client and the next attempt
+// redials.
+func (s *sftpStore) withClient(op func(client *sftp.Client) error) error {
+	select {
+	case s.streams <- struct{}{}:
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+	defer func() { <-s.streams }()
+
+	return s.retryBackoff(s.ctx, sftpAttempts, s.backoff, func() error {
+		client, err := s.connect()
+		if err != nil {
+			return err
+		}
+		err = op(client)
+		if err != nil && sftpTransient(err) {
+			s.mu.Lock()
+			if s.client == client {
+				s.client.Close()
+				s.client = nil
+			}
+			s.mu.Unlock()
+		}
+		return err
+	}, sftpTransient)
+}
+
+func (s *sftpStore) path(name string) string {
+	return path.Join(s.root, name)
+}
+
+func (s *sftpStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client == nil {
+		return nil
+	}
+	err := s.client.Close()
+	s.client = nil
+	return err
+}
+
+func (s *sftpStore) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	var info fs.FileInfo
+	err := s.withClient(func(client *sftp.Client) error {
+		var err error
+		info, err = client.Stat(s.path(name))
+		return err
+	})
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return info, nil
+}
+
+func (s *sftpStore) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	var infos []os.FileInfo
+	err := s.withClient(func(client *sftp.Client) error {
+		var err error
+		infos, err = client.ReadDir(s.path(name))
+		return err
+	})
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+
+	entries := make([]fs.DirEntry, 0, len(infos))
+	for _, info := range infos {
+		entries = append(entries, fs.FileInfoToDirEntry(info))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+func (s *sftpStore) ReadFile(name string) ([]byte, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrInvalid}
+	}
+	var data []byte
+	err := s.withClient(func(client *sftp.Client) error {
+		f, err := client.Open(s.path(name))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		data, err = io.ReadAll(f)
+		return err
+	})
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	return data, nil
+}
+
+func (s *sftpStore) Open(name string) (fs.File, error) {
+	return openRemote(s, name)
+}
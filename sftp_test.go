@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// fakeSSHServer serves the local filesystem over SFTP to a single client key
+type fakeSSHServer struct {
+	addr    string
+	hostKey ssh.PublicKey
+
+	mu    sync.Mutex
+	conns []net.Conn
+	dials int
+}
+
+func newTestSSHKey(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func startFakeSSHServer(t *testing.T, clientKey ssh.PublicKey) *fakeSSHServer {
+	t.Helper()
+	hostKey := newTestSSHKey(t)
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), clientKey.Marshal()) {
+				return nil, errors.New("key not authorized")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &fakeSSHServer{addr: listener.Addr().String(), hostKey: hostKey.PublicKey()}
+	t.Cleanup(func() {
+		listener.Close()
+		server.drop()
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server.mu.Lock()
+			server.conns = append(server.conns, conn)
+			server.dials++
+			server.mu.Unlock()
+			go server.serve(conn, config)
+		}
+	}()
+	return server
+}
+
+func (s *fakeSSHServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unsupported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				// the payload is the length prefixed subsystem name
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					server, err := sftp.NewServer(channel, sftp.ReadOnly())
+					if err != nil {
+						channel.Close()
+						return
+					}
+					go func() {
+						server.Serve()
+						server.Close()
+					}()
+				}
+			}
+		}()
+	}
+}
+
+func (s *fakeSSHServer) connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dials
+}
+
+// drop closes every connection, as a server restart or network failure would
+func (s *fakeSSHServer) drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+func (s *fakeSSHServer) knownHosts(t *testing.T) string {
+	t.Helper()
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(s.addr)}, s.hostKey)
+	if err := os.WriteFile(knownHosts, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return knownHosts
+}
+
+func writeTestSSHKey(t *testing.T) (string, ssh.Signer) {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyFile, signer
+}
+
+func TestParseSFTPURL(t *testing.T) {
+	tests := []struct {
+		url           string
+		user          string
+		addr          string
+		dir           string
+		expectedError bool
+	}{
+		{url: "sftp://backup@nas/srv/longhorn", user: "backup", addr: "nas:22", dir: "/srv/longhorn"},
+		{url: "sftp://backup@nas:2222/srv/longhorn/", user: "backup", addr: "nas:2222", dir: "/srv/longhorn"},
+		{url: "sftp://backup@[::1]:2222/", user: "backup", addr: "[::1]:2222", dir: "/"},
+		{url: "sftp://backup@/srv", expectedError: true},
+		{url: "nfs://nas:/srv", expectedError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			user, addr, dir, err := parseSFTPURL(tt.url)
+			if tt.expectedError {
+				if err == nil {
+					t.Error("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if user != tt.user || addr != tt.addr || dir != tt.dir {
+				t.Errorf("Expected %s@%s%s, got %s@%s%s", tt.user, tt.addr, tt.dir, user, addr, dir)
+			}
+		})
+	}
+}
+
+func TestSFTPStoreRestore(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	root := t.TempDir()
+	volumePath := filepath.Join(root, "backupstore", "volumes", "5f", "a2", "pvc-123")
+	if err := os.MkdirAll(filepath.Join(volumePath, "backups"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	blockSize := 4096
+	first := writeTestBlock(t, volumePath, testBlockData(1, blockSize))
+	second := writeTestBlock(t, volumePath, testBlockData(2, blockSize))
+	cfg := `{"CreatedTime": "2024-01-01T00:00:00Z", "Size": "8192", "CompressionMethod": "lz4", "BlockSize": "4096",
+		"Blocks": [{"Offset": 0, "BlockChecksum": "` + first + `"}, {"Offset": 4096, "BlockChecksum": "` + second + `"}]}`
+	if err := os.WriteFile(filepath.Join(volumePath, "backups", "backup_backup-1.cfg"), []byte(cfg), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	keyFile, signer := writeTestSSHKey(t)
+	server := startFakeSSHServer(t, signer.PublicKey())
+	store, backupStorePath, err := openBackupStore(context.Background(), "sftp://backup@"+server.addr+root, storeOptions{
+		SSHKey:        keyFile,
+		SSHKnownHosts: server.knownHosts(t),
+		SFTPStreams:   2,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer store.(*sftpStore).Close()
+	if backupStorePath != "sftp://backup@"+server.addr+root+"/backupstore" {
+		t.Errorf("Unexpected backupstore path %s", backupStorePath)
+	}
+
+	volumes, err := backupstore.ListVolumes(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(volumes) != 1 || volumes[0] != "volumes/5f/a2/pvc-123" {
+		t.Errorf("Expected the pvc-123 volume, got %v", volumes)
+	}
+
+	volumeBackupPath, err := backupstore.FindVolumeBackupPath(store, "pvc-123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeBackup, err := backupstore.ReadBackups(store, volumeBackupPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(volumeBackup.Backups) != 1 {
+		t.Fatalf("Expected 1 backup, got %d", len(volumeBackup.Backups))
+	}
+
+	out, err := os.Create(filepath.Join(t.TempDir(), "out.raw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	err = backupstore.Repack(context.Background(), store, volumeBackup.BackupPath, volumeBackup.Backups, out, backupstore.RepackOptions{Jobs: 4})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	content, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, append(testBlockData(1, blockSize), testBlockData(2, blockSize)...)) {
+		t.Error("Restored image does not match expected content")
+	}
+	if server.connections() != 1 {
+		t.Errorf("Expected the connection to be reused, got %d connections", server.connections())
+	}
+}
+
+func TestSFTPStoreHostKey(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	keyFile, signer := writeTestSSHKey(t)
+	server := startFakeSSHServer(t, signer.PublicKey())
+	otherServer := startFakeSSHServer(t, signer.PublicKey())
+	backupRoot := "sftp://backup@" + server.addr + t.TempDir()
+
+	// a known_hosts entry for a different key under the same address
+	otherServer.addr = server.addr
+	_, err := newSFTPStore(context.Background(), backupRoot, storeOptions{
+		SSHKey:        keyFile,
+		SSHKnownHosts: otherServer.knownHosts(t),
+	})
+	if err == nil {
+		t.Error("Expected a host key mismatch to be rejected")
+	}
+
+	empty := filepath.Join(t.TempDir(), "known_hosts")
+	if err := os.WriteFile(empty, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = newSFTPStore(context.Background(), backupRoot, storeOptions{SSHKey: keyFile, SSHKnownHosts: empty})
+	if err == nil {
+		t.Error("Expected an unknown host to be rejected")
+	}
+
+	store, err := newSFTPStore(context.Background(), backupRoot, storeOptions{SSHKey: keyFile, SSHSkipHostKeyCheck: true})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	store.Close()
+
+	otherKey, _ := writeTestSSHKey(t)
+	_, err = newSFTPStore(context.Background(), backupRoot, storeOptions{SSHKey: otherKey, SSHKnownHosts: server.knownHosts(t)})
+	if err == nil {
+		t.Error("Expected an unauthorized key to be rejected")
+	}
+}
+
+func TestSFTPStoreAgent(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+		t.Fatal(err)
+	}
+	agentSigner, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := startFakeSSHServer(t, agentSigner.PublicKey())
+
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+	t.Setenv("SSH_AUTH_SOCK", socket)
+
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "backupstore"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "backupstore", "volume.cfg"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	store, err := newSFTPStore(context.Background(), "sftp://backup@"+server.addr+dir, storeOptions{
+		SSHKnownHosts: server.knownHosts(t),
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer store.Close()
+	data, err := store.ReadFile("volume.cfg")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if string(data) != "data" {
+		t.Errorf("Expected data, got %s", data)
+	}
+}
+
+func TestSFTPStoreReconnect(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "backupstore"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "backupstore", "volume.cfg"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	keyFile, signer := writeTestSSHKey(t)
+	server := startFakeSSHServer(t, signer.PublicKey())
+	store, err := newSFTPStore(context.Background(), "sftp://backup@"+server.addr+dir, storeOptions{
+		SSHKey:        keyFile,
+		SSHKnownHosts: server.knownHosts(t),
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer store.Close()
+	store.backoff = 0
+
+	server.drop()
+	data, err := store.ReadFile("volume.cfg")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if string(data) != "data" {
+		t.Errorf("Expected data, got %s", data)
+	}
+	if server.connections() != 2 {
+		t.Errorf("Expected 1 reconnect, got %d connections", server.connections())
+	}
+
+	if _, err := store.ReadFile("missing.cfg"); !os.IsNotExist(err) {
+		t.Errorf("Expected not exist error, got %v", err)
+	}
+}
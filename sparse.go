@@ -0,0 +1,141 @@
+package main
+
+import (
+	"os"
+	"sync"
+
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+)
+
+// sparseImage maps guest clusters to host clusters that are appended to the
+// file the first time they are written. Formats with allocation tables
+// (qcow2, vmdk) build on it and lay out their metadata when closed.
+type sparseImage struct {
+	mu          sync.Mutex
+	file        *os.File
+	clusterSize int64
+	clusters    map[int64]int64
+	next        int64
+	size        int64
+	written     int64
+}
+
+func newSparseImage(path string, clusterSize int64, reserved int64) (*sparseImage, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &sparseImage{
+		file:        file,
+		clusterSize: clusterSize,
+		clusters:    make(map[int64]int64),
+		next:        reserved,
+		size:        -1,
+	}, nil
+}
+
+func (s *sparseImage) WriteAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	total := 0
+	for len(p) > 0 {
+		guest := off / s.clusterSize
+		within := off % s.clusterSize
+		n := int(min(int64(len(p)), s.clusterSize-within))
+
+		host, ok := s.clusters[guest]
+		switch {
+		case ok:
+			if _, err := s.file.WriteAt(p[:n], host+within); err != nil {
+				return total, err
+			}
+		case backupstore.IsZeroBlock(p[:n]):
+			// unallocated clusters already read as zero
+		default:
+			cluster := make([]byte, s.clusterSize)
+			copy(cluster[within:], p[:n])
+			host = s.next
+			if _, err := s.file.WriteAt(cluster, host); err != nil {
+				return total, err
+			}
+			s.clusters[guest] = host
+			s.next += s.clusterSize
+		}
+
+		s.written = max(s.written, off+int64(n))
+		total += n
+		off += int64(n)
+		p = p[n:]
+	}
+	return total, nil
+}
+
+func (s *sparseImage) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	total := 0
+	for len(p) > 0 {
+		guest := off / s.clusterSize
+		within := off % s.clusterSize
+		n := int(min(int64(len(p)), s.clusterSize-within))
+
+		if host, ok := s.clusters[guest]; ok {
+			if _, err := s.file.ReadAt(p[:n], host+within); err != nil {
+				return total, err
+			}
+		} else {
+			clear(p[:n])
+		}
+
+		total += n
+		off += int64(n)
+		p = p[n:]
+	}
+	return total, nil
+}
+
+func (s *sparseImage) Truncate(size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.size = size
+	return nil
+}
+
+func (s *sparseImage) allocate(clusters int64) int64 {
+	offset := s.next
+	s.next += clusters * s.clusterSize
+	return offset
+}
+
+// finalSize returns the disk size rounded up to whole sectors and forgets
+// clusters written past it, returning their host offsets
+func (s *sparseImage) finalSize() (int64, map[int64]struct{}) {
+	size := s.size
+	if size < 0 {
+		size = s.written
+	}
+	size = (size + 511) &^ 511
+
+	guestClusters := (size + s.clusterSize - 1) / s.clusterSize
+	dropped := make(map[int64]struct{})
+	for guest, host := range s.clusters {
+		if guest >= guestClusters {
+			dropped[host] = struct{}{}
+			delete(s.clusters, guest)
+		}
+	}
+	return size, dropped
+}
+
+func (s *sparseImage) closeWith(finish func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := finish(); err != nil {
+		s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+)
+
+const (
+	ext4SuperblockOffset = 1024
+	ext4MagicOffset      = ext4SuperblockOffset + 0x38
+	ext4Magic            = 0xEF53
+)
+
+func superblockFromData(data []byte) (Superblock, error) {
+	if len(data) < ext4MagicOffset+2 {
+		return Superblock{}, errors.New("block too short to contain an ext4 superblock")
+	}
+	if binary.LittleEndian.Uint16(data[ext4MagicOffset:]) != ext4Magic {
+		return Superblock{}, errors.New("no ext4 superblock found")
+	}
+
+	var raw superblockRaw
+	err := binary.Read(bytes.NewReader(data[ext4SuperblockOffset:]), binary.LittleEndian, &raw)
+	if err != nil {
+		return Superblock{}, err
+	}
+	superblock := Superblock{
+		TotalBlocks: int(raw.SBlocksCount),
+		BlockSize:   int(1024 << raw.SLogBlockSize),
+	}
+	// s_uuid and s_volume_name follow the counters at 0x68 and 0x78
+	if len(data) >= ext4SuperblockOffset+0x88 {
+		superblock.UUID = formatUUID([16]byte(data[ext4SuperblockOffset+0x68:]))
+		superblock.Label = cString(data[ext4SuperblockOffset+0x78 : ext4SuperblockOffset+0x88])
+	}
+	return superblock, nil
+}
+
+var zeroPage [4096]byte
+
+func writeZeroes(w io.Writer, n int64) error {
+	for n > 0 {
+		chunk := min(n, int64(len(zeroPage)))
+		if _, err := w.Write(zeroPage[:chunk]); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+type loadedBlock struct {
+	data []byte
+	err  error
+}
+
+// streamBackups writes the restored image sequentially to w, which does not
+// need to be seekable. Blocks are emitted in offset order with gaps filled
+// with zeroes, and the image length comes from opts.VolumeSize, or the filesystem
+// or partition table found in the first block, rather than from truncating
+// afterwards. Cancelling ctx stops the stream after the block being
+// written.
+func streamBackups(ctx context.Context, store fs.FS, backupPath string, backups []backupstore.Backup, w io.Writer, opts restoreOptions) (int64, error) {
+	jobs := opts.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	progress := opts.Progress
+	if progress == nil {
+		progress = io.Discard
+	}
+
+	logger := opts.Logger
+	if logger == nil {
+		logger = slog.New(slog.DiscardHandler)
+	}
+	if err := backupstore.CheckBackups(backups, opts.VolumeSize, opts.Strict, logger); err != nil {
+		return 0, err
+	}
+
+	blocks := backupstore.FinalBlockMap(backups)
+	stats := opts.Stats
+	if stats == nil {
+		stats = &backupstore.RepackStats{}
+	}
+	defer stats.Measure(store)()
+	stats.Update(func(s *backupstore.RepackStats) {
+		s.Backups += len(backups)
+		for _, backup := range backups {
+			s.BlocksSkipped += len(backup.Blocks)
+		}
+		s.BlocksSkipped -= len(blocks)
+	})
+
+	// decompress ahead of the writer, but hand results over in offset order
+	queue := make(chan chan loadedBlock, jobs*2)
+	work := make(chan func())
+	done := make(chan struct{})
+	defer close(done)
+	// blocks take their share of opts.Memory in order, and give it back
+	// once written
+	feedCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for range jobs {
+		go func() {
+			for job := range work {
+				job()
+			}
+		}()
+	}
+	go func() {
+		defer close(queue)
+		defer close(work)
+		for _, block := range blocks {
+			if err := opts.Memory.Acquire(feedCtx, backupstore.MaxBlockSize); err != nil {
+				return
+			}
+			result := make(chan loadedBlock, 1)
+			job := func() {
+				data, err := opts.Cache.Load(store, backupPath, block.Block, block.Compression, block.BlockSize)
+				result <- loadedBlock{data: data, err: err}
+			}
+			select {
+			case work <- job:
+			case <-done:
+				return
+			}
+			select {
+			case queue <- result:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// -1 until the superblock is found; without either the image simply
+	// ends with the last block
+	size := int64(-1)
+	if opts.VolumeSize > 0 {
+		size = opts.VolumeSize
+	}
+	// without blocks the image is only as large as it is padded to
+	if len(blocks) == 0 {
+		switch {
+		case opts.PadToSize > 0:
+			size = opts.PadToSize
+		case opts.NoTruncate:
+			size = -1
+		}
+	}
+	var pos int64
+	i := 0
+	status := newPassProgress(progress, "[stream]", len(blocks), opts.Verbosity)
+	status.limit(opts.Throttles)
+	defer status.close()
+	for result := range queue {
+		if err := ctx.Err(); err != nil {
+			return pos, err
+		}
+		block := blocks[i]
+		i++
+		loaded := <-result
+		data := loaded.data
+		if loaded.err != nil {
+			action, ok := opts.OnChecksumMismatch.Tolerate(loaded.err)
+			if !ok {
+				action, ok = opts.OnMissingBlock.Tolerate(loaded.err)
+			}
+			if !ok {
+				return pos, loaded.err
+			}
+			opts.Damaged.Add(block.Block, loaded.err, action)
+			// a stream has no holes to leave, so the block is zeroes
+			switch action {
+			case backupstore.ActionSkipped:
+				data = make([]byte, len(data))
+			case backupstore.ActionZeroed:
+				data = make([]byte, backupstore.ZeroExtent(blocks, i-1))
+			}
+			stats.Update(func(s *backupstore.RepackStats) {
+				if action == backupstore.ActionZeroed {
+					s.MissingBlocks++
+				} else {
+					s.ChecksumMismatches++
+				}
+			})
+		}
+		if loaded.data != nil {
+			stats.Update(func(s *backupstore.RepackStats) {
+				s.BlocksRead++
+				s.BytesDecompressed += int64(len(loaded.data))
+			})
+		}
+
+		if i == 1 {
+			if block.Offset == 0 {
+				if probed, _, err := imageSize(bytes.NewReader(data), opts.VolumeSize, progress); err == nil {
+					size = probed
+				}
+			}
+			switch {
+			case opts.PadToSize > 0:
+				size = opts.PadToSize
+			case opts.NoTruncate:
+				size = -1
+			case size < 0:
+				fmt.Fprintf(progress, "No filesystem found at the start of the image, the image will end with the last block\n")
+			}
+		}
+
+		end := int64(len(data))
+		if size >= 0 {
+			if block.Offset >= size {
+				break
+			}
+			end = min(end, size-block.Offset)
+		}
+		before := pos
+		if block.Offset > pos {
+			if err := writeZeroes(w, block.Offset-pos); err != nil {
+				return pos, err
+			}
+			pos = block.Offset
+		}
+		// drop anything already emitted or past the end of the image
+		start := pos - block.Offset
+		if start < end {
+			n, err := w.Write(data[start:end])
+			pos += int64(n)
+			if err != nil {
+				return pos, err
+			}
+		}
+		opts.Memory.Release(backupstore.MaxBlockSize)
+		stats.Update(func(s *backupstore.RepackStats) { s.BytesWritten += pos - before })
+
+		if opts.Events != nil {
+			opts.Events.block(1, 1, i, len(blocks), block.Block, pos-before)
+			continue
+		}
+		status.block(i, pos-before, func() string {
+			return fmt.Sprintf("Block %s* {offset=%d} {%s}", shortChecksum(block.Checksum), block.Offset, block.Compression)
+		})
+	}
+
+	if pos < size {
+		if err := writeZeroes(w, size-pos); err != nil {
+			return pos, err
+		}
+		stats.Update(func(s *backupstore.RepackStats) { s.BytesWritten += size - pos })
+		pos = size
+	}
+	return pos, nil
+}
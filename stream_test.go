@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+)
+
+func ext4TestBlock(size int, totalBlocks uint32, logBlockSize uint32) []byte {
+	data := testBlockData(7, size)
+	binary.LittleEndian.PutUint32(data[ext4SuperblockOffset+4:], totalBlocks)
+	binary.LittleEndian.PutUint32(data[ext4SuperblockOffset+24:], logBlockSize)
+	binary.LittleEndian.PutUint16(data[ext4MagicOffset:], ext4Magic)
+	return data
+}
+
+func TestFinalBlockMap(t *testing.T) {
+	backups := []backupstore.Backup{
+		{
+			Compression: "gzip",
+			Blocks: []backupstore.Block{
+				{Offset: 4096, Checksum: "old-4096"},
+				{Offset: 0, Checksum: "old-0"},
+			},
+		},
+		{
+			Compression: "lz4",
+			Blocks: []backupstore.Block{
+				{Offset: 8192, Checksum: "new-8192"},
+				{Offset: 0, Checksum: "new-0"},
+			},
+		},
+	}
+
+	mapped := backupstore.FinalBlockMap(backups)
+	expected := []string{"new-0", "old-4096", "new-8192"}
+	if len(mapped) != len(expected) {
+		t.Fatalf("Expected %d blocks, got %d", len(expected), len(mapped))
+	}
+	for i, checksum := range expected {
+		if mapped[i].Checksum != checksum {
+			t.Errorf("Expected %s at position %d, got %s", checksum, i, mapped[i].Checksum)
+		}
+	}
+	if mapped[1].Compression != "gzip" {
+		t.Errorf("Expected gzip compression for old block, got %s", mapped[1].Compression)
+	}
+}
+
+func TestSuperblockFromData(t *testing.T) {
+	superblock, err := superblockFromData(ext4TestBlock(4096, 10, 2))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if superblock.TotalBlocks != 10 || superblock.BlockSize != 4096 {
+		t.Errorf("Expected 10 blocks of 4096, got %d blocks of %d", superblock.TotalBlocks, superblock.BlockSize)
+	}
+
+	if _, err := superblockFromData(make([]byte, 4096)); err == nil {
+		t.Error("Expected error for data without ext4 magic")
+	}
+	if _, err := superblockFromData(make([]byte, 100)); err == nil {
+		t.Error("Expected error for short data")
+	}
+}
+
+func TestStreamBackups(t *testing.T) {
+	volumePath := t.TempDir()
+	blockSize := 4096
+
+	first := writeTestBlock(t, volumePath, ext4TestBlock(blockSize, 10, 0))
+	second := writeTestBlock(t, volumePath, testBlockData(2, blockSize))
+	third := writeTestBlock(t, volumePath, testBlockData(3, blockSize))
+
+	backups := []backupstore.Backup{
+		{
+			Identifier:  "backup-1",
+			Compression: "lz4",
+			Blocks: []backupstore.Block{
+				{Offset: 0, Checksum: first},
+				{Offset: int64(2 * blockSize), Checksum: second},
+			},
+		},
+		{
+			Identifier:  "backup-2",
+			Compression: "lz4",
+			Blocks: []backupstore.Block{
+				{Offset: int64(2 * blockSize), Checksum: third},
+				{Offset: int64(3 * blockSize), Checksum: second},
+			},
+		},
+	}
+
+	var streamed bytes.Buffer
+	written, err := streamBackups(context.Background(), os.DirFS(volumePath), ".", backups, &streamed, restoreOptions{Jobs: 3})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if written != 10240 || streamed.Len() != 10240 {
+		t.Fatalf("Expected 10240 bytes, wrote %d (%d in buffer)", written, streamed.Len())
+	}
+
+	out, err := os.Create(filepath.Join(t.TempDir(), "out.raw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	if err := backupstore.Repack(context.Background(), os.DirFS(volumePath), ".", backups, out, backupstore.RepackOptions{Jobs: 1, NoSparse: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := out.Truncate(10240); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(streamed.Bytes(), restored) {
+		t.Error("Streamed image does not match restored image")
+	}
+}
+
+func TestStreamBackupsVolumeSize(t *testing.T) {
+	volumePath := t.TempDir()
+	blockSize := 4096
+	// the filesystem claims 10 blocks of 1KiB
+	first := writeTestBlock(t, volumePath, ext4TestBlock(blockSize, 10, 0))
+	backups := []backupstore.Backup{
+		{Identifier: "backup-1", Compression: "lz4", Blocks: []backupstore.Block{{Offset: 0, Checksum: first}}},
+	}
+
+	tests := []struct {
+		name       string
+		volumeSize int64
+		noTruncate bool
+		padToSize  int64
+		expected   int64
+		warning    bool
+	}{
+		{name: "superblock fallback", volumeSize: 0, expected: 10240},
+		{name: "filesystem smaller than volume", volumeSize: 16384, expected: 16384},
+		{name: "filesystem larger than volume", volumeSize: 8192, expected: 8192, warning: true},
+		{name: "no truncate", volumeSize: 2048, noTruncate: true, expected: 4096, warning: true},
+		{name: "pad to size", volumeSize: 16384, padToSize: 20480, expected: 20480},
+		{name: "pad below block", padToSize: 1024, expected: 1024},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var streamed, progress bytes.Buffer
+			written, err := streamBackups(context.Background(), os.DirFS(volumePath), ".", backups, &streamed, restoreOptions{
+				Jobs:       1,
+				VolumeSize: tt.volumeSize,
+				NoTruncate: tt.noTruncate,
+				PadToSize:  tt.padToSize,
+				Progress:   &progress,
+			})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if written != tt.expected || int64(streamed.Len()) != tt.expected {
+				t.Errorf("Expected %d bytes, wrote %d (%d in buffer)", tt.expected, written, streamed.Len())
+			}
+			if warned := bytes.Contains(progress.Bytes(), []byte("Warning")); warned != tt.warning {
+				t.Errorf("Expected warning %v, got %v", tt.warning, warned)
+			}
+		})
+	}
+}
+
+func TestStreamBackupsCancelled(t *testing.T) {
+	volumePath := t.TempDir()
+	checksum := writeTestBlock(t, volumePath, testBlockData(1, 4096))
+	backups := []backupstore.Backup{{Identifier: "backup-1", Compression: "lz4", Blocks: []backupstore.Block{{Offset: 0, Checksum: checksum}}}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := streamBackups(ctx, os.DirFS(volumePath), ".", backups, io.Discard, restoreOptions{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected a cancelled stream to stop, got %v", err)
+	}
+}
+
+func TestStreamBackupsEmpty(t *testing.T) {
+	backups := []backupstore.Backup{{Identifier: "backup-1", Compression: "lz4"}}
+	tests := []struct {
+		name string
+		opts restoreOptions
+		size int
+	}{
+		{name: "no volume.cfg", size: 0},
+		{name: "volume.cfg", opts: restoreOptions{VolumeSize: 8192}, size: 8192},
+		{name: "padded", opts: restoreOptions{VolumeSize: 8192, PadToSize: 16384}, size: 16384},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			written, err := streamBackups(context.Background(), os.DirFS(t.TempDir()), ".", backups, &out, tt.opts)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if written != int64(tt.size) || !bytes.Equal(out.Bytes(), make([]byte, tt.size)) {
+				t.Errorf("Expected %d zero bytes, got %d", tt.size, written)
+			}
+		})
+	}
+}
+
+func TestStreamBackupsMemoryBudget(t *testing.T) {
+	volumePath := t.TempDir()
+	blocks := make([]backupstore.Block, 0, 16)
+	var expected []byte
+	for i := range 16 {
+		checksum := writeTestBlock(t, volumePath, testBlockData(byte(i), 4096))
+		blocks = append(blocks, backupstore.Block{Offset: int64(i * 4096), Checksum: checksum})
+		expected = append(expected, testBlockData(byte(i), 4096)...)
+	}
+	backups := []backupstore.Backup{{Identifier: "backup-1", Compression: "lz4", Blocks: blocks}}
+
+	// a budget smaller than a block lets one through at a time
+	memory := backupstore.NewMemoryBudget(1)
+	var streamed bytes.Buffer
+	_, err := streamBackups(context.Background(), os.DirFS(volumePath), ".", backups, &streamed, restoreOptions{Jobs: 4, NoTruncate: true, Memory: memory})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !bytes.Equal(streamed.Bytes(), expected) {
+		t.Error("Streamed image does not match expected content")
+	}
+	if memory.Peak() != 1 {
+		t.Errorf("Expected a peak of the whole budget, got %d", memory.Peak())
+	}
+}
+
+func TestStreamBackupsChecksumMismatch(t *testing.T) {
+	volumePath := t.TempDir()
+	first := writeTestBlock(t, volumePath, testBlockData(1, 4096))
+	second := writeTestBlock(t, volumePath, testBlockData(2, 4096))
+	// the second block's file now holds the first block's content
+	blockPath, err := backupstore.ResolveBlockPath(os.DirFS(volumePath), ".", second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(volumePath, blockPath), compressTestLZ4(t, testBlockData(1, 4096)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	backups := []backupstore.Backup{{Identifier: "backup-1", Compression: "lz4", Blocks: []backupstore.Block{
+		{Offset: 0, Checksum: first},
+		{Offset: 4096, Checksum: second},
+	}}}
+
+	tests := []struct {
+		policy   backupstore.MismatchPolicy
+		second   []byte
+		action   string
+		expected bool
+	}{
+		{policy: backupstore.MismatchFail},
+		{policy: backupstore.MismatchWarn, second: testBlockData(1, 4096), action: backupstore.ActionWritten, expected: true},
+		{policy: backupstore.MismatchSkip, second: make([]byte, 4096), action: backupstore.ActionSkipped, expected: true},
+	}
+	for _, tt := range tests {
+		damaged := &backupstore.DamageReport{}
+		var streamed bytes.Buffer
+		_, err := streamBackups(context.Background(), os.DirFS(volumePath), ".", backups, &streamed, restoreOptions{
+			Jobs:               2,
+			NoTruncate:         true,
+			OnChecksumMismatch: tt.policy,
+			Damaged:            damaged,
+		})
+		if !tt.expected {
+			var mismatch *backupstore.ChecksumMismatchError
+			if !errors.As(err, &mismatch) {
+				t.Errorf("Expected checksum mismatch error, got %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if expected := append(testBlockData(1, 4096), tt.second...); !bytes.Equal(streamed.Bytes(), expected) {
+			t.Errorf("Streamed image does not match expected content for %s", tt.action)
+		}
+		if report := damaged.Blocks(); len(report) != 1 || report[0].Offset != 4096 || report[0].Action != tt.action {
+			t.Errorf("Expected the block at offset 4096 to be %s, got %v", tt.action, report)
+		}
+		if code := damageExitCode(damaged); code != exitChecksumMismatch {
+			t.Errorf("Expected exit status %d, got %d", exitChecksumMismatch, code)
+		}
+	}
+}
+
+func TestStreamBackupsMissingBlock(t *testing.T) {
+	volumePath := t.TempDir()
+	first := writeTestBlock(t, volumePath, testBlockData(1, 4096))
+	missing := backupstore.Block{Offset: 4096, Checksum: "0123456789abcdef0123456789abcdef"}
+	backups := []backupstore.Backup{{Identifier: "backup-1", Compression: "lz4", Blocks: []backupstore.Block{{Offset: 0, Checksum: first}, missing}}}
+
+	_, err := streamBackups(context.Background(), os.DirFS(volumePath), ".", backups, io.Discard, restoreOptions{NoTruncate: true})
+	if exitCode(err) != exitBlockError {
+		t.Errorf("Expected a missing block to fail the stream, got %v", err)
+	}
+
+	damaged := &backupstore.DamageReport{}
+	var streamed bytes.Buffer
+	_, err = streamBackups(context.Background(), os.DirFS(volumePath), ".", backups, &streamed, restoreOptions{
+		VolumeSize:     12288,
+		OnMissingBlock: backupstore.MissingZero,
+		Damaged:        damaged,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expected := append(testBlockData(1, 4096), make([]byte, 8192)...); !bytes.Equal(streamed.Bytes(), expected) {
+		t.Errorf("Expected the missing block zero-filled to the volume size, got %d bytes", streamed.Len())
+	}
+	if report := damaged.Blocks(); len(report) != 1 || report[0].Block != missing || report[0].Action != backupstore.ActionZeroed {
+		t.Errorf("Expected the block at offset 4096 to be zero-filled, got %v", report)
+	}
+	if code := damageExitCode(damaged); code != exitDegraded {
+		t.Errorf("Expected exit status %d, got %d", exitDegraded, code)
+	}
+}
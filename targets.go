@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+)
+
+// targetList is the value of -target: volume names separated by commas,
+// which can also be given more than once
+type targetList string
+
+func (l *targetList) String() string {
+	if l == nil {
+		return ""
+	}
+	return string(*l)
+}
+
+func (l *targetList) Set(value string) error {
+	if *l != "" {
+		value = string(*l) + "," + value
+	}
+	*l = targetList(value)
+	return nil
+}
+
+// splitTargets returns the volume names of a -target value, in order and
+// without duplicates
+func splitTargets(value string) []string {
+	var targets []string
+	for _, target := range strings.Split(value, ",") {
+		target = strings.TrimSpace(target)
+		if target != "" && !slices.Contains(targets, target) {
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
+
+// ambiguousTargetError is a -target pattern matching several volumes
+type ambiguousTargetError struct {
+	pattern string
+	volumes []string
+}
+
+func (e *ambiguousTargetError) Error() string {
+	return fmt.Sprintf("-target %s matches %d volumes: %s", e.pattern, len(e.volumes), strings.Join(e.volumes, ", "))
+}
+
+// resolveTargets returns the names of the volumes each of patterns names,
+// matches or contains, see backupstore.MatchVolumes, and the directories
+// of those it found. A pattern matching no volume is kept as it is, to be
+// reported as not found, and one matching several is an
+// *ambiguousTargetError unless multi is set.
+func resolveTargets(store fs.FS, patterns []string, multi bool) ([]string, map[string]string, error) {
+	var targets, found []string
+	for _, pattern := range patterns {
+		matches, err := backupstore.MatchVolumes(store, pattern)
+		if err != nil {
+			return nil, nil, err
+		}
+		names := volumeNames(matches)
+		switch {
+		case len(names) > 1 && !multi:
+			return nil, nil, &ambiguousTargetError{pattern: pattern, volumes: names}
+		case len(names) == 0:
+			names = []string{pattern}
+		}
+		for _, name := range names {
+			if !slices.Contains(targets, name) {
+				targets = append(targets, name)
+			}
+		}
+		found = append(found, matches...)
+	}
+	return targets, volumeDirs(found), nil
+}
+
+// volumePathError is a -target path that can't be used as a volume
+// directory
+type volumePathError struct {
+	path   string
+	reason string
+}
+
+func (e *volumePathError) Error() string {
+	return fmt.Sprintf("-target %s %s", e.path, e.reason)
+}
+
+// isVolumePath reports whether target is the path of a volume directory
+// rather than a name or pattern, which never contain a separator
+func isVolumePath(target string) bool {
+	return strings.ContainsRune(target, '/') || strings.ContainsRune(target, filepath.Separator) || target == "." || target == ".."
+}
+
+// splitVolumePaths separates the volume directory paths among targets
+// from the names and patterns
+func splitVolumePaths(targets []string) (paths, patterns []string) {
+	for _, target := range targets {
+		if isVolumePath(target) {
+			paths = append(paths, target)
+		} else {
+			patterns = append(patterns, target)
+		}
+	}
+	return paths, patterns
+}
+
+// locateVolumePaths finds the backupstore directory the volume
+// directories at paths are in, and returns the names of the volumes, in
+// order, along with their directories in it. With backupRoot, a local one, the volumes have to be in
+// its backupstore. Without it, the backupstore is the nearest directory
+// named backupstore above the first volume, or when there is none, the
+// directory the volume is in, as that holds its blocks too.
+func locateVolumePaths(paths []string, backupRoot string) (string, []string, map[string]string, error) {
+	var storePath string
+	if backupRoot != "" {
+		storePath = filepath.Join(backupRoot, "backupstore")
+	}
+	var names []string
+	dirs := make(map[string]string)
+	for _, p := range paths {
+		volumePath, err := filepath.Abs(p)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		info, err := os.Stat(volumePath)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			return "", nil, nil, fmt.Errorf("-target %s does not exist: %w", p, backupstore.ErrVolumeNotFound)
+		case err != nil:
+			return "", nil, nil, err
+		case !info.IsDir():
+			return "", nil, nil, &volumePathError{path: p, reason: "is not a directory"}
+		}
+		if !isVolumeDir(volumePath) {
+			return "", nil, nil, &volumePathError{path: p, reason: "is not a Longhorn volume directory, which holds backups/ or volume.cfg"}
+		}
+
+		if storePath == "" {
+			storePath = findBackupstore(volumePath)
+		}
+		absStorePath, err := filepath.Abs(storePath)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		rel, err := filepath.Rel(absStorePath, volumePath)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return "", nil, nil, &volumePathError{path: p, reason: "is not in the backupstore " + storePath}
+		}
+		dir := filepath.ToSlash(rel)
+		name := path.Base(dir)
+		if found, ok := dirs[name]; ok && found != dir {
+			return "", nil, nil, &volumePathError{path: p, reason: fmt.Sprintf("has the same name as %s", found)}
+		}
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+		dirs[name] = dir
+	}
+	return storePath, names, dirs, nil
+}
+
+// isVolumeDir reports whether dir holds the backups or volume.cfg of a
+// volume
+func isVolumeDir(dir string) bool {
+	for _, marker := range []string{"backups", "volume.cfg"} {
+		if _, err := os.Stat(filepath.Join(dir, marker)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// findBackupstore returns the nearest directory named backupstore above
+// volumePath, or the directory volumePath is in
+func findBackupstore(volumePath string) string {
+	for dir := filepath.Dir(volumePath); ; {
+		if filepath.Base(dir) == "backupstore" {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return filepath.Dir(volumePath)
+		}
+		dir = parent
+	}
+}
+
+// volumeDirs maps the name of each volume in dirs to its directory,
+// leaving out names that several directories have
+func volumeDirs(dirs []string) map[string]string {
+	byName := make(map[string]string)
+	shared := make(map[string]bool)
+	for _, dir := range dirs {
+		name := path.Base(dir)
+		if found, ok := byName[name]; ok && found != dir {
+			shared[name] = true
+		}
+		byName[name] = dir
+	}
+	for name := range shared {
+		delete(byName, name)
+	}
+	return byName
+}
+
+// targetOutfile is where the image of target goes: outfile with {volume}
+// replaced by the name of target, or with several targets, a file named
+// after target in the directory outfile
+func targetOutfile(outfile, target, format string, multiple bool) string {
+	switch {
+	case outfile == "" || outfile == "-":
+		return outfile
+	case strings.Contains(outfile, "{volume}"):
+		return strings.ReplaceAll(outfile, "{volume}", target)
+	case !multiple:
+		return outfile
+	}
+	extension := ".img"
+	if format != "raw" {
+		extension = "." + format
+	}
+	return filepath.Join(outfile, target+extension)
+}
+
+// targetResult is how the command went for one of several targets
+type targetResult struct {
+	Target string
+	// Outfile is the image written, if any, shown unless the target failed
+	Outfile string
+	Code    int
+	// Ran is false for a target -fail-fast or an interrupt left out, and
+	// Empty is set for a volume -all skipped as it has no backups
+	Ran     bool
+	Empty   bool
+	Size    int64
+	Elapsed time.Duration
+}
+
+// failed is true unless the command finished, even with damaged blocks
+func (r targetResult) failed() bool {
+	return r.Code != 0 && r.Code != exitChecksumMismatch && r.Code != exitDegraded
+}
+
+// combinedExitCode is the exit status of the first target that failed, or
+// else the one of the most damaged restore
+func combinedExitCode(results []targetResult) int {
+	code := 0
+	for _, result := range results {
+		switch {
+		case result.failed():
+			return result.Code
+		case result.Code == exitChecksumMismatch, result.Code == exitDegraded && code == 0:
+			code = result.Code
+		}
+	}
+	return code
+}
+
+// printTargetSummary tabulates how each target went, including the ones
+// that were left out
+func printTargetSummary(w io.Writer, results []targetResult) {
+	succeeded := 0
+	for _, result := range results {
+		if result.Ran && !result.failed() {
+			succeeded++
+		}
+	}
+	fmt.Fprintf(w, "%d of %d targets succeeded\n", succeeded, len(results))
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "VOLUME\tSTATUS\tSIZE\tDURATION\tIMAGE")
+	for _, result := range results {
+		var status string
+		switch {
+		case !result.Ran:
+			status = "not run"
+		case result.Empty:
+			status = "skipped, no backups"
+		case result.Code == 0:
+			status = "ok"
+		case result.failed():
+			status = fmt.Sprintf("failed (exit %d)", result.Code)
+		default:
+			status = fmt.Sprintf("damaged blocks (exit %d)", result.Code)
+		}
+		size, elapsed, image := "-", "-", "-"
+		if result.Size > 0 {
+			size = formatBytes(result.Size)
+		}
+		if result.Ran {
+			elapsed = result.Elapsed.Round(time.Second).String()
+		}
+		if result.Outfile != "" && result.Ran && !result.Empty && !result.failed() {
+			image = result.Outfile
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", result.Target, status, size, elapsed, image)
+	}
+	tw.Flush()
+}
+
+// prefixWriter starts every line written through it with prefix, so the
+// output of targets run at the same time can be told apart. The writers
+// of one w share mu, and a write of whole lines is never split by another.
+type prefixWriter struct {
+	mu      *sync.Mutex
+	w       io.Writer
+	prefix  string
+	midLine bool
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := len(b)
+	var buf []byte
+	for len(b) > 0 {
+		if !p.midLine {
+			buf = append(buf, p.prefix...)
+		}
+		line, rest, found := bytes.Cut(b, []byte("\n"))
+		buf = append(buf, line...)
+		if found {
+			buf = append(buf, '\n')
+		}
+		b, p.midLine = rest, !found
+	}
+	if _, err := p.w.Write(buf); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+)
+
+func TestTargetList(t *testing.T) {
+	tests := []struct {
+		args    []string
+		targets []string
+	}{
+		{[]string{"-target", "pvc-1"}, []string{"pvc-1"}},
+		{[]string{"-target", "pvc-1, pvc-2,,pvc-1"}, []string{"pvc-1", "pvc-2"}},
+		{[]string{"-target", "pvc-1", "-target", "pvc-2,pvc-3"}, []string{"pvc-1", "pvc-2", "pvc-3"}},
+		{nil, nil},
+	}
+	for _, tt := range tests {
+		flags := flag.NewFlagSet("test", flag.ContinueOnError)
+		flags.SetOutput(io.Discard)
+		o := defineFlags(flags)
+		if err := flags.Parse(tt.args); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if targets := splitTargets(*o.target); !slices.Equal(targets, tt.targets) {
+			t.Errorf("Expected %v for %v, got %v", tt.targets, tt.args, targets)
+		}
+	}
+}
+
+func TestResolveTargets(t *testing.T) {
+	tmpDir := t.TempDir()
+	for _, dir := range []string{"ab/cd/pvc-8f3a01", "ef/01/pvc-8f3b02", "12/34/pvc-1"} {
+		if err := os.MkdirAll(filepath.Join(tmpDir, "volumes", dir, "backups"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store := os.DirFS(tmpDir)
+
+	targets, dirs, err := resolveTargets(store, []string{"8f3a", "pvc-1", "pvc-404"}, false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expected := []string{"pvc-8f3a01", "pvc-1", "pvc-404"}; !slices.Equal(targets, expected) {
+		t.Errorf("Expected %v, got %v", expected, targets)
+	}
+	if dirs["pvc-8f3a01"] != "volumes/ab/cd/pvc-8f3a01" || len(dirs) != 2 {
+		t.Errorf("Expected the directories of the 2 volumes found, got %v", dirs)
+	}
+
+	var ambiguous *ambiguousTargetError
+	if _, _, err := resolveTargets(store, []string{"pvc-8f3*"}, false); !errors.As(err, &ambiguous) || len(ambiguous.volumes) != 2 {
+		t.Errorf("Expected pvc-8f3* to match 2 volumes, got %v", err)
+	}
+	targets, _, err = resolveTargets(store, []string{"pvc-8f3*", "pvc-8f3b02"}, true)
+	if expected := []string{"pvc-8f3a01", "pvc-8f3b02"}; err != nil || !slices.Equal(targets, expected) {
+		t.Errorf("Expected %v with -multi, got %v and %v", expected, targets, err)
+	}
+}
+
+func TestLocateVolumePaths(t *testing.T) {
+	tmpDir := t.TempDir()
+	for _, dir := range []string{"backupstore/volumes/ab/cd/pvc-1/backups", "backupstore/volumes/ef/01/pvc-2/backups", "other/pvc-1/backups", "other/pvc-3/blocks"} {
+		if err := os.MkdirAll(filepath.Join(tmpDir, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, "other/pvc-2"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	volume := func(dir string) string {
+		return filepath.Join(tmpDir, filepath.FromSlash(dir))
+	}
+
+	storePath, names, dirs, err := locateVolumePaths([]string{volume("backupstore/volumes/ef/01/pvc-2"), volume("backupstore/volumes/ab/cd/pvc-1")}, "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if storePath != volume("backupstore") {
+		t.Errorf("Expected the backupstore %s, got %s", volume("backupstore"), storePath)
+	}
+	if !slices.Equal(names, []string{"pvc-2", "pvc-1"}) || dirs["pvc-1"] != "volumes/ab/cd/pvc-1" || dirs["pvc-2"] != "volumes/ef/01/pvc-2" {
+		t.Errorf("Expected pvc-2 and pvc-1 in their directories, got %v and %v", names, dirs)
+	}
+
+	// with no backupstore above it, the volume is read from its parent
+	storePath, _, dirs, err = locateVolumePaths([]string{volume("other/pvc-1")}, "")
+	if err != nil || storePath != volume("other") || dirs["pvc-1"] != "pvc-1" {
+		t.Errorf("Expected pvc-1 in %s, got %v in %s and %v", volume("other"), dirs, storePath, err)
+	}
+
+	_, _, dirs, err = locateVolumePaths([]string{volume("backupstore/volumes/ab/cd/pvc-1")}, tmpDir)
+	if err != nil || dirs["pvc-1"] != "volumes/ab/cd/pvc-1" {
+		t.Errorf("Expected pvc-1 in the backupstore of -backup-root, got %v and %v", dirs, err)
+	}
+
+	tests := []struct {
+		name       string
+		paths      []string
+		backupRoot string
+		notFound   bool
+	}{
+		{name: "missing", paths: []string{volume("other/pvc-404")}, notFound: true},
+		{name: "a file", paths: []string{volume("other/pvc-2")}},
+		{name: "not a volume", paths: []string{volume("backupstore/volumes")}},
+		{name: "only blocks", paths: []string{volume("other/pvc-3")}},
+		{name: "outside -backup-root", paths: []string{volume("other/pvc-1")}, backupRoot: tmpDir},
+		{name: "same name", paths: []string{volume("backupstore/volumes/ab/cd/pvc-1"), volume("other/pvc-1")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, _, err := locateVolumePaths(tt.paths, tt.backupRoot)
+			var pathErr *volumePathError
+			switch {
+			case tt.notFound && !errors.Is(err, backupstore.ErrVolumeNotFound):
+				t.Errorf("Expected ErrVolumeNotFound, got %v", err)
+			case !tt.notFound && !errors.As(err, &pathErr):
+				t.Errorf("Expected a volumePathError, got %v", err)
+			}
+		})
+	}
+}
+
+func TestTargetOutfile(t *testing.T) {
+	tests := []struct {
+		outfile  string
+		format   string
+		multiple bool
+		expected string
+	}{
+		{"/restore/disk.img", "raw", false, "/restore/disk.img"},
+		{"-", "raw", true, "-"},
+		{"/restore/{volume}.img", "raw", false, "/restore/pvc-1.img"},
+		{"/restore/{volume}/{volume}.qcow2", "qcow2", true, "/restore/pvc-1/pvc-1.qcow2"},
+		{"/restore", "raw", true, "/restore/pvc-1.img"},
+		{"/restore/", "vhd", true, "/restore/pvc-1.vhd"},
+	}
+	for _, tt := range tests {
+		if outfile := targetOutfile(tt.outfile, "pvc-1", tt.format, tt.multiple); outfile != tt.expected {
+			t.Errorf("Expected %s for %s, got %s", tt.expected, tt.outfile, outfile)
+		}
+	}
+}
+
+func TestCombinedExitCode(t *testing.T) {
+	tests := []struct {
+		codes    []int
+		expected int
+	}{
+		{[]int{0, 0}, 0},
+		{[]int{0, exitDegraded, exitChecksumMismatch}, exitChecksumMismatch},
+		{[]int{exitChecksumMismatch, exitDegraded}, exitChecksumMismatch},
+		{[]int{exitDegraded, exitBlockError, exitOutputError}, exitBlockError},
+	}
+	for _, tt := range tests {
+		var results []targetResult
+		for _, code := range tt.codes {
+			results = append(results, targetResult{Code: code})
+		}
+		if code := combinedExitCode(results); code != tt.expected {
+			t.Errorf("Expected exit status %d for %v, got %d", tt.expected, tt.codes, code)
+		}
+	}
+}
+
+func TestPrintTargetSummary(t *testing.T) {
+	results := []targetResult{
+		{Target: "pvc-1", Outfile: "/restore/pvc-1.img", Ran: true, Size: 20 << 30, Elapsed: 90 * time.Second},
+		{Target: "pvc-2", Outfile: "/restore/pvc-2.img", Ran: true, Code: exitDegraded, Size: 1 << 20},
+		{Target: "pvc-3", Outfile: "/restore/pvc-3.img", Ran: true, Code: exitBlockError},
+		{Target: "pvc-4", Outfile: "/restore/pvc-4.img", Ran: true, Empty: true},
+		{Target: "pvc-5"},
+	}
+	var out bytes.Buffer
+	printTargetSummary(&out, results)
+	expected := `3 of 5 targets succeeded
+VOLUME  STATUS                   SIZE      DURATION  IMAGE
+pvc-1   ok                       20.0 GiB  1m30s     /restore/pvc-1.img
+pvc-2   damaged blocks (exit 9)  1.0 MiB   0s        /restore/pvc-2.img
+pvc-3   failed (exit 4)          -         0s        -
+pvc-4   skipped, no backups      -         0s        -
+pvc-5   not run                  -         -         -
+`
+	if out.String() != expected {
+		t.Errorf("Expected summary:\n%s\ngot:\n%s", expected, out.String())
+	}
+}
+
+func TestPrefixWriter(t *testing.T) {
+	var (
+		out   bytes.Buffer
+		lines sync.Mutex
+	)
+	first := &prefixWriter{mu: &lines, w: &out, prefix: "[pvc-1] "}
+	second := &prefixWriter{mu: &lines, w: &out, prefix: "[pvc-2] "}
+	fmt.Fprintf(first, "Looking for backups\nFound ")
+	fmt.Fprintf(first, "2 backups\n")
+	fmt.Fprintf(second, "Looking for backups\n")
+	n, err := fmt.Fprintf(first, "Overwrite? ")
+	if err != nil || n != len("Overwrite? ") {
+		t.Fatalf("Expected %d bytes written, got %d and %v", len("Overwrite? "), n, err)
+	}
+	expected := "[pvc-1] Looking for backups\n[pvc-1] Found 2 backups\n[pvc-2] Looking for backups\n[pvc-1] Overwrite? "
+	if out.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, out.String())
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+const (
+	vdiSignature   = 0xbeda107f
+	vdiVersion     = 0x00010001
+	vdiHeaderSize  = 0x190
+	vdiTypeNormal  = 1
+	vdiBlockSize   = 1024 * 1024
+	vdiBlocksStart = 512
+	vdiUnallocated = 0xffffffff
+	vdiFileInfo    = "<<< Oracle VM VirtualBox Disk Image >>>\n"
+)
+
+type vdiGeometry struct {
+	Cylinders uint32
+	Heads     uint32
+	Sectors   uint32
+	SectorSz  uint32
+}
+
+type vdiHeader struct {
+	FileInfo         [64]byte
+	Signature        uint32
+	Version          uint32
+	HeaderSize       uint32
+	Type             uint32
+	Flags            uint32
+	Comment          [256]byte
+	OffsetBlocks     uint32
+	OffsetData       uint32
+	LegacyGeometry   vdiGeometry
+	Dummy            uint32
+	DiskSize         uint64
+	BlockSize        uint32
+	BlockExtra       uint32
+	Blocks           uint32
+	BlocksAllocated  uint32
+	UUIDCreate       [16]byte
+	UUIDModify       [16]byte
+	UUIDLinkage      [16]byte
+	UUIDParentModify [16]byte
+	LCHSGeometry     vdiGeometry
+}
+
+// vdiWriter writes a dynamic VDI image. Image blocks are allocated lazily as
+// restore blocks arrive, and the block map is written in front of the data
+// when the image is closed.
+type vdiWriter struct {
+	*sparseImage
+}
+
+func createVDI(path string) (*vdiWriter, error) {
+	// the first MiB holds the header and a block map for up to 256GiB;
+	// larger disks push the first data blocks to the end when closing
+	image, err := newSparseImage(path, vdiBlockSize, vdiBlockSize)
+	if err != nil {
+		return nil, err
+	}
+	return &vdiWriter{sparseImage: image}, nil
+}
+
+func (v *vdiWriter) Close() error {
+	return v.closeWith(v.finish)
+}
+
+func newVDIHeader(size int64, blocks, allocated uint32, offsetData uint32) (vdiHeader, error) {
+	header := vdiHeader{
+		Signature:       vdiSignature,
+		Version:         vdiVersion,
+		HeaderSize:      vdiHeaderSize,
+		Type:            vdiTypeNormal,
+		OffsetBlocks:    vdiBlocksStart,
+		OffsetData:      offsetData,
+		LegacyGeometry:  vdiGeometry{SectorSz: 512},
+		DiskSize:        uint64(size),
+		BlockSize:       vdiBlockSize,
+		Blocks:          blocks,
+		BlocksAllocated: allocated,
+		LCHSGeometry:    vdiGeometry{SectorSz: 512},
+	}
+	copy(header.FileInfo[:], vdiFileInfo)
+	for _, uuid := range []*[16]byte{&header.UUIDCreate, &header.UUIDModify} {
+		if _, err := rand.Read(uuid[:]); err != nil {
+			return vdiHeader{}, err
+		}
+		uuid[6] = uuid[6]&0x0f | 0x40
+		uuid[8] = uuid[8]&0x3f | 0x80
+	}
+	return header, nil
+}
+
+func (v *vdiWriter) finish() error {
+	size, _ := v.finalSize()
+	blocks := (size + vdiBlockSize - 1) / vdiBlockSize
+	mapSize := blocks * 4
+	offsetData := max(vdiBlockSize, (vdiBlocksStart+mapSize+vdiBlockSize-1)/vdiBlockSize*vdiBlockSize)
+
+	// move data blocks that sit where the block map has to go
+	guests := make([]int64, 0, len(v.clusters))
+	for guest := range v.clusters {
+		guests = append(guests, guest)
+	}
+	sort.Slice(guests, func(i, j int) bool { return guests[i] < guests[j] })
+	buf := make([]byte, vdiBlockSize)
+	for _, guest := range guests {
+		host := v.clusters[guest]
+		if host >= offsetData {
+			continue
+		}
+		if _, err := v.file.ReadAt(buf, host); err != nil {
+			return err
+		}
+		moved := v.allocate(1)
+		if _, err := v.file.WriteAt(buf, moved); err != nil {
+			return err
+		}
+		v.clusters[guest] = moved
+	}
+
+	blockMap := make([]byte, mapSize)
+	for i := int64(0); i < blocks; i++ {
+		binary.LittleEndian.PutUint32(blockMap[i*4:], vdiUnallocated)
+	}
+	for guest, host := range v.clusters {
+		binary.LittleEndian.PutUint32(blockMap[guest*4:], uint32((host-offsetData)/vdiBlockSize))
+	}
+	if _, err := v.file.WriteAt(blockMap, vdiBlocksStart); err != nil {
+		return err
+	}
+
+	header, err := newVDIHeader(size, uint32(blocks), uint32(len(v.clusters)), uint32(offsetData))
+	if err != nil {
+		return err
+	}
+	buf = make([]byte, vdiBlocksStart)
+	if _, err := binary.Encode(buf, binary.LittleEndian, header); err != nil {
+		return fmt.Errorf("failed to encode vdi header: %w", err)
+	}
+	if _, err := v.file.WriteAt(buf, 0); err != nil {
+		return err
+	}
+	// the relocated blocks leave a hole behind, but the file must still
+	// cover every allocated block
+	return v.file.Truncate(max(v.next, offsetData))
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+)
+
+func readVDIImage(t *testing.T, path string) (vdiHeader, func(offset int64) []byte) {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { file.Close() })
+
+	var header vdiHeader
+	if err := binary.Read(io.NewSectionReader(file, 0, 512), binary.LittleEndian, &header); err != nil {
+		t.Fatal(err)
+	}
+
+	readBlock := func(offset int64) []byte {
+		entry := make([]byte, 4)
+		if _, err := file.ReadAt(entry, int64(header.OffsetBlocks)+offset/vdiBlockSize*4); err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, vdiBlockSize)
+		index := binary.LittleEndian.Uint32(entry)
+		if index == vdiUnallocated {
+			return data
+		}
+		if _, err := file.ReadAt(data, int64(header.OffsetData)+int64(index)*vdiBlockSize); err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	return header, readBlock
+}
+
+func TestVDIWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.vdi")
+	writer, err := createVDI(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size := int64(64*1024*1024 + 4096)
+	first := testBlockData(1, 2*1024*1024)
+	second := testBlockData(2, 2*1024*1024)
+	if _, err := writer.WriteAt(first, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.WriteAt(second, 32*1024*1024); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.WriteAt(make([]byte, 2*1024*1024), 8*1024*1024); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	header, readBlock := readVDIImage(t, path)
+	if string(header.FileInfo[:len(vdiFileInfo)]) != vdiFileInfo {
+		t.Errorf("Unexpected file info %q", header.FileInfo)
+	}
+	if header.Signature != vdiSignature || header.Version != vdiVersion {
+		t.Errorf("Unexpected signature %x version %x", header.Signature, header.Version)
+	}
+	if header.HeaderSize != vdiHeaderSize || header.Type != vdiTypeNormal {
+		t.Errorf("Unexpected header size %x type %d", header.HeaderSize, header.Type)
+	}
+	if header.DiskSize != uint64(size) {
+		t.Errorf("Expected disk size %d, got %d", size, header.DiskSize)
+	}
+	if header.Blocks != 65 || header.BlocksAllocated != 4 {
+		t.Errorf("Expected 65 blocks with 4 allocated, got %d with %d", header.Blocks, header.BlocksAllocated)
+	}
+	if header.OffsetData < header.OffsetBlocks+header.Blocks*4 {
+		t.Error("Block map overlaps the data area")
+	}
+
+	if !bytes.Equal(readBlock(0), first[:vdiBlockSize]) {
+		t.Error("First block does not match written data")
+	}
+	if !bytes.Equal(readBlock(33*1024*1024), second[vdiBlockSize:]) {
+		t.Error("Second block does not match written data")
+	}
+	if !backupstore.IsZeroBlock(readBlock(8 * 1024 * 1024)) {
+		t.Error("Expected zero region to be unallocated")
+	}
+}
+
+func TestVDIWriterRelocatesBlocks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.vdi")
+	writer, err := createVDI(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 512GiB needs a 2MiB block map, overlapping the first data blocks
+	size := int64(512) << 30
+	data := testBlockData(3, 2*vdiBlockSize)
+	if _, err := writer.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	last := testBlockData(4, vdiBlockSize)
+	if _, err := writer.WriteAt(last, size-vdiBlockSize); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	header, readBlock := readVDIImage(t, path)
+	if header.OffsetData < header.OffsetBlocks+header.Blocks*4 {
+		t.Error("Block map overlaps the data area")
+	}
+	if !bytes.Equal(readBlock(0), data[:vdiBlockSize]) || !bytes.Equal(readBlock(vdiBlockSize), data[vdiBlockSize:]) {
+		t.Error("Relocated blocks do not match written data")
+	}
+	if !bytes.Equal(readBlock(size-vdiBlockSize), last) {
+		t.Error("Last block does not match written data")
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"slices"
+	"sync"
+
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+)
+
+type verifyMismatch struct {
+	Offset   int64
+	Checksum string
+	Reason   string
+}
+
+// verifyRestore decompresses the block that won each offset again and
+// compares it byte for byte with what ended up in the image. Blocks past
+// size, where the image was truncated, are only compared up to it; a
+// negative size compares whole blocks.
+func verifyRestore(store fs.FS, backupPath string, backups []backupstore.Backup, image io.ReaderAt, size int64, opts restoreOptions) (int, []verifyMismatch) {
+	jobs := max(opts.Jobs, 1)
+	progress := opts.Progress
+	if progress == nil {
+		progress = io.Discard
+	}
+
+	blocks := backupstore.FinalBlockMap(backups)
+	var (
+		wg         sync.WaitGroup
+		mu         sync.Mutex
+		mismatches []verifyMismatch
+		done       int
+	)
+	status := newPassProgress(progress, "[verify]", len(blocks), opts.Verbosity)
+	status.limit(opts.Throttles)
+	work := make(chan backupstore.MappedBlock)
+	for range jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for block := range work {
+				// the block and what the image holds for it
+				opts.Memory.Acquire(context.Background(), 2*backupstore.MaxBlockSize)
+				n, reason := verifyBlock(store, backupPath, block, image, size, opts.Cache)
+				opts.Memory.Release(2 * backupstore.MaxBlockSize)
+
+				mu.Lock()
+				done++
+				if reason != "" {
+					mismatches = append(mismatches, verifyMismatch{Offset: block.Offset, Checksum: block.Checksum, Reason: reason})
+				}
+				status.block(done, n, func() string {
+					return fmt.Sprintf("Block %s* {offset=%d}", shortChecksum(block.Checksum), block.Offset)
+				})
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, block := range blocks {
+		work <- block
+	}
+	close(work)
+	wg.Wait()
+	status.close()
+
+	slices.SortFunc(mismatches, func(a, b verifyMismatch) int {
+		return cmp.Compare(a.Offset, b.Offset)
+	})
+	return len(blocks), mismatches
+}
+
+// verifyBlock returns how many bytes of the image it compared with block
+// and why they don't match, or "" if they do
+func verifyBlock(store fs.FS, backupPath string, block backupstore.MappedBlock, image io.ReaderAt, size int64, cache *backupstore.BlockCache) (int64, string) {
+	expected, err := cache.Load(store, backupPath, block.Block, block.Compression, block.BlockSize)
+	if err != nil {
+		return 0, fmt.Sprintf("could not load the source block: %s", err)
+	}
+	if size >= 0 {
+		if block.Offset >= size {
+			return 0, ""
+		}
+		expected = expected[:min(int64(len(expected)), size-block.Offset)]
+	}
+
+	actual := make([]byte, len(expected))
+	n, err := image.ReadAt(actual, block.Offset)
+	if n < len(actual) {
+		return int64(n), fmt.Sprintf("image ends after %d of %d bytes: %v", n, len(actual), err)
+	}
+	if !bytes.Equal(actual, expected) {
+		for i := range actual {
+			if actual[i] != expected[i] {
+				return int64(len(actual)), fmt.Sprintf("first difference at image offset %d", block.Offset+int64(i))
+			}
+		}
+	}
+	return int64(len(actual)), ""
+}
+
+func printVerifyReport(w io.Writer, checked int, mismatches []verifyMismatch) {
+	fmt.Fprintf(w, "Verified %d blocks, %d mismatches\n", checked, len(mismatches))
+	for _, mismatch := range mismatches {
+		fmt.Fprintf(w, "  offset %d (block %s): %s\n", mismatch.Offset, mismatch.Checksum, mismatch.Reason)
+	}
+}
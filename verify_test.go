@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+)
+
+func TestVerifyRestore(t *testing.T) {
+	volumePath := t.TempDir()
+	blockSize := 4096
+	first := writeTestBlock(t, volumePath, testBlockData(1, blockSize))
+	second := writeTestBlock(t, volumePath, testBlockData(2, blockSize))
+	third := writeTestBlock(t, volumePath, testBlockData(3, blockSize))
+	backups := []backupstore.Backup{
+		{Identifier: "backup-1", Compression: "lz4", Blocks: []backupstore.Block{{Offset: 0, Checksum: first}, {Offset: 4096, Checksum: first}}},
+		{Identifier: "backup-2", Compression: "lz4", Blocks: []backupstore.Block{{Offset: 4096, Checksum: second}, {Offset: 8192, Checksum: third}}},
+	}
+
+	out, err := os.Create(filepath.Join(t.TempDir(), "out.raw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	store := os.DirFS(volumePath)
+	if err := backupstore.Repack(context.Background(), store, ".", backups, out, backupstore.RepackOptions{Jobs: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	checked, mismatches := verifyRestore(store, ".", backups, out, -1, restoreOptions{Jobs: 2})
+	if checked != 3 || len(mismatches) != 0 {
+		t.Errorf("Expected 3 matching blocks, got %d checked and mismatches %+v", checked, mismatches)
+	}
+
+	// only the part of the last block before the truncation is compared
+	if err := out.Truncate(10000); err != nil {
+		t.Fatal(err)
+	}
+	if _, mismatches := verifyRestore(store, ".", backups, out, 10000, restoreOptions{Jobs: 1}); len(mismatches) != 0 {
+		t.Errorf("Expected no mismatches in a truncated image, got %+v", mismatches)
+	}
+	if _, mismatches := verifyRestore(store, ".", backups, out, -1, restoreOptions{Jobs: 1}); len(mismatches) != 1 || mismatches[0].Offset != 8192 {
+		t.Errorf("Expected the cut off block at 8192 to mismatch, got %+v", mismatches)
+	}
+
+	if _, err := out.WriteAt([]byte{0xff}, 4096+100); err != nil {
+		t.Fatal(err)
+	}
+	_, mismatches = verifyRestore(store, ".", backups, out, 10000, restoreOptions{Jobs: 2})
+	if len(mismatches) != 1 || mismatches[0].Offset != 4096 || mismatches[0].Checksum != second {
+		t.Fatalf("Expected a mismatch in the newest block at 4096, got %+v", mismatches)
+	}
+	if !strings.Contains(mismatches[0].Reason, "offset 4196") {
+		t.Errorf("Expected the first difference to be reported, got %s", mismatches[0].Reason)
+	}
+}
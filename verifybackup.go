@@ -0,0 +1,213 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"slices"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+)
+
+// Kinds of blockCheck problems, besides problemMissing and problemCorrupt
+// which check reports too
+const (
+	problemUndecompressable = "undecompressable"
+	problemUnreadable       = "unreadable"
+)
+
+// blockCheck is a block file of a backup that failed verify-backup
+type blockCheck struct {
+	Kind     string `json:"kind"`
+	Checksum string `json:"checksum"`
+	// Offsets are where the backup references the block
+	Offsets []int64 `json:"offsets"`
+	Error   string  `json:"error"`
+}
+
+// backupCheck is what verify-backup found in a backup. Blocks counts the
+// block files, each read once however many offsets reference it, and
+// Bytes what they decompress to.
+type backupCheck struct {
+	Volume           string       `json:"volume"`
+	Backup           string       `json:"backup"`
+	Created          time.Time    `json:"created"`
+	Blocks           int          `json:"blocks"`
+	Bytes            int64        `json:"bytes"`
+	Missing          int          `json:"missing"`
+	Corrupt          int          `json:"corrupt"`
+	Undecompressable int          `json:"undecompressable"`
+	Unreadable       int          `json:"unreadable"`
+	Problems         []blockCheck `json:"problems"`
+}
+
+func (c *backupCheck) passed() bool {
+	return len(c.Problems) == 0
+}
+
+// exitCode is exitBlockError for a block that is missing or damaged, and
+// exitFailure when block files could only not be read
+func (c *backupCheck) exitCode() int {
+	switch {
+	case c.Missing > 0 || c.Corrupt > 0 || c.Undecompressable > 0:
+		return exitBlockError
+	case c.Unreadable > 0:
+		return exitFailure
+	}
+	return 0
+}
+
+// verifyBackup reads every block file backup references, jobs at a time,
+// decompressing it and checking it against its checksum. A block must
+// also decompress to something that fits before the next block of the
+// backup, within a Longhorn block and the volume when volumeSize is known.
+func verifyBackup(store fs.FS, volume *backupstore.VolumeBackup, backup backupstore.Backup, jobs int, progress io.Writer, level verbosity) *backupCheck {
+	checked := &backupCheck{Volume: volume.Name, Backup: backup.Identifier, Created: backup.Timestamp, Problems: []blockCheck{}}
+
+	// the offsets of each block file, and the most it may decompress to
+	offsets := make(map[string][]int64)
+	room := make(map[string]int64)
+	blocks := slices.SortedFunc(slices.Values(backup.Blocks), func(a, b backupstore.Block) int {
+		return cmp.Compare(a.Offset, b.Offset)
+	})
+	for i, block := range blocks {
+		n := cmp.Or(backup.BlockSize, backupstore.MaxBlockSize)
+		if i+1 < len(blocks) {
+			n = min(n, blocks[i+1].Offset-block.Offset)
+		}
+		if volume.Size > 0 {
+			n = min(n, volume.Size-block.Offset)
+		}
+		if r, ok := room[block.Checksum]; !ok || n < r {
+			room[block.Checksum] = n
+		}
+		offsets[block.Checksum] = append(offsets[block.Checksum], block.Offset)
+	}
+	checksums := slices.Sorted(maps.Keys(offsets))
+	checked.Blocks = len(checksums)
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		done    int
+		sem     = make(chan struct{}, max(jobs, 1))
+		buffers = sync.Pool{New: func() any { return make([]byte, 256<<10) }}
+	)
+	status := newPassProgress(progress, "[verify-backup]", len(checksums), level)
+	for _, checksum := range checksums {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			buf := buffers.Get().([]byte)
+			defer buffers.Put(buf)
+			var n int64
+			kind := problemMissing
+			blockPath, _, err := backupstore.StatBlock(store, volume.BackupPath, checksum)
+			switch {
+			case err == nil:
+				n, err = backupstore.CopyBlockFile(io.Discard, store, blockPath, checksum, backup.Compression, backup.BlockSize, buf)
+				kind = blockProblemKind(err)
+			case !errors.Is(err, fs.ErrNotExist):
+				kind = problemUnreadable
+			}
+			if err == nil && (n == 0 || n > room[checksum]) {
+				kind = problemUndecompressable
+				err = fmt.Errorf("block %s decompresses to %d bytes, expected 1 to %d", checksum, n, room[checksum])
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			done++
+			checked.Bytes += n
+			if err != nil {
+				checked.Problems = append(checked.Problems, blockCheck{Kind: kind, Checksum: checksum, Offsets: offsets[checksum], Error: err.Error()})
+				switch kind {
+				case problemMissing:
+					checked.Missing++
+				case problemCorrupt:
+					checked.Corrupt++
+				case problemUndecompressable:
+					checked.Undecompressable++
+				default:
+					checked.Unreadable++
+				}
+			}
+			status.block(done, n, func() string {
+				return fmt.Sprintf("Block %s* {offset=%d}", shortChecksum(checksum), offsets[checksum][0])
+			})
+		}()
+	}
+	wg.Wait()
+	status.close()
+
+	slices.SortFunc(checked.Problems, func(a, b blockCheck) int {
+		return cmp.Compare(a.Offsets[0], b.Offsets[0])
+	})
+	return checked
+}
+
+// blockProblemKind sorts the error of decompressing a block file found in
+// the store into the kinds verify-backup counts
+func blockProblemKind(err error) string {
+	var mismatch *backupstore.ChecksumMismatchError
+	var blockErr *backupstore.BlockError
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &mismatch):
+		return problemCorrupt
+	case errors.As(err, &blockErr):
+		return problemUndecompressable
+	}
+	return problemUnreadable
+}
+
+// printBackupCheck writes c as JSON, or as a row of counts followed by
+// the blocks that failed
+func printBackupCheck(w io.Writer, c *backupCheck, format string) error {
+	if format == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(c)
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "BACKUP\tCREATED\tBLOCKS\tMISSING\tCORRUPT\tUNDECOMPRESSABLE\tUNREADABLE")
+	fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%d\t%d\n", c.Backup, c.Created.Format(time.RFC3339), c.Blocks, c.Missing, c.Corrupt, c.Undecompressable, c.Unreadable)
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	for _, problem := range c.Problems {
+		fmt.Fprintf(w, "%s block %s at offset %d: %s\n", problem.Kind, problem.Checksum, problem.Offsets[0], problem.Error)
+	}
+	if c.passed() {
+		fmt.Fprintf(w, "Backup %s of %s passed, %d blocks decompress to %s\n", c.Backup, c.Volume, c.Blocks, formatSize(c.Bytes))
+	} else {
+		fmt.Fprintf(w, "Backup %s of %s failed, %d of %d blocks did not pass\n", c.Backup, c.Volume, len(c.Problems), c.Blocks)
+	}
+	return nil
+}
+
+// verifyBackupCommand runs verify-backup for volume, over the newest of
+// backups, and returns the exit status
+func (in *invocation) verifyBackupCommand(volume *backupstore.VolumeBackup, backups []backupstore.Backup) int {
+	if len(backups) == 0 {
+		in.log.Error(fmt.Sprintf("%s has no backups to verify", volume.Name))
+		return exitVolumeNotFound
+	}
+	checked := verifyBackup(in.store, volume, backups[len(backups)-1], *in.o.jobs, in.progress, in.level)
+	in.written = checked.Bytes
+	if err := printBackupCheck(in.out, checked, *in.o.listFormat); err != nil {
+		in.log.Error(fmt.Sprintf("Failed to verify %s", volume.Name), "error", err)
+		return exitFailure
+	}
+	return checked.exitCode()
+}
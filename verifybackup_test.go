@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+)
+
+func TestVerifyBackup(t *testing.T) {
+	volumePath := t.TempDir()
+	blockPath := func(checksum string) string {
+		return filepath.Join(volumePath, "blocks", checksum[0:2], checksum[2:4], checksum+".blk")
+	}
+	good := writeTestBlock(t, volumePath, testBlockData(1, 4096))
+	corrupt := writeTestBlock(t, volumePath, testBlockData(2, 4096))
+	if err := os.WriteFile(blockPath(corrupt), compressTestLZ4(t, testBlockData(3, 4096)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	garbage := writeTestBlock(t, volumePath, testBlockData(4, 4096))
+	if err := os.WriteFile(blockPath(garbage), []byte("not lz4 at all"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// too large for the room before the next block
+	large := writeTestBlock(t, volumePath, testBlockData(5, 8192))
+	missing := strings.Repeat("0", 128)
+
+	backup := backupstore.Backup{Identifier: "backup-1", Compression: "lz4", Blocks: []backupstore.Block{
+		{Offset: 0, Checksum: good},
+		{Offset: 4096, Checksum: corrupt},
+		{Offset: 8192, Checksum: garbage},
+		{Offset: 12288, Checksum: large},
+		{Offset: 16384, Checksum: missing},
+		{Offset: 20480, Checksum: good},
+	}}
+	volume := &backupstore.VolumeBackup{Name: "pvc-1", BackupPath: ".", Size: 24576}
+	checked := verifyBackup(os.DirFS(volumePath), volume, backup, 2, io.Discard, verbosityQuiet)
+
+	if checked.Blocks != 5 || checked.Missing != 1 || checked.Corrupt != 1 || checked.Undecompressable != 2 || checked.Unreadable != 0 {
+		t.Errorf("Expected 5 blocks with 1 missing, 1 corrupt and 2 undecompressable, got %+v", checked)
+	}
+	var kinds []string
+	for _, problem := range checked.Problems {
+		kinds = append(kinds, problem.Kind)
+	}
+	if expected := "corrupt undecompressable undecompressable missing"; strings.Join(kinds, " ") != expected {
+		t.Errorf("Expected the problems in offset order, %s, got %v", expected, kinds)
+	}
+	if checked.exitCode() != exitBlockError {
+		t.Errorf("Expected exit status %d, got %d", exitBlockError, checked.exitCode())
+	}
+
+	var out bytes.Buffer
+	if err := printBackupCheck(&out, checked, "text"); err != nil {
+		t.Fatal(err)
+	}
+	if line := "Backup backup-1 of pvc-1 failed, 4 of 5 blocks did not pass"; !strings.Contains(out.String(), line) {
+		t.Errorf("Expected %q, got %q", line, out.String())
+	}
+
+	backup.Blocks = []backupstore.Block{{Offset: 0, Checksum: good}, {Offset: 4096, Checksum: good}}
+	if checked := verifyBackup(os.DirFS(volumePath), volume, backup, 1, io.Discard, verbosityQuiet); !checked.passed() || checked.Blocks != 1 || checked.Bytes != 4096 || checked.exitCode() != 0 {
+		t.Errorf("Expected the block shared by both offsets to pass once, got %+v", checked)
+	}
+}
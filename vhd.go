@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	vhdFooterSize = 512
+	// Azure only accepts fixed VHDs whose size is a whole number of MiB
+	vhdAlignment = 1024 * 1024
+	vhdDiskFixed = 2
+)
+
+var vhdEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type vhdFooter struct {
+	Cookie             [8]byte
+	Features           uint32
+	FileFormatVersion  uint32
+	DataOffset         uint64
+	Timestamp          uint32
+	CreatorApplication [4]byte
+	CreatorVersion     uint32
+	CreatorHostOS      [4]byte
+	OriginalSize       uint64
+	CurrentSize        uint64
+	Cylinders          uint16
+	Heads              uint8
+	SectorsPerTrack    uint8
+	DiskType           uint32
+	Checksum           uint32
+	UniqueID           [16]byte
+	SavedState         uint8
+	Reserved           [427]byte
+}
+
+// vhdGeometry implements the CHS calculation from the VHD specification
+func vhdGeometry(size int64) (cylinders uint16, heads uint8, sectorsPerTrack uint8) {
+	totalSectors := size / 512
+	if totalSectors > 65535*16*255 {
+		totalSectors = 65535 * 16 * 255
+	}
+
+	var spt, h, cylinderTimesHeads int64
+	if totalSectors >= 65535*16*63 {
+		spt = 255
+		h = 16
+		cylinderTimesHeads = totalSectors / spt
+	} else {
+		spt = 17
+		cylinderTimesHeads = totalSectors / spt
+		h = max((cylinderTimesHeads+1023)/1024, 4)
+		if cylinderTimesHeads >= h*1024 || h > 16 {
+			spt = 31
+			h = 16
+			cylinderTimesHeads = totalSectors / spt
+		}
+		if cylinderTimesHeads >= h*1024 {
+			spt = 63
+			h = 16
+			cylinderTimesHeads = totalSectors / spt
+		}
+	}
+	return uint16(cylinderTimesHeads / h), uint8(h), uint8(spt)
+}
+
+func vhdChecksum(footer []byte) uint32 {
+	var sum uint32
+	for i, b := range footer {
+		// the checksum field itself is skipped
+		if i >= 64 && i < 68 {
+			continue
+		}
+		sum += uint32(b)
+	}
+	return ^sum
+}
+
+func newVHDFooter(size int64, now time.Time) ([]byte, error) {
+	footer := vhdFooter{
+		Features:          2,
+		FileFormatVersion: 0x00010000,
+		DataOffset:        0xFFFFFFFFFFFFFFFF,
+		Timestamp:         uint32(now.Sub(vhdEpoch) / time.Second),
+		CreatorVersion:    0x00010000,
+		OriginalSize:      uint64(size),
+		CurrentSize:       uint64(size),
+		DiskType:          vhdDiskFixed,
+	}
+	copy(footer.Cookie[:], "conectix")
+	copy(footer.CreatorApplication[:], "lhbr")
+	copy(footer.CreatorHostOS[:], "Wi2k")
+	footer.Cylinders, footer.Heads, footer.SectorsPerTrack = vhdGeometry(size)
+	if _, err := rand.Read(footer.UniqueID[:]); err != nil {
+		return nil, err
+	}
+	// RFC 4122 version 4
+	footer.UniqueID[6] = footer.UniqueID[6]&0x0f | 0x40
+	footer.UniqueID[8] = footer.UniqueID[8]&0x3f | 0x80
+
+	buf := make([]byte, vhdFooterSize)
+	if _, err := binary.Encode(buf, binary.BigEndian, footer); err != nil {
+		return nil, fmt.Errorf("failed to encode vhd footer: %w", err)
+	}
+	binary.BigEndian.PutUint32(buf[64:], vhdChecksum(buf))
+	return buf, nil
+}
+
+// vhdWriter writes a fixed VHD: the raw disk followed by a 512 byte footer
+type vhdWriter struct {
+	*os.File
+	size int64
+}
+
+func createVHD(path string) (*vhdWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &vhdWriter{File: file, size: -1}, nil
+}
+
+func (v *vhdWriter) Truncate(size int64) error {
+	v.size = size
+	return nil
+}
+
+func (v *vhdWriter) Close() error {
+	if err := v.finish(); err != nil {
+		v.File.Close()
+		return err
+	}
+	return v.File.Close()
+}
+
+func (v *vhdWriter) finish() error {
+	size := v.size
+	if size < 0 {
+		stat, err := v.File.Stat()
+		if err != nil {
+			return err
+		}
+		size = stat.Size()
+	}
+	size = (size + vhdAlignment - 1) / vhdAlignment * vhdAlignment
+
+	footer, err := newVHDFooter(size, time.Now())
+	if err != nil {
+		return err
+	}
+	if err := v.File.Truncate(size); err != nil {
+		return err
+	}
+	_, err = v.File.WriteAt(footer, size)
+	return err
+}
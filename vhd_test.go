@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestVHDGeometry(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int64
+		cylinders uint16
+		heads     uint8
+		sectors   uint8
+	}{
+		{name: "1GiB", size: 1 << 30, cylinders: 2080, heads: 16, sectors: 63},
+		{name: "20MiB", size: 20 << 20, cylinders: 602, heads: 4, sectors: 17},
+		{name: "Maximum", size: 4 << 40, cylinders: 65535, heads: 16, sectors: 255},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cylinders, heads, sectors := vhdGeometry(tt.size)
+			if cylinders != tt.cylinders || heads != tt.heads || sectors != tt.sectors {
+				t.Errorf("Expected %d/%d/%d, got %d/%d/%d",
+					tt.cylinders, tt.heads, tt.sectors, cylinders, heads, sectors)
+			}
+		})
+	}
+}
+
+func TestNewVHDFooter(t *testing.T) {
+	footer, err := newVHDFooter(1<<30, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(footer) != vhdFooterSize {
+		t.Fatalf("Expected %d byte footer, got %d", vhdFooterSize, len(footer))
+	}
+	if string(footer[0:8]) != "conectix" {
+		t.Errorf("Expected conectix cookie, got %q", footer[0:8])
+	}
+	if binary.BigEndian.Uint64(footer[48:]) != 1<<30 {
+		t.Errorf("Expected current size %d, got %d", 1<<30, binary.BigEndian.Uint64(footer[48:]))
+	}
+	if binary.BigEndian.Uint16(footer[56:]) != 2080 || footer[58] != 16 || footer[59] != 63 {
+		t.Errorf("Unexpected geometry %d/%d/%d", binary.BigEndian.Uint16(footer[56:]), footer[58], footer[59])
+	}
+	if binary.BigEndian.Uint32(footer[60:]) != vhdDiskFixed {
+		t.Errorf("Expected fixed disk type, got %d", binary.BigEndian.Uint32(footer[60:]))
+	}
+	if binary.BigEndian.Uint32(footer[64:]) != vhdChecksum(footer) {
+		t.Error("Footer checksum does not validate")
+	}
+	if bytes.Equal(footer[68:84], make([]byte, 16)) {
+		t.Error("Expected a unique ID")
+	}
+}
+
+func TestVHDWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.vhd")
+	writer, err := createVHD(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := testBlockData(1, 4096)
+	if _, err := writer.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	// not a whole MiB, so the image must be padded
+	if err := writer.Truncate(3*vhdAlignment + 4096); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedSize := 4*vhdAlignment + vhdFooterSize
+	if len(content) != expectedSize {
+		t.Fatalf("Expected %d bytes, got %d", expectedSize, len(content))
+	}
+	if !bytes.Equal(content[:4096], data) {
+		t.Error("Disk content does not match written data")
+	}
+	footer := content[4*vhdAlignment:]
+	if binary.BigEndian.Uint64(footer[48:]) != 4*vhdAlignment {
+		t.Errorf("Expected current size %d, got %d", 4*vhdAlignment, binary.BigEndian.Uint64(footer[48:]))
+	}
+	if binary.BigEndian.Uint32(footer[64:]) != vhdChecksum(footer) {
+		t.Error("Footer checksum does not validate")
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	vmdkMagic          = 0x564d444b
+	vmdkSectorSize     = 512
+	vmdkGrainSectors   = 128
+	vmdkGrainSize      = vmdkGrainSectors * vmdkSectorSize
+	vmdkGTEsPerGT      = 512
+	vmdkDescriptorSize = 20
+	// header and embedded descriptor fit in the first grain
+	vmdkOverhead = vmdkGrainSectors
+)
+
+type vmdkHeader struct {
+	MagicNumber        uint32
+	Version            uint32
+	Flags              uint32
+	Capacity           uint64
+	GrainSize          uint64
+	DescriptorOffset   uint64
+	DescriptorSize     uint64
+	NumGTEsPerGT       uint32
+	RgdOffset          uint64
+	GdOffset           uint64
+	OverHead           uint64
+	UncleanShutdown    uint8
+	SingleEndLineChar  uint8
+	NonEndLineChar     uint8
+	DoubleEndLineChar1 uint8
+	DoubleEndLineChar2 uint8
+	CompressAlgorithm  uint16
+	Pad                [433]uint8
+}
+
+// vmdkWriter writes a monolithicSparse VMDK. Grains are allocated as blocks
+// are applied and the grain directory and tables are written after the last
+// grain once the capacity is known.
+type vmdkWriter struct {
+	*sparseImage
+	name string
+}
+
+func createVMDK(path string) (*vmdkWriter, error) {
+	image, err := newSparseImage(path, vmdkGrainSize, vmdkOverhead*vmdkSectorSize)
+	if err != nil {
+		return nil, err
+	}
+	return &vmdkWriter{sparseImage: image, name: filepath.Base(path)}, nil
+}
+
+func (v *vmdkWriter) Close() error {
+	return v.closeWith(v.finish)
+}
+
+func vmdkDescriptor(name string, capacitySectors int64) (string, error) {
+	cid := make([]byte, 4)
+	if _, err := rand.Read(cid); err != nil {
+		return "", err
+	}
+	cylinders := min(capacitySectors/(16*63), 16383)
+
+	var b strings.Builder
+	b.WriteString("# Disk DescriptorFile\n")
+	b.WriteString("version=1\n")
+	fmt.Fprintf(&b, "CID=%08x\n", binary.BigEndian.Uint32(cid))
+	b.WriteString("parentCID=ffffffff\n")
+	b.WriteString("createType=\"monolithicSparse\"\n")
+	b.WriteString("\n# Extent description\n")
+	fmt.Fprintf(&b, "RW %d SPARSE \"%s\"\n", capacitySectors, name)
+	b.WriteString("\n# The Disk Data Base\n#DDB\n\n")
+	b.WriteString("ddb.virtualHWVersion = \"4\"\n")
+	fmt.Fprintf(&b, "ddb.geometry.cylinders = \"%d\"\n", cylinders)
+	b.WriteString("ddb.geometry.heads = \"16\"\n")
+	b.WriteString("ddb.geometry.sectors = \"63\"\n")
+	b.WriteString("ddb.adapterType = \"ide\"\n")
+
+	if b.Len() > vmdkDescriptorSize*vmdkSectorSize {
+		return "", fmt.Errorf("vmdk descriptor too large (%d bytes)", b.Len())
+	}
+	return b.String(), nil
+}
+
+func newVMDKHeader(capacitySectors int64, gdOffset int64) vmdkHeader {
+	return vmdkHeader{
+		MagicNumber: vmdkMagic,
+		Version:     1,
+		// valid newline detection test
+		Flags:              1,
+		Capacity:           uint64(capacitySectors),
+		GrainSize:          vmdkGrainSectors,
+		DescriptorOffset:   1,
+		DescriptorSize:     vmdkDescriptorSize,
+		NumGTEsPerGT:       vmdkGTEsPerGT,
+		GdOffset:           uint64(gdOffset),
+		OverHead:           vmdkOverhead,
+		SingleEndLineChar:  '\n',
+		NonEndLineChar:     ' ',
+		DoubleEndLineChar1: '\r',
+		DoubleEndLineChar2: '\n',
+	}
+}
+
+func (v *vmdkWriter) finish() error {
+	size, _ := v.finalSize()
+	capacity := size / vmdkSectorSize
+	grains := (size + vmdkGrainSize - 1) / vmdkGrainSize
+	tables := (grains + vmdkGTEsPerGT - 1) / vmdkGTEsPerGT
+
+	grainTables := make([]byte, tables*vmdkGTEsPerGT*4)
+	for guest, host := range v.clusters {
+		binary.LittleEndian.PutUint32(grainTables[guest*4:], uint32(host/vmdkSectorSize))
+	}
+
+	// grain tables follow the grain directory, both after the last grain
+	gdSectors := (tables*4 + vmdkSectorSize - 1) / vmdkSectorSize
+	gdOffset := v.next
+	gtOffset := gdOffset + gdSectors*vmdkSectorSize
+	directory := make([]byte, gdSectors*vmdkSectorSize)
+	for i := int64(0); i < tables; i++ {
+		sector := (gtOffset + i*vmdkGTEsPerGT*4) / vmdkSectorSize
+		binary.LittleEndian.PutUint32(directory[i*4:], uint32(sector))
+	}
+	if _, err := v.file.WriteAt(directory, gdOffset); err != nil {
+		return err
+	}
+	if _, err := v.file.WriteAt(grainTables, gtOffset); err != nil {
+		return err
+	}
+
+	descriptor, err := vmdkDescriptor(v.name, capacity)
+	if err != nil {
+		return err
+	}
+	meta := make([]byte, vmdkOverhead*vmdkSectorSize)
+	if _, err := binary.Encode(meta, binary.LittleEndian, newVMDKHeader(capacity, gdOffset/vmdkSectorSize)); err != nil {
+		return fmt.Errorf("failed to encode vmdk header: %w", err)
+	}
+	copy(meta[vmdkSectorSize:], descriptor)
+	_, err = v.file.WriteAt(meta, 0)
+	return err
+}
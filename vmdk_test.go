@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+)
+
+func TestVMDKDescriptor(t *testing.T) {
+	descriptor, err := vmdkDescriptor("disk.vmdk", 2097152)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"# Disk DescriptorFile",
+		"createType=\"monolithicSparse\"",
+		"RW 2097152 SPARSE \"disk.vmdk\"",
+		"ddb.geometry.cylinders = \"2080\"",
+	} {
+		if !strings.Contains(descriptor, expected) {
+			t.Errorf("Expected descriptor to contain %q", expected)
+		}
+	}
+}
+
+func TestVMDKWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.vmdk")
+	writer, err := createVMDK(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size := int64(64 * 1024 * 1024)
+	first := testBlockData(1, 2*1024*1024)
+	second := testBlockData(2, 2*1024*1024)
+	if _, err := writer.WriteAt(first, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.WriteAt(second, 40*1024*1024); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.WriteAt(make([]byte, 2*1024*1024), 20*1024*1024); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var header vmdkHeader
+	if err := binary.Read(io.NewSectionReader(file, 0, vmdkSectorSize), binary.LittleEndian, &header); err != nil {
+		t.Fatal(err)
+	}
+	if header.MagicNumber != vmdkMagic {
+		t.Errorf("Expected magic %x, got %x", vmdkMagic, header.MagicNumber)
+	}
+	if header.Capacity != uint64(size/vmdkSectorSize) {
+		t.Errorf("Expected capacity %d, got %d", size/vmdkSectorSize, header.Capacity)
+	}
+	if header.GrainSize != vmdkGrainSectors || header.NumGTEsPerGT != vmdkGTEsPerGT {
+		t.Errorf("Unexpected grain layout %d/%d", header.GrainSize, header.NumGTEsPerGT)
+	}
+	if header.DoubleEndLineChar1 != '\r' || header.DoubleEndLineChar2 != '\n' {
+		t.Error("Newline detection characters are wrong")
+	}
+
+	descriptor := make([]byte, vmdkDescriptorSize*vmdkSectorSize)
+	if _, err := file.ReadAt(descriptor, int64(header.DescriptorOffset)*vmdkSectorSize); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(descriptor, []byte("RW 131072 SPARSE \"out.vmdk\"")) {
+		t.Error("Descriptor does not describe the extent")
+	}
+
+	readGrain := func(offset int64) []byte {
+		grain := offset / vmdkGrainSize
+		entry := make([]byte, 4)
+		if _, err := file.ReadAt(entry, int64(header.GdOffset)*vmdkSectorSize+grain/vmdkGTEsPerGT*4); err != nil {
+			t.Fatal(err)
+		}
+		gtSector := int64(binary.LittleEndian.Uint32(entry))
+		if _, err := file.ReadAt(entry, gtSector*vmdkSectorSize+grain%vmdkGTEsPerGT*4); err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, vmdkGrainSize)
+		if sector := int64(binary.LittleEndian.Uint32(entry)); sector != 0 {
+			if _, err := file.ReadAt(data, sector*vmdkSectorSize); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return data
+	}
+
+	if !bytes.Equal(readGrain(0), first[:vmdkGrainSize]) {
+		t.Error("First grain does not match written data")
+	}
+	if !bytes.Equal(readGrain(40*1024*1024+vmdkGrainSize), second[vmdkGrainSize:2*vmdkGrainSize]) {
+		t.Error("Grain in second block does not match written data")
+	}
+	if !backupstore.IsZeroBlock(readGrain(20 * 1024 * 1024)) {
+		t.Error("Expected zero region to read as zeroes")
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Size() > 5*1024*1024 {
+		t.Errorf("Expected a compact image, got %d bytes", stat.Size())
+	}
+
+	if qemuImg, err := exec.LookPath("qemu-img"); err == nil {
+		if out, err := exec.Command(qemuImg, "info", path).CombinedOutput(); err != nil {
+			t.Errorf("qemu-img info failed: %v: %s", err, out)
+		}
+	}
+}
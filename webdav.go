@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const webdavAttempts = 4
+
+const webdavPropfind = `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:"><D:prop><D:resourcetype/><D:getcontentlength/><D:getlastmodified/></D:prop></D:propfind>`
+
+// webdavStore reads a backupstore published over WebDAV, listing
+// collections with PROPFIND and fetching cfg and block files with GET
+type webdavStore struct {
+	retryCounter
+	ctx     context.Context
+	client  *http.Client
+	base    *url.URL
+	auth    func(req *http.Request)
+	backoff time.Duration
+}
+
+type webdavStatusError struct {
+	Code   int
+	Status string
+}
+
+func (e *webdavStatusError) Error() string {
+	return "webdav: " + e.Status
+}
+
+func (e *webdavStatusError) Is(target error) bool {
+	switch e.Code {
+	case http.StatusNotFound:
+		return target == fs.ErrNotExist
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return target == fs.ErrPermission
+	}
+	return false
+}
+
+type webdavMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"href"`
+		Propstat []struct {
+			Status string `xml:"status"`
+			Prop   struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"collection"`
+				} `xml:"resourcetype"`
+				ContentLength string `xml:"getcontentlength"`
+				LastModified  string `xml:"getlastmodified"`
+			} `xml:"prop"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+// parseWebDAVURL maps webdav:// to http and webdavs:// to https. The
+// backupstore is the backupstore collection under the URL's path.
+func parseWebDAVURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "webdav":
+		u.Scheme = "http"
+	case "webdavs":
+		u.Scheme = "https"
+	default:
+		return nil, fmt.Errorf("not a webdav url: %s", raw)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing host in %s", raw)
+	}
+	u.Path = path.Join("/", u.Path, "backupstore") + "/"
+	u.RawPath = ""
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u, nil
+}
+
+func newWebDAVStore(ctx context.Context, backupRoot string, opts storeOptions) (*webdavStore, error) {
+	base, err := parseWebDAVURL(backupRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &webdavStore{
+		ctx:     ctx,
+		client:  http.DefaultClient,
+		base:    base,
+		auth:    func(req *http.Request) {},
+		backoff: 500 * time.Millisecond,
+	}
+	username, password := opts.WebDAVUser, opts.WebDAVPassword
+	if base.User != nil {
+		username = base.User.Username()
+		if p, ok := base.User.Password(); ok {
+			password = p
+		}
+		base.User = nil
+	}
+	switch {
+	case opts.WebDAVToken != "" && username != "":
+		return nil, errors.New("use either a WebDAV user or a bearer token, not both")
+	case opts.WebDAVToken != "":
+		store.auth = func(req *http.Request) {
+			req.Header.Set("Authorization", "Bearer "+opts.WebDAVToken)
+		}
+	case username != "":
+		store.auth = func(req *http.Request) {
+			req.SetBasicAuth(username, password)
+		}
+	}
+	return store, nil
+}
+
+func (s *webdavStore) String() string {
+	return strings.TrimSuffix(s.base.String(), "/")
+}
+
+// Remote implements backupstore.RemoteFS, so missing blocks aren't
+// searched for
+func (s *webdavStore) Remote() bool { return true }
+
+// webdavTransient reports server errors and network failures
+func webdavTransient(err error) bool {
+	var status *webdavStatusError
+	if errors.As(err, &status) {
+		return status.Code >= 500
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+func (s *webdavStore) url(name string, dir bool) string {
+	u := *s.base
+	if name != "." {
+		u.Path += name
+		if dir {
+			u.Path += "/"
+		}
+	}
+	return u.String()
+}
+
+// do sends a request, retrying server errors, and returns the body of a
+// response with the expected status
+func (s *webdavStore) do(method, rawURL string, header http.Header, body []byte, expected int) ([]byte, error) {
+	var data []byte
+	err := s.retryBackoff(s.ctx, webdavAttempts, s.backoff, func() error {
+		req, err := http.NewRequestWithContext(s.ctx, method, rawURL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		s.auth(req)
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != expected {
+			return &webdavStatusError{Code: resp.StatusCode, Status: resp.Status}
+		}
+		data, err = io.ReadAll(resp.Body)
+		return err
+	}, webdavTransient)
+	return data, err
+}
+
+// propfind lists name, and with depth 1 its children, keyed by the path
+// relative to the backupstore
+func (s *webdavStore) propfind(name string, depth string) (map[string]remoteFileInfo, error) {
+	// files have no trailing slash, and Depth 0 is only used by Stat where
+	// the kind isn't known yet
+	rawURL := s.url(name, depth != "0")
+	header := http.Header{
+		"Depth":        {depth},
+		"Content-Type": {`application/xml; charset="utf-8"`},
+	}
+	data, err := s.do("PROPFIND", rawURL, header, []byte(webdavPropfind), http.StatusMultiStatus)
+	if err != nil {
+		return nil, err
+	}
+	var multistatus webdavMultistatus
+	if err := xml.Unmarshal(data, &multistatus); err != nil {
+		return nil, fmt.Errorf("failed to parse PROPFIND response: %w", err)
+	}
+
+	infos := make(map[string]remoteFileInfo, len(multistatus.Responses))
+	for _, response := range multistatus.Responses {
+		// hrefs may be absolute URLs or absolute paths
+		href, err := url.Parse(response.Href)
+		if err != nil {
+			return nil, fmt.Errorf("invalid href %s: %w", response.Href, err)
+		}
+		rel, ok := strings.CutPrefix(strings.TrimSuffix(href.Path, "/")+"/", s.base.Path)
+		if !ok {
+			continue
+		}
+		rel = strings.TrimSuffix(rel, "/")
+		if rel == "" {
+			rel = "."
+		}
+
+		info := remoteFileInfo{name: path.Base(rel)}
+		for _, propstat := range response.Propstat {
+			if !strings.Contains(propstat.Status, " 200 ") {
+				continue
+			}
+			prop := propstat.Prop
+			info.dir = info.dir || prop.ResourceType.Collection != nil
+			if prop.ContentLength != "" {
+				info.size, _ = strconv.ParseInt(prop.ContentLength, 10, 64)
+			}
+			if modTime, err := http.ParseTime(prop.LastModified); err == nil {
+				info.modTime = modTime
+			}
+		}
+		infos[rel] = info
+	}
+	return infos, nil
+}
+
+func (s *webdavStore) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	infos, err := s.propfind(name, "0")
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	info, ok := infos[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return info, nil
+}
+
+func (s *webdavStore) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	infos, err := s.propfind(name, "1")
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+
+	entries := make([]fs.DirEntry, 0, len(infos))
+	for rel, info := range infos {
+		if rel == name {
+			continue
+		}
+		entries = append(entries, fs.FileInfoToDirEntry(info))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// Glob matches pattern by listing the tree one level per pattern segment,
+// following only the collections that match, instead of the Stat and
+// ReadDir round trips fs.Glob would make for every candidate
+func (s *webdavStore) Glob(pattern string) ([]string, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	segments := strings.Split(pattern, "/")
+	matches := make([]string, 0)
+	var walk func(dir string, depth int) error
+	walk = func(dir string, depth int) error {
+		entries, err := s.ReadDir(dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if ok, _ := path.Match(segments[depth], entry.Name()); !ok {
+				continue
+			}
+			name := path.Join(dir, entry.Name())
+			if depth == len(segments)-1 {
+				matches = append(matches, name)
+			} else if entry.IsDir() {
+				if err := walk(name, depth+1); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	// the literal leading segments need no listing of their own
+	start := 0
+	for start < len(segments)-1 && !strings.ContainsAny(segments[start], `*?[\`) {
+		start++
+	}
+	dir := "."
+	if start > 0 {
+		dir = path.Join(segments[:start]...)
+	}
+	if err := walk(dir, start); err != nil {
+		return nil, err
+	}
+	return matches, nil
+}
+
+func (s *webdavStore) ReadFile(name string) ([]byte, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrInvalid}
+	}
+	data, err := s.do(http.MethodGet, s.url(name, false), nil, nil, http.StatusOK)
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	return data, nil
+}
+
+func (s *webdavStore) Open(name string) (fs.File, error) {
+	return openRemote(s, name)
+}
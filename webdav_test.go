@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/thearyadev/longhorn-backup-repacker/pkg/backupstore"
+	"golang.org/x/net/webdav"
+)
+
+// fakeWebDAV wraps the x/net WebDAV handler with authentication, injected
+// server errors and request counting
+type fakeWebDAV struct {
+	handler  http.Handler
+	user     string
+	password string
+	token    string
+
+	mu        sync.Mutex
+	failures  map[string]int
+	requests  map[string]int
+	propfinds int
+}
+
+func startFakeWebDAV(t *testing.T, root string) (*fakeWebDAV, string) {
+	t.Helper()
+	server := &fakeWebDAV{
+		handler: &webdav.Handler{
+			Prefix:     "/dav",
+			FileSystem: webdav.Dir(root),
+			LockSystem: webdav.NewMemLS(),
+		},
+		failures: make(map[string]int),
+		requests: make(map[string]int),
+	}
+	ts := httptest.NewServer(server)
+	t.Cleanup(ts.Close)
+	return server, strings.Replace(ts.URL, "http://", "webdav://", 1) + "/dav"
+}
+
+func (f *fakeWebDAV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, password, basic := r.BasicAuth()
+	switch {
+	case f.token != "" && r.Header.Get("Authorization") != "Bearer "+f.token:
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	case f.user != "" && (!basic || user != f.user || password != f.password):
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	f.mu.Lock()
+	f.requests[r.URL.Path]++
+	if r.Method == "PROPFIND" {
+		f.propfinds++
+	}
+	if f.failures[r.URL.Path] > 0 {
+		f.failures[r.URL.Path]--
+		f.mu.Unlock()
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+		return
+	}
+	f.mu.Unlock()
+	f.handler.ServeHTTP(w, r)
+}
+
+func TestParseWebDAVURL(t *testing.T) {
+	tests := []struct {
+		url           string
+		expected      string
+		expectedError bool
+	}{
+		{url: "webdav://nas/longhorn", expected: "http://nas/longhorn/backupstore/"},
+		{url: "webdavs://nas:8443/longhorn/", expected: "https://nas:8443/longhorn/backupstore/"},
+		{url: "webdav://nas", expected: "http://nas/backupstore/"},
+		{url: "webdav:///longhorn", expectedError: true},
+		{url: "http://nas/longhorn", expectedError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			u, err := parseWebDAVURL(tt.url)
+			if tt.expectedError {
+				if err == nil {
+					t.Error("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if u.String() != tt.expected {
+				t.Errorf("Expected %s, got %s", tt.expected, u)
+			}
+		})
+	}
+}
+
+func TestWebDAVStoreRestore(t *testing.T) {
+	root := t.TempDir()
+	volumePath := filepath.Join(root, "backupstore", "volumes", "5f", "a2", "pvc-123")
+	if err := os.MkdirAll(filepath.Join(volumePath, "backups"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	blockSize := 4096
+	first := writeTestBlock(t, volumePath, testBlockData(1, blockSize))
+	second := writeTestBlock(t, volumePath, testBlockData(2, blockSize))
+	cfg := `{"CreatedTime": "2024-01-01T00:00:00Z", "Size": "8192", "CompressionMethod": "lz4", "BlockSize": "4096",
+		"Blocks": [{"Offset": 0, "BlockChecksum": "` + first + `"}, {"Offset": 4096, "BlockChecksum": "` + second + `"}]}`
+	if err := os.WriteFile(filepath.Join(volumePath, "backups", "backup_backup-1.cfg"), []byte(cfg), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// a second volume that the lookup of pvc-123 must not descend into
+	for _, dir := range []string{"blocks", "backups"} {
+		if err := os.MkdirAll(filepath.Join(root, "backupstore", "volumes", "01", "02", "pvc-456", dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	server, backupRoot := startFakeWebDAV(t, root)
+	server.user, server.password = "longhorn", "secret"
+	store, backupStorePath, err := openBackupStore(context.Background(), backupRoot, storeOptions{
+		WebDAVUser:     "longhorn",
+		WebDAVPassword: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(backupStorePath, "/dav/backupstore") {
+		t.Errorf("Unexpected backupstore path %s", backupStorePath)
+	}
+
+	volumes, err := backupstore.ListVolumes(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(volumes) != 2 || volumes[1] != "volumes/5f/a2/pvc-123" {
+		t.Errorf("Expected the pvc-456 and pvc-123 volumes, got %v", volumes)
+	}
+
+	server.propfinds = 0
+	volumeBackupPath, err := backupstore.FindVolumeBackupPath(store, "pvc-123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// volumes, 01, 01/02, pvc-456 to see that it is a volume, 5f and 5f/a2
+	if server.propfinds != 6 {
+		t.Errorf("Expected 6 listings to find the volume, got %d", server.propfinds)
+	}
+	volumeBackup, err := backupstore.ReadBackups(store, volumeBackupPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(volumeBackup.Backups) != 1 {
+		t.Fatalf("Expected 1 backup, got %d", len(volumeBackup.Backups))
+	}
+
+	out, err := os.Create(filepath.Join(t.TempDir(), "out.raw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	err = backupstore.Repack(context.Background(), store, volumeBackup.BackupPath, volumeBackup.Backups, out, backupstore.RepackOptions{Jobs: 2})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	content, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, append(testBlockData(1, blockSize), testBlockData(2, blockSize)...)) {
+		t.Error("Restored image does not match expected content")
+	}
+}
+
+func TestWebDAVStoreAuth(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "backupstore"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "backupstore", "volume.cfg"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	server, backupRoot := startFakeWebDAV(t, root)
+	server.token = "s3cr3t"
+
+	tests := []struct {
+		name          string
+		opts          storeOptions
+		expectedError bool
+	}{
+		{name: "bearer", opts: storeOptions{WebDAVToken: "s3cr3t"}},
+		{name: "wrong token", opts: storeOptions{WebDAVToken: "guess"}, expectedError: true},
+		{name: "anonymous", opts: storeOptions{}, expectedError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, err := newWebDAVStore(context.Background(), backupRoot, tt.opts)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			data, err := store.ReadFile("volume.cfg")
+			if tt.expectedError {
+				if !errors.Is(err, os.ErrPermission) {
+					t.Errorf("Expected permission error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if string(data) != "data" {
+				t.Errorf("Expected data, got %s", data)
+			}
+		})
+	}
+
+	_, err := newWebDAVStore(context.Background(), backupRoot, storeOptions{WebDAVUser: "longhorn", WebDAVToken: "s3cr3t"})
+	if err == nil {
+		t.Error("Expected error for both basic and bearer auth")
+	}
+}
+
+func TestWebDAVStoreRetries(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "backupstore"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"flaky.cfg", "broken.cfg"} {
+		if err := os.WriteFile(filepath.Join(root, "backupstore", name), []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server, backupRoot := startFakeWebDAV(t, root)
+	server.failures["/dav/backupstore/flaky.cfg"] = webdavAttempts - 1
+	server.failures["/dav/backupstore/broken.cfg"] = webdavAttempts
+	store, err := newWebDAVStore(context.Background(), backupRoot, storeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.backoff = 0
+
+	data, err := store.ReadFile("flaky.cfg")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if string(data) != "data" {
+		t.Errorf("Expected data, got %s", data)
+	}
+	if server.requests["/dav/backupstore/flaky.cfg"] != webdavAttempts {
+		t.Errorf("Expected %d attempts, got %d", webdavAttempts, server.requests["/dav/backupstore/flaky.cfg"])
+	}
+
+	if _, err := store.ReadFile("broken.cfg"); err == nil {
+		t.Error("Expected error after exhausting retries")
+	}
+
+	_, err = store.ReadFile("missing.cfg")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected not exist error, got %v", err)
+	}
+	if server.requests["/dav/backupstore/missing.cfg"] != 1 {
+		t.Errorf("Expected missing files not to be retried, got %d attempts", server.requests["/dav/backupstore/missing.cfg"])
+	}
+}